@@ -0,0 +1,165 @@
+package analysis
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// albLogInterval is how often an Application Load Balancer delivers an access log
+// file; a file holds the requests of the interval ending at the time in its name
+const albLogInterval = 5 * time.Minute
+
+// ALB access log fields used to correlate a line with a WAF record
+// (https://docs.aws.amazon.com/elasticloadbalancing/latest/application/load-balancer-access-logs.html)
+const (
+	albFieldTime            = 1
+	albFieldELB             = 2 // app/<name>/<id>
+	albFieldClient          = 3
+	albFieldTarget          = 4 // "-" if the load balancer answered itself
+	albFieldRequest         = 12
+	albFieldRequestCreation = 21
+)
+
+// FindALBLines returns the Application Load Balancer access log lines below dir for
+// the request of a WAF record: the same client IP, method and URI, created within
+// slack of the record's timestamp. Files whose name shows they cover another time
+// are not read.
+func FindALBLines(dir string, r *Record, slack time.Duration) ([]string, error) {
+	at := r.Time()
+	var lines []string
+	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		name := strings.TrimSuffix(info.Name(), ".gz")
+		if info.IsDir() || filepath.Ext(name) != ".log" {
+			return nil
+		}
+		if end, ok := albFileEnd(name); ok && (end.Before(at.Add(-slack)) || end.Add(-albLogInterval).After(at.Add(slack))) {
+			return nil
+		}
+		found, err := scanALBFile(path, r, slack)
+		if err != nil {
+			return err
+		}
+		lines = append(lines, found...)
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to search ALB access logs: %w", err)
+	}
+	return lines, nil
+}
+
+// albFileEnd returns the end of the interval an ALB access log file covers, from a
+// name like <account>_elasticloadbalancing_<region>_<lb>_<YYYYMMDDTHHmmZ>_<ip>_<id>.log
+func albFileEnd(name string) (time.Time, bool) {
+	parts := strings.Split(name, "_")
+	if len(parts) < 7 || parts[1] != "elasticloadbalancing" {
+		return time.Time{}, false
+	}
+	end, err := time.Parse("20060102T1504Z", parts[4])
+	return end, err == nil
+}
+
+// scanALBFile returns the lines of an ALB access log file that match a WAF record
+func scanALBFile(path string, r *Record, slack time.Duration) ([]string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var reader io.Reader = file
+	if filepath.Ext(path) == ".gz" {
+		gr, err := newGzipReader(file)
+		if err != nil {
+			return nil, fmt.Errorf("file %s has a .gz extension but is not a valid gzip file: %w", path, err)
+		}
+		defer gr.Close()
+		reader = gr
+	}
+
+	var lines []string
+	scanner := bufio.NewScanner(reader)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		line := scanner.Text()
+		// Cheap check before splitting the line
+		if !strings.Contains(line, r.HTTPRequest.ClientIP) {
+			continue
+		}
+		if matchesALBLine(splitALBLine(line), r, slack) {
+			lines = append(lines, line)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read %s: %w", path, err)
+	}
+	return lines, nil
+}
+
+// matchesALBLine reports whether the fields of an ALB access log line describe the
+// request of a WAF record
+func matchesALBLine(fields []string, r *Record, slack time.Duration) bool {
+	if len(fields) <= albFieldRequestCreation {
+		return false
+	}
+	client, _, err := net.SplitHostPort(fields[albFieldClient])
+	if err != nil || client != r.HTTPRequest.ClientIP {
+		return false
+	}
+	created, err := time.Parse(time.RFC3339Nano, fields[albFieldRequestCreation])
+	if err != nil || created.Sub(r.Time()).Abs() > slack {
+		return false
+	}
+	// "GET https://example.com:443/path?query HTTP/1.1"
+	method, rest, _ := strings.Cut(fields[albFieldRequest], " ")
+	url, _, _ := strings.Cut(rest, " ")
+	if _, afterScheme, ok := strings.Cut(url, "://"); ok {
+		url = afterScheme
+		if i := strings.Index(url, "/"); i >= 0 {
+			url = url[i:]
+		}
+	}
+	path, _, _ := strings.Cut(url, "?")
+	return strings.EqualFold(method, r.HTTPRequest.HTTPMethod) && path == r.HTTPRequest.URI
+}
+
+// splitALBLine splits an ALB access log line into its space-separated fields,
+// keeping quoted fields together and unquoting them
+func splitALBLine(line string) []string {
+	var fields []string
+	var field strings.Builder
+	quoted, escaped, inField := false, false, false
+	for _, c := range line {
+		switch {
+		case escaped:
+			field.WriteRune(c)
+			escaped = false
+		case quoted && c == '\\':
+			escaped = true
+		case c == '"':
+			quoted, inField = !quoted, true
+		case c == ' ' && !quoted:
+			if inField {
+				fields = append(fields, field.String())
+				field.Reset()
+				inField = false
+			}
+		default:
+			field.WriteRune(c)
+			inField = true
+		}
+	}
+	if inField {
+		fields = append(fields, field.String())
+	}
+	return fields
+}
@@ -0,0 +1,206 @@
+package analysis
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strings"
+	"time"
+
+	"waf-log-retriever/logging"
+	"waf-log-retriever/storage"
+)
+
+// OutputDirName is the directory, inside a Web ACL's log directory, where analysis results are written
+const OutputDirName = "analysis"
+
+// SnapshotDirName is the directory, inside a Web ACL's log directory, holding Web ACL snapshots
+const SnapshotDirName = "snapshots"
+
+// Result is the output of a single analysis run
+type Result struct {
+	GeneratedAt         time.Time             `json:"generatedAt"`
+	ProfileName         string                `json:"profileName"`
+	WebACLName          string                `json:"webACLName"`
+	Account             string                `json:"account,omitempty"` // Account the records came from with its name, if only one, see ResultAccount
+	InputFiles          int                   `json:"inputFiles"`
+	ClientIdentity      string                `json:"clientIdentity"` // What clients are counted by, see ClientIdentitySettings
+	Stats               *Stats                `json:"stats"`
+	Coverage            map[string]int        `json:"coverage,omitempty"`          // Associated resources by type
+	CoverageUnknown     string                `json:"coverageUnknown,omitempty"`   // Why Coverage is unknown, e.g. the associated resources could not be listed
+	OriginExposure      []OriginExposure      `json:"originExposure,omitempty"`    // Reachability of CloudFront origins without CloudFront
+	OperationalImpact   *OperationalImpact    `json:"operationalImpact,omitempty"` // WAF-added latency, if logged
+	BodyInspection      *BodyInspectionReport `json:"bodyInspection,omitempty"`    // Bodies beyond the inspection limit, if logged
+	HostHeaders         *HostHeaderReport     `json:"hostHeaders,omitempty"`       // Host header anomalies and requests to unexpected hosts
+	OriginBypass        *FlowLogReport        `json:"originBypass,omitempty"`      // Flows to the origin that bypassed CloudFront, if flow logs are given
+	Infrastructure      *InfrastructureReport `json:"infrastructure,omitempty"`    // Attacker IPs by hosting provider and domain, if DNS lookups are enabled
+	AttackLandscape     []LandscapeEntry      `json:"attackLandscape"`             // Observed attacks by OWASP Top 10 category
+	Origins             []OriginReport        `json:"origins,omitempty"`           // Where requests and attacks came from, by country
+	Scanners            []ScannerActivity     `json:"scanners"`                    // Scanners and attack tools seen in the logs
+	TLSFingerprints     []FingerprintCluster  `json:"tlsFingerprints"`             // JA3/JA4 fingerprints shared by many IPs or mostly malicious
+	ChallengeCandidates []ChallengeCandidate  `json:"challengeCandidates"`         // Gray-area automation better met with CAPTCHA or Challenge
+	AuthAbuse           *AuthAbuse            `json:"authAbuse"`                   // Credential stuffing and brute-force evidence
+	APIAbuse            *APIAbuse             `json:"apiAbuse"`                    // Enumeration, path probing and velocity evidence
+	Sessions            *SessionReport        `json:"sessions"`                    // Client sessions, with the automated and abusive ones
+	EndpointClasses     []ClassSummary        `json:"endpointClasses,omitempty"`   // Breakdown by configured endpoint class
+	Assets              []AssetReport         `json:"assets,omitempty"`            // Breakdown by asset, if an asset map is given
+	Hosts               []HostReport          `json:"hosts"`                       // Breakdown by Host header
+	Sources             []SourceReport        `json:"sources,omitempty"`           // Breakdown by source, if the records came from more than one
+	TimeProfile         *TimeProfile          `json:"timeProfile"`                 // Weekday/weekend and business hours profile
+	AuthorizedTesting   *TestingReport        `json:"authorizedTesting,omitempty"` // Attack statistics with and without authorized testing
+	RuleEfficiency      []RuleEfficiency      `json:"ruleEfficiency,omitempty"`    // WCUs of each rule against its matches
+	CapacityHeadroom    *CapacityHeadroom     `json:"capacityHeadroom,omitempty"`  // WCU usage against the limit
+	Policy              *PolicyReport         `json:"policy,omitempty"`            // Score against the policy template, if one is selected
+	Findings            []Finding             `json:"findings"`
+	CaseStudies         []CaseStudy           `json:"caseStudies,omitempty"`    // Sample requests of the busiest terminating rules, if collected
+	Queries             []QueryResult         `json:"queries,omitempty"`        // Saved queries run with the analysis
+	Reconciliation      *Reconciliation       `json:"reconciliation,omitempty"` // Record counts from download to export
+	Environment         *Environment          `json:"environment,omitempty"`    // What produced the result, for reproducing it
+}
+
+// AnalyzeDirectory aggregates every WAF log file below dir, reading them through
+// the record cache if one is given
+func AnalyzeDirectory(dir string, settings *Settings, records *RecordCache, logger logging.Logger) (*Stats, int, error) {
+	files, err := ListLogFiles(dir)
+	if err != nil {
+		return nil, 0, err
+	}
+	logger.Infof("Found %d log files under %s", len(files), dir)
+
+	stats := NewStats(settings)
+	skipped, err := aggregateFiles(stats, dir, files, records, logger)
+	if err != nil {
+		return nil, 0, err
+	}
+	records.Prune(files)
+	logAggregate(stats, skipped, logger)
+	return stats, len(files), nil
+}
+
+// aggregateFiles adds the records of log files below root to stats, applying the
+// host and source filters and suppressions of its settings, counts the records parsed
+// from each file and returns the number of records filtered out by host or source
+func aggregateFiles(stats *Stats, root string, files []string, records *RecordCache, logger logging.Logger) (int64, error) {
+	if stats.FileRecords == nil {
+		stats.FileRecords = make(map[string]int64)
+	}
+	var skipped int64
+	for _, file := range files {
+		logger.Debugf("Analyzing %s", file)
+		rel, err := filepath.Rel(root, file)
+		if err != nil {
+			rel = file
+		}
+		var parsed int64
+		err = records.ForEachRecord(file, func(r *Record) error {
+			parsed++
+			if !stats.settings.IncludesHost(r.Host()) || !stats.settings.IncludesSource(r) {
+				skipped++
+				return nil
+			}
+			if name := stats.settings.Suppress(r); name != "" {
+				if stats.Suppressed == nil {
+					stats.Suppressed = make(map[string]int64)
+				}
+				stats.Suppressed[name]++
+				return nil
+			}
+			stats.Add(r)
+			return nil
+		})
+		if err != nil {
+			return 0, err
+		}
+		stats.FileRecords[filepath.ToSlash(rel)] += parsed
+	}
+	stats.Finalize()
+	stats.Filtered += skipped
+	return skipped, nil
+}
+
+// logAggregate logs what an aggregation filtered out and how many records it counted
+func logAggregate(stats *Stats, skipped int64, logger logging.Logger) {
+	if skipped > 0 {
+		filters := append(slices.Clone(stats.settings.Hosts), stats.settings.Sources...)
+		logger.Infof("Skipped %d records not matching the host or source filter %s", skipped, strings.Join(filters, ", "))
+	}
+	for name, n := range stats.Suppressed {
+		logger.Infof("Suppressed %d records matching %s", n, name)
+	}
+	logger.Infof("Aggregated %d records", stats.TotalRequests)
+}
+
+// LatestSnapshotPath returns the most recent Web ACL snapshot file in a Web ACL's
+// log directory, or "" if none has been captured.
+func LatestSnapshotPath(aclDir string) (string, error) {
+	matches, err := filepath.Glob(filepath.Join(aclDir, SnapshotDirName, "webacl_*.json"))
+	if err != nil {
+		return "", fmt.Errorf("failed to list snapshots: %w", err)
+	}
+	if len(matches) == 0 {
+		return "", nil
+	}
+	sort.Strings(matches) // File names embed a sortable timestamp
+	return matches[len(matches)-1], nil
+}
+
+// LoadSnapshot reads a Web ACL snapshot file as generic JSON data
+func LoadSnapshot(path string) (map[string]interface{}, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read snapshot: %w", err)
+	}
+	var snapshot map[string]interface{}
+	if err := json.Unmarshal(data, &snapshot); err != nil {
+		return nil, fmt.Errorf("failed to parse snapshot %s: %w", path, err)
+	}
+	return snapshot, nil
+}
+
+// LatestResultPath returns the most recent analysis result in a Web ACL's log
+// directory, or "" if it has not been analyzed yet.
+func LatestResultPath(aclDir string) (string, error) {
+	matches, err := filepath.Glob(filepath.Join(aclDir, OutputDirName, "analysis_*.json"))
+	if err != nil {
+		return "", fmt.Errorf("failed to list analysis results: %w", err)
+	}
+	if len(matches) == 0 {
+		return "", nil
+	}
+	sort.Strings(matches) // File names embed a sortable timestamp
+	return matches[len(matches)-1], nil
+}
+
+// LoadResult reads an analysis result file
+func LoadResult(path string) (*Result, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read analysis result: %w", err)
+	}
+	var result Result
+	if err := json.Unmarshal(data, &result); err != nil {
+		return nil, fmt.Errorf("failed to parse analysis result %s: %w", path, err)
+	}
+	return &result, nil
+}
+
+// WriteResult writes an analysis result as indented JSON into outputDir and returns the file path
+func WriteResult(outputDir string, result *Result) (string, error) {
+	if err := os.MkdirAll(outputDir, 0755); err != nil {
+		return "", fmt.Errorf("failed to create analysis directory: %w", err)
+	}
+
+	data, err := json.MarshalIndent(result, "", "  ")
+	if err != nil {
+		return "", fmt.Errorf("failed to encode analysis result: %w", err)
+	}
+
+	path := filepath.Join(outputDir, fmt.Sprintf("analysis_%s.json", result.GeneratedAt.Format("20060102_150405")))
+	if err := storage.WriteFileAtomic(path, data); err != nil {
+		return "", fmt.Errorf("failed to write analysis result: %w", err)
+	}
+	return path, nil
+}
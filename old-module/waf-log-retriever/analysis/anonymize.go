@@ -0,0 +1,235 @@
+package analysis
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/netip"
+	"strings"
+	"time"
+)
+
+// AnonymizedSchemaVersion is the version of anonymized records; it changes whenever
+// a field is added, removed or derived differently
+const AnonymizedSchemaVersion = 1
+
+// MinHashKeyBytes is the shortest hash key accepted. Identifiers such as IPv4
+// addresses are few enough to hash exhaustively, so the key has to stay secret.
+const MinHashKeyBytes = 16
+
+// managedLabelPrefix starts the labels of AWS managed rule groups; other labels are
+// named by the customer and carry their account ID
+const managedLabelPrefix = "awswaf:managed:"
+
+// AnonymizedRecord is a WAF record reduced to what can be shared outside the
+// customer: no payload (URI, query string, headers or body), customer-named rules
+// and labels dropped or hashed, and identifiers replaced by keyed hashes, which
+// correlate across datasets hashed with the same key but cannot be reversed without it
+type AnonymizedRecord struct {
+	Time                time.Time `json:"time"`   // Truncated to the export's resolution
+	Source              string    `json:"source"` // Hash of the account, region and Web ACL
+	Action              string    `json:"action"`
+	ResponseCode        int       `json:"responseCode,omitempty"`
+	TerminatingRuleType string    `json:"terminatingRuleType"`
+	TerminatingRule     string    `json:"terminatingRule"`            // Hash, except for the default action
+	ManagedRuleGroup    string    `json:"managedRuleGroup,omitempty"` // Vendor rule group that terminated the request, e.g. AWS#AWSManagedRulesSQLiRuleSet
+	ManagedRule         string    `json:"managedRule,omitempty"`      // Its rule, e.g. SQLi_BODY
+	Labels              []string  `json:"labels,omitempty"`           // Labels of AWS managed rule groups only
+	AttackCategories    []string  `json:"attackCategories,omitempty"` // OWASP Top 10 IDs
+	Scanner             string    `json:"scanner,omitempty"`
+	Country             string    `json:"country"`
+	Method              string    `json:"method"`
+	HTTPVersion         string    `json:"httpVersion"`
+	Client              string    `json:"client"`              // Hash of the client IP
+	ClientNetwork       string    `json:"clientNetwork"`       // Hash of its /24 (IPv4) or /48 (IPv6) network
+	Host                string    `json:"host"`                // Hash of the Host header
+	Path                string    `json:"path"`                // Hash of the URI path
+	UserAgent           string    `json:"userAgent,omitempty"` // Hash of the User-Agent header
+	JA3                 string    `json:"ja3,omitempty"`
+	JA4                 string    `json:"ja4,omitempty"`
+}
+
+// AnonymizedExport describes an export of anonymized records, written next to it
+type AnonymizedExport struct {
+	SchemaVersion int       `json:"schemaVersion"`
+	KeyID         string    `json:"keyId"`      // Identifies the hash key, see HashKeyID
+	Resolution    string    `json:"resolution"` // Of the record times, e.g. 1h0m0s
+	CreatedAt     time.Time `json:"createdAt"`
+	From          time.Time `json:"from"`
+	To            time.Time `json:"to"`
+	Records       int64     `json:"records"`
+	Skipped       int64     `json:"skipped"` // Records left out, e.g. without an attack with AttacksOnly
+	AttacksOnly   bool      `json:"attacksOnly"`
+}
+
+// Anonymizer turns records into anonymized records
+type Anonymizer struct {
+	key         []byte
+	resolution  time.Duration
+	settings    *Settings
+	attacksOnly bool
+	export      AnonymizedExport
+}
+
+// NewAnonymizer returns an anonymizer hashing with key and truncating times to
+// resolution (not at all if 0). The settings tell where the client IP is; with
+// attacksOnly, only requests matching an attack category or from a scanner are kept.
+func NewAnonymizer(key []byte, resolution time.Duration, settings *Settings, attacksOnly bool) (*Anonymizer, error) {
+	if len(key) < MinHashKeyBytes {
+		return nil, fmt.Errorf("the hash key has %d bytes; use at least %d random bytes", len(key), MinHashKeyBytes)
+	}
+	if resolution < 0 {
+		return nil, fmt.Errorf("invalid time resolution %s", resolution)
+	}
+	return &Anonymizer{
+		key:         key,
+		resolution:  resolution,
+		settings:    settings,
+		attacksOnly: attacksOnly,
+		export: AnonymizedExport{
+			SchemaVersion: AnonymizedSchemaVersion,
+			KeyID:         HashKeyID(key),
+			Resolution:    resolution.String(),
+			AttacksOnly:   attacksOnly,
+		},
+	}, nil
+}
+
+// HashKeyID identifies a hash key by the first 8 bytes of its keyed hash of a fixed
+// string, so recipients can tell which datasets correlate without learning the key
+func HashKeyID(key []byte) string {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte("waf-log-retriever/key-id"))
+	return hex.EncodeToString(mac.Sum(nil)[:8])
+}
+
+// Anonymize returns the anonymized form of a record, or false if it is left out
+func (a *Anonymizer) Anonymize(r *Record) (AnonymizedRecord, bool) {
+	categories := attackCategoriesOf(r)
+	scanner := IdentifyScanner(r)
+	if a.attacksOnly && len(categories) == 0 && scanner == "" {
+		a.export.Skipped++
+		return AnonymizedRecord{}, false
+	}
+
+	ts := r.Time()
+	if a.resolution > 0 {
+		ts = ts.Truncate(a.resolution)
+	}
+	if a.export.From.IsZero() || ts.Before(a.export.From) {
+		a.export.From = ts
+	}
+	if ts.After(a.export.To) {
+		a.export.To = ts
+	}
+	a.export.Records++
+
+	ip := a.settings.ClientIP(r)
+	out := AnonymizedRecord{
+		Time:                ts,
+		Source:              a.hash("source", SourceKey(r.Source())),
+		Action:              r.Action,
+		TerminatingRuleType: r.TerminatingRuleType,
+		TerminatingRule:     a.hash("rule", r.TerminatingRuleID),
+		AttackCategories:    categories,
+		Scanner:             scanner,
+		Country:             r.HTTPRequest.Country,
+		Method:              r.HTTPRequest.HTTPMethod,
+		HTTPVersion:         r.HTTPRequest.HTTPVersion,
+		Client:              a.hash("client", ip),
+		ClientNetwork:       a.hash("network", clientNetwork(ip)),
+		Host:                a.hash("host", strings.ToLower(r.HTTPRequest.Host)),
+		Path:                a.hash("path", uriPath(r.HTTPRequest.URI)),
+		UserAgent:           a.hash("user-agent", r.HeaderValue("User-Agent")),
+		JA3:                 r.JA3Fingerprint,
+		JA4:                 r.JA4Fingerprint,
+	}
+	if r.TerminatingRuleID == "Default_Action" {
+		out.TerminatingRule = r.TerminatingRuleID
+	}
+	if r.ResponseCodeSent != nil {
+		out.ResponseCode = *r.ResponseCodeSent
+	}
+	for _, group := range r.RuleGroupList {
+		if group.TerminatingRule != nil && isVendorRuleGroup(group.RuleGroupID) {
+			out.ManagedRuleGroup, out.ManagedRule = group.RuleGroupID, group.TerminatingRule.RuleID
+			break
+		}
+	}
+	for _, label := range r.Labels {
+		if strings.HasPrefix(label.Name, managedLabelPrefix) {
+			out.Labels = append(out.Labels, label.Name)
+		}
+	}
+	return out, true
+}
+
+// Export describes the records anonymized so far
+func (a *Anonymizer) Export() AnonymizedExport {
+	return a.export
+}
+
+// hash returns the keyed hash of a value of a kind of identifier, see KeyedHash
+func (a *Anonymizer) hash(kind, value string) string {
+	return KeyedHash(a.key, kind, value)
+}
+
+// KeyedHash returns the HMAC-SHA256 of a value of a kind of identifier truncated to
+// 16 bytes, or "" for an empty value. The kind separates the domains, so a host and
+// a path of the same text do not hash alike.
+func KeyedHash(key []byte, kind, value string) string {
+	if value == "" {
+		return ""
+	}
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(kind))
+	mac.Write([]byte{0})
+	mac.Write([]byte(value))
+	return hex.EncodeToString(mac.Sum(nil)[:16])
+}
+
+// attackCategoriesOf returns the OWASP IDs of the attack categories a record matched
+func attackCategoriesOf(r *Record) []string {
+	var categories []string
+	seen := make(map[string]bool)
+	for _, name := range attackNames(r) {
+		if category, ok := categorize(name); ok && !seen[category.OWASP] {
+			seen[category.OWASP] = true
+			categories = append(categories, category.OWASP)
+		}
+	}
+	return categories
+}
+
+// isVendorRuleGroup reports whether a rule group ID names a rule group of AWS or a
+// Marketplace vendor, e.g. AWS#AWSManagedRulesCommonRuleSet, rather than the ARN of
+// one of the customer's own
+func isVendorRuleGroup(id string) bool {
+	return id != "" && !strings.HasPrefix(id, "arn:")
+}
+
+// clientNetwork returns the /24 network of an IPv4 address or the /48 of an IPv6
+// one, or "" if ip is not an address
+func clientNetwork(ip string) string {
+	addr, err := netip.ParseAddr(ip)
+	if err != nil {
+		return ""
+	}
+	bits := 48
+	if addr.Is4() || addr.Is4In6() {
+		addr, bits = addr.Unmap(), 24
+	}
+	prefix, err := addr.Prefix(bits)
+	if err != nil {
+		return ""
+	}
+	return prefix.String()
+}
+
+// uriPath returns a URI without its query string or fragment
+func uriPath(uri string) string {
+	path, _, _ := strings.Cut(uri, "?")
+	path, _, _ = strings.Cut(path, "#")
+	return path
+}
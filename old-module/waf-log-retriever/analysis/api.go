@@ -0,0 +1,297 @@
+package analysis
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// maxTrackedIDs caps the numeric IDs kept per client and endpoint for enumeration detection
+const maxTrackedIDs = 5000
+
+// idSegment matches URI path segments that identify a resource: numbers, UUIDs and long hex strings
+var idSegment = regexp.MustCompile(`^(\d+|[0-9a-fA-F]{8}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{12}|[0-9a-fA-F]{16,})$`)
+
+// EndpointTemplate replaces the resource IDs in a URI path with {id}, so that
+// /api/orders/1234 and /api/orders/1235 count as the same endpoint
+func EndpointTemplate(uri string) string {
+	segments := strings.Split(uri, "/")
+	for i, segment := range segments {
+		if idSegment.MatchString(segment) {
+			segments[i] = "{id}"
+		}
+	}
+	return strings.Join(segments, "/")
+}
+
+// lastNumericID returns the last all-digit path segment of a URI
+func lastNumericID(uri string) (int64, bool) {
+	segments := strings.Split(uri, "/")
+	for i := len(segments) - 1; i >= 0; i-- {
+		if id, err := strconv.ParseInt(segments[i], 10, 64); err == nil {
+			return id, true
+		}
+	}
+	return 0, false
+}
+
+// APIStats aggregates per-endpoint and per-client request patterns for API abuse detection
+type APIStats struct {
+	perMinute    map[string]map[int64]int64           // Endpoint template -> Unix minute -> requests
+	ids          map[string]map[string]map[int64]bool // Client -> endpoint template -> numeric IDs
+	paths        map[string]map[string]bool           // Client -> distinct URIs
+	notFound     map[string]int64                     // Client -> requests WAF answered with 404
+	clientRanges map[string][2]time.Time              // Client -> first and last request
+}
+
+// newAPIStats creates an empty APIStats instance
+func newAPIStats() *APIStats {
+	return &APIStats{
+		perMinute:    make(map[string]map[int64]int64),
+		ids:          make(map[string]map[string]map[int64]bool),
+		paths:        make(map[string]map[string]bool),
+		notFound:     make(map[string]int64),
+		clientRanges: make(map[string][2]time.Time),
+	}
+}
+
+// addAPI folds a record of client ip into the API aggregate
+func (s *Stats) addAPI(r *Record, ip string) {
+	a := s.API
+	uri := r.HTTPRequest.URI
+	template := EndpointTemplate(uri)
+
+	minutes, ok := a.perMinute[template]
+	if !ok {
+		minutes = make(map[int64]int64)
+		a.perMinute[template] = minutes
+	}
+	minutes[r.Timestamp/60000]++
+
+	if id, ok := lastNumericID(uri); ok {
+		byTemplate, ok := a.ids[ip]
+		if !ok {
+			byTemplate = make(map[string]map[int64]bool)
+			a.ids[ip] = byTemplate
+		}
+		ids, ok := byTemplate[template]
+		if !ok {
+			ids = make(map[int64]bool)
+			byTemplate[template] = ids
+		}
+		if len(ids) < maxTrackedIDs {
+			ids[id] = true
+		}
+	}
+
+	paths, ok := a.paths[ip]
+	if !ok {
+		paths = make(map[string]bool)
+		a.paths[ip] = paths
+	}
+	if len(paths) < maxTrackedIDs {
+		paths[uri] = true
+	}
+	if r.ResponseCodeSent != nil && *r.ResponseCodeSent == 404 {
+		a.notFound[ip]++
+	}
+
+	ts := r.Time()
+	span, ok := a.clientRanges[ip]
+	if !ok || ts.Before(span[0]) {
+		span[0] = ts
+	}
+	if ts.After(span[1]) {
+		span[1] = ts
+	}
+	a.clientRanges[ip] = span
+}
+
+// APIAbuse is the evidence of API abuse found in the logs
+type APIAbuse struct {
+	Enumeration []Enumeration   `json:"enumeration"`
+	PathProbing []PathProbe     `json:"pathProbing"`
+	Velocity    []VelocitySpike `json:"velocity"`
+}
+
+// Enumeration is a client walking through consecutive resource IDs of an endpoint
+type Enumeration struct {
+	ClientIP    string    `json:"clientIp"`
+	Endpoint    string    `json:"endpoint"`
+	Class       string    `json:"class,omitempty"` // Endpoint class, if configured
+	DistinctIDs int       `json:"distinctIds"`
+	Sequential  float64   `json:"sequential"` // Share of sorted IDs that follow the previous one
+	MinID       int64     `json:"minId"`
+	MaxID       int64     `json:"maxId"`
+	FirstSeen   time.Time `json:"firstSeen"`
+	LastSeen    time.Time `json:"lastSeen"`
+}
+
+// PathProbe is a client requesting an unusual number of distinct paths
+type PathProbe struct {
+	ClientIP      string    `json:"clientIp"`
+	DistinctPaths int       `json:"distinctPaths"`
+	NotFound      int64     `json:"notFound"` // Requests WAF answered with a custom 404 response
+	FirstSeen     time.Time `json:"firstSeen"`
+	LastSeen      time.Time `json:"lastSeen"`
+}
+
+// VelocitySpike is a minute where an endpoint received far more requests than usual
+type VelocitySpike struct {
+	Endpoint        string      `json:"endpoint"`
+	Class           string      `json:"class,omitempty"` // Endpoint class, if configured
+	PeakAt          time.Time   `json:"peakAt"`
+	PeakPerMinute   int64       `json:"peakPerMinute"`
+	MedianPerMinute int64       `json:"medianPerMinute"`
+	Series          []TimeCount `json:"series"` // Requests per minute around the peak
+}
+
+// TimeCount is the number of requests in the minute starting at Time
+type TimeCount struct {
+	Time  time.Time `json:"time"`
+	Count int64     `json:"count"`
+}
+
+// DetectAPIAbuse looks for sequential ID enumeration, path probing and per-endpoint
+// velocity spikes in the API aggregate
+func DetectAPIAbuse(a *APIStats, settings *Settings) *APIAbuse {
+	abuse := &APIAbuse{Enumeration: []Enumeration{}, PathProbing: []PathProbe{}, Velocity: []VelocitySpike{}}
+
+	for ip, byTemplate := range a.ids {
+		for template, idSet := range byTemplate {
+			if len(idSet) < settings.API.MinEnumerationIDs {
+				continue
+			}
+			ids := make([]int64, 0, len(idSet))
+			for id := range idSet {
+				ids = append(ids, id)
+			}
+			sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+			consecutive := 0
+			for i := 1; i < len(ids); i++ {
+				if ids[i]-ids[i-1] == 1 {
+					consecutive++
+				}
+			}
+			sequential := float64(consecutive) / float64(len(ids)-1)
+			if sequential < settings.API.MinSequentialShare {
+				continue
+			}
+			span := a.clientRanges[ip]
+			abuse.Enumeration = append(abuse.Enumeration, Enumeration{
+				ClientIP: ip, Endpoint: template, Class: settings.ClassifyEndpoint(template), DistinctIDs: len(ids), Sequential: round2(sequential),
+				MinID: ids[0], MaxID: ids[len(ids)-1], FirstSeen: span[0], LastSeen: span[1],
+			})
+		}
+	}
+	sort.Slice(abuse.Enumeration, func(i, j int) bool {
+		if abuse.Enumeration[i].DistinctIDs != abuse.Enumeration[j].DistinctIDs {
+			return abuse.Enumeration[i].DistinctIDs > abuse.Enumeration[j].DistinctIDs
+		}
+		return abuse.Enumeration[i].ClientIP < abuse.Enumeration[j].ClientIP
+	})
+
+	for ip, paths := range a.paths {
+		if len(paths) < settings.API.MinDistinctPaths {
+			continue
+		}
+		span := a.clientRanges[ip]
+		abuse.PathProbing = append(abuse.PathProbing, PathProbe{
+			ClientIP: ip, DistinctPaths: len(paths), NotFound: a.notFound[ip], FirstSeen: span[0], LastSeen: span[1],
+		})
+	}
+	sort.Slice(abuse.PathProbing, func(i, j int) bool {
+		if abuse.PathProbing[i].DistinctPaths != abuse.PathProbing[j].DistinctPaths {
+			return abuse.PathProbing[i].DistinctPaths > abuse.PathProbing[j].DistinctPaths
+		}
+		return abuse.PathProbing[i].ClientIP < abuse.PathProbing[j].ClientIP
+	})
+
+	for template, minutes := range a.perMinute {
+		if spike, ok := velocitySpike(template, minutes, settings.API); ok {
+			spike.Class = settings.ClassifyEndpoint(template)
+			abuse.Velocity = append(abuse.Velocity, spike)
+		}
+	}
+	sort.Slice(abuse.Velocity, func(i, j int) bool {
+		if abuse.Velocity[i].PeakPerMinute != abuse.Velocity[j].PeakPerMinute {
+			return abuse.Velocity[i].PeakPerMinute > abuse.Velocity[j].PeakPerMinute
+		}
+		return abuse.Velocity[i].Endpoint < abuse.Velocity[j].Endpoint
+	})
+	return abuse
+}
+
+// velocitySpike compares the busiest minute of an endpoint with its median minute
+func velocitySpike(template string, minutes map[int64]int64, settings APISettings) (VelocitySpike, bool) {
+	counts := make([]int64, 0, len(minutes))
+	var peakMinute, peak int64
+	for minute, n := range minutes {
+		counts = append(counts, n)
+		if n > peak || (n == peak && minute < peakMinute) {
+			peakMinute, peak = minute, n
+		}
+	}
+	if peak < settings.MinPeakPerMinute {
+		return VelocitySpike{}, false
+	}
+	sort.Slice(counts, func(i, j int) bool { return counts[i] < counts[j] })
+	median := counts[len(counts)/2]
+	if float64(peak) < settings.VelocityFactor*float64(median) {
+		return VelocitySpike{}, false
+	}
+
+	spike := VelocitySpike{
+		Endpoint:        template,
+		PeakAt:          time.Unix(peakMinute*60, 0).UTC(),
+		PeakPerMinute:   peak,
+		MedianPerMinute: median,
+	}
+	for minute := peakMinute - 10; minute <= peakMinute+10; minute++ {
+		spike.Series = append(spike.Series, TimeCount{Time: time.Unix(minute*60, 0).UTC(), Count: minutes[minute]})
+	}
+	return spike, true
+}
+
+// APIFindings reports the detected API abuse
+func APIFindings(webACLName string, abuse *APIAbuse) []Finding {
+	var findings []Finding
+	for _, e := range abuse.Enumeration {
+		findings = append(findings, Finding{
+			ID:       "api-id-enumeration",
+			Severity: SeverityHigh,
+			Title:    fmt.Sprintf("%s enumerated %d IDs of %s", e.ClientIP, e.DistinctIDs, e.Endpoint),
+			Description: fmt.Sprintf("Client %s requested IDs %d to %d of %s through Web ACL %s between %s and %s, %.0f%% of them in sequence. Check the endpoint for broken object level authorization and rate-limit it.",
+				e.ClientIP, e.MinID, e.MaxID, e.Endpoint, webACLName, e.FirstSeen.Format(time.RFC3339), e.LastSeen.Format(time.RFC3339), e.Sequential*100),
+			Source:        "api",
+			EndpointClass: e.Class,
+			Evidence:      &Evidence{Client: e.ClientIP, Endpoint: e.Endpoint},
+		})
+	}
+	for _, p := range abuse.PathProbing {
+		findings = append(findings, Finding{
+			ID:       "api-path-probing",
+			Severity: SeverityMedium,
+			Title:    fmt.Sprintf("%s probed %d distinct paths", p.ClientIP, p.DistinctPaths),
+			Description: fmt.Sprintf("Client %s requested %d distinct paths through Web ACL %s between %s and %s (%d answered with 404 by WAF). WAF logs do not record origin status codes, so check the origin logs for how many were not found.",
+				p.ClientIP, p.DistinctPaths, webACLName, p.FirstSeen.Format(time.RFC3339), p.LastSeen.Format(time.RFC3339), p.NotFound),
+			Source:   "api",
+			Evidence: &Evidence{Client: p.ClientIP},
+		})
+	}
+	for _, v := range abuse.Velocity {
+		findings = append(findings, Finding{
+			ID:       "api-velocity-spike",
+			Severity: SeverityMedium,
+			Title:    fmt.Sprintf("%s received %d requests in one minute", v.Endpoint, v.PeakPerMinute),
+			Description: fmt.Sprintf("Endpoint %s behind Web ACL %s received %d requests in the minute starting %s, against a median of %d per minute. See apiAbuse.velocity for the surrounding time series.",
+				v.Endpoint, webACLName, v.PeakPerMinute, v.PeakAt.Format(time.RFC3339), v.MedianPerMinute),
+			Source:        "api",
+			EndpointClass: v.Class,
+		})
+	}
+	return findings
+}
@@ -0,0 +1,171 @@
+package analysis
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"slices"
+	"sort"
+	"strings"
+)
+
+// Asset is a customer-supplied group of hosts and paths, with how critical it is to
+// the business and what data it handles
+type Asset struct {
+	Name               string   `json:"name"`
+	Hosts              []string `json:"hosts,omitempty"`              // Host patterns, see MatchHost; any host if empty
+	Paths              []string `json:"paths,omitempty"`              // URI patterns, see MatchURI; any path if empty
+	Criticality        string   `json:"criticality"`                  // See CriticalityLevels
+	DataClassification string   `json:"dataClassification,omitempty"` // e.g. public, internal, confidential, PII, PCI
+}
+
+// LoadAssets reads an asset map: a JSON array of assets, where the first asset
+// matching a request's host and path wins
+func LoadAssets(path string) ([]Asset, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read asset map: %w", err)
+	}
+	var assets []Asset
+	if err := json.Unmarshal(data, &assets); err != nil {
+		return nil, fmt.Errorf("failed to parse asset map %s: %w", path, err)
+	}
+	if err := compileAssets(assets); err != nil {
+		return nil, fmt.Errorf("asset map %s: %w", path, err)
+	}
+	return assets, nil
+}
+
+// compileAssets validates assets
+func compileAssets(assets []Asset) error {
+	names := make(map[string]bool)
+	for i, a := range assets {
+		if a.Name == "" {
+			return fmt.Errorf("asset %d has no name", i+1)
+		}
+		if names[a.Name] {
+			return fmt.Errorf("asset %s is defined twice", a.Name)
+		}
+		names[a.Name] = true
+		if !slices.Contains(CriticalityLevels, a.Criticality) {
+			return fmt.Errorf("asset %s: unknown criticality %q (want %s)", a.Name, a.Criticality, strings.Join(CriticalityLevels, ", "))
+		}
+	}
+	return nil
+}
+
+// AssetOf returns the first asset matching a record's host and path, or nil
+func (s *Settings) AssetOf(r *Record) *Asset {
+	for i := range s.Assets {
+		a := &s.Assets[i]
+		if (len(a.Hosts) == 0 || slices.ContainsFunc(a.Hosts, func(p string) bool { return MatchHost(p, r.Host()) })) &&
+			(len(a.Paths) == 0 || slices.ContainsFunc(a.Paths, func(p string) bool { return MatchURI(p, r.HTTPRequest.URI) })) {
+			return a
+		}
+	}
+	return nil
+}
+
+// AssetCounts aggregates the requests to one asset
+type AssetCounts struct {
+	Requests          int64            `json:"requests"`
+	Blocked           int64            `json:"blocked"`
+	Attacks           int64            `json:"attacks"`           // Matching an attack category or from a scanner
+	AttacksNotBlocked int64            `json:"attacksNotBlocked"` // Attacks that were not blocked
+	TerminatingRules  map[string]int64 `json:"terminatingRules"`
+}
+
+// addAsset folds a record into the statistics of its asset
+func (s *Stats) addAsset(r *Record, attackCategories []string, scanner string) {
+	asset := s.settings.AssetOf(r)
+	if asset == nil {
+		return
+	}
+	c, ok := s.Assets[asset.Name]
+	if !ok {
+		c = &AssetCounts{TerminatingRules: make(map[string]int64)}
+		s.Assets[asset.Name] = c
+	}
+	c.Requests++
+	blocked := r.Action == "BLOCK"
+	if blocked {
+		c.Blocked++
+	}
+	if len(attackCategories) > 0 || scanner != "" {
+		c.Attacks++
+		if !blocked {
+			c.AttacksNotBlocked++
+		}
+	}
+	c.TerminatingRules[r.TerminatingRuleID]++
+}
+
+// merge folds the counts of the same asset from another aggregate into c
+func (c *AssetCounts) merge(o *AssetCounts) {
+	c.Requests += o.Requests
+	c.Blocked += o.Blocked
+	c.Attacks += o.Attacks
+	c.AttacksNotBlocked += o.AttacksNotBlocked
+	mergeCounts(c.TerminatingRules, o.TerminatingRules)
+}
+
+// AssetReport is the report breakdown of one asset
+type AssetReport struct {
+	Name               string  `json:"name"`
+	Criticality        string  `json:"criticality"`
+	DataClassification string  `json:"dataClassification,omitempty"`
+	Requests           int64   `json:"requests"`
+	Blocked            int64   `json:"blocked"`
+	Attacks            int64   `json:"attacks"`
+	AttacksNotBlocked  int64   `json:"attacksNotBlocked"`
+	Findings           int     `json:"findings"` // Findings about requests to the asset, see CollectEvidence
+	TopRules           []Count `json:"topRules"`
+}
+
+// AssetBreakdown summarizes the assets that received requests, most critical first
+// and in configuration order within a criticality
+func AssetBreakdown(stats *Stats, findings []Finding) []AssetReport {
+	breakdown := []AssetReport{}
+	for _, a := range stats.settings.Assets {
+		c, ok := stats.Assets[a.Name]
+		if !ok {
+			continue
+		}
+		breakdown = append(breakdown, AssetReport{
+			Name:               a.Name,
+			Criticality:        a.Criticality,
+			DataClassification: a.DataClassification,
+			Requests:           c.Requests,
+			Blocked:            c.Blocked,
+			Attacks:            c.Attacks,
+			AttacksNotBlocked:  c.AttacksNotBlocked,
+			TopRules:           TopN(c.TerminatingRules, 10),
+		})
+	}
+	sort.SliceStable(breakdown, func(i, j int) bool {
+		return criticalityFactors[breakdown[i].Criticality] > criticalityFactors[breakdown[j].Criticality]
+	})
+	countAssetFindings(breakdown, findings)
+	return breakdown
+}
+
+// countAssetFindings counts the findings tagged with each asset
+func countAssetFindings(breakdown []AssetReport, findings []Finding) {
+	counts := make(map[string]int)
+	for _, f := range findings {
+		for _, a := range f.Assets {
+			counts[a.Name]++
+		}
+	}
+	for i := range breakdown {
+		breakdown[i].Findings = counts[breakdown[i].Name]
+	}
+}
+
+// FindingAsset is an asset a finding's requests went to
+type FindingAsset struct {
+	Name               string `json:"name"`
+	Criticality        string `json:"criticality"`
+	DataClassification string `json:"dataClassification,omitempty"`
+	Requests           int64  `json:"requests"` // Requests of the finding to the asset
+}
@@ -0,0 +1,201 @@
+package analysis
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+)
+
+// atpRuleGroup is the AWS managed rule group for Account Takeover Prevention
+const atpRuleGroup = "AWSManagedRulesATPRuleSet"
+
+// AuthStats aggregates login attempts against the configured authentication endpoints
+type AuthStats struct {
+	Attempts     int64            `json:"attempts"`
+	Blocked      int64            `json:"blocked"`
+	ATPEvaluated int64            `json:"atpEvaluated"` // Attempts the ATP rule group inspected
+	ATPLabeled   int64            `json:"atpLabeled"`   // Attempts ATP labeled, e.g. as using stolen credentials
+	Endpoints    map[string]int64 `json:"endpoints"`
+	ClientIPs    map[string]int64 `json:"clientIps"`
+
+	windows map[int64]map[string]int64 // Attempts by window start (Unix minutes), then client IP
+}
+
+// newAuthStats creates an empty AuthStats instance
+func newAuthStats() *AuthStats {
+	return &AuthStats{
+		Endpoints: make(map[string]int64),
+		ClientIPs: make(map[string]int64),
+		windows:   make(map[int64]map[string]int64),
+	}
+}
+
+// isLoginAttempt reports whether a record is a request to an authentication endpoint
+func (a *AuthSettings) isLoginAttempt(r *Record) bool {
+	method := false
+	for _, m := range a.Methods {
+		if strings.EqualFold(m, r.HTTPRequest.HTTPMethod) {
+			method = true
+			break
+		}
+	}
+	if !method {
+		return false
+	}
+	for _, endpoint := range a.Endpoints {
+		if MatchURI(endpoint, r.HTTPRequest.URI) {
+			return true
+		}
+	}
+	return false
+}
+
+// addAuth folds a record into the login attempt aggregate if it targets an authentication endpoint
+func (s *Stats) addAuth(r *Record, client string) {
+	if !s.settings.Auth.isLoginAttempt(r) {
+		return
+	}
+	a := s.Auth
+	a.Attempts++
+	if r.Action == "BLOCK" {
+		a.Blocked++
+	}
+	a.Endpoints[r.HTTPRequest.URI]++
+	a.ClientIPs[client]++
+
+	for _, group := range r.RuleGroupList {
+		if strings.Contains(group.RuleGroupID, atpRuleGroup) {
+			a.ATPEvaluated++
+			break
+		}
+	}
+	for _, label := range r.Labels {
+		if strings.Contains(label.Name, ":atp:") {
+			a.ATPLabeled++
+			break
+		}
+	}
+
+	windowMinutes := int64(s.settings.Auth.WindowMinutes)
+	window := r.Timestamp / 60000 / windowMinutes * windowMinutes
+	ips, ok := a.windows[window]
+	if !ok {
+		ips = make(map[string]int64)
+		a.windows[window] = ips
+	}
+	ips[client]++
+}
+
+// AuthAbuse is the evidence of authentication endpoint abuse
+type AuthAbuse struct {
+	WindowMinutes   int          `json:"windowMinutes"`
+	RotatingWindows []AuthWindow `json:"rotatingWindows"` // Suspicious windows spread over many IPs (credential stuffing)
+	BruteForceIPs   []Count      `json:"bruteForceIps"`   // IPs over the threshold within a single window, by peak attempts
+	LowAndSlowIPs   []Count      `json:"lowAndSlowIps"`   // IPs returning in many windows below the thresholds, by windows
+	Peak            *AuthWindow  `json:"peak,omitempty"`
+}
+
+// AuthWindow is one counting window of login attempts
+type AuthWindow struct {
+	Start     time.Time `json:"start"`
+	Attempts  int64     `json:"attempts"`
+	ClientIPs int       `json:"clientIps"`
+}
+
+// DetectAuthAbuse looks for credential stuffing from rotating IPs, single-IP brute
+// force and distributed low-and-slow attempts in the login attempt aggregate
+func DetectAuthAbuse(a *AuthStats, settings AuthSettings) *AuthAbuse {
+	abuse := &AuthAbuse{WindowMinutes: settings.WindowMinutes}
+
+	bruteForce := make(map[string]int64)
+	quietWindows := make(map[string]int64)
+	for window, ips := range a.windows {
+		var attempts int64
+		for ip, n := range ips {
+			attempts += n
+			if n >= settings.MinRequests {
+				if n > bruteForce[ip] {
+					bruteForce[ip] = n
+				}
+			} else {
+				quietWindows[ip]++
+			}
+		}
+		w := AuthWindow{Start: time.Unix(window*60, 0).UTC(), Attempts: attempts, ClientIPs: len(ips)}
+		if abuse.Peak == nil || w.Attempts > abuse.Peak.Attempts {
+			peak := w
+			abuse.Peak = &peak
+		}
+		if attempts >= settings.MinRequests && len(ips) >= settings.MinClientIPs {
+			abuse.RotatingWindows = append(abuse.RotatingWindows, w)
+		}
+	}
+	sort.Slice(abuse.RotatingWindows, func(i, j int) bool {
+		return abuse.RotatingWindows[i].Start.Before(abuse.RotatingWindows[j].Start)
+	})
+
+	lowAndSlow := make(map[string]int64)
+	for ip, windows := range quietWindows {
+		if windows >= int64(settings.LowAndSlowWindows) && bruteForce[ip] == 0 {
+			lowAndSlow[ip] = windows
+		}
+	}
+	abuse.BruteForceIPs = TopN(bruteForce, 20)
+	abuse.LowAndSlowIPs = TopN(lowAndSlow, 20)
+	return abuse
+}
+
+// AuthFindings reports the detected authentication endpoint abuse and whether ATP
+// (Account Takeover Prevention) inspected the attempts
+func AuthFindings(webACLName string, a *AuthStats, abuse *AuthAbuse) []Finding {
+	atp := "The Account Takeover Prevention (ATP) managed rule group did not inspect these attempts; it would detect stolen credentials, per-session and per-IP login volume and failed-login ratios and block them."
+	if a.ATPEvaluated > 0 {
+		atp = fmt.Sprintf("The Account Takeover Prevention (ATP) rule group inspected %d of %d attempts and labeled %d of them.", a.ATPEvaluated, a.Attempts, a.ATPLabeled)
+	}
+
+	var findings []Finding
+	if n := len(abuse.RotatingWindows); n > 0 {
+		var attempts int64
+		peak := abuse.RotatingWindows[0]
+		for _, w := range abuse.RotatingWindows {
+			attempts += w.Attempts
+			if w.Attempts > peak.Attempts {
+				peak = w
+			}
+		}
+		peakEnd := peak.Start.Add(time.Duration(abuse.WindowMinutes) * time.Minute)
+		findings = append(findings, Finding{
+			ID:       "auth-credential-stuffing",
+			Severity: SeverityHigh,
+			Title:    fmt.Sprintf("Possible credential stuffing in %d windows of %d minutes", n, abuse.WindowMinutes),
+			Description: fmt.Sprintf("Authentication endpoints behind Web ACL %s received %d login attempts from rotating client IPs in %d windows, peaking at %d attempts from %d IPs at %s. %d of all %d attempts were blocked. %s",
+				webACLName, attempts, n, peak.Attempts, peak.ClientIPs, peak.Start.Format(time.RFC3339), a.Blocked, a.Attempts, atp),
+			Source:   "auth",
+			Evidence: &Evidence{Login: true, From: &peak.Start, To: &peakEnd},
+		})
+	}
+	if len(abuse.BruteForceIPs) > 0 {
+		findings = append(findings, Finding{
+			ID:       "auth-brute-force",
+			Severity: SeverityHigh,
+			Title:    fmt.Sprintf("%d client IPs brute-forced authentication endpoints", len(abuse.BruteForceIPs)),
+			Description: fmt.Sprintf("Client IPs such as %s made at least %d login attempts within %d minutes against Web ACL %s. A rate-based rule scoped to the login endpoints would limit them. %s",
+				abuse.BruteForceIPs[0].Key, abuse.BruteForceIPs[len(abuse.BruteForceIPs)-1].Count, abuse.WindowMinutes, webACLName, atp),
+			Source:   "auth",
+			Evidence: &Evidence{Client: abuse.BruteForceIPs[0].Key, Login: true},
+		})
+	}
+	if len(abuse.LowAndSlowIPs) > 0 {
+		findings = append(findings, Finding{
+			ID:       "auth-low-and-slow",
+			Severity: SeverityMedium,
+			Title:    fmt.Sprintf("%d client IPs made low-and-slow login attempts", len(abuse.LowAndSlowIPs)),
+			Description: fmt.Sprintf("Client IPs such as %s returned to the authentication endpoints behind Web ACL %s in %d separate %d-minute windows while staying below rate thresholds. %s",
+				abuse.LowAndSlowIPs[0].Key, webACLName, abuse.LowAndSlowIPs[0].Count, abuse.WindowMinutes, atp),
+			Source:   "auth",
+			Evidence: &Evidence{Client: abuse.LowAndSlowIPs[0].Key, Login: true},
+		})
+	}
+	return findings
+}
@@ -0,0 +1,311 @@
+package analysis
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/netip"
+	"slices"
+	"sort"
+	"strings"
+)
+
+// BlocklistFormats are the formats WriteBlocklist writes
+var BlocklistFormats = []string{"cidr", "pf", "iptables", "nftables", "cloudflare", "waf-ipset"}
+
+// wafIPSetLimit is the most addresses an AWS WAF IP set holds
+const wafIPSetLimit = 10000
+
+// cloudflareIPv6Bits is the longest IPv6 prefix a Cloudflare IP list accepts
+const cloudflareIPv6Bits = 64
+
+// BlocklistEntry is a network to block with the requests WAF blocked from it and why
+// it is listed
+type BlocklistEntry struct {
+	Prefix  netip.Prefix
+	Blocked int64
+	Reasons []string // e.g. "blocked", "true-positive"
+}
+
+// BlocklistOptions name and describe the exported blocklist
+type BlocklistOptions struct {
+	Name        string // Table, chain, set or list name
+	Description string // Comment or description of the list
+	Scope       string // AWS WAF IP set scope: REGIONAL or CLOUDFRONT
+}
+
+// ParseBlocklistPrefix parses an IP or CIDR range, as an annotation key or a client
+// IP, into a prefix
+func ParseBlocklistPrefix(s string) (netip.Prefix, error) {
+	if strings.Contains(s, "/") {
+		p, err := netip.ParsePrefix(s)
+		if err != nil {
+			return netip.Prefix{}, fmt.Errorf("invalid CIDR %q", s)
+		}
+		return p.Masked(), nil
+	}
+	addr, err := netip.ParseAddr(s)
+	if err != nil || addr.Zone() != "" {
+		return netip.Prefix{}, fmt.Errorf("invalid IP %q", s)
+	}
+	addr = addr.Unmap()
+	return netip.PrefixFrom(addr, addr.BitLen()), nil
+}
+
+// IsPrivatePrefix reports whether a prefix is in private, loopback, link-local or
+// unspecified address space, which is never worth blocking at the edge
+func IsPrivatePrefix(p netip.Prefix) bool {
+	a := p.Addr()
+	return a.IsPrivate() || a.IsLoopback() || a.IsLinkLocalUnicast() || a.IsUnspecified()
+}
+
+// CollapseBlocklist merges overlapping and adjacent entries into the fewest CIDR
+// blocks, IPv4 first
+func CollapseBlocklist(entries []BlocklistEntry) []BlocklistEntry {
+	sorted := append([]BlocklistEntry(nil), entries...)
+	SortBlocklist(sorted)
+
+	var collapsed []BlocklistEntry
+	for i := 0; i < len(sorted); {
+		// Extend the run of overlapping and adjacent entries starting at i
+		first, last := sorted[i].Prefix.Addr(), lastAddr(sorted[i].Prefix)
+		j := i + 1
+		for ; j < len(sorted); j++ {
+			p := sorted[j].Prefix
+			next := last.Next()
+			if p.Addr().Is4() != first.Is4() || (next.IsValid() && next.Less(p.Addr())) {
+				break
+			}
+			if end := lastAddr(p); last.Less(end) {
+				last = end
+			}
+		}
+		for _, p := range rangePrefixes(first, last) {
+			block := BlocklistEntry{Prefix: p}
+			for _, e := range sorted[i:j] {
+				if p.Contains(e.Prefix.Addr()) {
+					block.Blocked += e.Blocked
+					block.Reasons = appendNew(block.Reasons, e.Reasons...)
+				}
+			}
+			collapsed = append(collapsed, block)
+		}
+		i = j
+	}
+	return collapsed
+}
+
+// SortBlocklist sorts entries by address, IPv4 first
+func SortBlocklist(entries []BlocklistEntry) {
+	sort.Slice(entries, func(i, j int) bool {
+		a, b := entries[i].Prefix.Addr(), entries[j].Prefix.Addr()
+		if a.Is4() != b.Is4() {
+			return a.Is4()
+		}
+		if a != b {
+			return a.Less(b)
+		}
+		return entries[i].Prefix.Bits() < entries[j].Prefix.Bits()
+	})
+}
+
+// appendNew appends the values not in list yet
+func appendNew(list []string, values ...string) []string {
+	for _, v := range values {
+		if !slices.Contains(list, v) {
+			list = append(list, v)
+		}
+	}
+	return list
+}
+
+// lastAddr returns the last address of a prefix
+func lastAddr(p netip.Prefix) netip.Addr {
+	b := p.Masked().Addr().AsSlice()
+	for i := p.Bits(); i < len(b)*8; i++ {
+		b[i/8] |= 0x80 >> (i % 8)
+	}
+	addr, _ := netip.AddrFromSlice(b)
+	return addr
+}
+
+// rangePrefixes returns the fewest prefixes covering the addresses first to last
+func rangePrefixes(first, last netip.Addr) []netip.Prefix {
+	var prefixes []netip.Prefix
+	for {
+		bits := first.BitLen()
+		for bits > 0 {
+			wider := netip.PrefixFrom(first, bits-1)
+			if wider.Masked().Addr() != first || last.Less(lastAddr(wider)) {
+				break
+			}
+			bits--
+		}
+		p := netip.PrefixFrom(first, bits)
+		prefixes = append(prefixes, p)
+		end := lastAddr(p)
+		if !end.Less(last) {
+			return prefixes
+		}
+		first = end.Next()
+	}
+}
+
+// WriteBlocklist writes a blocklist in one of BlocklistFormats
+func WriteBlocklist(w io.Writer, format string, entries []BlocklistEntry, opts BlocklistOptions) error {
+	var v4, v6 []string
+	for _, e := range entries {
+		if e.Prefix.Addr().Is4() {
+			v4 = append(v4, e.Prefix.String())
+		} else {
+			v6 = append(v6, e.Prefix.String())
+		}
+	}
+
+	var err error
+	switch format {
+	case "cidr":
+		_, err = fmt.Fprintf(w, "# %s\n%s", opts.Description, joinLines(append(v4, v6...)))
+	case "pf":
+		_, err = fmt.Fprintf(w, "# %s\n# Load with: pfctl -f <file>, or add the table to pf.conf\ntable <%s> persist {\n%s}\nblock drop in quick from <%s> to any\n",
+			opts.Description, opts.Name, indentLines(append(v4, v6...), "\t", ","), opts.Name)
+	case "iptables":
+		var b strings.Builder
+		fmt.Fprintf(&b, "#!/bin/sh\n# %s\nset -e\n", opts.Description)
+		for _, cmd := range []struct {
+			name  string
+			addrs []string
+		}{{"iptables", v4}, {"ip6tables", v6}} {
+			if len(cmd.addrs) == 0 {
+				continue
+			}
+			fmt.Fprintf(&b, "%s -N %s 2>/dev/null || %s -F %s\n", cmd.name, opts.Name, cmd.name, opts.Name)
+			for _, a := range cmd.addrs {
+				fmt.Fprintf(&b, "%s -A %s -s %s -j DROP\n", cmd.name, opts.Name, a)
+			}
+			fmt.Fprintf(&b, "%s -C INPUT -j %s 2>/dev/null || %s -I INPUT -j %s\n", cmd.name, opts.Name, cmd.name, opts.Name)
+		}
+		_, err = io.WriteString(w, b.String())
+	case "nftables":
+		var b strings.Builder
+		fmt.Fprintf(&b, "# %s\n# Load with: nft -f <file>\ntable inet %s {\n", opts.Description, opts.Name)
+		for _, set := range []struct {
+			name, kind string
+			addrs      []string
+		}{{"blocked_v4", "ipv4_addr", v4}, {"blocked_v6", "ipv6_addr", v6}} {
+			fmt.Fprintf(&b, "\tset %s {\n\t\ttype %s\n\t\tflags interval\n", set.name, set.kind)
+			if len(set.addrs) > 0 {
+				fmt.Fprintf(&b, "\t\telements = {\n%s\t\t}\n", indentLines(set.addrs, "\t\t\t", ","))
+			}
+			b.WriteString("\t}\n")
+		}
+		b.WriteString("\tchain input {\n\t\ttype filter hook input priority filter - 10; policy accept;\n")
+		b.WriteString("\t\tip saddr @blocked_v4 drop\n\t\tip6 saddr @blocked_v6 drop\n\t}\n}\n")
+		_, err = io.WriteString(w, b.String())
+	case "cloudflare":
+		err = writeCloudflareList(w, entries)
+	case "waf-ipset":
+		err = writeWAFIPSets(w, v4, v6, opts)
+	default:
+		return fmt.Errorf("unknown blocklist format %q (want %s)", format, strings.Join(BlocklistFormats, ", "))
+	}
+	if err != nil {
+		return fmt.Errorf("failed to write blocklist: %w", err)
+	}
+	return nil
+}
+
+// writeCloudflareList writes the items of a Cloudflare IP list, as accepted by the
+// list items API. Cloudflare lists take IPv6 ranges of at most /64, so longer IPv6
+// prefixes are widened.
+func writeCloudflareList(w io.Writer, entries []BlocklistEntry) error {
+	widened := make([]BlocklistEntry, 0, len(entries))
+	for _, e := range entries {
+		if e.Prefix.Addr().Is6() && e.Prefix.Bits() > cloudflareIPv6Bits {
+			e.Prefix = netip.PrefixFrom(e.Prefix.Addr(), cloudflareIPv6Bits).Masked()
+		}
+		widened = append(widened, e)
+	}
+	type item struct {
+		IP      string `json:"ip"`
+		Comment string `json:"comment,omitempty"`
+	}
+	items := []item{}
+	for _, e := range CollapseBlocklist(widened) {
+		comment := strings.Join(e.Reasons, ", ")
+		if e.Blocked > 0 {
+			comment = fmt.Sprintf("%s; %d blocked requests", comment, e.Blocked)
+		}
+		ip := e.Prefix.String()
+		if e.Prefix.IsSingleIP() {
+			ip = e.Prefix.Addr().String()
+		}
+		items = append(items, item{IP: ip, Comment: comment})
+	}
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(items)
+}
+
+// writeWAFIPSets writes the input of aws wafv2 create-ip-set for the IPv4 and the
+// IPv6 addresses; an IP set holds a single address version
+func writeWAFIPSets(w io.Writer, v4, v6 []string, opts BlocklistOptions) error {
+	type ipSet struct {
+		Name             string   `json:"Name"`
+		Scope            string   `json:"Scope"`
+		Description      string   `json:"Description"`
+		IPAddressVersion string   `json:"IPAddressVersion"`
+		Addresses        []string `json:"Addresses"`
+	}
+	// IP set descriptions allow at most 256 characters
+	description := opts.Description
+	if len(description) > 256 {
+		description = description[:256]
+	}
+	sets := []ipSet{}
+	for _, set := range []struct {
+		suffix, version string
+		addrs           []string
+	}{{"-ipv4", "IPV4", v4}, {"-ipv6", "IPV6", v6}} {
+		if len(set.addrs) == 0 {
+			continue
+		}
+		if len(set.addrs) > wafIPSetLimit {
+			return fmt.Errorf("%d %s ranges exceed the %d addresses of an AWS WAF IP set", len(set.addrs), set.version, wafIPSetLimit)
+		}
+		sets = append(sets, ipSet{
+			Name:             opts.Name + set.suffix,
+			Scope:            opts.Scope,
+			Description:      description,
+			IPAddressVersion: set.version,
+			Addresses:        set.addrs,
+		})
+	}
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(sets)
+}
+
+// joinLines joins values with a newline after each
+func joinLines(values []string) string {
+	var b strings.Builder
+	for _, v := range values {
+		b.WriteString(v)
+		b.WriteByte('\n')
+	}
+	return b.String()
+}
+
+// indentLines writes values one per line with a prefix, separated by sep
+func indentLines(values []string, prefix, sep string) string {
+	var b strings.Builder
+	for i, v := range values {
+		b.WriteString(prefix)
+		b.WriteString(v)
+		if i < len(values)-1 {
+			b.WriteString(sep)
+		}
+		b.WriteByte('\n')
+	}
+	return b.String()
+}
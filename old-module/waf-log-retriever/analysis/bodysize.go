@@ -0,0 +1,229 @@
+package analysis
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// bodyFields holds the record fields on request body sizes. AWS WAF logs them for
+// requests with a body; older logs have neither.
+type bodyFields struct {
+	RequestBodySize               *int64 `json:"requestBodySize"`
+	RequestBodySizeInspectedByWAF *int64 `json:"requestBodySizeInspectedByWAF"`
+}
+
+// BodySizes returns the size of the request body and how much of it WAF inspected,
+// and false if the record does not log them
+func (r *Record) BodySizes() (size, inspected int64, ok bool) {
+	if r.RequestBodySize == nil || r.RequestBodySizeInspectedByWAF == nil {
+		return 0, 0, false
+	}
+	return *r.RequestBodySize, *r.RequestBodySizeInspectedByWAF, true
+}
+
+// BodyInspectionStats counts requests whose body was larger than the part WAF
+// inspected
+type BodyInspectionStats struct {
+	WithBody         int64            `json:"withBody"`         // Requests with a non-empty body
+	Oversize         int64            `json:"oversize"`         // Bodies beyond the inspection limit
+	MaxBodySize      int64            `json:"maxBodySize"`      // Largest body, in bytes
+	InspectionLimit  int64            `json:"inspectionLimit"`  // Most bytes WAF inspected of an oversize body
+	OversizeActions  map[string]int64 `json:"oversizeActions"`  // Oversize requests by action
+	OversizeURIs     map[string]int64 `json:"oversizeUris"`     // Oversize requests by URI
+	OversizeRules    map[string]int64 `json:"oversizeRules"`    // Oversize requests by terminating rule
+	OversizeByMethod map[string]int64 `json:"oversizeByMethod"` // Oversize requests by HTTP method
+}
+
+// NewBodyInspectionStats creates an empty BodyInspectionStats instance
+func NewBodyInspectionStats() *BodyInspectionStats {
+	return &BodyInspectionStats{
+		OversizeActions:  make(map[string]int64),
+		OversizeURIs:     make(map[string]int64),
+		OversizeRules:    make(map[string]int64),
+		OversizeByMethod: make(map[string]int64),
+	}
+}
+
+// Add folds the body sizes of a record into the aggregate
+func (b *BodyInspectionStats) Add(r *Record, size, inspected int64) {
+	if size <= 0 {
+		return
+	}
+	b.WithBody++
+	if size > b.MaxBodySize {
+		b.MaxBodySize = size
+	}
+	if size <= inspected {
+		return
+	}
+	b.Oversize++
+	if inspected > b.InspectionLimit {
+		b.InspectionLimit = inspected
+	}
+	b.OversizeActions[r.Action]++
+	b.OversizeURIs[r.HTTPRequest.URI]++
+	b.OversizeRules[r.TerminatingRuleID]++
+	b.OversizeByMethod[r.HTTPRequest.HTTPMethod]++
+}
+
+// merge folds another body inspection aggregate into b
+func (b *BodyInspectionStats) merge(o *BodyInspectionStats) {
+	b.WithBody += o.WithBody
+	b.Oversize += o.Oversize
+	if o.MaxBodySize > b.MaxBodySize {
+		b.MaxBodySize = o.MaxBodySize
+	}
+	if o.InspectionLimit > b.InspectionLimit {
+		b.InspectionLimit = o.InspectionLimit
+	}
+	mergeCounts(b.OversizeActions, o.OversizeActions)
+	mergeCounts(b.OversizeURIs, o.OversizeURIs)
+	mergeCounts(b.OversizeRules, o.OversizeRules)
+	mergeCounts(b.OversizeByMethod, o.OversizeByMethod)
+}
+
+// OversizeHandling is how a rule of the Web ACL treats the part of a request
+// component beyond the inspection limit
+type OversizeHandling struct {
+	Rule     string `json:"rule"`
+	Field    string `json:"field"`    // Body, JsonBody, Headers or Cookies
+	Handling string `json:"handling"` // CONTINUE, MATCH or NO_MATCH
+}
+
+// BodyInspectionReport relates the oversize requests in the logs to the Web ACL's
+// body inspection limits and oversize handling
+type BodyInspectionReport struct {
+	RequestsWithBody int64              `json:"requestsWithBody"`
+	Oversize         int64              `json:"oversize"`
+	OversizeShare    float64            `json:"oversizeShare"` // Percentage of requests with a body
+	OversizeAllowed  int64              `json:"oversizeAllowed"`
+	MaxBodySize      int64              `json:"maxBodySize"`
+	InspectionLimit  int64              `json:"inspectionLimit"` // Observed, in bytes
+	OversizeActions  map[string]int64   `json:"oversizeActions"`
+	TopURIs          []Count            `json:"topUris"`
+	TopRules         []Count            `json:"topRules"`
+	Methods          []Count            `json:"methods"`
+	SizeLimits       map[string]string  `json:"sizeLimits,omitempty"` // Configured limit by resource type, e.g. "CLOUDFRONT": "KB_16"
+	Handling         []OversizeHandling `json:"handling"`             // From the Web ACL snapshot, if available
+}
+
+// BuildBodyInspectionReport summarizes the body inspection aggregate, with the
+// oversize handling of each rule when a Web ACL snapshot is given
+func BuildBodyInspectionReport(b *BodyInspectionStats, snapshot map[string]interface{}) *BodyInspectionReport {
+	report := &BodyInspectionReport{
+		RequestsWithBody: b.WithBody,
+		Oversize:         b.Oversize,
+		OversizeAllowed:  b.OversizeActions["ALLOW"],
+		MaxBodySize:      b.MaxBodySize,
+		InspectionLimit:  b.InspectionLimit,
+		OversizeActions:  b.OversizeActions,
+		TopURIs:          TopN(b.OversizeURIs, 10),
+		TopRules:         TopN(b.OversizeRules, 10),
+		Methods:          TopN(b.OversizeByMethod, 0),
+		Handling:         []OversizeHandling{},
+	}
+	if b.WithBody > 0 {
+		report.OversizeShare = 100 * float64(b.Oversize) / float64(b.WithBody)
+	}
+	if snapshot == nil {
+		return report
+	}
+
+	webACL, _ := snapshot["webACL"].(map[string]interface{})
+	association, _ := webACL["AssociationConfig"].(map[string]interface{})
+	requestBody, _ := association["RequestBody"].(map[string]interface{})
+	for resourceType, v := range requestBody {
+		config, _ := v.(map[string]interface{})
+		if limit, _ := config["DefaultSizeInspectionLimit"].(string); limit != "" {
+			if report.SizeLimits == nil {
+				report.SizeLimits = make(map[string]string)
+			}
+			report.SizeLimits[resourceType] = limit
+		}
+	}
+	for _, rule := range asSlice(webACL["Rules"]) {
+		name, _ := rule["Name"].(string)
+		report.Handling = append(report.Handling, oversizeHandling(name, rule["Statement"])...)
+	}
+	return report
+}
+
+// oversizeHandling returns the oversize handling of every field a statement and its
+// nested statements inspect
+func oversizeHandling(rule string, v interface{}) []OversizeHandling {
+	var handling []OversizeHandling
+	switch v := v.(type) {
+	case map[string]interface{}:
+		if fields, ok := v["FieldToMatch"].(map[string]interface{}); ok {
+			for field, f := range fields {
+				options, _ := f.(map[string]interface{})
+				if h, _ := options["OversizeHandling"].(string); h != "" {
+					handling = append(handling, OversizeHandling{Rule: rule, Field: field, Handling: h})
+				}
+			}
+		}
+		keys := make([]string, 0, len(v))
+		for key := range v {
+			if key != "FieldToMatch" {
+				keys = append(keys, key)
+			}
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			handling = append(handling, oversizeHandling(rule, v[key])...)
+		}
+	case []interface{}:
+		for _, item := range v {
+			handling = append(handling, oversizeHandling(rule, item)...)
+		}
+	}
+	return handling
+}
+
+// BodyInspectionFindings reports oversize requests that WAF allowed, naming the
+// rules whose oversize handling lets the uninspected part of a body through
+func BodyInspectionFindings(webACLName string, report *BodyInspectionReport) []Finding {
+	if report == nil || report.OversizeAllowed == 0 {
+		return nil
+	}
+	var passing []string
+	for _, h := range report.Handling {
+		if h.Field == "Body" || h.Field == "JsonBody" {
+			if h.Handling != "MATCH" {
+				passing = append(passing, fmt.Sprintf("%s (%s %s)", h.Rule, h.Field, h.Handling))
+			}
+		}
+	}
+
+	severity := SeverityMedium
+	description := fmt.Sprintf("Web ACL %s allowed %d requests whose body exceeded the %d bytes WAF inspected (%.1f%% of requests with a body; largest %d bytes). Content beyond the limit is never inspected, so payloads placed there bypass every body rule.",
+		webACLName, report.OversizeAllowed, report.InspectionLimit, report.OversizeShare, report.MaxBodySize)
+	if len(passing) > 0 {
+		severity = SeverityHigh
+		description += fmt.Sprintf(" Rules that inspect the body but do not match oversize bodies: %s.", strings.Join(passing, ", "))
+	}
+	if len(report.TopURIs) > 0 {
+		description += fmt.Sprintf(" Most affected URIs: %s.", formatTopCounts(report.TopURIs, 5))
+	}
+	description += " Set oversize handling to MATCH on a blocking body rule, block bodies above the limit with a size constraint rule where large uploads are not expected, or raise the body inspection limit of CloudFront, API Gateway, Cognito, App Runner and Verified Access resources (up to 64 KB)."
+	return []Finding{{
+		ID:          "body-inspection-oversize",
+		Severity:    severity,
+		Title:       fmt.Sprintf("%d requests with bodies beyond the inspection limit were allowed", report.OversizeAllowed),
+		Description: description,
+		Source:      "body-inspection",
+	}}
+}
+
+// formatTopCounts formats the first n counts as "a (3), b (1)"
+func formatTopCounts(counts []Count, n int) string {
+	if len(counts) > n {
+		counts = counts[:n]
+	}
+	parts := make([]string, 0, len(counts))
+	for _, c := range counts {
+		parts = append(parts, fmt.Sprintf("%s (%d)", c.Key, c.Count))
+	}
+	return strings.Join(parts, ", ")
+}
@@ -0,0 +1,142 @@
+package analysis
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"waf-log-retriever/logging"
+	"waf-log-retriever/storage"
+)
+
+// CacheDirName is the directory, inside a Web ACL's analysis directory, holding the
+// cached aggregates of log chunks
+const CacheDirName = "cache"
+
+// logChunk is a group of log files cached together: the files of one directory,
+// which the retriever lays out by date
+type logChunk struct {
+	dir   string
+	files []string
+}
+
+// AnalyzeIncremental aggregates every WAF log file below dir like AnalyzeDirectory,
+// but caches the partial aggregate of each log directory in cacheDir. A chunk is only parsed
+// again when its files or the settings change, so re-analyzing after retrieving
+// another day only parses the new day's logs. Parsed chunks are read through the
+// record cache if one is given.
+func AnalyzeIncremental(dir, cacheDir string, settings *Settings, records *RecordCache, logger logging.Logger) (*Stats, int, error) {
+	files, err := ListLogFiles(dir)
+	if err != nil {
+		return nil, 0, err
+	}
+	logger.Infof("Found %d log files under %s", len(files), dir)
+
+	settingsJSON, err := json.Marshal(settings)
+	if err != nil {
+		return nil, 0, fmt.Errorf("failed to encode settings: %w", err)
+	}
+	if err := os.MkdirAll(cacheDir, 0755); err != nil {
+		return nil, 0, fmt.Errorf("failed to create cache directory: %w", err)
+	}
+
+	stats := NewStats(settings)
+	var skipped int64
+	var cached, parsed int
+	keep := make(map[string]bool)
+	for _, chunk := range chunkFiles(files) {
+		key, err := chunkKey(dir, chunk, settingsJSON)
+		if err != nil {
+			return nil, 0, err
+		}
+		path := filepath.Join(cacheDir, key+PartialExtension)
+		keep[path] = true
+
+		p, err := readCachedPartial(path)
+		if err != nil {
+			logger.Warningf("Ignoring cached aggregate %s: %v", path, err)
+		}
+		if p != nil {
+			logger.Debugf("Using cached aggregate of %s", chunk.dir)
+			cached++
+		} else {
+			if p, err = AggregatePartial(dir, chunk.files, settings, records, logger); err != nil {
+				return nil, 0, err
+			}
+			if err := WritePartial(path, p); err != nil {
+				logger.Warningf("Failed to cache aggregate of %s: %v", chunk.dir, err)
+			}
+			parsed++
+		}
+		stats.Merge(p.Stats)
+		skipped += p.Header.Skipped
+	}
+	pruneCache(cacheDir, keep, logger)
+	records.Prune(files)
+
+	logger.Infof("Parsed %d log directories, reused %d from the cache", parsed, cached)
+	logAggregate(stats, skipped, logger)
+	return stats, len(files), nil
+}
+
+// chunkFiles groups log files by directory, keeping their order
+func chunkFiles(files []string) []logChunk {
+	var chunks []logChunk
+	for _, file := range files {
+		dir := filepath.Dir(file)
+		if len(chunks) == 0 || chunks[len(chunks)-1].dir != dir {
+			chunks = append(chunks, logChunk{dir: dir})
+		}
+		chunks[len(chunks)-1].files = append(chunks[len(chunks)-1].files, file)
+	}
+	return chunks
+}
+
+// chunkKey hashes what the aggregate of a chunk depends on: the partial schema
+// version, the settings and the path, size and modification time of each file
+func chunkKey(root string, chunk logChunk, settingsJSON []byte) (string, error) {
+	h := sha256.New()
+	fmt.Fprintf(h, "v%d\n%s\n", PartialSchemaVersion, settingsJSON)
+	for _, file := range chunk.files {
+		info, err := os.Stat(file)
+		if err != nil {
+			return "", fmt.Errorf("failed to stat log file: %w", err)
+		}
+		rel, err := filepath.Rel(root, file)
+		if err != nil {
+			rel = file
+		}
+		fmt.Fprintf(h, "%s\t%d\t%d\n", filepath.ToSlash(rel), info.Size(), info.ModTime().UnixNano())
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// readCachedPartial reads a cached partial aggregate, returning nil if there is none
+func readCachedPartial(path string) (*Partial, error) {
+	if _, err := os.Stat(path); os.IsNotExist(err) {
+		return nil, nil
+	}
+	return ReadPartial(path)
+}
+
+// pruneCache removes cached aggregates of chunks that changed or no longer exist
+func pruneCache(cacheDir string, keep map[string]bool, logger logging.Logger) {
+	entries, err := os.ReadDir(cacheDir)
+	if err != nil {
+		logger.Warningf("Failed to list cache: %v", err)
+		return
+	}
+	for _, e := range entries {
+		path := filepath.Join(cacheDir, e.Name())
+		if e.IsDir() || keep[path] || !(strings.HasSuffix(e.Name(), PartialExtension) || storage.IsTempFile(e.Name())) {
+			continue
+		}
+		if err := os.Remove(path); err != nil {
+			logger.Warningf("Failed to remove stale cache entry %s: %v", path, err)
+		}
+	}
+}
@@ -0,0 +1,152 @@
+package analysis
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// ExpensiveRuleWCU is the capacity from which a rule that rarely matches is worth
+// reporting; cheaper rules cost too little to be worth reviewing
+const ExpensiveRuleWCU = 50
+
+// lowValueMatchRate is the share of requests below which a rule counts as rarely
+// matching: fewer than 1 in 10,000
+const lowValueMatchRate = 0.0001
+
+// RuleEfficiency is what a Web ACL rule costs in WCUs against how often it matched
+type RuleEfficiency struct {
+	Rule          string  `json:"rule"`
+	Priority      int64   `json:"priority"`
+	Statement     string  `json:"statement"` // Top-level statement type, e.g. "ManagedRuleGroupStatement"
+	RuleGroupID   string  `json:"ruleGroupId,omitempty"`
+	Action        string  `json:"action"` // Rule action, or the override action of a rule group
+	WCU           int64   `json:"wcu"`
+	Matches       int64   `json:"matches"`       // Terminating and non-terminating matches
+	MatchesPerWCU float64 `json:"matchesPerWcu"` // Matches per capacity unit
+	WCUShare      float64 `json:"wcuShare"`      // Percentage of the WCUs of all checked rules
+}
+
+// RuleEfficiencyReport relates the capacity of each rule in a Web ACL snapshot to
+// the matches it had in the logs, by rule priority. It returns nil when the snapshot
+// predates per-rule capacity checks.
+func RuleEfficiencyReport(snapshot map[string]interface{}, stats *Stats) []RuleEfficiency {
+	capacities, ok := snapshot["ruleCapacities"].(map[string]interface{})
+	if !ok {
+		return nil
+	}
+	webACL, _ := snapshot["webACL"].(map[string]interface{})
+
+	var total float64
+	for _, c := range capacities {
+		wcu, _ := c.(float64)
+		total += wcu
+	}
+
+	var report []RuleEfficiency
+	for _, rule := range asSlice(webACL["Rules"]) {
+		name, _ := rule["Name"].(string)
+		wcu, ok := capacities[name].(float64)
+		if !ok {
+			continue // Its capacity check failed
+		}
+		priority, _ := rule["Priority"].(float64)
+		statement, _ := rule["Statement"].(map[string]interface{})
+		e := RuleEfficiency{
+			Rule:      name,
+			Priority:  int64(priority),
+			Statement: statementType(statement),
+			Action:    ruleAction(rule),
+			WCU:       int64(wcu),
+		}
+
+		if groupID, group := ruleGroupOf(statement); group != nil {
+			e.RuleGroupID = groupID
+			for id, rules := range stats.RuleGroups {
+				// Log IDs of managed groups may carry a version suffix
+				if id != groupID && !strings.HasPrefix(id, groupID+"#") {
+					continue
+				}
+				for _, counts := range rules {
+					e.Matches += counts.Terminating + counts.Count + counts.Overridden + counts.Excluded
+				}
+			}
+		} else {
+			e.Matches = stats.TerminatingRules[name] + stats.NonTerminatingRules[name]
+		}
+		if e.WCU > 0 {
+			e.MatchesPerWCU = float64(e.Matches) / float64(e.WCU)
+		}
+		if total > 0 {
+			e.WCUShare = 100 * wcu / total
+		}
+		report = append(report, e)
+	}
+	sort.SliceStable(report, func(i, j int) bool { return report[i].Priority < report[j].Priority })
+	return report
+}
+
+// statementType returns the key of a rule's top-level statement; snapshots list the
+// other statement types as null
+func statementType(statement map[string]interface{}) string {
+	for key, v := range statement {
+		if v != nil {
+			return key
+		}
+	}
+	return ""
+}
+
+// ruleAction returns the action of a rule, upper-cased as in logs, or the override
+// action of a rule group
+func ruleAction(rule map[string]interface{}) string {
+	for _, key := range []string{"Action", "OverrideAction"} {
+		action, _ := rule[key].(map[string]interface{})
+		for name, v := range action {
+			if v != nil {
+				return strings.ToUpper(name)
+			}
+		}
+	}
+	return ""
+}
+
+// RuleEfficiencyFindings reports expensive rules that almost never matched, and how
+// much capacity consolidating or removing them would free
+func RuleEfficiencyFindings(webACLName string, report []RuleEfficiency, totalRequests int64) []Finding {
+	if len(report) == 0 || totalRequests == 0 {
+		return nil
+	}
+	var findings []Finding
+	var lowValue []string
+	var freed int64
+	for _, e := range report {
+		if e.WCU < ExpensiveRuleWCU || float64(e.Matches) >= lowValueMatchRate*float64(totalRequests) {
+			continue
+		}
+		kind := "rule"
+		if e.RuleGroupID != "" {
+			kind = "rule group " + e.RuleGroupID
+		}
+		findings = append(findings, Finding{
+			ID:       "expensive-rule-unmatched",
+			Severity: SeverityLow,
+			Title:    fmt.Sprintf("Rule %s uses %d WCUs but matched %d of %d requests", e.Rule, e.WCU, e.Matches, totalRequests),
+			Description: fmt.Sprintf("Rule %s (%s) of Web ACL %s takes %d WCUs, %.1f%% of the capacity of its rules, and matched %d requests in the analyzed logs. If the traffic it guards against is not expected, remove it, or merge its conditions into a cheaper rule with the same action.",
+				e.Rule, kind, webACLName, e.WCU, e.WCUShare, e.Matches),
+			Source: "capacity",
+		})
+		lowValue = append(lowValue, fmt.Sprintf("%s (%d WCUs)", e.Rule, e.WCU))
+		freed += e.WCU
+	}
+	if len(lowValue) > 1 {
+		findings = append(findings, Finding{
+			ID:          "low-value-capacity",
+			Severity:    SeverityInfo,
+			Title:       fmt.Sprintf("%d WCUs are spent on %d rules that rarely match", freed, len(lowValue)),
+			Description: fmt.Sprintf("Web ACL %s spends %d WCUs on rules that matched fewer than 1 in %d requests: %s. Consolidating or removing them frees capacity for rules that match the observed attacks.", webACLName, freed, int(1/lowValueMatchRate), strings.Join(lowValue, ", ")),
+			Source:      "capacity",
+		})
+	}
+	return findings
+}
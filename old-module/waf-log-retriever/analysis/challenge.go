@@ -0,0 +1,239 @@
+package analysis
+
+import (
+	"fmt"
+	"slices"
+	"sort"
+	"strings"
+)
+
+// maxChallengeSegments caps the traffic segments tracked for challenge candidates
+const maxChallengeSegments = 20000
+
+// maxChallengeFindings caps the challenge candidates reported as findings
+const maxChallengeFindings = 10
+
+// asnLabelPrefix is the prefix of the label AWS WAF adds with the client IP's ASN
+const asnLabelPrefix = "awswaf:clientip:asn:"
+
+// botControlLabelPrefix is the prefix of the labels the Bot Control rule group adds
+const botControlLabelPrefix = "awswaf:managed:aws:bot-control:"
+
+// automationRuleGroups are the managed rule groups that block automation rather than
+// attack payloads
+var automationRuleGroups = []string{"AWSManagedRulesBotControlRuleSet", "AWSManagedRulesAnonymousIpList", "AWSManagedRulesAmazonIpReputationList"}
+
+// ChallengeSettings configure the CAPTCHA and Challenge candidate detector
+type ChallengeSettings struct {
+	MinRequests        int64   `json:"minRequests"`        // Requests a segment needs to be a candidate
+	MinAutomationShare float64 `json:"minAutomationShare"` // Share of its requests that must be blocked or labeled as automation
+	MaxAttackShare     float64 `json:"maxAttackShare"`     // Share of its requests that may match an attack category or come from a scanner
+	MinBrowserShare    float64 `json:"minBrowserShare"`    // Share of its requests that must have a browser User-Agent
+}
+
+// ChallengeCounts aggregates the requests of one traffic segment: an ASN, a TLS
+// fingerprint or a path
+type ChallengeCounts struct {
+	Requests   int64            `json:"requests"`
+	Blocked    int64            `json:"blocked"`
+	Automation int64            `json:"automation"` // Blocked by a rate-based or automation rule, or labeled by Bot Control
+	Attacks    int64            `json:"attacks"`    // Matching an attack category or from a scanner
+	Browser    int64            `json:"browser"`    // With a browser User-Agent
+	Challenged int64            `json:"challenged"` // Already answered with CAPTCHA or CHALLENGE
+	Logins     int64            `json:"logins"`     // Login attempts, see AuthSettings
+	Rules      map[string]int64 `json:"rules"`      // Rules that blocked the segment's automation
+}
+
+// challengeSegments returns the segment keys of a record: "asn:<number>",
+// "ja4:<fingerprint>" (or "ja3:" without JA4) and "path:<uri>"
+func challengeSegments(r *Record) []string {
+	segments := []string{"path:" + r.HTTPRequest.URI}
+	if r.JA4Fingerprint != "" {
+		segments = append(segments, fingerprintKey("ja4", r.JA4Fingerprint))
+	} else if r.JA3Fingerprint != "" {
+		segments = append(segments, fingerprintKey("ja3", r.JA3Fingerprint))
+	}
+	for _, label := range r.Labels {
+		if asn, ok := strings.CutPrefix(label.Name, asnLabelPrefix); ok {
+			segments = append(segments, "asn:"+asn)
+			break
+		}
+	}
+	return segments
+}
+
+// automationRule returns the rule that blocked a record as automation, or "" if it
+// was not blocked by a rate-based or automation rule
+func automationRule(r *Record) string {
+	if r.Action != "BLOCK" {
+		return ""
+	}
+	if r.TerminatingRuleType == "RATE_BASED" {
+		return r.TerminatingRuleID
+	}
+	for _, g := range r.RuleGroupList {
+		if g.TerminatingRule == nil {
+			continue
+		}
+		for _, group := range automationRuleGroups {
+			if strings.Contains(g.RuleGroupID, group) {
+				return g.TerminatingRule.RuleID
+			}
+		}
+	}
+	return ""
+}
+
+// addChallenge folds a record into the counts of its traffic segments
+func (s *Stats) addChallenge(r *Record, categories []string, scanner string) {
+	rule := automationRule(r)
+	automation := rule != "" || slices.ContainsFunc(r.Labels, func(l Label) bool { return strings.HasPrefix(l.Name, botControlLabelPrefix) })
+	browser := strings.HasPrefix(r.HeaderValue("User-Agent"), "Mozilla/")
+	login := s.settings.Auth.isLoginAttempt(r)
+	for _, segment := range challengeSegments(r) {
+		counts, ok := s.Challenge[segment]
+		if !ok {
+			if len(s.Challenge) >= maxChallengeSegments {
+				continue
+			}
+			counts = &ChallengeCounts{Rules: make(map[string]int64)}
+			s.Challenge[segment] = counts
+		}
+		counts.Requests++
+		if r.Action == "BLOCK" {
+			counts.Blocked++
+		}
+		if automation {
+			counts.Automation++
+		}
+		if len(categories) > 0 || scanner != "" {
+			counts.Attacks++
+		}
+		if browser {
+			counts.Browser++
+		}
+		if r.Action == "CAPTCHA" || r.Action == "CHALLENGE" {
+			counts.Challenged++
+		}
+		if login {
+			counts.Logins++
+		}
+		if rule != "" {
+			counts.Rules[rule]++
+		}
+	}
+}
+
+// merge folds the counts of the same segment from other records into c
+func (c *ChallengeCounts) merge(o *ChallengeCounts) {
+	c.Requests += o.Requests
+	c.Blocked += o.Blocked
+	c.Automation += o.Automation
+	c.Attacks += o.Attacks
+	c.Browser += o.Browser
+	c.Challenged += o.Challenged
+	c.Logins += o.Logins
+	mergeCounts(c.Rules, o.Rules)
+}
+
+// ChallengeCandidate is a traffic segment of gray-area automation: automated enough
+// to act on, but not attacking and mostly from browsers, so that a CAPTCHA or
+// Challenge action lets its humans through where BLOCK would not
+type ChallengeCandidate struct {
+	Kind            string  `json:"kind"` // asn, ja3, ja4 or path
+	Value           string  `json:"value"`
+	Requests        int64   `json:"requests"`
+	Blocked         int64   `json:"blocked"`
+	Automation      int64   `json:"automation"`
+	AutomationShare float64 `json:"automationShare"` // Percentage of the segment's requests
+	AttackShare     float64 `json:"attackShare"`
+	BrowserShare    float64 `json:"browserShare"`
+	Rules           []Count `json:"rules"`           // Rules blocking the automation, whose action to change
+	SuggestedAction string  `json:"suggestedAction"` // CAPTCHA or CHALLENGE
+	Suggestion      string  `json:"suggestion"`
+}
+
+// ChallengeCandidates lists the traffic segments where CAPTCHA or Challenge fits
+// better than BLOCK or ALLOW, most automation first
+func ChallengeCandidates(stats *Stats, settings ChallengeSettings) []ChallengeCandidate {
+	candidates := []ChallengeCandidate{}
+	for key, c := range stats.Challenge {
+		if c.Requests < settings.MinRequests || 2*c.Challenged >= c.Requests {
+			continue
+		}
+		share := func(n int64) float64 { return float64(n) / float64(c.Requests) }
+		if share(c.Automation) < settings.MinAutomationShare || share(c.Attacks) > settings.MaxAttackShare || share(c.Browser) < settings.MinBrowserShare {
+			continue
+		}
+		kind, value, _ := strings.Cut(key, ":")
+		candidate := ChallengeCandidate{
+			Kind:            kind,
+			Value:           value,
+			Requests:        c.Requests,
+			Blocked:         c.Blocked,
+			Automation:      c.Automation,
+			AutomationShare: 100 * share(c.Automation),
+			AttackShare:     100 * share(c.Attacks),
+			BrowserShare:    100 * share(c.Browser),
+			Rules:           TopN(c.Rules, 5),
+			SuggestedAction: "CHALLENGE",
+		}
+		// A silent challenge does not stop automated browsers on login forms; a
+		// CAPTCHA puts a human in front of the attempt
+		if 2*c.Logins >= c.Requests {
+			candidate.SuggestedAction = "CAPTCHA"
+		}
+		candidate.Suggestion = challengeSuggestion(candidate)
+		candidates = append(candidates, candidate)
+	}
+	sort.Slice(candidates, func(i, j int) bool {
+		if candidates[i].Automation != candidates[j].Automation {
+			return candidates[i].Automation > candidates[j].Automation
+		}
+		return candidates[i].Kind+candidates[i].Value < candidates[j].Kind+candidates[j].Value
+	})
+	return candidates
+}
+
+// challengeSegmentName names the segment of a candidate, e.g. "AS16509"
+func challengeSegmentName(c ChallengeCandidate) string {
+	switch c.Kind {
+	case "asn":
+		return "AS" + c.Value
+	case "ja3", "ja4":
+		return upperKind(c.Kind) + " fingerprint " + c.Value
+	}
+	return "path " + c.Value
+}
+
+// challengeSuggestion describes the action change for a candidate
+func challengeSuggestion(c ChallengeCandidate) string {
+	if len(c.Rules) == 0 {
+		return fmt.Sprintf("Add a rule with action %s for the requests of %s that Bot Control labels as automation", c.SuggestedAction, challengeSegmentName(c))
+	}
+	rules := make([]string, len(c.Rules))
+	for i, rule := range c.Rules {
+		rules[i] = rule.Key
+	}
+	return fmt.Sprintf("Change the action of %s from BLOCK to %s for the requests of %s", strings.Join(rules, ", "), c.SuggestedAction, challengeSegmentName(c))
+}
+
+// ChallengeFindings reports the strongest challenge candidates
+func ChallengeFindings(webACLName string, candidates []ChallengeCandidate) []Finding {
+	var findings []Finding
+	for _, c := range candidates[:min(len(candidates), maxChallengeFindings)] {
+		current := "ALLOW"
+		if len(c.Rules) > 0 {
+			current = "BLOCK"
+		}
+		findings = append(findings, Finding{
+			ID:       "challenge-candidate",
+			Severity: SeverityLow,
+			Title:    fmt.Sprintf("Automation from %s suits %s better than %s", challengeSegmentName(c), c.SuggestedAction, current),
+			Description: fmt.Sprintf("%.0f%% of the %d requests of %s to Web ACL %s were automation (%d blocked), yet %.0f%% carried a browser User-Agent and only %.1f%% matched an attack category or came from a scanner. %s: browsers that solve it keep working while scripts are stopped, and every outcome is logged.",
+				c.AutomationShare, c.Requests, challengeSegmentName(c), webACLName, c.Blocked, c.BrowserShare, c.AttackShare, c.Suggestion),
+			Source: "challenge",
+		})
+	}
+	return findings
+}
@@ -0,0 +1,97 @@
+package analysis
+
+// ClassStats aggregates the requests to one endpoint class
+type ClassStats struct {
+	Requests         int64            `json:"requests"`
+	Blocked          int64            `json:"blocked"`
+	Actions          map[string]int64 `json:"actions"`
+	TerminatingRules map[string]int64 `json:"terminatingRules"`
+	Methods          map[string]int64 `json:"methods"`
+	ClientIPs        map[string]int64 `json:"clientIps"`
+	Endpoints        map[string]int64 `json:"endpoints"`        // By endpoint template, see EndpointTemplate
+	AttackCategories map[string]int64 `json:"attackCategories"` // Requests by OWASP Top 10 category ID
+}
+
+// addEndpointClass folds a record into the statistics of its endpoint class
+func (s *Stats) addEndpointClass(r *Record, attackCategories []string, client string) {
+	class := s.settings.ClassifyEndpoint(r.HTTPRequest.URI)
+	if class == "" {
+		return
+	}
+	c, ok := s.EndpointClasses[class]
+	if !ok {
+		c = &ClassStats{
+			Actions:          make(map[string]int64),
+			TerminatingRules: make(map[string]int64),
+			Methods:          make(map[string]int64),
+			ClientIPs:        make(map[string]int64),
+			Endpoints:        make(map[string]int64),
+			AttackCategories: make(map[string]int64),
+		}
+		s.EndpointClasses[class] = c
+	}
+
+	c.Requests++
+	if r.Action == "BLOCK" {
+		c.Blocked++
+	}
+	c.Actions[r.Action]++
+	c.TerminatingRules[r.TerminatingRuleID]++
+	c.Methods[r.HTTPRequest.HTTPMethod]++
+	c.ClientIPs[client]++
+	c.Endpoints[EndpointTemplate(r.HTTPRequest.URI)]++
+	for _, category := range attackCategories {
+		c.AttackCategories[category]++
+	}
+}
+
+// ClassSummary is the report breakdown of one endpoint class
+type ClassSummary struct {
+	Class            string           `json:"class"`
+	Requests         int64            `json:"requests"`
+	Blocked          int64            `json:"blocked"`
+	ClientIPs        int              `json:"clientIps"`
+	Actions          map[string]int64 `json:"actions"`
+	AttackCategories map[string]int64 `json:"attackCategories"`
+	Findings         int              `json:"findings"` // Findings about endpoints of the class
+	TopEndpoints     []Count          `json:"topEndpoints"`
+	TopRules         []Count          `json:"topRules"`
+	TopClientIPs     []Count          `json:"topClientIps"`
+}
+
+// ClassBreakdown summarizes the endpoint classes in configuration order, followed by
+// OtherEndpointClass
+func ClassBreakdown(stats *Stats, findings []Finding) []ClassSummary {
+	findingCounts := make(map[string]int)
+	for _, f := range findings {
+		if f.EndpointClass != "" {
+			findingCounts[f.EndpointClass]++
+		}
+	}
+
+	var breakdown []ClassSummary
+	names := make([]string, 0, len(stats.settings.EndpointClasses)+1)
+	for _, class := range stats.settings.EndpointClasses {
+		names = append(names, class.Name)
+	}
+	names = append(names, OtherEndpointClass)
+	for _, name := range names {
+		c, ok := stats.EndpointClasses[name]
+		if !ok {
+			continue
+		}
+		breakdown = append(breakdown, ClassSummary{
+			Class:            name,
+			Requests:         c.Requests,
+			Blocked:          c.Blocked,
+			ClientIPs:        len(c.ClientIPs),
+			Actions:          c.Actions,
+			AttackCategories: c.AttackCategories,
+			Findings:         findingCounts[name],
+			TopEndpoints:     TopN(c.Endpoints, 10),
+			TopRules:         TopN(c.TerminatingRules, 10),
+			TopClientIPs:     TopN(c.ClientIPs, 10),
+		})
+	}
+	return breakdown
+}
@@ -0,0 +1,122 @@
+package analysis
+
+// Columns of the big count tables of a Stats, see recordColumns
+const (
+	columnAction = iota
+	columnTerminatingRule
+	columnCountry
+	columnClient
+	columnBlockedIP
+	columnURI
+	columnMethod
+	numColumns
+)
+
+// columnBatchSize is the number of records a column buffers before counting them
+const columnBatchSize = 1024
+
+// stringColumn is a dictionary-encoded column of one string field of the records
+// added to a Stats. Each distinct value is stored once and records refer to it by
+// index, so the column holds no string per record and its counts are a flat slice
+// without pointers for the garbage collector to scan.
+type stringColumn struct {
+	dict   map[string]uint32
+	values []string // By index
+	counts []int64  // By index, up to the last count
+	batch  []uint32 // Indexes of the values added since the last count
+}
+
+// add appends the value of a record, counting the batch once it is full
+func (c *stringColumn) add(value string) {
+	id, ok := c.dict[value]
+	if !ok {
+		if c.dict == nil {
+			c.dict = make(map[string]uint32)
+			c.batch = make([]uint32, 0, columnBatchSize)
+		}
+		id = uint32(len(c.values))
+		c.dict[value] = id
+		c.values = append(c.values, value)
+		c.counts = append(c.counts, 0)
+	}
+	c.batch = append(c.batch, id)
+	if len(c.batch) == columnBatchSize {
+		c.count()
+	}
+}
+
+// count adds the batch to the counts in one pass over it
+func (c *stringColumn) count() {
+	counts := c.counts
+	for _, id := range c.batch {
+		counts[id]++
+	}
+	c.batch = c.batch[:0]
+}
+
+// flush adds the counts of the column to a count map and empties the column
+func (c *stringColumn) flush(into map[string]int64) {
+	c.count()
+	for id, n := range c.counts {
+		if n > 0 {
+			into[c.values[id]] += n
+		}
+	}
+	*c = stringColumn{}
+}
+
+// recordColumns holds the fields of the records added to a Stats that its big count
+// tables count, by column, until Finalize adds them to the tables
+type recordColumns [numColumns]stringColumn
+
+// countTables returns the count table of each column
+func (s *Stats) countTables() [numColumns]map[string]int64 {
+	return [numColumns]map[string]int64{
+		columnAction:          s.Actions,
+		columnTerminatingRule: s.TerminatingRules,
+		columnCountry:         s.Countries,
+		columnClient:          s.ClientIPs,
+		columnBlockedIP:       s.BlockedIPs,
+		columnURI:             s.URIs,
+		columnMethod:          s.Methods,
+	}
+}
+
+// addColumns appends the fields of a record the big count tables count to the
+// columns of the aggregate
+func (s *Stats) addColumns(r *Record, client string) {
+	if s.columns == nil {
+		s.columns = new(recordColumns)
+	}
+	c := s.columns
+	c[columnAction].add(r.Action)
+	c[columnTerminatingRule].add(r.TerminatingRuleID)
+	c[columnCountry].add(r.HTTPRequest.Country)
+	c[columnClient].add(client)
+	c[columnURI].add(r.HTTPRequest.URI)
+	c[columnMethod].add(r.HTTPRequest.HTTPMethod)
+	if r.Action == "BLOCK" {
+		c[columnBlockedIP].add(s.settings.ClientIP(r))
+	}
+}
+
+// Finalize adds the columns of the aggregate, and of its per-host and authorized
+// testing aggregates, to their count tables. The tables, from Actions to Methods,
+// are complete only after it: callers of Add call it once their records are added,
+// before reading, merging or encoding the aggregate. Records may be added after it,
+// and it may be called again.
+func (s *Stats) Finalize() {
+	if s.columns != nil {
+		tables := s.countTables()
+		for i := range s.columns {
+			s.columns[i].flush(tables[i])
+		}
+		s.columns = nil
+	}
+	for _, hostStats := range s.Hosts {
+		hostStats.Finalize()
+	}
+	if s.AuthorizedTesting != nil {
+		s.AuthorizedTesting.Finalize()
+	}
+}
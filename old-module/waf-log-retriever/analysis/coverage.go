@@ -0,0 +1,48 @@
+package analysis
+
+import "fmt"
+
+// ResourceCoverage counts the resources a Web ACL snapshot is associated with, by resource type.
+// It returns nil when the snapshot predates association tracking. When the associated
+// resources could not all be listed, e.g. for a missing permission, coverage is unknown:
+// it returns nil and why.
+func ResourceCoverage(snapshot map[string]interface{}) (map[string]int, string) {
+	raw, ok := snapshot["associatedResources"]
+	if !ok {
+		return nil, ""
+	}
+	if reason, _ := snapshot["associationError"].(string); reason != "" {
+		return nil, reason
+	}
+	resources, ok := raw.([]interface{})
+	if !ok {
+		// Snapshots recorded null when the listing failed, before its error was recorded
+		return nil, "the associated resources could not be listed"
+	}
+
+	coverage := make(map[string]int)
+	for _, r := range resources {
+		resource, ok := r.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		resourceType, _ := resource["resourceType"].(string)
+		coverage[resourceType]++
+	}
+	return coverage, ""
+}
+
+// CoverageFindings reports Web ACLs that do not protect any resource. Unknown coverage,
+// nil, is no finding.
+func CoverageFindings(webACLName string, coverage map[string]int) []Finding {
+	if coverage == nil || len(coverage) > 0 {
+		return nil
+	}
+	return []Finding{{
+		ID:          "webacl-unassociated",
+		Severity:    SeverityHigh,
+		Title:       "Web ACL is not associated with any resource",
+		Description: fmt.Sprintf("No CloudFront distribution, load balancer, API Gateway stage, AppSync API, Cognito user pool, App Runner service or Verified Access instance uses Web ACL %s, so its rules protect nothing.", webACLName),
+		Source:      "coverage",
+	}}
+}
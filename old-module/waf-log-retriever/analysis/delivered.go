@@ -0,0 +1,226 @@
+package analysis
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+
+	"waf-log-retriever/athena"
+	"waf-log-retriever/storage"
+)
+
+// Formats of log files delivered outside AWS, told apart by their content
+const (
+	FormatJSONLines = "json-lines"        // WAF records or CloudWatch Logs envelopes one after another, as S3 and Firehose deliver them
+	FormatJSONArray = "json-array"        // A JSON array of WAF records or envelopes
+	FormatLogEvents = "cloudwatch-events" // Output of aws logs filter-log-events or get-log-events
+	FormatInsights  = "insights-results"  // Output of aws logs get-query-results, with the @message field
+)
+
+// gzipMagic starts every gzip stream
+var gzipMagic = []byte{0x1f, 0x8b}
+
+// deliveredPage is a page of CloudWatch Logs API output
+type deliveredPage struct {
+	Events []struct {
+		Message string `json:"message"`
+	} `json:"events"`
+	Results [][]struct {
+		Field string `json:"field"`
+		Value string `json:"value"`
+	} `json:"results"`
+}
+
+// ForEachDeliveredRecord streams the WAF records of a log file delivered outside AWS,
+// e.g. by a customer's file drop, detecting from its content whether it is
+// gzip-compressed and which of the delivered formats it is in, whatever its name.
+// Athena output over the WAF log table, as exported from a customer's data lake, is
+// read too. It returns the format. name identifies the file in errors.
+func ForEachDeliveredRecord(r io.Reader, name string, fn func(r *Record, payload []byte) error) (string, error) {
+	reader := bufio.NewReader(r)
+	if magic, _ := reader.Peek(len(gzipMagic)); bytes.Equal(magic, gzipMagic) {
+		gr, err := newGzipReader(reader)
+		if err != nil {
+			return "", fmt.Errorf("failed to decompress %s: %w", name, err)
+		}
+		defer gr.Close()
+		reader = bufio.NewReader(gr)
+	}
+	first, err := firstByte(reader)
+	if errors.Is(err, io.EOF) {
+		return FormatJSONLines, nil // Empty
+	}
+	if err != nil {
+		return "", fmt.Errorf("failed to read %s: %w", name, err)
+	}
+
+	emit := func(raw []byte) error {
+		record, payload, err := decodeRecord(raw)
+		if err != nil {
+			return fmt.Errorf("failed to decode record in %s: %w", name, err)
+		}
+		if record == nil {
+			return nil
+		}
+		return fn(record, payload)
+	}
+	emitRow := func(row map[string]any) error {
+		raw, err := athena.Record(row)
+		if err != nil {
+			return fmt.Errorf("failed to convert row in %s: %w", name, err)
+		}
+		return emit(raw)
+	}
+
+	if magic, _ := reader.Peek(len("PAR1")); athena.IsParquet(magic) {
+		if err := forEachParquetRecord(reader, name, emitRow); err != nil {
+			return "", err
+		}
+		return athena.FormatParquet, nil
+	}
+	if first != '[' && first != '{' {
+		line, _ := reader.Peek(reader.Buffered())
+		if i := bytes.IndexByte(line, '\n'); i >= 0 {
+			line = line[:i]
+		}
+		format := athena.TextFormat(line)
+		if format == "" {
+			return "", fmt.Errorf("%s is %w: it starts with %q rather than JSON", name, storage.ErrUnknownFormat, first)
+		}
+		if err := athena.ForEachTextRow(reader, format, emitRow); err != nil {
+			return "", fmt.Errorf("failed to decode %s: %w", name, err)
+		}
+		return format, nil
+	}
+
+	decoder := json.NewDecoder(reader)
+	switch first {
+	case '[':
+		if _, err := decoder.Token(); err != nil {
+			return "", fmt.Errorf("failed to decode %s: %w", name, err)
+		}
+		for decoder.More() {
+			var raw json.RawMessage
+			if err := decoder.Decode(&raw); err != nil {
+				return "", fmt.Errorf("failed to decode %s: %w", name, err)
+			}
+			if err := emit(raw); err != nil {
+				return "", err
+			}
+		}
+		return FormatJSONArray, nil
+	}
+
+	format := ""
+	for {
+		var raw json.RawMessage
+		if err := decoder.Decode(&raw); err != nil {
+			if errors.Is(err, io.EOF) {
+				return format, nil
+			}
+			return "", fmt.Errorf("failed to decode %s: %w", name, err)
+		}
+		if format == "" {
+			format = pageFormat(raw)
+			if format == FormatJSONLines && athena.IsRow(raw) {
+				format = athena.FormatJSON
+			}
+		}
+		if format == athena.FormatJSON {
+			restored, err := athena.RestoreJSON(raw)
+			if err != nil {
+				return "", fmt.Errorf("failed to decode %s: %w", name, err)
+			}
+			if err := emit(restored); err != nil {
+				return "", err
+			}
+			continue
+		}
+		if format == FormatJSONLines {
+			if err := emit(raw); err != nil {
+				return "", err
+			}
+			continue
+		}
+
+		var page deliveredPage
+		if err := json.Unmarshal(raw, &page); err != nil {
+			return "", fmt.Errorf("failed to decode %s: %w", name, err)
+		}
+		for _, event := range page.Events {
+			if err := emit([]byte(event.Message)); err != nil {
+				return "", err
+			}
+		}
+		for _, row := range page.Results {
+			for _, field := range row {
+				if field.Field != "@message" {
+					continue
+				}
+				if err := emit([]byte(field.Value)); err != nil {
+					return "", err
+				}
+			}
+		}
+	}
+}
+
+// forEachParquetRecord streams the rows of Parquet output, which is read from its
+// footer, so it is spooled to a temporary file first
+func forEachParquetRecord(r io.Reader, name string, fn func(row map[string]any) error) error {
+	spool, err := os.CreateTemp("", "waf-parquet-*")
+	if err != nil {
+		return fmt.Errorf("failed to spool %s: %w", name, err)
+	}
+	defer os.Remove(spool.Name())
+	defer spool.Close()
+
+	size, err := io.Copy(spool, r)
+	if err != nil {
+		return fmt.Errorf("failed to read %s: %w", name, err)
+	}
+	if err := athena.ForEachParquetRow(spool, size, fn); err != nil {
+		return fmt.Errorf("failed to decode %s: %w", name, err)
+	}
+	return nil
+}
+
+// pageFormat tells CloudWatch Logs API output apart from a WAF record or envelope
+// by its top-level keys
+func pageFormat(raw []byte) string {
+	var keys map[string]json.RawMessage
+	if json.Unmarshal(raw, &keys) != nil {
+		return FormatJSONLines
+	}
+	if _, ok := keys["events"]; ok {
+		return FormatLogEvents
+	}
+	if _, ok := keys["results"]; ok {
+		return FormatInsights
+	}
+	return FormatJSONLines
+}
+
+// firstByte returns the first byte of a reader that is not white space, without
+// consuming it. A UTF-8 byte order mark, as Windows tools write, is skipped too.
+func firstByte(r *bufio.Reader) (byte, error) {
+	if bom, _ := r.Peek(3); bytes.Equal(bom, []byte("\xef\xbb\xbf")) {
+		r.Discard(3)
+	}
+	for {
+		b, err := r.Peek(1)
+		if err != nil {
+			return 0, err
+		}
+		switch b[0] {
+		case ' ', '\t', '\r', '\n':
+			r.ReadByte()
+			continue
+		}
+		return b[0], nil
+	}
+}
@@ -0,0 +1,155 @@
+package analysis
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"strings"
+)
+
+// Formats of archives of log files delivered outside AWS, told apart by their content
+const (
+	FormatZip     = "zip"
+	FormatTar     = "tar"
+	FormatTarGzip = "tar.gz" // Also delivered as .tgz
+)
+
+// zipMagic starts every zip archive, and emptyZipMagic an empty one
+var (
+	zipMagic      = []byte("PK\x03\x04")
+	emptyZipMagic = []byte("PK\x05\x06")
+)
+
+// tarMagicOffset is the offset of the format magic, ustar, in a tar header
+const tarMagicOffset = 257
+
+// DeliveredArchiveFormat returns the format of a delivered file if it is an archive,
+// detected from its content whatever its name, or "" if it is not
+func DeliveredArchiveFormat(path string) (string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return "", fmt.Errorf("failed to open %s: %w", path, err)
+	}
+	defer file.Close()
+
+	reader := bufio.NewReader(file)
+	magic, _ := reader.Peek(len(zipMagic))
+	if bytes.Equal(magic, zipMagic) || bytes.Equal(magic, emptyZipMagic) {
+		return FormatZip, nil
+	}
+	format := FormatTar
+	if bytes.HasPrefix(magic, gzipMagic) {
+		gr, err := gzip.NewReader(reader)
+		if err != nil {
+			return "", nil // Not gzip after all; a delivered file can still be told apart by ForEachDeliveredRecord
+		}
+		defer gr.Close()
+		reader = bufio.NewReader(gr)
+		format = FormatTarGzip
+	}
+	header, _ := reader.Peek(tarMagicOffset + 5)
+	if len(header) == tarMagicOffset+5 && string(header[tarMagicOffset:]) == "ustar" {
+		return format, nil
+	}
+	return "", nil
+}
+
+// ForEachArchiveMember streams the files of an archive of delivered log files, in
+// their order in it, with their paths inside it, without extracting it. Directories,
+// links and hidden files, such as the __MACOSX metadata of archives made on a Mac,
+// are skipped. It returns the archive's format.
+func ForEachArchiveMember(path string, fn func(name string, r io.Reader) error) (string, error) {
+	format, err := DeliveredArchiveFormat(path)
+	if err != nil {
+		return "", err
+	}
+	switch format {
+	case FormatZip:
+		return format, forEachZipMember(path, fn)
+	case FormatTar, FormatTarGzip:
+		return format, forEachTarMember(path, fn)
+	}
+	return "", fmt.Errorf("%s is not a zip or tar archive", path)
+}
+
+// forEachZipMember streams the files of a zip archive, which is read from its end
+func forEachZipMember(path string, fn func(name string, r io.Reader) error) error {
+	archive, err := zip.OpenReader(path)
+	if err != nil {
+		return fmt.Errorf("failed to open %s: %w", path, err)
+	}
+	defer archive.Close()
+
+	for _, member := range archive.File {
+		name, ok := archiveMemberName(member.Name)
+		if !ok || !member.Mode().IsRegular() {
+			continue
+		}
+		r, err := member.Open()
+		if err != nil {
+			return fmt.Errorf("failed to open %s in %s: %w", name, path, err)
+		}
+		err = fn(name, r)
+		r.Close()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// forEachTarMember streams the files of a tar archive, gzip-compressed or not
+func forEachTarMember(path string, fn func(name string, r io.Reader) error) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return fmt.Errorf("failed to open %s: %w", path, err)
+	}
+	defer file.Close()
+
+	reader := bufio.NewReader(file)
+	var r io.Reader = reader
+	if magic, _ := reader.Peek(len(gzipMagic)); bytes.Equal(magic, gzipMagic) {
+		gr, err := newGzipReader(reader)
+		if err != nil {
+			return fmt.Errorf("failed to decompress %s: %w", path, err)
+		}
+		defer gr.Close()
+		r = gr
+	}
+	archive := tar.NewReader(r)
+	for {
+		header, err := archive.Next()
+		if errors.Is(err, io.EOF) {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("failed to read %s: %w", path, err)
+		}
+		name, ok := archiveMemberName(header.Name)
+		if !ok || !header.FileInfo().Mode().IsRegular() {
+			continue
+		}
+		if err := fn(name, archive); err != nil {
+			return err
+		}
+	}
+}
+
+// archiveMemberName returns the slash-separated path of an archive's file, and false
+// for hidden files and paths leaving the archive
+func archiveMemberName(name string) (string, bool) {
+	name = path.Clean(strings.TrimPrefix(strings.ReplaceAll(name, "\\", "/"), "/"))
+	for _, part := range strings.Split(name, "/") {
+		if part == ".." || strings.HasPrefix(part, ".") || part == "__MACOSX" {
+			return "", false
+		}
+	}
+	return name, true
+}
@@ -0,0 +1,231 @@
+package analysis
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"slices"
+	"strings"
+	"time"
+)
+
+// IPIntel is a reviewer-supplied enrichment entry for a network, such as its ASN
+// from a registry export or the verdict of a reputation feed
+type IPIntel struct {
+	CIDR       string `json:"cidr"`
+	ASN        int64  `json:"asn,omitempty"`
+	Org        string `json:"org,omitempty"`
+	Reputation string `json:"reputation,omitempty"` // e.g. "known scanner", "tor exit", "cloud provider"
+	Source     string `json:"source,omitempty"`     // Where the entry came from
+
+	net *net.IPNet
+}
+
+// LoadIPIntel reads an enrichment file: a JSON array of IPIntel entries
+func LoadIPIntel(path string) ([]IPIntel, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read enrichment file: %w", err)
+	}
+	var intel []IPIntel
+	if err := json.Unmarshal(data, &intel); err != nil {
+		return nil, fmt.Errorf("failed to parse enrichment file %s: %w", path, err)
+	}
+	for i := range intel {
+		nets, err := parseCIDRs([]string{intel[i].CIDR})
+		if err != nil {
+			return nil, fmt.Errorf("enrichment file %s: %w", path, err)
+		}
+		intel[i].net = nets[0]
+	}
+	return intel, nil
+}
+
+// LookupIPIntel returns the entry of the most specific network containing ip, or nil
+func LookupIPIntel(intel []IPIntel, ip net.IP) *IPIntel {
+	var best *IPIntel
+	bestBits := -1
+	for i := range intel {
+		if !intel[i].net.Contains(ip) {
+			continue
+		}
+		if bits, _ := intel[i].net.Mask.Size(); bits > bestBits {
+			best, bestBits = &intel[i], bits
+		}
+	}
+	return best
+}
+
+// IPEnrichment is what is known about an IP beyond its requests
+type IPEnrichment struct {
+	Countries  []Count  `json:"countries"`            // Countries WAF geolocated the requests to
+	Private    bool     `json:"private"`              // Private, loopback or link-local address
+	Intel      *IPIntel `json:"intel,omitempty"`      // From the enrichment file
+	ReverseDNS []string `json:"reverseDns,omitempty"` // PTR names, if looked up
+}
+
+// TimelineBucket is the request volume of one period of an IP's activity
+type TimelineBucket struct {
+	Start    time.Time `json:"start"`
+	Requests int64     `json:"requests"`
+	Blocked  int64     `json:"blocked"`
+}
+
+// IPDossier is everything the logs say about one client IP
+type IPDossier struct {
+	IP           string            `json:"ip"`
+	FirstSeen    time.Time         `json:"firstSeen"`
+	LastSeen     time.Time         `json:"lastSeen"`
+	Requests     int64             `json:"requests"`
+	Actions      map[string]int64  `json:"actions"`
+	Methods      map[string]int64  `json:"methods"`
+	Hosts        []Count           `json:"hosts"`
+	DistinctURIs int               `json:"distinctUris"`
+	URIs         []Count           `json:"uris"`
+	Rules        []Count           `json:"rules"` // Matched rules and rule groups, see RecordRules
+	Labels       []Count           `json:"labels"`
+	UserAgents   []Count           `json:"userAgents"`
+	Scanners     []Count           `json:"scanners"`
+	Bucket       string            `json:"bucket"` // Period of the timeline buckets
+	Timeline     []TimelineBucket  `json:"timeline"`
+	Enrichment   IPEnrichment      `json:"enrichment"`
+	Samples      []json.RawMessage `json:"samples"`
+
+	countries  map[string]int64
+	hosts      map[string]int64
+	uris       map[string]int64
+	rules      map[string]int64
+	labels     map[string]int64
+	userAgents map[string]int64
+	scanners   map[string]int64
+	buckets    map[int64]*TimelineBucket
+	sampled    map[string]bool
+	maxSamples int
+}
+
+// NewIPDossier starts a dossier that keeps up to samples raw records, the first
+// request of each distinct terminating rule
+func NewIPDossier(ip string, samples int) *IPDossier {
+	return &IPDossier{
+		IP:         ip,
+		Actions:    make(map[string]int64),
+		Methods:    make(map[string]int64),
+		Samples:    []json.RawMessage{},
+		countries:  make(map[string]int64),
+		hosts:      make(map[string]int64),
+		uris:       make(map[string]int64),
+		rules:      make(map[string]int64),
+		labels:     make(map[string]int64),
+		userAgents: make(map[string]int64),
+		scanners:   make(map[string]int64),
+		buckets:    make(map[int64]*TimelineBucket),
+		sampled:    make(map[string]bool),
+		maxSamples: samples,
+	}
+}
+
+// Add folds a record of the IP into the dossier
+func (d *IPDossier) Add(r *Record, raw []byte) {
+	d.Requests++
+	ts := r.Time()
+	if d.FirstSeen.IsZero() || ts.Before(d.FirstSeen) {
+		d.FirstSeen = ts
+	}
+	if ts.After(d.LastSeen) {
+		d.LastSeen = ts
+	}
+	d.Actions[r.Action]++
+	d.Methods[r.HTTPRequest.HTTPMethod]++
+	d.countries[r.HTTPRequest.Country]++
+	d.hosts[r.Host()]++
+	d.uris[r.HTTPRequest.URI]++
+	d.userAgents[r.HeaderValue("User-Agent")]++
+	if name := IdentifyScanner(r); name != "" {
+		d.scanners[name]++
+	}
+	labels := make(map[string]bool, len(r.Labels))
+	for _, l := range r.Labels {
+		labels[l.Name] = true
+		d.labels[l.Name]++
+	}
+	seen := make(map[string]bool)
+	for _, name := range RecordRules(r) {
+		if name == "" || name == "Default_Action" || labels[name] || seen[name] {
+			continue
+		}
+		seen[name] = true
+		d.rules[name]++
+	}
+
+	hour := r.Timestamp / 3600000
+	bucket, ok := d.buckets[hour]
+	if !ok {
+		bucket = &TimelineBucket{Start: time.UnixMilli(hour * 3600000).UTC()}
+		d.buckets[hour] = bucket
+	}
+	bucket.Requests++
+	if r.Action == "BLOCK" {
+		bucket.Blocked++
+	}
+
+	if len(d.Samples) < d.maxSamples && !d.sampled[r.TerminatingRuleID] {
+		d.sampled[r.TerminatingRuleID] = true
+		d.Samples = append(d.Samples, append(json.RawMessage(nil), raw...))
+	}
+}
+
+// Finish fills in the ranked sections, keeping the top entries of each, and the
+// timeline: hourly for up to three days of activity, daily beyond
+func (d *IPDossier) Finish(top int, intel []IPIntel) {
+	d.Hosts = TopN(d.hosts, top)
+	d.DistinctURIs = len(d.uris)
+	d.URIs = TopN(d.uris, top)
+	d.Rules = TopN(d.rules, top)
+	d.Labels = TopN(d.labels, top)
+	d.UserAgents = TopN(d.userAgents, top)
+	d.Scanners = TopN(d.scanners, top)
+
+	d.Bucket = "hour"
+	period := int64(1)
+	if d.LastSeen.Sub(d.FirstSeen) > 72*time.Hour {
+		d.Bucket, period = "day", 24
+	}
+	merged := make(map[int64]*TimelineBucket)
+	var keys []int64
+	for hour, b := range d.buckets {
+		key := hour - hour%period
+		m, ok := merged[key]
+		if !ok {
+			m = &TimelineBucket{Start: time.UnixMilli(key * 3600000).UTC()}
+			merged[key] = m
+			keys = append(keys, key)
+		}
+		m.Requests += b.Requests
+		m.Blocked += b.Blocked
+	}
+	slices.Sort(keys)
+	d.Timeline = make([]TimelineBucket, 0, len(keys))
+	for _, key := range keys {
+		d.Timeline = append(d.Timeline, *merged[key])
+	}
+
+	d.Enrichment.Countries = TopN(d.countries, 0)
+	if ip := net.ParseIP(d.IP); ip != nil {
+		d.Enrichment.Private = ip.IsPrivate() || ip.IsLoopback() || ip.IsLinkLocalUnicast()
+		d.Enrichment.Intel = LookupIPIntel(intel, ip)
+	}
+}
+
+// LookupReverseDNS adds the PTR names of the IP to the enrichment
+func (d *IPDossier) LookupReverseDNS() error {
+	names, err := net.LookupAddr(d.IP)
+	if err != nil {
+		return fmt.Errorf("failed to look up reverse DNS of %s: %w", d.IP, err)
+	}
+	for i := range names {
+		names[i] = strings.TrimSuffix(names[i], ".")
+	}
+	d.Enrichment.ReverseDNS = names
+	return nil
+}
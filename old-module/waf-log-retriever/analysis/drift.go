@@ -0,0 +1,505 @@
+package analysis
+
+import (
+	"encoding/json"
+	"fmt"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Kinds of rule drift
+const (
+	DriftMissing = "missing" // In the baseline only
+	DriftExtra   = "extra"   // In the target only
+	DriftChanged = "changed" // In both, configured differently
+)
+
+// maxDriftValue caps the length of the statement JSON shown in a difference
+const maxDriftValue = 300
+
+// actionStrength orders rule actions from the least to the most protective; an Allow
+// rule exempts traffic from every later rule, COUNT only labels it, a rule group
+// and NONE keeps the actions of a rule group
+var actionStrength = map[string]int{
+	"ALLOW":     0,
+	"COUNT":     1,
+	"CHALLENGE": 2,
+	"CAPTCHA":   2,
+	"BLOCK":     3,
+	"NONE":      3,
+}
+
+// DriftDifference is one way a rule or a Web ACL setting differs between two
+// environments
+type DriftDifference struct {
+	Field    string `json:"field"` // e.g. action, order, statement, version, ruleActionOverrides, rateLimit or defaultAction
+	Baseline string `json:"baseline"`
+	Target   string `json:"target"`
+	Weaker   bool   `json:"weaker"` // Whether the target protects less
+}
+
+// RuleDrift is a rule that is missing, extra or configured differently in the target
+type RuleDrift struct {
+	Rule        string            `json:"rule"`
+	TargetRule  string            `json:"targetRule,omitempty"` // Name in the target, when matched by its rule group rather than its name
+	Change      string            `json:"change"`               // missing, extra or changed
+	Action      string            `json:"action"`               // In the baseline, or in the target for extra rules
+	Differences []DriftDifference `json:"differences,omitempty"`
+	Weaker      bool              `json:"weaker"`
+}
+
+// DriftEnvironment identifies the snapshot of one environment
+type DriftEnvironment struct {
+	Name       string `json:"name"`
+	WebACL     string `json:"webAcl"`
+	Snapshot   string `json:"snapshot"`
+	CapturedAt string `json:"capturedAt,omitempty"`
+	Rules      int    `json:"rules"`
+}
+
+// DriftReport compares the Web ACL of a target environment, e.g. staging, with that
+// of a baseline, e.g. production
+type DriftReport struct {
+	Baseline  DriftEnvironment  `json:"baseline"`
+	Target    DriftEnvironment  `json:"target"`
+	Settings  []DriftDifference `json:"settings"`  // Web ACL level: default action, body inspection limits, CAPTCHA and challenge immunity
+	Rules     []RuleDrift       `json:"rules"`     // In baseline order, then the target's extra rules
+	Identical int               `json:"identical"` // Rules configured the same in both
+	Weaker    int               `json:"weaker"`    // Settings and rules that protect less in the target
+}
+
+// driftRule is a rule of a snapshot prepared for comparison
+type driftRule struct {
+	name     string
+	priority float64
+	group    string // Rule group ID, see ruleGroupOf, with ARNs reduced to their names
+	raw      map[string]interface{}
+}
+
+// snapshotRules returns the rules of a snapshot in evaluation order
+func snapshotRules(snapshot map[string]interface{}) []driftRule {
+	webACL, _ := snapshot["webACL"].(map[string]interface{})
+	var rules []driftRule
+	for _, rule := range asSlice(webACL["Rules"]) {
+		name, _ := rule["Name"].(string)
+		priority, _ := rule["Priority"].(float64)
+		statement, _ := rule["Statement"].(map[string]interface{})
+		group, _ := ruleGroupOf(statement)
+		rules = append(rules, driftRule{name: name, priority: priority, group: arnName(group), raw: rule})
+	}
+	sort.SliceStable(rules, func(i, j int) bool { return rules[i].priority < rules[j].priority })
+	return rules
+}
+
+// DescribeDriftEnvironment fills the Web ACL, capture time and rule count of an
+// environment from its snapshot
+func DescribeDriftEnvironment(name, path string, snapshot map[string]interface{}) DriftEnvironment {
+	webACL, _ := snapshot["webACL"].(map[string]interface{})
+	env := DriftEnvironment{Name: name, Snapshot: path, Rules: len(asSlice(webACL["Rules"]))}
+	env.WebACL, _ = webACL["Name"].(string)
+	env.CapturedAt, _ = snapshot["capturedAt"].(string)
+	return env
+}
+
+// CompareSnapshots reports how the Web ACL of a target snapshot drifted from that of
+// a baseline. Rules are matched by name, and rule group rules left over by the rule
+// group they reference, so renamed managed rule groups still pair up. ARNs are
+// compared by resource name, since IP sets and rule groups have other IDs in every
+// account and region.
+func CompareSnapshots(baseline, target DriftEnvironment, baselineSnapshot, targetSnapshot map[string]interface{}) *DriftReport {
+	report := &DriftReport{
+		Baseline: baseline,
+		Target:   target,
+		Settings: compareWebACLSettings(baselineSnapshot, targetSnapshot),
+		Rules:    []RuleDrift{},
+	}
+	if report.Settings == nil {
+		report.Settings = []DriftDifference{}
+	}
+
+	baseRules, targetRules := snapshotRules(baselineSnapshot), snapshotRules(targetSnapshot)
+	pairs := make(map[int]int) // Baseline index -> target index
+	matched := make(map[int]bool)
+	for i, b := range baseRules {
+		for j, t := range targetRules {
+			if !matched[j] && b.name == t.name {
+				pairs[i], matched[j] = j, true
+				break
+			}
+		}
+	}
+	for i, b := range baseRules {
+		if _, ok := pairs[i]; ok || b.group == "" {
+			continue
+		}
+		for j, t := range targetRules {
+			if !matched[j] && b.group == t.group {
+				pairs[i], matched[j] = j, true
+				break
+			}
+		}
+	}
+
+	// Positions among the rules both have, so that missing and extra rules do not
+	// count as reordering
+	var basePositions, targetPositions []int
+	for i := range baseRules {
+		if j, ok := pairs[i]; ok {
+			basePositions = append(basePositions, i)
+			targetPositions = append(targetPositions, j)
+		}
+	}
+	sort.Ints(targetPositions)
+	targetRank := make(map[int]int)
+	for rank, j := range targetPositions {
+		targetRank[j] = rank
+	}
+
+	for i, b := range baseRules {
+		j, ok := pairs[i]
+		if !ok {
+			action := ruleAction(b.raw)
+			report.Rules = append(report.Rules, RuleDrift{
+				Rule:   b.name,
+				Change: DriftMissing,
+				Action: action,
+				Weaker: action != "ALLOW",
+			})
+			continue
+		}
+		t := targetRules[j]
+		differences := compareRules(b.raw, t.raw)
+		if rank := targetRank[j]; basePositions[rank] != i {
+			baseRank := sort.SearchInts(basePositions, i)
+			differences = append(differences, DriftDifference{
+				Field:    "order",
+				Baseline: fmt.Sprintf("priority %.0f, position %d of %d shared rules", b.priority, baseRank+1, len(basePositions)),
+				Target:   fmt.Sprintf("priority %.0f, position %d of %d shared rules", t.priority, rank+1, len(basePositions)),
+			})
+		}
+		if len(differences) == 0 {
+			report.Identical++
+			continue
+		}
+		drift := RuleDrift{Rule: b.name, Change: DriftChanged, Action: ruleAction(b.raw), Differences: differences}
+		if t.name != b.name {
+			drift.TargetRule = t.name
+		}
+		for _, d := range differences {
+			drift.Weaker = drift.Weaker || d.Weaker
+		}
+		report.Rules = append(report.Rules, drift)
+	}
+	for j, t := range targetRules {
+		if matched[j] {
+			continue
+		}
+		action := ruleAction(t.raw)
+		report.Rules = append(report.Rules, RuleDrift{
+			Rule:   t.name,
+			Change: DriftExtra,
+			Action: action,
+			Weaker: action == "ALLOW", // An extra Allow rule exempts traffic from the rules after it
+		})
+	}
+
+	for _, d := range report.Settings {
+		if d.Weaker {
+			report.Weaker++
+		}
+	}
+	for _, r := range report.Rules {
+		if r.Weaker {
+			report.Weaker++
+		}
+	}
+	return report
+}
+
+// compareRules returns the differences between two rules that were paired up
+func compareRules(base, target map[string]interface{}) []DriftDifference {
+	var differences []DriftDifference
+	if b, t := ruleAction(base), ruleAction(target); b != t {
+		differences = append(differences, DriftDifference{Field: "action", Baseline: b, Target: t, Weaker: actionStrength[t] < actionStrength[b]})
+	}
+
+	baseStatement := normalizeARNs(consoleJSON(base["Statement"])).(map[string]interface{})
+	targetStatement := normalizeARNs(consoleJSON(target["Statement"])).(map[string]interface{})
+	baseParts, targetParts := splitStatement(baseStatement), splitStatement(targetStatement)
+	if b, t := baseParts.version, targetParts.version; b != t {
+		differences = append(differences, DriftDifference{Field: "version", Baseline: orDefault(b), Target: orDefault(t)})
+	}
+	if b, t := baseParts.overrides, targetParts.overrides; !slices.Equal(b, t) {
+		differences = append(differences, DriftDifference{Field: "ruleActionOverrides", Baseline: joinOrNone(b), Target: joinOrNone(t), Weaker: hasExtra(b, weakOverrides(t))})
+	}
+	if b, t := baseParts.excluded, targetParts.excluded; !slices.Equal(b, t) {
+		differences = append(differences, DriftDifference{Field: "excludedRules", Baseline: joinOrNone(b), Target: joinOrNone(t), Weaker: hasExtra(b, t)})
+	}
+	if b, t := baseParts.scopeDown, targetParts.scopeDown; b != t {
+		differences = append(differences, DriftDifference{Field: "scopeDown", Baseline: orNone(b), Target: orNone(t), Weaker: b == "" && t != ""})
+	}
+	if b, t := baseParts.rateLimit, targetParts.rateLimit; b != t {
+		differences = append(differences, DriftDifference{Field: "rateLimit", Baseline: strconv.FormatFloat(b, 'f', -1, 64), Target: strconv.FormatFloat(t, 'f', -1, 64), Weaker: t > b})
+	}
+	if b, t := canonicalJSON(baseParts.rest), canonicalJSON(targetParts.rest); b != t {
+		differences = append(differences, DriftDifference{Field: "statement", Baseline: clip(b, maxDriftValue), Target: clip(t, maxDriftValue)})
+	}
+	if b, t := ruleLabels(base), ruleLabels(target); !slices.Equal(b, t) {
+		differences = append(differences, DriftDifference{Field: "labels", Baseline: joinOrNone(b), Target: joinOrNone(t)})
+	}
+	for _, config := range []string{"CaptchaConfig", "ChallengeConfig"} {
+		if b, t := immunityTime(base[config]), immunityTime(target[config]); b != t {
+			differences = append(differences, DriftDifference{Field: config, Baseline: immunityString(b), Target: immunityString(t), Weaker: t > b})
+		}
+	}
+	return differences
+}
+
+// statementParts are the parts of a rule statement compared one by one; rest is the
+// statement without them
+type statementParts struct {
+	version   string
+	overrides []string // "<rule>:<action>"
+	excluded  []string
+	scopeDown string // Canonical JSON
+	rateLimit float64
+	rest      map[string]interface{}
+}
+
+// splitStatement takes the separately compared parts out of a normalized statement
+func splitStatement(statement map[string]interface{}) statementParts {
+	parts := statementParts{rest: statement}
+	for _, key := range []string{"ManagedRuleGroupStatement", "RuleGroupReferenceStatement", "RateBasedStatement"} {
+		inner, ok := statement[key].(map[string]interface{})
+		if !ok {
+			continue
+		}
+		parts.version, _ = inner["Version"].(string)
+		for _, o := range asSlice(inner["RuleActionOverrides"]) {
+			name, _ := o["Name"].(string)
+			action, _ := o["ActionToUse"].(map[string]interface{})
+			parts.overrides = append(parts.overrides, name+":"+ruleAction(map[string]interface{}{"Action": action}))
+		}
+		for _, e := range asSlice(inner["ExcludedRules"]) {
+			name, _ := e["Name"].(string)
+			parts.excluded = append(parts.excluded, name)
+		}
+		if scopeDown := inner["ScopeDownStatement"]; scopeDown != nil {
+			parts.scopeDown = canonicalJSON(scopeDown)
+		}
+		parts.rateLimit, _ = inner["Limit"].(float64)
+		sort.Strings(parts.overrides)
+		sort.Strings(parts.excluded)
+
+		rest := make(map[string]interface{}, len(inner))
+		for k, v := range inner {
+			switch k {
+			case "Version", "RuleActionOverrides", "ExcludedRules", "ScopeDownStatement", "Limit":
+			default:
+				rest[k] = v
+			}
+		}
+		parts.rest = map[string]interface{}{key: rest}
+	}
+	return parts
+}
+
+// normalizeARNs replaces the ARNs of WAF resources in snapshot JSON with their type
+// and name, e.g. ipset/office-ips
+func normalizeARNs(v interface{}) interface{} {
+	switch v := v.(type) {
+	case map[string]interface{}:
+		for key, value := range v {
+			if s, ok := value.(string); ok && key == "ARN" {
+				v[key] = arnName(s)
+				continue
+			}
+			v[key] = normalizeARNs(value)
+		}
+	case []interface{}:
+		for i, value := range v {
+			v[i] = normalizeARNs(value)
+		}
+	}
+	return v
+}
+
+// arnName reduces a WAF resource ARN, arn:aws:wafv2:<region>:<account>:<scope>/<type>/<name>/<id>,
+// to <type>/<name>; anything else is returned unchanged
+func arnName(arn string) string {
+	if !strings.HasPrefix(arn, "arn:") {
+		return arn
+	}
+	fields := strings.SplitN(arn, ":", 6)
+	if len(fields) < 6 {
+		return arn
+	}
+	resource := strings.Split(fields[5], "/")
+	if len(resource) < 3 {
+		return arn
+	}
+	return resource[1] + "/" + resource[2]
+}
+
+// ruleLabels returns the names of the labels a rule adds, sorted
+func ruleLabels(rule map[string]interface{}) []string {
+	var labels []string
+	for _, l := range asSlice(rule["RuleLabels"]) {
+		if name, _ := l["Name"].(string); name != "" {
+			labels = append(labels, name)
+		}
+	}
+	sort.Strings(labels)
+	return labels
+}
+
+// immunityTime returns the immunity time in seconds of a CAPTCHA or challenge
+// config, or 0 if it has none
+func immunityTime(v interface{}) float64 {
+	config, _ := v.(map[string]interface{})
+	property, _ := config["ImmunityTimeProperty"].(map[string]interface{})
+	seconds, _ := property["ImmunityTime"].(float64)
+	return seconds
+}
+
+// immunityString formats an immunity time for a difference
+func immunityString(seconds float64) string {
+	if seconds == 0 {
+		return "default"
+	}
+	return fmt.Sprintf("%.0f seconds", seconds)
+}
+
+// compareWebACLSettings returns the differences of the Web ACL level settings: the
+// default action, the body inspection limits and the CAPTCHA and challenge immunity
+func compareWebACLSettings(baseline, target map[string]interface{}) []DriftDifference {
+	baseACL, _ := baseline["webACL"].(map[string]interface{})
+	targetACL, _ := target["webACL"].(map[string]interface{})
+	var differences []DriftDifference
+
+	if b, t := ruleAction(map[string]interface{}{"Action": baseACL["DefaultAction"]}), ruleAction(map[string]interface{}{"Action": targetACL["DefaultAction"]}); b != t {
+		differences = append(differences, DriftDifference{Field: "defaultAction", Baseline: b, Target: t, Weaker: actionStrength[t] < actionStrength[b]})
+	}
+
+	baseLimits, targetLimits := bodyInspectionLimits(baseACL), bodyInspectionLimits(targetACL)
+	resourceTypes := make(map[string]bool)
+	for resourceType := range baseLimits {
+		resourceTypes[resourceType] = true
+	}
+	for resourceType := range targetLimits {
+		resourceTypes[resourceType] = true
+	}
+	var sorted []string
+	for resourceType := range resourceTypes {
+		sorted = append(sorted, resourceType)
+	}
+	sort.Strings(sorted)
+	for _, resourceType := range sorted {
+		b, t := baseLimits[resourceType], targetLimits[resourceType]
+		if b == t {
+			continue
+		}
+		differences = append(differences, DriftDifference{
+			Field:    "bodyInspectionLimit " + resourceType,
+			Baseline: orDefault(b),
+			Target:   orDefault(t),
+			Weaker:   sizeLimitKB(t) < sizeLimitKB(b),
+		})
+	}
+
+	for _, config := range []string{"CaptchaConfig", "ChallengeConfig"} {
+		if b, t := immunityTime(baseACL[config]), immunityTime(targetACL[config]); b != t {
+			differences = append(differences, DriftDifference{Field: config, Baseline: immunityString(b), Target: immunityString(t), Weaker: t > b})
+		}
+	}
+	return differences
+}
+
+// bodyInspectionLimits returns the configured body inspection limit of a Web ACL by
+// resource type, e.g. "CLOUDFRONT": "KB_32"
+func bodyInspectionLimits(webACL map[string]interface{}) map[string]string {
+	limits := make(map[string]string)
+	association, _ := webACL["AssociationConfig"].(map[string]interface{})
+	requestBody, _ := association["RequestBody"].(map[string]interface{})
+	for resourceType, v := range requestBody {
+		config, _ := v.(map[string]interface{})
+		if limit, _ := config["DefaultSizeInspectionLimit"].(string); limit != "" {
+			limits[resourceType] = limit
+		}
+	}
+	return limits
+}
+
+// sizeLimitKB returns the kilobytes of a size inspection limit such as KB_16; the
+// default of 16 KB when it is not set
+func sizeLimitKB(limit string) int {
+	if kb, err := strconv.Atoi(strings.TrimPrefix(limit, "KB_")); err == nil {
+		return kb
+	}
+	return 16
+}
+
+// canonicalJSON encodes snapshot JSON with sorted keys, "" for nil
+func canonicalJSON(v interface{}) string {
+	if v == nil {
+		return ""
+	}
+	data, err := json.Marshal(v)
+	if err != nil {
+		return fmt.Sprint(v)
+	}
+	return string(data)
+}
+
+// hasExtra reports whether target has entries base lacks
+func hasExtra(base, target []string) bool {
+	for _, t := range target {
+		if !slices.Contains(base, t) {
+			return true
+		}
+	}
+	return false
+}
+
+// weakOverrides returns the rule action overrides to COUNT or ALLOW, which disable
+// the rules of a rule group
+func weakOverrides(overrides []string) []string {
+	var weak []string
+	for _, o := range overrides {
+		if strings.HasSuffix(o, ":COUNT") || strings.HasSuffix(o, ":ALLOW") {
+			weak = append(weak, o)
+		}
+	}
+	return weak
+}
+
+// orNone returns a value for a difference, "none" if it is empty
+func orNone(s string) string {
+	if s == "" {
+		return "none"
+	}
+	return s
+}
+
+// joinOrNone joins a list for a difference, "none" if it is empty
+func joinOrNone(values []string) string {
+	return orNone(strings.Join(values, ", "))
+}
+
+// orDefault returns a setting for a difference, "default" if it is not set
+func orDefault(s string) string {
+	if s == "" {
+		return "default"
+	}
+	return s
+}
+
+// clip shortens s to at most n bytes, marking the cut
+func clip(s string, n int) string {
+	if len(s) <= n {
+		return s
+	}
+	return s[:n] + "..."
+}
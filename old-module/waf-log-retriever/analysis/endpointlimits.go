@@ -0,0 +1,170 @@
+package analysis
+
+import (
+	"fmt"
+	"math"
+	"regexp"
+	"slices"
+	"sort"
+	"strings"
+	"time"
+)
+
+// maxEndpointURIs caps the URIs whose client rates are tracked
+const maxEndpointURIs = 2000
+
+// EndpointLimitSettings configure the per-URI rate limit recommendations
+type EndpointLimitSettings struct {
+	Window     time.Duration // Evaluation window of the recommended rules
+	Percentile float64       // Percentile of the legitimate clients' peak rates the limit is derived from
+	Headroom   float64       // Factor applied to the percentile
+	MinClients int           // Legitimate clients a URI needs for a recommendation
+}
+
+// Validate checks the settings against what a rate-based rule supports
+func (s EndpointLimitSettings) Validate() error {
+	if !slices.Contains(rateLimitWindows, s.Window) {
+		return fmt.Errorf("window must be 1m, 2m, 5m or 10m, not %s", s.Window)
+	}
+	if s.Percentile <= 0 || s.Percentile > 100 {
+		return fmt.Errorf("percentile must be above 0 and at most 100")
+	}
+	if s.Headroom < 1 {
+		return fmt.Errorf("headroom must be at least 1")
+	}
+	return nil
+}
+
+// EndpointLimit is a recommended rate limit for one URI
+type EndpointLimit struct {
+	URI                 string                 `json:"uri"`
+	Requests            int64                  `json:"requests"`
+	LegitimateClients   int                    `json:"legitimateClients"`
+	OtherClients        int                    `json:"otherClients"` // Clients with a blocked, attack or scanner request
+	MedianRate          int64                  `json:"medianRate"`   // Of the legitimate clients' peak rates per window
+	PercentileRate      int64                  `json:"percentileRate"`
+	MaxRate             int64                  `json:"maxRate"`
+	Limit               int64                  `json:"limit"`
+	LegitimateOverLimit int                    `json:"legitimateOverLimit"` // Legitimate clients the limit would have limited
+	OtherOverLimit      int                    `json:"otherOverLimit"`      // Other clients the limit would have limited
+	Rule                map[string]interface{} `json:"rule"`                // Candidate rate-based rule, in console JSON
+}
+
+// EndpointLimitAnalysis tracks the peak request rate of every client on every URI
+type EndpointLimitAnalysis struct {
+	window time.Duration
+	uris   map[string]*RateLimitSimulation
+}
+
+// NewEndpointLimitAnalysis starts tracking client rates per window
+func NewEndpointLimitAnalysis(window time.Duration) *EndpointLimitAnalysis {
+	return &EndpointLimitAnalysis{window: window, uris: make(map[string]*RateLimitSimulation)}
+}
+
+// Add folds a record into the rates of its URI; records should arrive in time order
+func (a *EndpointLimitAnalysis) Add(r *Record) {
+	sim, ok := a.uris[r.HTTPRequest.URI]
+	if !ok {
+		if len(a.uris) >= maxEndpointURIs {
+			return
+		}
+		// A limit no client reaches, so that the simulation only measures rates
+		sim = NewRateLimitSimulation(RateLimitOptions{Limit: math.MaxInt64, Window: a.window, Keys: []string{"ip"}, Model: "sliding-window"})
+		a.uris[r.HTTPRequest.URI] = sim
+	}
+	sim.Add(r)
+}
+
+// Recommendations derives a rate limit for every URI with at least MinClients
+// legitimate clients, most requests first, listing at most top URIs (all if top is
+// not positive)
+func (a *EndpointLimitAnalysis) Recommendations(settings EndpointLimitSettings, top int) []EndpointLimit {
+	limits := []EndpointLimit{}
+	for uri, sim := range a.uris {
+		var legitimate, other []*rateLimitState
+		for _, st := range sim.keys {
+			if st.Legitimate == st.Requests {
+				legitimate = append(legitimate, st)
+			} else {
+				other = append(other, st)
+			}
+		}
+		if len(legitimate) == 0 || len(legitimate) < settings.MinClients {
+			continue
+		}
+		peaks := make([]int64, len(legitimate))
+		for i, st := range legitimate {
+			peaks[i] = st.PeakRate
+		}
+		sort.Slice(peaks, func(i, j int) bool { return peaks[i] < peaks[j] })
+
+		l := EndpointLimit{
+			URI:               uri,
+			Requests:          sim.requests,
+			LegitimateClients: len(legitimate),
+			OtherClients:      len(other),
+			MedianRate:        percentileOf(peaks, 50),
+			PercentileRate:    percentileOf(peaks, settings.Percentile),
+			MaxRate:           peaks[len(peaks)-1],
+		}
+		l.Limit = max(minRateLimit, int64(math.Ceil(float64(l.PercentileRate)*settings.Headroom)))
+		for _, peak := range peaks {
+			if peak > l.Limit {
+				l.LegitimateOverLimit++
+			}
+		}
+		for _, st := range other {
+			if st.PeakRate > l.Limit {
+				l.OtherOverLimit++
+			}
+		}
+		l.Rule = endpointLimitRule(uri, l.Limit, settings.Window)
+		limits = append(limits, l)
+	}
+	sort.Slice(limits, func(i, j int) bool {
+		if limits[i].Requests != limits[j].Requests {
+			return limits[i].Requests > limits[j].Requests
+		}
+		return limits[i].URI < limits[j].URI
+	})
+	if top > 0 && len(limits) > top {
+		limits = limits[:top]
+	}
+	return limits
+}
+
+// percentileOf returns the nearest-rank percentile of sorted values
+func percentileOf(sorted []int64, p float64) int64 {
+	rank := int(math.Ceil(p / 100 * float64(len(sorted))))
+	return sorted[min(max(rank, 1), len(sorted))-1]
+}
+
+// ruleNameChars matches the characters not allowed in a rule name
+var ruleNameChars = regexp.MustCompile(`[^A-Za-z0-9_-]+`)
+
+// endpointLimitRule returns a rate-based rule limiting each client IP on a URI, in
+// console JSON
+func endpointLimitRule(uri string, limit int64, window time.Duration) map[string]interface{} {
+	name := "rate-limit-" + strings.Trim(ruleNameChars.ReplaceAllString(uri, "-"), "-")
+	if len(name) > 128 {
+		name = name[:128]
+	}
+	return map[string]interface{}{
+		"Name":     name,
+		"Priority": 0,
+		"Action":   map[string]interface{}{"Block": map[string]interface{}{}},
+		"Statement": map[string]interface{}{
+			"RateBasedStatement": map[string]interface{}{
+				"Limit":               limit,
+				"EvaluationWindowSec": int64(window.Seconds()),
+				"AggregateKeyType":    "IP",
+				"ScopeDownStatement":  byteMatch(uri, "EXACTLY", map[string]interface{}{"UriPath": map[string]interface{}{}}, "NONE"),
+			},
+		},
+		"VisibilityConfig": map[string]interface{}{
+			"SampledRequestsEnabled":   true,
+			"CloudWatchMetricsEnabled": true,
+			"MetricName":               name,
+		},
+	}
+}
@@ -0,0 +1,99 @@
+package analysis
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+)
+
+// Environment records what produced an analysis result, so its numbers can be
+// reproduced exactly from the same archived raw data
+type Environment struct {
+	ToolVersion       string `json:"toolVersion"`
+	GoVersion         string `json:"goVersion"`
+	Deterministic     bool   `json:"deterministic"`     // Always set: nothing is sampled at random, so no seed is needed
+	ConfigHash        string `json:"configHash"`        // SHA-256 of the analysis settings and check scripts
+	InputManifestHash string `json:"inputManifestHash"` // SHA-256 of the input manifest (see ManifestHash)
+	InputFileCount    int    `json:"inputFileCount"`
+}
+
+// ManifestEntry is one input file of an analysis
+type ManifestEntry struct {
+	Path   string `json:"path"` // Slash-separated and relative to the analyzed directory
+	Size   int64  `json:"size"`
+	SHA256 string `json:"sha256"`
+}
+
+// BuildInputManifest hashes every input file, ordered by path
+func BuildInputManifest(dir string, files []string) ([]ManifestEntry, error) {
+	manifest := make([]ManifestEntry, 0, len(files))
+	for _, file := range files {
+		rel, err := filepath.Rel(dir, file)
+		if err != nil {
+			return nil, fmt.Errorf("failed to resolve input path %s: %w", file, err)
+		}
+		size, sum, err := hashFile(file)
+		if err != nil {
+			return nil, err
+		}
+		manifest = append(manifest, ManifestEntry{Path: filepath.ToSlash(rel), Size: size, SHA256: sum})
+	}
+	sort.Slice(manifest, func(i, j int) bool { return manifest[i].Path < manifest[j].Path })
+	return manifest, nil
+}
+
+// ManifestHash returns the SHA-256 of a manifest's canonical form: one
+// "<sha256>  <size>  <path>" line per entry, in path order
+func ManifestHash(manifest []ManifestEntry) string {
+	h := sha256.New()
+	for _, entry := range manifest {
+		fmt.Fprintf(h, "%s  %d  %s\n", entry.SHA256, entry.Size, entry.Path)
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// ConfigHash returns the SHA-256 of the analysis settings (hashed as JSON) and the
+// contents of the given configuration files, such as check scripts. Files are
+// identified by base name so the hash does not depend on where they are stored.
+func ConfigHash(settings interface{}, files []string) (string, error) {
+	data, err := json.Marshal(settings)
+	if err != nil {
+		return "", fmt.Errorf("failed to encode analysis settings: %w", err)
+	}
+
+	h := sha256.New()
+	h.Write(data)
+	h.Write([]byte("\n"))
+
+	sorted := append([]string(nil), files...)
+	sort.Slice(sorted, func(i, j int) bool { return filepath.Base(sorted[i]) < filepath.Base(sorted[j]) })
+	for _, file := range sorted {
+		_, sum, err := hashFile(file)
+		if err != nil {
+			return "", err
+		}
+		fmt.Fprintf(h, "%s  %s\n", sum, filepath.Base(file))
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// hashFile returns the size and hex SHA-256 of a file
+func hashFile(path string) (int64, string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return 0, "", fmt.Errorf("failed to open %s: %w", path, err)
+	}
+	defer file.Close()
+
+	h := sha256.New()
+	size, err := io.Copy(h, file)
+	if err != nil {
+		return 0, "", fmt.Errorf("failed to hash %s: %w", path, err)
+	}
+	return size, hex.EncodeToString(h.Sum(nil)), nil
+}
@@ -0,0 +1,124 @@
+package analysis
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// ExcludedRule is a rule group rule the Web ACL switched to COUNT, either through
+// excludedRules, a rule action override or a COUNT override of the whole group
+type ExcludedRule struct {
+	WebACLRule  string // Name of the Web ACL rule referencing the rule group
+	RuleGroupID string // Rule group as it appears in logs: "<vendor>#<name>" or its ARN
+	RuleID      string // Rule inside the group, "" when the whole group is overridden
+}
+
+// ExcludedRules lists the exclusions configured in a Web ACL snapshot
+func ExcludedRules(snapshot map[string]interface{}) []ExcludedRule {
+	webACL, _ := snapshot["webACL"].(map[string]interface{})
+	rules, _ := webACL["Rules"].([]interface{})
+
+	var excluded []ExcludedRule
+	for _, r := range rules {
+		rule, ok := r.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		name, _ := rule["Name"].(string)
+		statement, _ := rule["Statement"].(map[string]interface{})
+
+		groupID, group := ruleGroupOf(statement)
+		if group == nil {
+			continue
+		}
+
+		if override, ok := rule["OverrideAction"].(map[string]interface{}); ok && override["Count"] != nil {
+			excluded = append(excluded, ExcludedRule{WebACLRule: name, RuleGroupID: groupID})
+			continue
+		}
+		for _, e := range asSlice(group["ExcludedRules"]) {
+			if ruleName, _ := e["Name"].(string); ruleName != "" {
+				excluded = append(excluded, ExcludedRule{WebACLRule: name, RuleGroupID: groupID, RuleID: ruleName})
+			}
+		}
+		for _, o := range asSlice(group["RuleActionOverrides"]) {
+			action, _ := o["ActionToUse"].(map[string]interface{})
+			if ruleName, _ := o["Name"].(string); ruleName != "" && action["Count"] != nil {
+				excluded = append(excluded, ExcludedRule{WebACLRule: name, RuleGroupID: groupID, RuleID: ruleName})
+			}
+		}
+	}
+	return excluded
+}
+
+// ruleGroupOf returns the rule group a rule statement references, as its ID appears
+// in logs, and the group statement; the statement is nil if it is not a rule group
+func ruleGroupOf(statement map[string]interface{}) (string, map[string]interface{}) {
+	if managed, ok := statement["ManagedRuleGroupStatement"].(map[string]interface{}); ok {
+		vendor, _ := managed["VendorName"].(string)
+		groupName, _ := managed["Name"].(string)
+		return vendor + "#" + groupName, managed
+	}
+	if reference, ok := statement["RuleGroupReferenceStatement"].(map[string]interface{}); ok {
+		arn, _ := reference["ARN"].(string)
+		return arn, reference
+	}
+	return "", nil
+}
+
+// asSlice returns the objects of a JSON array, skipping anything else
+func asSlice(v interface{}) []map[string]interface{} {
+	items, _ := v.([]interface{})
+	var result []map[string]interface{}
+	for _, item := range items {
+		if m, ok := item.(map[string]interface{}); ok {
+			result = append(result, m)
+		}
+	}
+	return result
+}
+
+// ExcludedRuleFindings reports exclusions whose rules matched requests that the
+// Web ACL then allowed, i.e. traffic the excluded rule would have blocked
+func ExcludedRuleFindings(webACLName string, excluded []ExcludedRule, stats *Stats) []Finding {
+	var findings []Finding
+	for _, e := range excluded {
+		var allowed int64
+		var matchedRules []string
+		for groupID, rules := range stats.RuleGroups {
+			// Log IDs of managed groups may carry a version suffix
+			if groupID != e.RuleGroupID && !strings.HasPrefix(groupID, e.RuleGroupID+"#") {
+				continue
+			}
+			for ruleID, counts := range rules {
+				if (e.RuleID == "" || ruleID == e.RuleID) && counts.Allowed > 0 {
+					allowed += counts.Allowed
+					matchedRules = append(matchedRules, ruleID)
+				}
+			}
+		}
+		if allowed == 0 {
+			continue
+		}
+		sort.Strings(matchedRules)
+
+		finding := Finding{
+			ID:       "excluded-rule-matched",
+			Severity: SeverityHigh,
+			Source:   "exclusions",
+			Evidence: &Evidence{Rule: matchedRules[0], NotBlocked: true},
+		}
+		if e.RuleID == "" {
+			finding.Title = fmt.Sprintf("Rule group %s is in COUNT mode and matched %d allowed requests", e.RuleGroupID, allowed)
+			finding.Description = fmt.Sprintf("Web ACL %s overrides rule %s (%s) to COUNT. Its rules %s matched %d requests that were then allowed; review whether the override is still needed.",
+				webACLName, e.WebACLRule, e.RuleGroupID, strings.Join(matchedRules, ", "), allowed)
+		} else {
+			finding.Title = fmt.Sprintf("Excluded rule %s matched %d allowed requests", e.RuleID, allowed)
+			finding.Description = fmt.Sprintf("Web ACL %s sets %s in rule %s (%s) to COUNT, and it matched %d requests that were then allowed. These requests would have been blocked without the exclusion; narrow it with a scope-down statement or remove it.",
+				webACLName, e.RuleID, e.WebACLRule, e.RuleGroupID, allowed)
+		}
+		findings = append(findings, finding)
+	}
+	return findings
+}
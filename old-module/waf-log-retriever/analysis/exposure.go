@@ -0,0 +1,354 @@
+package analysis
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"net"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Exposure of a CloudFront origin: whether it can be reached without going through
+// CloudFront and so the Web ACL
+const (
+	ExposureRestricted     = "restricted"      // Not reachable from the internet
+	ExposureHeaderRequired = "header-required" // Reachable, but only forwards requests carrying CloudFront's origin header
+	ExposureCloudFrontOnly = "cloudfront-only" // Reachable from CloudFront's addresses only, of any distribution
+	ExposureOwnWebACL      = "own-web-acl"     // Reachable from the internet, behind a Web ACL of its own
+	ExposureOpen           = "open"            // Reachable from the internet, bypassing the Web ACL
+	ExposureUnknown        = "unknown"         // Its configuration is not known
+)
+
+// ExposureSource is the Source of origin exposure findings
+const ExposureSource = "origin-exposure"
+
+// cloudFrontPrefixList is the AWS-managed prefix list of CloudFront's origin-facing addresses
+const cloudFrontPrefixList = "com.amazonaws.global.cloudfront.origin-facing"
+
+// OriginExposure is how a custom origin of the Web ACL's CloudFront distributions,
+// or a load balancer in ALB access logs, can be reached without CloudFront
+type OriginExposure struct {
+	Distribution     string  `json:"distribution,omitempty"`
+	Origin           string  `json:"origin,omitempty"` // ID of the origin in the distribution
+	DomainName       string  `json:"domainName,omitempty"`
+	LoadBalancer     string  `json:"loadBalancer,omitempty"` // ARN, or app/<name>/<id> as ALB access logs name it
+	Status           string  `json:"status"`                 // See ExposureOpen etc.
+	Reason           string  `json:"reason"`
+	OpenPorts        []int   `json:"openPorts,omitempty"`        // Listener ports its security groups open to the internet
+	DirectRequests   int64   `json:"directRequests,omitempty"`   // ALB access log requests from outside CloudFront forwarded to a target
+	DirectRefused    int64   `json:"directRefused,omitempty"`    // Those the load balancer answered itself, e.g. with a fixed 403 response
+	TopDirectClients []Count `json:"topDirectClients,omitempty"` // Client addresses of the direct requests
+
+	directClients map[string]int64
+}
+
+// OriginExposures evaluates the origins recorded in a Web ACL snapshot of a
+// CloudFront Web ACL. Only load balancer origins can be evaluated: from their
+// scheme, the inbound rules of their security groups on their listener ports, the
+// headers their listener rules require and their own Web ACL. It returns nil when
+// the snapshot holds no origins.
+func OriginExposures(snapshot map[string]interface{}) []OriginExposure {
+	var exposures []OriginExposure
+	for _, origin := range asSlice(snapshot["origins"]) {
+		e := OriginExposure{}
+		e.Distribution, _ = origin["distributionId"].(string)
+		e.Origin, _ = origin["originId"].(string)
+		e.DomainName, _ = origin["domainName"].(string)
+		originType, _ := origin["type"].(string)
+		lb, _ := origin["loadBalancer"].(map[string]interface{})
+		e.LoadBalancer, _ = lb["arn"].(string)
+		switch errMsg, _ := origin["error"].(string); {
+		case errMsg != "":
+			e.Status, e.Reason = ExposureUnknown, "Its configuration could not be read: "+errMsg
+		case originType != "alb" || lb == nil:
+			e.Status, e.Reason = ExposureUnknown, "Only load balancer origins are checked."
+		default:
+			evaluateLoadBalancer(&e, lb, stringSlice(origin["originHeaders"]))
+		}
+		exposures = append(exposures, e)
+	}
+	return exposures
+}
+
+// evaluateLoadBalancer sets the exposure of a load balancer origin
+func evaluateLoadBalancer(e *OriginExposure, lb map[string]interface{}, originHeaders []string) {
+	if scheme, _ := lb["scheme"].(string); scheme == "internal" {
+		e.Status, e.Reason = ExposureRestricted, "The load balancer is internal, reachable only from its VPC, e.g. through CloudFront VPC origins."
+		return
+	}
+	lbType, _ := lb["type"].(string)
+	ingress := asSlice(lb["ingress"])
+	webACL, _ := lb["webACLArn"].(string)
+
+	var cloudFrontPorts, unprotected []int
+	for _, listener := range asSlice(lb["listeners"]) {
+		p, _ := listener["port"].(float64)
+		port := int(p)
+		internet, cloudFront := lbType == "network" && len(ingress) == 0, false // Without security groups, a network load balancer lets everyone in
+		for _, rule := range ingress {
+			if !allowsPort(rule, port) {
+				continue
+			}
+			source, _ := rule["source"].(string)
+			name, _ := rule["sourceName"].(string)
+			switch {
+			case source == "0.0.0.0/0" || source == "::/0":
+				internet = true
+			case name == cloudFrontPrefixList:
+				cloudFront = true
+			}
+		}
+		headerRequired := false
+		for _, h := range stringSlice(listener["requiredHeaders"]) {
+			if slices.Contains(originHeaders, h) {
+				headerRequired = true
+			}
+		}
+		switch {
+		case internet:
+			e.OpenPorts = append(e.OpenPorts, port)
+		case cloudFront:
+			cloudFrontPorts = append(cloudFrontPorts, port)
+		default:
+			continue
+		}
+		if !headerRequired {
+			unprotected = append(unprotected, port)
+		}
+	}
+	sort.Ints(e.OpenPorts)
+	sort.Ints(unprotected)
+
+	switch {
+	case len(e.OpenPorts) == 0 && len(cloudFrontPorts) == 0:
+		e.Status, e.Reason = ExposureRestricted, "Its security groups allow no internet addresses on its listener ports."
+	case len(unprotected) == 0:
+		e.Status, e.Reason = ExposureHeaderRequired, fmt.Sprintf("Its listeners only forward requests with CloudFront's origin header (%s).", strings.Join(originHeaders, ", "))
+	case len(e.OpenPorts) == 0:
+		e.Status, e.Reason = ExposureCloudFrontOnly, fmt.Sprintf("Its security groups only allow CloudFront's origin-facing addresses (%s), which every CloudFront distribution connects from, and its listeners on ports %s forward requests without a secret origin header.", cloudFrontPrefixList, joinInts(unprotected))
+	case webACL != "":
+		e.Status, e.Reason = ExposureOwnWebACL, fmt.Sprintf("The internet can connect to its ports %s, but requests reaching it directly are inspected by its own Web ACL %s.", joinInts(e.OpenPorts), webACL)
+	default:
+		e.Status, e.Reason = ExposureOpen, fmt.Sprintf("It is internet-facing, the internet can connect to its ports %s and its listeners on ports %s forward requests without a secret origin header.", joinInts(e.OpenPorts), joinInts(unprotected))
+	}
+}
+
+// allowsPort reports whether an inbound security group rule allows TCP to a port
+func allowsPort(rule map[string]interface{}, port int) bool {
+	protocol, _ := rule["protocol"].(string)
+	from, _ := rule["fromPort"].(float64)
+	to, _ := rule["toPort"].(float64)
+	return (protocol == "tcp" || protocol == "6" || protocol == "-1") && int(from) <= port && port <= int(to)
+}
+
+// stringSlice returns the strings of a decoded JSON array
+func stringSlice(v interface{}) []string {
+	items, _ := v.([]interface{})
+	var result []string
+	for _, item := range items {
+		if s, ok := item.(string); ok {
+			result = append(result, s)
+		}
+	}
+	return result
+}
+
+// joinInts joins integers with commas
+func joinInts(values []int) string {
+	parts := make([]string, len(values))
+	for i, v := range values {
+		parts[i] = fmt.Sprint(v)
+	}
+	return strings.Join(parts, ", ")
+}
+
+// CorrelateALBLogs counts the requests in the Application Load Balancer access
+// logs below dir that reached a load balancer without going through CloudFront,
+// within the window of the WAF logs. A request is direct when its client address
+// is neither private nor one of CloudFront's ranges; without the ranges, only
+// requests from clients of the Web ACL count. Load balancers in the logs that are
+// not origins of the exposures are added to them with an unknown exposure.
+func CorrelateALBLogs(dir string, exposures []OriginExposure, cloudFront []netip.Prefix, stats *Stats) ([]OriginExposure, error) {
+	clients, _ := wafClientAddresses(stats)
+	from, to := stats.FirstSeen.Add(-albLogInterval), stats.LastSeen.Add(albLogInterval)
+	byELB := make(map[string]int) // Index of the exposure of a load balancer, by its name in the logs
+
+	visit := func(fields []string) {
+		if len(fields) <= albFieldTarget {
+			return
+		}
+		at, err := time.Parse(time.RFC3339Nano, fields[albFieldTime])
+		if err != nil || (stats.TotalRequests > 0 && (at.Before(from) || at.After(to))) {
+			return
+		}
+		host, _, err := net.SplitHostPort(fields[albFieldClient])
+		if err != nil {
+			return
+		}
+		addr, err := netip.ParseAddr(host)
+		if err != nil {
+			return
+		}
+		addr = addr.Unmap()
+		if addr.IsPrivate() || addr.IsLoopback() || sharedAddressSpace.Contains(addr) || inPrefixes(cloudFront, addr) {
+			return
+		}
+		if _, isClient := clients[addr]; len(cloudFront) == 0 && !isClient {
+			return // Possibly CloudFront's
+		}
+
+		elb := fields[albFieldELB]
+		i, ok := byELB[elb]
+		if !ok {
+			i = -1
+			for j := range exposures {
+				if exposures[j].LoadBalancer != "" && strings.HasSuffix(exposures[j].LoadBalancer, "/"+elb) {
+					i = j
+				}
+			}
+			if i < 0 {
+				exposures = append(exposures, OriginExposure{
+					LoadBalancer: elb,
+					Status:       ExposureUnknown,
+					Reason:       "The load balancer is not an origin in the Web ACL snapshot.",
+				})
+				i = len(exposures) - 1
+			}
+			byELB[elb] = i
+		}
+		e := &exposures[i]
+		if fields[albFieldTarget] == "-" {
+			e.DirectRefused++
+			return
+		}
+		e.DirectRequests++
+		if e.directClients == nil {
+			e.directClients = make(map[string]int64)
+		}
+		e.directClients[addr.String()]++
+	}
+
+	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		name := strings.TrimSuffix(info.Name(), ".gz")
+		if info.IsDir() || filepath.Ext(name) != ".log" {
+			return nil
+		}
+		if end, ok := albFileEnd(name); ok && stats.TotalRequests > 0 && (end.Before(from) || end.Add(-albLogInterval).After(to)) {
+			return nil
+		}
+		return readALBFile(path, visit)
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to read ALB access logs: %w", err)
+	}
+	for i := range exposures {
+		exposures[i].TopDirectClients = TopN(exposures[i].directClients, 10)
+	}
+	return exposures, nil
+}
+
+// readALBFile calls visit with the fields of each line of an ALB access log file
+func readALBFile(path string, visit func(fields []string)) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	reader := bufio.NewReader(file)
+	var r io.Reader = reader
+	if magic, _ := reader.Peek(len(gzipMagic)); bytes.Equal(magic, gzipMagic) {
+		gr, err := newGzipReader(reader)
+		if err != nil {
+			return fmt.Errorf("failed to decompress %s: %w", path, err)
+		}
+		defer gr.Close()
+		r = gr
+	}
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		visit(splitALBLine(scanner.Text()))
+	}
+	if err := scanner.Err(); err != nil {
+		return fmt.Errorf("failed to read %s: %w", path, err)
+	}
+	return nil
+}
+
+// ExposureFindings reports origins that can be reached without CloudFront and the
+// Web ACL, and load balancers that received requests from outside CloudFront
+func ExposureFindings(webACLName string, exposures []OriginExposure) []Finding {
+	var findings []Finding
+	for _, e := range exposures {
+		name := e.DomainName
+		if name == "" {
+			name = e.LoadBalancer
+		}
+		if e.Distribution != "" {
+			name = fmt.Sprintf("%s (distribution %s)", name, e.Distribution)
+		}
+		direct := ""
+		if e.DirectRequests > 0 {
+			var top []string
+			for _, c := range e.TopDirectClients {
+				if len(top) < 5 {
+					top = append(top, fmt.Sprintf("%s (%d)", c.Key, c.Count))
+				}
+			}
+			direct = fmt.Sprintf(" Its access logs show %d requests from %d addresses outside CloudFront that reached its targets, e.g. %s.", e.DirectRequests, len(e.directClients), strings.Join(top, ", "))
+		}
+
+		switch e.Status {
+		case ExposureOpen:
+			severity := SeverityHigh
+			if e.DirectRequests > 0 {
+				severity = SeverityCritical
+			}
+			findings = append(findings, Finding{
+				ID:          "origin-reachable-directly",
+				Severity:    severity,
+				Title:       fmt.Sprintf("Origin %s is reachable directly from the internet", name),
+				Description: fmt.Sprintf("%s Anyone who finds the load balancer can send it requests that never pass CloudFront, so Web ACL %s does not inspect them.%s Allow only CloudFront's origin-facing managed prefix list (%s) in its security groups and have CloudFront add a secret origin header that its listener rules require, or move it behind CloudFront VPC origins.", e.Reason, webACLName, direct, cloudFrontPrefixList),
+				Source:      ExposureSource,
+			})
+			continue
+		case ExposureCloudFrontOnly:
+			findings = append(findings, Finding{
+				ID:          "origin-any-cloudfront",
+				Severity:    SeverityMedium,
+				Title:       fmt.Sprintf("Origin %s accepts requests from any CloudFront distribution", name),
+				Description: fmt.Sprintf("%s Anyone can create a distribution of their own with the load balancer as its origin and reach it without Web ACL %s. Have CloudFront add a secret origin header and make the listener rules forward only requests carrying it, or move the origin behind CloudFront VPC origins.", e.Reason, webACLName),
+				Source:      ExposureSource,
+			})
+		case ExposureOwnWebACL:
+			findings = append(findings, Finding{
+				ID:          "origin-own-web-acl",
+				Severity:    SeverityLow,
+				Title:       fmt.Sprintf("Origin %s is reachable directly, behind another Web ACL", name),
+				Description: fmt.Sprintf("%s Its rules may differ from those of Web ACL %s, and requests reaching it directly are missing from these logs. Restrict the load balancer to CloudFront unless direct access is intended.", e.Reason, webACLName),
+				Source:      ExposureSource,
+			})
+		}
+		if e.DirectRequests > 0 {
+			findings = append(findings, Finding{
+				ID:          "origin-direct-requests",
+				Severity:    SeverityHigh,
+				Title:       fmt.Sprintf("Load balancer %s received requests that bypassed CloudFront", name),
+				Description: fmt.Sprintf("The load balancer's exposure is %s: %s%s Web ACL %s never inspected these requests; check whether the configuration changed during the logged period.", e.Status, e.Reason, direct, webACLName),
+				Source:      ExposureSource,
+			})
+		}
+	}
+	return findings
+}
@@ -0,0 +1,62 @@
+package analysis
+
+// Finding severities, from most to least severe
+const (
+	SeverityCritical = "CRITICAL"
+	SeverityHigh     = "HIGH"
+	SeverityMedium   = "MEDIUM"
+	SeverityLow      = "LOW"
+	SeverityInfo     = "INFO"
+)
+
+// Finding is a single observation produced by the analyzer or a custom check
+type Finding struct {
+	ID          string `json:"id"`
+	Severity    string `json:"severity"`
+	Title       string `json:"title"`
+	Description string `json:"description,omitempty"`
+	Source      string `json:"source"` // Built-in detector name or check script file
+
+	EndpointClass string     `json:"endpointClass,omitempty"` // Class of the endpoint the finding is about, if configured
+	Narrative     *Narrative `json:"narrative,omitempty"`     // Model-drafted text, if narratives are enabled
+
+	Evidence *Evidence       `json:"evidence,omitempty"` // Which requests the finding is about, to pick samples from
+	Samples  []SampleRequest `json:"samples,omitempty"`  // Representative requests, see CollectEvidence
+	Score    *Score          `json:"score,omitempty"`    // How the severity was adjusted, if scoring is enabled
+	Assets   []FindingAsset  `json:"assets,omitempty"`   // Assets the requests went to, if an asset map is given
+}
+
+// Narrative is a model-drafted description and remediation of a finding. It is a
+// draft for the reviewer and never replaces the generated description.
+type Narrative struct {
+	Description string `json:"description"`
+	Remediation string `json:"remediation"`
+	Provider    string `json:"provider"`
+	Model       string `json:"model"`
+}
+
+// SeverityRank orders severities from INFO (0) to CRITICAL (4); unknown severities rank -1
+func SeverityRank(s string) int {
+	switch s {
+	case SeverityCritical:
+		return 4
+	case SeverityHigh:
+		return 3
+	case SeverityMedium:
+		return 2
+	case SeverityLow:
+		return 1
+	case SeverityInfo:
+		return 0
+	}
+	return -1
+}
+
+// ValidSeverity reports whether s is one of the known severities
+func ValidSeverity(s string) bool {
+	switch s {
+	case SeverityCritical, SeverityHigh, SeverityMedium, SeverityLow, SeverityInfo:
+		return true
+	}
+	return false
+}
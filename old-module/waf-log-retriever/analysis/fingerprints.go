@@ -0,0 +1,227 @@
+package analysis
+
+import (
+	"fmt"
+	"sort"
+	"time"
+)
+
+// maxFingerprintIPs caps the client IPs kept per TLS fingerprint
+const maxFingerprintIPs = 5000
+
+// maxFingerprintUserAgents caps the User-Agents kept per TLS fingerprint
+const maxFingerprintUserAgents = 100
+
+// FingerprintSettings configure the TLS fingerprint clustering
+type FingerprintSettings struct {
+	MinClientIPs         int     `json:"minClientIps"`         // Distinct IPs sharing a fingerprint that make it a cluster
+	MinMaliciousRequests int64   `json:"minMaliciousRequests"` // Malicious requests a fingerprint needs to be recommended for blocking
+	MinMaliciousShare    float64 `json:"minMaliciousShare"`    // Share of a fingerprint's requests that must be malicious
+}
+
+// FingerprintCounts aggregates the requests that presented one TLS fingerprint
+type FingerprintCounts struct {
+	Requests   int64            `json:"requests"`
+	Blocked    int64            `json:"blocked"`
+	Malicious  int64            `json:"malicious"` // Blocked, matching an attack category or from a scanner
+	FirstSeen  time.Time        `json:"firstSeen"`
+	LastSeen   time.Time        `json:"lastSeen"`
+	ClientIPs  map[string]int64 `json:"clientIps"`  // Capped at maxFingerprintIPs
+	UserAgents map[string]int64 `json:"userAgents"` // Capped at maxFingerprintUserAgents
+	Scanners   map[string]int64 `json:"scanners"`
+}
+
+// fingerprintKey is the key of a fingerprint in Stats.TLSFingerprints
+func fingerprintKey(kind, fingerprint string) string {
+	return kind + ":" + fingerprint
+}
+
+// addFingerprints folds the JA3 and JA4 fingerprints of a record into the aggregate
+func (s *Stats) addFingerprints(r *Record, categories []string, scanner, client string) {
+	malicious := r.Action == "BLOCK" || len(categories) > 0 || scanner != ""
+	for _, fp := range []struct{ kind, value string }{{"ja3", r.JA3Fingerprint}, {"ja4", r.JA4Fingerprint}} {
+		if fp.value == "" {
+			continue
+		}
+		key := fingerprintKey(fp.kind, fp.value)
+		counts, ok := s.TLSFingerprints[key]
+		if !ok {
+			counts = newFingerprintCounts()
+			s.TLSFingerprints[key] = counts
+		}
+		counts.Requests++
+		if r.Action == "BLOCK" {
+			counts.Blocked++
+		}
+		if malicious {
+			counts.Malicious++
+		}
+		ts := r.Time()
+		if counts.FirstSeen.IsZero() || ts.Before(counts.FirstSeen) {
+			counts.FirstSeen = ts
+		}
+		if ts.After(counts.LastSeen) {
+			counts.LastSeen = ts
+		}
+		addCapped(counts.ClientIPs, client, 1, maxFingerprintIPs)
+		addCapped(counts.UserAgents, r.HeaderValue("User-Agent"), 1, maxFingerprintUserAgents)
+		if scanner != "" {
+			counts.Scanners[scanner]++
+		}
+	}
+}
+
+// newFingerprintCounts creates empty fingerprint counts
+func newFingerprintCounts() *FingerprintCounts {
+	return &FingerprintCounts{
+		ClientIPs:  make(map[string]int64),
+		UserAgents: make(map[string]int64),
+		Scanners:   make(map[string]int64),
+	}
+}
+
+// merge folds the counts of the same fingerprint from other records into c
+func (c *FingerprintCounts) merge(o *FingerprintCounts) {
+	c.Requests += o.Requests
+	c.Blocked += o.Blocked
+	c.Malicious += o.Malicious
+	if !o.FirstSeen.IsZero() && (c.FirstSeen.IsZero() || o.FirstSeen.Before(c.FirstSeen)) {
+		c.FirstSeen = o.FirstSeen
+	}
+	if o.LastSeen.After(c.LastSeen) {
+		c.LastSeen = o.LastSeen
+	}
+	for ip, n := range o.ClientIPs {
+		addCapped(c.ClientIPs, ip, n, maxFingerprintIPs)
+	}
+	for ua, n := range o.UserAgents {
+		addCapped(c.UserAgents, ua, n, maxFingerprintUserAgents)
+	}
+	mergeCounts(c.Scanners, o.Scanners)
+}
+
+// addCapped adds n to a key's count, adding new keys only while the map is below max
+func addCapped(counts map[string]int64, key string, n int64, max int) {
+	if _, ok := counts[key]; ok || len(counts) < max {
+		counts[key] += n
+	}
+}
+
+// FingerprintCluster is the traffic of one TLS fingerprint, shared by many client IPs
+// or dominated by malicious requests
+type FingerprintCluster struct {
+	Kind           string                 `json:"kind"` // ja3 or ja4
+	Fingerprint    string                 `json:"fingerprint"`
+	Requests       int64                  `json:"requests"`
+	Blocked        int64                  `json:"blocked"`
+	Malicious      int64                  `json:"malicious"`
+	MaliciousShare float64                `json:"maliciousShare"` // Percentage of the fingerprint's requests
+	ClientIPs      int                    `json:"clientIps"`      // At most maxFingerprintIPs are counted
+	TopClientIPs   []Count                `json:"topClientIps"`
+	TopUserAgents  []Count                `json:"topUserAgents"`
+	Scanners       []Count                `json:"scanners"`
+	Toolkit        string                 `json:"toolkit,omitempty"` // Scanner behind most of the requests, if any
+	FirstSeen      time.Time              `json:"firstSeen"`
+	LastSeen       time.Time              `json:"lastSeen"`
+	BlockRule      map[string]interface{} `json:"blockRule,omitempty"` // Rule blocking the fingerprint, if recommended
+}
+
+// FingerprintReport lists the TLS fingerprints shared by at least MinClientIPs
+// clients, and those whose traffic is dominated by malicious requests with a rule to
+// block them, most requests first
+func FingerprintReport(stats *Stats, settings FingerprintSettings) []FingerprintCluster {
+	report := []FingerprintCluster{}
+	for key, c := range stats.TLSFingerprints {
+		share := float64(c.Malicious) / float64(c.Requests)
+		recommended := c.Malicious >= settings.MinMaliciousRequests && share >= settings.MinMaliciousShare
+		if !recommended && len(c.ClientIPs) < settings.MinClientIPs {
+			continue
+		}
+		kind, fingerprint := key[:3], key[4:]
+		cluster := FingerprintCluster{
+			Kind:           kind,
+			Fingerprint:    fingerprint,
+			Requests:       c.Requests,
+			Blocked:        c.Blocked,
+			Malicious:      c.Malicious,
+			MaliciousShare: 100 * share,
+			ClientIPs:      len(c.ClientIPs),
+			TopClientIPs:   TopN(c.ClientIPs, 10),
+			TopUserAgents:  TopN(c.UserAgents, 5),
+			Scanners:       TopN(c.Scanners, 0),
+			FirstSeen:      c.FirstSeen,
+			LastSeen:       c.LastSeen,
+		}
+		if len(cluster.Scanners) > 0 && 2*cluster.Scanners[0].Count >= c.Requests {
+			cluster.Toolkit = cluster.Scanners[0].Key
+		}
+		if recommended {
+			cluster.BlockRule = fingerprintBlockRule(kind, fingerprint)
+		}
+		report = append(report, cluster)
+	}
+	sort.Slice(report, func(i, j int) bool {
+		if report[i].Requests != report[j].Requests {
+			return report[i].Requests > report[j].Requests
+		}
+		return report[i].Kind+report[i].Fingerprint < report[j].Kind+report[j].Fingerprint
+	})
+	return report
+}
+
+// fingerprintBlockRule returns a Web ACL rule blocking a JA3 or JA4 fingerprint, in
+// console JSON
+func fingerprintBlockRule(kind, fingerprint string) map[string]interface{} {
+	field := "JA3Fingerprint"
+	if kind == "ja4" {
+		field = "JA4Fingerprint"
+	}
+	name := "block-" + kind + "-" + fingerprint
+	return map[string]interface{}{
+		"Name":      name,
+		"Priority":  0,
+		"Action":    map[string]interface{}{"Block": map[string]interface{}{}},
+		"Statement": byteMatch(fingerprint, "EXACTLY", map[string]interface{}{field: map[string]interface{}{"FallbackBehavior": "NO_MATCH"}}, "NONE"),
+		"VisibilityConfig": map[string]interface{}{
+			"SampledRequestsEnabled":   true,
+			"CloudWatchMetricsEnabled": true,
+			"MetricName":               name,
+		},
+	}
+}
+
+// FingerprintFindings reports the fingerprints recommended for blocking
+func FingerprintFindings(webACLName string, report []FingerprintCluster) []Finding {
+	var findings []Finding
+	for _, c := range report {
+		if c.BlockRule == nil {
+			continue
+		}
+		toolkit := ""
+		if c.Toolkit != "" {
+			toolkit = fmt.Sprintf(", mostly %s", c.Toolkit)
+		}
+		cost := "no other requests presented it"
+		if other := c.Requests - c.Malicious; other > 0 {
+			cost = fmt.Sprintf("at the cost of the %d other requests that presented it", other)
+		}
+		findings = append(findings, Finding{
+			ID:       "tls-fingerprint-malicious",
+			Severity: SeverityMedium,
+			Title:    fmt.Sprintf("%.0f%% of the requests with %s fingerprint %s are malicious", c.MaliciousShare, upperKind(c.Kind), c.Fingerprint),
+			Description: fmt.Sprintf("%d of %d requests to Web ACL %s from %d client IPs presented %s fingerprint %s%s; %d were blocked. Blocking the fingerprint stops the toolkit however many IPs it rotates through; %s. The analysis result includes the rule under blockRule.",
+				c.Malicious, c.Requests, webACLName, c.ClientIPs, upperKind(c.Kind), c.Fingerprint, toolkit, c.Blocked, cost),
+			Source:   "fingerprints",
+			Evidence: &Evidence{Fingerprint: fingerprintKey(c.Kind, c.Fingerprint)},
+		})
+	}
+	return findings
+}
+
+// upperKind returns the display name of a fingerprint kind
+func upperKind(kind string) string {
+	if kind == "ja4" {
+		return "JA4"
+	}
+	return "JA3"
+}
@@ -0,0 +1,474 @@
+package analysis
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// DefaultFlowLogPorts are the listener ports of an origin whose inbound flows are
+// correlated, as of an ALB listening for HTTP and HTTPS
+var DefaultFlowLogPorts = []int{80, 443}
+
+// flowLogSlack widens the window of the WAF logs flow records are correlated in,
+// as a flow record aggregates up to 10 minutes of traffic
+const flowLogSlack = 10 * time.Minute
+
+// topFlowSources is how many direct sources a flow log report lists
+const topFlowSources = 20
+
+// defaultFlowLogFields are the fields of the default flow log format, which files
+// without a header line are read by
+// (https://docs.aws.amazon.com/vpc/latest/userguide/flow-log-records.html)
+var defaultFlowLogFields = []string{
+	"version", "account-id", "interface-id", "srcaddr", "dstaddr", "srcport", "dstport",
+	"protocol", "packets", "bytes", "start", "end", "action", "log-status",
+}
+
+// cloudFrontServices are the services of ip-ranges.json whose addresses CloudFront
+// connects to origins from
+var cloudFrontServices = []string{"CLOUDFRONT", "CLOUDFRONT_ORIGIN_FACING"}
+
+// sharedAddressSpace is the carrier-grade NAT range, internal like private ranges
+var sharedAddressSpace = netip.MustParsePrefix("100.64.0.0/10")
+
+// FlowLogSettings select the flow records of an origin's listeners and tell
+// CloudFront's addresses apart
+type FlowLogSettings struct {
+	Interfaces []string       // Network interfaces of the origin, e.g. its ALB's; all in the files if empty
+	Ports      []int          // Listener ports; DefaultFlowLogPorts if empty
+	CloudFront []netip.Prefix // CloudFront's address ranges, see LoadCloudFrontRanges; nil if not known
+}
+
+// FlowCounts counts inbound flows to an origin's listeners
+type FlowCounts struct {
+	Flows   int64 `json:"flows"`
+	Packets int64 `json:"packets"`
+	Bytes   int64 `json:"bytes"`
+	Sources int   `json:"sources"` // Distinct source addresses
+}
+
+// FlowSource is an address that connected to an origin's listeners directly
+type FlowSource struct {
+	Address     string    `json:"address"`
+	Flows       int64     `json:"flows"`
+	Packets     int64     `json:"packets"`
+	Bytes       int64     `json:"bytes"`
+	Ports       []int     `json:"ports"`
+	FirstSeen   time.Time `json:"firstSeen"`
+	LastSeen    time.Time `json:"lastSeen"`
+	WAFRequests int64     `json:"wafRequests,omitempty"` // Requests of the address the Web ACL logged, if it is also one of its clients
+	WAFBlocked  int64     `json:"wafBlocked,omitempty"`  // Of which the Web ACL blocked
+}
+
+// FlowLogReport correlates the VPC Flow Logs of an origin's network interfaces with
+// the WAF logs: inbound flows to its listeners that did not come from CloudFront
+// never traversed CloudFront or the Web ACL
+type FlowLogReport struct {
+	Files         int       `json:"files"`
+	Records       int64     `json:"records"`    // Flow records read
+	Interfaces    []string  `json:"interfaces"` // Interfaces of the inbound flows
+	Ports         []int     `json:"ports"`
+	From          time.Time `json:"from"` // Window of the WAF logs flows are correlated in
+	To            time.Time `json:"to"`
+	OutsideWindow int64     `json:"outsideWindow"` // Inbound flows outside it
+
+	CloudFrontRangesKnown bool       `json:"cloudFrontRangesKnown"`
+	ViaCloudFront         FlowCounts `json:"viaCloudFront"`
+	Internal              FlowCounts `json:"internal"`     // From private addresses, e.g. within the VPC or a peered network
+	Direct                FlowCounts `json:"direct"`       // From other internet addresses, bypassing CloudFront and the Web ACL
+	Unclassified          FlowCounts `json:"unclassified"` // From internet addresses, CloudFront's or not, when its ranges are not known
+	WAFClients            FlowCounts `json:"wafClients"`   // Direct or unclassified flows from clients of the Web ACL
+	Rejected              FlowCounts `json:"rejected"`     // Inbound flows a security group or network ACL rejected
+
+	TopSources []FlowSource `json:"topSources"` // Direct sources, or unclassified clients of the Web ACL, by flows
+}
+
+// flowCounter accumulates FlowCounts with the distinct sources
+type flowCounter struct {
+	FlowCounts
+	sources map[netip.Addr]bool
+}
+
+func (c *flowCounter) add(source netip.Addr, packets, bytes int64) {
+	if c.sources == nil {
+		c.sources = make(map[netip.Addr]bool)
+	}
+	c.Flows++
+	c.Packets += packets
+	c.Bytes += bytes
+	c.sources[source] = true
+}
+
+func (c *flowCounter) counts() FlowCounts {
+	counts := c.FlowCounts
+	counts.Sources = len(c.sources)
+	return counts
+}
+
+// flowRecord is the part of a flow record the correlation needs
+type flowRecord struct {
+	iface          string
+	source         netip.Addr
+	port           int
+	packets, bytes int64
+	start, end     time.Time
+	accepted       bool
+}
+
+// LoadCloudFrontRanges reads CloudFront's address ranges from AWS's ip-ranges.json
+// (https://ip-ranges.amazonaws.com/ip-ranges.json)
+func LoadCloudFrontRanges(path string) ([]netip.Prefix, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read AWS IP ranges: %w", err)
+	}
+	var ranges struct {
+		Prefixes []struct {
+			Prefix  string `json:"ip_prefix"`
+			Service string `json:"service"`
+		} `json:"prefixes"`
+		IPv6Prefixes []struct {
+			Prefix  string `json:"ipv6_prefix"`
+			Service string `json:"service"`
+		} `json:"ipv6_prefixes"`
+	}
+	if err := json.Unmarshal(data, &ranges); err != nil {
+		return nil, fmt.Errorf("failed to parse AWS IP ranges %s: %w", path, err)
+	}
+	var prefixes []netip.Prefix
+	add := func(prefix, service string) error {
+		if !slices.Contains(cloudFrontServices, service) {
+			return nil
+		}
+		p, err := netip.ParsePrefix(prefix)
+		if err != nil {
+			return fmt.Errorf("invalid prefix %q in %s: %w", prefix, path, err)
+		}
+		prefixes = append(prefixes, p.Masked())
+		return nil
+	}
+	for _, p := range ranges.Prefixes {
+		if err := add(p.Prefix, p.Service); err != nil {
+			return nil, err
+		}
+	}
+	for _, p := range ranges.IPv6Prefixes {
+		if err := add(p.Prefix, p.Service); err != nil {
+			return nil, err
+		}
+	}
+	if len(prefixes) == 0 {
+		return nil, fmt.Errorf("%s holds no CloudFront ranges", path)
+	}
+	return prefixes, nil
+}
+
+// AnalyzeFlowLogs reads the VPC Flow Logs below dir, plain or gzipped, in the
+// default format or with a header line naming their fields as S3 delivers them, and
+// classifies the inbound flows to the origin's listeners within the window of the
+// WAF logs by where they came from
+func AnalyzeFlowLogs(dir string, settings FlowLogSettings, stats *Stats) (*FlowLogReport, error) {
+	ports := settings.Ports
+	if len(ports) == 0 {
+		ports = DefaultFlowLogPorts
+	}
+	report := &FlowLogReport{
+		Ports:                 ports,
+		From:                  stats.FirstSeen,
+		To:                    stats.LastSeen,
+		CloudFrontRangesKnown: len(settings.CloudFront) > 0,
+	}
+	clients, blocked := wafClientAddresses(stats)
+
+	var viaCloudFront, internal, direct, unclassified, wafClients, rejected flowCounter
+	sources := make(map[netip.Addr]*FlowSource)
+	interfaces := make(map[string]bool)
+	visit := func(f flowRecord) {
+		if len(settings.Interfaces) > 0 && !slices.Contains(settings.Interfaces, f.iface) {
+			return
+		}
+		if !slices.Contains(ports, f.port) {
+			return
+		}
+		if stats.TotalRequests > 0 && (f.end.Before(stats.FirstSeen.Add(-flowLogSlack)) || f.start.After(stats.LastSeen.Add(flowLogSlack))) {
+			report.OutsideWindow++
+			return
+		}
+		interfaces[f.iface] = true
+		if !f.accepted {
+			rejected.add(f.source, f.packets, f.bytes)
+			return
+		}
+		switch {
+		case f.source.IsPrivate() || f.source.IsLoopback() || f.source.IsLinkLocalUnicast() || sharedAddressSpace.Contains(f.source):
+			internal.add(f.source, f.packets, f.bytes)
+			return
+		case inPrefixes(settings.CloudFront, f.source):
+			viaCloudFront.add(f.source, f.packets, f.bytes)
+			return
+		case report.CloudFrontRangesKnown:
+			direct.add(f.source, f.packets, f.bytes)
+		default:
+			unclassified.add(f.source, f.packets, f.bytes)
+		}
+		requests, isClient := clients[f.source]
+		if isClient {
+			wafClients.add(f.source, f.packets, f.bytes)
+		} else if !report.CloudFrontRangesKnown {
+			return // Possibly CloudFront's
+		}
+		source := sources[f.source]
+		if source == nil {
+			source = &FlowSource{Address: f.source.String(), FirstSeen: f.start, LastSeen: f.end, WAFRequests: requests, WAFBlocked: blocked[f.source]}
+			sources[f.source] = source
+		}
+		source.Flows++
+		source.Packets += f.packets
+		source.Bytes += f.bytes
+		if !slices.Contains(source.Ports, f.port) {
+			source.Ports = append(source.Ports, f.port)
+		}
+		if f.start.Before(source.FirstSeen) {
+			source.FirstSeen = f.start
+		}
+		if f.end.After(source.LastSeen) {
+			source.LastSeen = f.end
+		}
+	}
+
+	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if strings.HasPrefix(info.Name(), ".") && path != dir {
+			if info.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if info.IsDir() {
+			return nil
+		}
+		report.Files++
+		records, err := readFlowLogFile(path, visit)
+		report.Records += records
+		return err
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to read flow logs: %w", err)
+	}
+
+	report.ViaCloudFront = viaCloudFront.counts()
+	report.Internal = internal.counts()
+	report.Direct = direct.counts()
+	report.Unclassified = unclassified.counts()
+	report.WAFClients = wafClients.counts()
+	report.Rejected = rejected.counts()
+	for iface := range interfaces {
+		report.Interfaces = append(report.Interfaces, iface)
+	}
+	sort.Strings(report.Interfaces)
+	for _, source := range sources {
+		sort.Ints(source.Ports)
+		report.TopSources = append(report.TopSources, *source)
+	}
+	sort.Slice(report.TopSources, func(i, j int) bool {
+		a, b := report.TopSources[i], report.TopSources[j]
+		if a.Flows != b.Flows {
+			return a.Flows > b.Flows
+		}
+		return a.Address < b.Address
+	})
+	if len(report.TopSources) > topFlowSources {
+		report.TopSources = report.TopSources[:topFlowSources]
+	}
+	return report, nil
+}
+
+// readFlowLogFile calls visit with each flow record of a file and returns how many
+// it read. Records without data (NODATA, SKIPDATA) are skipped.
+func readFlowLogFile(path string, visit func(flowRecord)) (int64, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer file.Close()
+
+	reader := bufio.NewReader(file)
+	var r io.Reader = reader
+	if magic, _ := reader.Peek(len(gzipMagic)); bytes.Equal(magic, gzipMagic) {
+		gr, err := newGzipReader(reader)
+		if err != nil {
+			return 0, fmt.Errorf("failed to decompress %s: %w", path, err)
+		}
+		defer gr.Close()
+		r = gr
+	}
+
+	var fields map[string]int
+	var records int64
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for line := 1; scanner.Scan(); line++ {
+		values := strings.Fields(scanner.Text())
+		if len(values) == 0 {
+			continue
+		}
+		if fields == nil {
+			names := defaultFlowLogFields
+			_, err := strconv.Atoi(values[0])
+			header := err != nil
+			if header {
+				names = values
+			}
+			fields = make(map[string]int, len(names))
+			for i, name := range names {
+				fields[strings.ReplaceAll(name, "_", "-")] = i
+			}
+			for _, name := range []string{"srcaddr", "dstport", "start", "end", "action"} {
+				if _, ok := fields[name]; !ok {
+					return records, fmt.Errorf("%s is not a VPC Flow Log: it has no %s field", path, name)
+				}
+			}
+			if header {
+				continue
+			}
+		}
+		records++
+		value := func(name string) string {
+			if i, ok := fields[name]; ok && i < len(values) && values[i] != "-" {
+				return values[i]
+			}
+			return ""
+		}
+		if status := value("log-status"); status != "" && status != "OK" {
+			continue
+		}
+		if direction := value("flow-direction"); direction != "" && direction != "ingress" {
+			continue
+		}
+		address := value("pkt-srcaddr")
+		if address == "" {
+			address = value("srcaddr")
+		}
+		source, err := netip.ParseAddr(address)
+		if err != nil {
+			continue
+		}
+		port, err := strconv.Atoi(value("dstport"))
+		if err != nil {
+			continue
+		}
+		start, err1 := strconv.ParseInt(value("start"), 10, 64)
+		end, err2 := strconv.ParseInt(value("end"), 10, 64)
+		if err1 != nil || err2 != nil {
+			return records, fmt.Errorf("%s line %d: invalid start or end time", path, line)
+		}
+		packets, _ := strconv.ParseInt(value("packets"), 10, 64)
+		bytes, _ := strconv.ParseInt(value("bytes"), 10, 64)
+		visit(flowRecord{
+			iface:    value("interface-id"),
+			source:   source.Unmap(),
+			port:     port,
+			packets:  packets,
+			bytes:    bytes,
+			start:    time.Unix(start, 0).UTC(),
+			end:      time.Unix(end, 0).UTC(),
+			accepted: value("action") == "ACCEPT",
+		})
+	}
+	if err := scanner.Err(); err != nil {
+		return records, fmt.Errorf("failed to read %s: %w", path, err)
+	}
+	return records, nil
+}
+
+// wafClientAddresses returns the requests and blocked requests of the addresses the
+// Web ACL logged. Clients counted by a header rather than an address are left out.
+func wafClientAddresses(stats *Stats) (requests, blocked map[netip.Addr]int64) {
+	requests = make(map[netip.Addr]int64)
+	for client, count := range stats.ClientIPs {
+		address, _, _ := strings.Cut(client, " ")
+		if addr, err := netip.ParseAddr(address); err == nil {
+			requests[addr.Unmap()] += count
+		}
+	}
+	blocked = make(map[netip.Addr]int64)
+	for client, count := range stats.BlockedIPs {
+		if addr, err := netip.ParseAddr(client); err == nil {
+			blocked[addr.Unmap()] += count
+		}
+	}
+	return requests, blocked
+}
+
+// inPrefixes reports whether an address is in any of the prefixes
+func inPrefixes(prefixes []netip.Prefix, addr netip.Addr) bool {
+	for _, p := range prefixes {
+		if p.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// FlowLogFindings reports traffic that reached the origin without traversing
+// CloudFront and the Web ACL
+func FlowLogFindings(webACLName string, report *FlowLogReport) []Finding {
+	if report == nil {
+		return nil
+	}
+	bypass := report.Direct
+	if !report.CloudFrontRangesKnown {
+		bypass = report.WAFClients // Without CloudFront's ranges, only its clients are certain to bypass it
+	}
+	if bypass.Flows == 0 {
+		return nil
+	}
+
+	severity := SeverityHigh
+	var blockedSources, top []string
+	for _, s := range report.TopSources {
+		if s.WAFBlocked > 0 {
+			blockedSources = append(blockedSources, s.Address)
+		}
+		if len(top) < 5 {
+			top = append(top, fmt.Sprintf("%s (%d flows)", s.Address, s.Flows))
+		}
+	}
+	description := fmt.Sprintf("The VPC Flow Logs of the origin's network interfaces (%s) show %d inbound flows from %d internet addresses to its listener ports between %s and %s that did not come from CloudFront, so Web ACL %s never inspected their requests.",
+		strings.Join(report.Interfaces, ", "), bypass.Flows, bypass.Sources,
+		report.From.Format(time.RFC3339), report.To.Format(time.RFC3339), webACLName)
+	if !report.CloudFrontRangesKnown {
+		description = fmt.Sprintf("The VPC Flow Logs of the origin's network interfaces (%s) show %d inbound flows to its listener ports between %s and %s from %d addresses that are also clients of Web ACL %s, so they reach the origin both through CloudFront and directly. Another %d internet addresses connected that may or may not be CloudFront's; give AWS's ip-ranges.json to tell them apart.",
+			strings.Join(report.Interfaces, ", "), bypass.Flows,
+			report.From.Format(time.RFC3339), report.To.Format(time.RFC3339), bypass.Sources, webACLName,
+			report.Unclassified.Sources-bypass.Sources)
+	} else if report.WAFClients.Sources > 0 {
+		description += fmt.Sprintf(" %d of the addresses are also clients of the Web ACL.", report.WAFClients.Sources)
+	}
+	if len(blockedSources) > 0 {
+		severity = SeverityCritical
+		description += fmt.Sprintf(" Addresses the Web ACL blocked reached the origin directly: %s.", strings.Join(blockedSources, ", "))
+	}
+	description += fmt.Sprintf(" Top sources: %s.", strings.Join(top, ", "))
+	description += " Allow only CloudFront's origin-facing managed prefix list (com.amazonaws.global.cloudfront.origin-facing) in the origin's security group, have CloudFront add a secret origin header that the ALB's listener rules require, or move the origin behind CloudFront VPC origins."
+	return []Finding{{
+		ID:          "origin-bypass-flow-logs",
+		Severity:    severity,
+		Title:       fmt.Sprintf("%d addresses reached the origin directly, bypassing CloudFront and the Web ACL", bypass.Sources),
+		Description: description,
+		Source:      "flow-logs",
+	}}
+}
@@ -0,0 +1,48 @@
+package analysis
+
+import (
+	"io"
+	"runtime"
+	"sync/atomic"
+
+	"github.com/klauspost/pgzip"
+)
+
+// GzipBlockSize is the size of the blocks gzipped log files are decompressed in
+const GzipBlockSize = 1 << 20
+
+// gzipBlocks is the number of blocks decompressed ahead of parsing, see
+// SetGzipConcurrency
+var gzipBlocks atomic.Int64
+
+// DefaultGzipBlocks returns the number of blocks decompressed ahead of parsing by
+// default: one per CPU, and at least 4
+func DefaultGzipBlocks() int {
+	return max(4, runtime.NumCPU())
+}
+
+// MinGzipBlocks is the fewest blocks decompressed ahead; pgzip computes wrong
+// checksums with a single block
+const MinGzipBlocks = 2
+
+// SetGzipConcurrency sets how many blocks of a gzipped log file are decompressed
+// ahead of parsing, in a goroutine of their own, so decompression and parsing run
+// on separate cores. Each block in flight holds up to GzipBlockSize bytes. Zero or
+// less restores DefaultGzipBlocks, and fewer than MinGzipBlocks is raised to it.
+func SetGzipConcurrency(blocks int) {
+	if blocks > 0 {
+		blocks = max(blocks, MinGzipBlocks)
+	}
+	gzipBlocks.Store(int64(blocks))
+}
+
+// newGzipReader returns a reader decompressing r ahead of its reads, with the
+// concurrency set by SetGzipConcurrency. Like compress/gzip, it reads concatenated
+// gzip members as one stream.
+func newGzipReader(r io.Reader) (io.ReadCloser, error) {
+	blocks := int(gzipBlocks.Load())
+	if blocks <= 0 {
+		blocks = DefaultGzipBlocks()
+	}
+	return pgzip.NewReaderN(r, GzipBlockSize, blocks)
+}
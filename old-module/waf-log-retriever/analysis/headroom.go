@@ -0,0 +1,192 @@
+package analysis
+
+import (
+	"fmt"
+	"strings"
+)
+
+// WebACLCapacityLimit is the most WCUs a Web ACL can use
+const WebACLCapacityLimit = 5000
+
+// WebACLIncludedCapacity is the WCUs included in the Web ACL price; AWS charges for
+// the request inspection of Web ACLs above it
+const WebACLIncludedCapacity = 1500
+
+// capacityWarnShare is the share of the limit from which usage is reported
+const capacityWarnShare = 0.8
+
+// rateBasedRuleWCU is the capacity of a rate-based rule without a scope-down statement
+const rateBasedRuleWCU = 2
+
+// managedRuleGroupWCU are the published capacities of the AWS managed rule groups
+// the analysis can recommend. A new version of a group may cost more.
+var managedRuleGroupWCU = map[string]int64{
+	"AWSManagedRulesCommonRuleSet":          700,
+	"AWSManagedRulesKnownBadInputsRuleSet":  200,
+	"AWSManagedRulesSQLiRuleSet":            200,
+	"AWSManagedRulesAmazonIpReputationList": 25,
+	"AWSManagedRulesATPRuleSet":             50,
+}
+
+// RuleRecommendation is a rule the logs suggest adding, with its capacity
+type RuleRecommendation struct {
+	Rule         string `json:"rule"`                  // Rule group name, or "RateBasedRule"
+	RuleGroupID  string `json:"ruleGroupId,omitempty"` // As it would appear in logs
+	Reason       string `json:"reason"`
+	WCU          int64  `json:"wcu"`
+	ProjectedWCU int64  `json:"projectedWcu"` // Web ACL capacity with this and every earlier recommendation added
+	Fits         bool   `json:"fits"`         // Whether the projected capacity is within the limit
+}
+
+// CapacityHeadroom is the WCU usage of a Web ACL against its limit
+type CapacityHeadroom struct {
+	Used            int64                `json:"used"`
+	Source          string               `json:"source"` // "CheckCapacity", or "GetWebACL" for older snapshots
+	Limit           int64                `json:"limit"`
+	Headroom        int64                `json:"headroom"`
+	UsedShare       float64              `json:"usedShare"` // Percentage of the limit
+	Recommendations []RuleRecommendation `json:"recommendations"`
+}
+
+// BuildCapacityHeadroom compares the capacity of the Web ACL in a snapshot with the
+// limit, and projects the capacity after each rule the analysis result recommends.
+// It returns nil when the snapshot records no capacity.
+func BuildCapacityHeadroom(snapshot map[string]interface{}, result *Result) *CapacityHeadroom {
+	webACL, _ := snapshot["webACL"].(map[string]interface{})
+	h := &CapacityHeadroom{Limit: WebACLCapacityLimit}
+	if used, ok := snapshot["ruleSetCapacity"].(float64); ok {
+		h.Used, h.Source = int64(used), "CheckCapacity"
+	} else if used, ok := webACL["Capacity"].(float64); ok {
+		h.Used, h.Source = int64(used), "GetWebACL"
+	} else {
+		return nil
+	}
+	h.Headroom = h.Limit - h.Used
+	h.UsedShare = 100 * float64(h.Used) / float64(h.Limit)
+
+	projected := h.Used
+	for _, rec := range recommendRules(webACL, result) {
+		projected += rec.WCU
+		rec.ProjectedWCU = projected
+		rec.Fits = projected <= h.Limit
+		h.Recommendations = append(h.Recommendations, rec)
+	}
+	if h.Recommendations == nil {
+		h.Recommendations = []RuleRecommendation{}
+	}
+	return h
+}
+
+// recommendRules lists the rules missing from a Web ACL that the observed traffic
+// calls for, most fundamental first
+func recommendRules(webACL map[string]interface{}, result *Result) []RuleRecommendation {
+	configured := make(map[string]bool)
+	rateBased := false
+	for _, rule := range asSlice(webACL["Rules"]) {
+		statement, _ := rule["Statement"].(map[string]interface{})
+		if groupID, group := ruleGroupOf(statement); group != nil {
+			if name, _ := group["Name"].(string); name != "" {
+				configured[name] = true
+			}
+			configured[groupID] = true
+		}
+		if statementType(statement) == "RateBasedStatement" {
+			rateBased = true
+		}
+	}
+
+	var recs []RuleRecommendation
+	recommend := func(group, reason string) {
+		if configured[group] {
+			return
+		}
+		configured[group] = true
+		recs = append(recs, RuleRecommendation{
+			Rule:        group,
+			RuleGroupID: "AWS#" + group,
+			Reason:      reason,
+			WCU:         managedRuleGroupWCU[group],
+		})
+	}
+
+	var attacks, injection int64
+	for _, e := range result.AttackLandscape {
+		attacks += e.Requests - e.Blocked
+		if e.OWASP == "A03:2021" {
+			injection += e.Requests - e.Blocked
+		}
+	}
+	var scanned int64
+	for _, s := range result.Scanners {
+		scanned += s.Allowed
+	}
+	if attacks > 0 || scanned > 0 {
+		recommend("AWSManagedRulesCommonRuleSet", fmt.Sprintf("%d attack and %d scanner requests were not blocked", attacks, scanned))
+	}
+	if injection > 0 {
+		recommend("AWSManagedRulesSQLiRuleSet", fmt.Sprintf("%d injection requests were not blocked", injection))
+	}
+	if scanned > 0 {
+		recommend("AWSManagedRulesKnownBadInputsRuleSet", fmt.Sprintf("%d scanner requests were not blocked", scanned))
+		recommend("AWSManagedRulesAmazonIpReputationList", fmt.Sprintf("%d scanner requests were not blocked", scanned))
+	}
+	if a := result.AuthAbuse; a != nil && len(a.RotatingWindows)+len(a.BruteForceIPs)+len(a.LowAndSlowIPs) > 0 {
+		recommend("AWSManagedRulesATPRuleSet", "login abuse was detected on authentication endpoints")
+	}
+
+	if a := result.APIAbuse; !rateBased && a != nil && len(a.Enumeration)+len(a.PathProbing)+len(a.Velocity) > 0 {
+		recs = append(recs, RuleRecommendation{
+			Rule:   "RateBasedRule",
+			Reason: fmt.Sprintf("no rate-based rule limits the %d enumeration, path probing and velocity cases", len(a.Enumeration)+len(a.PathProbing)+len(a.Velocity)),
+			WCU:    rateBasedRuleWCU,
+		})
+	}
+	return recs
+}
+
+// CapacityHeadroomFindings reports Web ACLs close to the capacity limit and
+// recommended rules that would not fit, or would cross the included capacity
+func CapacityHeadroomFindings(webACLName string, h *CapacityHeadroom) []Finding {
+	if h == nil {
+		return nil
+	}
+	var findings []Finding
+	if float64(h.Used) >= capacityWarnShare*float64(h.Limit) {
+		findings = append(findings, Finding{
+			ID:          "webacl-capacity-high",
+			Severity:    SeverityMedium,
+			Title:       fmt.Sprintf("Web ACL uses %d of %d WCUs", h.Used, h.Limit),
+			Description: fmt.Sprintf("Web ACL %s uses %.0f%% of its capacity, leaving %d WCUs for new rules. Remove or consolidate rules that rarely match before adding protections.", webACLName, h.UsedShare, h.Headroom),
+			Source:      "capacity",
+		})
+	}
+
+	var overLimit, overIncluded []string
+	for _, rec := range h.Recommendations {
+		entry := fmt.Sprintf("%s (%d WCUs, %d projected)", rec.Rule, rec.WCU, rec.ProjectedWCU)
+		if !rec.Fits {
+			overLimit = append(overLimit, entry)
+		} else if len(overIncluded) == 0 && h.Used <= WebACLIncludedCapacity && rec.ProjectedWCU > WebACLIncludedCapacity {
+			overIncluded = append(overIncluded, entry)
+		}
+	}
+	if len(overLimit) > 0 {
+		findings = append(findings, Finding{
+			ID:          "recommended-rules-exceed-capacity",
+			Severity:    SeverityMedium,
+			Title:       fmt.Sprintf("%d recommended rules do not fit in the Web ACL's capacity", len(overLimit)),
+			Description: fmt.Sprintf("Web ACL %s has %d WCUs of headroom. Adding the recommended rules in order exceeds the %d WCU limit from %s; free capacity first.", webACLName, h.Headroom, h.Limit, strings.Join(overLimit, ", ")),
+			Source:      "capacity",
+		})
+	}
+	if len(overIncluded) > 0 {
+		findings = append(findings, Finding{
+			ID:          "recommended-rules-exceed-included-capacity",
+			Severity:    SeverityInfo,
+			Title:       fmt.Sprintf("Recommended rules take the Web ACL past %d WCUs", WebACLIncludedCapacity),
+			Description: fmt.Sprintf("Web ACL %s uses %d WCUs. Adding the recommended rules in order crosses the %d WCUs included in the Web ACL price at %s, which adds request inspection charges.", webACLName, h.Used, WebACLIncludedCapacity, strings.Join(overIncluded, ", ")),
+			Source:      "capacity",
+		})
+	}
+	return findings
+}
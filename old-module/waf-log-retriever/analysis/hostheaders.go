@@ -0,0 +1,439 @@
+package analysis
+
+import (
+	"fmt"
+	"net"
+	"net/netip"
+	"slices"
+	"sort"
+	"strings"
+)
+
+// Kinds of Host header anomalies. The first three are injection attempts; the others
+// are requests addressed to something other than a site's name.
+const (
+	HostMalformed  = "malformed"  // Characters no host name has, e.g. an injected path, user info or line break
+	HostDuplicate  = "duplicate"  // More than one Host header, with different values
+	HostOverride   = "override"   // A forwarding header naming another host, e.g. X-Forwarded-Host
+	HostMissing    = "missing"    // No Host header
+	HostIPLiteral  = "ip-literal" // An IP address rather than a name
+	HostPort       = "port"       // A port other than 80 or 443
+	HostMissingSNI = "no-sni"     // A name in the Host header but none in the TLS handshake, from JA4
+)
+
+// hostInjectionKinds are the anomalies that try to make the application trust
+// another host
+var hostInjectionKinds = []string{HostMalformed, HostDuplicate, HostOverride}
+
+// hostOverrideHeaders are the headers frameworks and proxies take the host from in
+// place of the Host header
+var hostOverrideHeaders = []string{"X-Forwarded-Host", "X-Host", "X-Original-Host", "X-Forwarded-Server", "X-HTTP-Host-Override", "Forwarded"}
+
+// Caps of the sets tracked per Host header anomaly
+const (
+	maxHostAnomalyValues  = 200
+	maxHostAnomalyClients = 1000
+	maxHostAnomalyURIs    = 200
+)
+
+// HostAnomalyCounts aggregates the requests with one kind of Host header anomaly
+type HostAnomalyCounts struct {
+	Requests  int64            `json:"requests"`
+	Blocked   int64            `json:"blocked"`
+	Values    map[string]int64 `json:"values"`    // Offending values, capped at maxHostAnomalyValues
+	ClientIPs map[string]int64 `json:"clientIps"` // Capped at maxHostAnomalyClients
+	URIs      map[string]int64 `json:"uris"`      // Capped at maxHostAnomalyURIs
+}
+
+// hostAnomaly is one anomaly of a record and the value it was found in
+type hostAnomaly struct {
+	kind, value string
+}
+
+// hostAnomalies returns the Host header anomalies of a record
+func hostAnomalies(r *Record) []hostAnomaly {
+	var values []string
+	for _, h := range r.HTTPRequest.Headers {
+		if strings.EqualFold(h.Name, "Host") {
+			values = append(values, h.Value)
+		}
+	}
+	raw := strings.TrimSpace(r.HTTPRequest.Host)
+	if raw == "" && len(values) > 0 {
+		raw = strings.TrimSpace(values[0])
+	}
+	if raw == "" {
+		return []hostAnomaly{{HostMissing, ""}}
+	}
+
+	var anomalies []hostAnomaly
+	host, port := raw, ""
+	if h, p, err := net.SplitHostPort(raw); err == nil {
+		host, port = h, p
+	}
+	host = strings.TrimSuffix(strings.ToLower(strings.Trim(host, "[]")), ".")
+	_, ipErr := netip.ParseAddr(host)
+	switch {
+	case ipErr == nil:
+		anomalies = append(anomalies, hostAnomaly{HostIPLiteral, raw})
+	case !validHostName(host):
+		anomalies = append(anomalies, hostAnomaly{HostMalformed, raw})
+	case len(r.JA4Fingerprint) > 3 && r.JA4Fingerprint[3] == 'i':
+		anomalies = append(anomalies, hostAnomaly{HostMissingSNI, host})
+	}
+	if port != "" && port != "80" && port != "443" {
+		anomalies = append(anomalies, hostAnomaly{HostPort, raw})
+	}
+	for _, v := range values {
+		if !strings.EqualFold(strings.TrimSpace(v), raw) {
+			anomalies = append(anomalies, hostAnomaly{HostDuplicate, strings.Join(values, ", ")})
+			break
+		}
+	}
+	for _, name := range hostOverrideHeaders {
+		override := r.HeaderValue(name)
+		if name == "Forwarded" {
+			override = forwardedHost(override)
+		}
+		if override == "" {
+			continue
+		}
+		if h, _, err := net.SplitHostPort(override); err == nil {
+			override = h
+		}
+		if !strings.EqualFold(strings.TrimSuffix(override, "."), host) {
+			anomalies = append(anomalies, hostAnomaly{HostOverride, name + ": " + r.HeaderValue(name)})
+			break
+		}
+	}
+	return anomalies
+}
+
+// validHostName reports whether a lower-cased host is a DNS name: labels of letters,
+// digits, hyphens and underscores, none empty or longer than 63 characters
+func validHostName(host string) bool {
+	if host == "" || len(host) > 253 {
+		return false
+	}
+	for _, label := range strings.Split(host, ".") {
+		if label == "" || len(label) > 63 || label[0] == '-' {
+			return false
+		}
+		for _, c := range label {
+			if !(c >= 'a' && c <= 'z' || c >= '0' && c <= '9' || c == '-' || c == '_') {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// forwardedHost returns the first host parameter of a Forwarded header (RFC 7239)
+func forwardedHost(value string) string {
+	for _, element := range strings.Split(value, ",") {
+		for _, pair := range strings.Split(element, ";") {
+			if k, v, ok := strings.Cut(strings.TrimSpace(pair), "="); ok && strings.EqualFold(k, "host") {
+				return strings.Trim(v, `"`)
+			}
+		}
+	}
+	return ""
+}
+
+// addHostAnomalies folds the Host header anomalies of a record into the aggregate
+func (s *Stats) addHostAnomalies(r *Record, client string) {
+	for _, a := range hostAnomalies(r) {
+		if s.HostAnomalies == nil {
+			s.HostAnomalies = make(map[string]*HostAnomalyCounts)
+		}
+		counts := s.HostAnomalies[a.kind]
+		if counts == nil {
+			counts = newHostAnomalyCounts()
+			s.HostAnomalies[a.kind] = counts
+		}
+		counts.Requests++
+		if r.Action == "BLOCK" {
+			counts.Blocked++
+		}
+		addCapped(counts.Values, a.value, 1, maxHostAnomalyValues)
+		addCapped(counts.ClientIPs, client, 1, maxHostAnomalyClients)
+		addCapped(counts.URIs, r.HTTPRequest.URI, 1, maxHostAnomalyURIs)
+	}
+}
+
+func newHostAnomalyCounts() *HostAnomalyCounts {
+	return &HostAnomalyCounts{
+		Values:    make(map[string]int64),
+		ClientIPs: make(map[string]int64),
+		URIs:      make(map[string]int64),
+	}
+}
+
+// merge folds the counts of another aggregate into c
+func (c *HostAnomalyCounts) merge(o *HostAnomalyCounts) {
+	c.Requests += o.Requests
+	c.Blocked += o.Blocked
+	for value, n := range o.Values {
+		addCapped(c.Values, value, n, maxHostAnomalyValues)
+	}
+	for ip, n := range o.ClientIPs {
+		addCapped(c.ClientIPs, ip, n, maxHostAnomalyClients)
+	}
+	for uri, n := range o.URIs {
+		addCapped(c.URIs, uri, n, maxHostAnomalyURIs)
+	}
+}
+
+// HostAnomaly is the report of one kind of Host header anomaly
+type HostAnomaly struct {
+	Kind         string  `json:"kind"`
+	Requests     int64   `json:"requests"`
+	Blocked      int64   `json:"blocked"`
+	Allowed      int64   `json:"allowed"` // Not blocked, including COUNT, CAPTCHA and CHALLENGE outcomes
+	TopValues    []Count `json:"topValues"`
+	TopClientIPs []Count `json:"topClientIps"`
+	TopURIs      []Count `json:"topUris"`
+}
+
+// UnexpectedHost is the traffic to one host outside the expected domains
+type UnexpectedHost struct {
+	Host         string  `json:"host"`
+	Requests     int64   `json:"requests"`
+	Blocked      int64   `json:"blocked"`
+	TopClientIPs []Count `json:"topClientIps"`
+	TopURIs      []Count `json:"topUris"`
+}
+
+// HostHeaderReport lists Host header injection attempts and other anomalies, and the
+// traffic to hosts outside the expected domains
+type HostHeaderReport struct {
+	ExpectedHosts      []string               `json:"expectedHosts,omitempty"` // Host patterns, from the settings or the asset map; none means unexpected hosts are not checked
+	Anomalies          []HostAnomaly          `json:"anomalies"`               // Injection attempts first
+	Unexpected         []UnexpectedHost       `json:"unexpected"`              // Busiest first
+	UnexpectedRequests int64                  `json:"unexpectedRequests"`
+	UnexpectedAllowed  int64                  `json:"unexpectedAllowed"`
+	BlockRule          map[string]interface{} `json:"blockRule,omitempty"` // Rule blocking requests to other hosts, if some were allowed
+}
+
+// ExpectedHostPatterns returns the host patterns a Web ACL's traffic is expected to be
+// addressed to: those of the settings, or else the hosts of the asset map
+func (s *Settings) ExpectedHostPatterns() []string {
+	if len(s.ExpectedHosts) > 0 {
+		return s.ExpectedHosts
+	}
+	var patterns []string
+	for _, asset := range s.Assets {
+		for _, host := range asset.Hosts {
+			if !containsFold(patterns, host) {
+				patterns = append(patterns, host)
+			}
+		}
+	}
+	return patterns
+}
+
+// containsFold reports whether values contains s, case-insensitively
+func containsFold(values []string, s string) bool {
+	for _, v := range values {
+		if strings.EqualFold(v, s) {
+			return true
+		}
+	}
+	return false
+}
+
+// BuildHostHeaderReport summarizes the Host header anomalies of the statistics and,
+// when expected hosts are known, the traffic to other hosts. It returns nil when
+// there is neither.
+func BuildHostHeaderReport(stats *Stats, settings *Settings) *HostHeaderReport {
+	expected := settings.ExpectedHostPatterns()
+	if len(stats.HostAnomalies) == 0 && len(expected) == 0 {
+		return nil
+	}
+	report := &HostHeaderReport{
+		ExpectedHosts: expected,
+		Anomalies:     []HostAnomaly{},
+		Unexpected:    []UnexpectedHost{},
+	}
+	for kind, c := range stats.HostAnomalies {
+		report.Anomalies = append(report.Anomalies, HostAnomaly{
+			Kind:         kind,
+			Requests:     c.Requests,
+			Blocked:      c.Blocked,
+			Allowed:      c.Requests - c.Blocked,
+			TopValues:    TopN(c.Values, 10),
+			TopClientIPs: TopN(c.ClientIPs, 10),
+			TopURIs:      TopN(c.URIs, 10),
+		})
+	}
+	sort.Slice(report.Anomalies, func(i, j int) bool {
+		a, b := report.Anomalies[i], report.Anomalies[j]
+		if ai, bi := slices.Contains(hostInjectionKinds, a.Kind), slices.Contains(hostInjectionKinds, b.Kind); ai != bi {
+			return ai
+		}
+		if a.Requests != b.Requests {
+			return a.Requests > b.Requests
+		}
+		return a.Kind < b.Kind
+	})
+	if len(expected) == 0 {
+		return report
+	}
+
+	for host, hostStats := range stats.Hosts {
+		if hostMatchesAny(expected, host) {
+			continue
+		}
+		blocked := hostStats.Actions["BLOCK"]
+		report.Unexpected = append(report.Unexpected, UnexpectedHost{
+			Host:         host,
+			Requests:     hostStats.TotalRequests,
+			Blocked:      blocked,
+			TopClientIPs: TopN(hostStats.ClientIPs, 5),
+			TopURIs:      TopN(hostStats.URIs, 5),
+		})
+		report.UnexpectedRequests += hostStats.TotalRequests
+		report.UnexpectedAllowed += hostStats.TotalRequests - blocked
+	}
+	sort.Slice(report.Unexpected, func(i, j int) bool {
+		if report.Unexpected[i].Requests != report.Unexpected[j].Requests {
+			return report.Unexpected[i].Requests > report.Unexpected[j].Requests
+		}
+		return report.Unexpected[i].Host < report.Unexpected[j].Host
+	})
+	if report.UnexpectedAllowed > 0 {
+		report.BlockRule = unexpectedHostRule(expected)
+	}
+	return report
+}
+
+// hostMatchesAny reports whether a host matches one of the patterns, see MatchHost
+func hostMatchesAny(patterns []string, host string) bool {
+	for _, pattern := range patterns {
+		if MatchHost(pattern, host) {
+			return true
+		}
+	}
+	return false
+}
+
+// unexpectedHostRule returns a Web ACL rule blocking requests whose Host header
+// matches none of the expected patterns, in console JSON
+func unexpectedHostRule(patterns []string) map[string]interface{} {
+	hostHeader := map[string]interface{}{"SingleHeader": map[string]interface{}{"Name": "host"}}
+	var matches []interface{}
+	for _, pattern := range patterns {
+		if suffix, ok := strings.CutPrefix(strings.ToLower(pattern), "*"); ok && strings.HasPrefix(suffix, ".") {
+			matches = append(matches, byteMatch(suffix, "ENDS_WITH", hostHeader, "LOWERCASE"))
+		} else {
+			matches = append(matches, byteMatch(strings.ToLower(pattern), "EXACTLY", hostHeader, "LOWERCASE"))
+		}
+	}
+	expected := matches[0]
+	if len(matches) > 1 {
+		expected = map[string]interface{}{"OrStatement": map[string]interface{}{"Statements": matches}}
+	}
+	name := "block-unexpected-hosts"
+	return map[string]interface{}{
+		"Name":      name,
+		"Priority":  0,
+		"Action":    map[string]interface{}{"Block": map[string]interface{}{}},
+		"Statement": map[string]interface{}{"NotStatement": map[string]interface{}{"Statement": expected}},
+		"VisibilityConfig": map[string]interface{}{
+			"SampledRequestsEnabled":   true,
+			"CloudWatchMetricsEnabled": true,
+			"MetricName":               name,
+		},
+	}
+}
+
+// hostAnomalyDescriptions say what the requests with each kind of anomaly did
+var hostAnomalyDescriptions = map[string]string{
+	HostMalformed:  "carried a Host header with characters no host name has",
+	HostDuplicate:  "carried several Host headers with different values",
+	HostOverride:   "named another host in X-Forwarded-Host or a similar header",
+	HostMissing:    "carried no Host header",
+	HostIPLiteral:  "were addressed to an IP address rather than a host name",
+	HostPort:       "named a port other than 80 or 443 in the Host header",
+	HostMissingSNI: "named a host they did not send in the TLS handshake (SNI)",
+}
+
+// HostHeaderFindings reports Host header injection attempts, other anomalies that
+// were not all blocked, and traffic to unexpected hosts
+func HostHeaderFindings(webACLName string, report *HostHeaderReport) []Finding {
+	if report == nil {
+		return nil
+	}
+	var findings []Finding
+	for _, a := range report.Anomalies {
+		var values []string
+		for _, v := range a.TopValues[:min(3, len(a.TopValues))] {
+			values = append(values, fmt.Sprintf("%q (%d)", v.Key, v.Count))
+		}
+		var clients []string
+		for _, c := range a.TopClientIPs[:min(5, len(a.TopClientIPs))] {
+			clients = append(clients, c.Key)
+		}
+		title := fmt.Sprintf("%d requests %s", a.Requests, hostAnomalyDescriptions[a.Kind])
+		description := fmt.Sprintf("%d requests to Web ACL %s from %s %s; %d were not blocked.",
+			a.Requests, webACLName, strings.Join(clients, ", "), hostAnomalyDescriptions[a.Kind], a.Allowed)
+		if len(values) > 0 && a.Kind != HostMissing {
+			description += fmt.Sprintf(" Most frequent values: %s.", strings.Join(values, ", "))
+		}
+
+		if slices.Contains(hostInjectionKinds, a.Kind) {
+			severity := SeverityLow
+			if a.Allowed > 0 {
+				severity = SeverityHigh
+			}
+			findings = append(findings, Finding{
+				ID:          "host-header-injection",
+				Severity:    severity,
+				Title:       title,
+				Description: description + " Applications that build links, redirects or cache keys from the Host header can be made to send password reset links, cached pages or routed requests to an attacker's host. Block requests whose Host header matches no expected host, drop X-Forwarded-Host and similar headers at the edge, and never build absolute URLs from request headers.",
+				Source:      "host-headers",
+			})
+			continue
+		}
+		if a.Allowed == 0 {
+			continue
+		}
+		description += " Such requests mostly come from scanners sweeping address ranges and ports, and reach the origin if the Web ACL lets them through."
+		if a.Kind == HostMissingSNI {
+			description += " Their JA4 fingerprints show a TLS handshake without SNI, so the client connected by address and chose the host afterwards, as in domain fronting."
+		}
+		findings = append(findings, Finding{
+			ID:          "host-header-anomaly",
+			Severity:    SeverityLow,
+			Title:       title,
+			Description: description,
+			Source:      "host-headers",
+		})
+	}
+
+	if report.UnexpectedRequests > 0 {
+		var hosts []string
+		for _, h := range report.Unexpected[:min(5, len(report.Unexpected))] {
+			host := h.Host
+			if host == "" {
+				host = "(none)"
+			}
+			hosts = append(hosts, fmt.Sprintf("%s (%d)", host, h.Requests))
+		}
+		severity := SeverityLow
+		description := fmt.Sprintf("%d requests to Web ACL %s were addressed to %d hosts matching none of the expected hosts (%s): %s. %d of them were not blocked.",
+			report.UnexpectedRequests, webACLName, len(report.Unexpected), strings.Join(report.ExpectedHosts, ", "), strings.Join(hosts, ", "), report.UnexpectedAllowed)
+		if report.UnexpectedAllowed > 0 {
+			severity = SeverityMedium
+			description += " The origin answers requests for hosts it does not serve, which lets attackers reach it under names no rule scoped to your domains inspects and fingerprints it for host header attacks. The analysis result includes a rule blocking them under blockRule."
+		}
+		findings = append(findings, Finding{
+			ID:          "host-header-unexpected",
+			Severity:    severity,
+			Title:       fmt.Sprintf("%d requests went to hosts outside the expected domains", report.UnexpectedRequests),
+			Description: description,
+			Source:      "host-headers",
+		})
+	}
+	return findings
+}
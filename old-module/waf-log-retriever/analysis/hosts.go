@@ -0,0 +1,104 @@
+package analysis
+
+import (
+	"net"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Host returns the lower-cased host the request was sent to, without a port, or ""
+// if the record has none
+func (r *Record) Host() string {
+	host := r.HTTPRequest.Host
+	if host == "" {
+		host = r.HeaderValue("Host")
+	}
+	host = strings.ToLower(strings.TrimSpace(host))
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	return host
+}
+
+// MatchHost reports whether a host matches a pattern, case-insensitively. A pattern
+// starting with *. matches any subdomain; others match exactly.
+func MatchHost(pattern, host string) bool {
+	pattern = strings.ToLower(pattern)
+	if suffix, ok := strings.CutPrefix(pattern, "*"); ok && strings.HasPrefix(suffix, ".") {
+		return strings.HasSuffix(host, suffix)
+	}
+	return host == pattern
+}
+
+// IncludesHost reports whether a record for host passes the host filter of the settings
+func (s *Settings) IncludesHost(host string) bool {
+	if len(s.Hosts) == 0 {
+		return true
+	}
+	for _, pattern := range s.Hosts {
+		if MatchHost(pattern, host) {
+			return true
+		}
+	}
+	return false
+}
+
+// addHost folds a record into the statistics of its host
+func (s *Stats) addHost(r *Record) {
+	if s.Hosts == nil {
+		return // Per-host statistics themselves
+	}
+	host := r.Host()
+	hostStats, ok := s.Hosts[host]
+	if !ok {
+		hostStats = NewStats(s.settings)
+		hostStats.Hosts, hostStats.Sources = nil, nil
+		s.Hosts[host] = hostStats
+	}
+	hostStats.Add(r)
+}
+
+// HostReport is the report section of one host
+type HostReport struct {
+	Host            string            `json:"host"`
+	Requests        int64             `json:"requests"`
+	Blocked         int64             `json:"blocked"`
+	FirstSeen       time.Time         `json:"firstSeen"`
+	LastSeen        time.Time         `json:"lastSeen"`
+	Actions         map[string]int64  `json:"actions"`
+	TopURIs         []Count           `json:"topUris"`
+	TopClientIPs    []Count           `json:"topClientIps"`
+	TopCountries    []Count           `json:"topCountries"`
+	TopRules        []Count           `json:"topRules"`
+	AttackLandscape []LandscapeEntry  `json:"attackLandscape"`
+	Scanners        []ScannerActivity `json:"scanners"`
+}
+
+// HostBreakdown builds the per-host report sections, busiest host first
+func HostBreakdown(stats *Stats) []HostReport {
+	reports := make([]HostReport, 0, len(stats.Hosts))
+	for host, hostStats := range stats.Hosts {
+		reports = append(reports, HostReport{
+			Host:            host,
+			Requests:        hostStats.TotalRequests,
+			Blocked:         hostStats.Actions["BLOCK"],
+			FirstSeen:       hostStats.FirstSeen,
+			LastSeen:        hostStats.LastSeen,
+			Actions:         hostStats.Actions,
+			TopURIs:         TopN(hostStats.URIs, 10),
+			TopClientIPs:    TopN(hostStats.ClientIPs, 10),
+			TopCountries:    TopN(hostStats.Countries, 10),
+			TopRules:        TopN(hostStats.TerminatingRules, 10),
+			AttackLandscape: AttackLandscape(hostStats),
+			Scanners:        ScannerReport(hostStats),
+		})
+	}
+	sort.Slice(reports, func(i, j int) bool {
+		if reports[i].Requests != reports[j].Requests {
+			return reports[i].Requests > reports[j].Requests
+		}
+		return reports[i].Host < reports[j].Host
+	})
+	return reports
+}
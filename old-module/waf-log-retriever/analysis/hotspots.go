@@ -0,0 +1,312 @@
+package analysis
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"io"
+	"math"
+	"net/netip"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// Locator places client IPs, e.g. with a GeoIP City database
+type Locator interface {
+	Locate(addr netip.Addr) (lat, lon float64, ok bool)
+}
+
+// Hotspot is one cell of the spatial aggregation of client IPs
+type Hotspot struct {
+	Lat               float64 // Center of the cell
+	Lon               float64
+	Country           string
+	Requests          int64
+	Blocked           int64
+	Attacks           int64 // Matching an attack category or from a scanner
+	AttacksNotBlocked int64
+	ClientIPs         int64
+	Networks          int64 // /24 IPv4 and /48 IPv6 networks of the client IPs
+}
+
+// Hotspots aggregates the malicious requests (blocked, matching an attack category
+// or from a scanner) of any number of client IPs into cells of a latitude and
+// longitude grid, so millions of IPs reduce to the places they come from. Client IPs
+// are placed by the locator if it knows them, otherwise at the centroid of the
+// country WAF logged.
+type Hotspots struct {
+	cellDegrees float64
+	locator     Locator
+	all         bool
+
+	cells     []*Hotspot
+	cellIndex map[hotspotKey]int
+	clients   map[netip.Addr]int // Cell of each client IP, -1 if it could not be placed
+	networks  map[netip.Prefix]bool
+
+	Located   int64 // Client IPs placed by the locator
+	Unlocated int64 // Requests from IPs neither the locator nor the country table places
+}
+
+type hotspotKey struct {
+	row, col int
+	country  string
+}
+
+// NewHotspots returns an empty aggregation into cells of cellDegrees; a nil locator
+// places every IP at its country's centroid. With all, every request is aggregated,
+// not only malicious ones.
+func NewHotspots(cellDegrees float64, locator Locator, all bool) *Hotspots {
+	return &Hotspots{
+		cellDegrees: cellDegrees,
+		locator:     locator,
+		all:         all,
+		cellIndex:   make(map[hotspotKey]int),
+		clients:     make(map[netip.Addr]int),
+		networks:    make(map[netip.Prefix]bool),
+	}
+}
+
+// Add folds a record into the aggregation
+func (h *Hotspots) Add(r *Record) {
+	attack := IsAttack(r) || IdentifyScanner(r) != ""
+	blocked := r.Action == "BLOCK"
+	if !h.all && !attack && !blocked {
+		return
+	}
+	addr, err := netip.ParseAddr(r.HTTPRequest.ClientIP)
+	if err != nil {
+		h.Unlocated++
+		return
+	}
+	addr = addr.Unmap()
+
+	index, seen := h.clients[addr]
+	if !seen {
+		index = h.place(addr, r.HTTPRequest.Country)
+		h.clients[addr] = index
+		if index >= 0 {
+			h.cells[index].ClientIPs++
+			bits := 24
+			if addr.Is6() {
+				bits = 48
+			}
+			if network, err := addr.Prefix(bits); err == nil && !h.networks[network] {
+				h.networks[network] = true
+				h.cells[index].Networks++
+			}
+		}
+	}
+	if index < 0 {
+		h.Unlocated++
+		return
+	}
+	c := h.cells[index]
+	c.Requests++
+	if blocked {
+		c.Blocked++
+	}
+	if attack {
+		c.Attacks++
+		if !blocked {
+			c.AttacksNotBlocked++
+		}
+	}
+}
+
+// place returns the cell of a client IP, creating it if needed, or -1
+func (h *Hotspots) place(addr netip.Addr, country string) int {
+	lat, lon, ok := 0.0, 0.0, false
+	if h.locator != nil {
+		if lat, lon, ok = h.locator.Locate(addr); ok {
+			h.Located++
+		}
+	}
+	if !ok {
+		location, found := LookupCountry(country)
+		if !found {
+			return -1
+		}
+		lat, lon = location.Lat, location.Lon
+	}
+	key := hotspotKey{
+		row:     int(math.Floor(lat / h.cellDegrees)),
+		col:     int(math.Floor(lon / h.cellDegrees)),
+		country: country,
+	}
+	index, ok := h.cellIndex[key]
+	if !ok {
+		index = len(h.cells)
+		h.cellIndex[key] = index
+		h.cells = append(h.cells, &Hotspot{
+			Lat:     (float64(key.row) + 0.5) * h.cellDegrees,
+			Lon:     (float64(key.col) + 0.5) * h.cellDegrees,
+			Country: country,
+		})
+	}
+	return index
+}
+
+// ClientIPs returns the number of distinct client IPs aggregated
+func (h *Hotspots) ClientIPs() int {
+	return len(h.clients)
+}
+
+// Cells returns the cells with requests, those with the most attacks first
+func (h *Hotspots) Cells() []Hotspot {
+	cells := make([]Hotspot, 0, len(h.cells))
+	for _, c := range h.cells {
+		if c.Requests > 0 {
+			cells = append(cells, *c)
+		}
+	}
+	sort.Slice(cells, func(i, j int) bool {
+		if cells[i].Attacks != cells[j].Attacks {
+			return cells[i].Attacks > cells[j].Attacks
+		}
+		if cells[i].Requests != cells[j].Requests {
+			return cells[i].Requests > cells[j].Requests
+		}
+		if cells[i].Lat != cells[j].Lat {
+			return cells[i].Lat > cells[j].Lat
+		}
+		return cells[i].Lon < cells[j].Lon
+	})
+	return cells
+}
+
+// hotspotFields are the columns of exported hotspots with their kepler.gl types;
+// kepler.gl detects the latitude and longitude columns by name
+var hotspotFields = []struct{ name, typ, analyzer string }{
+	{"latitude", "real", "FLOAT"},
+	{"longitude", "real", "FLOAT"},
+	{"country", "string", "STRING"},
+	{"requests", "integer", "INT"},
+	{"blocked", "integer", "INT"},
+	{"attacks", "integer", "INT"},
+	{"attacks_not_blocked", "integer", "INT"},
+	{"client_ips", "integer", "INT"},
+	{"networks", "integer", "INT"},
+}
+
+// values returns the columns of a hotspot
+func (c Hotspot) values() []any {
+	return []any{c.Lat, c.Lon, c.Country, c.Requests, c.Blocked, c.Attacks, c.AttacksNotBlocked, c.ClientIPs, c.Networks}
+}
+
+// WriteHotspotsCSV writes hotspots as CSV, which kepler.gl loads as a point dataset
+func WriteHotspotsCSV(w io.Writer, cells []Hotspot) error {
+	cw := csv.NewWriter(w)
+	header := make([]string, len(hotspotFields))
+	for i, f := range hotspotFields {
+		header[i] = f.name
+	}
+	cw.Write(header)
+	for _, c := range cells {
+		row := make([]string, 0, len(hotspotFields))
+		for _, v := range c.values() {
+			switch v := v.(type) {
+			case float64:
+				row = append(row, strconv.FormatFloat(v, 'f', -1, 64))
+			case int64:
+				row = append(row, strconv.FormatInt(v, 10))
+			case string:
+				row = append(row, v)
+			}
+		}
+		cw.Write(row)
+	}
+	cw.Flush()
+	return cw.Error()
+}
+
+// WriteKeplerMap writes hotspots as a kepler.gl map (Export Map > JSON format) with the
+// dataset and a hexagon layer summing the attacks of the cells it bins, ready to
+// load with "Add Data > Load Map using URL" or by dropping the file on kepler.gl
+func WriteKeplerMap(w io.Writer, title string, cells []Hotspot, created time.Time) error {
+	const dataID = "waf_hotspots"
+	fields := make([]map[string]any, len(hotspotFields))
+	for i, f := range hotspotFields {
+		fields[i] = map[string]any{"name": f.name, "type": f.typ, "format": "", "analyzerType": f.analyzer}
+	}
+	rows := make([][]any, len(cells))
+	for i, c := range cells {
+		rows[i] = c.values()
+	}
+	tooltip := make([]map[string]any, 0, len(hotspotFields)-2)
+	for _, f := range hotspotFields[2:] {
+		tooltip = append(tooltip, map[string]any{"name": f.name, "format": nil})
+	}
+
+	doc := map[string]any{
+		"datasets": []any{map[string]any{
+			"version": "v1",
+			"data": map[string]any{
+				"id":      dataID,
+				"label":   title,
+				"color":   []int{192, 57, 43},
+				"allData": rows,
+				"fields":  fields,
+			},
+		}},
+		"config": map[string]any{
+			"version": "v1",
+			"config": map[string]any{
+				"visState": map[string]any{
+					"filters": []any{},
+					"layers": []any{map[string]any{
+						"id":   "attacks",
+						"type": "hexagon",
+						"config": map[string]any{
+							"dataId":    dataID,
+							"label":     "Attacks",
+							"color":     []int{192, 57, 43},
+							"columns":   map[string]string{"lat": "latitude", "lng": "longitude"},
+							"isVisible": true,
+							"visConfig": map[string]any{
+								"opacity":             0.8,
+								"worldUnitSize":       50,
+								"resolution":          8,
+								"coverage":            1,
+								"sizeRange":           []int{0, 500},
+								"percentile":          []int{0, 100},
+								"elevationPercentile": []int{0, 100},
+								"elevationScale":      5,
+								"colorAggregation":    "sum",
+								"sizeAggregation":     "sum",
+								"enable3d":            false,
+								"colorRange": map[string]any{
+									"name":     "Global Warming",
+									"type":     "sequential",
+									"category": "Uber",
+									"colors":   []string{"#5A1846", "#900C3F", "#C70039", "#E3611C", "#F1920E", "#FFC300"},
+								},
+							},
+						},
+						"visualChannels": map[string]any{
+							"colorField": map[string]string{"name": "attacks", "type": "integer"},
+							"colorScale": "quantile",
+							"sizeField":  map[string]string{"name": "client_ips", "type": "integer"},
+							"sizeScale":  "linear",
+						},
+					}},
+					"interactionConfig": map[string]any{
+						"tooltip": map[string]any{"enabled": true, "fieldsToShow": map[string]any{dataID: tooltip}},
+					},
+					"layerBlending": "normal",
+					"splitMaps":     []any{},
+				},
+				"mapState": map[string]any{"latitude": 20, "longitude": 0, "zoom": 1.5, "bearing": 0, "pitch": 0, "dragRotate": false},
+				"mapStyle": map[string]any{"styleType": "dark"},
+			},
+		},
+		"info": map[string]any{
+			"app":        "kepler.gl",
+			"created_at": created.UTC().Format(time.RFC1123),
+			"title":      title,
+		},
+	}
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(doc)
+}
@@ -0,0 +1,84 @@
+package analysis
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"slices"
+	"strings"
+)
+
+// ClientIdentityModes are the ways requests are attributed to clients
+var ClientIdentityModes = []string{"ip", "ip-user-agent", "header"}
+
+// ClientIdentitySettings configure which client every aggregation attributes a
+// request to. Behind some CDNs and proxies clientIp is the address of the proxy, so
+// the client's address is taken from a header, and clients sharing an address, such
+// as users behind a NAT or API consumers, can be told apart by User-Agent or by a
+// header of their own.
+type ClientIdentitySettings struct {
+	Mode     string `json:"mode"`     // See ClientIdentityModes
+	IPHeader string `json:"ipHeader"` // Header holding the client's address, e.g. True-Client-IP or X-Forwarded-For (first address); clientIp if empty
+	Header   string `json:"header"`   // Header identifying the client in header mode, e.g. x-api-key
+}
+
+// Validate checks the mode and its header
+func (c ClientIdentitySettings) Validate() error {
+	if !slices.Contains(ClientIdentityModes, c.Mode) {
+		return fmt.Errorf("unknown client identity mode %q (want %s)", c.Mode, strings.Join(ClientIdentityModes, ", "))
+	}
+	if c.Mode == "header" && c.Header == "" {
+		return fmt.Errorf("client identity mode header requires a header")
+	}
+	return nil
+}
+
+// String describes the client identity, e.g. "ip", "ip-user-agent (IP from
+// True-Client-IP)" or "header x-api-key"
+func (c ClientIdentitySettings) String() string {
+	s := c.Mode
+	if c.Mode == "header" {
+		s += " " + c.Header
+	}
+	if c.IPHeader != "" {
+		s += fmt.Sprintf(" (IP from %s)", c.IPHeader)
+	}
+	return s
+}
+
+// ClientIP returns the address of a record's client: the first address in the IP
+// header if one is configured and holds a valid one, clientIp otherwise
+func (s *Settings) ClientIP(r *Record) string {
+	if s.ClientIdentity.IPHeader != "" {
+		first, _, _ := strings.Cut(r.HeaderValue(s.ClientIdentity.IPHeader), ",")
+		if ip := net.ParseIP(strings.TrimSpace(first)); ip != nil {
+			return ip.String()
+		}
+	}
+	return r.HTTPRequest.ClientIP
+}
+
+// ClientID returns the client a record is attributed to: its address, its address
+// and a hash of its User-Agent ("203.0.113.7 ua:<hash>"), or a hash of the
+// identifying header ("x-api-key:<hash>"), falling back to the address for
+// requests without the header. Header values are hashed so secrets such as API
+// keys never reach results and reports.
+func (s *Settings) ClientID(r *Record) string {
+	ip := s.ClientIP(r)
+	switch s.ClientIdentity.Mode {
+	case "ip-user-agent":
+		return ip + " ua:" + identityHash(r.HeaderValue("User-Agent"))
+	case "header":
+		if value := r.HeaderValue(s.ClientIdentity.Header); value != "" {
+			return strings.ToLower(s.ClientIdentity.Header) + ":" + identityHash(value)
+		}
+	}
+	return ip
+}
+
+// identityHash returns a short hash of a header value
+func identityHash(value string) string {
+	sum := sha256.Sum256([]byte(value))
+	return hex.EncodeToString(sum[:6])
+}
@@ -0,0 +1,348 @@
+package analysis
+
+import (
+	_ "embed"
+	"encoding/json"
+	"fmt"
+	"net/netip"
+	"slices"
+	"sort"
+	"strings"
+)
+
+// hostingJSON is the built-in library of hosting providers and networks, by the
+// domains of their reverse DNS names, and of the name tokens that tell what kind of
+// network an address is on
+//
+//go:embed hosting.json
+var hostingJSON []byte
+
+// Kinds of attacker infrastructure
+const (
+	InfraHosting     = "hosting"     // Cloud and hosting providers
+	InfraResidential = "residential" // Consumer ISPs, typically compromised devices or residential proxies
+	InfraVPN         = "vpn"         // VPNs and proxies
+	InfraTor         = "tor"         // Tor exit relays
+	InfraScanner     = "scanner"     // Internet-wide scanning projects
+	InfraUnknown     = "unknown"
+)
+
+// unresolvedGroup groups the attacker IPs no DNS name was found for
+const unresolvedGroup = "unresolved"
+
+// InfrastructureSource is the source of infrastructure findings
+const InfrastructureSource = "infrastructure"
+
+// Thresholds of infrastructure findings
+const (
+	minProviderAddresses = 3 // Attacker IPs at one provider or domain worth a finding
+	topGroupAddresses    = 5 // Attacker IPs listed per group
+)
+
+// HostingProvider is a provider or network known by the domains of its names
+type HostingProvider struct {
+	Name    string   `json:"name"`
+	Kind    string   `json:"kind"`
+	Domains []string `json:"domains"` // Names in these domains or their subdomains
+}
+
+// hostingTokens are name tokens of one kind of network, e.g. "dsl" or "vps"
+type hostingTokens struct {
+	Kind   string   `json:"kind"`
+	Tokens []string `json:"tokens"`
+}
+
+// hostingLibrary is the parsed built-in hosting library
+type hostingLibrary struct {
+	Providers []HostingProvider `json:"providers"`
+	Tokens    []hostingTokens   `json:"tokens"`
+}
+
+// hosting is the built-in hosting library
+var hosting = mustLoadHosting(hostingJSON)
+
+// mustLoadHosting parses a hosting library, panicking on errors since the library
+// is embedded at build time
+func mustLoadHosting(data []byte) hostingLibrary {
+	var library hostingLibrary
+	if err := json.Unmarshal(data, &library); err != nil {
+		panic(fmt.Sprintf("invalid hosting library: %v", err))
+	}
+	return library
+}
+
+// secondLevelLabels are the labels under which country code domains register names,
+// e.g. the co of example.co.uk
+var secondLevelLabels = map[string]bool{"co": true, "com": true, "net": true, "org": true, "ac": true, "gov": true, "edu": true, "ne": true, "or": true, "go": true}
+
+// HostNames are the DNS names found for an attacker IP
+type HostNames struct {
+	Reverse []string `json:"reverse,omitempty"` // PTR names
+	Passive []string `json:"passive,omitempty"` // Names passive DNS saw resolve to it
+}
+
+// AttackerHost is one attacker IP and the infrastructure it was traced to
+type AttackerHost struct {
+	Address      string   `json:"address"`
+	Requests     int64    `json:"requests"` // All its requests, if clients are counted by IP
+	Blocked      int64    `json:"blocked"`
+	Scanners     []string `json:"scanners,omitempty"`     // Scanners seen from it
+	Names        []string `json:"names,omitempty"`        // Reverse DNS names
+	PassiveNames []string `json:"passiveNames,omitempty"` // Names passive DNS saw resolve to it
+	Domain       string   `json:"domain,omitempty"`       // Registered domain of its names
+	Provider     string   `json:"provider,omitempty"`     // Provider or network of its reverse DNS names, see hosting.json
+	Kind         string   `json:"kind"`                   // hosting, residential, vpn, tor, scanner or unknown
+}
+
+// InfrastructureGroup is the attacker IPs traced to one provider, or to one domain
+// when their provider is not known
+type InfrastructureGroup struct {
+	Name         string   `json:"name"` // Provider, registered domain or "unresolved"
+	Kind         string   `json:"kind"`
+	Addresses    int      `json:"addresses"`
+	Requests     int64    `json:"requests"`
+	Blocked      int64    `json:"blocked"`
+	Domains      []string `json:"domains,omitempty"` // Registered domains of the names in the group
+	TopAddresses []string `json:"topAddresses"`      // Most blocked first
+}
+
+// InfrastructureReport traces the attacker IPs of the logs to the networks and
+// domains they attack from
+type InfrastructureReport struct {
+	Addresses  int                   `json:"addresses"`            // Attacker IPs looked up
+	Resolved   int                   `json:"resolved"`             // Attacker IPs with at least one name
+	ReverseDNS bool                  `json:"reverseDns"`           // Whether reverse DNS was looked up
+	PassiveDNS string                `json:"passiveDns,omitempty"` // Passive DNS provider, if any
+	Kinds      map[string]int        `json:"kinds"`                // Attacker IPs by kind of infrastructure
+	Groups     []InfrastructureGroup `json:"groups"`               // Most addresses first
+	Hosts      []AttackerHost        `json:"hosts"`                // Most blocked first
+}
+
+// AttackerIPs returns up to n public client addresses the Web ACL blocked or
+// scanners were seen from, those with the most blocked and scanner requests first.
+// A non-positive n returns all of them.
+func AttackerIPs(stats *Stats, n int) []string {
+	scores := make(map[string]int64)
+	for ip, blocked := range stats.BlockedIPs {
+		if isPublicAddress(ip) {
+			scores[ip] += blocked
+		}
+	}
+	for _, counts := range stats.Scanners {
+		for client, requests := range counts.ClientIPs {
+			if isPublicAddress(client) {
+				scores[client] += requests
+			}
+		}
+	}
+	var ips []string
+	for _, c := range TopN(scores, n) {
+		ips = append(ips, c.Key)
+	}
+	return ips
+}
+
+// isPublicAddress reports whether s is an IP address outside private, loopback and
+// link-local ranges
+func isPublicAddress(s string) bool {
+	addr, err := netip.ParseAddr(s)
+	return err == nil && !IsPrivatePrefix(netip.PrefixFrom(addr, addr.BitLen()))
+}
+
+// AttackerInfrastructure traces attacker IPs to the providers and domains of their
+// DNS names, grouping them by provider, or by registered domain when the provider is
+// not in the hosting library
+func AttackerInfrastructure(stats *Stats, addresses []string, names map[string]HostNames, reverseDNS bool, passiveDNS string) *InfrastructureReport {
+	report := &InfrastructureReport{
+		Addresses:  len(addresses),
+		ReverseDNS: reverseDNS,
+		PassiveDNS: passiveDNS,
+		Kinds:      make(map[string]int),
+		Hosts:      []AttackerHost{},
+	}
+	for _, address := range addresses {
+		host := AttackerHost{
+			Address:      address,
+			Requests:     stats.ClientIPs[address],
+			Blocked:      stats.BlockedIPs[address],
+			Names:        names[address].Reverse,
+			PassiveNames: names[address].Passive,
+			Kind:         InfraUnknown,
+		}
+		for name, counts := range stats.Scanners {
+			if counts.ClientIPs[address] > 0 {
+				host.Scanners = append(host.Scanners, name)
+			}
+		}
+		sort.Strings(host.Scanners)
+		if len(host.Names) > 0 || len(host.PassiveNames) > 0 {
+			report.Resolved++
+		}
+		classifyHost(&host)
+		report.Kinds[host.Kind]++
+		report.Hosts = append(report.Hosts, host)
+	}
+	sort.SliceStable(report.Hosts, func(i, j int) bool {
+		return report.Hosts[i].Blocked > report.Hosts[j].Blocked
+	})
+
+	groups := make(map[string]*InfrastructureGroup)
+	for _, host := range report.Hosts {
+		name := host.Provider
+		if name == "" {
+			name = host.Domain
+		}
+		if name == "" {
+			name = unresolvedGroup
+		}
+		group := groups[name]
+		if group == nil {
+			group = &InfrastructureGroup{Name: name, Kind: host.Kind}
+			groups[name] = group
+		}
+		group.Addresses++
+		group.Requests += host.Requests
+		group.Blocked += host.Blocked
+		if host.Domain != "" && !slices.Contains(group.Domains, host.Domain) {
+			group.Domains = append(group.Domains, host.Domain)
+		}
+		if len(group.TopAddresses) < topGroupAddresses {
+			group.TopAddresses = append(group.TopAddresses, host.Address)
+		}
+	}
+	report.Groups = make([]InfrastructureGroup, 0, len(groups))
+	for _, group := range groups {
+		sort.Strings(group.Domains)
+		report.Groups = append(report.Groups, *group)
+	}
+	sort.Slice(report.Groups, func(i, j int) bool {
+		if report.Groups[i].Addresses != report.Groups[j].Addresses {
+			return report.Groups[i].Addresses > report.Groups[j].Addresses
+		}
+		return report.Groups[i].Name < report.Groups[j].Name
+	})
+	return report
+}
+
+// classifyHost sets the registered domain, provider and kind of an attacker IP from
+// its names. The provider and kind come from its reverse DNS names only, since the
+// names passive DNS saw point at whatever it hosts, not at the network it is on.
+func classifyHost(host *AttackerHost) {
+	for _, name := range host.Names {
+		if provider := hostingProvider(name); provider != nil {
+			host.Provider, host.Kind = provider.Name, provider.Kind
+			break
+		}
+	}
+	if host.Kind == InfraUnknown {
+		for _, name := range host.Names {
+			if kind := tokenKind(name); kind != "" {
+				host.Kind = kind
+				break
+			}
+		}
+	}
+	if len(host.Names) > 0 {
+		host.Domain = registeredDomain(host.Names[0])
+	} else if len(host.PassiveNames) > 0 {
+		domains := make(map[string]int64)
+		for _, name := range host.PassiveNames {
+			domains[registeredDomain(name)]++
+		}
+		host.Domain = TopN(domains, 1)[0].Key
+	}
+}
+
+// hostingProvider returns the provider of the library a name belongs to, or nil
+func hostingProvider(name string) *HostingProvider {
+	for i, provider := range hosting.Providers {
+		for _, domain := range provider.Domains {
+			if name == domain || strings.HasSuffix(name, "."+domain) {
+				return &hosting.Providers[i]
+			}
+		}
+	}
+	return nil
+}
+
+// tokenKind returns the kind of network the tokens of a name's host part point to,
+// e.g. residential for pool-203-0-113-7.dsl.example.net, or ""
+func tokenKind(name string) string {
+	domain := registeredDomain(name)
+	hostPart := strings.TrimSuffix(strings.TrimSuffix(name, domain), ".")
+	tokens := make(map[string]bool)
+	for _, token := range strings.FieldsFunc(hostPart, func(r rune) bool { return r == '.' || r == '-' || r == '_' }) {
+		tokens[strings.Trim(token, "0123456789")] = true
+	}
+	for _, kind := range hosting.Tokens {
+		for _, token := range kind.Tokens {
+			if tokens[token] {
+				return kind.Kind
+			}
+		}
+	}
+	return ""
+}
+
+// registeredDomain approximates the domain a name was registered under, e.g.
+// example.com for a.b.example.com and example.co.uk for a.example.co.uk
+func registeredDomain(name string) string {
+	labels := strings.Split(name, ".")
+	n := 2
+	if len(labels) >= 3 && len(labels[len(labels)-1]) == 2 && secondLevelLabels[labels[len(labels)-2]] {
+		n = 3
+	}
+	if len(labels) <= n {
+		return name
+	}
+	return strings.Join(labels[len(labels)-n:], ".")
+}
+
+// InfrastructureFindings reports attack infrastructure concentrated at hosting
+// providers or shared domains, and attacks through anonymizers
+func InfrastructureFindings(webACLName string, report *InfrastructureReport) []Finding {
+	if report == nil {
+		return nil
+	}
+	var findings []Finding
+	for _, group := range report.Groups {
+		description := fmt.Sprintf("%d of the %d attacker IPs of Web ACL %s (%s) were traced to %s; the Web ACL blocked %d of their %d requests.",
+			group.Addresses, report.Addresses, webACLName, strings.Join(group.TopAddresses, ", "), group.Name, group.Blocked, group.Requests)
+		severity := SeverityLow
+		if group.Requests > group.Blocked {
+			severity = SeverityMedium
+		}
+		if group.Kind == InfraTor || group.Kind == InfraVPN {
+			findings = append(findings, Finding{
+				ID:          "attack-infrastructure-anonymizer",
+				Severity:    SeverityMedium,
+				Title:       fmt.Sprintf("%d attacker IPs attack through %s anonymizers", group.Addresses, group.Name),
+				Description: description + " Their names point to Tor exit relays, VPNs or proxies that hide the real client; consider the AWS managed Anonymous IP list rule group (AnonymousIPList).",
+				Source:      InfrastructureSource,
+			})
+			continue
+		}
+		if group.Addresses < minProviderAddresses || group.Name == unresolvedGroup {
+			continue
+		}
+		switch group.Kind {
+		case InfraHosting:
+			findings = append(findings, Finding{
+				ID:          "attack-infrastructure-hosting",
+				Severity:    severity,
+				Title:       fmt.Sprintf("%d attacker IPs are hosted at %s", group.Addresses, group.Name),
+				Description: description + " Requests from cloud and hosting networks are rarely end users; consider the HostingProviderIPList rule of the AWS managed Anonymous IP list rule group, or rate-based rules scoped down to the provider's ASNs.",
+				Source:      InfrastructureSource,
+			})
+		case InfraUnknown:
+			findings = append(findings, Finding{
+				ID:          "attack-infrastructure-domain",
+				Severity:    severity,
+				Title:       fmt.Sprintf("%d attacker IPs share the domain %s", group.Addresses, group.Name),
+				Description: description + " Addresses sharing a domain are likely one operator's infrastructure; review the domain's other addresses and block them together.",
+				Source:      InfrastructureSource,
+			})
+		}
+	}
+	return findings
+}
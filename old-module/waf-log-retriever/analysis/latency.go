@@ -0,0 +1,187 @@
+package analysis
+
+import (
+	"fmt"
+	"math"
+	"sort"
+)
+
+// HighLatencyThresholdMs is the p99 WAF-added latency above which a rule or action
+// is reported as an operational impact finding
+const HighLatencyThresholdMs = 100
+
+// latencyFields holds the optional record fields carrying the processing time WAF
+// added to a request. Standard AWS WAF logs have none; some logging pipelines and
+// log formats add one of these.
+type latencyFields struct {
+	WAFLatencyMs     *float64 `json:"wafLatencyMs"`
+	LatencyMs        *float64 `json:"latencyMs"`
+	ProcessingTimeMs *float64 `json:"processingTimeMs"`
+}
+
+// WAFLatency returns the WAF-added latency of the record in milliseconds, and false
+// if the record has no latency field
+func (r *Record) WAFLatency() (float64, bool) {
+	for _, v := range []*float64{r.WAFLatencyMs, r.LatencyMs, r.ProcessingTimeMs} {
+		if v != nil && *v >= 0 {
+			return *v, true
+		}
+	}
+	return 0, false
+}
+
+// Latency histogram buckets grow by 5% from 1µs, so percentiles are accurate to
+// within 5% up to about 10 minutes
+const (
+	latencyBucketMinMs  = 0.001
+	latencyBucketGrowth = 1.05
+	latencyBucketCount  = 420
+)
+
+// latencyHistogram is a fixed-size log-scale histogram of latencies
+type latencyHistogram struct {
+	buckets [latencyBucketCount]int64
+	count   int64
+	sum     float64
+	max     float64
+}
+
+// add records one latency
+func (h *latencyHistogram) add(ms float64) {
+	i := 0
+	if ms > latencyBucketMinMs {
+		i = int(math.Ceil(math.Log(ms/latencyBucketMinMs) / math.Log(latencyBucketGrowth)))
+	}
+	if i >= latencyBucketCount {
+		i = latencyBucketCount - 1
+	}
+	h.buckets[i]++
+	h.count++
+	h.sum += ms
+	if ms > h.max {
+		h.max = ms
+	}
+}
+
+// quantile returns the upper bound of the bucket holding quantile q
+func (h *latencyHistogram) quantile(q float64) float64 {
+	rank := int64(math.Ceil(q * float64(h.count)))
+	var seen int64
+	for i, n := range h.buckets {
+		seen += n
+		if seen >= rank && n > 0 {
+			return math.Min(latencyBucketMinMs*math.Pow(latencyBucketGrowth, float64(i)), h.max)
+		}
+	}
+	return h.max
+}
+
+// summary returns the count, mean and percentiles of the histogram
+func (h *latencyHistogram) summary() LatencySummary {
+	return LatencySummary{
+		Count:  h.count,
+		MeanMs: round2(h.sum / float64(h.count)),
+		P50Ms:  round2(h.quantile(0.50)),
+		P90Ms:  round2(h.quantile(0.90)),
+		P99Ms:  round2(h.quantile(0.99)),
+		MaxMs:  round2(h.max),
+	}
+}
+
+// LatencyStats aggregates WAF-added latency overall, per action and per terminating rule
+type LatencyStats struct {
+	overall  latencyHistogram
+	byAction map[string]*latencyHistogram
+	byRule   map[string]*latencyHistogram
+}
+
+// NewLatencyStats creates an empty LatencyStats instance
+func NewLatencyStats() *LatencyStats {
+	return &LatencyStats{
+		byAction: make(map[string]*latencyHistogram),
+		byRule:   make(map[string]*latencyHistogram),
+	}
+}
+
+// Add folds the latency of a record into the aggregate
+func (l *LatencyStats) Add(r *Record, ms float64) {
+	l.overall.add(ms)
+	histogramFor(l.byAction, r.Action).add(ms)
+	histogramFor(l.byRule, r.TerminatingRuleID).add(ms)
+}
+
+// histogramFor returns the histogram of a key, creating it if needed
+func histogramFor(m map[string]*latencyHistogram, key string) *latencyHistogram {
+	h, ok := m[key]
+	if !ok {
+		h = &latencyHistogram{}
+		m[key] = h
+	}
+	return h
+}
+
+// LatencySummary holds approximate latency percentiles in milliseconds
+type LatencySummary struct {
+	Count  int64   `json:"count"`
+	MeanMs float64 `json:"meanMs"`
+	P50Ms  float64 `json:"p50Ms"`
+	P90Ms  float64 `json:"p90Ms"`
+	P99Ms  float64 `json:"p99Ms"`
+	MaxMs  float64 `json:"maxMs"`
+}
+
+// OperationalImpact is the latency WAF added to requests, where the logs record it
+type OperationalImpact struct {
+	RecordsWithLatency int64                     `json:"recordsWithLatency"`
+	Overall            LatencySummary            `json:"overall"`
+	ByAction           map[string]LatencySummary `json:"byAction"`
+	ByRule             map[string]LatencySummary `json:"byRule"` // By terminating rule
+}
+
+// OperationalImpact summarizes the aggregated latencies
+func (l *LatencyStats) OperationalImpact() *OperationalImpact {
+	impact := &OperationalImpact{
+		RecordsWithLatency: l.overall.count,
+		Overall:            l.overall.summary(),
+		ByAction:           make(map[string]LatencySummary, len(l.byAction)),
+		ByRule:             make(map[string]LatencySummary, len(l.byRule)),
+	}
+	for action, h := range l.byAction {
+		impact.ByAction[action] = h.summary()
+	}
+	for rule, h := range l.byRule {
+		impact.ByRule[rule] = h.summary()
+	}
+	return impact
+}
+
+// LatencyFindings reports the terminating rules whose p99 WAF-added latency exceeds
+// HighLatencyThresholdMs
+func LatencyFindings(webACLName string, impact *OperationalImpact) []Finding {
+	rules := make([]string, 0, len(impact.ByRule))
+	for rule, summary := range impact.ByRule {
+		if summary.P99Ms > HighLatencyThresholdMs {
+			rules = append(rules, rule)
+		}
+	}
+	sort.Strings(rules)
+
+	var findings []Finding
+	for _, rule := range rules {
+		summary := impact.ByRule[rule]
+		findings = append(findings, Finding{
+			ID:       "waf-latency-high",
+			Severity: SeverityMedium,
+			Title:    fmt.Sprintf("Requests terminated by %s see high WAF latency", rule),
+			Description: fmt.Sprintf("Web ACL %s added a p99 latency of %.1f ms (p50 %.1f ms) to %d requests terminated by %s, above the %d ms threshold. Review the rule's statements (e.g. regex sets or body inspection) for cost.",
+				webACLName, summary.P99Ms, summary.P50Ms, summary.Count, rule, HighLatencyThresholdMs),
+			Source: "latency",
+		})
+	}
+	return findings
+}
+
+// round2 rounds to two decimals for readable output
+func round2(v float64) float64 {
+	return math.Round(v*100) / 100
+}
@@ -0,0 +1,501 @@
+package analysis
+
+import (
+	"bytes"
+	"encoding/gob"
+	"time"
+)
+
+// Merge folds the statistics of another set of records, aggregated with the same
+// settings, into s. Aggregating records in chunks and merging the chunks gives the
+// same statistics as aggregating all records at once.
+func (s *Stats) Merge(o *Stats) {
+	if o == nil || o.TotalRequests == 0 && len(o.Suppressed) == 0 && len(o.FileRecords) == 0 && len(o.UncountedFiles) == 0 {
+		return
+	}
+	s.TotalRequests += o.TotalRequests
+	if !o.FirstSeen.IsZero() && (s.FirstSeen.IsZero() || o.FirstSeen.Before(s.FirstSeen)) {
+		s.FirstSeen = o.FirstSeen
+	}
+	if o.LastSeen.After(s.LastSeen) {
+		s.LastSeen = o.LastSeen
+	}
+
+	o.Finalize()
+	mergeCounts(s.Actions, o.Actions)
+	mergeCounts(s.TerminatingRules, o.TerminatingRules)
+	mergeCounts(s.Countries, o.Countries)
+	mergeCounts(s.ClientIPs, o.ClientIPs)
+	mergeCounts(s.BlockedIPs, o.BlockedIPs)
+	mergeCounts(s.URIs, o.URIs)
+	mergeCounts(s.Methods, o.Methods)
+	mergeCounts(s.NonTerminatingRules, o.NonTerminatingRules)
+
+	for groupID, rules := range o.RuleGroups {
+		group, ok := s.RuleGroups[groupID]
+		if !ok {
+			group = make(map[string]*SubRuleCounts)
+			s.RuleGroups[groupID] = group
+		}
+		for ruleID, c := range rules {
+			counts := subRuleCounts(group, ruleID)
+			counts.Terminating += c.Terminating
+			counts.Count += c.Count
+			counts.Overridden += c.Overridden
+			counts.Excluded += c.Excluded
+			counts.Allowed += c.Allowed
+		}
+	}
+
+	for owasp, c := range o.AttackCategories {
+		counts, ok := s.AttackCategories[owasp]
+		if !ok {
+			counts = &AttackCounts{CAPEC: make(map[string]int64), Rules: make(map[string]int64)}
+			s.AttackCategories[owasp] = counts
+		}
+		counts.Requests += c.Requests
+		counts.Blocked += c.Blocked
+		mergeCounts(counts.CAPEC, c.CAPEC)
+		mergeCounts(counts.Rules, c.Rules)
+	}
+
+	for name, c := range o.Scanners {
+		counts, ok := s.Scanners[name]
+		if !ok {
+			counts = &ScannerCounts{ClientIPs: make(map[string]int64), perMinute: make(map[int64]int64)}
+			s.Scanners[name] = counts
+		}
+		counts.Requests += c.Requests
+		counts.Blocked += c.Blocked
+		if !c.FirstSeen.IsZero() && (counts.FirstSeen.IsZero() || c.FirstSeen.Before(counts.FirstSeen)) {
+			counts.FirstSeen = c.FirstSeen
+		}
+		if c.LastSeen.After(counts.LastSeen) {
+			counts.LastSeen = c.LastSeen
+		}
+		mergeCounts(counts.ClientIPs, c.ClientIPs)
+		mergeCounts(counts.perMinute, c.perMinute)
+	}
+
+	for key, c := range o.TLSFingerprints {
+		counts, ok := s.TLSFingerprints[key]
+		if !ok {
+			counts = newFingerprintCounts()
+			s.TLSFingerprints[key] = counts
+		}
+		counts.merge(c)
+	}
+
+	for key, c := range o.Challenge {
+		counts, ok := s.Challenge[key]
+		if !ok {
+			if len(s.Challenge) >= maxChallengeSegments {
+				continue
+			}
+			counts = &ChallengeCounts{Rules: make(map[string]int64)}
+			s.Challenge[key] = counts
+		}
+		counts.merge(c)
+	}
+
+	if o.Auth != nil {
+		s.Auth.merge(o.Auth)
+	}
+	if o.API != nil {
+		s.API.merge(o.API)
+	}
+	if o.Sessions != nil {
+		s.Sessions.merge(o.Sessions)
+	}
+
+	for name, c := range o.EndpointClasses {
+		class, ok := s.EndpointClasses[name]
+		if !ok {
+			class = &ClassStats{
+				Actions:          make(map[string]int64),
+				TerminatingRules: make(map[string]int64),
+				Methods:          make(map[string]int64),
+				ClientIPs:        make(map[string]int64),
+				Endpoints:        make(map[string]int64),
+				AttackCategories: make(map[string]int64),
+			}
+			s.EndpointClasses[name] = class
+		}
+		class.Requests += c.Requests
+		class.Blocked += c.Blocked
+		mergeCounts(class.Actions, c.Actions)
+		mergeCounts(class.TerminatingRules, c.TerminatingRules)
+		mergeCounts(class.Methods, c.Methods)
+		mergeCounts(class.ClientIPs, c.ClientIPs)
+		mergeCounts(class.Endpoints, c.Endpoints)
+		mergeCounts(class.AttackCategories, c.AttackCategories)
+	}
+
+	for name, c := range o.Assets {
+		counts, ok := s.Assets[name]
+		if !ok {
+			counts = &AssetCounts{TerminatingRules: make(map[string]int64)}
+			s.Assets[name] = counts
+		}
+		counts.merge(c)
+	}
+
+	if s.Sources != nil {
+		for key, c := range o.Sources {
+			counts, ok := s.Sources[key]
+			if !ok {
+				counts = &SourceCounts{Provenance: c.Provenance, Hosts: make(map[string]int64), TerminatingRules: make(map[string]int64)}
+				s.Sources[key] = counts
+			}
+			counts.merge(c)
+		}
+	}
+
+	for code, c := range o.Origins {
+		counts, ok := s.Origins[code]
+		if !ok {
+			counts = &OriginCounts{}
+			s.Origins[code] = counts
+		}
+		counts.merge(c)
+	}
+
+	if o.Heatmap != nil {
+		for day := range s.Heatmap.Requests {
+			for hour := range s.Heatmap.Requests[day] {
+				s.Heatmap.Requests[day][hour] += o.Heatmap.Requests[day][hour]
+				s.Heatmap.Blocked[day][hour] += o.Heatmap.Blocked[day][hour]
+			}
+		}
+	}
+
+	if s.Hosts != nil {
+		for host, hs := range o.Hosts {
+			hostStats, ok := s.Hosts[host]
+			if !ok {
+				hostStats = NewStats(s.settings)
+				hostStats.Hosts, hostStats.Sources = nil, nil
+				s.Hosts[host] = hostStats
+			}
+			hostStats.Merge(hs)
+		}
+		if o.AuthorizedTesting != nil {
+			if s.AuthorizedTesting == nil {
+				s.AuthorizedTesting = NewStats(s.settings)
+				s.AuthorizedTesting.Hosts = nil
+			}
+			s.AuthorizedTesting.Merge(o.AuthorizedTesting)
+		}
+	}
+
+	if o.Latency != nil {
+		if s.Latency == nil {
+			s.Latency = NewLatencyStats()
+		}
+		s.Latency.merge(o.Latency)
+	}
+
+	if o.BodyInspection != nil {
+		if s.BodyInspection == nil {
+			s.BodyInspection = NewBodyInspectionStats()
+		}
+		s.BodyInspection.merge(o.BodyInspection)
+	}
+
+	for kind, c := range o.HostAnomalies {
+		if s.HostAnomalies == nil {
+			s.HostAnomalies = make(map[string]*HostAnomalyCounts)
+		}
+		if s.HostAnomalies[kind] == nil {
+			s.HostAnomalies[kind] = newHostAnomalyCounts()
+		}
+		s.HostAnomalies[kind].merge(c)
+	}
+
+	if len(o.Suppressed) > 0 {
+		if s.Suppressed == nil {
+			s.Suppressed = make(map[string]int64)
+		}
+		mergeCounts(s.Suppressed, o.Suppressed)
+	}
+	s.Filtered += o.Filtered
+	if len(o.FileRecords) > 0 {
+		if s.FileRecords == nil {
+			s.FileRecords = make(map[string]int64)
+		}
+		mergeCounts(s.FileRecords, o.FileRecords)
+	}
+	s.UncountedRecords += o.UncountedRecords
+	s.UncountedFiles = append(s.UncountedFiles, o.UncountedFiles...)
+}
+
+// mergeCounts adds the counts of src to dst
+func mergeCounts[K comparable](dst, src map[K]int64) {
+	for k, n := range src {
+		dst[k] += n
+	}
+}
+
+// merge folds another login attempt aggregate into a
+func (a *AuthStats) merge(o *AuthStats) {
+	a.Attempts += o.Attempts
+	a.Blocked += o.Blocked
+	a.ATPEvaluated += o.ATPEvaluated
+	a.ATPLabeled += o.ATPLabeled
+	mergeCounts(a.Endpoints, o.Endpoints)
+	mergeCounts(a.ClientIPs, o.ClientIPs)
+	for window, ips := range o.windows {
+		counts, ok := a.windows[window]
+		if !ok {
+			counts = make(map[string]int64)
+			a.windows[window] = counts
+		}
+		mergeCounts(counts, ips)
+	}
+}
+
+// merge folds another API aggregate into a, keeping the caps on tracked IDs and paths
+func (a *APIStats) merge(o *APIStats) {
+	for template, minutes := range o.perMinute {
+		counts, ok := a.perMinute[template]
+		if !ok {
+			counts = make(map[int64]int64)
+			a.perMinute[template] = counts
+		}
+		mergeCounts(counts, minutes)
+	}
+	for ip, byTemplate := range o.ids {
+		dst, ok := a.ids[ip]
+		if !ok {
+			dst = make(map[string]map[int64]bool)
+			a.ids[ip] = dst
+		}
+		for template, ids := range byTemplate {
+			set, ok := dst[template]
+			if !ok {
+				set = make(map[int64]bool)
+				dst[template] = set
+			}
+			for id := range ids {
+				if len(set) >= maxTrackedIDs {
+					break
+				}
+				set[id] = true
+			}
+		}
+	}
+	for ip, paths := range o.paths {
+		set, ok := a.paths[ip]
+		if !ok {
+			set = make(map[string]bool)
+			a.paths[ip] = set
+		}
+		for path := range paths {
+			if len(set) >= maxTrackedIDs {
+				break
+			}
+			set[path] = true
+		}
+	}
+	mergeCounts(a.notFound, o.notFound)
+	for ip, span := range o.clientRanges {
+		dst, ok := a.clientRanges[ip]
+		if !ok || span[0].Before(dst[0]) {
+			dst[0] = span[0]
+		}
+		if span[1].After(dst[1]) {
+			dst[1] = span[1]
+		}
+		a.clientRanges[ip] = dst
+	}
+}
+
+// merge folds another latency aggregate into l
+func (l *LatencyStats) merge(o *LatencyStats) {
+	l.overall.merge(&o.overall)
+	for action, h := range o.byAction {
+		histogramFor(l.byAction, action).merge(h)
+	}
+	for rule, h := range o.byRule {
+		histogramFor(l.byRule, rule).merge(h)
+	}
+}
+
+// merge adds the latencies of another histogram to h
+func (h *latencyHistogram) merge(o *latencyHistogram) {
+	for i, n := range o.buckets {
+		h.buckets[i] += n
+	}
+	h.count += o.count
+	h.sum += o.sum
+	if o.max > h.max {
+		h.max = o.max
+	}
+}
+
+// The aggregates below keep internal state in unexported fields, which gob skips,
+// so they encode an exported copy of it. Encoded statistics are only ever merged
+// into statistics created with NewStats, since gob leaves empty maps nil.
+
+type authStatsState struct {
+	Attempts, Blocked, ATPEvaluated, ATPLabeled int64
+	Endpoints, ClientIPs                        map[string]int64
+	Windows                                     map[int64]map[string]int64
+}
+
+// GobEncode encodes the aggregate including its windows
+func (a *AuthStats) GobEncode() ([]byte, error) {
+	return gobState(authStatsState{a.Attempts, a.Blocked, a.ATPEvaluated, a.ATPLabeled, a.Endpoints, a.ClientIPs, a.windows})
+}
+
+// GobDecode decodes an aggregate encoded with GobEncode
+func (a *AuthStats) GobDecode(data []byte) error {
+	var st authStatsState
+	if err := gob.NewDecoder(bytes.NewReader(data)).Decode(&st); err != nil {
+		return err
+	}
+	*a = AuthStats{st.Attempts, st.Blocked, st.ATPEvaluated, st.ATPLabeled, st.Endpoints, st.ClientIPs, st.Windows}
+	return nil
+}
+
+type apiStatsState struct {
+	PerMinute    map[string]map[int64]int64
+	IDs          map[string]map[string]map[int64]bool
+	Paths        map[string]map[string]bool
+	NotFound     map[string]int64
+	ClientRanges map[string][2]int64 // Unix milliseconds
+}
+
+// GobEncode encodes the aggregate
+func (a *APIStats) GobEncode() ([]byte, error) {
+	ranges := make(map[string][2]int64, len(a.clientRanges))
+	for ip, span := range a.clientRanges {
+		ranges[ip] = [2]int64{span[0].UnixMilli(), span[1].UnixMilli()}
+	}
+	return gobState(apiStatsState{a.perMinute, a.ids, a.paths, a.notFound, ranges})
+}
+
+// GobDecode decodes an aggregate encoded with GobEncode
+func (a *APIStats) GobDecode(data []byte) error {
+	var st apiStatsState
+	if err := gob.NewDecoder(bytes.NewReader(data)).Decode(&st); err != nil {
+		return err
+	}
+	*a = *newAPIStats()
+	a.perMinute, a.ids, a.paths, a.notFound = st.PerMinute, st.IDs, st.Paths, st.NotFound
+	for ip, span := range st.ClientRanges {
+		a.clientRanges[ip] = [2]time.Time{time.UnixMilli(span[0]).UTC(), time.UnixMilli(span[1]).UTC()}
+	}
+	return nil
+}
+
+type sessionStatsState struct {
+	Idle      int64
+	Clients   map[string][]*Session
+	Untracked int64
+}
+
+// GobEncode encodes the sessions
+func (a *SessionStats) GobEncode() ([]byte, error) {
+	return gobState(sessionStatsState{a.idle, a.clients, a.untracked})
+}
+
+// GobDecode decodes sessions encoded with GobEncode
+func (a *SessionStats) GobDecode(data []byte) error {
+	var st sessionStatsState
+	if err := gob.NewDecoder(bytes.NewReader(data)).Decode(&st); err != nil {
+		return err
+	}
+	*a = SessionStats{st.Idle, st.Clients, st.Untracked}
+	if a.clients == nil {
+		a.clients = make(map[string][]*Session)
+	}
+	return nil
+}
+
+type scannerCountsState struct {
+	Requests, Blocked   int64
+	FirstSeen, LastSeen time.Time
+	ClientIPs           map[string]int64
+	PerMinute           map[int64]int64
+}
+
+// GobEncode encodes the counts including the per-minute rate
+func (c *ScannerCounts) GobEncode() ([]byte, error) {
+	return gobState(scannerCountsState{c.Requests, c.Blocked, c.FirstSeen, c.LastSeen, c.ClientIPs, c.perMinute})
+}
+
+// GobDecode decodes counts encoded with GobEncode
+func (c *ScannerCounts) GobDecode(data []byte) error {
+	var st scannerCountsState
+	if err := gob.NewDecoder(bytes.NewReader(data)).Decode(&st); err != nil {
+		return err
+	}
+	*c = ScannerCounts{st.Requests, st.Blocked, st.FirstSeen, st.LastSeen, st.ClientIPs, st.PerMinute}
+	return nil
+}
+
+type latencyHistogramState struct {
+	Buckets  []int64
+	Count    int64
+	Sum, Max float64
+}
+
+type latencyStatsState struct {
+	Overall  latencyHistogramState
+	ByAction map[string]latencyHistogramState
+	ByRule   map[string]latencyHistogramState
+}
+
+// GobEncode encodes the latency histograms
+func (l *LatencyStats) GobEncode() ([]byte, error) {
+	st := latencyStatsState{
+		Overall:  l.overall.state(),
+		ByAction: make(map[string]latencyHistogramState, len(l.byAction)),
+		ByRule:   make(map[string]latencyHistogramState, len(l.byRule)),
+	}
+	for action, h := range l.byAction {
+		st.ByAction[action] = h.state()
+	}
+	for rule, h := range l.byRule {
+		st.ByRule[rule] = h.state()
+	}
+	return gobState(st)
+}
+
+// GobDecode decodes latency histograms encoded with GobEncode
+func (l *LatencyStats) GobDecode(data []byte) error {
+	var st latencyStatsState
+	if err := gob.NewDecoder(bytes.NewReader(data)).Decode(&st); err != nil {
+		return err
+	}
+	*l = *NewLatencyStats()
+	l.overall.restore(st.Overall)
+	for action, h := range st.ByAction {
+		histogramFor(l.byAction, action).restore(h)
+	}
+	for rule, h := range st.ByRule {
+		histogramFor(l.byRule, rule).restore(h)
+	}
+	return nil
+}
+
+// state returns an exported copy of the histogram
+func (h *latencyHistogram) state() latencyHistogramState {
+	return latencyHistogramState{Buckets: h.buckets[:], Count: h.count, Sum: h.sum, Max: h.max}
+}
+
+// restore sets the histogram from an exported copy
+func (h *latencyHistogram) restore(st latencyHistogramState) {
+	copy(h.buckets[:], st.Buckets)
+	h.count, h.sum, h.max = st.Count, st.Sum, st.Max
+}
+
+// gobState gob-encodes an exported copy of an aggregate's state
+func gobState(state interface{}) ([]byte, error) {
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(state); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
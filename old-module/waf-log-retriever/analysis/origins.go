@@ -0,0 +1,163 @@
+package analysis
+
+import (
+	_ "embed"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+)
+
+// countryLocationsJSON is the built-in table of country names and approximate
+// centroids, by ISO 3166-1 alpha-2 code as WAF logs them
+//
+//go:embed countries.json
+var countryLocationsJSON []byte
+
+// CountryLocation names a country and places it at its approximate centroid
+type CountryLocation struct {
+	Code string  `json:"code"`
+	Name string  `json:"name"`
+	Lat  float64 `json:"lat"`
+	Lon  float64 `json:"lon"`
+}
+
+// countryLocations is the built-in country table, sorted by code
+var countryLocations = mustLoadCountryLocations(countryLocationsJSON)
+
+// mustLoadCountryLocations parses the country table, panicking on errors since the
+// table is embedded at build time
+func mustLoadCountryLocations(data []byte) []CountryLocation {
+	var locations []CountryLocation
+	if err := json.Unmarshal(data, &locations); err != nil {
+		panic(fmt.Sprintf("invalid country table: %v", err))
+	}
+	sort.Slice(locations, func(i, j int) bool { return locations[i].Code < locations[j].Code })
+	return locations
+}
+
+// CountryLocations returns the built-in country table, sorted by code
+func CountryLocations() []CountryLocation {
+	return countryLocations
+}
+
+// LookupCountry returns the location of a country code, if the table has it
+func LookupCountry(code string) (CountryLocation, bool) {
+	i := sort.Search(len(countryLocations), func(i int) bool { return countryLocations[i].Code >= code })
+	if i < len(countryLocations) && countryLocations[i].Code == code {
+		return countryLocations[i], true
+	}
+	return CountryLocation{}, false
+}
+
+// OriginCounts counts the requests from one country
+type OriginCounts struct {
+	Requests          int64 `json:"requests"`
+	Blocked           int64 `json:"blocked"`
+	Attacks           int64 `json:"attacks"`           // Matching an attack category or from a scanner
+	AttacksNotBlocked int64 `json:"attacksNotBlocked"` // Attacks that were not blocked
+}
+
+// addOrigin folds a record into the counts of its country
+func (s *Stats) addOrigin(r *Record, attackCategories []string, scanner string) {
+	c, ok := s.Origins[r.HTTPRequest.Country]
+	if !ok {
+		c = &OriginCounts{}
+		s.Origins[r.HTTPRequest.Country] = c
+	}
+	c.Requests++
+	blocked := r.Action == "BLOCK"
+	if blocked {
+		c.Blocked++
+	}
+	if len(attackCategories) > 0 || scanner != "" {
+		c.Attacks++
+		if !blocked {
+			c.AttacksNotBlocked++
+		}
+	}
+}
+
+// merge folds the counts of the same country from another aggregate into c
+func (c *OriginCounts) merge(o *OriginCounts) {
+	c.Requests += o.Requests
+	c.Blocked += o.Blocked
+	c.Attacks += o.Attacks
+	c.AttacksNotBlocked += o.AttacksNotBlocked
+}
+
+// OriginReport is where requests came from, by country
+type OriginReport struct {
+	Country string  `json:"country"`        // ISO 3166-1 alpha-2 code as logged
+	Name    string  `json:"name,omitempty"` // Empty for codes the country table lacks
+	Lat     float64 `json:"lat,omitempty"`  // Approximate centroid
+	Lon     float64 `json:"lon,omitempty"`
+	Located bool    `json:"located"` // Whether the table has the country, so Lat and Lon are set
+	OriginCounts
+}
+
+// AttackOrigins lists the countries requests came from, those with the most attacks
+// first, then by requests
+func AttackOrigins(stats *Stats) []OriginReport {
+	origins := make([]OriginReport, 0, len(stats.Origins))
+	for code, c := range stats.Origins {
+		o := OriginReport{Country: code, OriginCounts: *c}
+		if location, ok := LookupCountry(code); ok {
+			o.Name, o.Lat, o.Lon, o.Located = location.Name, location.Lat, location.Lon, true
+		}
+		origins = append(origins, o)
+	}
+	sort.Slice(origins, func(i, j int) bool {
+		if origins[i].Attacks != origins[j].Attacks {
+			return origins[i].Attacks > origins[j].Attacks
+		}
+		if origins[i].Requests != origins[j].Requests {
+			return origins[i].Requests > origins[j].Requests
+		}
+		return origins[i].Country < origins[j].Country
+	})
+	return origins
+}
+
+// geoJSONFeatureCollection is a GeoJSON (RFC 7946) feature collection of points
+type geoJSONFeatureCollection struct {
+	Type     string           `json:"type"`
+	Features []geoJSONFeature `json:"features"`
+}
+
+type geoJSONFeature struct {
+	Type       string         `json:"type"`
+	Geometry   geoJSONPoint   `json:"geometry"`
+	Properties map[string]any `json:"properties"`
+}
+
+type geoJSONPoint struct {
+	Type        string     `json:"type"`
+	Coordinates [2]float64 `json:"coordinates"` // Longitude, latitude
+}
+
+// WriteOriginsGeoJSON writes the located origins as a GeoJSON feature collection with
+// a point at each country's centroid, so GIS tools and map libraries can render them
+func WriteOriginsGeoJSON(w io.Writer, origins []OriginReport) error {
+	collection := geoJSONFeatureCollection{Type: "FeatureCollection", Features: []geoJSONFeature{}}
+	for _, o := range origins {
+		if !o.Located {
+			continue
+		}
+		collection.Features = append(collection.Features, geoJSONFeature{
+			Type:     "Feature",
+			Geometry: geoJSONPoint{Type: "Point", Coordinates: [2]float64{o.Lon, o.Lat}},
+			Properties: map[string]any{
+				"country":           o.Country,
+				"name":              o.Name,
+				"requests":          o.Requests,
+				"blocked":           o.Blocked,
+				"attacks":           o.Attacks,
+				"attacksNotBlocked": o.AttacksNotBlocked,
+			},
+		})
+	}
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(collection)
+}
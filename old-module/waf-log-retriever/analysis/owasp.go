@@ -0,0 +1,237 @@
+package analysis
+
+import (
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"unicode"
+)
+
+// AttackCategory is an OWASP Top 10 (2021) category with its closest CAPEC attack pattern
+type AttackCategory struct {
+	OWASP string `json:"owasp"`
+	Name  string `json:"name"`
+	CAPEC string `json:"capec"`
+}
+
+// attackPatterns maps rule IDs and label names to attack categories. A pattern matches
+// whole tokens of a name, compared case-insensitively, where tokens are the runs of
+// letters and digits, so "GenericLFI_URIPATH" and "awswaf:managed:aws:linux-os:LFI_URIPath"
+// match "genericlfi" and "lfi" but "CustomLFIAllowlist" matches neither. A pattern of
+// several tokens, e.g. "host_localhost", matches them in a row. The first match wins,
+// so specific patterns come first.
+var attackPatterns = []struct {
+	pattern  string
+	category AttackCategory
+}{
+	{"sqli", AttackCategory{"A03:2021", "Injection", "CAPEC-66 SQL Injection"}},
+	{"sqliextendedpatterns", AttackCategory{"A03:2021", "Injection", "CAPEC-66 SQL Injection"}},
+	{"crosssitescripting", AttackCategory{"A03:2021", "Injection", "CAPEC-63 Cross-Site Scripting"}},
+	{"xss", AttackCategory{"A03:2021", "Injection", "CAPEC-63 Cross-Site Scripting"}},
+	{"powershellcommands", AttackCategory{"A03:2021", "Injection", "CAPEC-88 OS Command Injection"}},
+	{"windowsshellcommands", AttackCategory{"A03:2021", "Injection", "CAPEC-88 OS Command Injection"}},
+	{"unixshellcommandsvariables", AttackCategory{"A03:2021", "Injection", "CAPEC-88 OS Command Injection"}},
+	{"shellcommands", AttackCategory{"A03:2021", "Injection", "CAPEC-88 OS Command Injection"}},
+	{"rfi", AttackCategory{"A03:2021", "Injection", "CAPEC-193 PHP Remote File Inclusion"}},
+	{"genericrfi", AttackCategory{"A03:2021", "Injection", "CAPEC-193 PHP Remote File Inclusion"}},
+	{"phphighriskmethodsvariables", AttackCategory{"A03:2021", "Injection", "CAPEC-242 Code Injection"}},
+	{"lfi", AttackCategory{"A01:2021", "Broken Access Control", "CAPEC-126 Path Traversal"}},
+	{"genericlfi", AttackCategory{"A01:2021", "Broken Access Control", "CAPEC-126 Path Traversal"}},
+	{"pathtraversal", AttackCategory{"A01:2021", "Broken Access Control", "CAPEC-126 Path Traversal"}},
+	{"restrictedextensions", AttackCategory{"A01:2021", "Broken Access Control", "CAPEC-126 Path Traversal"}},
+	{"adminprotection", AttackCategory{"A01:2021", "Broken Access Control", "CAPEC-87 Forceful Browsing"}},
+	{"exploitablepaths", AttackCategory{"A01:2021", "Broken Access Control", "CAPEC-87 Forceful Browsing"}},
+	{"ssrf", AttackCategory{"A10:2021", "Server-Side Request Forgery", "CAPEC-664 Server Side Request Forgery"}},
+	{"ec2metadatassrf", AttackCategory{"A10:2021", "Server-Side Request Forgery", "CAPEC-664 Server Side Request Forgery"}},
+	{"log4j", AttackCategory{"A06:2021", "Vulnerable and Outdated Components", "CAPEC-136 LDAP Injection"}},
+	{"log4jrce", AttackCategory{"A06:2021", "Vulnerable and Outdated Components", "CAPEC-136 LDAP Injection"}},
+	{"deserialization", AttackCategory{"A08:2021", "Software and Data Integrity Failures", "CAPEC-586 Object Injection"}},
+	{"javadeserializationrce", AttackCategory{"A08:2021", "Software and Data Integrity Failures", "CAPEC-586 Object Injection"}},
+	{"host_localhost", AttackCategory{"A05:2021", "Security Misconfiguration", "CAPEC-141 Cache Poisoning"}},
+	{"propfind", AttackCategory{"A05:2021", "Security Misconfiguration", "CAPEC-169 Footprinting"}},
+	{"sizerestrictions", AttackCategory{"A05:2021", "Security Misconfiguration", "CAPEC-100 Overflow Buffers"}},
+	{"aws:atp", AttackCategory{"A07:2021", "Identification and Authentication Failures", "CAPEC-600 Credential Stuffing"}},
+	{"aws:acfp", AttackCategory{"A07:2021", "Identification and Authentication Failures", "CAPEC-21 Exploitation of Trusted Identifiers"}},
+}
+
+// AttackCounts counts the requests that matched rules of an attack category
+type AttackCounts struct {
+	Requests int64            `json:"requests"`
+	Blocked  int64            `json:"blocked"`
+	CAPEC    map[string]int64 `json:"capec"` // Requests by CAPEC pattern
+	Rules    map[string]int64 `json:"rules"` // Requests by matching rule ID or label
+}
+
+// categories caches the attack category of rule IDs and label names: name ->
+// *AttackCategory, nil if it maps to none
+var categories sync.Map
+
+// categorize returns the attack category of a rule ID or label name
+func categorize(name string) (AttackCategory, bool) {
+	if c, ok := categories.Load(name); ok {
+		if c := c.(*AttackCategory); c != nil {
+			return *c, true
+		}
+		return AttackCategory{}, false
+	}
+	var found *AttackCategory
+	tokens := nameTokens(name)
+	for _, p := range attackPatterns {
+		if containsTokens(tokens, nameTokens(p.pattern)) {
+			found = &p.category
+			break
+		}
+	}
+	categories.Store(name, found)
+	if found == nil {
+		return AttackCategory{}, false
+	}
+	return *found, true
+}
+
+// nameTokens splits a rule ID or label name into its lowercase runs of letters and digits
+func nameTokens(name string) []string {
+	return strings.FieldsFunc(strings.ToLower(name), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	})
+}
+
+// containsTokens reports whether tokens holds pattern as a run of whole tokens
+func containsTokens(tokens, pattern []string) bool {
+	for i := 0; i+len(pattern) <= len(tokens); i++ {
+		if slices.Equal(tokens[i:i+len(pattern)], pattern) {
+			return true
+		}
+	}
+	return false
+}
+
+// IsAttack reports whether any rule or label of a record maps to an attack category
+func IsAttack(r *Record) bool {
+	for _, name := range attackNames(r) {
+		if _, ok := categorize(name); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// attackNames returns the rule IDs and labels of a record that may map to an attack
+// category: those of the rule that blocked it, of the rules that matched it in COUNT,
+// and its labels. A rule that allowed a request, and rules excluded from their rule
+// group, whose labels are left out as well, did not find an attack.
+func attackNames(r *Record) []string {
+	var names []string
+	if r.Action == "BLOCK" {
+		names = append(names, r.TerminatingRuleID)
+	}
+	var excluded []string
+	for _, rule := range r.NonTerminatingMatchingRules {
+		if attackAction(rule.Action) {
+			names = append(names, rule.RuleID)
+		}
+	}
+	for _, group := range r.RuleGroupList {
+		if rule := group.TerminatingRule; rule != nil && attackAction(rule.Action) {
+			names = append(names, rule.RuleID)
+		}
+		for _, rule := range group.NonTerminatingMatchingRules {
+			if attackAction(rule.Action) {
+				names = append(names, rule.RuleID)
+			}
+		}
+		for _, rule := range group.ExcludedRules {
+			excluded = append(excluded, strings.ToLower(rule.RuleID))
+		}
+	}
+	for _, label := range r.Labels {
+		if !slices.Contains(excluded, strings.ToLower(label.Name[strings.LastIndexByte(label.Name, ':')+1:])) {
+			names = append(names, label.Name)
+		}
+	}
+	return names
+}
+
+// attackAction reports whether a rule matching with an action found an attack: it
+// blocked the request, or counted it, as rules being evaluated before enforcement do
+func attackAction(action string) bool {
+	return action == "BLOCK" || action == "COUNT"
+}
+
+// addAttackCategories folds the attack categories a record matched into the aggregate,
+// counting each category once per record, and returns the OWASP IDs it matched
+func (s *Stats) addAttackCategories(r *Record) []string {
+	names := attackNames(r)
+
+	var matched []string
+	seenOWASP := make(map[string]bool)
+	seenCAPEC := make(map[string]bool)
+	for _, name := range names {
+		category, ok := categorize(name)
+		if !ok {
+			continue
+		}
+		counts, ok := s.AttackCategories[category.OWASP]
+		if !ok {
+			counts = &AttackCounts{CAPEC: make(map[string]int64), Rules: make(map[string]int64)}
+			s.AttackCategories[category.OWASP] = counts
+		}
+		counts.Rules[name]++
+		if !seenCAPEC[category.CAPEC] {
+			seenCAPEC[category.CAPEC] = true
+			counts.CAPEC[category.CAPEC]++
+		}
+		if !seenOWASP[category.OWASP] {
+			seenOWASP[category.OWASP] = true
+			matched = append(matched, category.OWASP)
+			counts.Requests++
+			if r.Action == "BLOCK" {
+				counts.Blocked++
+			}
+		}
+	}
+	return matched
+}
+
+// LandscapeEntry is one OWASP Top 10 category of the attack landscape
+type LandscapeEntry struct {
+	OWASP    string  `json:"owasp"`
+	Name     string  `json:"name"`
+	Requests int64   `json:"requests"`
+	Blocked  int64   `json:"blocked"`
+	CAPEC    []Count `json:"capec"`
+	TopRules []Count `json:"topRules"`
+}
+
+// AttackLandscape lists the OWASP Top 10 categories the logs show attacks for, most hit first
+func AttackLandscape(stats *Stats) []LandscapeEntry {
+	return landscapeOf(stats.AttackCategories)
+}
+
+// landscapeOf lists attack counts by OWASP Top 10 category, most hit first
+func landscapeOf(categories map[string]*AttackCounts) []LandscapeEntry {
+	names := make(map[string]string)
+	for _, p := range attackPatterns {
+		names[p.category.OWASP] = p.category.Name
+	}
+
+	landscape := make([]LandscapeEntry, 0, len(categories))
+	for owasp, counts := range categories {
+		landscape = append(landscape, LandscapeEntry{
+			OWASP:    owasp,
+			Name:     names[owasp],
+			Requests: counts.Requests,
+			Blocked:  counts.Blocked,
+			CAPEC:    TopN(counts.CAPEC, 0),
+			TopRules: TopN(counts.Rules, 5),
+		})
+	}
+	sort.Slice(landscape, func(i, j int) bool {
+		if landscape[i].Requests != landscape[j].Requests {
+			return landscape[i].Requests > landscape[j].Requests
+		}
+		return landscape[i].OWASP < landscape[j].OWASP
+	})
+	return landscape
+}
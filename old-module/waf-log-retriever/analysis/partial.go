@@ -0,0 +1,328 @@
+package analysis
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/gob"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"waf-log-retriever/logging"
+	"waf-log-retriever/storage"
+)
+
+// PartialExtension is the file extension of partial aggregates
+const PartialExtension = ".wafpart"
+
+// PartialSchemaVersion changes whenever Stats or its encoding changes; partials of
+// older versions back to MinPartialSchemaVersion are migrated when read, see
+// partialMigrations
+const PartialSchemaVersion = 12
+
+// MinPartialSchemaVersion is the oldest schema version of partials that can be
+// migrated; older partials have to be aggregated again from their logs
+const MinPartialSchemaVersion = 7
+
+// partialMagic identifies partial aggregate files
+const partialMagic = "waf-log-retriever/partial"
+
+// PartialHeader describes a partial aggregate: which logs it covers and the
+// settings it was aggregated with
+type PartialHeader struct {
+	Magic         string
+	SchemaVersion int
+	ProfileName   string
+	WebACLName    string
+	Chunk         string // Log directory aggregated, relative to the Web ACL's log directory
+	CreatedAt     time.Time
+	Files         int
+	Skipped       int64           // Records filtered out by host
+	Settings      []byte          // Analysis settings as JSON; only partials with equal settings merge
+	Inputs        []ManifestEntry // Manifest of the aggregated log files, if recorded
+}
+
+// Partial is the aggregate of one chunk of log files. Every statistic is a count,
+// a sum or a capped set, so partials of disjoint chunks merge into the statistics
+// of all their logs, which is how analysis is spread over machines or runs.
+type Partial struct {
+	Header PartialHeader
+	Stats  *Stats
+
+	// MigratedFrom is the schema version a partial was written with if ReadPartial
+	// migrated it, and Caveats what it lacks compared to a current one
+	MigratedFrom int
+	Caveats      []string
+}
+
+// partialMigration upgrades a partial decoded from the schema version before to.
+// Gob leaves the fields a partial predates at their zero value, so a migration only
+// fills in what can be derived and what must not stay nil; caveat tells what the
+// partial still lacks.
+type partialMigration struct {
+	to      int
+	migrate func(p *Partial)
+	caveat  string
+}
+
+// partialMigrations are applied in order to partials of older schema versions
+var partialMigrations = []partialMigration{
+	{to: 8}, // Account names were added to the settings only
+	{
+		to:      9,
+		migrate: func(p *Partial) { p.Stats.Origins = make(map[string]*OriginCounts) },
+		caveat:  "no attack origins by country",
+	},
+	{
+		to: 10,
+		migrate: func(p *Partial) {
+			s := p.Stats
+			s.Filtered = p.Header.Skipped
+			s.UncountedRecords = s.TotalRequests + s.Filtered
+			for _, n := range s.Suppressed {
+				s.UncountedRecords += n
+			}
+			for _, input := range p.Header.Inputs {
+				s.UncountedFiles = append(s.UncountedFiles, input.Path)
+			}
+		},
+		caveat: "no record counts by log file, so the record count reconciliation only checks their totals",
+	},
+	{to: 11}, // Uncounted records were added, which only migrated partials have
+	{to: 12, caveat: "no Host header anomalies"},
+}
+
+// AggregatePartial aggregates a chunk of log files below root, reading them through
+// the record cache if one is given
+func AggregatePartial(root string, files []string, settings *Settings, records *RecordCache, logger logging.Logger) (*Partial, error) {
+	settingsJSON, err := json.Marshal(settings)
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode settings: %w", err)
+	}
+	chunk := "."
+	if len(files) > 0 {
+		if chunk, err = filepath.Rel(root, filepath.Dir(files[0])); err != nil {
+			return nil, fmt.Errorf("failed to resolve log directory: %w", err)
+		}
+	}
+	p := &Partial{
+		Header: PartialHeader{
+			Magic:         partialMagic,
+			SchemaVersion: PartialSchemaVersion,
+			Chunk:         filepath.ToSlash(chunk),
+			CreatedAt:     time.Now().UTC(),
+			Files:         len(files),
+			Settings:      settingsJSON,
+		},
+		Stats: NewStats(settings),
+	}
+	if p.Header.Skipped, err = aggregateFiles(p.Stats, root, files, records, logger); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+// WritePartials writes one partial aggregate, with its input manifest, for each log
+// directory below root to outputDir, and returns how many it wrote
+func WritePartials(root, outputDir, profile, webACL string, settings *Settings, records *RecordCache, logger logging.Logger) (int, error) {
+	files, err := ListLogFiles(root)
+	if err != nil {
+		return 0, err
+	}
+	logger.Infof("Found %d log files under %s", len(files), root)
+	if err := os.MkdirAll(outputDir, 0755); err != nil {
+		return 0, fmt.Errorf("failed to create partial aggregate directory: %w", err)
+	}
+
+	chunks := chunkFiles(files)
+	for _, chunk := range chunks {
+		p, err := AggregatePartial(root, chunk.files, settings, records, logger)
+		if err != nil {
+			return 0, err
+		}
+		p.Header.ProfileName, p.Header.WebACLName = profile, webACL
+		if p.Header.Inputs, err = BuildInputManifest(root, chunk.files); err != nil {
+			return 0, err
+		}
+		name := strings.ReplaceAll(p.Header.Chunk, "/", "-")
+		if name == "." {
+			name = "logs" // Log files directly in the Web ACL's log directory
+		}
+		name += PartialExtension
+		path := filepath.Join(outputDir, name)
+		if err := WritePartial(path, p); err != nil {
+			return 0, err
+		}
+		logger.Debugf("Wrote partial aggregate of %s to %s", p.Header.Chunk, path)
+	}
+	records.Prune(files)
+	return len(chunks), nil
+}
+
+// WritePartial writes a partial aggregate: the gob-encoded header followed by the
+// gob-encoded statistics. It writes a temporary file and renames it, so a partial
+// file is never truncated.
+func WritePartial(path string, p *Partial) error {
+	var buf bytes.Buffer
+	enc := gob.NewEncoder(&buf)
+	if err := enc.Encode(&p.Header); err != nil {
+		return fmt.Errorf("failed to encode partial aggregate header: %w", err)
+	}
+	p.Stats.Finalize() // The columns are not encoded
+	if err := enc.Encode(p.Stats); err != nil {
+		return fmt.Errorf("failed to encode partial aggregate: %w", err)
+	}
+	if err := storage.WriteFileAtomic(path, buf.Bytes()); err != nil {
+		return fmt.Errorf("failed to write partial aggregate: %w", err)
+	}
+	return nil
+}
+
+// ReadPartial reads a partial aggregate, migrating files of older schema versions
+// and rejecting those it cannot migrate
+func ReadPartial(path string) (*Partial, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open partial aggregate: %w", err)
+	}
+	defer file.Close()
+
+	dec := gob.NewDecoder(bufio.NewReader(file))
+	p := &Partial{}
+	if err := dec.Decode(&p.Header); err != nil || p.Header.Magic != partialMagic {
+		return nil, fmt.Errorf("%s is not a partial aggregate", path)
+	}
+	if v := p.Header.SchemaVersion; v < MinPartialSchemaVersion || v > PartialSchemaVersion {
+		return nil, fmt.Errorf("partial aggregate %s has schema version %d, this version reads %d to %d; aggregate its logs again",
+			path, v, MinPartialSchemaVersion, PartialSchemaVersion)
+	}
+	p.Stats = &Stats{}
+	if err := dec.Decode(p.Stats); err != nil {
+		return nil, fmt.Errorf("failed to decode partial aggregate %s: %w", path, err)
+	}
+	if p.Header.SchemaVersion < PartialSchemaVersion {
+		if err := migratePartial(p); err != nil {
+			return nil, fmt.Errorf("failed to migrate partial aggregate %s: %w", path, err)
+		}
+	}
+	return p, nil
+}
+
+// migratePartial upgrades a partial of an older schema version to the current one.
+// Its settings are re-encoded, so that settings added since take their defaults and
+// it still merges with current partials aggregated with the same settings.
+func migratePartial(p *Partial) error {
+	settings := DefaultSettings()
+	if err := json.Unmarshal(p.Header.Settings, settings); err != nil {
+		return fmt.Errorf("failed to parse settings: %w", err)
+	}
+	settingsJSON, err := json.Marshal(settings)
+	if err != nil {
+		return fmt.Errorf("failed to encode settings: %w", err)
+	}
+	p.Header.Settings = settingsJSON
+
+	p.MigratedFrom = p.Header.SchemaVersion
+	for _, m := range partialMigrations {
+		if m.to <= p.Header.SchemaVersion {
+			continue
+		}
+		if m.migrate != nil {
+			m.migrate(p)
+		}
+		if m.caveat != "" {
+			p.Caveats = append(p.Caveats, m.caveat)
+		}
+		p.Header.SchemaVersion = m.to
+	}
+	return nil
+}
+
+// Merged is the merge of partial aggregates
+type Merged struct {
+	ProfileName string // Empty if partials of several Web ACLs were combined
+	WebACLName  string
+	Settings    *Settings
+	Stats       *Stats
+	Files       int
+	Inputs      []ManifestEntry // Manifest of every aggregated log file, if all partials recorded theirs
+}
+
+// MergePartials merges partial aggregates of disjoint chunks of the same Web ACL's
+// logs, aggregated with the same settings. With combine, partials of several Web
+// ACLs, e.g. of other accounts, are merged into one analysis; their records stay
+// apart in the statistics by source, and the paths of their inputs are prefixed
+// with the profile and Web ACL.
+func MergePartials(partials []*Partial, combine bool, logger logging.Logger) (*Merged, error) {
+	if len(partials) == 0 {
+		return nil, fmt.Errorf("no partial aggregates to merge")
+	}
+	sorted := append([]*Partial(nil), partials...)
+	sort.SliceStable(sorted, func(i, j int) bool { return partialID(sorted[i].Header) < partialID(sorted[j].Header) })
+
+	first := sorted[0].Header
+	settings := DefaultSettings()
+	if err := json.Unmarshal(first.Settings, settings); err != nil {
+		return nil, fmt.Errorf("failed to decode the settings of partial %s: %w", first.Chunk, err)
+	}
+	if err := settings.compile(); err != nil {
+		return nil, fmt.Errorf("settings of partial %s: %w", first.Chunk, err)
+	}
+
+	m := &Merged{ProfileName: first.ProfileName, WebACLName: first.WebACLName, Settings: settings, Stats: NewStats(settings)}
+	var skipped int64
+	manifest := true
+	seen := make(map[string]bool)
+	for _, p := range sorted {
+		h := p.Header
+		if h.ProfileName != m.ProfileName || h.WebACLName != m.WebACLName {
+			if !combine {
+				return nil, fmt.Errorf("partial %s is of Web ACL %s/%s, not %s/%s; combine them to merge several Web ACLs",
+					h.Chunk, h.ProfileName, h.WebACLName, m.ProfileName, m.WebACLName)
+			}
+			m.ProfileName, m.WebACLName = "", ""
+		}
+		if !bytes.Equal(h.Settings, first.Settings) {
+			return nil, fmt.Errorf("partial %s was aggregated with other settings than partial %s", partialID(h), partialID(first))
+		}
+		if seen[partialID(h)] {
+			return nil, fmt.Errorf("log directory %s is in more than one partial", partialID(h))
+		}
+		seen[partialID(h)] = true
+
+		m.Stats.Merge(p.Stats)
+		m.Files += h.Files
+		skipped += h.Skipped
+		if len(h.Inputs) != h.Files {
+			manifest = false
+		}
+		for _, input := range h.Inputs {
+			if combine {
+				input.Path = h.ProfileName + "/" + h.WebACLName + "/" + input.Path
+			}
+			m.Inputs = append(m.Inputs, input)
+		}
+	}
+	if manifest {
+		sort.Slice(m.Inputs, func(i, j int) bool { return m.Inputs[i].Path < m.Inputs[j].Path })
+	} else {
+		m.Inputs = nil
+	}
+
+	if m.ProfileName == "" && len(m.Stats.Sources) > 0 {
+		logger.Infof("Combined %d sources", len(m.Stats.Sources))
+	}
+	logger.Infof("Merged %d partial aggregates covering %d log files", len(sorted), m.Files)
+	logAggregate(m.Stats, skipped, logger)
+	return m, nil
+}
+
+// partialID identifies the log directory of a partial among the partials of all Web
+// ACLs: the profile, Web ACL and chunk
+func partialID(h PartialHeader) string {
+	return h.ProfileName + "/" + h.WebACLName + "/" + h.Chunk
+}
@@ -0,0 +1,371 @@
+package analysis
+
+import (
+	_ "embed"
+	"encoding/json"
+	"fmt"
+	"math"
+	"os"
+	"sort"
+	"strings"
+)
+
+// policyTemplatesJSON is the built-in library of baseline Web ACL templates
+//
+//go:embed policytemplates.json
+var policyTemplatesJSON []byte
+
+// PolicySource is the source of the findings of policy template gaps
+const PolicySource = "policy-template"
+
+// Statuses of a policy requirement
+const (
+	PolicyMet     = "met"
+	PolicyPartial = "partial" // Present, but only counting, with rules overridden to Count or excluded, or too lax
+	PolicyMissing = "missing"
+)
+
+// partialCredit is the share of its weight a partially met requirement scores
+const partialCredit = 0.5
+
+// PolicyTemplate is an opinionated baseline Web ACL for a kind of application
+type PolicyTemplate struct {
+	Name         string              `json:"name"`
+	Title        string              `json:"title"`
+	Description  string              `json:"description"`
+	Requirements []PolicyRequirement `json:"requirements"`
+}
+
+// PolicyRequirement is one protection a template expects, met by a managed rule
+// group, a rate-based rule or a rule containing a kind of statement
+type PolicyRequirement struct {
+	ID                      string        `json:"id"`
+	Title                   string        `json:"title"`
+	Severity                string        `json:"severity"` // Of the finding when the requirement is missing; one lower when partially met
+	Weight                  int           `json:"weight"`
+	ManagedRuleGroup        string        `json:"managedRuleGroup,omitempty"`        // Vendor#name, e.g. AWS#AWSManagedRulesCommonRuleSet
+	ManagedRuleGroupConfigs []interface{} `json:"managedRuleGroupConfigs,omitempty"` // Of the recommended rule, for groups that need them
+	RateBased               bool          `json:"rateBased,omitempty"`
+	MaxRateLimit            int64         `json:"maxRateLimit,omitempty"` // Highest limit that meets the requirement; also the limit of the recommended rule
+	Statement               string        `json:"statement,omitempty"`    // Statement type a rule must contain, e.g. SizeConstraintStatement
+	Recommendation          string        `json:"recommendation"`
+}
+
+// PolicyGap is how a Web ACL meets one requirement of a template
+type PolicyGap struct {
+	Requirement    string   `json:"requirement"`
+	Title          string   `json:"title"`
+	Severity       string   `json:"severity"`
+	Weight         int      `json:"weight"`
+	Status         string   `json:"status"`
+	Rules          []string `json:"rules,omitempty"`  // Rules of the Web ACL meeting it, in full or in part
+	Detail         string   `json:"detail,omitempty"` // Why it is only partially met
+	Recommendation string   `json:"recommendation,omitempty"`
+	RuleJSON       string   `json:"ruleJson,omitempty"` // Rule closing the gap, for pasting into the console's rule JSON editor
+}
+
+// PolicyReport scores a Web ACL against a policy template
+type PolicyReport struct {
+	Template    string      `json:"template"`
+	Title       string      `json:"title"`
+	Description string      `json:"description"`
+	Score       int         `json:"score"` // Percent of the requirements' weight met, partial requirements counting half
+	Met         int         `json:"met"`
+	Partial     int         `json:"partial"`
+	Missing     int         `json:"missing"`
+	Gaps        []PolicyGap `json:"gaps"` // Every requirement, in template order
+}
+
+// policyTemplates is the parsed built-in template library
+var policyTemplates = mustLoadPolicyTemplates(policyTemplatesJSON)
+
+// mustLoadPolicyTemplates parses and validates the template library, panicking on
+// errors since the library is embedded at build time
+func mustLoadPolicyTemplates(data []byte) []PolicyTemplate {
+	var templates []PolicyTemplate
+	if err := json.Unmarshal(data, &templates); err != nil {
+		panic(fmt.Sprintf("invalid policy templates: %v", err))
+	}
+	for i := range templates {
+		if err := templates[i].Validate(); err != nil {
+			panic(fmt.Sprintf("invalid policy template: %v", err))
+		}
+	}
+	return templates
+}
+
+// PolicyTemplateNames returns the names of the built-in policy templates
+func PolicyTemplateNames() []string {
+	names := make([]string, len(policyTemplates))
+	for i, t := range policyTemplates {
+		names[i] = t.Name
+	}
+	return names
+}
+
+// LoadPolicyTemplate returns the built-in policy template of a name, or reads a
+// template from a JSON file
+func LoadPolicyTemplate(nameOrPath string) (*PolicyTemplate, error) {
+	for _, t := range policyTemplates {
+		if t.Name == nameOrPath {
+			template := t
+			return &template, nil
+		}
+	}
+	data, err := os.ReadFile(nameOrPath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, fmt.Errorf("unknown policy template %q (built-in: %s; or a template file)", nameOrPath, strings.Join(PolicyTemplateNames(), ", "))
+		}
+		return nil, fmt.Errorf("failed to read policy template: %w", err)
+	}
+	var template PolicyTemplate
+	if err := json.Unmarshal(data, &template); err != nil {
+		return nil, fmt.Errorf("failed to parse policy template %s: %w", nameOrPath, err)
+	}
+	if err := template.Validate(); err != nil {
+		return nil, fmt.Errorf("invalid policy template %s: %w", nameOrPath, err)
+	}
+	return &template, nil
+}
+
+// Validate checks that every requirement has an ID, a positive weight, a severity
+// and exactly one way of being met
+func (t *PolicyTemplate) Validate() error {
+	if t.Name == "" {
+		return fmt.Errorf("template has no name")
+	}
+	if len(t.Requirements) == 0 {
+		return fmt.Errorf("template %s has no requirements", t.Name)
+	}
+	seen := make(map[string]bool)
+	for _, r := range t.Requirements {
+		if r.ID == "" || seen[r.ID] {
+			return fmt.Errorf("template %s: requirement IDs must be set and unique (%q)", t.Name, r.ID)
+		}
+		seen[r.ID] = true
+		if r.Weight <= 0 {
+			return fmt.Errorf("template %s: requirement %s needs a positive weight", t.Name, r.ID)
+		}
+		if !ValidSeverity(r.Severity) {
+			return fmt.Errorf("template %s: requirement %s has unknown severity %q", t.Name, r.ID, r.Severity)
+		}
+		kinds := 0
+		for _, set := range []bool{r.ManagedRuleGroup != "", r.RateBased, r.Statement != ""} {
+			if set {
+				kinds++
+			}
+		}
+		if kinds != 1 {
+			return fmt.Errorf("template %s: requirement %s needs exactly one of managedRuleGroup, rateBased and statement", t.Name, r.ID)
+		}
+	}
+	return nil
+}
+
+// ScorePolicy scores a Web ACL snapshot against a policy template, with a
+// recommendation, and where possible a rule, for every requirement not fully met
+func ScorePolicy(template *PolicyTemplate, snapshot map[string]interface{}) *PolicyReport {
+	webACL, _ := snapshot["webACL"].(map[string]interface{})
+	rules := asSlice(webACL["Rules"])
+	report := &PolicyReport{Template: template.Name, Title: template.Title, Description: template.Description}
+
+	var total, earned float64
+	for _, req := range template.Requirements {
+		gap := evaluateRequirement(req, rules)
+		total += float64(req.Weight)
+		switch gap.Status {
+		case PolicyMet:
+			report.Met++
+			earned += float64(req.Weight)
+		case PolicyPartial:
+			report.Partial++
+			earned += partialCredit * float64(req.Weight)
+		default:
+			report.Missing++
+		}
+		report.Gaps = append(report.Gaps, gap)
+	}
+	report.Score = int(math.Round(100 * earned / total))
+	return report
+}
+
+// evaluateRequirement finds the rules meeting a requirement and how fully they do
+func evaluateRequirement(req PolicyRequirement, rules []map[string]interface{}) PolicyGap {
+	gap := PolicyGap{Requirement: req.ID, Title: req.Title, Severity: req.Severity, Weight: req.Weight, Status: PolicyMissing}
+	var partial, fixes []string
+	for _, rule := range rules {
+		name, _ := rule["Name"].(string)
+		statement, _ := rule["Statement"].(map[string]interface{})
+		action := ruleAction(rule)
+		enforcing := action != "COUNT" && action != "ALLOW"
+
+		var detail, fix string
+		switch {
+		case req.ManagedRuleGroup != "":
+			id, group := ruleGroupOf(statement)
+			if id != req.ManagedRuleGroup || statement["ManagedRuleGroupStatement"] == nil {
+				continue
+			}
+			if !enforcing {
+				detail = fmt.Sprintf("%s only counts the rule group's matches", name)
+				fix = fmt.Sprintf("Change the override action of %s from Count to None once its matches are reviewed.", name)
+			} else if weakened := weakenedRules(group); len(weakened) > 0 {
+				detail = fmt.Sprintf("%s overrides rules of the group to Count or excludes them: %s", name, strings.Join(weakened, ", "))
+				fix = fmt.Sprintf("Enforce the overridden rules of %s again, scoped down to the requests they misfire on (see scope-down).", name)
+			}
+		case req.RateBased:
+			rate, ok := statement["RateBasedStatement"].(map[string]interface{})
+			if !ok {
+				continue
+			}
+			limit, _ := rate["Limit"].(float64)
+			if !enforcing {
+				detail = fmt.Sprintf("%s only counts", name)
+				fix = fmt.Sprintf("Change the action of %s from %s to Block.", name, strings.ToLower(action))
+			} else if req.MaxRateLimit > 0 && int64(limit) > req.MaxRateLimit {
+				detail = fmt.Sprintf("%s allows %.0f requests, above %d", name, limit, req.MaxRateLimit)
+				fix = fmt.Sprintf("Lower the limit of %s to %d or less (see rate-limits).", name, req.MaxRateLimit)
+			}
+		default:
+			if !containsStatement(statement, req.Statement) {
+				continue
+			}
+			if !enforcing {
+				detail = fmt.Sprintf("%s only counts", name)
+				fix = fmt.Sprintf("Change the action of %s from %s to Block.", name, strings.ToLower(action))
+			}
+		}
+
+		gap.Rules = append(gap.Rules, name)
+		if detail == "" {
+			gap.Status = PolicyMet
+		} else {
+			partial = append(partial, detail)
+			fixes = append(fixes, fix)
+		}
+	}
+
+	switch {
+	case gap.Status == PolicyMet:
+		return gap
+	case len(partial) > 0:
+		gap.Status = PolicyPartial
+		gap.Detail = strings.Join(partial, "; ")
+		gap.Severity = severities[max(0, SeverityRank(req.Severity)-1)]
+		gap.Recommendation = strings.Join(fixes, " ")
+		return gap
+	}
+	gap.Recommendation = req.Recommendation
+	if rule := requirementRule(req); rule != nil {
+		gap.RuleJSON, _ = MarshalRuleJSON(rule)
+	}
+	return gap
+}
+
+// weakenedRules returns the rules of a rule group statement that are overridden to
+// Count or Allow, or excluded
+func weakenedRules(group map[string]interface{}) []string {
+	var weakened []string
+	for _, o := range asSlice(group["RuleActionOverrides"]) {
+		name, _ := o["Name"].(string)
+		action, _ := o["ActionToUse"].(map[string]interface{})
+		if a := ruleAction(map[string]interface{}{"Action": action}); a == "COUNT" || a == "ALLOW" {
+			weakened = append(weakened, name)
+		}
+	}
+	for _, e := range asSlice(group["ExcludedRules"]) {
+		name, _ := e["Name"].(string)
+		weakened = append(weakened, name)
+	}
+	sort.Strings(weakened)
+	return weakened
+}
+
+// containsStatement reports whether a statement is, or nests, a statement of a type
+func containsStatement(v interface{}, statementType string) bool {
+	switch v := v.(type) {
+	case map[string]interface{}:
+		for key, value := range v {
+			if key == statementType && value != nil {
+				return true
+			}
+			if containsStatement(value, statementType) {
+				return true
+			}
+		}
+	case []interface{}:
+		for _, value := range v {
+			if containsStatement(value, statementType) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// requirementRule returns a rule meeting a managed rule group or rate-based
+// requirement, in console JSON, or nil for statement requirements
+func requirementRule(req PolicyRequirement) map[string]interface{} {
+	var name string
+	rule := map[string]interface{}{"Priority": 0}
+	switch {
+	case req.ManagedRuleGroup != "":
+		vendor, group, _ := strings.Cut(req.ManagedRuleGroup, "#")
+		name = vendor + "-" + group
+		managed := map[string]interface{}{"VendorName": vendor, "Name": group}
+		if len(req.ManagedRuleGroupConfigs) > 0 {
+			managed["ManagedRuleGroupConfigs"] = req.ManagedRuleGroupConfigs
+		}
+		rule["OverrideAction"] = map[string]interface{}{"None": map[string]interface{}{}}
+		rule["Statement"] = map[string]interface{}{"ManagedRuleGroupStatement": managed}
+	case req.RateBased:
+		name = "rate-limit-per-ip"
+		limit := req.MaxRateLimit
+		if limit == 0 {
+			limit = 2000
+		}
+		rule["Action"] = map[string]interface{}{"Block": map[string]interface{}{}}
+		rule["Statement"] = map[string]interface{}{
+			"RateBasedStatement": map[string]interface{}{"Limit": limit, "EvaluationWindowSec": 300, "AggregateKeyType": "IP"},
+		}
+	default:
+		return nil
+	}
+	rule["Name"] = name
+	rule["VisibilityConfig"] = map[string]interface{}{
+		"SampledRequestsEnabled":   true,
+		"CloudWatchMetricsEnabled": true,
+		"MetricName":               name,
+	}
+	return rule
+}
+
+// PolicyFindings reports each requirement of the template the Web ACL does not meet
+func PolicyFindings(webACLName string, report *PolicyReport) []Finding {
+	if report == nil {
+		return nil
+	}
+	var findings []Finding
+	for _, gap := range report.Gaps {
+		var title, description string
+		switch gap.Status {
+		case PolicyMissing:
+			title = fmt.Sprintf("Web ACL %s lacks %s", webACLName, gap.Title)
+			description = fmt.Sprintf("The %s baseline expects %s, which no rule provides. %s", report.Title, gap.Title, gap.Recommendation)
+		case PolicyPartial:
+			title = fmt.Sprintf("Web ACL %s only partly provides %s", webACLName, gap.Title)
+			description = fmt.Sprintf("The %s baseline expects %s, but %s. %s", report.Title, gap.Title, gap.Detail, gap.Recommendation)
+		default:
+			continue
+		}
+		findings = append(findings, Finding{
+			ID:          "policy-gap-" + gap.Requirement,
+			Severity:    gap.Severity,
+			Title:       title,
+			Description: description,
+			Source:      PolicySource,
+		})
+	}
+	return findings
+}
@@ -0,0 +1,266 @@
+package analysis
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+
+	"waf-log-retriever/storage"
+)
+
+// provenances caches the provenance of log directories: directory -> *storage.Provenance,
+// nil if neither it nor a directory above it has one
+var provenances sync.Map
+
+// provenanceOf returns the provenance recorded for a log file's Web ACL directory, the
+// nearest directory above the file with a provenance file, or nil if there is none,
+// e.g. for logs retrieved by earlier versions
+func provenanceOf(file string) *storage.Provenance {
+	dir, err := filepath.Abs(filepath.Dir(file))
+	if err != nil {
+		return nil
+	}
+	var visited []string
+	var found *storage.Provenance
+	for {
+		if p, ok := provenances.Load(dir); ok {
+			found = p.(*storage.Provenance)
+			break
+		}
+		visited = append(visited, dir)
+		if _, err := os.Stat(filepath.Join(dir, storage.ProvenanceFileName)); err == nil {
+			// An unreadable provenance file leaves the records to their Web ACL ARN
+			found, _ = storage.LoadProvenance(dir)
+			break
+		}
+		parent := filepath.Dir(dir)
+		if parent == dir {
+			break
+		}
+		dir = parent
+	}
+	for _, d := range visited {
+		provenances.Store(d, found)
+	}
+	return found
+}
+
+// Source returns the provenance of a record: the profile, account, region and Web ACL
+// recorded at retrieval, with what is missing taken from the record's Web ACL ARN,
+// e.g. arn:aws:wafv2:us-east-1:123456789012:global/webacl/my-acl/<id>
+func (r *Record) Source() storage.Provenance {
+	var p storage.Provenance
+	if r.provenance != nil {
+		p = *r.provenance
+	}
+	if p.AccountID != "" && p.Region != "" && p.WebACL != "" {
+		return p
+	}
+	parts := strings.SplitN(r.WebACLID, ":", 6)
+	if len(parts) < 6 {
+		return p
+	}
+	if p.Region == "" {
+		p.Region = parts[3]
+	}
+	if p.AccountID == "" {
+		p.AccountID = parts[4]
+	}
+	if resource := strings.Split(parts[5], "/"); p.WebACL == "" && len(resource) >= 3 {
+		p.WebACL = resource[2]
+	}
+	return p
+}
+
+// SourceKey identifies the source of records in aggregations and the source filter:
+// <account>/<region>/<Web ACL>, with the profile standing in for an unknown account
+func SourceKey(p storage.Provenance) string {
+	account := p.AccountID
+	if account == "" {
+		account = p.Profile
+	}
+	return strings.Join([]string{orUnknown(account), orUnknown(p.Region), orUnknown(p.WebACL)}, "/")
+}
+
+// orUnknown returns s, or "unknown" if it is empty
+func orUnknown(s string) string {
+	if s == "" {
+		return "unknown"
+	}
+	return s
+}
+
+// AccountName returns the name reports show for the account of a source: its friendly
+// name in the settings, else the friendly name or IAM alias recorded at retrieval, or ""
+func (s *Settings) AccountName(p storage.Provenance) string {
+	if s != nil && p.AccountID != "" {
+		if name := s.AccountNames[p.AccountID]; name != "" {
+			return name
+		}
+	}
+	return p.AccountName
+}
+
+// AccountLabel returns an account as "Payments Prod (123456789012)", or only its ID
+// without a name
+func AccountLabel(name, id string) string {
+	if name == "" || id == "" {
+		return orUnknown(id + name)
+	}
+	return name + " (" + id + ")"
+}
+
+// compileSources validates the patterns of the source filter
+func compileSources(patterns []string) error {
+	for _, pattern := range patterns {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return fmt.Errorf("invalid source pattern %q: %w", pattern, err)
+		}
+	}
+	return nil
+}
+
+// SetSources sets the source filter, see IncludesSource
+func (s *Settings) SetSources(patterns []string) error {
+	if err := compileSources(patterns); err != nil {
+		return err
+	}
+	s.Sources = patterns
+	return nil
+}
+
+// IncludesSource reports whether a record passes the source filter of the settings:
+// whether its source key matches one of the patterns, e.g. 123456789012/*/* or
+// */eu-west-1/*
+func (s *Settings) IncludesSource(r *Record) bool {
+	if len(s.Sources) == 0 {
+		return true
+	}
+	key := SourceKey(r.Source())
+	for _, pattern := range s.Sources {
+		if ok, _ := path.Match(pattern, key); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// SourceCounts aggregates the records of one source
+type SourceCounts struct {
+	storage.Provenance
+	Requests          int64            `json:"requests"`
+	Blocked           int64            `json:"blocked"`
+	Attacks           int64            `json:"attacks"`           // Matching an attack category or from a scanner
+	AttacksNotBlocked int64            `json:"attacksNotBlocked"` // Attacks that were not blocked
+	Hosts             map[string]int64 `json:"hosts"`
+	TerminatingRules  map[string]int64 `json:"terminatingRules"`
+}
+
+// addSource folds a record into the statistics of its source
+func (s *Stats) addSource(r *Record, attackCategories []string, scanner string) {
+	if s.Sources == nil {
+		return // Per-host statistics
+	}
+	source := r.Source()
+	key := SourceKey(source)
+	c, ok := s.Sources[key]
+	if !ok {
+		c = &SourceCounts{Provenance: source, Hosts: make(map[string]int64), TerminatingRules: make(map[string]int64)}
+		s.Sources[key] = c
+	}
+	c.Requests++
+	blocked := r.Action == "BLOCK"
+	if blocked {
+		c.Blocked++
+	}
+	if len(attackCategories) > 0 || scanner != "" {
+		c.Attacks++
+		if !blocked {
+			c.AttacksNotBlocked++
+		}
+	}
+	c.Hosts[r.Host()]++
+	c.TerminatingRules[r.TerminatingRuleID]++
+}
+
+// merge folds the counts of the same source from another aggregate into c
+func (c *SourceCounts) merge(o *SourceCounts) {
+	if c.Profile == "" {
+		c.Profile = o.Profile
+	}
+	if c.Destination == "" {
+		c.Destination = o.Destination
+	}
+	if c.AccountName == "" {
+		c.AccountName = o.AccountName
+	}
+	c.Requests += o.Requests
+	c.Blocked += o.Blocked
+	c.Attacks += o.Attacks
+	c.AttacksNotBlocked += o.AttacksNotBlocked
+	mergeCounts(c.Hosts, o.Hosts)
+	mergeCounts(c.TerminatingRules, o.TerminatingRules)
+}
+
+// SourceReport is the report breakdown of one source
+type SourceReport struct {
+	Key     string `json:"key"`     // See SourceKey
+	Account string `json:"account"` // Account with its name, see AccountLabel
+	storage.Provenance
+	Requests          int64   `json:"requests"`
+	Blocked           int64   `json:"blocked"`
+	Attacks           int64   `json:"attacks"`
+	AttacksNotBlocked int64   `json:"attacksNotBlocked"`
+	TopHosts          []Count `json:"topHosts"`
+	TopRules          []Count `json:"topRules"`
+}
+
+// SourceBreakdown summarizes the records of each source, busiest first, naming their
+// accounts as the settings of the statistics do
+func SourceBreakdown(stats *Stats) []SourceReport {
+	breakdown := make([]SourceReport, 0, len(stats.Sources))
+	for key, c := range stats.Sources {
+		provenance := c.Provenance
+		provenance.AccountName = stats.settings.AccountName(provenance)
+		breakdown = append(breakdown, SourceReport{
+			Key:               key,
+			Account:           AccountLabel(provenance.AccountName, provenance.AccountID),
+			Provenance:        provenance,
+			Requests:          c.Requests,
+			Blocked:           c.Blocked,
+			Attacks:           c.Attacks,
+			AttacksNotBlocked: c.AttacksNotBlocked,
+			TopHosts:          TopN(c.Hosts, 5),
+			TopRules:          TopN(c.TerminatingRules, 5),
+		})
+	}
+	sort.Slice(breakdown, func(i, j int) bool {
+		if breakdown[i].Requests != breakdown[j].Requests {
+			return breakdown[i].Requests > breakdown[j].Requests
+		}
+		return breakdown[i].Key < breakdown[j].Key
+	})
+	return breakdown
+}
+
+// ResultAccount returns the account the records of the statistics came from, with its
+// name, or "" if they came from several accounts or none is known
+func ResultAccount(stats *Stats) string {
+	var account storage.Provenance
+	for _, c := range stats.Sources {
+		if c.AccountID == "" || account.AccountID != "" && c.AccountID != account.AccountID {
+			return ""
+		}
+		if account.AccountID == "" || account.AccountName == "" {
+			account = c.Provenance
+		}
+	}
+	if account.AccountID == "" {
+		return ""
+	}
+	return AccountLabel(stats.settings.AccountName(account), account.AccountID)
+}
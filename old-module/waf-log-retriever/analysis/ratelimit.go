@@ -0,0 +1,251 @@
+package analysis
+
+import (
+	"fmt"
+	"net"
+	"slices"
+	"sort"
+	"strings"
+	"time"
+)
+
+// RateLimitKeys are the request components a simulated rate limit can aggregate on
+var RateLimitKeys = []string{"ip", "forwarded-ip", "uri", "host"}
+
+// RateLimitModels are the ways a simulated rate limit can count requests
+var RateLimitModels = []string{"sliding-window", "token-bucket"}
+
+// rateLimitWindows are the evaluation windows AWS WAF rate-based rules support
+var rateLimitWindows = []time.Duration{time.Minute, 2 * time.Minute, 5 * time.Minute, 10 * time.Minute}
+
+// minRateLimit is the lowest limit of an AWS WAF rate-based rule
+const minRateLimit = 10
+
+// RateLimitOptions describe a proposed rate-based rule
+type RateLimitOptions struct {
+	Limit           int64         // Requests allowed per window and key
+	Window          time.Duration // Evaluation window
+	Keys            []string      // Components of the aggregation key, see RateLimitKeys
+	ForwardedHeader string        // Header holding the client IP for the forwarded-ip key
+	URIs            []string      // Only count requests to these URIs (see MatchURI); all if empty
+	Hosts           []string      // Only count requests to these hosts (see MatchHost); all if empty
+	Model           string        // See RateLimitModels
+}
+
+// Validate checks the options against what a rate-based rule supports
+func (o *RateLimitOptions) Validate() error {
+	if o.Limit < minRateLimit {
+		return fmt.Errorf("rate limit must be at least %d", minRateLimit)
+	}
+	if !slices.Contains(rateLimitWindows, o.Window) {
+		return fmt.Errorf("window must be 1m, 2m, 5m or 10m, not %s", o.Window)
+	}
+	if len(o.Keys) == 0 {
+		return fmt.Errorf("at least one aggregation key is required")
+	}
+	for _, key := range o.Keys {
+		if !slices.Contains(RateLimitKeys, key) {
+			return fmt.Errorf("unknown aggregation key %q (want %s)", key, strings.Join(RateLimitKeys, ", "))
+		}
+	}
+	if !slices.Contains(RateLimitModels, o.Model) {
+		return fmt.Errorf("unknown model %q (want %s)", o.Model, strings.Join(RateLimitModels, " or "))
+	}
+	return nil
+}
+
+// IsLegitimate reports whether a record looks like legitimate traffic: not blocked by
+// WAF, matching no attack category and from no known scanner
+func IsLegitimate(r *Record) bool {
+	return r.Action != "BLOCK" && !IsAttack(r) && IdentifyScanner(r) == ""
+}
+
+// RateLimitedClient is an aggregation key the proposed rule would have limited
+type RateLimitedClient struct {
+	Key               string    `json:"key"`
+	Requests          int64     `json:"requests"`
+	Legitimate        int64     `json:"legitimate"`
+	Limited           int64     `json:"limited"`
+	LegitimateLimited int64     `json:"legitimateLimited"` // Collateral damage
+	AlreadyBlocked    int64     `json:"alreadyBlocked"`    // Limited requests WAF blocked anyway
+	PeakRate          int64     `json:"peakRate"`          // Most requests in one window
+	FirstLimited      time.Time `json:"firstLimited"`
+	LastLimited       time.Time `json:"lastLimited"`
+}
+
+// rateLimitState is the state of one aggregation key
+type rateLimitState struct {
+	RateLimitedClient
+	window []int64 // Timestamps in the current window, oldest first
+	tokens float64
+	last   int64
+}
+
+// RateLimitSimulation replays records through a proposed rate-based rule
+type RateLimitSimulation struct {
+	opts      RateLimitOptions
+	windowMs  int64
+	requests  int64
+	evaluated int64
+	keys      map[string]*rateLimitState
+}
+
+// NewRateLimitSimulation starts a simulation of validated options
+func NewRateLimitSimulation(opts RateLimitOptions) *RateLimitSimulation {
+	return &RateLimitSimulation{
+		opts:     opts,
+		windowMs: opts.Window.Milliseconds(),
+		keys:     make(map[string]*rateLimitState),
+	}
+}
+
+// Add replays a record; records should arrive in time order, and earlier ones are
+// counted at the time of the latest
+func (s *RateLimitSimulation) Add(r *Record) {
+	s.requests++
+	key, ok := s.keyOf(r)
+	if !ok {
+		return
+	}
+	s.evaluated++
+	st, ok := s.keys[key]
+	if !ok {
+		st = &rateLimitState{RateLimitedClient: RateLimitedClient{Key: key}, tokens: float64(s.opts.Limit)}
+		s.keys[key] = st
+	}
+	ts := max(r.Timestamp, st.last)
+
+	// The window always counts every request, limited or not, as AWS WAF does
+	drop := 0
+	for drop < len(st.window) && st.window[drop] <= ts-s.windowMs {
+		drop++
+	}
+	st.window = append(st.window[drop:], ts)
+	rate := int64(len(st.window))
+	st.PeakRate = max(st.PeakRate, rate)
+
+	limited := false
+	switch s.opts.Model {
+	case "sliding-window":
+		limited = rate > s.opts.Limit
+	case "token-bucket":
+		if st.last > 0 {
+			st.tokens += float64(ts-st.last) * float64(s.opts.Limit) / float64(s.windowMs)
+			st.tokens = min(st.tokens, float64(s.opts.Limit))
+		}
+		if st.tokens >= 1 {
+			st.tokens--
+		} else {
+			limited = true
+		}
+	}
+	st.last = ts
+
+	legitimate := IsLegitimate(r)
+	st.Requests++
+	if legitimate {
+		st.Legitimate++
+	}
+	if !limited {
+		return
+	}
+	st.Limited++
+	if legitimate {
+		st.LegitimateLimited++
+	}
+	if r.Action == "BLOCK" {
+		st.AlreadyBlocked++
+	}
+	at := time.UnixMilli(ts).UTC()
+	if st.FirstLimited.IsZero() {
+		st.FirstLimited = at
+	}
+	st.LastLimited = at
+}
+
+// keyOf returns the aggregation key of a record, and false if the rule would not
+// count it: out of scope, or without a valid forwarded IP
+func (s *RateLimitSimulation) keyOf(r *Record) (string, bool) {
+	if len(s.opts.URIs) > 0 && !slices.ContainsFunc(s.opts.URIs, func(p string) bool { return MatchURI(p, r.HTTPRequest.URI) }) {
+		return "", false
+	}
+	if len(s.opts.Hosts) > 0 && !slices.ContainsFunc(s.opts.Hosts, func(p string) bool { return MatchHost(p, strings.ToLower(r.Host())) }) {
+		return "", false
+	}
+	parts := make([]string, 0, len(s.opts.Keys))
+	for _, key := range s.opts.Keys {
+		switch key {
+		case "ip":
+			parts = append(parts, r.HTTPRequest.ClientIP)
+		case "forwarded-ip":
+			// Like a rate-based rule with a NO_MATCH fallback, requests without a valid
+			// first address in the header are not counted
+			first, _, _ := strings.Cut(r.HeaderValue(s.opts.ForwardedHeader), ",")
+			ip := net.ParseIP(strings.TrimSpace(first))
+			if ip == nil {
+				return "", false
+			}
+			parts = append(parts, ip.String())
+		case "uri":
+			parts = append(parts, r.HTTPRequest.URI)
+		case "host":
+			parts = append(parts, r.Host())
+		}
+	}
+	return strings.Join(parts, " "), true
+}
+
+// RateLimitReport is the outcome of a rate limit simulation
+type RateLimitReport struct {
+	Limit             int64               `json:"limit"`
+	WindowSeconds     int64               `json:"windowSeconds"`
+	Keys              []string            `json:"keys"`
+	Model             string              `json:"model"`
+	Requests          int64               `json:"requests"`  // Replayed
+	Evaluated         int64               `json:"evaluated"` // In scope and with a key
+	Legitimate        int64               `json:"legitimate"`
+	Limited           int64               `json:"limited"`
+	LegitimateLimited int64               `json:"legitimateLimited"`
+	AlreadyBlocked    int64               `json:"alreadyBlocked"`
+	CollateralShare   float64             `json:"collateralShare"` // Percentage of legitimate requests limited
+	LimitedKeys       int                 `json:"limitedKeys"`
+	Clients           []RateLimitedClient `json:"clients"` // Limited keys, most limited first
+}
+
+// Report returns the outcome so far, listing up to top limited keys (all if top is
+// not positive)
+func (s *RateLimitSimulation) Report(top int) *RateLimitReport {
+	report := &RateLimitReport{
+		Limit:         s.opts.Limit,
+		WindowSeconds: int64(s.opts.Window.Seconds()),
+		Keys:          s.opts.Keys,
+		Model:         s.opts.Model,
+		Requests:      s.requests,
+		Evaluated:     s.evaluated,
+		Clients:       []RateLimitedClient{},
+	}
+	for _, st := range s.keys {
+		report.Legitimate += st.Legitimate
+		if st.Limited == 0 {
+			continue
+		}
+		report.Limited += st.Limited
+		report.LegitimateLimited += st.LegitimateLimited
+		report.AlreadyBlocked += st.AlreadyBlocked
+		report.Clients = append(report.Clients, st.RateLimitedClient)
+	}
+	if report.Legitimate > 0 {
+		report.CollateralShare = 100 * float64(report.LegitimateLimited) / float64(report.Legitimate)
+	}
+	report.LimitedKeys = len(report.Clients)
+	sort.Slice(report.Clients, func(i, j int) bool {
+		if report.Clients[i].Limited != report.Clients[j].Limited {
+			return report.Clients[i].Limited > report.Clients[j].Limited
+		}
+		return report.Clients[i].Key < report.Clients[j].Key
+	})
+	if top > 0 && len(report.Clients) > top {
+		report.Clients = report.Clients[:top]
+	}
+	return report
+}
@@ -0,0 +1,158 @@
+package analysis
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"waf-log-retriever/storage"
+)
+
+// Reconciliation stages, in the order records pass through them
+const (
+	StageDownloaded = "downloaded" // Records in the log files when they were retrieved, from the manifest
+	StageParsed     = "parsed"     // Records decoded from the log files
+	StageAnalyzed   = "analyzed"   // Records aggregated, plus those filtered or suppressed
+	StageExported   = "exported"   // Records in the action breakdown reports and exports are built from
+)
+
+// maxReconciledFiles caps the log files listed with mismatching counts
+const maxReconciledFiles = 50
+
+// StageCount is the number of records at one stage of a review
+type StageCount struct {
+	Stage   string `json:"stage"`
+	Records int64  `json:"records"`
+	Files   int    `json:"files,omitempty"` // Log files the count covers, for the downloaded and parsed stages
+}
+
+// FileCount is a log file whose parsed record count differs from its downloaded one
+type FileCount struct {
+	Path       string `json:"path"` // Relative to the Web ACL's directory
+	Downloaded int64  `json:"downloaded"`
+	Parsed     int64  `json:"parsed"`
+}
+
+// Reconciliation follows the record counts of an analysis from download to export,
+// so deliverables can state how complete their data is
+type Reconciliation struct {
+	Stages     []StageCount `json:"stages"`
+	Filtered   int64        `json:"filtered"`   // Parsed records left out by the host or source filter
+	Suppressed int64        `json:"suppressed"` // Parsed records left out by suppressions
+	Unrecorded int          `json:"unrecorded"` // Parsed log files with records the manifest has no count of, e.g. retrieved by older versions
+	Uncounted  int          `json:"uncounted"`  // Log files aggregated without a count each, by older versions in migrated partials
+	NotParsed  []string     `json:"notParsed"`  // Downloaded log files missing from the analysis, capped
+	Mismatched []FileCount  `json:"mismatched"` // Log files parsed to another count than downloaded, capped
+	Alerts     []string     `json:"alerts"`     // Counts that do not match; empty if the data is complete
+}
+
+// Complete reports whether every count matched
+func (r *Reconciliation) Complete() bool {
+	return len(r.Alerts) == 0
+}
+
+// Reconcile compares the record counts the manifest of a Web ACL's directory recorded
+// at download with those parsed, analyzed and exported by an aggregate
+func Reconcile(aclDir string, stats *Stats) (*Reconciliation, error) {
+	manifest, _, err := storage.LoadManifest(aclDir)
+	if err != nil {
+		return nil, err
+	}
+	r := &Reconciliation{Filtered: stats.Filtered, NotParsed: []string{}, Mismatched: []FileCount{}, Alerts: []string{}}
+	for _, n := range stats.Suppressed {
+		r.Suppressed += n
+	}
+	uncounted := make(map[string]bool, len(stats.UncountedFiles))
+	for _, path := range stats.UncountedFiles {
+		uncounted[path] = true
+	}
+	r.Uncounted = len(uncounted)
+
+	downloaded := StageCount{Stage: StageDownloaded}
+	parsed := StageCount{Stage: StageParsed}
+	var notParsed, mismatched int
+	var mismatchedDownloaded, mismatchedParsed int64
+	for path, entry := range manifest {
+		if entry.Records == nil || !IsLogFile(path) {
+			continue
+		}
+		downloaded.Records += *entry.Records
+		downloaded.Files++
+		n, ok := stats.FileRecords[path]
+		if !ok && uncounted[path] {
+			continue
+		}
+		if !ok {
+			notParsed++
+			r.NotParsed = append(r.NotParsed, path)
+			continue
+		}
+		if n != *entry.Records {
+			mismatched++
+			mismatchedDownloaded += *entry.Records
+			mismatchedParsed += n
+			r.Mismatched = append(r.Mismatched, FileCount{Path: path, Downloaded: *entry.Records, Parsed: n})
+		}
+	}
+	for path, n := range stats.FileRecords {
+		entry, ok := manifest[path]
+		if n == 0 && !ok {
+			continue // Not a log file after all, e.g. the workspace
+		}
+		parsed.Records += n
+		parsed.Files++
+		if !ok || entry.Records == nil {
+			r.Unrecorded++
+		}
+	}
+	parsed.Records += stats.UncountedRecords
+	parsed.Files += r.Uncounted
+	analyzed := StageCount{Stage: StageAnalyzed, Records: stats.TotalRequests}
+	exported := StageCount{Stage: StageExported}
+	for _, n := range stats.Actions {
+		exported.Records += n
+	}
+	r.Stages = []StageCount{downloaded, parsed, analyzed, exported}
+
+	sort.Strings(r.NotParsed)
+	if len(r.NotParsed) > maxReconciledFiles {
+		r.NotParsed = r.NotParsed[:maxReconciledFiles]
+	}
+	sort.Slice(r.Mismatched, func(i, j int) bool { return r.Mismatched[i].Path < r.Mismatched[j].Path })
+	if len(r.Mismatched) > maxReconciledFiles {
+		r.Mismatched = r.Mismatched[:maxReconciledFiles]
+	}
+
+	if notParsed > 0 {
+		r.Alerts = append(r.Alerts, fmt.Sprintf("%d downloaded log files were not analyzed", notParsed))
+	}
+	if mismatched > 0 {
+		r.Alerts = append(r.Alerts, fmt.Sprintf("%d log files parsed to %d records, but held %d when downloaded",
+			mismatched, mismatchedParsed, mismatchedDownloaded))
+	}
+	if accounted := analyzed.Records + r.Filtered + r.Suppressed; accounted != parsed.Records {
+		r.Alerts = append(r.Alerts, fmt.Sprintf("%d records were parsed, but %d were analyzed, filtered or suppressed",
+			parsed.Records, accounted))
+	}
+	if exported.Records != analyzed.Records {
+		r.Alerts = append(r.Alerts, fmt.Sprintf("%d records were analyzed, but the action breakdown holds %d",
+			analyzed.Records, exported.Records))
+	}
+	return r, nil
+}
+
+// ReconciliationFindings reports record counts that do not reconcile, since the
+// statistics of an incomplete analysis understate what reached the Web ACL
+func ReconciliationFindings(webACLName string, r *Reconciliation) []Finding {
+	if r == nil || r.Complete() {
+		return nil
+	}
+	return []Finding{{
+		ID:       "record-count-mismatch",
+		Severity: SeverityMedium,
+		Title:    fmt.Sprintf("Record counts do not reconcile (%d alerts)", len(r.Alerts)),
+		Description: fmt.Sprintf("The record counts of Web ACL %s differ between stages: %s. Run manifest verify and retrieve the affected logs again before stating the completeness of the data.",
+			webACLName, strings.Join(r.Alerts, "; ")),
+		Source: "reconciliation",
+	}}
+}
@@ -0,0 +1,241 @@
+// Package analysis provides offline aggregation of retrieved WAF logs
+package analysis
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"waf-log-retriever/storage"
+)
+
+// Record is a single AWS WAF log entry
+type Record struct {
+	Timestamp                   int64           `json:"timestamp"`
+	FormatVersion               int             `json:"formatVersion"`
+	WebACLID                    string          `json:"webaclId"`
+	TerminatingRuleID           string          `json:"terminatingRuleId"`
+	TerminatingRuleType         string          `json:"terminatingRuleType"`
+	Action                      string          `json:"action"`
+	HTTPSourceName              string          `json:"httpSourceName"`
+	HTTPSourceID                string          `json:"httpSourceId"`
+	RuleGroupList               []RuleGroup     `json:"ruleGroupList"`
+	RateBasedRuleList           []RateBasedRule `json:"rateBasedRuleList"`
+	NonTerminatingMatchingRules []MatchingRule  `json:"nonTerminatingMatchingRules"`
+	ResponseCodeSent            *int            `json:"responseCodeSent"`
+	HTTPRequest                 HTTPRequest     `json:"httpRequest"`
+	Labels                      []Label         `json:"labels"`
+	JA3Fingerprint              string          `json:"ja3Fingerprint"`
+	JA4Fingerprint              string          `json:"ja4Fingerprint"`
+	latencyFields
+	bodyFields
+
+	provenance *storage.Provenance // Of the log file's Web ACL directory, see Source
+}
+
+// HTTPRequest is the request section of a WAF log entry
+type HTTPRequest struct {
+	ClientIP    string   `json:"clientIp"`
+	Country     string   `json:"country"`
+	Headers     []Header `json:"headers"`
+	URI         string   `json:"uri"`
+	Args        string   `json:"args"`
+	HTTPVersion string   `json:"httpVersion"`
+	HTTPMethod  string   `json:"httpMethod"`
+	RequestID   string   `json:"requestId"`
+	Host        string   `json:"host"`
+}
+
+// Header is a single request header
+type Header struct {
+	Name  string `json:"name"`
+	Value string `json:"value"`
+}
+
+// RuleGroup is an entry of ruleGroupList
+type RuleGroup struct {
+	RuleGroupID                 string         `json:"ruleGroupId"`
+	TerminatingRule             *MatchingRule  `json:"terminatingRule"`
+	NonTerminatingMatchingRules []MatchingRule `json:"nonTerminatingMatchingRules"`
+	ExcludedRules               []MatchingRule `json:"excludedRules"`
+}
+
+// MatchingRule is a rule reference inside a log entry
+type MatchingRule struct {
+	RuleID           string `json:"ruleId"`
+	Action           string `json:"action"`
+	OverriddenAction string `json:"overriddenAction"` // Rule's own action when the Web ACL overrides it
+}
+
+// RateBasedRule is an entry of rateBasedRuleList
+type RateBasedRule struct {
+	RateBasedRuleID   string `json:"rateBasedRuleId"`
+	RateBasedRuleName string `json:"rateBasedRuleName"`
+	LimitKey          string `json:"limitKey"`
+	MaxRateAllowed    int64  `json:"maxRateAllowed"`
+}
+
+// Label is a label attached to the request by a rule
+type Label struct {
+	Name string `json:"name"`
+}
+
+// Time returns the record timestamp in UTC
+func (r *Record) Time() time.Time {
+	return time.UnixMilli(r.Timestamp).UTC()
+}
+
+// HeaderValue returns the first value of a header (case-insensitive), or "" if absent
+func (r *Record) HeaderValue(name string) string {
+	for _, h := range r.HTTPRequest.Headers {
+		if strings.EqualFold(h.Name, name) {
+			return h.Value
+		}
+	}
+	return ""
+}
+
+// cloudWatchEnvelope covers the wrappers CloudWatch Logs puts around a WAF record:
+// Insights query results use "@message", exported log events use "message".
+type cloudWatchEnvelope struct {
+	AtMessage string `json:"@message"`
+	Message   string `json:"message"`
+}
+
+// ForEachRecord streams every WAF record in a log file to fn.
+// It handles S3 deliveries (newline-delimited, usually gzipped) as well as
+// CloudWatch Logs output where each record is wrapped in a message envelope.
+func ForEachRecord(path string, fn func(*Record) error) error {
+	return ForEachRawRecord(path, func(r *Record, raw []byte) error {
+		return fn(r)
+	})
+}
+
+// ForEachRawRecord streams every WAF record in a log file to fn together with its
+// raw JSON, unwrapped from any CloudWatch envelope
+func ForEachRawRecord(path string, fn func(r *Record, raw []byte) error) error {
+	return forEachRecord(path, nil, fn)
+}
+
+// forEachRecord streams the WAF records of a log file to fn, leaving out records
+// for which skip, if set, returns true on the undecoded JSON
+func forEachRecord(path string, skip func(raw []byte) bool, fn func(r *Record, raw []byte) error) error {
+	provenance := provenanceOf(path)
+	return forEachJSON(path, func(raw json.RawMessage) error {
+		if skip != nil && skip(raw) {
+			return nil
+		}
+		record, payload, err := decodeRecord(raw)
+		if err != nil {
+			return fmt.Errorf("failed to decode record in %s: %w", path, err)
+		}
+		if record == nil {
+			return nil
+		}
+		record.provenance = provenance
+		return fn(record, payload)
+	})
+}
+
+// forEachJSON streams the undecoded JSON values of a log file to fn
+func forEachJSON(path string, fn func(raw json.RawMessage) error) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return fmt.Errorf("failed to open log file: %w", err)
+	}
+	defer file.Close()
+
+	var reader io.Reader = bufio.NewReader(file)
+	if filepath.Ext(path) == ".gz" {
+		gr, err := newGzipReader(reader)
+		if err != nil {
+			return fmt.Errorf("file %s has a .gz extension but is not a valid gzip file: %w", path, err)
+		}
+		defer gr.Close()
+		reader = gr
+	}
+
+	decoder := json.NewDecoder(reader)
+	for {
+		var raw json.RawMessage
+		if err := decoder.Decode(&raw); err != nil {
+			if errors.Is(err, io.EOF) {
+				return nil
+			}
+			return fmt.Errorf("failed to decode %s: %w", path, err)
+		}
+		if err := fn(raw); err != nil {
+			return err
+		}
+	}
+}
+
+// decodeRecord unwraps an optional CloudWatch envelope and decodes the WAF record,
+// also returning its JSON
+func decodeRecord(raw json.RawMessage) (*Record, []byte, error) {
+	var envelope cloudWatchEnvelope
+	if err := json.Unmarshal(raw, &envelope); err != nil {
+		return nil, nil, err
+	}
+
+	payload := []byte(raw)
+	if envelope.AtMessage != "" {
+		payload = []byte(envelope.AtMessage)
+	} else if envelope.Message != "" {
+		payload = []byte(envelope.Message)
+	}
+
+	var record Record
+	if err := json.Unmarshal(payload, &record); err != nil {
+		return nil, nil, err
+	}
+	if record.Timestamp == 0 && record.Action == "" {
+		return nil, nil, nil // Not a WAF record (e.g. an empty CloudWatch result row)
+	}
+	return &record, payload, nil
+}
+
+// IsLogFile reports whether a path looks like a retrieved WAF log file
+func IsLogFile(path string) bool {
+	name := filepath.Base(path)
+	if strings.HasPrefix(name, ".") {
+		return false
+	}
+	name = strings.TrimSuffix(name, ".gz")
+	switch filepath.Ext(name) {
+	case ".log", ".json", ".jsonl":
+		return true
+	}
+	return false
+}
+
+// ListLogFiles walks a directory and returns all WAF log files below it, skipping
+// the analysis output and snapshot directories.
+func ListLogFiles(dir string) ([]string, error) {
+	var files []string
+	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() {
+			if path != dir && (info.Name() == OutputDirName || info.Name() == SnapshotDirName) {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if IsLogFile(path) {
+			files = append(files, path)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to list log files: %w", err)
+	}
+	return files, nil
+}
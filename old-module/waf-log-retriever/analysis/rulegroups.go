@@ -0,0 +1,61 @@
+package analysis
+
+// SubRuleCounts counts how often a rule inside a rule group matched, by how the
+// match was handled
+type SubRuleCounts struct {
+	Terminating int64 `json:"terminating"` // Matched and decided the request
+	Count       int64 `json:"count"`       // Matched with the rule's own COUNT action
+	Overridden  int64 `json:"overridden"`  // Matched with its action overridden to COUNT by the Web ACL
+	Excluded    int64 `json:"excluded"`    // Matched while listed in the legacy excludedRules
+	Allowed     int64 `json:"allowed"`     // Matched on requests the Web ACL ultimately allowed
+}
+
+// addRuleGroups folds the rule group and non-terminating matches of a record into the aggregate
+func (s *Stats) addRuleGroups(r *Record) {
+	for _, rule := range r.NonTerminatingMatchingRules {
+		s.NonTerminatingRules[rule.RuleID]++
+	}
+
+	for _, group := range r.RuleGroupList {
+		if group.TerminatingRule == nil && len(group.NonTerminatingMatchingRules) == 0 && len(group.ExcludedRules) == 0 {
+			continue // Evaluated without any match
+		}
+		rules, ok := s.RuleGroups[group.RuleGroupID]
+		if !ok {
+			rules = make(map[string]*SubRuleCounts)
+			s.RuleGroups[group.RuleGroupID] = rules
+		}
+		matched := make(map[string]bool)
+		if group.TerminatingRule != nil {
+			subRuleCounts(rules, group.TerminatingRule.RuleID).Terminating++
+			matched[group.TerminatingRule.RuleID] = true
+		}
+		for _, rule := range group.NonTerminatingMatchingRules {
+			if rule.OverriddenAction != "" {
+				subRuleCounts(rules, rule.RuleID).Overridden++
+			} else {
+				subRuleCounts(rules, rule.RuleID).Count++
+			}
+			matched[rule.RuleID] = true
+		}
+		for _, rule := range group.ExcludedRules {
+			subRuleCounts(rules, rule.RuleID).Excluded++
+			matched[rule.RuleID] = true
+		}
+		if r.Action == "ALLOW" {
+			for ruleID := range matched {
+				rules[ruleID].Allowed++
+			}
+		}
+	}
+}
+
+// subRuleCounts returns the counts of a rule, creating them if needed
+func subRuleCounts(rules map[string]*SubRuleCounts, ruleID string) *SubRuleCounts {
+	counts, ok := rules[ruleID]
+	if !ok {
+		counts = &SubRuleCounts{}
+		rules[ruleID] = counts
+	}
+	return counts
+}
@@ -0,0 +1,324 @@
+package analysis
+
+import (
+	"encoding/json"
+	"regexp"
+	"slices"
+	"sort"
+	"strings"
+	"time"
+)
+
+// maxSampledFindings caps the findings sample requests are picked for, most severe first
+const maxSampledFindings = 10
+
+// maxCaseStudies caps the terminating rules sample requests are picked for, busiest first
+const maxCaseStudies = 5
+
+// Evidence selects the requests a finding is about, to pick sample requests from.
+// A request must meet every set criterion.
+type Evidence struct {
+	Client      string     `json:"client,omitempty"`      // Client identity, see ClientIdentitySettings
+	Rule        string     `json:"rule,omitempty"`        // Rule ID, rule group ID or label the request matched
+	Terminating string     `json:"terminating,omitempty"` // Terminating rule ID
+	Endpoint    string     `json:"endpoint,omitempty"`    // Endpoint template, see EndpointTemplate
+	Scanner     string     `json:"scanner,omitempty"`     // Scanner name, see IdentifyScanner
+	Fingerprint string     `json:"fingerprint,omitempty"` // "ja3:<fingerprint>" or "ja4:<fingerprint>"
+	Login       bool       `json:"login,omitempty"`       // Only login attempts, see AuthSettings
+	NotBlocked  bool       `json:"notBlocked,omitempty"`  // Only requests that were not blocked
+	From        *time.Time `json:"from,omitempty"`
+	To          *time.Time `json:"to,omitempty"`
+}
+
+// matches reports whether a record of client meets the evidence criteria
+func (e *Evidence) matches(r *Record, client string, settings *Settings) bool {
+	if e.From != nil && r.Time().Before(*e.From) || e.To != nil && r.Time().After(*e.To) {
+		return false
+	}
+	if e.Client != "" && client != e.Client {
+		return false
+	}
+	if e.NotBlocked && r.Action == "BLOCK" {
+		return false
+	}
+	if e.Endpoint != "" && EndpointTemplate(r.HTTPRequest.URI) != e.Endpoint {
+		return false
+	}
+	if e.Fingerprint != "" && e.Fingerprint != fingerprintKey("ja4", r.JA4Fingerprint) && e.Fingerprint != fingerprintKey("ja3", r.JA3Fingerprint) {
+		return false
+	}
+	if e.Login && !settings.Auth.isLoginAttempt(r) {
+		return false
+	}
+	if e.Terminating != "" && r.TerminatingRuleID != e.Terminating {
+		return false
+	}
+	if e.Rule != "" && !slices.Contains(RecordRules(r), e.Rule) {
+		return false
+	}
+	return e.Scanner == "" || IdentifyScanner(r) == e.Scanner
+}
+
+// SampleRequest is a request picked as evidence, redacted of personal data: query
+// parameters with sensitive names, e-mail addresses, JSON web tokens and card
+// numbers are masked, and only the User-Agent of the headers is kept
+type SampleRequest struct {
+	Time          time.Time `json:"time"`
+	Client        string    `json:"client"`
+	Country       string    `json:"country"`
+	Method        string    `json:"method"`
+	Host          string    `json:"host"`
+	URI           string    `json:"uri"`
+	Args          string    `json:"args,omitempty"`
+	UserAgent     string    `json:"userAgent,omitempty"`
+	Action        string    `json:"action"`
+	Rule          string    `json:"rule"`                    // Terminating rule
+	MatchLocation string    `json:"matchLocation,omitempty"` // Where the terminating rule matched, e.g. QUERY_STRING
+	MatchedData   []string  `json:"matchedData,omitempty"`   // Payload the terminating rule matched
+	Labels        []string  `json:"labels,omitempty"`
+	RequestID     string    `json:"requestId"`
+}
+
+// CaseStudy holds sample requests of one of the busiest terminating rules
+type CaseStudy struct {
+	Rule     string          `json:"rule"`
+	Requests int64           `json:"requests"`
+	Samples  []SampleRequest `json:"samples"`
+}
+
+// matchDetails is the part of a WAF record that holds the matched payload
+type matchDetails struct {
+	TerminatingRuleMatchDetails []struct {
+		ConditionType string   `json:"conditionType"`
+		Location      string   `json:"location"`
+		MatchedData   []string `json:"matchedData"`
+	} `json:"terminatingRuleMatchDetails"`
+}
+
+// hasPayload reports whether a sample shows what the request carried
+func (s *SampleRequest) hasPayload() bool {
+	return len(s.MatchedData) > 0 || s.Args != ""
+}
+
+// sampler picks up to max sample requests, preferring ones from different sources
+// and ones with a payload
+type sampler struct {
+	evidence *Evidence
+	max      int
+	samples  []SampleRequest
+	sources  map[string]bool
+}
+
+// offer considers a record as a sample. Records from a source already sampled are
+// skipped; once the sampler is full, a record with a payload, i.e. matched data
+// or query arguments, replaces a sample without one.
+func (s *sampler) offer(r *Record, raw []byte, client string) {
+	// A finding about one client gets its samples from different endpoints instead
+	source := client
+	if s.evidence != nil && s.evidence.Client != "" {
+		source = EndpointTemplate(r.HTTPRequest.URI)
+	}
+	if s.sources[source] {
+		return
+	}
+	replace := -1
+	if len(s.samples) == s.max {
+		replace = slices.IndexFunc(s.samples, func(sample SampleRequest) bool { return !sample.hasPayload() })
+		if replace < 0 {
+			return
+		}
+	}
+	sample := newSampleRequest(r, raw, client)
+	if replace >= 0 {
+		if !sample.hasPayload() {
+			return
+		}
+		s.samples[replace] = sample
+	} else {
+		s.samples = append(s.samples, sample)
+	}
+	s.sources[source] = true
+}
+
+// newSampleRequest returns the redacted sample of a record
+func newSampleRequest(r *Record, raw []byte, client string) SampleRequest {
+	sample := SampleRequest{
+		Time:      r.Time(),
+		Client:    redactText(client),
+		Country:   r.HTTPRequest.Country,
+		Method:    r.HTTPRequest.HTTPMethod,
+		Host:      r.Host(),
+		URI:       redactText(r.HTTPRequest.URI),
+		Args:      RedactArgs(r.HTTPRequest.Args),
+		UserAgent: redactText(r.HeaderValue("User-Agent")),
+		Action:    r.Action,
+		Rule:      r.TerminatingRuleID,
+		RequestID: r.HTTPRequest.RequestID,
+	}
+	var details matchDetails
+	if json.Unmarshal(raw, &details) == nil {
+		for _, d := range details.TerminatingRuleMatchDetails {
+			if sample.MatchLocation == "" {
+				sample.MatchLocation = d.Location
+			}
+			for _, data := range d.MatchedData {
+				sample.MatchedData = append(sample.MatchedData, redactText(data))
+			}
+		}
+	}
+	for _, l := range r.Labels {
+		sample.Labels = append(sample.Labels, l.Name)
+	}
+	return sample
+}
+
+// sensitiveParams are substrings of query parameter names whose values are masked
+var sensitiveParams = []string{"pass", "pwd", "token", "secret", "key", "auth", "session", "sid", "mail", "phone", "ssn", "card", "otp", "code"}
+
+// personalData matches e-mail addresses, JSON web tokens and card numbers
+var personalData = []struct {
+	pattern *regexp.Regexp
+	mask    string
+}{
+	{regexp.MustCompile(`[A-Za-z0-9._%+-]+(@|%40)[A-Za-z0-9.-]+\.[A-Za-z]{2,}`), "[email]"},
+	{regexp.MustCompile(`eyJ[A-Za-z0-9_-]+\.[A-Za-z0-9_-]+\.[A-Za-z0-9_-]*`), "[token]"},
+	{regexp.MustCompile(`\b\d(?:[ -]?\d){12,18}\b`), "[card]"},
+}
+
+// redactText masks the e-mail addresses, JSON web tokens and card numbers in s
+func redactText(s string) string {
+	for _, p := range personalData {
+		s = p.pattern.ReplaceAllString(s, p.mask)
+	}
+	return s
+}
+
+// RedactArgs masks the values of query parameters with sensitive names, and the
+// personal data in the others
+func RedactArgs(args string) string {
+	if args == "" {
+		return ""
+	}
+	params := strings.Split(args, "&")
+	for i, param := range params {
+		name, value, ok := strings.Cut(param, "=")
+		if !ok {
+			params[i] = redactText(param)
+			continue
+		}
+		lower := strings.ToLower(name)
+		if slices.ContainsFunc(sensitiveParams, func(s string) bool { return strings.Contains(lower, s) }) {
+			params[i] = name + "=[redacted]"
+		} else {
+			params[i] = name + "=" + redactText(value)
+		}
+	}
+	return strings.Join(params, "&")
+}
+
+// CollectEvidence reads the log files once more for the findings that carry
+// evidence. With an asset map, it tags each one with the assets its requests went
+// to; with scoring enabled, it rescores each one from the requests it is about;
+// with perTarget above zero, it picks up to that many sample requests
+// for the most severe of them and for the busiest terminating rules, which become
+// the result's case studies. Records the analysis left out, by host or source filter
+// or suppression, are never counted or picked.
+func CollectEvidence(files []string, result *Result, settings *Settings, perTarget int) error {
+	scoring := settings.ScoringEnabled()
+	tally := scoring || len(settings.Assets) > 0
+	var findings []int
+	for i := range result.Findings {
+		if result.Findings[i].Evidence != nil {
+			findings = append(findings, i)
+		}
+	}
+	if !tally && len(findings) > maxSampledFindings {
+		// Without rescoring the most severe findings are known before the pass
+		sortBySeverity(result.Findings, findings)
+		findings = findings[:maxSampledFindings]
+	}
+	tallies := make([]scoreTally, len(findings))
+	samplers := make([]*sampler, 0, len(findings)+maxCaseStudies)
+	for _, i := range findings {
+		samplers = append(samplers, &sampler{evidence: result.Findings[i].Evidence, max: perTarget, sources: make(map[string]bool)})
+	}
+
+	var rules []Count
+	if result.Stats != nil && perTarget > 0 {
+		for _, c := range TopN(result.Stats.TerminatingRules, 0) {
+			if c.Key != "Default_Action" && c.Key != "" {
+				rules = append(rules, c)
+			}
+			if len(rules) == maxCaseStudies {
+				break
+			}
+		}
+	}
+	for _, c := range rules {
+		samplers = append(samplers, &sampler{evidence: &Evidence{Terminating: c.Key}, max: perTarget, sources: make(map[string]bool)})
+	}
+	if len(samplers) == 0 {
+		return nil
+	}
+
+	for _, file := range files {
+		err := ForEachRawRecord(file, func(r *Record, raw []byte) error {
+			if !settings.IncludesHost(r.Host()) || !settings.IncludesSource(r) || settings.Suppress(r) != "" {
+				return nil
+			}
+			client := settings.ClientID(r)
+			for n, s := range samplers {
+				if !s.evidence.matches(r, client, settings) {
+					continue
+				}
+				if tally && n < len(findings) {
+					tallies[n].add(r, settings)
+				}
+				if perTarget > 0 {
+					s.offer(r, raw, client)
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	for n, i := range findings {
+		tallies[n].tagAssets(&result.Findings[i], settings)
+		if scoring {
+			tallies[n].score(&result.Findings[i], &settings.Scoring)
+		}
+	}
+	countAssetFindings(result.Assets, result.Findings)
+	if perTarget == 0 {
+		return nil
+	}
+	sampled := slices.Clone(findings)
+	sortBySeverity(result.Findings, sampled)
+	if len(sampled) > maxSampledFindings {
+		sampled = sampled[:maxSampledFindings]
+	}
+	for n, i := range findings {
+		if slices.Contains(sampled, i) {
+			result.Findings[i].Samples = samplers[n].samples
+		}
+	}
+	result.CaseStudies = []CaseStudy{}
+	for n, c := range rules {
+		samples := samplers[len(findings)+n].samples
+		if samples == nil {
+			samples = []SampleRequest{}
+		}
+		result.CaseStudies = append(result.CaseStudies, CaseStudy{Rule: c.Key, Requests: c.Count, Samples: samples})
+	}
+	return nil
+}
+
+// sortBySeverity orders indices of findings by severity, most severe first
+func sortBySeverity(findings []Finding, indices []int) {
+	sort.SliceStable(indices, func(i, j int) bool {
+		return SeverityRank(findings[indices[i]].Severity) > SeverityRank(findings[indices[j]].Severity)
+	})
+}
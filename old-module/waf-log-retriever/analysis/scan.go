@@ -0,0 +1,259 @@
+package analysis
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strconv"
+)
+
+// HotFields are the fields of a WAF record the common aggregations and search
+// conditions use, scanned from its raw JSON without decoding it. The slices point
+// into the raw record, so they are only valid while it is.
+type HotFields struct {
+	Timestamp         int64
+	Action            []byte
+	TerminatingRuleID []byte
+	ClientIP          []byte
+	Country           []byte
+	URI               []byte
+	RequestID         []byte
+}
+
+// Reset clears the fields for the next record
+func (f *HotFields) Reset() {
+	*f = HotFields{}
+}
+
+// fromRecord fills the fields from a decoded record, for records that cannot be scanned
+func (f *HotFields) fromRecord(r *Record) {
+	*f = HotFields{
+		Timestamp:         r.Timestamp,
+		Action:            []byte(r.Action),
+		TerminatingRuleID: []byte(r.TerminatingRuleID),
+		ClientIP:          []byte(r.HTTPRequest.ClientIP),
+		Country:           []byte(r.HTTPRequest.Country),
+		URI:               []byte(r.HTTPRequest.URI),
+		RequestID:         []byte(r.HTTPRequest.RequestID),
+	}
+}
+
+// isRecord reports whether the fields are those of a WAF record, as decodeRecord
+// decides it
+func (f *HotFields) isRecord() bool {
+	return f.Timestamp != 0 || len(f.Action) > 0
+}
+
+// ScanHotFields fills f from the raw JSON of a record, skipping over every other
+// value without decoding or allocating. It reports false when the record has to be
+// decoded instead: a CloudWatch envelope, a hot field with escape sequences, or
+// JSON it cannot follow.
+func ScanHotFields(raw []byte, f *HotFields) bool {
+	f.Reset()
+	s := jsonScanner{data: raw}
+	return s.object(func(key []byte) bool {
+		switch string(key) {
+		case "timestamp":
+			return s.int64(&f.Timestamp)
+		case "action":
+			return s.string(&f.Action)
+		case "terminatingRuleId":
+			return s.string(&f.TerminatingRuleID)
+		case "httpRequest":
+			return s.object(func(key []byte) bool {
+				switch string(key) {
+				case "clientIp":
+					return s.string(&f.ClientIP)
+				case "country":
+					return s.string(&f.Country)
+				case "uri":
+					return s.string(&f.URI)
+				case "requestId":
+					return s.string(&f.RequestID)
+				}
+				return s.skip()
+			})
+		case "@message", "message":
+			return false // CloudWatch envelope, whose record is an escaped string
+		}
+		return s.skip()
+	}) && s.end()
+}
+
+// jsonScanner walks JSON just far enough to find values, trusting it to be valid
+// where that does not matter for the values taken
+type jsonScanner struct {
+	data []byte
+	pos  int
+}
+
+// space skips whitespace
+func (s *jsonScanner) space() {
+	for s.pos < len(s.data) {
+		switch s.data[s.pos] {
+		case ' ', '\t', '\n', '\r':
+			s.pos++
+		default:
+			return
+		}
+	}
+}
+
+// consume skips whitespace and the byte c, reporting whether it was there
+func (s *jsonScanner) consume(c byte) bool {
+	s.space()
+	if s.pos < len(s.data) && s.data[s.pos] == c {
+		s.pos++
+		return true
+	}
+	return false
+}
+
+// end reports whether only whitespace is left
+func (s *jsonScanner) end() bool {
+	s.space()
+	return s.pos == len(s.data)
+}
+
+// object walks an object, calling member with each key to scan or skip its value
+func (s *jsonScanner) object(member func(key []byte) bool) bool {
+	if !s.consume('{') {
+		return false
+	}
+	if s.consume('}') {
+		return true
+	}
+	for {
+		var key []byte
+		if !s.string(&key) || !s.consume(':') || !member(key) {
+			return false
+		}
+		if s.consume('}') {
+			return true
+		}
+		if !s.consume(',') {
+			return false
+		}
+	}
+}
+
+// string scans a string without escape sequences into v
+func (s *jsonScanner) string(v *[]byte) bool {
+	if !s.consume('"') {
+		return false
+	}
+	end := bytes.IndexByte(s.data[s.pos:], '"')
+	if end < 0 {
+		return false
+	}
+	value := s.data[s.pos : s.pos+end]
+	if bytes.IndexByte(value, '\\') >= 0 {
+		return false
+	}
+	*v = value
+	s.pos += end + 1
+	return true
+}
+
+// int64 scans an integer into v
+func (s *jsonScanner) int64(v *int64) bool {
+	s.space()
+	start := s.pos
+	for s.pos < len(s.data) && (s.data[s.pos] == '-' || s.data[s.pos] >= '0' && s.data[s.pos] <= '9') {
+		s.pos++
+	}
+	n, err := strconv.ParseInt(string(s.data[start:s.pos]), 10, 64)
+	if err != nil {
+		return false
+	}
+	*v = n
+	return true
+}
+
+// skip skips a value of any type
+func (s *jsonScanner) skip() bool {
+	s.space()
+	if s.pos >= len(s.data) {
+		return false
+	}
+	switch s.data[s.pos] {
+	case '"':
+		return s.skipString()
+	case '{', '[':
+		return s.skipNested()
+	}
+	// A number, true, false or null runs up to the next delimiter
+	start := s.pos
+	for s.pos < len(s.data) {
+		switch s.data[s.pos] {
+		case ',', '}', ']', ' ', '\t', '\n', '\r':
+			return s.pos > start
+		}
+		s.pos++
+	}
+	return s.pos > start
+}
+
+// skipString skips a string, escape sequences included
+func (s *jsonScanner) skipString() bool {
+	s.pos++ // Opening quote
+	for s.pos < len(s.data) {
+		switch s.data[s.pos] {
+		case '\\':
+			s.pos += 2
+		case '"':
+			s.pos++
+			return true
+		default:
+			s.pos++
+		}
+	}
+	return false
+}
+
+// skipNested skips an object or array, counting brackets outside strings
+func (s *jsonScanner) skipNested() bool {
+	depth := 0
+	for s.pos < len(s.data) {
+		switch s.data[s.pos] {
+		case '"':
+			if !s.skipString() {
+				return false
+			}
+			continue
+		case '{', '[':
+			depth++
+		case '}', ']':
+			depth--
+			if depth == 0 {
+				s.pos++
+				return true
+			}
+		}
+		s.pos++
+	}
+	return false
+}
+
+// forEachHotFields streams the hot fields of the WAF records of a log file to fn with
+// their raw JSON, decoding only the records ScanHotFields cannot scan
+func forEachHotFields(path string, fn func(f *HotFields, raw []byte) error) error {
+	var f HotFields
+	return forEachJSON(path, func(raw json.RawMessage) error {
+		if ScanHotFields(raw, &f) {
+			if !f.isRecord() {
+				return nil
+			}
+			return fn(&f, raw)
+		}
+		record, payload, err := decodeRecord(raw)
+		if err != nil {
+			return fmt.Errorf("failed to decode record in %s: %w", path, err)
+		}
+		if record == nil {
+			return nil
+		}
+		f.fromRecord(record)
+		return fn(&f, payload)
+	})
+}
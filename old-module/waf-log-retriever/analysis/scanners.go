@@ -0,0 +1,174 @@
+package analysis
+
+import (
+	_ "embed"
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"sort"
+	"time"
+)
+
+// scannerSignaturesJSON is the built-in library of scanner and attack tool signatures
+//
+//go:embed scanners.json
+var scannerSignaturesJSON []byte
+
+// ScannerSignature identifies a scanner by its User-Agent, the URIs it probes or a
+// header it sends; a request matching any of them is attributed to the scanner
+type ScannerSignature struct {
+	Name      string `json:"name"`
+	UserAgent string `json:"userAgent,omitempty"` // Regular expression
+	URI       string `json:"uri,omitempty"`       // Regular expression over the URI and query string
+	Header    string `json:"header,omitempty"`    // Header name
+
+	userAgent *regexp.Regexp
+	uri       *regexp.Regexp
+}
+
+// scannerSignatures is the compiled built-in signature library
+var scannerSignatures = mustLoadScannerSignatures(scannerSignaturesJSON)
+
+// mustLoadScannerSignatures parses and compiles a signature library, panicking on
+// errors since the library is embedded at build time
+func mustLoadScannerSignatures(data []byte) []ScannerSignature {
+	var signatures []ScannerSignature
+	if err := json.Unmarshal(data, &signatures); err != nil {
+		panic(fmt.Sprintf("invalid scanner signatures: %v", err))
+	}
+	for i := range signatures {
+		if signatures[i].UserAgent != "" {
+			signatures[i].userAgent = regexp.MustCompile(signatures[i].UserAgent)
+		}
+		if signatures[i].URI != "" {
+			signatures[i].uri = regexp.MustCompile(signatures[i].URI)
+		}
+	}
+	return signatures
+}
+
+// match reports whether a record matches the signature
+func (s *ScannerSignature) match(r *Record) bool {
+	if s.userAgent != nil && s.userAgent.MatchString(r.HeaderValue("User-Agent")) {
+		return true
+	}
+	if s.uri != nil && (s.uri.MatchString(r.HTTPRequest.URI) || s.uri.MatchString(r.HTTPRequest.Args)) {
+		return true
+	}
+	return s.Header != "" && r.HeaderValue(s.Header) != ""
+}
+
+// IdentifyScanner returns the name of the scanner a record came from, or "" if it
+// matches no signature
+func IdentifyScanner(r *Record) string {
+	for i := range scannerSignatures {
+		if scannerSignatures[i].match(r) {
+			return scannerSignatures[i].Name
+		}
+	}
+	return ""
+}
+
+// ScannerCounts aggregates the requests attributed to one scanner
+type ScannerCounts struct {
+	Requests  int64            `json:"requests"`
+	Blocked   int64            `json:"blocked"`
+	FirstSeen time.Time        `json:"firstSeen"`
+	LastSeen  time.Time        `json:"lastSeen"`
+	ClientIPs map[string]int64 `json:"clientIps"`
+
+	perMinute map[int64]int64 // Requests by Unix minute, for the peak rate
+}
+
+// addScanner attributes a record to a scanner if it matches a signature, and returns
+// the scanner's name or ""
+func (s *Stats) addScanner(r *Record, client string) string {
+	name := IdentifyScanner(r)
+	if name == "" {
+		return ""
+	}
+	counts, ok := s.Scanners[name]
+	if !ok {
+		counts = &ScannerCounts{ClientIPs: make(map[string]int64), perMinute: make(map[int64]int64)}
+		s.Scanners[name] = counts
+	}
+
+	counts.Requests++
+	if r.Action == "BLOCK" {
+		counts.Blocked++
+	}
+	ts := r.Time()
+	if counts.FirstSeen.IsZero() || ts.Before(counts.FirstSeen) {
+		counts.FirstSeen = ts
+	}
+	if ts.After(counts.LastSeen) {
+		counts.LastSeen = ts
+	}
+	counts.ClientIPs[client]++
+	counts.perMinute[r.Timestamp/60000]++
+	return name
+}
+
+// ScannerActivity summarizes what one scanner did against the application
+type ScannerActivity struct {
+	Name          string    `json:"name"`
+	Requests      int64     `json:"requests"`
+	Blocked       int64     `json:"blocked"`
+	Allowed       int64     `json:"allowed"` // Not blocked, including COUNT, CAPTCHA and CHALLENGE outcomes
+	ClientIPs     int       `json:"clientIps"`
+	FirstSeen     time.Time `json:"firstSeen"`
+	LastSeen      time.Time `json:"lastSeen"`
+	PeakPerMinute int64     `json:"peakPerMinute"`
+	TopClientIPs  []Count   `json:"topClientIps"`
+}
+
+// ScannerReport lists the scanners seen in the logs, most active first
+func ScannerReport(stats *Stats) []ScannerActivity {
+	report := make([]ScannerActivity, 0, len(stats.Scanners))
+	for name, counts := range stats.Scanners {
+		var peak int64
+		for _, n := range counts.perMinute {
+			if n > peak {
+				peak = n
+			}
+		}
+		report = append(report, ScannerActivity{
+			Name:          name,
+			Requests:      counts.Requests,
+			Blocked:       counts.Blocked,
+			Allowed:       counts.Requests - counts.Blocked,
+			ClientIPs:     len(counts.ClientIPs),
+			FirstSeen:     counts.FirstSeen,
+			LastSeen:      counts.LastSeen,
+			PeakPerMinute: peak,
+			TopClientIPs:  TopN(counts.ClientIPs, 5),
+		})
+	}
+	sort.Slice(report, func(i, j int) bool {
+		if report[i].Requests != report[j].Requests {
+			return report[i].Requests > report[j].Requests
+		}
+		return report[i].Name < report[j].Name
+	})
+	return report
+}
+
+// ScannerFindings reports scanners whose requests were not all blocked
+func ScannerFindings(webACLName string, report []ScannerActivity) []Finding {
+	var findings []Finding
+	for _, scanner := range report {
+		if scanner.Allowed == 0 {
+			continue
+		}
+		findings = append(findings, Finding{
+			ID:       "scanner-not-blocked",
+			Severity: SeverityMedium,
+			Title:    fmt.Sprintf("%d of %d %s requests were not blocked", scanner.Allowed, scanner.Requests, scanner.Name),
+			Description: fmt.Sprintf("%s scanned the application behind Web ACL %s from %d client IPs between %s and %s (peak %d requests per minute). Consider blocking known scanner signatures, e.g. with the AWS managed Known Bad Inputs or Bot Control rule groups.",
+				scanner.Name, webACLName, scanner.ClientIPs, scanner.FirstSeen.Format(time.RFC3339), scanner.LastSeen.Format(time.RFC3339), scanner.PeakPerMinute),
+			Source:   "scanners",
+			Evidence: &Evidence{Scanner: scanner.Name, NotBlocked: true},
+		})
+	}
+	return findings
+}
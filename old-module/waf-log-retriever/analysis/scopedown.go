@@ -0,0 +1,321 @@
+package analysis
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"path"
+	"sort"
+	"strings"
+)
+
+// scopeDownPrefixPaths is the number of distinct false-positive paths below one
+// directory from which the whole directory is excluded instead of each path
+const scopeDownPrefixPaths = 3
+
+// FalsePositiveFunc reports whether a rule group match on a record is a false
+// positive, given the Web ACL rule, the rule group and the rule inside it
+type FalsePositiveFunc func(r *Record, webACLRule, ruleGroupID, ruleID string) bool
+
+// ScopeDownPath is a request path a scope-down statement takes out of a rule group's
+// inspection, optionally only on one host
+type ScopeDownPath struct {
+	Host           string `json:"host,omitempty"`
+	Path           string `json:"path"`
+	Match          string `json:"match"` // EXACTLY or STARTS_WITH
+	FalsePositives int64  `json:"falsePositives"`
+	OtherMatches   int64  `json:"otherMatches"` // Matches not marked false positive that would no longer be inspected
+}
+
+// ScopeDownRecommendation is a managed rule group rule with a scope-down statement
+// excluding the paths of its false positives
+type ScopeDownRecommendation struct {
+	Rule           string                 `json:"rule"`
+	RuleGroupID    string                 `json:"ruleGroupId"`
+	Matches        int64                  `json:"matches"`
+	FalsePositives int64                  `json:"falsePositives"`
+	SubRules       []Count                `json:"subRules"` // Rules of the group with false positives
+	Paths          []ScopeDownPath        `json:"paths"`
+	Uncovered      int64                  `json:"uncovered"`   // False positives on paths beyond the most excluded
+	LostMatches    int64                  `json:"lostMatches"` // Sum of OtherMatches
+	RuleJSON       map[string]interface{} `json:"ruleJson"`    // The rule with the scope-down statement, in console JSON
+}
+
+// scopeDownKey is a request path on a host
+type scopeDownKey struct {
+	host, path string
+}
+
+// scopeDownGroup collects the matches of one managed rule group rule
+type scopeDownGroup struct {
+	rule           map[string]interface{}
+	name, groupID  string
+	matches, fps   int64
+	subRules       map[string]int64
+	falsePositives map[scopeDownKey]int64
+	others         map[scopeDownKey]int64
+}
+
+// ScopeDownAnalysis finds the paths where the managed rule groups of a Web ACL
+// snapshot match requests marked as false positives
+type ScopeDownAnalysis struct {
+	groups          []*scopeDownGroup
+	isFalsePositive FalsePositiveFunc
+}
+
+// NewScopeDownAnalysis prepares the analysis of the managed rule groups in a Web ACL
+// snapshot
+func NewScopeDownAnalysis(snapshot map[string]interface{}, isFalsePositive FalsePositiveFunc) *ScopeDownAnalysis {
+	a := &ScopeDownAnalysis{isFalsePositive: isFalsePositive}
+	webACL, _ := snapshot["webACL"].(map[string]interface{})
+	for _, rule := range asSlice(webACL["Rules"]) {
+		statement, _ := rule["Statement"].(map[string]interface{})
+		if _, ok := statement["ManagedRuleGroupStatement"].(map[string]interface{}); !ok {
+			continue
+		}
+		groupID, _ := ruleGroupOf(statement)
+		name, _ := rule["Name"].(string)
+		a.groups = append(a.groups, &scopeDownGroup{
+			rule:           rule,
+			name:           name,
+			groupID:        groupID,
+			subRules:       make(map[string]int64),
+			falsePositives: make(map[scopeDownKey]int64),
+			others:         make(map[scopeDownKey]int64),
+		})
+	}
+	return a
+}
+
+// RuleGroups returns the number of managed rule group rules analyzed
+func (a *ScopeDownAnalysis) RuleGroups() int {
+	return len(a.groups)
+}
+
+// Add folds the managed rule group matches of a record into the analysis
+func (a *ScopeDownAnalysis) Add(r *Record) {
+	for _, g := range r.RuleGroupList {
+		group := a.groupOf(g.RuleGroupID)
+		if group == nil {
+			continue
+		}
+		var ruleIDs []string
+		if g.TerminatingRule != nil {
+			ruleIDs = append(ruleIDs, g.TerminatingRule.RuleID)
+		}
+		for _, m := range g.NonTerminatingMatchingRules {
+			ruleIDs = append(ruleIDs, m.RuleID)
+		}
+		for _, m := range g.ExcludedRules {
+			ruleIDs = append(ruleIDs, m.RuleID)
+		}
+		if len(ruleIDs) == 0 {
+			continue
+		}
+
+		group.matches++
+		key := scopeDownKey{host: strings.ToLower(r.Host()), path: r.HTTPRequest.URI}
+		fp := false
+		for _, ruleID := range ruleIDs {
+			if a.isFalsePositive(r, group.name, group.groupID, ruleID) {
+				group.subRules[ruleID]++
+				fp = true
+			}
+		}
+		if fp {
+			group.fps++
+			group.falsePositives[key]++
+		} else {
+			group.others[key]++
+		}
+	}
+}
+
+// groupOf returns the analyzed rule of a rule group ID from the logs, which may
+// carry a version suffix
+func (a *ScopeDownAnalysis) groupOf(logID string) *scopeDownGroup {
+	for _, group := range a.groups {
+		if logID == group.groupID || strings.HasPrefix(logID, group.groupID+"#") {
+			return group
+		}
+	}
+	return nil
+}
+
+// Recommendations returns a scope-down recommendation for every rule group with at
+// least minFalsePositives false positives, excluding at most maxPaths paths each
+func (a *ScopeDownAnalysis) Recommendations(minFalsePositives int64, maxPaths int) []ScopeDownRecommendation {
+	var recs []ScopeDownRecommendation
+	for _, group := range a.groups {
+		if group.fps == 0 || group.fps < minFalsePositives {
+			continue
+		}
+		rec := ScopeDownRecommendation{
+			Rule:           group.name,
+			RuleGroupID:    group.groupID,
+			Matches:        group.matches,
+			FalsePositives: group.fps,
+			SubRules:       TopN(group.subRules, 0),
+		}
+		paths := scopeDownPaths(group.falsePositives)
+		if maxPaths > 0 && len(paths) > maxPaths {
+			for _, p := range paths[maxPaths:] {
+				rec.Uncovered += p.FalsePositives
+			}
+			paths = paths[:maxPaths]
+		}
+		for i := range paths {
+			for key, n := range group.others {
+				if paths[i].covers(key) {
+					paths[i].OtherMatches += n
+				}
+			}
+			rec.LostMatches += paths[i].OtherMatches
+		}
+		rec.Paths = paths
+		rec.RuleJSON = scopeDownRule(group.rule, paths)
+		recs = append(recs, rec)
+	}
+	return recs
+}
+
+// covers reports whether a request path on a host is excluded by the path
+func (p ScopeDownPath) covers(key scopeDownKey) bool {
+	if p.Host != "" && p.Host != key.host {
+		return false
+	}
+	if p.Match == "STARTS_WITH" {
+		return strings.HasPrefix(key.path, p.Path)
+	}
+	return key.path == p.Path
+}
+
+// scopeDownPaths turns the false positives by host and path into paths to exclude,
+// most false positives first. Directories with several false-positive paths are
+// excluded as a whole, and a path is limited to its host when all of its false
+// positives were on one host.
+func scopeDownPaths(falsePositives map[scopeDownKey]int64) []ScopeDownPath {
+	dirPaths := make(map[string]map[string]bool)
+	for key := range falsePositives {
+		dir := path.Dir(key.path)
+		if dirPaths[dir] == nil {
+			dirPaths[dir] = make(map[string]bool)
+		}
+		dirPaths[dir][key.path] = true
+	}
+
+	type condition struct {
+		path, match string
+	}
+	counts := make(map[condition]int64)
+	hosts := make(map[condition]map[string]bool)
+	for key, n := range falsePositives {
+		c := condition{key.path, "EXACTLY"}
+		if dir := path.Dir(key.path); dir != "/" && dir != "." && len(dirPaths[dir]) >= scopeDownPrefixPaths {
+			c = condition{dir + "/", "STARTS_WITH"}
+		}
+		counts[c] += n
+		if hosts[c] == nil {
+			hosts[c] = make(map[string]bool)
+		}
+		hosts[c][key.host] = true
+	}
+
+	paths := make([]ScopeDownPath, 0, len(counts))
+	for c, n := range counts {
+		p := ScopeDownPath{Path: c.path, Match: c.match, FalsePositives: n}
+		if len(hosts[c]) == 1 {
+			for host := range hosts[c] {
+				p.Host = host
+			}
+		}
+		paths = append(paths, p)
+	}
+	sort.Slice(paths, func(i, j int) bool {
+		if paths[i].FalsePositives != paths[j].FalsePositives {
+			return paths[i].FalsePositives > paths[j].FalsePositives
+		}
+		return paths[i].Host+paths[i].Path < paths[j].Host+paths[j].Path
+	})
+	return paths
+}
+
+// scopeDownRule returns a copy of a Web ACL rule whose managed rule group skips the
+// excluded paths, combined with any scope-down statement it already has
+func scopeDownRule(rule map[string]interface{}, paths []ScopeDownPath) map[string]interface{} {
+	var conditions []interface{}
+	for _, p := range paths {
+		pathMatch := byteMatch(p.Path, p.Match, map[string]interface{}{"UriPath": map[string]interface{}{}}, "NONE")
+		if p.Host == "" {
+			conditions = append(conditions, pathMatch)
+			continue
+		}
+		hostMatch := byteMatch(p.Host, "EXACTLY", map[string]interface{}{"SingleHeader": map[string]interface{}{"Name": "host"}}, "LOWERCASE")
+		conditions = append(conditions, map[string]interface{}{
+			"AndStatement": map[string]interface{}{"Statements": []interface{}{hostMatch, pathMatch}},
+		})
+	}
+	excluded := conditions[0]
+	if len(conditions) > 1 {
+		excluded = map[string]interface{}{"OrStatement": map[string]interface{}{"Statements": conditions}}
+	}
+	scopeDown := map[string]interface{}{"NotStatement": map[string]interface{}{"Statement": excluded}}
+
+	copied, _ := consoleJSON(rule).(map[string]interface{})
+	statement, _ := copied["Statement"].(map[string]interface{})
+	managed, _ := statement["ManagedRuleGroupStatement"].(map[string]interface{})
+	if existing, ok := managed["ScopeDownStatement"]; ok {
+		scopeDown = map[string]interface{}{"AndStatement": map[string]interface{}{"Statements": []interface{}{existing, scopeDown}}}
+	}
+	managed["ScopeDownStatement"] = scopeDown
+	return copied
+}
+
+// byteMatch returns a ByteMatchStatement on a field
+func byteMatch(search, constraint string, field map[string]interface{}, transformation string) map[string]interface{} {
+	return map[string]interface{}{
+		"ByteMatchStatement": map[string]interface{}{
+			"SearchString":         search,
+			"FieldToMatch":         field,
+			"TextTransformations":  []interface{}{map[string]interface{}{"Priority": 0, "Type": transformation}},
+			"PositionalConstraint": constraint,
+		},
+	}
+}
+
+// consoleJSON deep-copies snapshot JSON into the form of the console's rule JSON
+// editor: without null fields, and with search strings as text rather than base64
+func consoleJSON(v interface{}) interface{} {
+	switch v := v.(type) {
+	case map[string]interface{}:
+		copied := make(map[string]interface{}, len(v))
+		for key, value := range v {
+			if value == nil {
+				continue
+			}
+			if s, ok := value.(string); ok && key == "SearchString" {
+				if decoded, err := base64.StdEncoding.DecodeString(s); err == nil {
+					value = string(decoded)
+				}
+			}
+			copied[key] = consoleJSON(value)
+		}
+		return copied
+	case []interface{}:
+		copied := make([]interface{}, len(v))
+		for i, value := range v {
+			copied[i] = consoleJSON(value)
+		}
+		return copied
+	}
+	return v
+}
+
+// MarshalRuleJSON formats a rule for pasting into the console's rule JSON editor
+func MarshalRuleJSON(rule map[string]interface{}) (string, error) {
+	data, err := json.MarshalIndent(rule, "", "  ")
+	if err != nil {
+		return "", fmt.Errorf("failed to encode rule JSON: %w", err)
+	}
+	return string(data), nil
+}
@@ -0,0 +1,142 @@
+package analysis
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"os"
+	"sort"
+)
+
+// CriticalityLevels are the criticalities of assets, from most to least critical
+var CriticalityLevels = []string{"critical", "high", "medium", "low"}
+
+// criticalityFactors are the criticality factors of the levels; medium is neutral
+var criticalityFactors = map[string]float64{"critical": 1, "high": 0.75, "medium": 0.5, "low": 0.25}
+
+// ScoringSettings configure how findings are rescored from the requests they are
+// about, so that reports match a customer's risk appetite. Each weight is the number
+// of severity levels its factor moves a finding up at its maximum, and down at its
+// minimum; a factor of 0.5 leaves the severity alone. The criticality of the hosts
+// and paths a finding's requests went to comes from the asset map.
+type ScoringSettings struct {
+	Weights     ScoringWeights `json:"weights"`
+	VolumeScale int64          `json:"volumeScale"` // Requests at which the volume factor reaches 1, on a log scale
+}
+
+// ScoringWeights weigh the factors a finding's severity is adjusted by
+type ScoringWeights struct {
+	Volume      float64 `json:"volume"`      // Requests the finding is about
+	Success     float64 `json:"success"`     // Share of them that were not blocked
+	Criticality float64 `json:"criticality"` // Criticality of the most critical asset they went to
+}
+
+// ScoringEnabled reports whether findings are rescored: whether volume or success
+// is weighted, or criticality is and an asset map is given
+func (s *Settings) ScoringEnabled() bool {
+	w := s.Scoring.Weights
+	return w.Volume != 0 || w.Success != 0 || w.Criticality != 0 && len(s.Assets) > 0
+}
+
+// LoadScoring reads a scoring model file: a JSON object of scoring settings
+func LoadScoring(path string) (ScoringSettings, error) {
+	scoring := DefaultSettings().Scoring
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return scoring, fmt.Errorf("failed to read scoring file: %w", err)
+	}
+	if err := json.Unmarshal(data, &scoring); err != nil {
+		return scoring, fmt.Errorf("failed to parse scoring file %s: %w", path, err)
+	}
+	if err := scoring.Validate(); err != nil {
+		return scoring, fmt.Errorf("scoring file %s: %w", path, err)
+	}
+	return scoring, nil
+}
+
+// Validate checks the weights and the volume scale
+func (s *ScoringSettings) Validate() error {
+	if s.Weights.Volume < 0 || s.Weights.Success < 0 || s.Weights.Criticality < 0 {
+		return fmt.Errorf("scoring weights must not be negative")
+	}
+	if s.VolumeScale < 2 {
+		return fmt.Errorf("scoring volumeScale must be at least 2")
+	}
+	return nil
+}
+
+// Score explains how a finding's severity was adjusted
+type Score struct {
+	BaseSeverity     string  `json:"baseSeverity"` // Severity the detector assigned
+	Requests         int64   `json:"requests"`     // Requests the finding is about, see Evidence
+	NotBlocked       int64   `json:"notBlocked"`
+	CriticalityLevel string  `json:"criticalityLevel"` // Of the most critical asset requested, medium for none
+	Volume           float64 `json:"volume"`           // Factors from 0 to 1
+	Success          float64 `json:"success"`
+	Criticality      float64 `json:"criticality"`
+	Adjustment       float64 `json:"adjustment"` // Severity levels added, before rounding
+}
+
+// scoreTally counts the requests a finding is about
+type scoreTally struct {
+	requests   int64
+	notBlocked int64
+	level      string           // Most critical level requested
+	assets     map[string]int64 // Asset name -> requests
+}
+
+// add counts a record the finding is about
+func (t *scoreTally) add(r *Record, settings *Settings) {
+	t.requests++
+	if r.Action != "BLOCK" {
+		t.notBlocked++
+	}
+	level := "medium"
+	if asset := settings.AssetOf(r); asset != nil {
+		level = asset.Criticality
+		if t.assets == nil {
+			t.assets = make(map[string]int64)
+		}
+		t.assets[asset.Name]++
+	}
+	if t.level == "" || criticalityFactors[level] > criticalityFactors[t.level] {
+		t.level = level
+	}
+}
+
+// tagAssets lists the assets a finding's requests went to, most critical first
+func (t *scoreTally) tagAssets(f *Finding, settings *Settings) {
+	for _, a := range settings.Assets {
+		if n := t.assets[a.Name]; n > 0 {
+			f.Assets = append(f.Assets, FindingAsset{Name: a.Name, Criticality: a.Criticality, DataClassification: a.DataClassification, Requests: n})
+		}
+	}
+	sort.SliceStable(f.Assets, func(i, j int) bool {
+		return criticalityFactors[f.Assets[i].Criticality] > criticalityFactors[f.Assets[j].Criticality]
+	})
+}
+
+// score rescores a finding from the requests it is about; findings about no
+// requests keep their severity
+func (t *scoreTally) score(f *Finding, scoring *ScoringSettings) {
+	if t.requests == 0 {
+		return
+	}
+	score := &Score{
+		BaseSeverity:     f.Severity,
+		Requests:         t.requests,
+		NotBlocked:       t.notBlocked,
+		CriticalityLevel: t.level,
+		Volume:           round2(min(math.Log10(float64(t.requests)+1)/math.Log10(float64(scoring.VolumeScale)+1), 1)),
+		Success:          round2(float64(t.notBlocked) / float64(t.requests)),
+		Criticality:      criticalityFactors[t.level],
+	}
+	w := scoring.Weights
+	score.Adjustment = round2(w.Volume*(2*score.Volume-1) + w.Success*(2*score.Success-1) + w.Criticality*(2*score.Criticality-1))
+	rank := SeverityRank(f.Severity) + int(math.Round(score.Adjustment))
+	f.Severity = severities[max(0, min(rank, len(severities)-1))]
+	f.Score = score
+}
+
+// severities are the severities by rank, see SeverityRank
+var severities = []string{SeverityInfo, SeverityLow, SeverityMedium, SeverityHigh, SeverityCritical}
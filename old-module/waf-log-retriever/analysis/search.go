@@ -0,0 +1,258 @@
+package analysis
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"waf-log-retriever/storage"
+)
+
+// Query selects WAF records; a record matches when it meets every set criterion.
+// Text criteria are case-insensitive substrings.
+type Query struct {
+	IP        string // Client IP or CIDR range
+	URI       string // Substring of the URI
+	Args      string // Substring of the query string
+	Header    string // Header name, or name=value substring
+	Rule      string // Substring of any matched rule ID, rule group ID or label
+	Action    string // ALLOW, BLOCK, COUNT, CAPTCHA or CHALLENGE
+	Host      string // Host pattern, see MatchHost
+	Country   string
+	RequestID string
+	Text      string // Substring of the raw record JSON
+	From, To  time.Time
+
+	nets    []*net.IPNet
+	literal []byte // Bytes every matching raw record contains, to skip decoding others
+	hot     bool   // Whether any criterion is on a HotFields field, see matchesHot
+}
+
+// Compile validates the query and prepares it for matching
+func (q *Query) Compile() error {
+	q.literal = nil
+	if q.IP != "" {
+		nets, err := parseCIDRs([]string{q.IP})
+		if err != nil {
+			return err
+		}
+		q.nets = nets
+		if !strings.Contains(q.IP, "/") {
+			q.literal = []byte(q.IP) // Unquoted, as CloudWatch envelopes escape the quotes
+		}
+	}
+	if q.RequestID != "" {
+		q.literal = []byte(q.RequestID)
+	}
+	if !q.From.IsZero() && !q.To.IsZero() && !q.To.After(q.From) {
+		return fmt.Errorf("the search window ends before it starts")
+	}
+	q.URI, q.Args, q.Header, q.Rule, q.Text = strings.ToLower(q.URI), strings.ToLower(q.Args),
+		strings.ToLower(q.Header), strings.ToLower(q.Rule), strings.ToLower(q.Text)
+	q.hot = !q.From.IsZero() || !q.To.IsZero() || len(q.nets) > 0 || q.Action != "" ||
+		q.Country != "" || q.RequestID != "" || q.URI != ""
+	return nil
+}
+
+// HotOnly reports whether every criterion of the query is on a HotFields field or
+// the raw text, so ForEachHotMatch can select its records
+func (q *Query) HotOnly() bool {
+	return q.Args == "" && q.Header == "" && q.Rule == "" && q.Host == ""
+}
+
+// ForEachMatch streams the records of a log file that match the query to fn with
+// their raw JSON. Records that cannot match are skipped before they are decoded,
+// by their hot fields where the query has criteria on them.
+func (q *Query) ForEachMatch(path string, fn func(r *Record, raw []byte) error) error {
+	var f HotFields
+	skip := func(raw []byte) bool {
+		if q.literal != nil && !bytes.Contains(raw, q.literal) {
+			return true
+		}
+		return q.hot && ScanHotFields(raw, &f) && !q.matchesHot(&f)
+	}
+	return forEachRecord(path, skip, func(r *Record, raw []byte) error {
+		if !q.Matches(r, raw) {
+			return nil
+		}
+		return fn(r, raw)
+	})
+}
+
+// ForEachHotMatch streams the hot fields of the records of a log file that match the
+// query to fn, without decoding the records ScanHotFields can scan. The criteria
+// other than those HotOnly allows are ignored.
+func (q *Query) ForEachHotMatch(path string, fn func(f *HotFields) error) error {
+	return forEachHotFields(path, func(f *HotFields, raw []byte) error {
+		if q.literal != nil && !bytes.Contains(raw, q.literal) {
+			return nil
+		}
+		if !q.matchesHot(f) {
+			return nil
+		}
+		if q.Text != "" && !bytes.Contains(bytes.ToLower(raw), []byte(q.Text)) {
+			return nil
+		}
+		return fn(f)
+	})
+}
+
+// matchesHot reports whether the hot fields of a record meet the criteria on them,
+// as Matches does for the decoded record
+func (q *Query) matchesHot(f *HotFields) bool {
+	if !q.From.IsZero() || !q.To.IsZero() {
+		t := time.UnixMilli(f.Timestamp)
+		if (!q.From.IsZero() && t.Before(q.From)) || (!q.To.IsZero() && !t.Before(q.To)) {
+			return false
+		}
+	}
+	if len(q.nets) > 0 {
+		ip := net.ParseIP(string(f.ClientIP))
+		if ip == nil || !containsIP(q.nets, ip) {
+			return false
+		}
+	}
+	if q.Action != "" && !strings.EqualFold(string(f.Action), q.Action) {
+		return false
+	}
+	if q.Country != "" && !strings.EqualFold(string(f.Country), q.Country) {
+		return false
+	}
+	if q.RequestID != "" && string(f.RequestID) != q.RequestID {
+		return false
+	}
+	if q.URI != "" && !bytes.Contains(bytes.ToLower(f.URI), []byte(q.URI)) {
+		return false
+	}
+	return true
+}
+
+// Matches reports whether a record matches the query
+func (q *Query) Matches(r *Record, raw []byte) bool {
+	if !q.From.IsZero() || !q.To.IsZero() {
+		t := r.Time()
+		if (!q.From.IsZero() && t.Before(q.From)) || (!q.To.IsZero() && !t.Before(q.To)) {
+			return false
+		}
+	}
+	if len(q.nets) > 0 {
+		ip := net.ParseIP(r.HTTPRequest.ClientIP)
+		if ip == nil || !containsIP(q.nets, ip) {
+			return false
+		}
+	}
+	if q.Action != "" && !strings.EqualFold(r.Action, q.Action) {
+		return false
+	}
+	if q.Country != "" && !strings.EqualFold(r.HTTPRequest.Country, q.Country) {
+		return false
+	}
+	if q.RequestID != "" && r.HTTPRequest.RequestID != q.RequestID {
+		return false
+	}
+	if q.Host != "" && !MatchHost(q.Host, r.Host()) {
+		return false
+	}
+	if q.URI != "" && !strings.Contains(strings.ToLower(r.HTTPRequest.URI), q.URI) {
+		return false
+	}
+	if q.Args != "" && !strings.Contains(strings.ToLower(r.HTTPRequest.Args), q.Args) {
+		return false
+	}
+	if q.Header != "" && !q.matchesHeader(r) {
+		return false
+	}
+	if q.Rule != "" && !q.matchesRule(r) {
+		return false
+	}
+	if q.Text != "" && !bytes.Contains(bytes.ToLower(raw), []byte(q.Text)) {
+		return false
+	}
+	return true
+}
+
+// matchesHeader reports whether the record has the queried header
+func (q *Query) matchesHeader(r *Record) bool {
+	name, value, hasValue := strings.Cut(q.Header, "=")
+	for _, h := range r.HTTPRequest.Headers {
+		if !strings.EqualFold(h.Name, name) {
+			continue
+		}
+		if !hasValue || strings.Contains(strings.ToLower(h.Value), value) {
+			return true
+		}
+	}
+	return false
+}
+
+// matchesRule reports whether any rule that matched the record, or any label it
+// carries, contains the queried substring
+func (q *Query) matchesRule(r *Record) bool {
+	for _, name := range RecordRules(r) {
+		if strings.Contains(strings.ToLower(name), q.Rule) {
+			return true
+		}
+	}
+	return false
+}
+
+// RecordRules lists the terminating rule, every rule group and rule that matched a
+// record, and its labels. ruleGroupList names every rule group that inspected the
+// request, so only groups with a matching rule are listed.
+func RecordRules(r *Record) []string {
+	names := []string{r.TerminatingRuleID}
+	for _, m := range r.NonTerminatingMatchingRules {
+		names = append(names, m.RuleID)
+	}
+	for _, g := range r.RuleGroupList {
+		if g.TerminatingRule == nil && len(g.NonTerminatingMatchingRules) == 0 && len(g.ExcludedRules) == 0 {
+			continue
+		}
+		names = append(names, g.RuleGroupID)
+		if g.TerminatingRule != nil {
+			names = append(names, g.TerminatingRule.RuleID)
+		}
+		for _, m := range g.NonTerminatingMatchingRules {
+			names = append(names, m.RuleID)
+		}
+		for _, m := range g.ExcludedRules {
+			names = append(names, m.RuleID)
+		}
+	}
+	for _, rb := range r.RateBasedRuleList {
+		names = append(names, rb.RateBasedRuleName)
+	}
+	for _, l := range r.Labels {
+		names = append(names, l.Name)
+	}
+	return names
+}
+
+// MayContain reports whether a log file below root can hold records of the query's
+// time window. Files in an hourly, daily or hive partition (see storage.Layouts)
+// outside the window are skipped; any other file may hold records of any time.
+func (q *Query) MayContain(root, file string) bool {
+	if q.From.IsZero() && q.To.IsZero() {
+		return true
+	}
+	rel, err := filepath.Rel(root, filepath.Dir(file))
+	if err != nil {
+		return true
+	}
+	_, start, length, ok := storage.ParsePartition(rel)
+	if !ok {
+		return true
+	}
+	// Records can be delivered up to a few minutes after the hour they belong to
+	const slack = 15 * time.Minute
+	if !q.To.IsZero() && !start.Before(q.To.Add(slack)) {
+		return false
+	}
+	if !q.From.IsZero() && start.Add(length+slack).Before(q.From) {
+		return false
+	}
+	return true
+}
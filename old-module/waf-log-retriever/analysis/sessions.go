@@ -0,0 +1,320 @@
+package analysis
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+)
+
+// maxSessionClients caps the clients whose sessions are tracked
+const maxSessionClients = 50000
+
+// maxClientSessions caps the sessions tracked per client
+const maxClientSessions = 1000
+
+// maxSessionPaths caps the paths kept of each session's sequence
+const maxSessionPaths = 20
+
+// maxSessionFindings caps the sessions of each kind reported as findings
+const maxSessionFindings = 10
+
+// maxReportedSessions caps the sessions of each kind listed in the report
+const maxReportedSessions = 50
+
+// SessionSettings configure sessionization and the session-based bot and abuse detectors
+type SessionSettings struct {
+	IdleMinutes          int     `json:"idleMinutes"`          // Gap after which a client's next request starts a new session
+	MinRequests          int64   `json:"minRequests"`          // Requests a session needs to be automated or abusive
+	MaxRequestsPerMinute float64 `json:"maxRequestsPerMinute"` // Sustained rate above which a session is automated
+	MinBlockRatio        float64 `json:"minBlockRatio"`        // Share of blocked requests from which a session is abusive
+}
+
+// Session is a run of requests from one client without a gap of the idle timeout
+type Session struct {
+	Client   string // Client identity, see ClientIdentitySettings
+	Start    int64  // Unix milliseconds
+	End      int64
+	Requests int64
+	Blocked  int64
+	Paths    []string // First URIs requested, repeats of the previous one left out
+}
+
+// join folds another session of the same client into s, ordering the paths by
+// which session started first
+func (s *Session) join(o *Session) {
+	first, second := s.Paths, o.Paths
+	if o.Start < s.Start {
+		first, second = second, first
+	}
+	paths := append([]string(nil), first...)
+	for _, path := range second {
+		paths = appendPath(paths, path)
+	}
+	s.Paths = paths
+	s.Start = min(s.Start, o.Start)
+	s.End = max(s.End, o.End)
+	s.Requests += o.Requests
+	s.Blocked += o.Blocked
+}
+
+// appendPath appends a path to a session's sequence unless it repeats the previous
+// one or the sequence is full
+func appendPath(paths []string, path string) []string {
+	if len(paths) >= maxSessionPaths || len(paths) > 0 && paths[len(paths)-1] == path {
+		return paths
+	}
+	return append(paths, path)
+}
+
+// SessionStats groups the requests of each client into sessions. Sessions of
+// disjoint chunks of records merge into the sessions of all of them, so records
+// need not arrive in time order.
+type SessionStats struct {
+	idle      int64                 // Idle timeout in milliseconds
+	clients   map[string][]*Session // Client -> sessions, by start
+	untracked int64                 // Requests beyond the caps on clients and sessions
+}
+
+// newSessionStats creates an empty SessionStats instance
+func newSessionStats(idle time.Duration) *SessionStats {
+	return &SessionStats{idle: idle.Milliseconds(), clients: make(map[string][]*Session)}
+}
+
+// addSession folds a record into the sessions of its client
+func (s *Stats) addSession(r *Record, client string) {
+	if s.Hosts == nil {
+		return // Per-host and testing statistics are not sessionized
+	}
+	a := s.Sessions
+	blocked := int64(0)
+	if r.Action == "BLOCK" {
+		blocked = 1
+	}
+
+	// Requests mostly arrive in time order and extend the client's latest session
+	sessions := a.clients[client]
+	if n := len(sessions); n > 0 {
+		last := sessions[n-1]
+		if r.Timestamp >= last.Start && r.Timestamp <= last.End+a.idle {
+			last.End = max(last.End, r.Timestamp)
+			last.Requests++
+			last.Blocked += blocked
+			last.Paths = appendPath(last.Paths, r.HTTPRequest.URI)
+			return
+		}
+	}
+	a.add(&Session{
+		Client:   client,
+		Start:    r.Timestamp,
+		End:      r.Timestamp,
+		Requests: 1,
+		Blocked:  blocked,
+		Paths:    []string{r.HTTPRequest.URI},
+	})
+}
+
+// add inserts a session into the sessions of its client, joining it with every
+// session less than the idle timeout apart
+func (a *SessionStats) add(session *Session) {
+	sessions, ok := a.clients[session.Client]
+	if !ok && len(a.clients) >= maxSessionClients {
+		a.untracked += session.Requests
+		return
+	}
+	// Sessions of a client are more than the idle timeout apart, so they are ordered
+	// by end as well as by start
+	i := sort.Search(len(sessions), func(i int) bool { return sessions[i].End+a.idle >= session.Start })
+	j := i
+	for j < len(sessions) && sessions[j].Start-a.idle <= session.End {
+		session.join(sessions[j])
+		j++
+	}
+	if i == j && len(sessions) >= maxClientSessions {
+		a.untracked += session.Requests
+		return
+	}
+	sessions = append(sessions[:i], append([]*Session{session}, sessions[j:]...)...)
+	a.clients[session.Client] = sessions
+}
+
+// merge folds the sessions of another aggregate into a
+func (a *SessionStats) merge(o *SessionStats) {
+	for _, sessions := range o.clients {
+		for _, session := range sessions {
+			copied := *session
+			copied.Paths = append([]string(nil), session.Paths...)
+			a.add(&copied)
+		}
+	}
+	a.untracked += o.untracked
+}
+
+// SessionReport summarizes the sessions of all clients and lists the automated and
+// abusive ones
+type SessionReport struct {
+	IdleMinutes        int                 `json:"idleMinutes"`
+	Sessions           int                 `json:"sessions"`
+	Clients            int                 `json:"clients"`
+	UntrackedRequests  int64               `json:"untrackedRequests"` // Beyond the caps on clients and sessions per client
+	RequestsPerSession SessionDistribution `json:"requestsPerSession"`
+	DurationSeconds    SessionDistribution `json:"durationSeconds"`
+	BlockedSessions    int                 `json:"blockedSessions"` // Sessions with at least one blocked request
+	Automated          []SessionSummary    `json:"automated"`       // Sustained rate above the threshold, most requests first
+	Abusive            []SessionSummary    `json:"abusive"`         // Mostly blocked yet continued, most blocked first
+}
+
+// SessionDistribution describes the distribution of a session metric
+type SessionDistribution struct {
+	Median int64 `json:"median"`
+	P90    int64 `json:"p90"`
+	P99    int64 `json:"p99"`
+	Max    int64 `json:"max"`
+}
+
+// SessionSummary is the report entry of one session
+type SessionSummary struct {
+	Client            string    `json:"client"`
+	Start             time.Time `json:"start"`
+	End               time.Time `json:"end"`
+	Requests          int64     `json:"requests"`
+	Blocked           int64     `json:"blocked"`
+	BlockRatio        float64   `json:"blockRatio"`
+	RequestsPerMinute float64   `json:"requestsPerMinute"` // Over the session, counting at least one minute
+	Paths             []string  `json:"paths"`             // First URIs requested, in order
+}
+
+// summarize returns the report entry of a session
+func summarize(s *Session) SessionSummary {
+	minutes := max(float64(s.End-s.Start)/60000, 1)
+	return SessionSummary{
+		Client:            s.Client,
+		Start:             time.UnixMilli(s.Start).UTC(),
+		End:               time.UnixMilli(s.End).UTC(),
+		Requests:          s.Requests,
+		Blocked:           s.Blocked,
+		BlockRatio:        round2(float64(s.Blocked) / float64(s.Requests)),
+		RequestsPerMinute: round2(float64(s.Requests) / minutes),
+		Paths:             s.Paths,
+	}
+}
+
+// distribution returns the median, 90th and 99th percentile and maximum of values,
+// sorting them
+func distribution(values []int64) SessionDistribution {
+	if len(values) == 0 {
+		return SessionDistribution{}
+	}
+	sort.Slice(values, func(i, j int) bool { return values[i] < values[j] })
+	return SessionDistribution{
+		Median: percentileOf(values, 50),
+		P90:    percentileOf(values, 90),
+		P99:    percentileOf(values, 99),
+		Max:    values[len(values)-1],
+	}
+}
+
+// BuildSessionReport summarizes the sessions and detects the automated and abusive ones
+func BuildSessionReport(a *SessionStats, settings SessionSettings) *SessionReport {
+	report := &SessionReport{
+		IdleMinutes:       settings.IdleMinutes,
+		Clients:           len(a.clients),
+		UntrackedRequests: a.untracked,
+		Automated:         []SessionSummary{},
+		Abusive:           []SessionSummary{},
+	}
+	var requests, durations []int64
+	for _, sessions := range a.clients {
+		for _, s := range sessions {
+			requests = append(requests, s.Requests)
+			durations = append(durations, (s.End-s.Start)/1000)
+			if s.Blocked > 0 {
+				report.BlockedSessions++
+			}
+			if s.Requests < settings.MinRequests {
+				continue
+			}
+			summary := summarize(s)
+			if summary.RequestsPerMinute > settings.MaxRequestsPerMinute {
+				report.Automated = append(report.Automated, summary)
+			}
+			if summary.BlockRatio >= settings.MinBlockRatio {
+				report.Abusive = append(report.Abusive, summary)
+			}
+		}
+	}
+	report.Sessions = len(requests)
+	report.RequestsPerSession = distribution(requests)
+	report.DurationSeconds = distribution(durations)
+
+	sort.Slice(report.Automated, func(i, j int) bool {
+		if report.Automated[i].Requests != report.Automated[j].Requests {
+			return report.Automated[i].Requests > report.Automated[j].Requests
+		}
+		return report.Automated[i].Start.Before(report.Automated[j].Start)
+	})
+	sort.Slice(report.Abusive, func(i, j int) bool {
+		if report.Abusive[i].Blocked != report.Abusive[j].Blocked {
+			return report.Abusive[i].Blocked > report.Abusive[j].Blocked
+		}
+		return report.Abusive[i].Start.Before(report.Abusive[j].Start)
+	})
+	if len(report.Automated) > maxReportedSessions {
+		report.Automated = report.Automated[:maxReportedSessions]
+	}
+	if len(report.Abusive) > maxReportedSessions {
+		report.Abusive = report.Abusive[:maxReportedSessions]
+	}
+	return report
+}
+
+// evidence selects the requests of the session
+func (s SessionSummary) evidence() *Evidence {
+	return &Evidence{Client: s.Client, From: &s.Start, To: &s.End}
+}
+
+// sessionPaths formats the start of a session's path sequence
+func sessionPaths(paths []string) string {
+	if len(paths) > 5 {
+		return strings.Join(paths[:5], " -> ") + " -> ..."
+	}
+	return strings.Join(paths, " -> ")
+}
+
+// SessionFindings reports the most active automated and the most blocked abusive sessions
+func SessionFindings(webACLName string, report *SessionReport) []Finding {
+	var findings []Finding
+	for i, s := range report.Automated {
+		if i == maxSessionFindings {
+			break
+		}
+		findings = append(findings, Finding{
+			ID:       "session-automated",
+			Severity: SeverityMedium,
+			Title:    fmt.Sprintf("%s sent %d requests in one session at %.0f per minute", s.Client, s.Requests, s.RequestsPerMinute),
+			Description: fmt.Sprintf("Client %s kept up %.0f requests per minute through Web ACL %s from %s to %s, faster than people browse; %d of its %d requests were blocked. It requested %s. Consider a rate-based rule or Bot Control for the paths it used.",
+				s.Client, s.RequestsPerMinute, webACLName, s.Start.Format(time.RFC3339), s.End.Format(time.RFC3339), s.Blocked, s.Requests, sessionPaths(s.Paths)),
+			Source:   "sessions",
+			Evidence: s.evidence(),
+		})
+	}
+	for i, s := range report.Abusive {
+		if i == maxSessionFindings {
+			break
+		}
+		severity := SeverityMedium
+		if s.Blocked == s.Requests {
+			severity = SeverityLow
+		}
+		findings = append(findings, Finding{
+			ID:       "session-abusive",
+			Severity: severity,
+			Title:    fmt.Sprintf("%s kept going after %d of %d requests in one session were blocked", s.Client, s.Blocked, s.Requests),
+			Description: fmt.Sprintf("Client %s went on sending requests through Web ACL %s from %s to %s although %.0f%% of them were blocked, so %d got through. It requested %s. Consider blocking the client for the rest of its session, e.g. with a rate-based rule scoped to blocked labels.",
+				s.Client, webACLName, s.Start.Format(time.RFC3339), s.End.Format(time.RFC3339), s.BlockRatio*100, s.Requests-s.Blocked, sessionPaths(s.Paths)),
+			Source:   "sessions",
+			Evidence: s.evidence(),
+		})
+	}
+	return findings
+}
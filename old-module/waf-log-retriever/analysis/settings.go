@@ -0,0 +1,224 @@
+package analysis
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+	_ "time/tzdata" // Time zones must resolve on hosts without a zoneinfo database
+)
+
+// Settings tune the built-in detectors. They are read from a JSON file passed to
+// analyze with -settings; fields missing from the file keep their defaults.
+type Settings struct {
+	Auth            AuthSettings           `json:"auth"`
+	API             APISettings            `json:"api"`
+	Fingerprints    FingerprintSettings    `json:"fingerprints"`
+	Challenge       ChallengeSettings      `json:"challenge"`
+	Sessions        SessionSettings        `json:"sessions"`
+	ClientIdentity  ClientIdentitySettings `json:"clientIdentity"`  // Client requests are attributed to in every aggregation
+	Scoring         ScoringSettings        `json:"scoring"`         // Severity scoring model; usually loaded with -scoring
+	Assets          []Asset                `json:"assets"`          // Criticality and data classification of hosts and paths; usually loaded with -assets
+	PolicyTemplate  *PolicyTemplate        `json:"policyTemplate"`  // Baseline the Web ACL is scored against; usually loaded with -policy-template
+	EndpointClasses []EndpointClass        `json:"endpointClasses"` // Usually loaded with -endpoint-classes
+	Hosts           []string               `json:"hosts"`           // Only analyze these hosts (see MatchHost); usually set with -host
+	ExpectedHosts   []string               `json:"expectedHosts"`   // Hosts the Web ACL's sites are served under (see MatchHost); others are reported as unexpected
+	Sources         []string               `json:"sources"`         // Only analyze these sources (see IncludesSource); usually set with -source
+	AccountNames    map[string]string      `json:"accountNames"`    // Friendly names by account ID, e.g. "Payments Prod"; preferred to names recorded at retrieval
+	TimeZone        string                 `json:"timeZone"`        // IANA time zone of the heatmap and time profile, e.g. Europe/Berlin
+	Suppressions    []Suppression          `json:"suppressions"`    // Known-benign traffic to leave out; usually loaded with -suppressions
+	TestWindows     []TestWindow           `json:"testWindows"`     // Authorized testing periods; usually loaded with -test-windows
+
+	location *time.Location
+}
+
+// OtherEndpointClass is the class of URIs that match no configured endpoint class
+const OtherEndpointClass = "other"
+
+// EndpointClass is a business-relevant group of endpoints, such as login, search,
+// checkout, admin or static
+type EndpointClass struct {
+	Name     string   `json:"name"`
+	Patterns []string `json:"patterns"` // URI patterns, see MatchURI
+}
+
+// AuthSettings configure the credential-stuffing and brute-force detector
+type AuthSettings struct {
+	Endpoints         []string `json:"endpoints"`         // Login and token URIs; a trailing * matches any suffix
+	Methods           []string `json:"methods"`           // HTTP methods of login attempts
+	WindowMinutes     int      `json:"windowMinutes"`     // Length of the windows requests are counted in
+	MinRequests       int64    `json:"minRequests"`       // Attempts per window that make a window suspicious
+	MinClientIPs      int      `json:"minClientIps"`      // Distinct IPs in a suspicious window that indicate rotation
+	LowAndSlowWindows int      `json:"lowAndSlowWindows"` // Windows an IP must return in, below the thresholds, to be low-and-slow
+}
+
+// APISettings configure the API abuse and enumeration detector
+type APISettings struct {
+	MinEnumerationIDs  int     `json:"minEnumerationIds"`  // Distinct numeric IDs of one endpoint a client must request
+	MinSequentialShare float64 `json:"minSequentialShare"` // Share of those IDs that must be consecutive
+	MinDistinctPaths   int     `json:"minDistinctPaths"`   // Distinct URIs that make a client a path prober
+	MinPeakPerMinute   int64   `json:"minPeakPerMinute"`   // Requests per minute an endpoint spike must reach
+	VelocityFactor     float64 `json:"velocityFactor"`     // How many times the median minute a spike must be
+}
+
+// DefaultSettings returns the settings used when no settings file is given
+func DefaultSettings() *Settings {
+	return &Settings{
+		Auth: AuthSettings{
+			Endpoints: []string{
+				"/login*", "/signin*", "/sign-in*", "/logon*", "/auth*", "/session*",
+				"/oauth/token*", "/oauth2/token*", "/token*", "/api/login*", "/api/auth*",
+				"/wp-login.php*", "/user/login*", "/account/login*",
+			},
+			Methods:           []string{"POST"},
+			WindowMinutes:     5,
+			MinRequests:       100,
+			MinClientIPs:      10,
+			LowAndSlowWindows: 24,
+		},
+		API: APISettings{
+			MinEnumerationIDs:  50,
+			MinSequentialShare: 0.8,
+			MinDistinctPaths:   500,
+			MinPeakPerMinute:   300,
+			VelocityFactor:     10,
+		},
+		Fingerprints: FingerprintSettings{
+			MinClientIPs:         20,
+			MinMaliciousRequests: 100,
+			MinMaliciousShare:    0.9,
+		},
+		Challenge: ChallengeSettings{
+			MinRequests:        100,
+			MinAutomationShare: 0.2,
+			MaxAttackShare:     0.05,
+			MinBrowserShare:    0.5,
+		},
+		Sessions: SessionSettings{
+			IdleMinutes:          30,
+			MinRequests:          50,
+			MaxRequestsPerMinute: 60,
+			MinBlockRatio:        0.5,
+		},
+		ClientIdentity: ClientIdentitySettings{Mode: "ip"},
+		Scoring: ScoringSettings{
+			Weights:     ScoringWeights{Criticality: 1},
+			VolumeScale: 10000,
+		},
+		TimeZone: "UTC",
+		location: time.UTC,
+	}
+}
+
+// LoadSettings reads a settings file over the defaults; an empty path returns the defaults
+func LoadSettings(path string) (*Settings, error) {
+	settings := DefaultSettings()
+	if path == "" {
+		return settings, nil
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read settings file: %w", err)
+	}
+	if err := json.Unmarshal(data, settings); err != nil {
+		return nil, fmt.Errorf("failed to parse settings file %s: %w", path, err)
+	}
+	if err := settings.compile(); err != nil {
+		return nil, fmt.Errorf("settings file %s: %w", path, err)
+	}
+	return settings, nil
+}
+
+// compile validates settings decoded from JSON and prepares their time zone,
+// suppressions and test windows
+func (s *Settings) compile() error {
+	if s.Auth.WindowMinutes <= 0 {
+		return fmt.Errorf("auth.windowMinutes must be positive")
+	}
+	if s.Sessions.IdleMinutes <= 0 {
+		return fmt.Errorf("sessions.idleMinutes must be positive")
+	}
+	if err := s.ClientIdentity.Validate(); err != nil {
+		return fmt.Errorf("clientIdentity: %w", err)
+	}
+	if err := s.Scoring.Validate(); err != nil {
+		return err
+	}
+	if err := compileAssets(s.Assets); err != nil {
+		return err
+	}
+	if err := compileSources(s.Sources); err != nil {
+		return err
+	}
+	if err := s.SetTimeZone(s.TimeZone); err != nil {
+		return err
+	}
+	if err := compileSuppressions(s.Suppressions); err != nil {
+		return err
+	}
+	return compileTestWindows(s.TestWindows)
+}
+
+// SetTimeZone sets the time zone of the heatmap and time profile
+func (s *Settings) SetTimeZone(name string) error {
+	location, err := time.LoadLocation(name)
+	if err != nil {
+		return fmt.Errorf("unknown time zone %q: %w", name, err)
+	}
+	s.TimeZone, s.location = location.String(), location
+	return nil
+}
+
+// Location returns the configured time zone, UTC if none is set
+func (s *Settings) Location() *time.Location {
+	if s.location == nil {
+		return time.UTC
+	}
+	return s.location
+}
+
+// LoadEndpointClasses reads an endpoint classification file: a JSON array of
+// endpoint classes, where the first class with a matching pattern wins
+func LoadEndpointClasses(path string) ([]EndpointClass, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read endpoint classification file: %w", err)
+	}
+	var classes []EndpointClass
+	if err := json.Unmarshal(data, &classes); err != nil {
+		return nil, fmt.Errorf("failed to parse endpoint classification file %s: %w", path, err)
+	}
+	for _, class := range classes {
+		if class.Name == "" || class.Name == OtherEndpointClass {
+			return nil, fmt.Errorf("endpoint classification file %s: class names must be set and not %q", path, OtherEndpointClass)
+		}
+	}
+	return classes, nil
+}
+
+// ClassifyEndpoint returns the endpoint class of a URI, OtherEndpointClass if it
+// matches none, or "" if no endpoint classes are configured
+func (s *Settings) ClassifyEndpoint(uri string) string {
+	if len(s.EndpointClasses) == 0 {
+		return ""
+	}
+	for _, class := range s.EndpointClasses {
+		for _, pattern := range class.Patterns {
+			if MatchURI(pattern, uri) {
+				return class.Name
+			}
+		}
+	}
+	return OtherEndpointClass
+}
+
+// MatchURI reports whether a URI matches a pattern, case-insensitively. A pattern
+// ending in * matches any URI starting with the rest of it; others match exactly.
+func MatchURI(pattern, uri string) bool {
+	pattern, uri = strings.ToLower(pattern), strings.ToLower(uri)
+	if prefix, ok := strings.CutSuffix(pattern, "*"); ok {
+		return strings.HasPrefix(uri, prefix)
+	}
+	return uri == pattern
+}
@@ -0,0 +1,358 @@
+package analysis
+
+import (
+	"errors"
+	"fmt"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"waf-log-retriever/storage"
+)
+
+// Statement verbs
+const (
+	VerbTop   = "top"   // Busiest values of a dimension among the matching records
+	VerbCount = "count" // Number of matching records
+	VerbShow  = "show"  // Matching records themselves
+)
+
+// Statement is one query of the interactive prompt, e.g.
+// `top ips where action=BLOCK and country=US last 24h limit 20`
+type Statement struct {
+	Verb      string
+	Dimension string        // What top counts, see Dimensions
+	Query     Query         // From the where clause
+	Last      time.Duration // Only records this long before the end of the dataset; 0 for all
+	Limit     int           // Values or records shown
+}
+
+// DefaultStatementLimit is the number of values or records shown without a limit clause
+const DefaultStatementLimit = 10
+
+// Dimensions are what top counts records by, each returning the values a record adds
+// to, e.g. every label it carries
+var Dimensions = map[string]func(r *Record) []string{
+	"ips":         func(r *Record) []string { return []string{r.HTTPRequest.ClientIP} },
+	"countries":   func(r *Record) []string { return []string{r.HTTPRequest.Country} },
+	"hosts":       func(r *Record) []string { return []string{r.Host()} },
+	"uris":        func(r *Record) []string { return []string{r.HTTPRequest.URI} },
+	"endpoints":   func(r *Record) []string { return []string{EndpointTemplate(r.HTTPRequest.URI)} },
+	"methods":     func(r *Record) []string { return []string{r.HTTPRequest.HTTPMethod} },
+	"actions":     func(r *Record) []string { return []string{r.Action} },
+	"rules":       func(r *Record) []string { return []string{r.TerminatingRuleID} },
+	"labels":      recordLabels,
+	"user-agents": func(r *Record) []string { return []string{r.HeaderValue("User-Agent")} },
+	"scanners":    func(r *Record) []string { return []string{IdentifyScanner(r)} },
+	"ja3":         func(r *Record) []string { return []string{r.JA3Fingerprint} },
+	"ja4":         func(r *Record) []string { return []string{r.JA4Fingerprint} },
+}
+
+// hotDimensions are the dimensions top can count from the HotFields of a record,
+// without decoding it
+var hotDimensions = map[string]func(f *HotFields) []byte{
+	"ips":       func(f *HotFields) []byte { return f.ClientIP },
+	"countries": func(f *HotFields) []byte { return f.Country },
+	"uris":      func(f *HotFields) []byte { return f.URI },
+	"actions":   func(f *HotFields) []byte { return f.Action },
+	"rules":     func(f *HotFields) []byte { return f.TerminatingRuleID },
+}
+
+// DimensionNames returns the names of the dimensions, sorted
+func DimensionNames() []string {
+	names := make([]string, 0, len(Dimensions))
+	for name := range Dimensions {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// recordLabels returns the names of the labels of a record
+func recordLabels(r *Record) []string {
+	labels := make([]string, 0, len(r.Labels))
+	for _, l := range r.Labels {
+		labels = append(labels, l.Name)
+	}
+	return labels
+}
+
+// ConditionKeys are the keys of where conditions, named like the flags of search
+var ConditionKeys = []string{"ip", "uri", "args", "header", "rule", "action", "host", "country", "request-id", "text", "from", "to"}
+
+// ParseStatement parses a statement:
+//
+//	top <dimension> [where <key>=<value> [and ...]] [last <duration>] [limit <n>]
+//	count [where ...] [last <duration>]
+//	show [where ...] [last <duration>] [limit <n>]
+//
+// Values with spaces are double-quoted; durations are Go durations or days, e.g. 7d.
+// The query of the statement is compiled.
+func ParseStatement(line string) (*Statement, error) {
+	tokens, err := tokenize(line)
+	if err != nil {
+		return nil, err
+	}
+	if len(tokens) == 0 {
+		return nil, errors.New("empty statement")
+	}
+	s := &Statement{Verb: strings.ToLower(tokens[0]), Limit: DefaultStatementLimit}
+	tokens = tokens[1:]
+	switch s.Verb {
+	case VerbTop:
+		if len(tokens) == 0 {
+			return nil, fmt.Errorf("top needs a dimension: %s", strings.Join(DimensionNames(), ", "))
+		}
+		s.Dimension = strings.ToLower(tokens[0])
+		if Dimensions[s.Dimension] == nil {
+			return nil, fmt.Errorf("unknown dimension %q (known: %s)", tokens[0], strings.Join(DimensionNames(), ", "))
+		}
+		tokens = tokens[1:]
+	case VerbCount, VerbShow:
+	default:
+		return nil, fmt.Errorf("unknown statement %q (want %s, %s or %s)", tokens[0], VerbTop, VerbCount, VerbShow)
+	}
+
+	for len(tokens) > 0 {
+		clause := strings.ToLower(tokens[0])
+		switch clause {
+		case "where", "and":
+			if len(tokens) < 2 {
+				return nil, fmt.Errorf("%s needs a <key>=<value> condition", clause)
+			}
+			if err := s.Query.setCondition(tokens[1]); err != nil {
+				return nil, err
+			}
+		case "last":
+			if len(tokens) < 2 {
+				return nil, errors.New("last needs a duration, e.g. 24h or 7d")
+			}
+			if s.Last, err = parseLast(tokens[1]); err != nil {
+				return nil, err
+			}
+		case "limit":
+			if len(tokens) < 2 {
+				return nil, errors.New("limit needs a number")
+			}
+			if s.Limit, err = strconv.Atoi(tokens[1]); err != nil || s.Limit <= 0 {
+				return nil, fmt.Errorf("invalid limit %q", tokens[1])
+			}
+		default:
+			return nil, fmt.Errorf("unexpected %q (want where, and, last or limit)", tokens[0])
+		}
+		tokens = tokens[2:]
+	}
+	if s.Last > 0 && !s.Query.From.IsZero() {
+		return nil, errors.New("use either last or from, not both")
+	}
+	if err := s.Query.Compile(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// setCondition sets the criterion of a <key>=<value> condition
+func (q *Query) setCondition(condition string) error {
+	key, value, ok := strings.Cut(condition, "=")
+	if !ok || value == "" {
+		return fmt.Errorf("invalid condition %q (want <key>=<value>)", condition)
+	}
+	var err error
+	switch strings.ToLower(key) {
+	case "ip":
+		q.IP = value
+	case "uri":
+		q.URI = value
+	case "args":
+		q.Args = value
+	case "header":
+		q.Header = value // name=value conditions keep their second =
+	case "rule":
+		q.Rule = value
+	case "action":
+		q.Action = strings.ToUpper(value)
+	case "host":
+		q.Host = value
+	case "country":
+		q.Country = value
+	case "request-id":
+		q.RequestID = value
+	case "text":
+		q.Text = value
+	case "from":
+		q.From, err = parseStatementTime(value)
+	case "to":
+		q.To, err = parseStatementTime(value)
+	default:
+		return fmt.Errorf("unknown condition key %q (known: %s)", key, strings.Join(ConditionKeys, ", "))
+	}
+	return err
+}
+
+// parseStatementTime parses the time of a from or to condition
+func parseStatementTime(value string) (time.Time, error) {
+	for _, layout := range []string{time.RFC3339, "2006-01-02T15:04Z", "2006-01-02"} {
+		if t, err := time.Parse(layout, value); err == nil {
+			return t, nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("invalid time %q (want YYYY-MM-DD, YYYY-MM-DDTHH:mmZ or RFC 3339)", value)
+}
+
+// parseLast parses the duration of a last clause: a Go duration, or days such as 7d
+func parseLast(value string) (time.Duration, error) {
+	var d time.Duration
+	var err error
+	if days, ok := strings.CutSuffix(value, "d"); ok {
+		var n int
+		n, err = strconv.Atoi(days)
+		d = time.Duration(n) * 24 * time.Hour
+	} else {
+		d, err = time.ParseDuration(value)
+	}
+	if err != nil || d <= 0 {
+		return 0, fmt.Errorf("invalid duration %q (want e.g. 30m, 24h or 7d)", value)
+	}
+	return d, nil
+}
+
+// tokenize splits a statement at spaces, keeping double-quoted parts together
+// without their quotes, e.g. uri="/a b" is one token
+func tokenize(line string) ([]string, error) {
+	var tokens []string
+	var token strings.Builder
+	inToken, quoted := false, false
+	for _, c := range line {
+		switch {
+		case c == '"':
+			quoted = !quoted
+			inToken = true
+		case !quoted && (c == ' ' || c == '\t'):
+			if inToken {
+				tokens = append(tokens, token.String())
+				token.Reset()
+				inToken = false
+			}
+		default:
+			token.WriteRune(c)
+			inToken = true
+		}
+	}
+	if quoted {
+		return nil, errors.New("unterminated quote")
+	}
+	if inToken {
+		tokens = append(tokens, token.String())
+	}
+	return tokens, nil
+}
+
+// StatementResult is the outcome of a statement
+type StatementResult struct {
+	Matched int64   // Matching records
+	Top     []Count // Busiest values, for top
+	Scanned int     // Log files read; files outside the time window are skipped
+}
+
+// Run executes the statement over the log files below root. end is the end of the
+// dataset, which a last clause counts back from; show passes at most Limit matching
+// records to fn. Counts, and tops of hot dimensions, whose conditions are all on hot
+// fields are taken from the scanned HotFields of the records without decoding them.
+func (s *Statement) Run(root string, files []string, end time.Time, fn func(r *Record, raw []byte) error) (*StatementResult, error) {
+	q := s.Query
+	if s.Last > 0 {
+		q.From = end.Add(-s.Last)
+		if err := q.Compile(); err != nil {
+			return nil, err
+		}
+	}
+	result := &StatementResult{}
+	counts := make(map[string]int64)
+	dimension := Dimensions[s.Dimension]
+	hotDimension := hotDimensions[s.Dimension]
+	hot := q.HotOnly() && (s.Verb == VerbCount || s.Verb == VerbTop && hotDimension != nil)
+	for _, file := range files {
+		if !q.MayContain(root, file) {
+			continue
+		}
+		result.Scanned++
+		if hot {
+			err := q.ForEachHotMatch(file, func(f *HotFields) error {
+				result.Matched++
+				if s.Verb == VerbTop {
+					counts[string(hotDimension(f))]++
+				}
+				return nil
+			})
+			if err != nil {
+				return nil, err
+			}
+			continue
+		}
+		err := q.ForEachMatch(file, func(r *Record, raw []byte) error {
+			result.Matched++
+			switch s.Verb {
+			case VerbTop:
+				for _, value := range dimension(r) {
+					counts[value]++
+				}
+			case VerbShow:
+				if err := fn(r, raw); err != nil {
+					return err
+				}
+				if result.Matched >= int64(s.Limit) {
+					return errStatementLimit
+				}
+			}
+			return nil
+		})
+		if errors.Is(err, errStatementLimit) {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	if s.Verb == VerbTop {
+		delete(counts, "")
+		result.Top = TopN(counts, s.Limit)
+	}
+	return result, nil
+}
+
+// QueryResult is the outcome of a saved query run with an analysis
+type QueryResult struct {
+	Name        string  `json:"name"`
+	Description string  `json:"description,omitempty"`
+	Statement   string  `json:"statement"`
+	Matched     int64   `json:"matched"`       // Matching records
+	Top         []Count `json:"top,omitempty"` // Busiest values, for top statements
+}
+
+// errStatementLimit stops a show statement once it has shown enough records
+var errStatementLimit = errors.New("statement limit reached")
+
+// DatasetEnd returns the end of the time covered by the log files below root: the end
+// of their latest hourly, daily or hive partition (see storage.Layouts), or the zero
+// time if none is in one
+func DatasetEnd(root string, files []string) time.Time {
+	var end time.Time
+	dirs := make(map[string]bool)
+	for _, file := range files {
+		dir := filepath.Dir(file)
+		if dirs[dir] {
+			continue
+		}
+		dirs[dir] = true
+		rel, err := filepath.Rel(root, dir)
+		if err != nil {
+			continue
+		}
+		if _, start, length, ok := storage.ParsePartition(rel); ok && start.Add(length).After(end) {
+			end = start.Add(length)
+		}
+	}
+	return end
+}
@@ -0,0 +1,173 @@
+package analysis
+
+import (
+	"sort"
+	"time"
+)
+
+// Stats holds the aggregate statistics computed over a set of WAF records
+type Stats struct {
+	TotalRequests    int64            `json:"totalRequests"`
+	FirstSeen        time.Time        `json:"firstSeen"`
+	LastSeen         time.Time        `json:"lastSeen"`
+	Actions          map[string]int64 `json:"actions"`
+	TerminatingRules map[string]int64 `json:"terminatingRules"`
+	Countries        map[string]int64 `json:"countries"`
+	ClientIPs        map[string]int64 `json:"clientIps"`  // By client identity, see ClientIdentitySettings
+	BlockedIPs       map[string]int64 `json:"blockedIps"` // By client address
+	URIs             map[string]int64 `json:"uris"`
+	Methods          map[string]int64 `json:"methods"`
+
+	// Rule matches that did not terminate the request, at Web ACL level and by rule group
+	NonTerminatingRules map[string]int64                     `json:"nonTerminatingRules"`
+	RuleGroups          map[string]map[string]*SubRuleCounts `json:"ruleGroups"` // Rule group ID -> rule ID
+
+	AttackCategories map[string]*AttackCounts      `json:"attackCategories"` // By OWASP Top 10 category ID
+	Scanners         map[string]*ScannerCounts     `json:"scanners"`         // By scanner name, see scanners.json
+	TLSFingerprints  map[string]*FingerprintCounts `json:"tlsFingerprints"`  // By "ja3:<fingerprint>" or "ja4:<fingerprint>"
+	Challenge        map[string]*ChallengeCounts   `json:"challenge"`        // By "asn:<number>", "ja3:"/"ja4:<fingerprint>" or "path:<uri>"
+	Auth             *AuthStats                    `json:"auth"`             // Login attempts, see AuthSettings
+	API              *APIStats                     `json:"-"`
+	Sessions         *SessionStats                 `json:"-"` // Requests by client session, see SessionSettings
+
+	// Per-endpoint statistics by endpoint class; empty unless classes are configured
+	EndpointClasses map[string]*ClassStats `json:"endpointClasses"`
+
+	Assets map[string]*AssetCounts `json:"assets"` // By asset name; empty unless an asset map is given
+
+	Sources map[string]*SourceCounts `json:"sources,omitempty"` // By source, see SourceKey; nil for per-host statistics
+
+	Origins map[string]*OriginCounts `json:"origins"` // By country code
+
+	Heatmap *Heatmap `json:"heatmap"` // Requests by day of week and hour
+
+	Hosts map[string]*Stats `json:"hosts,omitempty"` // Everything above by Host header
+
+	AuthorizedTesting *Stats `json:"authorizedTesting,omitempty"` // Everything above for traffic in test windows
+
+	Latency *LatencyStats `json:"-"` // nil unless a record carried a latency field
+
+	BodyInspection *BodyInspectionStats `json:"bodyInspection,omitempty"` // nil unless a record carried body sizes
+
+	HostAnomalies map[string]*HostAnomalyCounts `json:"hostAnomalies,omitempty"` // By kind, see hostAnomalies; nil unless a record had one
+
+	Suppressed map[string]int64 `json:"suppressed,omitempty"` // Records left out of everything above, by suppression name
+	Filtered   int64            `json:"filtered,omitempty"`   // Records left out of everything above by the host or source filter
+
+	FileRecords map[string]int64 `json:"fileRecords,omitempty"` // Records parsed by log file, relative to the Web ACL's directory; nil for per-host statistics
+
+	// Records and log files of partials migrated from before FileRecords was kept,
+	// which have no count by log file; see partialMigrations
+	UncountedRecords int64    `json:"uncountedRecords,omitempty"`
+	UncountedFiles   []string `json:"uncountedFiles,omitempty"`
+
+	columns  *recordColumns // Records added since the count tables were last complete, see Finalize
+	settings *Settings
+}
+
+// NewStats creates an empty Stats instance; nil settings use DefaultSettings
+func NewStats(settings *Settings) *Stats {
+	if settings == nil {
+		settings = DefaultSettings()
+	}
+	return &Stats{
+		Actions:          make(map[string]int64),
+		TerminatingRules: make(map[string]int64),
+		Countries:        make(map[string]int64),
+		ClientIPs:        make(map[string]int64),
+		BlockedIPs:       make(map[string]int64),
+		URIs:             make(map[string]int64),
+		Methods:          make(map[string]int64),
+
+		NonTerminatingRules: make(map[string]int64),
+		RuleGroups:          make(map[string]map[string]*SubRuleCounts),
+
+		AttackCategories: make(map[string]*AttackCounts),
+		Scanners:         make(map[string]*ScannerCounts),
+		TLSFingerprints:  make(map[string]*FingerprintCounts),
+		Challenge:        make(map[string]*ChallengeCounts),
+		Auth:             newAuthStats(),
+		API:              newAPIStats(),
+		Sessions:         newSessionStats(time.Duration(settings.Sessions.IdleMinutes) * time.Minute),
+
+		EndpointClasses: make(map[string]*ClassStats),
+		Assets:          make(map[string]*AssetCounts),
+		Sources:         make(map[string]*SourceCounts),
+		Origins:         make(map[string]*OriginCounts),
+		Heatmap:         &Heatmap{TimeZone: settings.Location().String()},
+		Hosts:           make(map[string]*Stats),
+
+		settings: settings,
+	}
+}
+
+// Add folds a single record into the aggregate. The big count tables, from Actions
+// to Methods, only include it once Finalize is called.
+func (s *Stats) Add(r *Record) {
+	s.TotalRequests++
+
+	ts := r.Time()
+	if s.FirstSeen.IsZero() || ts.Before(s.FirstSeen) {
+		s.FirstSeen = ts
+	}
+	if ts.After(s.LastSeen) {
+		s.LastSeen = ts
+	}
+
+	// Clients are counted by their configured identity, but blocklists need addresses
+	client := s.settings.ClientID(r)
+	s.addColumns(r, client)
+	s.addRuleGroups(r)
+	categories := s.addAttackCategories(r)
+	s.addEndpointClass(r, categories, client)
+	scanner := s.addScanner(r, client)
+	s.addFingerprints(r, categories, scanner, client)
+	s.addAsset(r, categories, scanner)
+	s.addSource(r, categories, scanner)
+	s.addOrigin(r, categories, scanner)
+	s.addChallenge(r, categories, scanner)
+	s.addAuth(r, client)
+	s.addAPI(r, client)
+	s.addSession(r, client)
+	s.addHeatmap(r)
+	s.addHostAnomalies(r, client)
+	s.addHost(r)
+	s.addTesting(r)
+	if ms, ok := r.WAFLatency(); ok {
+		if s.Latency == nil {
+			s.Latency = NewLatencyStats()
+		}
+		s.Latency.Add(r, ms)
+	}
+	if size, inspected, ok := r.BodySizes(); ok {
+		if s.BodyInspection == nil {
+			s.BodyInspection = NewBodyInspectionStats()
+		}
+		s.BodyInspection.Add(r, size, inspected)
+	}
+}
+
+// Count is a key with its number of occurrences
+type Count struct {
+	Key   string `json:"key"`
+	Count int64  `json:"count"`
+}
+
+// TopN returns the n largest entries of a count map, ordered by count then key.
+// A non-positive n returns all entries.
+func TopN(counts map[string]int64, n int) []Count {
+	result := make([]Count, 0, len(counts))
+	for k, v := range counts {
+		result = append(result, Count{Key: k, Count: v})
+	}
+	sort.Slice(result, func(i, j int) bool {
+		if result[i].Count != result[j].Count {
+			return result[i].Count > result[j].Count
+		}
+		return result[i].Key < result[j].Key
+	})
+	if n > 0 && len(result) > n {
+		result = result[:n]
+	}
+	return result
+}
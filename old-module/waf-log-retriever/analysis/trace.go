@@ -0,0 +1,178 @@
+package analysis
+
+import (
+	"encoding/json"
+	"errors"
+	"sort"
+	"time"
+)
+
+// errStopScan stops a scan over log files once it found what it looked for
+var errStopScan = errors.New("scan stopped")
+
+// TraceRule is a rule that matched the traced request
+type TraceRule struct {
+	RuleGroup string `json:"ruleGroup,omitempty"`
+	RuleID    string `json:"ruleId"`
+	Action    string `json:"action,omitempty"`
+	Match     string `json:"match"` // terminating, non-terminating, excluded or rate-based
+}
+
+// TraceEvent is one request of the client's timeline around the traced request
+type TraceEvent struct {
+	Time      time.Time `json:"time"`
+	RequestID string    `json:"requestId"`
+	Action    string    `json:"action"`
+	Method    string    `json:"method"`
+	URI       string    `json:"uri"`
+	Args      string    `json:"args,omitempty"`
+	Rule      string    `json:"terminatingRule"`
+	Focus     bool      `json:"focus,omitempty"` // The traced request itself
+}
+
+// Trace is the reconstructed context of a single request
+type Trace struct {
+	Record   *Record         `json:"-"`
+	Raw      json.RawMessage `json:"record"`
+	Rules    []TraceRule     `json:"matchedRules"`
+	Labels   []string        `json:"labels"`
+	From     time.Time       `json:"from"` // Window of the timeline
+	To       time.Time       `json:"to"`
+	Timeline []TraceEvent    `json:"timeline"`
+	Before   int             `json:"omittedBefore"` // Timeline requests left out before and after the shown ones
+	After    int             `json:"omittedAfter"`
+	ALBLines []string        `json:"albLogLines,omitempty"`
+}
+
+// FindRequest returns the first record with the request ID in the log files, or
+// nil if there is none
+func FindRequest(files []string, requestID string) (*Record, []byte, error) {
+	q := Query{RequestID: requestID}
+	if err := q.Compile(); err != nil {
+		return nil, nil, err
+	}
+	var found *Record
+	var foundRaw []byte
+	for _, file := range files {
+		err := q.ForEachMatch(file, func(r *Record, raw []byte) error {
+			found, foundRaw = r, append([]byte(nil), raw...)
+			return errStopScan
+		})
+		if errors.Is(err, errStopScan) {
+			break
+		}
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+	return found, foundRaw, nil
+}
+
+// FindNearest returns the record from a client IP closest in time to around, within
+// window on either side, or nil if there is none. root is the directory of the
+// hourly log layout, so that files outside the window are not read.
+func FindNearest(root string, files []string, ip string, around time.Time, window time.Duration) (*Record, []byte, error) {
+	q := Query{IP: ip, From: around.Add(-window), To: around.Add(window)}
+	if err := q.Compile(); err != nil {
+		return nil, nil, err
+	}
+	var nearest *Record
+	var nearestRaw []byte
+	var best time.Duration
+	for _, file := range files {
+		if !q.MayContain(root, file) {
+			continue
+		}
+		err := q.ForEachMatch(file, func(r *Record, raw []byte) error {
+			d := r.Time().Sub(around).Abs()
+			if nearest == nil || d < best {
+				nearest, nearestRaw, best = r, append([]byte(nil), raw...), d
+			}
+			return nil
+		})
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+	return nearest, nearestRaw, nil
+}
+
+// BuildTrace reconstructs the context of a record: its matched rules and labels, and
+// the requests of the same client within window on either side, at most context of
+// them before and after it
+func BuildTrace(root string, files []string, r *Record, raw []byte, window time.Duration, context int) (*Trace, error) {
+	t := &Trace{
+		Record: r,
+		Raw:    raw,
+		Rules:  traceRules(r),
+		Labels: []string{},
+		From:   r.Time().Add(-window),
+		To:     r.Time().Add(window),
+	}
+	for _, l := range r.Labels {
+		t.Labels = append(t.Labels, l.Name)
+	}
+
+	q := Query{IP: r.HTTPRequest.ClientIP, From: t.From, To: t.To}
+	if err := q.Compile(); err != nil {
+		return nil, err
+	}
+	var events []TraceEvent
+	for _, file := range files {
+		if !q.MayContain(root, file) {
+			continue
+		}
+		err := q.ForEachMatch(file, func(n *Record, _ []byte) error {
+			events = append(events, TraceEvent{
+				Time:      n.Time(),
+				RequestID: n.HTTPRequest.RequestID,
+				Action:    n.Action,
+				Method:    n.HTTPRequest.HTTPMethod,
+				URI:       n.HTTPRequest.URI,
+				Args:      n.HTTPRequest.Args,
+				Rule:      n.TerminatingRuleID,
+				Focus:     n.Timestamp == r.Timestamp && n.HTTPRequest.RequestID == r.HTTPRequest.RequestID,
+			})
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	sort.SliceStable(events, func(i, j int) bool { return events[i].Time.Before(events[j].Time) })
+
+	focus := sort.Search(len(events), func(i int) bool { return !events[i].Time.Before(r.Time()) })
+	for i, e := range events {
+		if e.Focus {
+			focus = i
+			break
+		}
+	}
+	start, end := max(focus-context, 0), min(focus+context+1, len(events))
+	t.Timeline, t.Before, t.After = events[start:end], start, len(events)-end
+	return t, nil
+}
+
+// traceRules lists the rules that matched a record, the Web ACL's terminating rule
+// first and then the rules inside rule groups
+func traceRules(r *Record) []TraceRule {
+	rules := []TraceRule{{RuleID: r.TerminatingRuleID, Action: r.Action, Match: "terminating"}}
+	for _, m := range r.NonTerminatingMatchingRules {
+		rules = append(rules, TraceRule{RuleID: m.RuleID, Action: m.Action, Match: "non-terminating"})
+	}
+	for _, rb := range r.RateBasedRuleList {
+		rules = append(rules, TraceRule{RuleID: rb.RateBasedRuleName, Match: "rate-based"})
+	}
+	for _, g := range r.RuleGroupList {
+		if g.TerminatingRule != nil {
+			rules = append(rules, TraceRule{RuleGroup: g.RuleGroupID, RuleID: g.TerminatingRule.RuleID, Action: g.TerminatingRule.Action, Match: "terminating"})
+		}
+		for _, m := range g.NonTerminatingMatchingRules {
+			rules = append(rules, TraceRule{RuleGroup: g.RuleGroupID, RuleID: m.RuleID, Action: m.Action, Match: "non-terminating"})
+		}
+		for _, m := range g.ExcludedRules {
+			rules = append(rules, TraceRule{RuleGroup: g.RuleGroupID, RuleID: m.RuleID, Action: m.Action, Match: "excluded"})
+		}
+	}
+	return rules
+}
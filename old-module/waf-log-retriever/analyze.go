@@ -0,0 +1,703 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"net"
+	"net/netip"
+	"path/filepath"
+	"runtime"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"waf-log-retriever/analysis"
+	"waf-log-retriever/checks"
+	"waf-log-retriever/logging"
+	"waf-log-retriever/narrative"
+	"waf-log-retriever/resolve"
+	"waf-log-retriever/telemetry"
+
+	"go.opentelemetry.io/otel/attribute"
+)
+
+// subcommands maps subcommand names to their entry points, which return the process exit code
+var subcommands = map[string]func(args []string) int{
+	"analyze":       runAnalyze,
+	"annotate":      runAnnotate,
+	"archive":       runArchive,
+	"bench":         runBench,
+	"blocklist":     runBlocklist,
+	"bundle":        runBundle,
+	"checkoff":      runCheckoff,
+	"demo":          runDemo,
+	"drift":         runDrift,
+	"encrypt":       runEncrypt,
+	"query":         runQuery,
+	"engagement":    runEngagement,
+	"hotspots":      runHotspots,
+	"import-urls":   runImportURLs,
+	"ingest":        runIngest,
+	"ip-report":     runIPReport,
+	"keygen":        runKeygen,
+	"manifest":      runManifest,
+	"merge":         runMerge,
+	"notebook":      runNotebook,
+	"origins":       runOrigins,
+	"rate-limits":   runRateLimits,
+	"scope-down":    runScopeDown,
+	"search":        runSearch,
+	"self-update":   runSelfUpdate,
+	"share":         runShare,
+	"simulate-rate": runSimulateRate,
+	"report":        runReport,
+	"repl":          runREPL,
+	"restore":       runRestore,
+	"sign":          runSign,
+	"status":        runStatus,
+	"storage":       runStorage,
+	"trace":         runTrace,
+	"trends":        runTrends,
+	"verify":        runVerify,
+	"version":       runVersion,
+
+	// Workflow presets, see presets.go
+	"download-only": presetCommand("download-only"),
+	"full-review":   presetCommand("full-review"),
+	"full":          presetCommand("full"),
+	"review":        presetCommand("review"),
+}
+
+// runAnalyze aggregates previously retrieved logs for one Web ACL and evaluates custom checks
+func runAnalyze(args []string) int {
+	fs := flag.NewFlagSet("analyze", flag.ExitOnError)
+	outputDir := fs.String("output-dir", "../logs/raw", "Directory containing retrieved logs")
+	profile := fs.String("profile", "", "AWS profile name the logs were retrieved with")
+	webACL := fs.String("web-acl", "", "Name of the Web ACL to analyze")
+	checksDir := fs.String("checks-dir", "", "Directory of custom check scripts (*.star)")
+	settingsFile := fs.String("settings", "", "JSON file tuning the built-in detectors (optional)")
+	timeZone := fs.String("time-zone", "", "IANA time zone of the heatmap and time profile, e.g. Europe/Berlin (default: UTC)")
+	hosts := fs.String("host", "", "Only analyze requests to these hosts (comma-separated; *.example.com matches subdomains)")
+	expectedHosts := fs.String("expected-hosts", "", "Hosts the Web ACL's sites are served under, to report requests to others (comma-separated; *.example.com matches subdomains; default: expectedHosts in the settings file, or the hosts of the asset map)")
+	sources := fs.String("source", "", "Only analyze records from these sources (comma-separated <account>/<region>/<web-acl> patterns, e.g. 123456789012/*/*)")
+	clientIdentity := fs.String("client-identity", "", "What to count clients by: ip, ip-user-agent or header:<name>, e.g. header:x-api-key (default: ip, or clientIdentity in the settings file)")
+	clientIPHeader := fs.String("client-ip-header", "", "Header holding the client's address behind a CDN or proxy, e.g. True-Client-IP or X-Forwarded-For (default: clientIp)")
+	narrativeFile := fs.String("narratives", "", "JSON file enabling model-drafted finding narratives through Bedrock or an OpenAI-compatible endpoint (optional)")
+	suppressionsFile := fs.String("suppressions", "", "JSON file of known-benign traffic (office IPs, health checks, pentest ranges) to leave out (optional)")
+	testWindowsFile := fs.String("test-windows", "", "JSON file of authorized testing windows, reported separately from other attack traffic (optional)")
+	scoringFile := fs.String("scoring", "", "JSON file weighting finding severities by volume, success and criticality of the assets hit (optional)")
+	policyTemplate := fs.String("policy-template", "", "Baseline to score the Web ACL against: "+strings.Join(analysis.PolicyTemplateNames(), ", ")+" or a template JSON file (optional)")
+	assetsFile := fs.String("assets", "", "JSON file mapping hosts and paths to assets with a criticality and data classification (optional)")
+	flowLogsDir := fs.String("flow-logs", "", "Directory of VPC Flow Logs of the origin's network interfaces, e.g. the ALB behind CloudFront, to find traffic that bypassed CloudFront and the Web ACL (optional)")
+	flowLogENIs := fs.String("flow-log-enis", "", "Network interfaces of the origin to read flows of (comma-separated, default: all in the flow logs)")
+	flowLogPorts := fs.String("flow-log-ports", "80,443", "Listener ports of the origin (comma-separated)")
+	albLogs := fs.String("alb-logs", "", "Directory of access logs of the load balancers behind CloudFront, to find requests that bypassed CloudFront and the Web ACL (optional)")
+	ipRanges := fs.String("ip-ranges", "", "AWS ip-ranges.json, to tell CloudFront's addresses in flow logs and ALB access logs apart from direct traffic (optional)")
+	reverseDNS := fs.Bool("reverse-dns", false, "Look up the reverse DNS names of attacker IPs to group attack infrastructure by hosting provider and domain (sends DNS queries for them)")
+	passiveDNSFile := fs.String("passive-dns", "", "JSON file enabling passive DNS lookups of attacker IPs through CIRCL or DNSDB (optional)")
+	attackerIPs := fs.Int("attacker-ips", 100, "Most blocked attacker IPs to look up with -reverse-dns or -passive-dns")
+	classesFile := fs.String("endpoint-classes", "", "JSON file classifying endpoints, e.g. login, search, checkout, admin, static (optional)")
+	logLevel := fs.String("log-level", "INFO", "Logging level (DEBUG, INFO, WARNING, ERROR)")
+	signKey := fs.String("sign-key", "", "PEM private key to sign the analysis result with (optional)")
+	samples := fs.Int("samples", 3, "Representative requests to embed as evidence per finding and for the busiest rules (0 disables)")
+	queries := fs.String("queries", "", "Saved queries of the review to run and include in the result (comma-separated names, or all)")
+	partialsDir := fs.String("partials", "", "Write a partial aggregate per log directory to this directory for merge, instead of a result")
+	recordCache := fs.Bool("record-cache", false, "Keep a binary copy of parsed log files, so later runs with other settings skip JSON parsing (uses extra disk space)")
+	noCache := fs.Bool("no-cache", false, "Parse every log file instead of reusing the cached aggregates of unchanged log directories")
+	gzipBlocks := fs.Int("gzip-blocks", analysis.DefaultGzipBlocks(), "Blocks of 1 MB of a gzipped log file to decompress ahead of parsing, on other cores")
+	otlpEndpoint := fs.String("otlp-endpoint", "", "OTLP/HTTP endpoint URL for OpenTelemetry traces and metrics (default: OTEL_EXPORTER_OTLP_ENDPOINT)")
+	forceUnlock := fs.Bool("force-unlock", false, "Take over the lock of the Web ACL's directory even if another run appears to hold it")
+	fs.Parse(args)
+
+	if *profile == "" || *webACL == "" {
+		fmt.Println("analyze requires -profile and -web-acl")
+		fs.Usage()
+		return 2
+	}
+	if *samples < 0 {
+		fmt.Println("-samples must not be negative")
+		return 2
+	}
+	if *attackerIPs <= 0 {
+		fmt.Println("-attacker-ips must be positive")
+		return 2
+	}
+	if *gzipBlocks < analysis.MinGzipBlocks {
+		fmt.Printf("-gzip-blocks must be at least %d\n", analysis.MinGzipBlocks)
+		return 2
+	}
+	analysis.SetGzipConcurrency(*gzipBlocks)
+
+	logger, err := logging.SetupLogger(*logLevel)
+	if err != nil {
+		fmt.Printf("Failed to initialize application: %v\n", err)
+		return 1
+	}
+	defer logger.Close()
+
+	shutdownTelemetry, err := telemetry.Setup(context.Background(), *otlpEndpoint)
+	if err != nil {
+		logger.Errorf("Failed to set up telemetry: %v", err)
+		return 1
+	}
+	defer func() {
+		if err := telemetry.Shutdown(shutdownTelemetry); err != nil {
+			logger.Warningf("%v", err)
+		}
+	}()
+
+	settings, err := analysis.LoadSettings(*settingsFile)
+	if err != nil {
+		logger.Errorf("%v", err)
+		return 1
+	}
+	if *classesFile != "" {
+		if settings.EndpointClasses, err = analysis.LoadEndpointClasses(*classesFile); err != nil {
+			logger.Errorf("%v", err)
+			return 1
+		}
+		logger.Infof("Loaded %d endpoint classes from %s", len(settings.EndpointClasses), *classesFile)
+	}
+	if *scoringFile != "" {
+		if settings.Scoring, err = analysis.LoadScoring(*scoringFile); err != nil {
+			logger.Errorf("%v", err)
+			return 1
+		}
+		logger.Infof("Loaded the severity scoring model from %s", *scoringFile)
+	}
+	if *assetsFile != "" {
+		if settings.Assets, err = analysis.LoadAssets(*assetsFile); err != nil {
+			logger.Errorf("%v", err)
+			return 1
+		}
+		logger.Infof("Loaded %d assets from %s", len(settings.Assets), *assetsFile)
+	}
+	if *policyTemplate != "" {
+		if settings.PolicyTemplate, err = analysis.LoadPolicyTemplate(*policyTemplate); err != nil {
+			logger.Errorf("%v", err)
+			return 1
+		}
+		logger.Infof("Scoring the Web ACL against the %s policy template", settings.PolicyTemplate.Name)
+	}
+	if *suppressionsFile != "" {
+		if settings.Suppressions, err = analysis.LoadSuppressions(*suppressionsFile); err != nil {
+			logger.Errorf("%v", err)
+			return 1
+		}
+		logger.Infof("Loaded %d suppressions from %s", len(settings.Suppressions), *suppressionsFile)
+	}
+	if *testWindowsFile != "" {
+		if settings.TestWindows, err = analysis.LoadTestWindows(*testWindowsFile); err != nil {
+			logger.Errorf("%v", err)
+			return 1
+		}
+		logger.Infof("Loaded %d authorized testing windows from %s", len(settings.TestWindows), *testWindowsFile)
+	}
+	if *hosts != "" {
+		settings.Hosts = strings.Split(*hosts, ",")
+	}
+	if *expectedHosts != "" {
+		settings.ExpectedHosts = strings.Split(*expectedHosts, ",")
+	}
+	if *sources != "" {
+		if err := settings.SetSources(strings.Split(*sources, ",")); err != nil {
+			logger.Errorf("%v", err)
+			return 1
+		}
+	}
+	if *timeZone != "" {
+		if err := settings.SetTimeZone(*timeZone); err != nil {
+			logger.Errorf("%v", err)
+			return 1
+		}
+	}
+	if *clientIdentity != "" {
+		mode, header, _ := strings.Cut(*clientIdentity, ":")
+		settings.ClientIdentity.Mode, settings.ClientIdentity.Header = mode, header
+	}
+	if *clientIPHeader != "" {
+		settings.ClientIdentity.IPHeader = *clientIPHeader
+	}
+	if err := settings.ClientIdentity.Validate(); err != nil {
+		logger.Errorf("%v", err)
+		return 1
+	}
+
+	var flowLogs analysis.FlowLogSettings
+	if *flowLogENIs != "" {
+		flowLogs.Interfaces = strings.Split(*flowLogENIs, ",")
+	}
+	for _, port := range strings.Split(*flowLogPorts, ",") {
+		n, err := strconv.Atoi(strings.TrimSpace(port))
+		if err != nil || n <= 0 || n > 65535 {
+			logger.Errorf("Invalid port %q in -flow-log-ports", port)
+			return 1
+		}
+		flowLogs.Ports = append(flowLogs.Ports, n)
+	}
+	if *ipRanges != "" {
+		if flowLogs.CloudFront, err = analysis.LoadCloudFrontRanges(*ipRanges); err != nil {
+			logger.Errorf("%v", err)
+			return 1
+		}
+		logger.Infof("Loaded %d CloudFront address ranges from %s", len(flowLogs.CloudFront), *ipRanges)
+	}
+
+	var passiveDNS *resolve.Passive
+	if *passiveDNSFile != "" {
+		cfg, err := resolve.LoadPassiveConfig(*passiveDNSFile)
+		if err == nil {
+			passiveDNS, err = resolve.NewPassive(cfg)
+		}
+		if err != nil {
+			logger.Errorf("%v", err)
+			return 1
+		}
+		logger.Infof("Looking up attacker IPs in %s passive DNS", cfg.Provider)
+	}
+
+	aclDir := filepath.Join(*outputDir, *profile, *webACL)
+	lock, err := lockWebACL(aclDir, "analyze", *forceUnlock, logger.Infof, logger.Warningf)
+	if err != nil {
+		logger.Errorf("%v", err)
+		return 1
+	}
+	defer releaseLock(lock, logger.Warningf)
+	logger.Infof("Analyzing logs for Web ACL %s in %s", *webACL, aclDir)
+	var records *analysis.RecordCache
+	if *recordCache {
+		records, err = analysis.NewRecordCache(aclDir, filepath.Join(aclDir, analysis.OutputDirName, analysis.RecordCacheDirName), logger)
+		if err != nil {
+			logger.Errorf("%v", err)
+			return 1
+		}
+	}
+	if *partialsDir != "" {
+		count, err := analysis.WritePartials(aclDir, *partialsDir, *profile, *webACL, settings, records, logger)
+		if err != nil {
+			logger.Errorf("Failed to write partial aggregates: %v", err)
+			return 1
+		}
+		logger.Infof("Wrote %d partial aggregates to %s; combine them with merge", count, *partialsDir)
+		return 0
+	}
+	aclAttributes := []attribute.KeyValue{
+		attribute.String("waf.profile", *profile),
+		attribute.String("waf.web_acl", *webACL),
+	}
+
+	ctx, parsePhase := telemetry.StartPhase(context.Background(), telemetry.PhaseParse, aclAttributes...)
+	var stats *analysis.Stats
+	var fileCount int
+	if *noCache {
+		stats, fileCount, err = analysis.AnalyzeDirectory(aclDir, settings, records, logger)
+	} else {
+		cacheDir := filepath.Join(aclDir, analysis.OutputDirName, analysis.CacheDirName)
+		stats, fileCount, err = analysis.AnalyzeIncremental(aclDir, cacheDir, settings, records, logger)
+	}
+	if err == nil {
+		parsePhase.AddFiles(ctx, fileCount)
+		parsePhase.AddRecords(ctx, int(stats.TotalRequests))
+	}
+	parsePhase.End(ctx, err)
+	if err != nil {
+		logger.Errorf("Failed to analyze logs: %v", err)
+		return 1
+	}
+
+	ctx, analyzePhase := telemetry.StartPhase(context.Background(), telemetry.PhaseAnalyze, aclAttributes...)
+	result, err := analyzeStats(*profile, *webACL, aclDir, *checksDir, stats, settings, fileCount, logger)
+	if err == nil {
+		analyzePhase.SetAttributes(attribute.Int("waf.findings", len(result.Findings)))
+	}
+	analyzePhase.End(ctx, err)
+	if err != nil {
+		logger.Errorf("Analysis failed: %v", err)
+		return 1
+	}
+	if *albLogs != "" {
+		if err := correlateALBLogs(*albLogs, flowLogs.CloudFront, result, logger); err != nil {
+			logger.Errorf("%v", err)
+			return 1
+		}
+	}
+	if *flowLogsDir != "" {
+		if err := correlateFlowLogs(*flowLogsDir, flowLogs, result, logger); err != nil {
+			logger.Errorf("%v", err)
+			return 1
+		}
+	}
+	if *reverseDNS || passiveDNS != nil {
+		traceInfrastructure(*attackerIPs, *reverseDNS, passiveDNS, result, logger)
+	}
+	if *samples > 0 || settings.ScoringEnabled() || len(settings.Assets) > 0 {
+		if err := collectEvidence(aclDir, result, settings, *samples, logger); err != nil {
+			logger.Errorf("Failed to collect finding evidence: %v", err)
+			return 1
+		}
+	}
+
+	if *queries != "" {
+		if result.Queries, err = runSavedQueries(aclDir, *profile, *webACL, *queries, logger); err != nil {
+			logger.Errorf("%v", err)
+			return 1
+		}
+	}
+
+	result.Environment, err = captureEnvironment(aclDir, *checksDir, settings)
+	if err != nil {
+		logger.Errorf("Failed to capture the analysis environment: %v", err)
+		return 1
+	}
+	return writeAnalysis(result, aclDir, *narrativeFile, *signKey, logger)
+}
+
+// correlateFlowLogs adds the origin bypass report of the flow logs in dir, and its
+// findings, to an analysis result
+func correlateFlowLogs(dir string, settings analysis.FlowLogSettings, result *analysis.Result, logger logging.Logger) error {
+	report, err := analysis.AnalyzeFlowLogs(dir, settings, result.Stats)
+	if err != nil {
+		return err
+	}
+	if report.Records == 0 {
+		logger.Warningf("No flow records found under %s", dir)
+	}
+	if report.CloudFrontRangesKnown {
+		logger.Infof("Read %d flow records from %d files: %d inbound flows via CloudFront, %d direct, %d internal, %d rejected",
+			report.Records, report.Files, report.ViaCloudFront.Flows, report.Direct.Flows, report.Internal.Flows, report.Rejected.Flows)
+	} else {
+		logger.Infof("Read %d flow records from %d files: %d inbound flows from internet addresses, %d internal, %d rejected",
+			report.Records, report.Files, report.Unclassified.Flows, report.Internal.Flows, report.Rejected.Flows)
+		logger.Warningf("Without -ip-ranges, only flows from clients of the Web ACL can be told apart from CloudFront's")
+	}
+	if report.OutsideWindow > 0 {
+		logger.Infof("Left out %d inbound flows outside the window of the WAF logs", report.OutsideWindow)
+	}
+	result.OriginBypass = report
+	result.Findings = append(result.Findings, analysis.FlowLogFindings(result.WebACLName, report)...)
+	return nil
+}
+
+// correlateALBLogs adds the requests that reached load balancers without going
+// through CloudFront to the origin exposure of an analysis result, and rederives
+// its findings
+func correlateALBLogs(dir string, cloudFront []netip.Prefix, result *analysis.Result, logger logging.Logger) error {
+	exposures, err := analysis.CorrelateALBLogs(dir, result.OriginExposure, cloudFront, result.Stats)
+	if err != nil {
+		return err
+	}
+	if len(cloudFront) == 0 {
+		logger.Warningf("Without -ip-ranges, only ALB requests from clients of the Web ACL can be told apart from CloudFront's")
+	}
+	for _, e := range exposures {
+		if e.DirectRequests > 0 || e.DirectRefused > 0 {
+			logger.Infof("Load balancer %s received %d requests from outside CloudFront, %d of them refused", e.LoadBalancer, e.DirectRequests+e.DirectRefused, e.DirectRefused)
+		}
+	}
+	result.OriginExposure = exposures
+	result.Findings = slices.DeleteFunc(result.Findings, func(f analysis.Finding) bool { return f.Source == analysis.ExposureSource })
+	result.Findings = append(result.Findings, analysis.ExposureFindings(result.WebACLName, exposures)...)
+	return nil
+}
+
+// traceInfrastructure looks up the DNS names of the most blocked attacker IPs of
+// an analysis result and adds the infrastructure they trace to, and its findings.
+// Failed lookups only leave names out, so they are warnings.
+func traceInfrastructure(count int, reverseDNS bool, passiveDNS *resolve.Passive, result *analysis.Result, logger logging.Logger) {
+	addresses := analysis.AttackerIPs(result.Stats, count)
+	if len(addresses) == 0 {
+		logger.Infof("No public attacker IPs to look up")
+		return
+	}
+	ctx := context.Background()
+	names := make(map[string]analysis.HostNames, len(addresses))
+	if reverseDNS {
+		reverse, failed := resolve.Reverse(ctx, net.DefaultResolver, addresses, resolve.DefaultWorkers)
+		for address, found := range reverse {
+			names[address] = analysis.HostNames{Reverse: found}
+		}
+		logger.Infof("Found reverse DNS names of %d of %d attacker IPs", len(reverse), len(addresses))
+		if failed > 0 {
+			logger.Warningf("%d reverse DNS lookups failed", failed)
+		}
+	}
+	var provider string
+	if passiveDNS != nil {
+		passive, err := passiveDNS.Lookup(ctx, addresses)
+		if err != nil {
+			logger.Warningf("%v; keeping the names of %d addresses found before", err, len(passive))
+		}
+		for address, found := range passive {
+			hostNames := names[address]
+			hostNames.Passive = found
+			names[address] = hostNames
+		}
+		logger.Infof("Found passive DNS names of %d of %d attacker IPs", len(passive), len(addresses))
+		provider = passiveDNS.Provider()
+	}
+	result.Infrastructure = analysis.AttackerInfrastructure(result.Stats, addresses, names, reverseDNS, provider)
+	result.Findings = append(result.Findings, analysis.InfrastructureFindings(result.WebACLName, result.Infrastructure)...)
+}
+
+// collectEvidence tags the findings of an analysis result with the assets they
+// affect, rescores them if scoring is enabled and embeds representative requests
+// from the log files in them and its case studies
+func collectEvidence(aclDir string, result *analysis.Result, settings *analysis.Settings, perTarget int, logger logging.Logger) error {
+	files, err := analysis.ListLogFiles(aclDir)
+	if err != nil {
+		return err
+	}
+	if err := analysis.CollectEvidence(files, result, settings, perTarget); err != nil {
+		return err
+	}
+	var sampled, scored, changed int
+	for _, f := range result.Findings {
+		if len(f.Samples) > 0 {
+			sampled++
+		}
+		if f.Score != nil {
+			scored++
+			if f.Score.BaseSeverity != f.Severity {
+				changed++
+			}
+		}
+	}
+	if settings.ScoringEnabled() {
+		logger.Infof("Rescored %d findings, changing the severity of %d", scored, changed)
+	}
+	if perTarget > 0 {
+		logger.Infof("Picked sample requests for %d findings and %d case studies", sampled, len(result.CaseStudies))
+	}
+	return nil
+}
+
+// writeAnalysis drafts the narratives of an analysis result if configured, writes
+// it to the Web ACL's analysis directory and signs it if a key is given
+func writeAnalysis(result *analysis.Result, aclDir, narrativeFile, signKey string, logger logging.Logger) int {
+	if narrativeFile != "" {
+		if err := draftNarratives(narrativeFile, result, logger); err != nil {
+			logger.Errorf("%v", err)
+			return 1
+		}
+	}
+
+	resultPath, err := analysis.WriteResult(filepath.Join(aclDir, analysis.OutputDirName), result)
+	if err != nil {
+		logger.Errorf("Failed to write analysis result: %v", err)
+		return 1
+	}
+
+	logger.Infof("Analysis complete: %d requests, %d findings", result.Stats.TotalRequests, len(result.Findings))
+	logger.Infof("Analysis written to: %s", resultPath)
+	if signKey != "" {
+		if err := signDeliverable(resultPath, signKey, "", logger); err != nil {
+			logger.Errorf("Failed to sign analysis result: %v", err)
+			return 1
+		}
+	}
+	logger.Infof("Reproduce with version %s (inputs sha256:%s, config sha256:%s)", result.Environment.ToolVersion,
+		result.Environment.InputManifestHash, result.Environment.ConfigHash)
+	return 0
+}
+
+// captureEnvironment records the tool version and hashes of the inputs and
+// configuration of an analysis. The inputs are the log files and the Web ACL snapshot.
+func captureEnvironment(aclDir, checksDir string, settings *analysis.Settings) (*analysis.Environment, error) {
+	inputs, err := analysis.ListLogFiles(aclDir)
+	if err != nil {
+		return nil, err
+	}
+	snapshotPath, err := analysis.LatestSnapshotPath(aclDir)
+	if err != nil {
+		return nil, err
+	}
+	if snapshotPath != "" {
+		inputs = append(inputs, snapshotPath)
+	}
+
+	manifest, err := analysis.BuildInputManifest(aclDir, inputs)
+	if err != nil {
+		return nil, err
+	}
+	return environmentOf(manifest, checksDir, settings)
+}
+
+// environmentOf records the tool version and hashes of an analysis given the
+// manifest of its inputs
+func environmentOf(manifest []analysis.ManifestEntry, checksDir string, settings *analysis.Settings) (*analysis.Environment, error) {
+	var err error
+	env := &analysis.Environment{
+		ToolVersion:       toolVersion(),
+		GoVersion:         runtime.Version(),
+		Deterministic:     true,
+		InputManifestHash: analysis.ManifestHash(manifest),
+		InputFileCount:    len(manifest),
+	}
+
+	var checkFiles []string
+	if checksDir != "" {
+		if checkFiles, err = filepath.Glob(filepath.Join(checksDir, "*"+checks.FileExtension)); err != nil {
+			return nil, fmt.Errorf("failed to list check scripts: %w", err)
+		}
+	}
+	if env.ConfigHash, err = analysis.ConfigHash(settings, checkFiles); err != nil {
+		return nil, err
+	}
+	return env, nil
+}
+
+// analyzeStats builds the analysis result from aggregated statistics, the latest
+// Web ACL snapshot and the custom checks
+func analyzeStats(profile, webACL, aclDir, checksDir string, stats *analysis.Stats, settings *analysis.Settings, fileCount int, logger logging.Logger) (*analysis.Result, error) {
+	result := &analysis.Result{
+		GeneratedAt:    time.Now().UTC(),
+		ProfileName:    profile,
+		WebACLName:     webACL,
+		InputFiles:     fileCount,
+		ClientIdentity: settings.ClientIdentity.String(),
+		Stats:          stats,
+		Account:        analysis.ResultAccount(stats),
+	}
+	result.AttackLandscape = analysis.AttackLandscape(stats)
+	result.Origins = analysis.AttackOrigins(stats)
+	result.Scanners = analysis.ScannerReport(stats)
+	result.Findings = append(result.Findings, analysis.ScannerFindings(webACL, result.Scanners)...)
+	result.TLSFingerprints = analysis.FingerprintReport(stats, settings.Fingerprints)
+	result.Findings = append(result.Findings, analysis.FingerprintFindings(webACL, result.TLSFingerprints)...)
+	result.ChallengeCandidates = analysis.ChallengeCandidates(stats, settings.Challenge)
+	result.Findings = append(result.Findings, analysis.ChallengeFindings(webACL, result.ChallengeCandidates)...)
+	result.AuthAbuse = analysis.DetectAuthAbuse(stats.Auth, settings.Auth)
+	result.Findings = append(result.Findings, analysis.AuthFindings(webACL, stats.Auth, result.AuthAbuse)...)
+	result.APIAbuse = analysis.DetectAPIAbuse(stats.API, settings)
+	result.Findings = append(result.Findings, analysis.APIFindings(webACL, result.APIAbuse)...)
+	result.Sessions = analysis.BuildSessionReport(stats.Sessions, settings.Sessions)
+	result.Findings = append(result.Findings, analysis.SessionFindings(webACL, result.Sessions)...)
+
+	if stats.Latency != nil {
+		result.OperationalImpact = stats.Latency.OperationalImpact()
+		result.Findings = append(result.Findings, analysis.LatencyFindings(webACL, result.OperationalImpact)...)
+	}
+
+	snapshot, err := loadLatestSnapshot(aclDir, logger)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load Web ACL snapshot: %w", err)
+	}
+	if snapshot != nil {
+		result.Coverage, result.CoverageUnknown = analysis.ResourceCoverage(snapshot)
+		if result.CoverageUnknown != "" {
+			logger.Warningf("Coverage of %s is unknown: %s", webACL, result.CoverageUnknown)
+		}
+		result.Findings = append(result.Findings, analysis.CoverageFindings(webACL, result.Coverage)...)
+		result.OriginExposure = analysis.OriginExposures(snapshot)
+		result.Findings = append(result.Findings, analysis.ExposureFindings(webACL, result.OriginExposure)...)
+		result.Findings = append(result.Findings, analysis.ExcludedRuleFindings(webACL, analysis.ExcludedRules(snapshot), stats)...)
+		result.RuleEfficiency = analysis.RuleEfficiencyReport(snapshot, stats)
+		result.Findings = append(result.Findings, analysis.RuleEfficiencyFindings(webACL, result.RuleEfficiency, stats.TotalRequests)...)
+		result.CapacityHeadroom = analysis.BuildCapacityHeadroom(snapshot, result)
+		result.Findings = append(result.Findings, analysis.CapacityHeadroomFindings(webACL, result.CapacityHeadroom)...)
+		if settings.PolicyTemplate != nil {
+			result.Policy = analysis.ScorePolicy(settings.PolicyTemplate, snapshot)
+			result.Findings = append(result.Findings, analysis.PolicyFindings(webACL, result.Policy)...)
+		}
+	}
+	if stats.BodyInspection != nil {
+		result.BodyInspection = analysis.BuildBodyInspectionReport(stats.BodyInspection, snapshot)
+		result.Findings = append(result.Findings, analysis.BodyInspectionFindings(webACL, result.BodyInspection)...)
+	}
+	result.HostHeaders = analysis.BuildHostHeaderReport(stats, settings)
+	result.Findings = append(result.Findings, analysis.HostHeaderFindings(webACL, result.HostHeaders)...)
+
+	if checksDir != "" {
+		findings, err := runChecks(checksDir, snapshot, stats, logger)
+		if err != nil {
+			return nil, fmt.Errorf("failed to run custom checks: %w", err)
+		}
+		result.Findings = append(result.Findings, findings...)
+	}
+
+	result.EndpointClasses = analysis.ClassBreakdown(stats, result.Findings)
+	if len(settings.Assets) > 0 {
+		result.Assets = analysis.AssetBreakdown(stats, result.Findings)
+	}
+	result.Hosts = analysis.HostBreakdown(stats)
+	if len(stats.Sources) > 1 {
+		result.Sources = analysis.SourceBreakdown(stats)
+	}
+	result.TimeProfile = analysis.BuildTimeProfile(stats.Heatmap)
+	result.AuthorizedTesting = analysis.AuthorizedTestingReport(stats)
+
+	if result.Reconciliation, err = analysis.Reconcile(aclDir, stats); err != nil {
+		return nil, fmt.Errorf("failed to reconcile record counts: %w", err)
+	}
+	logReconciliation(result.Reconciliation, logger)
+	result.Findings = append(result.Findings, analysis.ReconciliationFindings(webACL, result.Reconciliation)...)
+	return result, nil
+}
+
+// logReconciliation logs the record count of every stage and the counts that do
+// not match
+func logReconciliation(r *analysis.Reconciliation, logger logging.Logger) {
+	for _, stage := range r.Stages {
+		if stage.Files > 0 {
+			logger.Infof("Records %s: %d from %d log files", stage.Stage, stage.Records, stage.Files)
+		} else {
+			logger.Infof("Records %s: %d", stage.Stage, stage.Records)
+		}
+	}
+	if r.Unrecorded > 0 {
+		logger.Infof("%d log files have no record count in the manifest and are reconciled from parsing on", r.Unrecorded)
+	}
+	if r.Uncounted > 0 {
+		logger.Infof("%d log files were aggregated by older versions without a record count each and are only reconciled in total", r.Uncounted)
+	}
+	for _, alert := range r.Alerts {
+		logger.Warningf("Record counts do not reconcile: %s", alert)
+	}
+}
+
+// draftNarratives adds model-drafted narratives to the findings when the narrative
+// config enables them
+func draftNarratives(configPath string, result *analysis.Result, logger logging.Logger) error {
+	cfg, err := narrative.LoadConfig(configPath)
+	if err != nil {
+		return err
+	}
+	if !cfg.Enabled {
+		logger.Infof("Finding narratives are disabled in %s", configPath)
+		return nil
+	}
+	provider, err := narrative.NewProvider(context.Background(), cfg)
+	if err != nil {
+		return fmt.Errorf("failed to set up the narrative provider: %w", err)
+	}
+	drafted := narrative.Draft(context.Background(), cfg, provider, result, logger)
+	logger.Infof("Drafted %d finding narratives", drafted)
+	return nil
+}
+
+// loadLatestSnapshot loads the most recent Web ACL snapshot, returning nil if none was captured
+func loadLatestSnapshot(aclDir string, logger logging.Logger) (map[string]interface{}, error) {
+	snapshotPath, err := analysis.LatestSnapshotPath(aclDir)
+	if err != nil {
+		return nil, err
+	}
+	if snapshotPath == "" {
+		logger.Warning("No Web ACL snapshot found; snapshot-based analysis is skipped")
+		return nil, nil
+	}
+	logger.Infof("Using Web ACL snapshot: %s", snapshotPath)
+	return analysis.LoadSnapshot(snapshotPath)
+}
+
+// runChecks loads the custom checks and evaluates them against the Web ACL snapshot
+func runChecks(checksDir string, snapshot map[string]interface{}, stats *analysis.Stats, logger logging.Logger) ([]analysis.Finding, error) {
+	loaded, err := checks.LoadChecks(checksDir)
+	if err != nil {
+		return nil, err
+	}
+	logger.Infof("Loaded %d custom checks from %s", len(loaded), checksDir)
+
+	return checks.RunAll(loaded, snapshot, stats, logger), nil
+}
@@ -0,0 +1,309 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+
+	awsconfig "github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+
+	"waf-log-retriever/analysis"
+	"waf-log-retriever/archive"
+	"waf-log-retriever/storage"
+	"waf-log-retriever/workspace"
+)
+
+// archiveTagPrefix prefixes the object tags every archive sets, for lifecycle rules
+const archiveTagPrefix = "waf-log-retriever:"
+
+// s3ClientFor returns an S3 client for an AWS shared config profile and region, each
+// defaulting to the default credential chain
+func s3ClientFor(ctx context.Context, awsProfile, region string) (*s3.Client, error) {
+	var options []func(*awsconfig.LoadOptions) error
+	if awsProfile != "" {
+		options = append(options, awsconfig.WithSharedConfigProfile(awsProfile))
+	}
+	if region != "" {
+		options = append(options, awsconfig.WithRegion(region))
+	}
+	awsCfg, err := awsconfig.LoadDefaultConfig(ctx, options...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load AWS configuration: %w", err)
+	}
+	return s3.NewFromConfig(awsCfg), nil
+}
+
+// parseTags parses comma-separated key=value object tags
+func parseTags(s string) (map[string]string, error) {
+	tags := make(map[string]string)
+	for _, pair := range strings.Split(s, ",") {
+		if pair = strings.TrimSpace(pair); pair == "" {
+			continue
+		}
+		key, value, ok := strings.Cut(pair, "=")
+		if !ok || key == "" {
+			return nil, fmt.Errorf("tag %q is not key=value", pair)
+		}
+		tags[key] = value
+	}
+	return tags, nil
+}
+
+// runArchive pushes the raw data of a completed engagement to an S3 archive
+func runArchive(args []string) int {
+	fs := flag.NewFlagSet("archive", flag.ExitOnError)
+	outputDir := fs.String("output-dir", "../logs/raw", "Directory containing retrieved logs")
+	profile := fs.String("profile", "", "AWS profile name the logs were retrieved with")
+	webACL := fs.String("web-acl", "", "Name of the Web ACL whose logs to archive")
+	location := fs.String("location", "", "Archive bucket and prefix, e.g. s3://my-archive/waf-reviews")
+	storageClass := fs.String("storage-class", "GLACIER", "Storage class of the archived logs: "+strings.Join(archive.StorageClasses, ", "))
+	tagList := fs.String("tags", "", "Comma-separated key=value object tags to add, e.g. for lifecycle rules")
+	prune := fs.Bool("prune", false, "Remove the local logs once they are archived")
+	force := fs.Bool("force", false, "Archive even if the review checklist is not complete")
+	reviewer := fs.String("reviewer", defaultReviewer(), "Name of the reviewer archiving the logs")
+	awsProfile := fs.String("aws-profile", "", "AWS shared config profile for the archive bucket (default: default credential chain)")
+	region := fs.String("region", "", "AWS region of the archive bucket")
+	forceUnlock := fs.Bool("force-unlock", false, "Take over the lock of the Web ACL's directory even if another run appears to hold it")
+	fs.Parse(args)
+
+	if *profile == "" || *webACL == "" || *location == "" {
+		fmt.Println("archive requires -profile, -web-acl and -location")
+		fs.Usage()
+		return 2
+	}
+	base, err := archive.ParseLocation(*location)
+	if err != nil {
+		fmt.Printf("%v\n", err)
+		return 2
+	}
+	if !slices.Contains(archive.StorageClasses, *storageClass) {
+		fmt.Printf("Unknown -storage-class %q (known: %s)\n", *storageClass, strings.Join(archive.StorageClasses, ", "))
+		return 2
+	}
+	tags, err := parseTags(*tagList)
+	if err != nil {
+		fmt.Printf("%v\n", err)
+		return 2
+	}
+
+	aclDir := filepath.Join(*outputDir, *profile, *webACL)
+	lock, err := lockWebACL(aclDir, "archive", *forceUnlock, printInfo, printWarning)
+	if err != nil {
+		fmt.Printf("%v\n", err)
+		return 1
+	}
+	defer releaseLock(lock, printWarning)
+	ws, err := workspace.Open(aclDir, *profile, *webACL)
+	if err != nil {
+		fmt.Printf("%v\n", err)
+		return 1
+	}
+	if done, total := ws.Progress(); done < total && !*force {
+		fmt.Printf("The review of %s is not complete (%d of %d checklist items done); pass -force to archive it anyway\n", *webACL, done, total)
+		return 1
+	}
+	files, err := analysis.ListLogFiles(aclDir)
+	if err != nil {
+		fmt.Printf("%v\n", err)
+		return 1
+	}
+	files = slices.DeleteFunc(files, func(file string) bool {
+		return file == workspace.Path(aclDir)
+	})
+	if len(files) == 0 {
+		fmt.Printf("No log files found in %s\n", aclDir)
+		return 1
+	}
+	// The index travels with the logs it describes
+	if _, err := os.Stat(filepath.Join(aclDir, storage.IndexFileName)); err == nil {
+		files = append(files, filepath.Join(aclDir, storage.IndexFileName))
+	}
+
+	now := time.Now().UTC()
+	index := &archive.Index{
+		ID:           now.Format("20060102T150405Z"),
+		Profile:      *profile,
+		WebACL:       *webACL,
+		StorageClass: *storageClass,
+		CreatedAt:    now,
+	}
+	loc := base.Join(*profile, *webACL, index.ID)
+	tags[archiveTagPrefix+"profile"] = *profile
+	tags[archiveTagPrefix+"web-acl"] = *webACL
+	tags[archiveTagPrefix+"archive-id"] = index.ID
+
+	ctx := context.Background()
+	client, err := s3ClientFor(ctx, *awsProfile, *region)
+	if err != nil {
+		fmt.Printf("%v\n", err)
+		return 1
+	}
+	fmt.Printf("Archiving %d files of %s to %s in %s\n", len(files), aclDir, loc, *storageClass)
+	if err := archive.Archive(ctx, client, loc, aclDir, files, index, archive.Options{StorageClass: *storageClass, Tags: tags}); err != nil {
+		fmt.Printf("Archive failed: %v\n", err)
+		fmt.Println("No local file was removed; rerun the command to archive again")
+		return 1
+	}
+
+	// The archive is recorded in the workspace, which is then archived itself so a
+	// restore on another machine knows the engagement's history
+	ws.AddArchive(workspace.Archive{
+		ID:           index.ID,
+		Location:     loc.String(),
+		StorageClass: *storageClass,
+		Files:        len(index.Files),
+		Bytes:        index.Bytes(),
+		ArchivedBy:   *reviewer,
+		ArchivedAt:   now,
+		Pruned:       *prune,
+	})
+	if err := ws.Save(); err != nil {
+		fmt.Printf("%v\n", err)
+		return 1
+	}
+	if err := archive.Upload(ctx, client, loc, workspace.FileName, workspace.Path(aclDir), tags); err != nil {
+		fmt.Printf("Failed to archive the workspace: %v\n", err)
+		return 1
+	}
+	fmt.Printf("Archived %d files (%.1f MB) as %s\n", len(index.Files), float64(index.Bytes())/1e6, index.ID)
+
+	if *prune {
+		if err := archive.Prune(loc, aclDir, index); err != nil {
+			fmt.Printf("Failed to remove the local logs: %v\n", err)
+			return 1
+		}
+		fmt.Printf("Removed the local logs; restore them with: restore -profile %s -web-acl %s -archive %s\n", *profile, *webACL, index.ID)
+	}
+	return 0
+}
+
+// runRestore brings the archived raw data of an engagement back locally
+func runRestore(args []string) int {
+	fs := flag.NewFlagSet("restore", flag.ExitOnError)
+	outputDir := fs.String("output-dir", "../logs/raw", "Directory to restore the logs into")
+	profile := fs.String("profile", "", "AWS profile name the logs were retrieved with")
+	webACL := fs.String("web-acl", "", "Name of the Web ACL whose logs to restore")
+	archiveID := fs.String("archive", "", "ID of the archive recorded in the workspace to restore (default: the latest one)")
+	location := fs.String("location", "", "Location of the archive to restore instead, e.g. s3://my-archive/waf-reviews/<profile>/<web-acl>/<id>/")
+	tier := fs.String("tier", "Standard", "Glacier retrieval tier: "+strings.Join(archive.Tiers, ", "))
+	days := fs.Int("days", 7, "Days S3 keeps the retrieved copies of Glacier objects")
+	reviewer := fs.String("reviewer", defaultReviewer(), "Name of the reviewer restoring the logs")
+	awsProfile := fs.String("aws-profile", "", "AWS shared config profile for the archive bucket (default: default credential chain)")
+	region := fs.String("region", "", "AWS region of the archive bucket")
+	forceUnlock := fs.Bool("force-unlock", false, "Take over the lock of the Web ACL's directory even if another run appears to hold it")
+	fs.Parse(args)
+
+	if *profile == "" || *webACL == "" {
+		fmt.Println("restore requires -profile and -web-acl")
+		fs.Usage()
+		return 2
+	}
+	if !slices.Contains(archive.Tiers, *tier) {
+		fmt.Printf("Unknown -tier %q (known: %s)\n", *tier, strings.Join(archive.Tiers, ", "))
+		return 2
+	}
+	if *days < 1 {
+		fmt.Println("-days must be at least 1")
+		return 2
+	}
+
+	ctx := context.Background()
+	client, err := s3ClientFor(ctx, *awsProfile, *region)
+	if err != nil {
+		fmt.Printf("%v\n", err)
+		return 1
+	}
+	aclDir := filepath.Join(*outputDir, *profile, *webACL)
+	lock, err := lockWebACL(aclDir, "restore", *forceUnlock, printInfo, printWarning)
+	if err != nil {
+		fmt.Printf("%v\n", err)
+		return 1
+	}
+	defer releaseLock(lock, printWarning)
+	var loc archive.Location
+	if *location != "" {
+		if loc, err = archive.ParseLocation(*location); err != nil {
+			fmt.Printf("%v\n", err)
+			return 2
+		}
+		// On another machine, the archived workspace brings back the review state
+		if _, err := os.Stat(workspace.Path(aclDir)); errors.Is(err, os.ErrNotExist) {
+			if err := archive.Fetch(ctx, client, loc, workspace.FileName, workspace.Path(aclDir)); err != nil {
+				fmt.Printf("Failed to restore the workspace: %v\n", err)
+				return 1
+			}
+			fmt.Printf("Restored the workspace from %s\n", loc)
+		}
+	}
+	ws, err := workspace.Open(aclDir, *profile, *webACL)
+	if err != nil {
+		fmt.Printf("%v\n", err)
+		return 1
+	}
+	if *location == "" {
+		record := ws.FindArchive(*archiveID)
+		if record == nil {
+			if *archiveID != "" {
+				fmt.Printf("The workspace of %s records no archive %s\n", *webACL, *archiveID)
+			} else {
+				fmt.Printf("The workspace of %s records no archive; pass -location to restore from one\n", *webACL)
+			}
+			return 1
+		}
+		if loc, err = archive.ParseLocation(record.Location); err != nil {
+			fmt.Printf("%v\n", err)
+			return 1
+		}
+	}
+	index, err := archive.LoadIndex(ctx, client, loc)
+	if err != nil {
+		fmt.Printf("%v\n", err)
+		return 1
+	}
+	record := ws.FindArchive(index.ID)
+	if record == nil {
+		ws.AddArchive(workspace.Archive{
+			ID:           index.ID,
+			Location:     loc.String(),
+			StorageClass: index.StorageClass,
+			Files:        len(index.Files),
+			Bytes:        index.Bytes(),
+			ArchivedAt:   index.CreatedAt,
+		})
+		record = ws.FindArchive(index.ID)
+	}
+
+	fmt.Printf("Restoring %d files (%.1f MB, %s) archived as %s from %s\n", len(index.Files), float64(index.Bytes())/1e6, index.StorageClass, index.ID, loc)
+	result, err := archive.Restore(ctx, client, loc, aclDir, index, archive.RestoreOptions{Tier: *tier, Days: int32(*days)})
+	if result != nil && (result.Restored > 0 || result.Pending > 0) {
+		record.Restores = append(record.Restores, workspace.ArchiveRestore{
+			At:       time.Now().UTC(),
+			Reviewer: *reviewer,
+			Restored: result.Restored,
+			Pending:  result.Pending,
+		})
+		if saveErr := ws.Save(); saveErr != nil {
+			fmt.Printf("%v\n", saveErr)
+			return 1
+		}
+	}
+	if err != nil {
+		fmt.Printf("Restore failed: %v\n", err)
+		fmt.Println("Files already restored are kept; rerun the command to continue")
+		return 1
+	}
+
+	fmt.Printf("Restored %d files; %d were already present\n", result.Restored, result.Present)
+	if result.Pending > 0 {
+		fmt.Printf("%d files are being retrieved from %s (%d requested by this run, %s tier); rerun the command once S3 has retrieved them\n",
+			result.Pending, index.StorageClass, result.Requested, *tier)
+	}
+	return 0
+}
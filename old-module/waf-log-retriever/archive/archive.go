@@ -0,0 +1,369 @@
+// Package archive pushes the raw data of a completed engagement to an S3 archive
+// bucket, in a cold storage class such as Glacier, and restores it locally
+package archive
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/aws/smithy-go"
+
+	"waf-log-retriever/storage"
+)
+
+// IndexName is the object listing the files of an archive. It is always stored in
+// the STANDARD class so that a restore can read it without waiting for Glacier.
+const IndexName = "archive.json"
+
+// StorageClasses lists the storage classes files can be archived in
+var StorageClasses = []string{"STANDARD_IA", "GLACIER_IR", "GLACIER", "DEEP_ARCHIVE"}
+
+// Tiers lists the Glacier retrieval tiers, fastest first
+var Tiers = []string{"Expedited", "Standard", "Bulk"}
+
+// Location is an S3 bucket and key prefix
+type Location struct {
+	Bucket string
+	Prefix string // Empty or ending in a slash
+}
+
+// ParseLocation parses an s3://bucket/prefix URL
+func ParseLocation(s string) (Location, error) {
+	rest, ok := strings.CutPrefix(s, "s3://")
+	if !ok {
+		return Location{}, fmt.Errorf("archive location %q is not an s3://bucket/prefix URL", s)
+	}
+	bucket, prefix, _ := strings.Cut(rest, "/")
+	if bucket == "" {
+		return Location{}, fmt.Errorf("archive location %q has no bucket", s)
+	}
+	if prefix = strings.Trim(prefix, "/"); prefix != "" {
+		prefix += "/"
+	}
+	return Location{Bucket: bucket, Prefix: prefix}, nil
+}
+
+// Join returns the location below l named by the slash-separated elements
+func (l Location) Join(elem ...string) Location {
+	return Location{Bucket: l.Bucket, Prefix: path.Join(append([]string{l.Prefix}, elem...)...) + "/"}
+}
+
+// Key returns the object key of a file of the location
+func (l Location) Key(name string) string {
+	return l.Prefix + name
+}
+
+func (l Location) String() string {
+	return "s3://" + l.Bucket + "/" + l.Prefix
+}
+
+// File is an archived file
+type File struct {
+	Path   string `json:"path"` // Slash-separated, relative to the Web ACL's directory
+	Size   int64  `json:"size"`
+	SHA256 string `json:"sha256"`
+}
+
+// Index describes an archive; it is stored as IndexName in the archive
+type Index struct {
+	ID           string    `json:"id"`
+	Profile      string    `json:"profile"`
+	WebACL       string    `json:"webAcl"`
+	StorageClass string    `json:"storageClass"`
+	CreatedAt    time.Time `json:"createdAt"`
+	Files        []File    `json:"files"`
+	Manifest     bool      `json:"manifest"` // The download manifest is archived, in the STANDARD class
+}
+
+// Bytes returns the total size of the archived files
+func (i *Index) Bytes() int64 {
+	var total int64
+	for _, f := range i.Files {
+		total += f.Size
+	}
+	return total
+}
+
+// Options control an archive
+type Options struct {
+	StorageClass string
+	Tags         map[string]string // Object tags, e.g. for lifecycle rules
+}
+
+// Archive uploads files below a Web ACL's directory to loc, each in the storage class
+// and with the tags of opts and with its SHA-256 checksum verified by S3, and then
+// writes the directory's download manifest, if any, and the archive's index
+func Archive(ctx context.Context, client *s3.Client, loc Location, aclDir string, files []string, index *Index, opts Options) error {
+	tagging := encodeTags(opts.Tags)
+	for _, file := range files {
+		entry, err := storage.FileEntry(aclDir, file, "")
+		if err != nil {
+			return err
+		}
+		if err := upload(ctx, client, loc.Bucket, loc.Key(entry.Path), file, entry.SHA256, opts.StorageClass, tagging); err != nil {
+			return err
+		}
+		index.Files = append(index.Files, File{Path: entry.Path, Size: entry.Size, SHA256: entry.SHA256})
+	}
+	sort.Slice(index.Files, func(i, j int) bool { return index.Files[i].Path < index.Files[j].Path })
+
+	manifest := filepath.Join(aclDir, storage.ManifestFileName)
+	if _, err := os.Stat(manifest); err == nil {
+		if err := Upload(ctx, client, loc, storage.ManifestFileName, manifest, opts.Tags); err != nil {
+			return err
+		}
+		index.Manifest = true
+	}
+
+	data, err := json.MarshalIndent(index, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to encode archive index: %w", err)
+	}
+	_, err = client.PutObject(ctx, &s3.PutObjectInput{
+		Bucket:      aws.String(loc.Bucket),
+		Key:         aws.String(loc.Key(IndexName)),
+		Body:        strings.NewReader(string(data)),
+		ContentType: aws.String("application/json"),
+		Tagging:     tagging,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to upload archive index: %w", err)
+	}
+	return nil
+}
+
+// Upload uploads a single file to loc in the STANDARD class, e.g. the workspace
+func Upload(ctx context.Context, client *s3.Client, loc Location, name, file string, tags map[string]string) error {
+	entry, err := storage.FileEntry(filepath.Dir(file), file, "")
+	if err != nil {
+		return err
+	}
+	return upload(ctx, client, loc.Bucket, loc.Key(name), file, entry.SHA256, string(types.StorageClassStandard), encodeTags(tags))
+}
+
+// upload puts a file, letting S3 verify its checksum
+func upload(ctx context.Context, client *s3.Client, bucket, key, file, sum, class string, tagging *string) error {
+	digest, err := hex.DecodeString(sum)
+	if err != nil {
+		return fmt.Errorf("invalid checksum of %s: %w", file, err)
+	}
+	f, err := os.Open(file)
+	if err != nil {
+		return fmt.Errorf("failed to open %s: %w", file, err)
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return fmt.Errorf("failed to stat %s: %w", file, err)
+	}
+	_, err = client.PutObject(ctx, &s3.PutObjectInput{
+		Bucket:         aws.String(bucket),
+		Key:            aws.String(key),
+		Body:           f,
+		ContentLength:  aws.Int64(info.Size()),
+		ChecksumSHA256: aws.String(base64.StdEncoding.EncodeToString(digest)),
+		StorageClass:   types.StorageClass(class),
+		Tagging:        tagging,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to upload %s to s3://%s/%s: %w", file, bucket, key, err)
+	}
+	return nil
+}
+
+// encodeTags encodes object tags as the query string S3 expects, or nil
+func encodeTags(tags map[string]string) *string {
+	if len(tags) == 0 {
+		return nil
+	}
+	values := url.Values{}
+	for key, value := range tags {
+		values.Set(key, value)
+	}
+	return aws.String(values.Encode())
+}
+
+// Prune removes the local copies of the archived files, and the directories they
+// leave empty, recording the removals in the download manifest
+func Prune(loc Location, aclDir string, index *Index) error {
+	root := filepath.Clean(aclDir)
+	var removed []storage.ManifestEntry
+	for _, f := range index.Files {
+		file := filepath.Join(aclDir, filepath.FromSlash(f.Path))
+		if err := os.Remove(file); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return fmt.Errorf("failed to remove %s: %w", f.Path, err)
+		}
+		removed = append(removed, storage.RemoveEntry(f.Path, "archived:"+loc.String()))
+		for dir := filepath.Dir(file); dir != root && dir != "."; dir = filepath.Dir(dir) {
+			if os.Remove(dir) != nil {
+				break
+			}
+		}
+	}
+	return storage.AppendManifest(aclDir, removed...)
+}
+
+// LoadIndex reads the index of the archive at loc
+func LoadIndex(ctx context.Context, client *s3.Client, loc Location) (*Index, error) {
+	out, err := client.GetObject(ctx, &s3.GetObjectInput{
+		Bucket: aws.String(loc.Bucket),
+		Key:    aws.String(loc.Key(IndexName)),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to read archive index %s%s: %w", loc, IndexName, err)
+	}
+	defer out.Body.Close()
+	var index Index
+	if err := json.NewDecoder(out.Body).Decode(&index); err != nil {
+		return nil, fmt.Errorf("failed to parse archive index %s%s: %w", loc, IndexName, err)
+	}
+	return &index, nil
+}
+
+// Fetch downloads a single file of the archive at loc, e.g. the workspace
+func Fetch(ctx context.Context, client *s3.Client, loc Location, name, dest string) error {
+	return download(ctx, client, loc.Bucket, loc.Key(name), dest, "")
+}
+
+// RestoreOptions control a restore
+type RestoreOptions struct {
+	Tier string // Glacier retrieval tier
+	Days int32  // Days S3 keeps the retrieved copy of a Glacier object
+}
+
+// RestoreResult summarizes a restore
+type RestoreResult struct {
+	Present   int // Files already on disk with the archived checksum
+	Restored  int // Files downloaded
+	Requested int // Files whose retrieval from Glacier was requested by this run
+	Pending   int // Files still being retrieved from Glacier, including Requested
+}
+
+// Restore downloads the files of the archive at loc into a Web ACL's directory. Files
+// in a Glacier class that cannot be read directly are retrieved first, which takes
+// minutes to hours depending on the tier; a later run downloads them. Every
+// downloaded file is checked against its archived checksum and recorded in the
+// download manifest.
+func Restore(ctx context.Context, client *s3.Client, loc Location, aclDir string, index *Index, opts RestoreOptions) (*RestoreResult, error) {
+	result := &RestoreResult{}
+	// The local manifest, if any, was only appended to since; otherwise the archived
+	// one brings back the history of the files
+	manifest := filepath.Join(aclDir, storage.ManifestFileName)
+	if _, err := os.Stat(manifest); errors.Is(err, os.ErrNotExist) && index.Manifest {
+		if err := Fetch(ctx, client, loc, storage.ManifestFileName, manifest); err != nil {
+			return result, err
+		}
+	}
+	for _, f := range index.Files {
+		dest := filepath.Join(aclDir, filepath.FromSlash(f.Path))
+		if entry, err := storage.FileEntry(aclDir, dest, ""); err == nil && entry.SHA256 == f.SHA256 {
+			result.Present++
+			continue
+		}
+
+		key := loc.Key(f.Path)
+		head, err := client.HeadObject(ctx, &s3.HeadObjectInput{Bucket: aws.String(loc.Bucket), Key: aws.String(key)})
+		if err != nil {
+			return result, fmt.Errorf("failed to look up s3://%s/%s: %w", loc.Bucket, key, err)
+		}
+		if head.StorageClass == types.StorageClassGlacier || head.StorageClass == types.StorageClassDeepArchive {
+			status := aws.ToString(head.Restore)
+			if status == "" {
+				if err := requestRetrieval(ctx, client, loc.Bucket, key, opts); err != nil {
+					return result, err
+				}
+				result.Requested++
+				result.Pending++
+				continue
+			}
+			if strings.Contains(status, `ongoing-request="true"`) {
+				result.Pending++
+				continue
+			}
+		}
+
+		if err := download(ctx, client, loc.Bucket, key, dest, f.SHA256); err != nil {
+			return result, err
+		}
+		entry, err := storage.FileEntry(aclDir, dest, fmt.Sprintf("s3://%s/%s", loc.Bucket, key))
+		if err == nil {
+			err = storage.AppendManifest(aclDir, entry)
+		}
+		if err != nil {
+			return result, err
+		}
+		result.Restored++
+	}
+	return result, nil
+}
+
+// requestRetrieval asks S3 to retrieve a Glacier object; a retrieval already in
+// progress is not an error
+func requestRetrieval(ctx context.Context, client *s3.Client, bucket, key string, opts RestoreOptions) error {
+	_, err := client.RestoreObject(ctx, &s3.RestoreObjectInput{
+		Bucket: aws.String(bucket),
+		Key:    aws.String(key),
+		RestoreRequest: &types.RestoreRequest{
+			Days:                 aws.Int32(opts.Days),
+			GlacierJobParameters: &types.GlacierJobParameters{Tier: types.Tier(opts.Tier)},
+		},
+	})
+	var apiErr smithy.APIError
+	if errors.As(err, &apiErr) && apiErr.ErrorCode() == "RestoreAlreadyInProgress" {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to request retrieval of s3://%s/%s: %w", bucket, key, err)
+	}
+	return nil
+}
+
+// download writes an object to dest through a temporary file, checking its SHA-256
+// checksum if one is given
+func download(ctx context.Context, client *s3.Client, bucket, key, dest, sum string) error {
+	out, err := client.GetObject(ctx, &s3.GetObjectInput{Bucket: aws.String(bucket), Key: aws.String(key)})
+	if err != nil {
+		return fmt.Errorf("failed to download s3://%s/%s: %w", bucket, key, err)
+	}
+	defer out.Body.Close()
+
+	if err := os.MkdirAll(filepath.Dir(dest), 0755); err != nil {
+		return fmt.Errorf("failed to create directory for %s: %w", dest, err)
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(dest), "."+filepath.Base(dest)+".*.tmp")
+	if err != nil {
+		return fmt.Errorf("failed to create temporary file: %w", err)
+	}
+	defer os.Remove(tmp.Name())
+	h := sha256.New()
+	if _, err := io.Copy(io.MultiWriter(tmp, h), out.Body); err != nil {
+		tmp.Close()
+		return fmt.Errorf("failed to download s3://%s/%s: %w", bucket, key, err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("failed to write %s: %w", dest, err)
+	}
+	if got := hex.EncodeToString(h.Sum(nil)); sum != "" && got != sum {
+		return fmt.Errorf("s3://%s/%s has checksum %s, but %s was archived", bucket, key, got, sum)
+	}
+	if err := os.Rename(tmp.Name(), dest); err != nil {
+		return fmt.Errorf("failed to move %s into place: %w", dest, err)
+	}
+	return nil
+}
@@ -0,0 +1,145 @@
+// Package athena reads WAF logs exported from a data lake with Athena: the Parquet
+// and delimited text output of CTAS queries over the WAF log table, the CSV of
+// query results and JSON with the table's lowercase column names. Rows are turned
+// back into WAF log records, with the field names and types AWS WAF delivers.
+package athena
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Formats of Athena output, as reported by ingest
+const (
+	FormatParquet = "athena-parquet" // CTAS with format = 'PARQUET', Athena's default
+	FormatText    = "athena-text"    // CTAS with format = 'TEXTFILE', without a header
+	FormatCSV     = "athena-csv"     // Query results, with a header
+	FormatJSON    = "athena-json"    // CTAS with format = 'JSON'
+)
+
+// wafFieldNames are the field names of WAF log records. Athena lowercases column
+// and struct field names, so they are restored by their lowercase form.
+var wafFieldNames = []string{
+	"timestamp", "formatVersion", "webaclId", "terminatingRuleId", "terminatingRuleType", "action",
+	"terminatingRuleMatchDetails", "conditionType", "sensitivityLevel", "location", "matchedData", "matchedFieldName",
+	"httpSourceName", "httpSourceId",
+	"ruleGroupList", "ruleGroupId", "terminatingRule", "ruleId", "ruleMatchDetails", "nonTerminatingMatchingRules",
+	"overriddenAction", "excludedRules", "exclusionType", "customerConfig",
+	"rateBasedRuleList", "rateBasedRuleId", "rateBasedRuleName", "limitKey", "maxRateAllowed", "evaluationWindowSec", "customValues", "key",
+	"requestHeadersInserted", "responseCodeSent",
+	"httpRequest", "clientIp", "country", "headers", "name", "value", "uri", "args", "httpVersion", "httpMethod", "requestId",
+	"fragment", "scheme", "host",
+	"labels", "captchaResponse", "challengeResponse", "responseCode", "solveTimestamp", "failureReason",
+	"ja3Fingerprint", "ja4Fingerprint", "oversizeFields", "requestBodySize", "requestBodySizeInspectedByWAF",
+}
+
+// wafFields maps lowercase field names to those of WAF log records
+var wafFields = func() map[string]string {
+	fields := make(map[string]string, len(wafFieldNames))
+	for _, name := range wafFieldNames {
+		fields[strings.ToLower(name)] = name
+	}
+	return fields
+}()
+
+// numberFields are numeric in WAF log records, but may be strings in the table,
+// as responsecodesent is
+var numberFields = map[string]bool{
+	"timestamp": true, "formatVersion": true, "responseCodeSent": true, "maxRateAllowed": true,
+	"evaluationWindowSec": true, "requestBodySize": true, "requestBodySizeInspectedByWAF": true,
+}
+
+// structuredFields are lists or objects in WAF log records, but may be JSON strings
+// in the table, as excludedrules is
+var structuredFields = map[string]bool{
+	"excludedRules": true, "customerConfig": true, "oversizeFields": true, "customValues": true,
+}
+
+// Record returns the JSON of the WAF log record of a row, with the field names
+// restored and the fields the table types differently converted. Null fields are
+// left out.
+func Record(row map[string]any) ([]byte, error) {
+	data, err := json.Marshal(restore(row))
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode record: %w", err)
+	}
+	return data, nil
+}
+
+// restore restores the field names and types of a row or a value in it
+func restore(v any) any {
+	switch v := v.(type) {
+	case map[string]any:
+		out := make(map[string]any, len(v))
+		for key, value := range v {
+			name := key
+			if field, ok := wafFields[strings.ToLower(key)]; ok {
+				name = field
+			}
+			if value = restoreField(name, restore(value)); value != nil {
+				out[name] = value
+			}
+		}
+		return out
+	case []any:
+		for i, item := range v {
+			v[i] = restore(item)
+		}
+		return v
+	}
+	return v
+}
+
+// restoreField converts a field's value to the type of the field in WAF log
+// records, or returns nil if it has no value of that type
+func restoreField(name string, v any) any {
+	s, ok := v.(string)
+	if !ok {
+		return v
+	}
+	switch {
+	case numberFields[name]:
+		s = strings.TrimSpace(s)
+		if n, err := strconv.ParseInt(s, 10, 64); err == nil {
+			return n
+		}
+		if f, err := strconv.ParseFloat(s, 64); err == nil {
+			return f
+		}
+		return nil
+	case structuredFields[name]:
+		var parsed any
+		if json.Unmarshal([]byte(s), &parsed) != nil {
+			return nil
+		}
+		return restore(parsed)
+	}
+	return v
+}
+
+// IsRow reports whether the top-level keys of a JSON object are those of the WAF
+// log table rather than of a WAF log record: lowercase, as Athena writes them
+func IsRow(raw []byte) bool {
+	var keys map[string]json.RawMessage
+	if json.Unmarshal(raw, &keys) != nil {
+		return false
+	}
+	_, table := keys["httprequest"]
+	_, record := keys["httpRequest"]
+	return table && !record
+}
+
+// RestoreJSON restores a JSON object with the WAF log table's column names, as
+// CTAS with format = 'JSON' writes them, into a WAF log record
+func RestoreJSON(raw []byte) ([]byte, error) {
+	decoder := json.NewDecoder(bytes.NewReader(raw))
+	decoder.UseNumber()
+	var row map[string]any
+	if err := decoder.Decode(&row); err != nil {
+		return nil, err
+	}
+	return Record(row)
+}
@@ -0,0 +1,461 @@
+package athena
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"math/big"
+	"math/bits"
+	"strings"
+	"time"
+)
+
+// Physical types of Parquet columns
+const (
+	physicalBoolean   = 0
+	physicalInt32     = 1
+	physicalInt64     = 2
+	physicalInt96     = 3
+	physicalFloat     = 4
+	physicalDouble    = 5
+	physicalByteArray = 6
+	physicalFixed     = 7
+)
+
+// Encodings of Parquet values
+const (
+	encodingPlain           = 0
+	encodingPlainDictionary = 2
+	encodingRLE             = 3
+	encodingDeltaBinary     = 5
+	encodingDeltaLength     = 6
+	encodingDeltaByteArray  = 7
+	encodingRLEDictionary   = 8
+	encodingByteStreamSplit = 9
+)
+
+// julianUnixEpoch is the Julian day of the Unix epoch, which INT96 timestamps count from
+const julianUnixEpoch = 2440588
+
+// errTruncated is returned for values that end before their page does
+var errTruncated = errors.New("truncated values")
+
+// bitWidth returns the bits needed for levels up to max
+func bitWidth(max int) int {
+	return bits.Len(uint(max))
+}
+
+// readBits returns the width bits of data from bit on, least significant first,
+// as Parquet packs them
+func readBits(data []byte, bit, width int) uint64 {
+	var v uint64
+	for read := 0; read < width; {
+		index, offset := (bit+read)/8, (bit+read)%8
+		if index >= len(data) {
+			break
+		}
+		take := min(8-offset, width-read)
+		v |= (uint64(data[index]>>offset) & (1<<take - 1)) << read
+		read += take
+	}
+	return v
+}
+
+// decodeHybrid decodes n values of the RLE/bit-packing hybrid encoding, in which
+// levels, dictionary indices and booleans are encoded
+func decodeHybrid(data []byte, width, n int) ([]int, error) {
+	if width > 32 {
+		return nil, fmt.Errorf("invalid bit width %d", width)
+	}
+	out := make([]int, 0, n)
+	pos := 0
+	for len(out) < n {
+		header, k := binary.Uvarint(data[pos:])
+		if k <= 0 {
+			return nil, errTruncated
+		}
+		pos += k
+		if header&1 == 0 {
+			size := (width + 7) / 8
+			if pos+size > len(data) {
+				return nil, errTruncated
+			}
+			value := int(readBits(data[pos:pos+size], 0, width))
+			pos += size
+			for count := header >> 1; count > 0 && len(out) < n; count-- {
+				out = append(out, value)
+			}
+			continue
+		}
+		// Writers may leave out the padding of the last bit-packed run
+		groups := header >> 1
+		end := len(data)
+		if packed := groups * uint64(width); packed < uint64(end-pos) {
+			end = pos + int(packed)
+		}
+		run := data[pos:end]
+		for i := 0; uint64(i) < groups*8 && len(out) < n && (i+1)*width <= len(run)*8; i++ {
+			out = append(out, int(readBits(run, i*width, width)))
+		}
+		pos = end
+		if len(out) < n && end == len(data) {
+			return nil, errTruncated
+		}
+	}
+	return out, nil
+}
+
+// decodePrefixedLevels decodes the levels of a version 1 data page, which are
+// prefixed with their length, and returns the data after them
+func decodePrefixedLevels(data []byte, max, n int) ([]int, []byte, error) {
+	if len(data) < 4 {
+		return nil, nil, errTruncated
+	}
+	length := binary.LittleEndian.Uint32(data)
+	if uint64(length) > uint64(len(data)-4) {
+		return nil, nil, errTruncated
+	}
+	levels, err := decodeHybrid(data[4:4+length], bitWidth(max), n)
+	return levels, data[4+length:], err
+}
+
+// decodeDictionaryIndices decodes the dictionary indices of count values, which are
+// prefixed with their bit width
+func decodeDictionaryIndices(data []byte, dict []any, count int) ([]any, error) {
+	if count == 0 {
+		return nil, nil
+	}
+	if len(data) == 0 {
+		return nil, errTruncated
+	}
+	indices, err := decodeHybrid(data[1:], int(data[0]), count)
+	if err != nil {
+		return nil, err
+	}
+	values := make([]any, len(indices))
+	for i, index := range indices {
+		if index >= len(dict) {
+			return nil, fmt.Errorf("dictionary index %d out of range", index)
+		}
+		values[i] = dict[index]
+	}
+	return values, nil
+}
+
+// decodeValues decodes count values of a leaf in an encoding other than a dictionary's
+func decodeValues(leaf *parquetNode, encoding int, data []byte, count int) ([]any, error) {
+	switch encoding {
+	case encodingPlain:
+		return decodePlain(leaf, data, count)
+	case encodingRLE:
+		if leaf.physical != physicalBoolean {
+			break
+		}
+		if len(data) < 4 {
+			return nil, errTruncated
+		}
+		bools, err := decodeHybrid(data[4:], 1, count)
+		if err != nil {
+			return nil, err
+		}
+		values := make([]any, len(bools))
+		for i, b := range bools {
+			values[i] = b == 1
+		}
+		return values, nil
+	case encodingDeltaBinary:
+		if leaf.physical != physicalInt32 && leaf.physical != physicalInt64 {
+			break
+		}
+		ints, _, err := decodeDelta(data)
+		if err != nil {
+			return nil, err
+		}
+		values := make([]any, len(ints))
+		for i, n := range ints {
+			values[i] = convert(leaf, n)
+		}
+		return checkCount(values, count)
+	case encodingDeltaLength:
+		arrays, err := decodeDeltaLength(data)
+		if err != nil {
+			return nil, err
+		}
+		return checkCount(convertArrays(leaf, arrays), count)
+	case encodingDeltaByteArray:
+		prefixes, rest, err := decodeDelta(data)
+		if err != nil {
+			return nil, err
+		}
+		suffixes, err := decodeDeltaLength(rest)
+		if err != nil {
+			return nil, err
+		}
+		if len(suffixes) != len(prefixes) {
+			return nil, errors.New("prefix and suffix counts differ")
+		}
+		arrays := make([][]byte, len(prefixes))
+		var previous []byte
+		for i, prefix := range prefixes {
+			if prefix < 0 || prefix > int64(len(previous)) {
+				return nil, errors.New("invalid prefix length")
+			}
+			arrays[i] = append(previous[:prefix:prefix], suffixes[i]...)
+			previous = arrays[i]
+		}
+		return checkCount(convertArrays(leaf, arrays), count)
+	case encodingByteStreamSplit:
+		width := map[int]int{physicalInt32: 4, physicalInt64: 8, physicalFloat: 4, physicalDouble: 8, physicalFixed: leaf.typeLength}[leaf.physical]
+		if width == 0 {
+			break
+		}
+		if len(data) < width*count {
+			return nil, errTruncated
+		}
+		plain := make([]byte, width*count)
+		for i := 0; i < count; i++ {
+			for j := 0; j < width; j++ {
+				plain[i*width+j] = data[j*count+i]
+			}
+		}
+		return decodePlain(leaf, plain, count)
+	}
+	return nil, fmt.Errorf("unsupported encoding %d of type %d", encoding, leaf.physical)
+}
+
+func checkCount(values []any, count int) ([]any, error) {
+	if len(values) < count {
+		return nil, errTruncated
+	}
+	return values[:count], nil
+}
+
+func convertArrays(leaf *parquetNode, arrays [][]byte) []any {
+	values := make([]any, len(arrays))
+	for i, b := range arrays {
+		values[i] = convert(leaf, b)
+	}
+	return values
+}
+
+// decodePlain decodes count values of a leaf in the plain encoding
+func decodePlain(leaf *parquetNode, data []byte, count int) ([]any, error) {
+	values := make([]any, 0, min(count, len(data)*8+1))
+	pos := 0
+	take := func(n int) ([]byte, error) {
+		if n < 0 || n > len(data)-pos {
+			return nil, errTruncated
+		}
+		pos += n
+		return data[pos-n : pos], nil
+	}
+	for i := 0; i < count; i++ {
+		var v any
+		switch leaf.physical {
+		case physicalBoolean:
+			if i/8 >= len(data) {
+				return nil, errTruncated
+			}
+			values = append(values, data[i/8]>>(i%8)&1 == 1)
+			continue
+		case physicalInt32:
+			b, err := take(4)
+			if err != nil {
+				return nil, err
+			}
+			v = int64(int32(binary.LittleEndian.Uint32(b)))
+		case physicalInt64:
+			b, err := take(8)
+			if err != nil {
+				return nil, err
+			}
+			v = int64(binary.LittleEndian.Uint64(b))
+		case physicalInt96:
+			b, err := take(12)
+			if err != nil {
+				return nil, err
+			}
+			nanos := int64(binary.LittleEndian.Uint64(b))
+			days := int64(binary.LittleEndian.Uint32(b[8:]))
+			values = append(values, (days-julianUnixEpoch)*86400000+nanos/1e6)
+			continue
+		case physicalFloat:
+			b, err := take(4)
+			if err != nil {
+				return nil, err
+			}
+			v = float64(math.Float32frombits(binary.LittleEndian.Uint32(b)))
+		case physicalDouble:
+			b, err := take(8)
+			if err != nil {
+				return nil, err
+			}
+			v = math.Float64frombits(binary.LittleEndian.Uint64(b))
+		case physicalByteArray:
+			b, err := take(4)
+			if err != nil {
+				return nil, err
+			}
+			if v, err = take(int(binary.LittleEndian.Uint32(b))); err != nil {
+				return nil, err
+			}
+		case physicalFixed:
+			b, err := take(leaf.typeLength)
+			if err != nil {
+				return nil, err
+			}
+			v = b
+		default:
+			return nil, fmt.Errorf("unsupported type %d", leaf.physical)
+		}
+		values = append(values, convert(leaf, v))
+	}
+	return values, nil
+}
+
+// decodeDelta decodes the delta binary packed encoding, and returns the data after it
+func decodeDelta(data []byte) ([]int64, []byte, error) {
+	pos := 0
+	uvarint := func() (uint64, error) {
+		v, n := binary.Uvarint(data[pos:])
+		if n <= 0 {
+			return 0, errTruncated
+		}
+		pos += n
+		return v, nil
+	}
+	zigzag := func() (int64, error) {
+		v, err := uvarint()
+		return int64(v>>1) ^ -int64(v&1), err
+	}
+	blockSize, err := uvarint()
+	if err != nil {
+		return nil, nil, err
+	}
+	miniblocks, err := uvarint()
+	if err != nil {
+		return nil, nil, err
+	}
+	total, err := uvarint()
+	if err != nil {
+		return nil, nil, err
+	}
+	last, err := zigzag()
+	if err != nil {
+		return nil, nil, err
+	}
+	if miniblocks == 0 || blockSize%miniblocks != 0 || blockSize/miniblocks%8 != 0 || blockSize > 1<<20 {
+		return nil, nil, errors.New("invalid delta block size")
+	}
+	per := int(blockSize / miniblocks)
+	values := make([]int64, 0, min(total, uint64(len(data))*8+1))
+	if total > 0 {
+		values = append(values, last)
+	}
+	for uint64(len(values)) < total {
+		minDelta, err := zigzag()
+		if err != nil {
+			return nil, nil, err
+		}
+		if uint64(len(data)-pos) < miniblocks {
+			return nil, nil, errTruncated
+		}
+		widths := data[pos : pos+int(miniblocks)]
+		pos += int(miniblocks)
+		for _, width := range widths {
+			if uint64(len(values)) >= total {
+				break
+			}
+			if width > 64 {
+				return nil, nil, fmt.Errorf("invalid bit width %d", width)
+			}
+			size := per * int(width) / 8
+			if size > len(data)-pos {
+				return nil, nil, errTruncated
+			}
+			for i := 0; i < per && uint64(len(values)) < total; i++ {
+				delta := readBits(data[pos:pos+size], i*int(width), int(width))
+				last = int64(uint64(last) + uint64(minDelta) + delta)
+				values = append(values, last)
+			}
+			pos += size
+		}
+	}
+	return values, data[pos:], nil
+}
+
+// decodeDeltaLength decodes the delta length byte array encoding: the lengths of
+// the arrays, delta encoded, then the arrays one after another
+func decodeDeltaLength(data []byte) ([][]byte, error) {
+	lengths, rest, err := decodeDelta(data)
+	if err != nil {
+		return nil, err
+	}
+	arrays := make([][]byte, len(lengths))
+	for i, length := range lengths {
+		if length < 0 || length > int64(len(rest)) {
+			return nil, errTruncated
+		}
+		arrays[i], rest = rest[:length], rest[length:]
+	}
+	return arrays, nil
+}
+
+// convert converts a plain value to the value of its annotated type: strings,
+// dates, timestamps as epoch milliseconds and decimals
+func convert(leaf *parquetNode, v any) any {
+	if decimal := leaf.logical.strct(logicalDecimal); decimal != nil || leaf.converted == convertedDecimal {
+		scale := leaf.scale
+		if decimal != nil {
+			scale = int(decimal.int(1, 0))
+		}
+		switch v := v.(type) {
+		case int64:
+			return decimalNumber(big.NewInt(v), scale)
+		case []byte:
+			n := new(big.Int).SetBytes(v)
+			if len(v) > 0 && v[0]&0x80 != 0 { // Two's complement
+				n.Sub(n, new(big.Int).Lsh(big.NewInt(1), uint(len(v))*8))
+			}
+			return decimalNumber(n, scale)
+		}
+	}
+	switch v := v.(type) {
+	case []byte:
+		return string(v)
+	case int64:
+		if leaf.converted == convertedDate || leaf.logical.has(logicalDate) {
+			return time.Unix(v*86400, 0).UTC().Format("2006-01-02")
+		}
+		switch {
+		case leaf.converted == convertedTimestampMicros:
+			return v / 1000
+		case leaf.logical.has(logicalTimestamp):
+			unit := leaf.logical.strct(logicalTimestamp).strct(2)
+			if unit.has(2) {
+				return v / 1000
+			}
+			if unit.has(3) {
+				return v / 1e6
+			}
+		}
+	}
+	return v
+}
+
+// decimalNumber formats an unscaled decimal as a JSON number
+func decimalNumber(unscaled *big.Int, scale int) json.Number {
+	digits := new(big.Int).Abs(unscaled).String()
+	if scale > 0 {
+		if len(digits) <= scale {
+			digits = strings.Repeat("0", scale-len(digits)+1) + digits
+		}
+		digits = digits[:len(digits)-scale] + "." + digits[len(digits)-scale:]
+	}
+	if unscaled.Sign() < 0 {
+		digits = "-" + digits
+	}
+	return json.Number(digits)
+}
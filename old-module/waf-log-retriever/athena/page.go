@@ -0,0 +1,273 @@
+package athena
+
+import (
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/klauspost/compress/s2"
+	"github.com/klauspost/compress/zstd"
+)
+
+// maxPageSize and maxPageValues bound the uncompressed size and entries of a page,
+// against corrupt files
+const (
+	maxPageSize   = 1 << 30
+	maxPageValues = 1 << 24
+)
+
+// Compression codecs of Parquet column chunks
+const (
+	codecUncompressed = 0
+	codecSnappy       = 1
+	codecGzip         = 2
+	codecZstd         = 6
+)
+
+// Types of Parquet pages
+const (
+	pageData       = 0
+	pageIndex      = 1
+	pageDictionary = 2
+	pageDataV2     = 3
+)
+
+// decompressors decompresses pages, sharing a zstd decoder across the columns of a file
+type decompressors struct {
+	zstd *zstd.Decoder
+}
+
+func newDecompressors() *decompressors {
+	return &decompressors{}
+}
+
+func (d *decompressors) close() {
+	if d.zstd != nil {
+		d.zstd.Close()
+	}
+}
+
+// decompress decompresses a page of a codec to its uncompressed size
+func (d *decompressors) decompress(codec int, data []byte, size int) ([]byte, error) {
+	if size < 0 || size > maxPageSize {
+		return nil, fmt.Errorf("invalid page size %d", size)
+	}
+	var out []byte
+	var err error
+	switch codec {
+	case codecUncompressed:
+		return data, nil
+	case codecSnappy:
+		out, err = s2.Decode(make([]byte, size), data)
+	case codecGzip:
+		var gr *gzip.Reader
+		if gr, err = gzip.NewReader(bytes.NewReader(data)); err == nil {
+			out = make([]byte, size)
+			_, err = io.ReadFull(gr, out)
+			gr.Close()
+		}
+	case codecZstd:
+		if d.zstd == nil {
+			if d.zstd, err = zstd.NewReader(nil); err != nil {
+				return nil, err
+			}
+		}
+		out, err = d.zstd.DecodeAll(data, make([]byte, 0, size))
+	default:
+		return nil, fmt.Errorf("unsupported compression codec %d; write the output with SNAPPY, GZIP or ZSTD compression", codec)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to decompress page: %w", err)
+	}
+	if len(out) != size {
+		return nil, fmt.Errorf("page decompressed to %d bytes rather than %d", len(out), size)
+	}
+	return out, nil
+}
+
+// columnCursor reads the entries of a column chunk, a page at a time: the
+// repetition and definition levels of each and the values of those defined
+type columnCursor struct {
+	leaf   *parquetNode
+	codec  int
+	data   []byte // The rest of the chunk's pages
+	codecs *decompressors
+
+	dict       []any
+	reps, defs []int
+	values     []any
+	entry      int // Next entry of the page
+	value      int // Next value of the page
+}
+
+// peek returns the levels of the next entry, or io.EOF after the last
+func (c *columnCursor) peek() (rep, def int, err error) {
+	for c.entry >= len(c.defs) {
+		if err := c.readPage(); errors.Is(err, io.EOF) {
+			return 0, 0, err
+		} else if err != nil {
+			return 0, 0, fmt.Errorf("column %s: %w", c.leaf.name, err)
+		}
+	}
+	rep = 0
+	if c.reps != nil {
+		rep = c.reps[c.entry]
+	}
+	return rep, c.defs[c.entry], nil
+}
+
+// next consumes the next entry, and returns its value or nil if it is not defined
+func (c *columnCursor) next() (any, error) {
+	_, def, err := c.peek()
+	if errors.Is(err, io.EOF) {
+		return nil, errors.New("column ended early")
+	}
+	if err != nil {
+		return nil, err
+	}
+	c.entry++
+	if def < c.leaf.maxDef {
+		return nil, nil
+	}
+	if c.value >= len(c.values) {
+		return nil, errors.New("page has fewer values than defined entries")
+	}
+	c.value++
+	return c.values[c.value-1], nil
+}
+
+// readPage decodes the next data page of the chunk, reading its dictionary page
+// first if it comes to it
+func (c *columnCursor) readPage() error {
+	for {
+		if len(c.data) == 0 {
+			return io.EOF
+		}
+		decoder := &thriftDecoder{data: c.data}
+		header, err := decoder.readStruct()
+		if err != nil {
+			return fmt.Errorf("failed to decode page header: %w", err)
+		}
+		size := header.int(3, -1)
+		if size < 0 || size > int64(len(c.data)-decoder.pos) {
+			return errors.New("invalid page size")
+		}
+		page := c.data[decoder.pos : decoder.pos+int(size)]
+		c.data = c.data[decoder.pos+int(size):]
+		uncompressed := int(header.int(2, -1))
+
+		switch header.int(1, -1) {
+		case pageDictionary:
+			dh := header.strct(7)
+			if dh == nil {
+				return errors.New("missing dictionary page header")
+			}
+			data, err := c.codecs.decompress(c.codec, page, uncompressed)
+			if err != nil {
+				return err
+			}
+			if c.dict, err = decodePlain(c.leaf, data, int(dh.int(1, 0))); err != nil {
+				return fmt.Errorf("failed to decode dictionary: %w", err)
+			}
+		case pageData:
+			dh := header.strct(5)
+			if dh == nil {
+				return errors.New("missing data page header")
+			}
+			data, err := c.codecs.decompress(c.codec, page, uncompressed)
+			if err != nil {
+				return err
+			}
+			return c.decodeV1(dh, data)
+		case pageDataV2:
+			dh := header.strct(8)
+			if dh == nil {
+				return errors.New("missing data page header")
+			}
+			return c.decodeV2(dh, page, uncompressed)
+		}
+	}
+}
+
+// decodeV1 decodes a version 1 data page, whose levels are compressed with its
+// values and prefixed with their length
+func (c *columnCursor) decodeV1(header thriftStruct, data []byte) error {
+	n := int(header.int(1, 0))
+	if n < 0 || n > maxPageValues {
+		return fmt.Errorf("invalid page entry count %d", n)
+	}
+	c.entry, c.value = 0, 0
+	c.reps, c.defs = nil, nil
+	var err error
+	if c.leaf.maxRep > 0 {
+		if c.reps, data, err = decodePrefixedLevels(data, c.leaf.maxRep, n); err != nil {
+			return fmt.Errorf("failed to decode repetition levels: %w", err)
+		}
+	}
+	if c.leaf.maxDef > 0 {
+		if c.defs, data, err = decodePrefixedLevels(data, c.leaf.maxDef, n); err != nil {
+			return fmt.Errorf("failed to decode definition levels: %w", err)
+		}
+	} else {
+		c.defs = make([]int, n)
+	}
+	return c.decodeValues(int(header.int(2, 0)), data)
+}
+
+// decodeV2 decodes a version 2 data page, whose levels come uncompressed before its
+// values
+func (c *columnCursor) decodeV2(header thriftStruct, page []byte, uncompressed int) error {
+	n := int(header.int(1, 0))
+	if n < 0 || n > maxPageValues {
+		return fmt.Errorf("invalid page entry count %d", n)
+	}
+	repLength, defLength := int(header.int(6, 0)), int(header.int(5, 0))
+	if repLength < 0 || defLength < 0 || repLength+defLength > len(page) {
+		return errors.New("invalid level lengths")
+	}
+	c.entry, c.value = 0, 0
+	c.reps, c.defs = nil, nil
+	var err error
+	if c.leaf.maxRep > 0 {
+		if c.reps, err = decodeHybrid(page[:repLength], bitWidth(c.leaf.maxRep), n); err != nil {
+			return fmt.Errorf("failed to decode repetition levels: %w", err)
+		}
+	}
+	if c.leaf.maxDef > 0 {
+		if c.defs, err = decodeHybrid(page[repLength:repLength+defLength], bitWidth(c.leaf.maxDef), n); err != nil {
+			return fmt.Errorf("failed to decode definition levels: %w", err)
+		}
+	} else {
+		c.defs = make([]int, n)
+	}
+	data := page[repLength+defLength:]
+	if header.bool(7, true) {
+		if data, err = c.codecs.decompress(c.codec, data, uncompressed-repLength-defLength); err != nil {
+			return err
+		}
+	}
+	return c.decodeValues(int(header.int(4, 0)), data)
+}
+
+// decodeValues decodes the values of the page's defined entries
+func (c *columnCursor) decodeValues(encoding int, data []byte) error {
+	count := 0
+	for _, def := range c.defs {
+		if def == c.leaf.maxDef {
+			count++
+		}
+	}
+	var err error
+	switch encoding {
+	case encodingPlainDictionary, encodingRLEDictionary:
+		c.values, err = decodeDictionaryIndices(data, c.dict, count)
+	default:
+		c.values, err = decodeValues(c.leaf, encoding, data, count)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to decode values: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,374 @@
+package athena
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// parquetMagic starts and ends every Parquet file; encryptedMagic ends those with
+// an encrypted footer
+var (
+	parquetMagic   = []byte("PAR1")
+	encryptedMagic = []byte("PARE")
+)
+
+// maxFooterSize and maxChunkSize bound what is read into memory for a corrupt file
+const (
+	maxFooterSize = 64 << 20
+	maxChunkSize  = 1 << 30
+)
+
+// Repetition types of Parquet schema elements
+const (
+	repRequired = 0
+	repOptional = 1
+	repRepeated = 2
+)
+
+// Converted types, the legacy annotations of Parquet schema elements
+const (
+	convertedUTF8            = 0
+	convertedMap             = 1
+	convertedMapKeyValue     = 2
+	convertedList            = 3
+	convertedDecimal         = 5
+	convertedDate            = 6
+	convertedTimestampMillis = 9
+	convertedTimestampMicros = 10
+)
+
+// Fields of the Parquet LogicalType union, which supersedes converted types
+const (
+	logicalMap       = 2
+	logicalList      = 3
+	logicalDecimal   = 5
+	logicalDate      = 6
+	logicalTimestamp = 8
+)
+
+// IsParquet reports whether data starts as a Parquet file does
+func IsParquet(data []byte) bool {
+	return bytes.HasPrefix(data, parquetMagic)
+}
+
+// parquetNode is an element of a Parquet file's schema
+type parquetNode struct {
+	name       string
+	repetition int
+	physical   int // Of leaves
+	typeLength int // Of FIXED_LEN_BYTE_ARRAY leaves
+	converted  int // -1 without a converted type
+	logical    thriftStruct
+	scale      int
+	children   []*parquetNode
+
+	maxDef, maxRep int   // Levels of the node's values, counting the node itself
+	leaves         []int // Columns under the node, in order; the first drives assembly
+}
+
+func (n *parquetNode) isLeaf() bool {
+	return n.children == nil
+}
+
+// annotatedList reports whether a group is annotated as a list
+func (n *parquetNode) annotatedList() bool {
+	return n.converted == convertedList || n.logical.has(logicalList)
+}
+
+// annotatedMap reports whether a group is annotated as a map
+func (n *parquetNode) annotatedMap() bool {
+	return n.converted == convertedMap || n.converted == convertedMapKeyValue || n.logical.has(logicalMap)
+}
+
+// ForEachParquetRow streams the rows of a Parquet file, one row group at a time, as
+// maps by column name. Nested columns are maps and lists, as Athena writes structs
+// and arrays.
+func ForEachParquetRow(r io.ReaderAt, size int64, fn func(row map[string]any) error) error {
+	meta, err := readParquetFooter(r, size)
+	if err != nil {
+		return err
+	}
+	root, leaves, err := parquetSchema(meta.list(2))
+	if err != nil {
+		return err
+	}
+	codecs := newDecompressors()
+	defer codecs.close()
+
+	for _, item := range meta.list(4) {
+		group, _ := item.(thriftStruct)
+		chunks := group.list(1)
+		if len(chunks) != len(leaves) {
+			return fmt.Errorf("row group has %d columns rather than the %d of the schema", len(chunks), len(leaves))
+		}
+		cursors := make([]*columnCursor, len(leaves))
+		for i, item := range chunks {
+			chunk, _ := item.(thriftStruct)
+			if cursors[i], err = readColumnChunk(r, size, chunk, leaves[i], codecs); err != nil {
+				return fmt.Errorf("column %s: %w", leaves[i].name, err)
+			}
+		}
+		a := &assembler{cursors: cursors}
+		for rows := group.int(3, 0); rows > 0; rows-- {
+			row, err := a.group(root)
+			if err != nil {
+				return err
+			}
+			if err := fn(row); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// readParquetFooter decodes the FileMetaData at the end of a Parquet file
+func readParquetFooter(r io.ReaderAt, size int64) (thriftStruct, error) {
+	tail := make([]byte, 8)
+	if size < 12 {
+		return nil, errors.New("too short for a Parquet file")
+	}
+	if _, err := r.ReadAt(tail, size-8); err != nil {
+		return nil, fmt.Errorf("failed to read the Parquet footer: %w", err)
+	}
+	if bytes.Equal(tail[4:], encryptedMagic) {
+		return nil, errors.New("the Parquet file is encrypted")
+	}
+	if !bytes.Equal(tail[4:], parquetMagic) {
+		return nil, errors.New("the Parquet file is truncated: it does not end with PAR1")
+	}
+	length := int64(binary.LittleEndian.Uint32(tail))
+	if length > maxFooterSize || length > size-12 {
+		return nil, fmt.Errorf("invalid Parquet footer length %d", length)
+	}
+	footer := make([]byte, length)
+	if _, err := r.ReadAt(footer, size-8-length); err != nil {
+		return nil, fmt.Errorf("failed to read the Parquet footer: %w", err)
+	}
+	decoder := &thriftDecoder{data: footer}
+	meta, err := decoder.readStruct()
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode the Parquet footer: %w", err)
+	}
+	return meta, nil
+}
+
+// parquetSchema builds the tree of a Parquet file's schema from its flattened
+// elements, and returns its root and leaves in column order
+func parquetSchema(elements []any) (*parquetNode, []*parquetNode, error) {
+	var leaves []*parquetNode
+	pos := 0
+	var build func(parent *parquetNode, depth int) (*parquetNode, error)
+	build = func(parent *parquetNode, depth int) (*parquetNode, error) {
+		if pos >= len(elements) || depth > maxThriftDepth {
+			return nil, errors.New("invalid Parquet schema")
+		}
+		element, _ := elements[pos].(thriftStruct)
+		pos++
+		node := &parquetNode{
+			name:       element.string(4),
+			repetition: int(element.int(3, repRequired)),
+			physical:   int(element.int(1, -1)),
+			typeLength: int(element.int(2, 0)),
+			converted:  int(element.int(6, -1)),
+			logical:    element.strct(10),
+			scale:      int(element.int(7, 0)),
+		}
+		if parent != nil {
+			node.maxDef, node.maxRep = parent.maxDef, parent.maxRep
+			if node.repetition != repRequired {
+				node.maxDef++
+			}
+			if node.repetition == repRepeated {
+				node.maxRep++
+			}
+		}
+		children := element.int(5, 0)
+		if !element.has(5) || (children == 0 && parent != nil) {
+			if parent == nil {
+				return nil, errors.New("invalid Parquet schema: the root is not a group")
+			}
+			node.leaves = []int{len(leaves)}
+			leaves = append(leaves, node)
+			return node, nil
+		}
+		node.children = []*parquetNode{}
+		for i := int64(0); i < children; i++ {
+			child, err := build(node, depth+1)
+			if err != nil {
+				return nil, err
+			}
+			node.children = append(node.children, child)
+			node.leaves = append(node.leaves, child.leaves...)
+		}
+		if len(node.leaves) == 0 {
+			return nil, fmt.Errorf("invalid Parquet schema: group %s has no columns", node.name)
+		}
+		return node, nil
+	}
+	root, err := build(nil, 0)
+	if err != nil {
+		return nil, nil, err
+	}
+	return root, leaves, nil
+}
+
+// readColumnChunk reads a column chunk of a row group into memory, from its first
+// page, which is its dictionary page if it has one
+func readColumnChunk(r io.ReaderAt, size int64, chunk thriftStruct, leaf *parquetNode, codecs *decompressors) (*columnCursor, error) {
+	if chunk.string(1) != "" {
+		return nil, errors.New("columns in other files are not supported")
+	}
+	meta := chunk.strct(3)
+	if meta == nil {
+		return nil, errors.New("missing column metadata")
+	}
+	start := meta.int(9, 0)
+	if dict := meta.int(11, 0); dict > 0 && dict < start {
+		start = dict
+	}
+	length := meta.int(7, 0)
+	if start < 4 || length < 0 || length > maxChunkSize || start+length > size {
+		return nil, errors.New("invalid column chunk offsets")
+	}
+	data := make([]byte, length)
+	if _, err := r.ReadAt(data, start); err != nil {
+		return nil, fmt.Errorf("failed to read column chunk: %w", err)
+	}
+	return &columnCursor{
+		leaf:   leaf,
+		codec:  int(meta.int(4, 0)),
+		data:   data,
+		codecs: codecs,
+	}, nil
+}
+
+// assembler assembles rows from the levels and values of their columns, as
+// described by the Dremel paper Parquet is based on
+type assembler struct {
+	cursors []*columnCursor
+}
+
+// group assembles a value of a group, all of whose ancestors are present
+func (a *assembler) group(node *parquetNode) (map[string]any, error) {
+	row := make(map[string]any, len(node.children))
+	for _, child := range node.children {
+		var value any
+		var err error
+		if child.repetition == repRepeated {
+			value, err = a.repeated(child)
+		} else {
+			value, err = a.value(child)
+		}
+		if err != nil {
+			return nil, err
+		}
+		if value != nil {
+			row[child.name] = value
+		}
+	}
+	return row, nil
+}
+
+// value assembles a value of a node that is not repeated itself, or an element of
+// a repeated one, or returns nil for a null one
+func (a *assembler) value(node *parquetNode) (any, error) {
+	driver := a.cursors[node.leaves[0]]
+	_, def, err := driver.peek()
+	if err != nil {
+		return nil, err
+	}
+	if def < node.maxDef {
+		return nil, a.skip(node)
+	}
+	switch {
+	case node.isLeaf():
+		return driver.next()
+	case node.annotatedList() && len(node.children) == 1 && node.children[0].repetition == repRepeated:
+		return a.list(node, node.children[0])
+	case node.annotatedMap() && len(node.children) == 1 && node.children[0].repetition == repRepeated:
+		return a.mapValue(node.children[0])
+	}
+	return a.group(node)
+}
+
+// repeated assembles the elements of a repeated node, which are none if the first
+// entry of its driving column is not defined to its level
+func (a *assembler) repeated(node *parquetNode) ([]any, error) {
+	driver := a.cursors[node.leaves[0]]
+	_, def, err := driver.peek()
+	if err != nil {
+		return nil, err
+	}
+	items := []any{}
+	if def < node.maxDef {
+		return items, a.skip(node)
+	}
+	for {
+		item, err := a.value(node)
+		if err != nil {
+			return nil, err
+		}
+		items = append(items, item)
+		rep, _, err := driver.peek()
+		if errors.Is(err, io.EOF) || (err == nil && rep < node.maxRep) {
+			return items, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+}
+
+// list assembles a group annotated as a list from its repeated child. The child
+// wraps each element, unless it is the element itself, as in files written with
+// the two-level lists of older writers.
+func (a *assembler) list(parent, node *parquetNode) ([]any, error) {
+	items, err := a.repeated(node)
+	if err != nil {
+		return nil, err
+	}
+	if node.isLeaf() || len(node.children) != 1 || node.name == "array" || node.name == parent.name+"_tuple" {
+		return items, nil
+	}
+	element := node.children[0].name
+	for i, item := range items {
+		if m, ok := item.(map[string]any); ok {
+			items[i] = m[element]
+		}
+	}
+	return items, nil
+}
+
+// mapValue assembles a group annotated as a map from its repeated key_value child
+func (a *assembler) mapValue(node *parquetNode) (map[string]any, error) {
+	items, err := a.repeated(node)
+	if err != nil {
+		return nil, err
+	}
+	if node.isLeaf() || len(node.children) < 2 {
+		return nil, fmt.Errorf("invalid Parquet map %s", node.name)
+	}
+	key, value := node.children[0].name, node.children[1].name
+	out := make(map[string]any, len(items))
+	for _, item := range items {
+		if m, ok := item.(map[string]any); ok && m[key] != nil {
+			out[fmt.Sprint(m[key])] = m[value]
+		}
+	}
+	return out, nil
+}
+
+// skip consumes the entry of every column under a node that is null or an empty
+// repetition, which has one entry in each
+func (a *assembler) skip(node *parquetNode) error {
+	for _, leaf := range node.leaves {
+		if _, err := a.cursors[leaf].next(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
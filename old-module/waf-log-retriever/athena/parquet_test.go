@@ -0,0 +1,118 @@
+package athena
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+// The fixtures in testdata are written by parquet-go, with the generator in
+// testdata/generate, along with the records they are expected to be read as.
+
+func TestForEachParquetRow(t *testing.T) {
+	tests := []struct {
+		fixture  string
+		expected string
+	}{
+		{"waf-uncompressed-v1-plain.parquet", "waf.jsonl"},
+		{"waf-snappy-v1-dictionary.parquet", "waf.jsonl"},
+		{"waf-gzip-v2-dictionary.parquet", "waf.jsonl"},
+		{"waf-zstd-v2-delta.parquet", "waf.jsonl"},
+		{"waf-snappy-row-groups.parquet", "waf.jsonl"},
+		{"types.parquet", "types.jsonl"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.fixture, func(t *testing.T) {
+			expected := readExpected(t, filepath.Join("testdata", tt.expected))
+			actual := readParquetRecords(t, filepath.Join("testdata", tt.fixture))
+			if len(actual) != len(expected) {
+				t.Fatalf("read %d records, expected %d", len(actual), len(expected))
+			}
+			for i := range expected {
+				if !reflect.DeepEqual(actual[i], expected[i]) {
+					got, _ := json.Marshal(actual[i])
+					want, _ := json.Marshal(expected[i])
+					t.Errorf("record %d:\n got  %s\n want %s", i, got, want)
+				}
+			}
+		})
+	}
+}
+
+func TestForEachParquetRowTruncated(t *testing.T) {
+	data, err := os.ReadFile(filepath.Join("testdata", "waf-snappy-v1-dictionary.parquet"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, size := range []int{0, 4, 12, len(data) / 2, len(data) - 1} {
+		truncated := data[:size]
+		err := ForEachParquetRow(bytes.NewReader(truncated), int64(len(truncated)), func(map[string]any) error { return nil })
+		if err == nil {
+			t.Errorf("reading %d of %d bytes succeeded", size, len(data))
+		}
+	}
+}
+
+// readParquetRecords reads the WAF log records of a Parquet file, decoded as the
+// expected records are
+func readParquetRecords(t *testing.T, path string) []any {
+	t.Helper()
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var records []any
+	err = ForEachParquetRow(f, info.Size(), func(row map[string]any) error {
+		data, err := Record(row)
+		if err != nil {
+			return err
+		}
+		records = append(records, decodeJSON(t, data))
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("failed to read %s: %v", path, err)
+	}
+	return records
+}
+
+// readExpected reads the expected records of a fixture
+func readExpected(t *testing.T, path string) []any {
+	t.Helper()
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	var records []any
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		records = append(records, decodeJSON(t, scanner.Bytes()))
+	}
+	if err := scanner.Err(); err != nil {
+		t.Fatal(err)
+	}
+	return records
+}
+
+// decodeJSON decodes JSON keeping numbers as written, so that decimals compare
+// with their scale
+func decodeJSON(t *testing.T, data []byte) any {
+	t.Helper()
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+	var v any
+	if err := decoder.Decode(&v); err != nil {
+		t.Fatalf("failed to decode %s: %v", data, err)
+	}
+	return v
+}
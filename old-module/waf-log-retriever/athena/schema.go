@@ -0,0 +1,139 @@
+package athena
+
+import (
+	"fmt"
+	"strings"
+)
+
+// wafTable is the columns of the WAF log table, as created by the DDL of the AWS WAF
+// documentation, in order. Text output without a header is read by it.
+const wafTable = `struct<
+timestamp:bigint,
+formatversion:int,
+webaclid:string,
+terminatingruleid:string,
+terminatingruletype:string,
+action:string,
+terminatingrulematchdetails:array<struct<conditiontype:string,sensitivitylevel:string,location:string,matcheddata:array<string>>>,
+httpsourcename:string,
+httpsourceid:string,
+rulegrouplist:array<struct<rulegroupid:string,terminatingrule:struct<ruleid:string,action:string,rulematchdetails:array<struct<conditiontype:string,sensitivitylevel:string,location:string,matcheddata:array<string>>>>,nonterminatingmatchingrules:array<struct<ruleid:string,action:string,overriddenaction:string,rulematchdetails:array<struct<conditiontype:string,sensitivitylevel:string,location:string,matcheddata:array<string>>>,challengeresponse:struct<responsecode:string,solvetimestamp:string>,captcharesponse:struct<responsecode:string,solvetimestamp:string>>>,excludedrules:string>>,
+ratebasedrulelist:array<struct<ratebasedruleid:string,limitkey:string,maxrateallowed:int>>,
+nonterminatingmatchingrules:array<struct<ruleid:string,action:string,rulematchdetails:array<struct<conditiontype:string,sensitivitylevel:string,location:string,matcheddata:array<string>>>,challengeresponse:struct<responsecode:string,solvetimestamp:string>,captcharesponse:struct<responsecode:string,solvetimestamp:string>>>,
+requestheadersinserted:array<struct<name:string,value:string>>,
+responsecodesent:string,
+httprequest:struct<clientip:string,country:string,headers:array<struct<name:string,value:string>>,uri:string,args:string,httpversion:string,httpmethod:string,requestid:string,fragment:string,scheme:string,host:string>,
+labels:array<struct<name:string>>,
+captcharesponse:struct<responsecode:string,solvetimestamp:string,failurereason:string>,
+challengeresponse:struct<responsecode:string,solvetimestamp:string,failurereason:string>,
+ja3fingerprint:string,
+ja4fingerprint:string,
+oversizefields:string,
+requestbodysize:int,
+requestbodysizeinspectedbywaf:int>`
+
+// Kinds of Hive types
+const (
+	kindScalar = iota
+	kindStruct
+	kindArray
+	kindMap
+)
+
+// hiveType is a Hive type, as in Athena DDL
+type hiveType struct {
+	kind   int
+	name   string      // Scalar type name, e.g. string or bigint
+	fields []hiveField // Of structs
+	elem   *hiveType   // Of arrays, and the values of maps
+}
+
+// hiveField is a field of a struct type
+type hiveField struct {
+	name string
+	typ  *hiveType
+}
+
+// tableType is the parsed wafTable
+var tableType = mustParseHiveType(wafTable)
+
+// field returns the type of a struct's field by name, or nil
+func (t *hiveType) field(name string) *hiveType {
+	for _, f := range t.fields {
+		if strings.EqualFold(f.name, name) {
+			return f.typ
+		}
+	}
+	return nil
+}
+
+// mustParseHiveType parses a Hive type, ignoring white space
+func mustParseHiveType(s string) *hiveType {
+	s = strings.Join(strings.Fields(s), "")
+	t, rest, err := parseHiveType(s)
+	if err != nil || rest != "" {
+		panic(fmt.Sprintf("invalid Hive type %q: %v", s, err))
+	}
+	return t
+}
+
+// parseHiveType parses a Hive type at the start of s and returns the rest
+func parseHiveType(s string) (*hiveType, string, error) {
+	switch {
+	case strings.HasPrefix(s, "struct<"):
+		t := &hiveType{kind: kindStruct}
+		s = s[len("struct<"):]
+		for {
+			name, rest, ok := strings.Cut(s, ":")
+			if !ok {
+				return nil, "", fmt.Errorf("struct field without type at %q", s)
+			}
+			typ, rest, err := parseHiveType(rest)
+			if err != nil {
+				return nil, "", err
+			}
+			t.fields = append(t.fields, hiveField{name: name, typ: typ})
+			switch {
+			case strings.HasPrefix(rest, ","):
+				s = rest[1:]
+			case strings.HasPrefix(rest, ">"):
+				return t, rest[1:], nil
+			default:
+				return nil, "", fmt.Errorf("unterminated struct at %q", rest)
+			}
+		}
+	case strings.HasPrefix(s, "array<"):
+		elem, rest, err := parseHiveType(s[len("array<"):])
+		if err != nil {
+			return nil, "", err
+		}
+		if !strings.HasPrefix(rest, ">") {
+			return nil, "", fmt.Errorf("unterminated array at %q", rest)
+		}
+		return &hiveType{kind: kindArray, elem: elem}, rest[1:], nil
+	case strings.HasPrefix(s, "map<"):
+		key, rest, err := parseHiveType(s[len("map<"):])
+		if err != nil {
+			return nil, "", err
+		}
+		if key.kind != kindScalar || !strings.HasPrefix(rest, ",") {
+			return nil, "", fmt.Errorf("invalid map key at %q", rest)
+		}
+		value, rest, err := parseHiveType(rest[1:])
+		if err != nil {
+			return nil, "", err
+		}
+		if !strings.HasPrefix(rest, ">") {
+			return nil, "", fmt.Errorf("unterminated map at %q", rest)
+		}
+		return &hiveType{kind: kindMap, elem: value}, rest[1:], nil
+	}
+	end := strings.IndexAny(s, ",>")
+	if end < 0 {
+		end = len(s)
+	}
+	if end == 0 {
+		return nil, "", fmt.Errorf("missing type at %q", s)
+	}
+	return &hiveType{kind: kindScalar, name: s[:end]}, s[end:], nil
+}
@@ -0,0 +1,350 @@
+// Command generate writes the Parquet fixtures of the athena package's tests with
+// parquet-go, a Parquet implementation independent of the package's reader, and
+// the WAF log records each is expected to be read back as.
+//
+// Run it from this directory to regenerate the fixtures:
+//
+//	go run . -out ..
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/parquet-go/parquet-go"
+)
+
+// wafRow is a row of the WAF log table, with the lowercase column and field names
+// Athena writes
+type wafRow struct {
+	Timestamp         int64       `parquet:"timestamp"`
+	FormatVersion     int32       `parquet:"formatversion"`
+	WebACLID          string      `parquet:"webaclid"`
+	TerminatingRuleID string      `parquet:"terminatingruleid"`
+	Action            string      `parquet:"action"`
+	RuleGroupList     []ruleGroup `parquet:"rulegrouplist,list"`
+	ResponseCodeSent  *string     `parquet:"responsecodesent,optional"`
+	HTTPRequest       httpRequest `parquet:"httprequest"`
+	Labels            []label     `parquet:"labels,list"`
+}
+
+type ruleGroup struct {
+	RuleGroupID                 string  `parquet:"rulegroupid"`
+	TerminatingRule             *rule   `parquet:"terminatingrule,optional"`
+	NonTerminatingMatchingRules []rule  `parquet:"nonterminatingmatchingrules,list"`
+	ExcludedRules               *string `parquet:"excludedrules,optional"`
+}
+
+type rule struct {
+	RuleID string `parquet:"ruleid"`
+	Action string `parquet:"action"`
+}
+
+type httpRequest struct {
+	ClientIP   string   `parquet:"clientip"`
+	Country    string   `parquet:"country"`
+	Headers    []header `parquet:"headers,list"`
+	URI        string   `parquet:"uri"`
+	Args       *string  `parquet:"args,optional"`
+	HTTPMethod string   `parquet:"httpmethod"`
+	RequestID  string   `parquet:"requestid"`
+}
+
+type header struct {
+	Name  string `parquet:"name"`
+	Value string `parquet:"value"`
+}
+
+type label struct {
+	Name string `parquet:"name"`
+}
+
+// typesRow has a column of each type the reader converts
+type typesRow struct {
+	ID         int64             `parquet:"id"`
+	Small      int32             `parquet:"small"`
+	Flag       bool              `parquet:"flag"`
+	Ratio      float64           `parquet:"ratio"`
+	Score      float32           `parquet:"score"`
+	Day        int32             `parquet:"day,date"`
+	Millis     int64             `parquet:"millis,timestamp(millisecond)"`
+	Micros     int64             `parquet:"micros,timestamp(microsecond)"`
+	Nanos      int64             `parquet:"nanos,timestamp(nanosecond)"`
+	Price      int64             `parquet:"price,decimal(2:18)"`
+	Rate       int32             `parquet:"rate,decimal(3:9)"`
+	Note       *string           `parquet:"note,optional"`
+	Tags       []string          `parquet:"tags,list"`
+	Matrix     [][]int64         `parquet:"matrix,list"`
+	Attributes map[string]string `parquet:"attributes"`
+}
+
+// wafFixtures are written with the same rows, covering the codecs, page versions
+// and encodings the reader supports
+var wafFixtures = []struct {
+	name    string
+	options []parquet.WriterOption
+}{
+	{"waf-uncompressed-v1-plain", []parquet.WriterOption{
+		parquet.Compression(&parquet.Uncompressed), parquet.DataPageVersion(1), parquet.DefaultEncoding(&parquet.Plain),
+	}},
+	{"waf-snappy-v1-dictionary", []parquet.WriterOption{
+		parquet.Compression(&parquet.Snappy), parquet.DataPageVersion(1), parquet.DefaultEncoding(&parquet.RLEDictionary),
+	}},
+	{"waf-gzip-v2-dictionary", []parquet.WriterOption{
+		parquet.Compression(&parquet.Gzip), parquet.DataPageVersion(2), parquet.DefaultEncoding(&parquet.RLEDictionary),
+	}},
+	{"waf-zstd-v2-delta", []parquet.WriterOption{
+		parquet.Compression(&parquet.Zstd), parquet.DataPageVersion(2),
+		parquet.DefaultEncodingFor(parquet.ByteArray, &parquet.DeltaByteArray),
+		parquet.DefaultEncodingFor(parquet.Int64, &parquet.DeltaBinaryPacked),
+	}},
+	{"waf-snappy-row-groups", []parquet.WriterOption{
+		parquet.Compression(&parquet.Snappy), parquet.MaxRowsPerRowGroup(7), parquet.PageBufferSize(512),
+	}},
+}
+
+func main() {
+	out := flag.String("out", "..", "Directory to write the fixtures to")
+	flag.Parse()
+
+	rows, records := wafRows(40)
+	for _, fixture := range wafFixtures {
+		if err := writeParquet(filepath.Join(*out, fixture.name+".parquet"), rows, fixture.options...); err != nil {
+			log.Fatal(err)
+		}
+	}
+	if err := writeRecords(filepath.Join(*out, "waf.jsonl"), records); err != nil {
+		log.Fatal(err)
+	}
+
+	types, typeRecords := typesRows(12)
+	if err := writeParquet(filepath.Join(*out, "types.parquet"), types, parquet.Compression(&parquet.Snappy)); err != nil {
+		log.Fatal(err)
+	}
+	if err := writeRecords(filepath.Join(*out, "types.jsonl"), typeRecords); err != nil {
+		log.Fatal(err)
+	}
+}
+
+// wafRows returns rows of the WAF log table and the WAF log records they hold
+func wafRows(n int) ([]wafRow, []map[string]any) {
+	random := rand.New(rand.NewSource(1))
+	actions := []string{"ALLOW", "BLOCK", "COUNT", "CAPTCHA"}
+	countries := []string{"US", "DE", "VN", "BR", "JP"}
+	methods := []string{"GET", "POST", "PUT"}
+
+	rows := make([]wafRow, n)
+	records := make([]map[string]any, n)
+	for i := range rows {
+		row := wafRow{
+			Timestamp:         1700000000000 + int64(i)*1234,
+			FormatVersion:     1,
+			WebACLID:          "arn:aws:wafv2:us-east-1:123456789012:regional/webacl/example/0f1e2d3c",
+			TerminatingRuleID: "Default_Action",
+			Action:            actions[random.Intn(len(actions))],
+			HTTPRequest: httpRequest{
+				ClientIP:   fmt.Sprintf("10.0.%d.%d", random.Intn(256), random.Intn(256)),
+				Country:    countries[random.Intn(len(countries))],
+				URI:        fmt.Sprintf("/path/%d", random.Intn(5)),
+				HTTPMethod: methods[random.Intn(len(methods))],
+				RequestID:  fmt.Sprintf("request-%04d", i),
+			},
+		}
+		request := map[string]any{
+			"clientIp":   row.HTTPRequest.ClientIP,
+			"country":    row.HTTPRequest.Country,
+			"uri":        row.HTTPRequest.URI,
+			"httpMethod": row.HTTPRequest.HTTPMethod,
+			"requestId":  row.HTTPRequest.RequestID,
+		}
+		record := map[string]any{
+			"timestamp":         row.Timestamp,
+			"formatVersion":     1,
+			"webaclId":          row.WebACLID,
+			"terminatingRuleId": row.TerminatingRuleID,
+			"action":            row.Action,
+			"httpRequest":       request,
+		}
+
+		headers := []any{}
+		for j := random.Intn(4); j > 0; j-- {
+			h := header{Name: fmt.Sprintf("x-header-%d", j), Value: fmt.Sprintf("value-%d", random.Intn(100))}
+			row.HTTPRequest.Headers = append(row.HTTPRequest.Headers, h)
+			headers = append(headers, map[string]any{"name": h.Name, "value": h.Value})
+		}
+		request["headers"] = headers
+		if random.Intn(3) == 0 {
+			args := fmt.Sprintf("id=%d", random.Intn(1000))
+			row.HTTPRequest.Args = &args
+			request["args"] = args
+		}
+		if row.Action == "BLOCK" {
+			code := "403"
+			row.ResponseCodeSent = &code
+			record["responseCodeSent"] = 403
+		}
+
+		labels := []any{}
+		for j := random.Intn(3); j > 0; j-- {
+			name := fmt.Sprintf("awswaf:managed:aws:label-%d", j)
+			row.Labels = append(row.Labels, label{Name: name})
+			labels = append(labels, map[string]any{"name": name})
+		}
+		record["labels"] = labels
+
+		groups := []any{}
+		for j := random.Intn(3); j > 0; j-- {
+			group := ruleGroup{RuleGroupID: fmt.Sprintf("AWS#AWSManagedRulesCommonRuleSet#%d", j)}
+			out := map[string]any{"ruleGroupId": group.RuleGroupID}
+			if random.Intn(2) == 0 {
+				group.TerminatingRule = &rule{RuleID: "SizeRestrictions_BODY", Action: "BLOCK"}
+				out["terminatingRule"] = map[string]any{"ruleId": "SizeRestrictions_BODY", "action": "BLOCK"}
+			}
+			matching := []any{}
+			for k := random.Intn(3); k > 0; k-- {
+				r := rule{RuleID: fmt.Sprintf("Rule_%d", k), Action: "COUNT"}
+				group.NonTerminatingMatchingRules = append(group.NonTerminatingMatchingRules, r)
+				matching = append(matching, map[string]any{"ruleId": r.RuleID, "action": r.Action})
+			}
+			out["nonTerminatingMatchingRules"] = matching
+			if random.Intn(2) == 0 {
+				excluded := `[{"exclusionType":"EXCLUDED_AS_COUNT","ruleId":"NoUserAgent_HEADER"}]`
+				group.ExcludedRules = &excluded
+				out["excludedRules"] = []any{map[string]any{"exclusionType": "EXCLUDED_AS_COUNT", "ruleId": "NoUserAgent_HEADER"}}
+			}
+			row.RuleGroupList = append(row.RuleGroupList, group)
+			groups = append(groups, out)
+		}
+		record["ruleGroupList"] = groups
+
+		rows[i], records[i] = row, record
+	}
+	return rows, records
+}
+
+// typesRows returns rows of a column of each type and the values they are read as
+func typesRows(n int) ([]typesRow, []map[string]any) {
+	rows := make([]typesRow, n)
+	records := make([]map[string]any, n)
+	for i := range rows {
+		millis := 1700000000000 + int64(i)*86400123
+		row := typesRow{
+			ID:     int64(i) - 5,
+			Small:  int32(i * 7),
+			Flag:   i%3 == 0,
+			Ratio:  float64(i) / 4,
+			Score:  float32(i) / 2,
+			Day:    int32(19000 + i),
+			Millis: millis,
+			Micros: millis*1000 + 999,
+			Nanos:  millis*1000000 + 999999,
+			Price:  int64(i*1234 - 5000),
+			Rate:   int32(i * 5),
+		}
+		record := map[string]any{
+			"id":     row.ID,
+			"small":  row.Small,
+			"flag":   row.Flag,
+			"ratio":  row.Ratio,
+			"score":  row.Score,
+			"day":    dayString(row.Day),
+			"millis": millis,
+			"micros": millis,
+			"nanos":  millis,
+			"price":  json.Number(decimalString(row.Price, 2)),
+			"rate":   json.Number(decimalString(int64(row.Rate), 3)),
+		}
+		if i%2 == 0 {
+			note := fmt.Sprintf("note %d", i)
+			row.Note = &note
+			record["note"] = note
+		}
+		tags := []any{}
+		for j := 0; j < i%4; j++ {
+			tag := fmt.Sprintf("tag-%d", j)
+			row.Tags = append(row.Tags, tag)
+			tags = append(tags, tag)
+		}
+		record["tags"] = tags
+		matrix := []any{}
+		for j := 0; j < i%3; j++ {
+			inner := []int64{}
+			items := []any{}
+			for k := 0; k < j+i%2; k++ {
+				inner = append(inner, int64(i*10+k))
+				items = append(items, int64(i*10+k))
+			}
+			row.Matrix = append(row.Matrix, inner)
+			matrix = append(matrix, items)
+		}
+		record["matrix"] = matrix
+		attributes := map[string]any{}
+		if i%3 != 2 {
+			row.Attributes = map[string]string{"env": "prod", "index": fmt.Sprint(i)}
+			attributes = map[string]any{"env": "prod", "index": fmt.Sprint(i)}
+		}
+		record["attributes"] = attributes
+
+		rows[i], records[i] = row, record
+	}
+	return rows, records
+}
+
+// dayString formats days since the epoch as a date
+func dayString(days int32) string {
+	return time.Unix(int64(days)*86400, 0).UTC().Format("2006-01-02")
+}
+
+// decimalString formats an unscaled decimal
+func decimalString(unscaled int64, scale int) string {
+	sign := ""
+	if unscaled < 0 {
+		sign, unscaled = "-", -unscaled
+	}
+	pow := int64(1)
+	for i := 0; i < scale; i++ {
+		pow *= 10
+	}
+	return fmt.Sprintf("%s%d.%0*d", sign, unscaled/pow, scale, unscaled%pow)
+}
+
+// writeParquet writes rows to a Parquet file
+func writeParquet[T any](path string, rows []T, options ...parquet.WriterOption) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	options = append(options, parquet.CreatedBy("parquet-go", "fixture", ""))
+	w := parquet.NewGenericWriter[T](f, options...)
+	if _, err := w.Write(rows); err != nil {
+		f.Close()
+		return fmt.Errorf("failed to write %s: %w", path, err)
+	}
+	if err := w.Close(); err != nil {
+		f.Close()
+		return fmt.Errorf("failed to write %s: %w", path, err)
+	}
+	return f.Close()
+}
+
+// writeRecords writes the expected records as JSON Lines
+func writeRecords(path string, records []map[string]any) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	encoder := json.NewEncoder(f)
+	for _, record := range records {
+		if err := encoder.Encode(record); err != nil {
+			f.Close()
+			return err
+		}
+	}
+	return f.Close()
+}
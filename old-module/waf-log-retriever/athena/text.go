@@ -0,0 +1,339 @@
+package athena
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// hiveNull is how Hive text files write null
+const hiveNull = `\N`
+
+// hiveSeparators are the delimiters of Hive text files by nesting level: fields of
+// rows, then the elements of nested arrays, structs and maps
+var hiveSeparators = []byte{
+	1, 2, 3, 4, 5, 6, 7, 8, 11, 14, 15, 16, 17, 18, 19, 20, 21, 22, 23, 24, 25, 26, 28, 29, 30, 31,
+}
+
+// TextFormat returns the format of Athena text output from its first line: a CSV
+// header naming the timestamp column, or a row of the WAF log table starting with its
+// timestamp in epoch milliseconds. It returns "" for neither.
+func TextFormat(line []byte) string {
+	line = bytes.TrimRight(line, "\r\n")
+	if textDelimiter(line) != 0 {
+		return FormatText
+	}
+	reader := csv.NewReader(bytes.NewReader(line))
+	header, err := reader.Read()
+	if err != nil {
+		return ""
+	}
+	for _, column := range header {
+		if strings.EqualFold(strings.TrimSpace(column), "timestamp") {
+			return FormatCSV
+		}
+	}
+	return ""
+}
+
+// textDelimiter returns the field delimiter of a headerless row: Hive's default, or
+// a custom field_delimiter after a leading timestamp in epoch milliseconds
+func textDelimiter(line []byte) byte {
+	if bytes.IndexByte(line, hiveSeparators[0]) >= 0 {
+		return hiveSeparators[0]
+	}
+	end := bytes.IndexAny(line, ",\t|")
+	if end != 13 {
+		return 0
+	}
+	if _, err := strconv.ParseInt(string(line[:end]), 10, 64); err != nil {
+		return 0
+	}
+	return line[end]
+}
+
+// ForEachTextRow streams the rows of Athena text output in a format returned by
+// TextFormat, as maps by column name
+func ForEachTextRow(r *bufio.Reader, format string, fn func(row map[string]any) error) error {
+	if format == FormatCSV {
+		return forEachCSVRow(r, fn)
+	}
+	line := 0
+	for {
+		text, err := r.ReadString('\n')
+		if text = strings.TrimRight(text, "\r\n"); text != "" {
+			line++
+			row, rowErr := parseHiveRow(text)
+			if rowErr != nil {
+				return fmt.Errorf("line %d: %w", line, rowErr)
+			}
+			if err := fn(row); err != nil {
+				return err
+			}
+		}
+		if errors.Is(err, io.EOF) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// parseHiveRow parses a row of a Hive text file with the columns of the WAF log table
+func parseHiveRow(line string) (map[string]any, error) {
+	delimiter := textDelimiter([]byte(line))
+	if delimiter == 0 {
+		return nil, errors.New("not a row of the WAF log table")
+	}
+	values := strings.Split(line, string(delimiter))
+	if len(values) > len(tableType.fields) {
+		values = values[:len(tableType.fields)] // Partition columns follow the table's
+	}
+	row := make(map[string]any, len(values))
+	for i, value := range values {
+		field := tableType.fields[i]
+		if v := parseHiveValue(value, field.typ, 1); v != nil {
+			row[field.name] = v
+		}
+	}
+	return row, nil
+}
+
+// parseHiveValue parses a value of a Hive text file nested to a level
+func parseHiveValue(s string, typ *hiveType, level int) any {
+	if s == hiveNull {
+		return nil
+	}
+	if typ.kind == kindScalar {
+		return scalar(s, typ)
+	}
+	if level >= len(hiveSeparators) {
+		return s
+	}
+	separator := string(hiveSeparators[level])
+	switch typ.kind {
+	case kindArray:
+		items := []any{}
+		if s == "" {
+			return items
+		}
+		for _, item := range strings.Split(s, separator) {
+			items = append(items, parseHiveValue(item, typ.elem, level+1))
+		}
+		return items
+	case kindMap:
+		out := make(map[string]any)
+		if s == "" || level+1 >= len(hiveSeparators) {
+			return out
+		}
+		for _, entry := range strings.Split(s, separator) {
+			key, value, _ := strings.Cut(entry, string(hiveSeparators[level+1]))
+			out[key] = parseHiveValue(value, typ.elem, level+2)
+		}
+		return out
+	}
+	out := make(map[string]any, len(typ.fields))
+	for i, value := range strings.Split(s, separator) {
+		if i >= len(typ.fields) {
+			break
+		}
+		if v := parseHiveValue(value, typ.fields[i].typ, level+1); v != nil {
+			out[typ.fields[i].name] = v
+		}
+	}
+	return out
+}
+
+// scalar converts a scalar's text to a value of its type, or nil if it is empty
+// and not a string
+func scalar(s string, typ *hiveType) any {
+	switch typ.name {
+	case "string", "varchar", "char":
+		return s
+	case "tinyint", "smallint", "int", "integer", "bigint":
+		if n, err := strconv.ParseInt(strings.TrimSpace(s), 10, 64); err == nil {
+			return n
+		}
+	case "float", "double", "real":
+		if f, err := strconv.ParseFloat(strings.TrimSpace(s), 64); err == nil {
+			return f
+		}
+	case "boolean":
+		if b, err := strconv.ParseBool(strings.TrimSpace(s)); err == nil {
+			return b
+		}
+	default:
+		if s != "" {
+			return s
+		}
+	}
+	return nil
+}
+
+// forEachCSVRow streams the rows of the CSV of Athena query results. Columns are
+// matched with those of the WAF log table by name; nested ones are rendered as
+// Athena does, e.g. {name=Host, value=example.com}, or as JSON if they were cast to it.
+func forEachCSVRow(r io.Reader, fn func(row map[string]any) error) error {
+	reader := csv.NewReader(r)
+	reader.FieldsPerRecord = -1
+	header, err := reader.Read()
+	if err != nil {
+		return fmt.Errorf("failed to read CSV header: %w", err)
+	}
+	types := make([]*hiveType, len(header))
+	for i, column := range header {
+		header[i] = strings.ToLower(strings.TrimSpace(column))
+		types[i] = tableType.field(header[i])
+	}
+	for {
+		values, err := reader.Read()
+		if errors.Is(err, io.EOF) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		row := make(map[string]any, len(values))
+		for i, value := range values {
+			if i >= len(header) || value == "" {
+				continue
+			}
+			typ := types[i]
+			if typ == nil {
+				typ = &hiveType{kind: kindScalar, name: "string"}
+			}
+			if v := parseRendered(value, typ); v != nil {
+				row[header[i]] = v
+			}
+		}
+		if err := fn(row); err != nil {
+			return err
+		}
+	}
+}
+
+// parseRendered parses a value as Athena renders it in query results
+func parseRendered(s string, typ *hiveType) any {
+	if s == "null" {
+		return nil
+	}
+	if typ.kind == kindScalar {
+		return scalar(s, typ)
+	}
+	if trimmed := strings.TrimSpace(s); strings.HasPrefix(trimmed, `{"`) || strings.HasPrefix(trimmed, `["`) ||
+		strings.HasPrefix(trimmed, "[{\"") || trimmed == "[]" || trimmed == "{}" {
+		decoder := json.NewDecoder(strings.NewReader(trimmed))
+		decoder.UseNumber()
+		var v any
+		if decoder.Decode(&v) == nil {
+			return v
+		}
+	}
+	switch typ.kind {
+	case kindArray:
+		inner, ok := bracketed(s, "[", "]")
+		if !ok {
+			return nil
+		}
+		items := []any{}
+		for _, item := range splitRendered(inner, typ.elem.kind != kindScalar) {
+			items = append(items, parseRendered(item, typ.elem))
+		}
+		return items
+	case kindMap:
+		inner, ok := bracketed(s, "{", "}")
+		if !ok {
+			return nil
+		}
+		out := make(map[string]any)
+		for _, entry := range splitRendered(inner, typ.elem.kind != kindScalar) {
+			key, value, _ := strings.Cut(entry, "=")
+			out[key] = parseRendered(value, typ.elem)
+		}
+		return out
+	}
+	inner, ok := bracketed(s, "{", "}")
+	if !ok {
+		return nil
+	}
+	out := make(map[string]any, len(typ.fields))
+	for i, field := range typ.fields {
+		rest, ok := strings.CutPrefix(inner, field.name+"=")
+		if !ok {
+			return out
+		}
+		var value string
+		if field.typ.kind != kindScalar && !strings.HasPrefix(rest, "null") {
+			end := closingBracket(rest)
+			value, inner = rest[:end], rest[end:]
+		} else if i+1 < len(typ.fields) {
+			end := strings.Index(rest, ", "+typ.fields[i+1].name+"=")
+			if end < 0 {
+				end = len(rest)
+			}
+			value, inner = rest[:end], rest[end:]
+		} else {
+			value, inner = rest, ""
+		}
+		inner = strings.TrimPrefix(inner, ", ")
+		if v := parseRendered(value, field.typ); v != nil {
+			out[field.name] = v
+		}
+	}
+	return out
+}
+
+// bracketed returns what is between the brackets s is enclosed in
+func bracketed(s, open, close string) (string, bool) {
+	if !strings.HasPrefix(s, open) || !strings.HasSuffix(s, close) || len(s) < 2 {
+		return "", false
+	}
+	return s[1 : len(s)-1], true
+}
+
+// splitRendered splits the elements of a rendered array or map, which are nested
+// values in brackets or scalars separated by commas
+func splitRendered(s string, nested bool) []string {
+	if s == "" {
+		return nil
+	}
+	if !nested {
+		return strings.Split(s, ", ")
+	}
+	var items []string
+	for s != "" {
+		end := len(s)
+		if strings.HasPrefix(s, "{") || strings.HasPrefix(s, "[") {
+			end = closingBracket(s)
+		} else if comma := strings.Index(s, ", "); comma >= 0 {
+			end = comma
+		}
+		items = append(items, s[:end])
+		s = strings.TrimPrefix(s[end:], ", ")
+	}
+	return items
+}
+
+// closingBracket returns the end of the bracketed value s starts with, or of s if
+// its brackets are not balanced
+func closingBracket(s string) int {
+	depth := 0
+	for i := 0; i < len(s); i++ {
+		switch s[i] {
+		case '{', '[':
+			depth++
+		case '}', ']':
+			if depth--; depth == 0 {
+				return i + 1
+			}
+		}
+	}
+	return len(s)
+}
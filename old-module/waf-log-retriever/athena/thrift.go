@@ -0,0 +1,226 @@
+package athena
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+)
+
+// errThriftTruncated is returned for Thrift data that ends too early
+var errThriftTruncated = errors.New("truncated Thrift data")
+
+// Types of the Thrift compact protocol, in which Parquet metadata is encoded
+const (
+	thriftStop   = 0
+	thriftTrue   = 1
+	thriftFalse  = 2
+	thriftByte   = 3
+	thriftI16    = 4
+	thriftI32    = 5
+	thriftI64    = 6
+	thriftDouble = 7
+	thriftBinary = 8
+	thriftList   = 9
+	thriftSet    = 10
+	thriftMap    = 11
+	thriftNested = 12
+)
+
+// maxThriftDepth bounds the nesting of structs and lists
+const maxThriftDepth = 64
+
+// thriftStruct is a decoded Thrift struct, by field id. Integers are int64, binary
+// fields []byte, lists and sets []any and maps are left out.
+type thriftStruct map[int16]any
+
+// int returns an integer field, or def if it is not set
+func (s thriftStruct) int(id int16, def int64) int64 {
+	if v, ok := s[id].(int64); ok {
+		return v
+	}
+	return def
+}
+
+// bool returns a boolean field, or def if it is not set
+func (s thriftStruct) bool(id int16, def bool) bool {
+	if v, ok := s[id].(bool); ok {
+		return v
+	}
+	return def
+}
+
+// string returns a binary field as a string
+func (s thriftStruct) string(id int16) string {
+	v, _ := s[id].([]byte)
+	return string(v)
+}
+
+// has reports whether a field is set
+func (s thriftStruct) has(id int16) bool {
+	_, ok := s[id]
+	return ok
+}
+
+// strct returns a struct field, or nil
+func (s thriftStruct) strct(id int16) thriftStruct {
+	v, _ := s[id].(thriftStruct)
+	return v
+}
+
+// list returns a list field, or nil
+func (s thriftStruct) list(id int16) []any {
+	v, _ := s[id].([]any)
+	return v
+}
+
+// thriftDecoder decodes compact protocol data from a buffer
+type thriftDecoder struct {
+	data []byte
+	pos  int
+}
+
+// readStruct decodes a struct and leaves the decoder after it
+func (d *thriftDecoder) readStruct() (thriftStruct, error) {
+	return d.structAt(0)
+}
+
+func (d *thriftDecoder) structAt(depth int) (thriftStruct, error) {
+	if depth > maxThriftDepth {
+		return nil, errors.New("Thrift data nested too deeply")
+	}
+	s := make(thriftStruct)
+	var id int16
+	for {
+		header, err := d.byte()
+		if err != nil {
+			return nil, err
+		}
+		typ := header & 0x0f
+		if typ == thriftStop {
+			return s, nil
+		}
+		if delta := header >> 4; delta != 0 {
+			id += int16(delta)
+		} else {
+			n, err := d.zigzag()
+			if err != nil {
+				return nil, err
+			}
+			id = int16(n)
+		}
+		var v any
+		switch typ {
+		case thriftTrue:
+			v = true
+		case thriftFalse:
+			v = false
+		default:
+			if v, err = d.value(typ, depth); err != nil {
+				return nil, err
+			}
+		}
+		if v != nil {
+			s[id] = v
+		}
+	}
+}
+
+// value decodes a value of a type other than a struct field's boolean
+func (d *thriftDecoder) value(typ byte, depth int) (any, error) {
+	switch typ {
+	case thriftTrue, thriftFalse:
+		b, err := d.byte()
+		return b == thriftTrue, err
+	case thriftByte:
+		b, err := d.byte()
+		return int64(int8(b)), err
+	case thriftI16, thriftI32, thriftI64:
+		return d.zigzag()
+	case thriftDouble:
+		if len(d.data)-d.pos < 8 {
+			return nil, errThriftTruncated
+		}
+		bits := binary.LittleEndian.Uint64(d.data[d.pos:])
+		d.pos += 8
+		return math.Float64frombits(bits), nil
+	case thriftBinary:
+		n, err := d.varint()
+		if err != nil {
+			return nil, err
+		}
+		if n > uint64(len(d.data)-d.pos) {
+			return nil, errThriftTruncated
+		}
+		b := d.data[d.pos : d.pos+int(n)]
+		d.pos += int(n)
+		return b, nil
+	case thriftList, thriftSet:
+		header, err := d.byte()
+		if err != nil {
+			return nil, err
+		}
+		size := uint64(header >> 4)
+		if size == 15 {
+			if size, err = d.varint(); err != nil {
+				return nil, err
+			}
+		}
+		if size > uint64(len(d.data)-d.pos) { // Every element takes at least a byte
+			return nil, errThriftTruncated
+		}
+		items := make([]any, 0, size)
+		for i := uint64(0); i < size; i++ {
+			item, err := d.value(header&0x0f, depth+1)
+			if err != nil {
+				return nil, err
+			}
+			items = append(items, item)
+		}
+		return items, nil
+	case thriftMap:
+		size, err := d.varint()
+		if err != nil || size == 0 {
+			return nil, err
+		}
+		types, err := d.byte()
+		if err != nil {
+			return nil, err
+		}
+		for i := uint64(0); i < size; i++ {
+			if _, err := d.value(types>>4, depth+1); err != nil {
+				return nil, err
+			}
+			if _, err := d.value(types&0x0f, depth+1); err != nil {
+				return nil, err
+			}
+		}
+		return nil, nil
+	case thriftNested:
+		return d.structAt(depth + 1)
+	}
+	return nil, fmt.Errorf("invalid Thrift type %d", typ)
+}
+
+func (d *thriftDecoder) byte() (byte, error) {
+	if d.pos >= len(d.data) {
+		return 0, errThriftTruncated
+	}
+	b := d.data[d.pos]
+	d.pos++
+	return b, nil
+}
+
+func (d *thriftDecoder) varint() (uint64, error) {
+	v, n := binary.Uvarint(d.data[d.pos:])
+	if n <= 0 {
+		return 0, errThriftTruncated
+	}
+	d.pos += n
+	return v, nil
+}
+
+func (d *thriftDecoder) zigzag() (int64, error) {
+	v, err := d.varint()
+	return int64(v>>1) ^ -int64(v&1), err
+}
@@ -0,0 +1,52 @@
+package aws
+
+import (
+	"context"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/iam"
+
+	"waf-log-retriever/logging"
+)
+
+// Account identifies the AWS account a session is in, with the names reports show
+// instead of its 12-digit ID
+type Account struct {
+	ID    string
+	Alias string // IAM account alias; empty if the account has none or it could not be read
+	Name  string // Friendly name from the config's account_names, if any
+}
+
+// DisplayName returns the friendly name of the account, else its IAM alias, or ""
+// if it has neither
+func (a Account) DisplayName() string {
+	if a.Name != "" {
+		return a.Name
+	}
+	return a.Alias
+}
+
+// String returns the account as "Payments Prod (123456789012)", or only its ID
+// without a name
+func (a Account) String() string {
+	if name := a.DisplayName(); name != "" {
+		return name + " (" + a.ID + ")"
+	}
+	return a.ID
+}
+
+// accountAlias reads the IAM alias of the session's account. Reading it requires
+// iam:ListAccountAliases, which read-only roles often lack, so a failure is only
+// logged and leaves the account to its ID or configured name.
+func accountAlias(ctx context.Context, cfg aws.Config, logger logging.Logger) string {
+	result, err := iam.NewFromConfig(cfg).ListAccountAliases(ctx, &iam.ListAccountAliasesInput{})
+	if err != nil {
+		logger.Debugf("Could not read the IAM account alias: %v", err)
+		return ""
+	}
+	// An account has at most one alias
+	if len(result.AccountAliases) == 0 {
+		return ""
+	}
+	return result.AccountAliases[0]
+}
@@ -0,0 +1,47 @@
+package aws
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/credentials/stscreds"
+	"github.com/aws/aws-sdk-go-v2/service/sts"
+
+	"waf-log-retriever/config"
+	"waf-log-retriever/logging"
+	"waf-log-retriever/secrets"
+)
+
+// roleSessionName identifies the tool's sessions in the CloudTrail logs of the
+// accounts whose roles it assumes
+const roleSessionName = "waf-log-retriever"
+
+// assumeRole returns a copy of a session whose credentials are those of the profile's
+// RoleARN, assumed through STS with the session's own credentials, e.g. a role in the
+// central logging account holding the WAF log buckets. The credentials are refreshed
+// before they expire, so long retrievals outlast a role session. An encrypted or
+// referenced ExternalID is resolved through the session first. The role is assumed
+// right away, so that a role that cannot be assumed fails the connection.
+func assumeRole(ctx context.Context, session aws.Config, profile config.AWSProfileConfig, logger logging.Logger) (aws.Config, error) {
+	externalID, err := secrets.ResolveString(ctx, profile.ExternalID, secrets.SessionResolvers(session))
+	if err != nil {
+		return aws.Config{}, fmt.Errorf("failed to resolve the external ID of role %s: %w", profile.RoleARN, err)
+	}
+
+	logger.Infof("Assuming role %s", profile.RoleARN)
+	provider := stscreds.NewAssumeRoleProvider(sts.NewFromConfig(session), profile.RoleARN, func(o *stscreds.AssumeRoleOptions) {
+		o.RoleSessionName = roleSessionName
+		if externalID != "" {
+			o.ExternalID = aws.String(externalID)
+		}
+	})
+	assumed := session.Copy()
+	assumed.Credentials = aws.NewCredentialsCache(provider)
+	identity, err := sts.NewFromConfig(assumed).GetCallerIdentity(ctx, &sts.GetCallerIdentityInput{})
+	if err != nil {
+		return aws.Config{}, fmt.Errorf("failed to assume role %s: %w", profile.RoleARN, err)
+	}
+	logger.Infof("Retrieving S3 logs as: %s (Account: %s)", aws.ToString(identity.Arn), aws.ToString(identity.Account))
+	return assumed, nil
+}
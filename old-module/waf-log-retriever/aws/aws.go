@@ -3,15 +3,16 @@
 package aws
 
 import (
+    "bytes"
     "context"
     "encoding/json"
     "errors"
     "fmt"
     "io"
     "os"
-    "path/filepath"
 	"strconv"
     "strings"
+    "sync"
     "time"
 
     "github.com/aws/aws-sdk-go-v2/aws"
@@ -26,6 +27,7 @@ import (
     smithylogging "github.com/aws/smithy-go/logging"
     "waf-log-retriever/config"
     "waf-log-retriever/logging"                      
+    "waf-log-retriever/storage"
 )
 
 // WAFv2Manager handles WAFv2 service interactions
@@ -35,32 +37,49 @@ type WAFv2Manager struct {
 
 // WAFLogSource represents a WAF logging configuration
 type WAFLogSource struct {
-    ProfileName     string
-    Region         string
-    WebACLName     string
-    WebACLID       string
-    LogSourceType  string // "s3" or "cloudwatchlogs"
-    DestinationARN string
-    S3BucketName   string
-    CWLogsGroupName string
-    Scope           string // "Regional" or "CloudFront"
+    ProfileName     string `json:"profileName"`
+    Region          string `json:"region"`
+    WebACLName      string `json:"webACLName"`
+    WebACLID        string `json:"webACLID"`
+    LogSourceType   string `json:"logSourceType"` // "s3", "cloudwatchlogs" or "firehose"
+    DestinationARN  string `json:"destinationARN"`
+    S3BucketName    string `json:"s3BucketName,omitempty"`    // For firehose, the bucket the delivery stream delivers to
+    S3Prefix        string `json:"s3Prefix,omitempty"`        // Prefix of the delivery stream's objects, for firehose
+    FirehoseStream  string `json:"firehoseStream,omitempty"`  // Name of the delivery stream, for firehose
+    CWLogsGroupName string `json:"cwLogsGroupName,omitempty"`
+    Scope           string `json:"scope"` // "Regional" or "CloudFront"
+    LocalName       string `json:"localName,omitempty"` // Directory below the profile's to store the logs in, see DirName
 }
 
 // SessionManager manages AWS session configuration and validation
 type SessionManager struct {
-    Config  *config.Config
-    Session aws.Config
-    Logger  logging.Logger
+    Config     *config.Config
+    Session    aws.Config // Session of the profile's own credentials, for WAF, CloudWatch Logs and everything else of its account
+    LogSession aws.Config // Session S3 log objects are retrieved with: that of the profile's role, if any, else Session
+    Logger     logging.Logger
+    Account    Account // Account the profile's credentials belong to, whose Web ACLs are reviewed; set by validation
 }
 
 // S3Manager handles S3 operations for log retrieval
 type S3Manager struct {
-    Session aws.Config
+    Session          aws.Config              // Session the log objects are retrieved with
+    AccountSession   aws.Config              // Session of the Web ACLs' own account, e.g. to describe Firehose delivery streams; Session if unset
+    Storage          *storage.StorageManager // Decides where the objects are written
+    Account          Account                 // Account of the Web ACLs, recorded with the logs
+    SkipConfirmation bool                    // Download without prompting, e.g. in batch mode
+    Resume           bool                    // Skip the objects the checkpoint of an interrupted retrieval records, see storage.Checkpoint
+    KeyPatterns      []KeyPattern            // Namings of log objects, see CompileKeyPatterns; DefaultKeyPatterns if nil
+    BoundarySlack    time.Duration           // Objects this far outside the time range are listed too, see RetrieveLogsFromS3
+    Records          storage.RecordFunc      // Streams the records of a downloaded object; without it, objects of the boundary slack are all kept
 }
 
 // CWLogsManager handles CloudWatch Logs operations
 type CWLogsManager struct {
-    Session aws.Config
+    Session              aws.Config
+    Storage              *storage.StorageManager // Decides where the query results are written, and compresses them
+    Account              Account                 // Account of the session, recorded with the logs
+    MaxConcurrentQueries int                     // Insights queries run at once; DefaultMaxConcurrentQueries if not positive
+    queries              querySlots              // Shared by all retrievals, e.g. of the sources of a batch
 }
 // awsLoggerWrapper wraps your app logger and implements aws.Logger.
 // awsLoggerWrapper wraps your app logger and implements smithy-go/logging.Logger.
@@ -105,17 +124,19 @@ func NewCWLogsManager(session aws.Config) *CWLogsManager {
 }
 
 
-// deriveBasePrefix splits a key by "/" and returns the prefix up to (but not including) the first part that is a 4-digit year.
-func deriveBasePrefix(key string) string {
+// deriveBasePrefix splits a key by "/" and returns the prefix up to (but not including) the first part that is a 4-digit year,
+// or a year=YYYY partition, and whether the key is partitioned that way.
+func deriveBasePrefix(key string) (string, bool) {
     parts := strings.Split(key, "/")
     for i, p := range parts {
-        if len(p) == 4 {
-            if _, err := strconv.Atoi(p); err == nil {
-                return strings.Join(parts[:i], "/") + "/"
+        year, partitioned := strings.CutPrefix(p, "year=")
+        if len(year) == 4 {
+            if _, err := strconv.Atoi(year); err == nil {
+                return strings.Join(parts[:i], "/") + "/", partitioned
             }
         }
     }
-    return ""
+    return "", false
 }
 
 // commonPrefix returns the longest common prefix among a slice of strings.
@@ -135,8 +156,9 @@ func commonPrefix(strs []string) string {
     return prefix
 }
 
-// queryS3BasePrefix lists objects under "AWSLogs/" and returns a common base prefix containing the Web ACL name.
-func queryS3BasePrefix(ctx context.Context, s3Client *s3.Client, bucket string, webACLName string, logger logging.Logger) (string, error) {
+// queryS3BasePrefix lists objects under "AWSLogs/" and returns a common base prefix containing the Web ACL name,
+// and whether the objects below it are in year=/month=/day=/hour= partitions rather than YYYY/MM/DD/HH folders.
+func queryS3BasePrefix(ctx context.Context, s3Client *s3.Client, bucket string, webACLName string, logger logging.Logger) (string, bool, error) {
     input := &s3.ListObjectsV2Input{
         Bucket:  aws.String(bucket),
         Prefix:  aws.String("AWSLogs/"),
@@ -147,7 +169,7 @@ func queryS3BasePrefix(ctx context.Context, s3Client *s3.Client, bucket string,
     for paginator.HasMorePages() {
         page, err := paginator.NextPage(ctx)
         if err != nil {
-            return "", fmt.Errorf("failed to list S3 objects: %w", err)
+            return "", false, fmt.Errorf("failed to list S3 objects: %w", err)
         }
         for _, obj := range page.Contents {
             if strings.Contains(*obj.Key, webACLName) {
@@ -159,10 +181,10 @@ func queryS3BasePrefix(ctx context.Context, s3Client *s3.Client, bucket string,
         }
     }
     if len(candidateKeys) == 0 {
-        return "", fmt.Errorf("no objects found containing Web ACL name %s", webACLName)
+        return "", false, fmt.Errorf("no objects found containing Web ACL name %s", webACLName)
     }
     // Try to derive a base prefix from the first candidate.
-    base := deriveBasePrefix(candidateKeys[0])
+    base, partitioned := deriveBasePrefix(candidateKeys[0])
     if base == "" {
         // Fallback: compute the common prefix from all candidate keys.
         base = commonPrefix(candidateKeys)
@@ -170,35 +192,12 @@ func queryS3BasePrefix(ctx context.Context, s3Client *s3.Client, bucket string,
     if base != "" && !strings.HasSuffix(base, "/") {
         base += "/"
     }
-    logger.Debugf("Queried base prefix: %s", base)
-    return base, nil
+    logger.Debugf("Queried base prefix: %s (partitioned: %t)", base, partitioned)
+    return base, partitioned, nil
 }
-// extractTimestampFromKey extracts the timestamp from the log file name.
-// For example, given:
-// "430096642635_waflogs_ap-southeast-1_vfbs-prod-dominos-v2_20241202T0105Z_d15273e2.log.gz"
-// it will extract "20241202T0105Z" and parse it using layout "20060102T1504Z".
-func extractTimestampFromKey(key string) (time.Time, error) {
-    parts := strings.Split(key, "/")
-    if len(parts) == 0 {
-        return time.Time{}, errors.New("invalid key structure")
-    }
-    filename := parts[len(parts)-1]
-    segments := strings.Split(filename, "_")
-    var tsStr string
-    for _, seg := range segments {
-        if len(seg) == 13 && seg[8] == 'T' && seg[len(seg)-1] == 'Z' {
-            // Optionally, you can add further checks here (e.g., ensuring the first 8 characters are digits)
-            tsStr = seg
-            break
-        }
-    }
-    if tsStr == "" {
-        return time.Time{}, fmt.Errorf("timestamp segment not found in filename %s", filename)
-    }
-    return time.Parse("20060102T1504Z", tsStr)
-}
-// NewSessionManager creates and validates an AWS session
-func NewSessionManager(cfg *config.Config, logger logging.Logger) (*SessionManager, error) {
+// NewSessionManager creates and validates an AWS session. Extra options, such as an
+// API tracer's ConfigOption, are applied when loading the AWS configuration.
+func NewSessionManager(cfg *config.Config, logger logging.Logger, options ...func(*awsconfig.LoadOptions) error) (*SessionManager, error) {
     if cfg == nil {
         return nil, fmt.Errorf("config cannot be nil")
     }
@@ -210,29 +209,54 @@ func NewSessionManager(cfg *config.Config, logger logging.Logger) (*SessionManag
     logger.Infof("Attempting to connect to AWS using profile: %s", cfg.AWSProfiles[0].ProfileName)
 
     // Load AWS configuration with specified profile and region
-    awsCfg, err := awsconfig.LoadDefaultConfig(context.TODO(),
+    loadOptions := []func(*awsconfig.LoadOptions) error{
     awsconfig.WithRegion(cfg.AWSProfiles[0].RegionName),
     awsconfig.WithSharedConfigProfile(cfg.AWSProfiles[0].ProfileName),
     awsconfig.WithLogger(awsLoggerWrapper{logger: logger}),
     // awsconfig.WithLogMode(0), // Disable AWS SDK logging if you don't want any
-    )
+    }
+    loadOptions = append(loadOptions, options...)
 
+    sm := &SessionManager{
+        Config: cfg,
+        Logger: logger,
+    }
+    err := sm.connect(loadOptions)
+    if sso := findSSOProfile(sm.Session); sso != nil && ssoLoginNeeded(err) {
+        // The profile's IAM Identity Center session expired: log in and connect again
+        if err := ssoLogin(context.TODO(), sm.Session, sso, cfg.AWSProfiles[0].ProfileName, logger); err != nil {
+            return nil, err
+        }
+        err = sm.connect(loadOptions)
+    }
     if err != nil {
-        return nil, fmt.Errorf("unable to load SDK config: %w", err)
+        return nil, err
     }
 
-    sm := &SessionManager{
-        Config:  cfg,
-        Session: awsCfg,
-        Logger:  logger,
+    return sm, nil
+}
+
+// connect loads the AWS configuration and validates the session, then assumes the
+// profile's role for the log session if it has one
+func (sm *SessionManager) connect(loadOptions []func(*awsconfig.LoadOptions) error) error {
+    awsCfg, err := awsconfig.LoadDefaultConfig(context.TODO(), loadOptions...)
+    if err != nil {
+        return fmt.Errorf("unable to load SDK config: %w", err)
     }
+    sm.Session, sm.LogSession = awsCfg, awsCfg
 
     // Validate the session by making a test API call
     if err := sm.validateSession(); err != nil {
-        return nil, fmt.Errorf("failed to validate AWS session: %w", err)
+        return fmt.Errorf("failed to validate AWS session: %w", err)
     }
 
-    return sm, nil
+    profile := sm.Config.AWSProfiles[0]
+    if profile.RoleARN != "" {
+        if sm.LogSession, err = assumeRole(context.TODO(), awsCfg, profile, sm.Logger); err != nil {
+            return err
+        }
+    }
+    return nil
 }
 
 // validateSession verifies the AWS session by making a test API call
@@ -247,7 +271,12 @@ func (sm *SessionManager) validateSession() error {
         return fmt.Errorf("failed to validate credentials: %w", err)
     }
 
-    sm.Logger.Infof("Successfully connected to AWS as: %s (Account: %s)", *result.Arn, *result.Account)
+    sm.Account = Account{
+        ID:    aws.ToString(result.Account),
+        Alias: accountAlias(ctx, sm.Session, sm.Logger),
+        Name:  sm.Config.AccountNames[aws.ToString(result.Account)],
+    }
+    sm.Logger.Infof("Successfully connected to AWS as: %s (Account: %s)", *result.Arn, sm.Account)
     return nil
 }
 
@@ -255,14 +284,17 @@ func (sm *SessionManager) validateSession() error {
 // DiscoverWAFLogSources discovers WAF ACLs and their logging configurations
 func DiscoverWAFLogSources(wafv2Mgr *WAFv2Manager, cfg *config.Config, logger logging.Logger) ([]*WAFLogSource, error) {
     ctx := context.TODO()
-    client := wafv2.NewFromConfig(wafv2Mgr.Session)
+    homeRegion := cfg.AWSProfiles[0].RegionName
 
     logger.Info("Discovering WAF Web ACLs...")
 
     var discoveredSources []*WAFLogSource
 
-    // Helper function to list Web ACLs for a given scope
-    listWebACLs := func(scope wafTypes.Scope) error {
+    // Helper function to list Web ACLs for a given scope, Regional ones in a region
+    listWebACLs := func(scope wafTypes.Scope, region string) error {
+        client := wafv2.NewFromConfig(wafv2Mgr.Session, func(o *wafv2.Options) {
+            o.Region = region
+        })
         var nextMarker *string
 
         for {
@@ -277,7 +309,7 @@ func DiscoverWAFLogSources(wafv2Mgr *WAFv2Manager, cfg *config.Config, logger lo
                 return fmt.Errorf("failed to list Web ACLs for scope %s: %w", scope, err)
             }
 
-            logger.Infof("Found %d Web ACLs for scope %s", len(result.WebACLs), scope)
+            logger.Infof("Found %d Web ACLs for scope %s in %s", len(result.WebACLs), scope, region)
 
             // Process each Web ACL
             for _, acl := range result.WebACLs {
@@ -308,12 +340,15 @@ func DiscoverWAFLogSources(wafv2Mgr *WAFv2Manager, cfg *config.Config, logger lo
 
                 source := &WAFLogSource{
                     ProfileName:    cfg.AWSProfiles[0].ProfileName,
-                    Region:         cfg.AWSProfiles[0].RegionName,
+                    Region:         region,
                     WebACLName:     aclName,
                     WebACLID:       aclID,
                     DestinationARN: destArn,
                     Scope:          string(scope), // Add the scope (Regional or CloudFront)
                 }
+                if scope == wafTypes.ScopeRegional {
+                    source.LocalName = regionalLocalName(aclName, region, homeRegion)
+                }
 
                 if isS3Destination(destArn) {
                     source.LogSourceType = "s3"
@@ -323,6 +358,13 @@ func DiscoverWAFLogSources(wafv2Mgr *WAFv2Manager, cfg *config.Config, logger lo
                     source.LogSourceType = "cloudwatchlogs"
                     source.CWLogsGroupName = extractLogGroupName(destArn)
                     logger.Debugf("Found CloudWatch Logs destination: %s", source.CWLogsGroupName)
+                } else if isFirehoseDestination(destArn) {
+                    source.LogSourceType = "firehose"
+                    if err := ResolveFirehoseDestination(wafv2Mgr.Session, source, logger); err != nil {
+                        logger.Warningf("Logs of Web ACL %s cannot be retrieved: %v", aclName, err)
+                    } else {
+                        logger.Debugf("Found Firehose destination: %s delivering to %s", source.FirehoseStream, source.S3BucketName)
+                    }
                 }
 
                 discoveredSources = append(discoveredSources, source)
@@ -337,11 +379,22 @@ func DiscoverWAFLogSources(wafv2Mgr *WAFv2Manager, cfg *config.Config, logger lo
         return nil
     }
 
-    // List Web ACLs for both Regional and CloudFront scopes
-    if err := listWebACLs(wafTypes.ScopeRegional); err != nil {
-        return nil, fmt.Errorf("error discovering Regional Web ACLs: %w", err)
+    // List Regional Web ACLs in every region of the profile. With several regions, a
+    // region that cannot be listed, e.g. one an SCP denies, is skipped.
+    regions, err := discoveryRegions(wafv2Mgr.Session, cfg.AWSProfiles[0], logger)
+    if err != nil {
+        return nil, err
     }
-    if err := listWebACLs(wafTypes.ScopeCloudfront); err != nil {
+    for _, region := range regions {
+        if err := listWebACLs(wafTypes.ScopeRegional, region); err != nil {
+            if len(regions) == 1 {
+                return nil, fmt.Errorf("error discovering Regional Web ACLs: %w", err)
+            }
+            logger.Warningf("Skipping region %s: %v", region, err)
+        }
+    }
+    // CloudFront Web ACLs are global and listed once, in the profile's region
+    if err := listWebACLs(wafTypes.ScopeCloudfront, homeRegion); err != nil {
         return nil, fmt.Errorf("error discovering CloudFront Web ACLs: %w", err)
     }
 
@@ -372,9 +425,81 @@ func ConvertWAFLogSource(cfg *config.WAFLogSourceConfig) *WAFLogSource {
         DestinationARN: cfg.DestinationARN,
         S3BucketName:   cfg.S3BucketName,
         CWLogsGroupName: cfg.CWLogsGroupName,
+        Scope:           strings.ToUpper(cfg.Scope),
+        LocalName:       cfg.LocalName,
     }
 }
 
+// WebACLSnapshot captures a Web ACL definition at a point in time
+type WebACLSnapshot struct {
+    CapturedAt          time.Time            `json:"capturedAt"`
+    Scope               string               `json:"scope"`
+    Region              string               `json:"region"`
+    WebACL              *wafTypes.WebACL     `json:"webACL"`
+    AssociatedResources []AssociatedResource `json:"associatedResources"`
+    AssociationError    string               `json:"associationError,omitempty"` // Why AssociatedResources could not all be listed; null or incomplete then
+    RuleSetCapacity     int64                `json:"ruleSetCapacity,omitempty"` // WCUs of all rules together, see RuleSetCapacity
+    RuleCapacities      map[string]int64     `json:"ruleCapacities,omitempty"`  // WCUs of each rule by name, see RuleCapacities
+    Origins             []OriginConfig       `json:"origins,omitempty"`         // Custom origins of its CloudFront distributions, see DescribeCloudFrontOrigins
+}
+
+// GetWebACLSnapshot fetches the current definition of the source's Web ACL
+func GetWebACLSnapshot(wafv2Mgr *WAFv2Manager, source *WAFLogSource, logger logging.Logger) (*WebACLSnapshot, error) {
+    ctx := context.TODO()
+    wafv2Mgr = NewWAFv2Manager(sourceSession(wafv2Mgr.Session, source))
+    client := wafv2.NewFromConfig(wafv2Mgr.Session)
+
+    scope := wafTypes.Scope(strings.ToUpper(source.Scope))
+    if scope == "" {
+        scope = wafTypes.ScopeRegional
+    }
+
+    logger.Debugf("Fetching Web ACL definition for %s (%s)", source.WebACLName, scope)
+    result, err := client.GetWebACL(ctx, &wafv2.GetWebACLInput{
+        Name:  aws.String(source.WebACLName),
+        Id:    aws.String(source.WebACLID),
+        Scope: scope,
+    })
+    if err != nil {
+        return nil, fmt.Errorf("failed to get Web ACL %s: %w", source.WebACLName, err)
+    }
+
+    snapshot := &WebACLSnapshot{
+        CapturedAt: time.Now().UTC(),
+        Scope:      string(scope),
+        Region:     source.Region,
+        WebACL:     result.WebACL,
+    }
+
+    // Record which resources the ACL protects so coverage can be analyzed offline
+    if result.WebACL != nil {
+        resources, err := ListAssociatedResources(wafv2Mgr, source, aws.ToString(result.WebACL.ARN), logger)
+        snapshot.AssociatedResources = resources
+        if err != nil {
+            // Recorded, so that analyses do not take the Web ACL for unassociated
+            snapshot.AssociationError = err.Error()
+            logger.Warningf("Failed to list resources associated with %s: %v", source.WebACLName, err)
+        } else {
+            logger.Infof("Web ACL %s is associated with %d resources", source.WebACLName, len(resources))
+        }
+        if capacity, err := RuleSetCapacity(wafv2Mgr, scope, result.WebACL); err != nil {
+            logger.Warningf("Failed to check the capacity of Web ACL %s: %v", source.WebACLName, err)
+        } else {
+            snapshot.RuleSetCapacity = capacity
+        }
+        snapshot.RuleCapacities = RuleCapacities(wafv2Mgr, scope, result.WebACL, logger)
+        if scope == wafTypes.ScopeCloudfront {
+            if origins, err := DescribeCloudFrontOrigins(wafv2Mgr, source, aws.ToString(result.WebACL.ARN), logger); err != nil {
+                logger.Warningf("Failed to describe the origins of %s: %v", source.WebACLName, err)
+            } else {
+                snapshot.Origins = origins
+            }
+        }
+    }
+
+    return snapshot, nil
+}
+
 // RetrieveLogsFromS3 retrieves WAF logs from an S3 bucket
 
 
@@ -397,7 +522,9 @@ func extractS3Prefix(arn string) string {
 // generatePrefixesForTimeRangeCustom builds prefixes using the provided base prefix.
 func generatePrefixesForTimeRangeCustom(startTime, endTime time.Time, basePrefix string) []string {
     var prefixes []string
-    currentTime := startTime
+    // Start from the day of the start time, so a range from late in one day into the
+    // next lists both days
+    currentTime := startTime.UTC().Truncate(24 * time.Hour)
     for !currentTime.After(endTime) {
         for hour := 0; hour < 24; hour++ {
             prefix := fmt.Sprintf("%s%d/%02d/%02d/%02d/",
@@ -414,25 +541,63 @@ func generatePrefixesForTimeRangeCustom(startTime, endTime time.Time, basePrefix
     return prefixes
 }
 
+// generatePartitionPrefixes builds the prefixes of the year=/month=/day=/hour= partitions of the time range below the base prefix.
+func generatePartitionPrefixes(startTime, endTime time.Time, basePrefix string) []string {
+    var prefixes []string
+    for currentTime := startTime.UTC().Truncate(24 * time.Hour); !currentTime.After(endTime); currentTime = currentTime.AddDate(0, 0, 1) {
+        for hour := 0; hour < 24; hour++ {
+            prefixes = append(prefixes, fmt.Sprintf("%syear=%d/month=%02d/day=%02d/hour=%02d/",
+                basePrefix, currentTime.Year(), currentTime.Month(), currentTime.Day(), hour))
+        }
+    }
+    return prefixes
+}
 
-// --- In the RetrieveLogsFromS3 function ---
-func RetrieveLogsFromS3(s3Mgr *S3Manager, source *WAFLogSource, startTime, endTime time.Time, outputDir string, logger logging.Logger) (int, error) {
+// RetrieveLogsFromS3 downloads the source's log objects in the time range. Objects that
+// fail to download are recorded in the result and skipped; an error is returned only
+// when the objects cannot be listed at all. Each object downloaded is checkpointed, so
+// with the manager's Resume, a rerun of an interrupted retrieval skips the objects it
+// downloaded.
+//
+// The time in an object's key lags or leads the timestamps of its records, so the
+// records at the edges of the time range may be in objects just outside it. Objects
+// up to the manager's BoundarySlack outside the range are therefore downloaded too,
+// and kept only if one of their records falls in the range. Objects are stored whole,
+// as delivered, so retrievals of adjacent ranges write the same files.
+func RetrieveLogsFromS3(s3Mgr *S3Manager, source *WAFLogSource, startTime, endTime time.Time, logger logging.Logger) (*RetrievalResult, error) {
     ctx, cancel := context.WithTimeout(context.Background(), 30*time.Minute)
     defer cancel()
 
-    s3Client := s3.NewFromConfig(s3Mgr.Session)
-    var logCount int
-
-    // 1) Determine the base prefix for listing objects.
-    basePrefix, err := queryS3BasePrefix(ctx, s3Client, source.S3BucketName, source.WebACLName, logger)
+    s3Client := s3.NewFromConfig(sourceSession(s3Mgr.Session, source))
+    result := &RetrievalResult{}
+    aclDir := s3Mgr.Storage.WebACLDir(source.ProfileName, source.DirName())
+    recordProvenance(aclDir, source, s3Mgr.Account, logger)
+    boundary, err := storage.LoadBoundaryObjects(aclDir)
     if err != nil {
-        logger.Warningf("Failed to query S3 for base prefix: %v. Falling back to extracting from DestinationARN.", err)
-        basePrefix = extractS3Prefix(source.DestinationARN)
+        logger.Warningf("Ignoring the boundary journal: %v", err)
     }
-    logger.Debugf("Using base prefix: %s", basePrefix)
 
-    // 2) Generate all possible prefixes for the time range.
-    prefixes := generatePrefixesForTimeRangeCustom(startTime, endTime, basePrefix)
+    // 1) Determine the base prefix for listing objects, and 2) generate all possible
+    // prefixes for the time range widened by the boundary slack. Firehose delivery
+    // streams have their own prefix.
+    listStart, listEnd := startTime.Add(-s3Mgr.BoundarySlack), endTime.Add(s3Mgr.BoundarySlack)
+    var prefixes []string
+    if source.LogSourceType == "firehose" {
+        logger.Debugf("Using Firehose prefix: %s", source.S3Prefix)
+        prefixes = firehosePrefixes(source.S3Prefix, listStart, listEnd)
+    } else {
+        basePrefix, partitioned, err := queryS3BasePrefix(ctx, s3Client, source.S3BucketName, source.WebACLName, logger)
+        if err != nil {
+            logger.Warningf("Failed to query S3 for base prefix: %v. Falling back to extracting from DestinationARN.", err)
+            basePrefix = extractS3Prefix(source.DestinationARN)
+        }
+        logger.Debugf("Using base prefix: %s", basePrefix)
+        if partitioned {
+            prefixes = generatePartitionPrefixes(listStart, listEnd, basePrefix)
+        } else {
+            prefixes = generatePrefixesForTimeRangeCustom(listStart, listEnd, basePrefix)
+        }
+    }
     logger.Debugf("Generated %d prefixes to check for logs", len(prefixes))
 
     // 3) Collect all matching objects first (to calculate total compressed size).
@@ -440,9 +605,13 @@ func RetrieveLogsFromS3(s3Mgr *S3Manager, source *WAFLogSource, startTime, endTi
         Key       string
         Timestamp time.Time
         Size      int64
+        Margin    bool      // In the boundary slack, outside the time range
+        KeepFrom  time.Time // For Margin objects, the records their log file keeps, see
+        KeepTo    time.Time // storage.BoundaryObject.KeepRange
     }
     var logObjects []s3LogObject
     var totalSize int64
+    var namings keyNamings
 
     for _, prefix := range prefixes {
         logger.Debugf("Checking prefix: %s", prefix)
@@ -454,77 +623,180 @@ func RetrieveLogsFromS3(s3Mgr *S3Manager, source *WAFLogSource, startTime, endTi
         for paginator.HasMorePages() {
             page, err := paginator.NextPage(ctx)
             if err != nil {
-                return 0, fmt.Errorf("failed to list S3 objects for prefix %s: %w", prefix, err)
+                return nil, fmt.Errorf("failed to list S3 objects for prefix %s: %w", prefix, err)
             }
             for _, obj := range page.Contents {
+                if strings.HasSuffix(*obj.Key, "/") {
+                    continue // Folder placeholder
+                }
                 logger.Debugf("Found log file: %s", *obj.Key)
-                timestamp, err := extractTimestampFromPath(*obj.Key)
+                timestamp, naming, err := extractTimestampFromKey(s3Mgr.keyPatterns(), *obj.Key)
+                namings.add(naming, *obj.Key)
                 if err != nil {
-                    logger.Debugf("Skipping file due to timestamp parsing error: %s - %v", *obj.Key, err)
+                    logger.Debugf("Skipping file: %v", err)
                     continue
                 }
-                if timestamp.Before(startTime) || timestamp.After(endTime) {
+                if timestamp.Before(listStart) || timestamp.After(listEnd) {
                     continue
                 }
-                logObjects = append(logObjects, s3LogObject{
+                logObj := s3LogObject{
                     Key:       *obj.Key,
                     Timestamp: timestamp,
                     Size:      *obj.Size,
-                })
+                    Margin:    timestamp.Before(startTime) || timestamp.After(endTime),
+                    KeepFrom:  startTime,
+                    KeepTo:    endTime,
+                }
+                if logObj.Margin {
+                    outPath := s3Mgr.Storage.GetLogFilePath(source.ProfileName, source.DirName(), timestamp, localLogName(source, *obj.Key))
+                    previous, covered := boundaryObject(boundary, fmt.Sprintf("s3://%s/%s", source.S3BucketName, *obj.Key), outPath, startTime, endTime)
+                    if covered {
+                        logger.Debugf("Skipping %s: it has no records of the time range that are not stored already", *obj.Key)
+                        continue
+                    }
+                    logObj.KeepFrom, logObj.KeepTo = previous.KeepRange(startTime, endTime)
+                }
+                logObjects = append(logObjects, logObj)
                 totalSize += *obj.Size
+                if !logObj.Margin && !timestamp.Before(result.LastTimestamp) {
+                    result.LastTimestamp, result.LastKey = timestamp, *obj.Key
+                }
             }
         }
     }
 
+    // Report the namings of the objects listed, and those of none known rather than
+    // leaving them out silently
+    if len(namings.counts) > 0 {
+        logger.Infof("S3 object naming of %s: %s", source.WebACLName, namings.String())
+    }
+    if len(namings.unrecognized) > 0 {
+        logger.Warningf("%s: %s", source.WebACLName, unrecognizedWarning(namings.unrecognized))
+        result.Unrecognized = namings.unrecognized
+    }
+
     if len(logObjects) == 0 {
         logger.Warning("No log files found in the specified time range")
-        return 0, nil
+        return result, nil
     }
-
-    // 4) Prompt user with total size & object count.
-    sizeInMB := float64(totalSize) / (1024 * 1024)
-    fmt.Printf("\nFound %d log files (%.2f MB total). Proceed with download? (y/n): ", len(logObjects), sizeInMB)
-    var userResp string
-    _, _ = fmt.Scanln(&userResp)
-    if strings.ToLower(userResp) != "y" {
-        logger.Info("User chose to cancel the download.")
-        return 0, nil
-    }
-
-    // 5) Create one overall progress bar using the total compressed size.
-    overallBar := progressbar.NewOptions64(
-        totalSize,
-        progressbar.OptionSetDescription("Overall Download Progress"),
-        progressbar.OptionSetWidth(40),
-        progressbar.OptionSetTheme(progressbar.Theme{
-            Saucer:        "█",
-            SaucerHead:    "█",
-            SaucerPadding: "░",
-            BarStart:      "[",
-            BarEnd:        "]",
-        }),
-        progressbar.OptionClearOnFinish(),
-    )
-
-    // 6) Download each object, updating the overall progress bar.
+    result.Found = len(logObjects)
+
+    // 4) Start the checkpoint of the run; when resuming, leave out the objects the
+    // interrupted run downloaded.
+    downloader := newObjectDownloader(aclDir, s3Mgr.Resume, 1, nil, logger)
+    var pending []s3LogObject
+    var downloads []objectDownload
+    var skippedSize int64
     for _, logObj := range logObjects {
-        outPath := generateOutputPath(outputDir, source, logObj.Timestamp, logObj.Key)
-        if err := os.MkdirAll(filepath.Dir(outPath), 0755); err != nil {
-            return logCount, fmt.Errorf("failed to create output directory: %w", err)
+        download := objectDownload{
+            Origin:  fmt.Sprintf("s3://%s/%s", source.S3BucketName, logObj.Key),
+            OutPath: s3Mgr.Storage.GetLogFilePath(source.ProfileName, source.DirName(), logObj.Timestamp, localLogName(source, logObj.Key)),
+            Size:    logObj.Size,
         }
-        logger.Debugf("Downloading %s to %s", logObj.Key, outPath)
-        if err := downloadS3Object(ctx, s3Client, source.S3BucketName, logObj.Key, outPath, overallBar); err != nil {
-            return logCount, fmt.Errorf("failed to download object %s: %w", logObj.Key, err)
+        if downloader.downloaded(download.Origin, download.OutPath) {
+            logger.Debugf("Skipping %s: downloaded by the interrupted run", download.Origin)
+            result.Skipped++
+            skippedSize += logObj.Size
+            totalSize -= logObj.Size
+            continue
         }
-        logCount++
+        key := logObj.Key
+        download.get = func(ctx context.Context, outPath string, progress io.Writer) error {
+            return downloadS3Object(ctx, s3Client, source.S3BucketName, key, outPath, progress)
+        }
+        pending = append(pending, logObj)
+        downloads = append(downloads, download)
+    }
+    if result.Skipped > 0 {
+        logger.Infof("Resuming: skipping %d log files (%.2f MB) downloaded by the interrupted run",
+            result.Skipped, float64(skippedSize)/(1024*1024))
+    }
+    if len(downloads) == 0 {
+        logger.Infof("All %d log files were downloaded by the interrupted run", result.Found)
+        downloader.finish(logger)
+        return result, nil
     }
 
-    logger.Infof("Successfully downloaded %d log files", logCount)
-    return logCount, nil
-}
+    // 5) Prompt user with total size & object count.
+    sizeInMB := float64(totalSize) / (1024 * 1024)
+    if s3Mgr.SkipConfirmation {
+        logger.Infof("Found %d log files (%.2f MB total) for %s", len(downloads), sizeInMB, source.WebACLName)
+    } else {
+        fmt.Printf("\nFound %d log files (%.2f MB total). Proceed with download? (y/n): ", len(downloads), sizeInMB)
+        var userResp string
+        _, _ = fmt.Scanln(&userResp)
+        if strings.ToLower(userResp) != "y" {
+            logger.Info("User chose to cancel the download.")
+            return &RetrievalResult{}, nil
+        }
+    }
 
+    // 6) Download each object onto one overall progress bar of the total compressed
+    // size, checkpointing it once it is in place.
+    downloader.run(ctx, downloads, totalSize, logger, func(i int, err error) bool {
+        logObj, download := pending[i], downloads[i]
+        if err != nil {
+            logger.Errorf("Failed to download object %s: %v", logObj.Key, err)
+            result.addFailure(logObj.Key, err)
+            return false
+        }
+        if logObj.Margin {
+            // Keep only the records of the time range
+            object := filterToRange(s3Mgr.Records, download.OutPath, logObj.KeepFrom, logObj.KeepTo, logger)
+            object.Origin = download.Origin
+            recordBoundaryObject(boundary, object, logger)
+            if !object.Kept() {
+                logger.Debugf("Dropped %s: none of its records is in the time range", logObj.Key)
+                result.Found-- // Not a log file of the range after all
+                result.OutsideRange++
+                return false
+            }
+        } else if _, ok := boundary.Lookup(download.Origin); ok {
+            // Downloaded whole now, where the journal has it filtered
+            recordBoundaryObject(boundary, storage.BoundaryObject{Origin: download.Origin, Whole: true}, logger)
+        }
+        result.Retrieved++
+        recordDownload(aclDir, download.OutPath, download.Origin, logger)
+        return true
+    })
+
+    if len(result.Failed) > 0 {
+        logger.Warningf("Downloaded %d of %d log files; %d failed", result.Retrieved, result.Found, len(result.Failed))
+    } else {
+        logger.Infof("Successfully downloaded %d log files", result.Retrieved)
+        downloader.finish(logger)
+    }
+    if result.OutsideRange > 0 {
+        logger.Infof("Left out %d objects within %s of the time range holding none of its records", result.OutsideRange, s3Mgr.BoundarySlack)
+    }
+    return result, nil
+}
 
+// boundaryObject looks up an object of the boundary slack in the boundary journal,
+// and reports whether it need not be downloaded: it has no records of the time
+// range, or its log file keeps them already. An object the journal does not have
+// was downloaded whole by a retrieval of its own range if its log file exists.
+func boundaryObject(boundary *storage.BoundaryObjects, origin, outPath string, startTime, endTime time.Time) (storage.BoundaryObject, bool) {
+    _, err := os.Stat(outPath)
+    exists := err == nil
+    object, ok := boundary.Lookup(origin)
+    if !ok {
+        return object, exists
+    }
+    return object, object.Covers(startTime, endTime, exists)
+}
 
+// recordBoundaryObject appends an object of the boundary slack to the boundary
+// journal. A failure is only logged: the object is then checked again by the next
+// retrieval.
+func recordBoundaryObject(boundary *storage.BoundaryObjects, object storage.BoundaryObject, logger logging.Logger) {
+    if boundary == nil {
+        return
+    }
+    if err := boundary.Record(object); err != nil {
+        logger.Warningf("Failed to record %s in the boundary journal: %v", object.Origin, err)
+    }
+}
 
 
 
@@ -553,66 +825,59 @@ func generatePrefixesForTimeRange(startTime, endTime time.Time, source *WAFLogSo
     return prefixes
 }
 
-// extractTimestampFromPath extracts the timestamp from a WAF log file path
-func extractTimestampFromPath(path string) (time.Time, error) {
-    // Split the path and get components
-    parts := strings.Split(path, "/")
-    if len(parts) < 7 {
-        return time.Time{}, fmt.Errorf("invalid path structure")
-    }
-
-    // Find the year, month, day, and hour in the path
-    var year, month, day, hour string
-    for i, part := range parts {
-        if i > 0 && i < len(parts)-4 {
-            // Try to parse each part as a year (4 digits)
-            if len(part) == 4 && part[0] == '2' {
-                year = part
-                if i+3 < len(parts) {
-                    month = parts[i+1]
-                    day = parts[i+2]
-                    hour = parts[i+3]
-                    break
-                }
-            }
-        }
+// recordDownload appends a retrieved file to the manifest of its Web ACL's directory.
+// A failure is only logged: the file itself was retrieved, and manifest verify
+// reports it as orphaned.
+func recordDownload(aclDir, file, origin string, logger logging.Logger) {
+    entry, err := storage.FileEntry(aclDir, file, origin)
+    if err == nil {
+        err = storage.AppendManifest(aclDir, entry)
     }
-
-    if year == "" || month == "" || day == "" || hour == "" {
-        return time.Time{}, fmt.Errorf("could not find date components in path")
+    if err != nil {
+        logger.Warningf("Failed to record %s in the manifest: %v", file, err)
     }
+}
 
-    // Parse the timestamp
-    timeStr := fmt.Sprintf("%s-%s-%sT%s:00:00Z", year, month, day, hour)
-    return time.Parse(time.RFC3339, timeStr)
+// recordProvenance records where the logs of a Web ACL's directory come from, so that
+// analyses merging several Web ACLs or accounts can tell their records apart. The
+// account is taken from the destination ARN, or is that of the Web ACLs for S3
+// buckets, whose ARNs have none, even if they are read through a role in a logging
+// account; records carry it in their Web ACL ARN as well. The account's name is
+// recorded with it, so reports can name the account. A failure is only logged,
+// like one to record a download.
+func recordProvenance(aclDir string, source *WAFLogSource, account Account, logger logging.Logger) {
+    provenance := &storage.Provenance{
+        Profile:     source.ProfileName,
+        AccountID:   arnAccount(source.DestinationARN),
+        Region:      source.Region,
+        WebACL:      source.WebACLName,
+        Destination: source.DestinationARN,
+    }
+    if provenance.AccountID == "" {
+        provenance.AccountID = account.ID
+    }
+    if provenance.AccountID == account.ID {
+        provenance.AccountName = account.DisplayName()
+    }
+    if err := provenance.Save(aclDir); err != nil {
+        logger.Warningf("Failed to record the provenance of %s: %v", source.WebACLName, err)
+    }
 }
 
-// generateOutputPath creates the output file path maintaining the same structure
-// generateOutputPath creates the output file path maintaining the same structure
-func generateOutputPath(baseDir string, source *WAFLogSource, timestamp time.Time, originalKey string) string {
-    // Create directory structure: baseDir/profile/waf-name/year/month/day/hour/
-    datePath := filepath.Join(
-        timestamp.Format("2006"),
-        timestamp.Format("01"),
-        timestamp.Format("02"),
-        timestamp.Format("15"),
-    )
-    
-    // Use the original filename as-is, including .gz
-    baseName := filepath.Base(originalKey)
-    
-    return filepath.Join(
-        baseDir,
-        source.ProfileName,
-        source.WebACLName,
-        datePath,
-        baseName,
-    )
+// arnAccount returns the account ID of an ARN, or "" if it has none, e.g. for S3 buckets
+func arnAccount(arn string) string {
+    parts := strings.SplitN(arn, ":", 6)
+    if len(parts) < 6 {
+        return ""
+    }
+    return parts[4]
 }
 
 // downloadS3Object downloads a compressed object from S3 and writes it to outputPath as-is,
-// preserving its compressed .gz format, while displaying a progress bar.
-func downloadS3Object(ctx context.Context, client *s3.Client, bucket, key, outputPath string, overallBar *progressbar.ProgressBar) error {
+// preserving its compressed .gz format, while displaying a progress bar. The object is
+// written to a temporary file first, so an interrupted download never leaves a
+// truncated file at outputPath.
+func downloadS3Object(ctx context.Context, client *s3.Client, bucket, key, outputPath string, overallBar io.Writer) error {
     // Get the object from S3.
     result, err := client.GetObject(ctx, &s3.GetObjectInput{
         Bucket: aws.String(bucket),
@@ -623,12 +888,12 @@ func downloadS3Object(ctx context.Context, client *s3.Client, bucket, key, outpu
     }
     defer result.Body.Close()
 
-    // Create the output file.
-    outFile, err := os.Create(outputPath)
+    // Create the temporary output file.
+    outFile, err := storage.CreateAtomic(outputPath)
     if err != nil {
         return fmt.Errorf("failed to create output file: %w", err)
     }
-    defer outFile.Close()
+    defer outFile.Abort()
 
     // Create a TeeReader to update the overall progress bar as compressed bytes are read.
     tee := io.TeeReader(result.Body, overallBar)
@@ -637,100 +902,143 @@ func downloadS3Object(ctx context.Context, client *s3.Client, bucket, key, outpu
     if _, err := io.Copy(outFile, tee); err != nil {
         return fmt.Errorf("failed to copy compressed data: %w", err)
     }
-    return nil
+    return outFile.Commit()
 }
 
 
-func RetrieveLogsFromCWLogs(cwLogsMgr *CWLogsManager, source *WAFLogSource, startTime, endTime time.Time, outputDir string, logger logging.Logger) (int, error) {
+// RetrieveLogsFromCWLogs runs a CloudWatch Logs Insights query per time chunk and writes
+// the results through the manager's storage, in the same layout as S3 deliveries. Chunk queries run concurrently, up to the manager's
+// MaxConcurrentQueries. Chunks whose query fails are recorded in the result and
+// skipped so the remaining chunks are still retrieved.
+func RetrieveLogsFromCWLogs(cwLogsMgr *CWLogsManager, source *WAFLogSource, startTime, endTime time.Time, logger logging.Logger) (*RetrievalResult, error) {
     ctx, cancel := context.WithTimeout(context.Background(), 30*time.Minute)
     defer cancel()
 
-    cwlogsClient := cloudwatchlogs.NewFromConfig(cwLogsMgr.Session)
+    cwlogsClient := cloudwatchlogs.NewFromConfig(sourceSession(cwLogsMgr.Session, source))
 
-    outputPath := filepath.Join(outputDir, source.ProfileName, source.WebACLName)
-    if err := os.MkdirAll(outputPath, 0755); err != nil {
-        return 0, fmt.Errorf("failed to create output directory: %w", err)
-    }
+    result := &RetrievalResult{}
+    recordProvenance(cwLogsMgr.Storage.WebACLDir(source.ProfileName, source.DirName()), source, cwLogsMgr.Account, logger)
 
-    // ✅ Set Time Chunk Interval (Adjust if Needed)
-    timeChunk := 6 * time.Hour // Splitting logs into 6-hour chunks
-    totalChunks := int(endTime.Sub(startTime) / timeChunk) // Total number of queries to execute
-    if totalChunks == 0 {
-        totalChunks = 1 // Ensure at least one chunk
+    // ✅ Split the window into 6-hour chunks, one query each
+    type chunk struct {
+        start, end time.Time
+        records    int
+        err        error
     }
-
-    // ✅ Initialize Progress Bar
-    progress := progressbar.Default(int64(totalChunks), "Retrieving logs...")
-
-    currentStart := startTime
-    totalLogCount := 0
-
-    // ✅ Loop Over Time Chunks
-    for currentStart.Before(endTime) {
+    timeChunk := 6 * time.Hour
+    var chunks []chunk
+    for currentStart := startTime; currentStart.Before(endTime); currentStart = currentStart.Add(timeChunk) {
         currentEnd := currentStart.Add(timeChunk)
         if currentEnd.After(endTime) {
             currentEnd = endTime
         }
+        chunks = append(chunks, chunk{start: currentStart, end: currentEnd})
+    }
 
-        logger.Infof("Querying logs from %s to %s", currentStart.Format(time.RFC3339), currentEnd.Format(time.RFC3339))
-
-        // ✅ Query CloudWatch Logs
-        queryInput := &cloudwatchlogs.StartQueryInput{
-            LogGroupName: aws.String(source.CWLogsGroupName),
-            StartTime:    aws.Int64(currentStart.UnixNano() / int64(time.Millisecond)),
-            EndTime:      aws.Int64(currentEnd.UnixNano() / int64(time.Millisecond)),
-            QueryString:  aws.String("fields @timestamp, @message"),
+    // ✅ Initialize Progress Bar
+    progress := progressbar.Default(int64(len(chunks)), "Retrieving logs...")
+
+    // ✅ Query the chunks concurrently; the manager limits the queries running at once
+    var wg sync.WaitGroup
+    for i := range chunks {
+        wg.Add(1)
+        go func(c *chunk) {
+            defer wg.Done()
+            c.records, c.err = retrieveCWLogsChunk(ctx, cwLogsMgr, cwlogsClient, source, c.start, c.end, logger)
+            _ = progress.Add(1)
+        }(&chunks[i])
+    }
+    wg.Wait()
+
+    // ✅ Fold the chunk outcomes into the result in time order
+    for _, c := range chunks {
+        result.Found++
+        if c.err != nil {
+            logger.Errorf("Failed to retrieve logs from %s to %s: %v", c.start.Format(time.RFC3339), c.end.Format(time.RFC3339), c.err)
+            result.addFailure(FormatChunkKey(c.start, c.end), c.err)
+            continue
         }
-
-        startQueryOutput, err := cwlogsClient.StartQuery(ctx, queryInput)
-        if err != nil {
-            return totalLogCount, fmt.Errorf("failed to start CloudWatch Logs query: %w", err)
+        result.Retrieved++
+        result.Records += c.records
+        if len(result.Failed) == 0 {
+            result.LastTimestamp = c.end
         }
+    }
 
-        logger.Infof("Started log retrieval query with ID: %s", *startQueryOutput.QueryId)
+    if len(result.Failed) > 0 {
+        logger.Warningf("Retrieved %d logs from %d of %d time chunks; %d failed", result.Records, result.Retrieved, result.Found, len(result.Failed))
+    } else {
+        logger.Infof("Successfully retrieved a total of %d logs", result.Records)
+    }
+    return result, nil
+}
 
-        // ✅ Process Query Results
-        for {
-            queryResults, err := cwlogsClient.GetQueryResults(ctx, &cloudwatchlogs.GetQueryResultsInput{
-                QueryId: startQueryOutput.QueryId,
-            })
+// retrieveCWLogsChunk runs the Insights query for one time chunk and returns the number of records written.
+// The query holds one of the manager's query slots until it ends, and is polled at growing intervals.
+func retrieveCWLogsChunk(ctx context.Context, cwLogsMgr *CWLogsManager, cwlogsClient *cloudwatchlogs.Client, source *WAFLogSource, chunkStart, chunkEnd time.Time, logger logging.Logger) (int, error) {
+    logger.Infof("Querying logs from %s to %s", chunkStart.Format(time.RFC3339), chunkEnd.Format(time.RFC3339))
+
+    // ✅ Query CloudWatch Logs
+    queryInput := &cloudwatchlogs.StartQueryInput{
+        LogGroupName: aws.String(source.CWLogsGroupName),
+        StartTime:    aws.Int64(chunkStart.UnixNano() / int64(time.Millisecond)),
+        EndTime:      aws.Int64(chunkEnd.UnixNano() / int64(time.Millisecond)),
+        QueryString:  aws.String("fields @timestamp, @message"),
+    }
 
-            if err != nil {
-                return totalLogCount, fmt.Errorf("failed to get query results: %w", err)
-            }
+    if err := cwLogsMgr.acquireQuery(ctx); err != nil {
+        return 0, fmt.Errorf("gave up waiting for a CloudWatch Logs query slot: %w", err)
+    }
+    defer cwLogsMgr.releaseQuery()
 
-            if len(queryResults.Results) > 0 {
-                // ✅ Generate a unique filename per chunk
-                outputFile := filepath.Join(outputPath, fmt.Sprintf("waf_logs_%s_to_%s.json", 
-                    currentStart.Format("20060102_150405"), currentEnd.Format("20060102_150405")))
+    startQueryOutput, err := startQuery(ctx, cwlogsClient, queryInput, logger)
+    if err != nil {
+        return 0, fmt.Errorf("failed to start CloudWatch Logs query: %w", err)
+    }
 
-                if err := writeLogsToFile(outputFile, queryResults.Results); err != nil {
-                    return totalLogCount, fmt.Errorf("failed to write logs to file: %w", err)
-                }
+    logger.Infof("Started log retrieval query with ID: %s", *startQueryOutput.QueryId)
 
-                totalLogCount += len(queryResults.Results)
+    // ✅ Process Query Results
+    poll := minQueryPoll
+    for {
+        queryResults, err := cwlogsClient.GetQueryResults(ctx, &cloudwatchlogs.GetQueryResultsInput{
+            QueryId: startQueryOutput.QueryId,
+        })
 
-                firstLogTime := queryResults.Results[0][0].Value
-                lastLogTime := queryResults.Results[len(queryResults.Results)-1][0].Value
-                logger.Infof("Retrieved logs from %s to %s", firstLogTime, lastLogTime)
-            }
+        if err != nil {
+            return 0, fmt.Errorf("failed to get query results: %w", err)
+        }
 
-            if queryResults.Status == cwTypes.QueryStatusComplete {
-                break
+        switch queryResults.Status {
+        case cwTypes.QueryStatusComplete:
+            if len(queryResults.Results) == 0 {
+                return 0, nil
+            }
+            // ✅ One file per chunk, in the hour directory of the chunk start like S3 deliveries
+            name := fmt.Sprintf("waf_logs_%s_to_%s.json", chunkStart.UTC().Format("20060102_150405"), chunkEnd.UTC().Format("20060102_150405"))
+            outputFile := cwLogsMgr.Storage.GetLogFilePath(source.ProfileName, source.DirName(), chunkStart, cwLogsMgr.Storage.LogFileName(name))
+            content, err := encodeLogs(queryResults.Results)
+            if err != nil {
+                return 0, err
+            }
+            if err := cwLogsMgr.Storage.WriteLogFile(outputFile, content); err != nil {
+                return 0, fmt.Errorf("failed to write logs to file: %w", err)
             }
 
-            time.Sleep(5 * time.Second)
+            firstLogTime := queryResults.Results[0][0].Value
+            lastLogTime := queryResults.Results[len(queryResults.Results)-1][0].Value
+            logger.Infof("Retrieved logs from %s to %s", aws.ToString(firstLogTime), aws.ToString(lastLogTime))
+            recordDownload(cwLogsMgr.Storage.WebACLDir(source.ProfileName, source.DirName()), outputFile, "cloudwatch:"+source.CWLogsGroupName, logger)
+            return len(queryResults.Results), nil
+        case cwTypes.QueryStatusFailed, cwTypes.QueryStatusCancelled, cwTypes.QueryStatusTimeout:
+            return 0, fmt.Errorf("query %s ended with status %s", *startQueryOutput.QueryId, queryResults.Status)
         }
 
-        // ✅ Update Progress Bar
-        _ = progress.Add(1)
-
-        // ✅ Move to Next Time Chunk
-        currentStart = currentEnd
+        if err := sleepContext(ctx, poll); err != nil {
+            return 0, fmt.Errorf("query %s did not complete: %w", *startQueryOutput.QueryId, err)
+        }
+        poll = nextQueryPoll(poll)
     }
-
-    logger.Infof("Successfully retrieved a total of %d logs", totalLogCount)
-    return totalLogCount, nil
 }
 
 
@@ -763,23 +1071,17 @@ func extractLogGroupName(arn string) string {
     return parts[6]
 }
 
-// writeLogsToFile writes CloudWatch Logs query results to a JSON file
-func writeLogsToFile(filename string, results [][]cwTypes.ResultField) error {
-    file, err := os.Create(filename)
-    if err != nil {
-        return fmt.Errorf("failed to create output file: %w", err)
-    }
-    defer file.Close()
-
-    encoder := json.NewEncoder(file)
-    encoder.SetIndent("", "  ") // Add indentation for better readability
+// encodeLogs encodes CloudWatch Logs query results as newline-delimited JSON, one
+// object of the result fields per log entry
+func encodeLogs(results [][]cwTypes.ResultField) ([]byte, error) {
+    var buf bytes.Buffer
+    encoder := json.NewEncoder(&buf)
 
     for _, result := range results {
         // Convert the ResultField slice to a map for better JSON structure
         logEntry := make(map[string]interface{})
         for _, field := range result {
             if field.Field != nil && field.Value != nil {
-                // Handle different field types appropriately
                 logEntry[*field.Field] = *field.Value
             }
         }
@@ -787,12 +1089,12 @@ func writeLogsToFile(filename string, results [][]cwTypes.ResultField) error {
         // Only write non-empty log entries
         if len(logEntry) > 0 {
             if err := encoder.Encode(logEntry); err != nil {
-                return fmt.Errorf("failed to encode log entry: %w", err)
+                return nil, fmt.Errorf("failed to encode log entry: %w", err)
             }
         }
     }
 
-    return nil
+    return buf.Bytes(), nil
 }
 
 // Utility function to validate the WAF log source configuration
@@ -809,8 +1111,8 @@ func validateWAFLogSource(source *WAFLogSource) error {
         return fmt.Errorf("WebACL ID cannot be empty")
     }
 
-    if source.LogSourceType != "s3" && source.LogSourceType != "cloudwatchlogs" {
-        return fmt.Errorf("invalid log source type: %s (must be 's3' or 'cloudwatchlogs')", source.LogSourceType)
+    if source.LogSourceType != "s3" && source.LogSourceType != "cloudwatchlogs" && source.LogSourceType != "firehose" {
+        return fmt.Errorf("invalid log source type: %s (must be 's3', 'cloudwatchlogs' or 'firehose')", source.LogSourceType)
     }
 
     if source.LogSourceType == "s3" && source.S3BucketName == "" {
@@ -821,24 +1123,32 @@ func validateWAFLogSource(source *WAFLogSource) error {
         return fmt.Errorf("CloudWatch Logs group name cannot be empty for CloudWatch Logs source")
     }
 
+    if source.LogSourceType == "firehose" && !isFirehoseDestination(source.DestinationARN) {
+        return fmt.Errorf("destination ARN must be a Firehose delivery stream for Firehose source")
+    }
+
     return nil
 }
 
-// BatchRetrieveLogs retrieves logs from multiple WAF sources in parallel
+// BatchRetrieveLogs retrieves logs from multiple WAF sources in parallel. A failing
+// source does not stop the others; the outcome of every source is collected into
+// the returned report. With sinceLastRun, each source is retrieved from where its
+// last run got, see SinceLastRun, rather than from startTime.
 func BatchRetrieveLogs(sources []*WAFLogSource, s3Mgr *S3Manager, cwLogsMgr *CWLogsManager, 
-    startTime, endTime time.Time, outputDir string, logger logging.Logger, maxConcurrent int) []error {
+    startTime, endTime time.Time, logger logging.Logger, maxConcurrent int, sinceLastRun bool) *RunReport {
     
     if maxConcurrent <= 0 {
         maxConcurrent = 4 // Default concurrent retrievals
     }
 
-    type retrievalResult struct {
-        source *WAFLogSource
-        err    error
+    report := &RunReport{
+        StartedAt:  time.Now().UTC(),
+        RangeStart: startTime,
+        RangeEnd:   endTime,
     }
 
     // Create a channel to receive results
-    results := make(chan retrievalResult, len(sources))
+    results := make(chan SourceReport, len(sources))
     semaphore := make(chan struct{}, maxConcurrent)
 
     // Start retrieval for each source
@@ -847,44 +1157,59 @@ func BatchRetrieveLogs(sources []*WAFLogSource, s3Mgr *S3Manager, cwLogsMgr *CWL
             semaphore <- struct{}{} // Acquire semaphore
             defer func() { <-semaphore }() // Release semaphore
 
-            var err error
-            if err = validateWAFLogSource(src); err != nil {
-                results <- retrievalResult{src, fmt.Errorf("validation failed: %w", err)}
+            if err := validateWAFLogSource(src); err != nil {
+                results <- NewSourceReport(src, nil, fmt.Errorf("validation failed: %w", err))
                 return
             }
 
             logger.Infof("Starting log retrieval for WAF WebACL: %s", src.WebACLName)
 
+            store := s3Mgr.Storage
+            if src.LogSourceType == "cloudwatchlogs" {
+                store = cwLogsMgr.Storage
+            }
+            start := startTime
+            if sinceLastRun {
+                start = SinceLastRun(store, src, startTime, logger)
+            }
+
+            var result *RetrievalResult
+            var err error
             switch src.LogSourceType {
             case "s3":
-                _, err = RetrieveLogsFromS3(s3Mgr, src, startTime, endTime, outputDir, logger)
+                result, err = RetrieveLogsFromS3(s3Mgr, src, start, endTime, logger)
             case "cloudwatchlogs":
-                _, err = RetrieveLogsFromCWLogs(cwLogsMgr, src, startTime, endTime, outputDir, logger)
+                result, err = RetrieveLogsFromCWLogs(cwLogsMgr, src, start, endTime, logger)
+            case "firehose":
+                result, err = RetrieveLogsFromFirehose(s3Mgr, src, start, endTime, logger)
             default:
                 err = fmt.Errorf("unsupported log source type: %s", src.LogSourceType)
             }
-
-            if err != nil {
-                err = fmt.Errorf("failed to retrieve logs for %s: %w", src.WebACLName, err)
+            if err == nil {
+                RecordRunState(store, src, result, start, endTime, logger)
             }
 
-            results <- retrievalResult{src, err}
+            results <- NewSourceReport(src, result, err)
         }(source)
     }
 
     // Collect results
-    var errors []error
     for range sources {
-        result := <-results
-        if result.err != nil {
-            errors = append(errors, result.err)
-            logger.Errorf("Error retrieving logs for %s: %v", result.source.WebACLName, result.err)
-        } else {
-            logger.Infof("Successfully retrieved logs for %s", result.source.WebACLName)
+        sourceReport := <-results
+        switch sourceReport.Status {
+        case StatusSuccess:
+            logger.Infof("Successfully retrieved logs for %s", sourceReport.Source.WebACLName)
+        case StatusPartial:
+            logger.Warningf("Partially retrieved logs for %s: %d of %d retrieved", sourceReport.Source.WebACLName, sourceReport.Retrieved, sourceReport.Found)
+        default:
+            logger.Errorf("Error retrieving logs for %s: %s", sourceReport.Source.WebACLName, sourceReport.Error)
         }
+        report.Sources = append(report.Sources, sourceReport)
     }
 
-    return errors
+    report.FinishedAt = time.Now().UTC()
+    report.sortSources()
+    return report
 }
 
 // GetWAFLogMetrics retrieves basic metrics about WAF logs
@@ -910,6 +1235,11 @@ func GetWAFLogMetrics(source *WAFLogSource, startTime, endTime time.Time, logger
         // Add CloudWatch Logs specific metrics
         metrics["logGroupName"] = source.CWLogsGroupName
         // You could add more CloudWatch metrics here (e.g., log volume, query stats)
+
+    case "firehose":
+        // Firehose delivers to S3, where the logs are retrieved from
+        metrics["deliveryStream"] = source.FirehoseStream
+        metrics["bucketName"] = source.S3BucketName
     }
 
     return metrics, nil
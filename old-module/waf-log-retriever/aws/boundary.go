@@ -0,0 +1,100 @@
+package aws
+
+import (
+	"bufio"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+
+	"waf-log-retriever/logging"
+	"waf-log-retriever/storage"
+)
+
+// filterToRange rewrites a log file downloaded from the boundary slack to keep only
+// its records from keepFrom to keepTo, read with forEach, and returns the boundary
+// journal line of its object. A file left without records is removed. Files that
+// cannot be read, or are read without forEach, are kept whole rather than risk
+// losing records of the range.
+func filterToRange(forEach storage.RecordFunc, file string, keepFrom, keepTo time.Time, logger logging.Logger) storage.BoundaryObject {
+	if forEach == nil {
+		return storage.BoundaryObject{Whole: true}
+	}
+	object, err := rewriteInRange(forEach, file, keepFrom, keepTo)
+	if err != nil {
+		logger.Warningf("Keeping all of %s, whose records could not be filtered to the time range: %v", file, err)
+		return storage.BoundaryObject{Whole: true}
+	}
+	return object
+}
+
+// rewriteInRange writes the records of a log file from keepFrom to keepTo to a
+// temporary file, gzipped like the log file, and renames it over the log file
+func rewriteInRange(forEach storage.RecordFunc, file string, keepFrom, keepTo time.Time) (storage.BoundaryObject, error) {
+	var object storage.BoundaryObject
+	out, err := storage.CreateAtomic(file)
+	if err != nil {
+		return object, err
+	}
+	defer out.Abort()
+	var gz *gzip.Writer
+	var w io.Writer = out
+	if filepath.Ext(file) == ".gz" {
+		gz = gzip.NewWriter(out)
+		w = gz
+	}
+	buffered := bufio.NewWriter(w)
+
+	from, to := keepFrom.UnixMilli(), keepTo.UnixMilli()
+	var first, last int64
+	total, kept := 0, 0
+	err = forEach(file, func(timestamp int64, raw []byte) error {
+		if total == 0 || timestamp < first {
+			first = timestamp
+		}
+		if total == 0 || timestamp > last {
+			last = timestamp
+		}
+		total++
+		if timestamp < from || timestamp > to {
+			return nil
+		}
+		kept++
+		if _, err := buffered.Write(raw); err != nil {
+			return err
+		}
+		return buffered.WriteByte('\n')
+	})
+	if err != nil {
+		return object, err
+	}
+	if total > 0 {
+		object.First, object.Last = time.UnixMilli(first).UTC(), time.UnixMilli(last).UTC()
+	}
+
+	switch kept {
+	case 0:
+		if err := os.Remove(file); err != nil {
+			return object, fmt.Errorf("failed to remove %s: %w", file, err)
+		}
+		return object, nil
+	case total:
+		object.Whole = true // Left as downloaded
+		return object, nil
+	}
+	if err := buffered.Flush(); err != nil {
+		return object, fmt.Errorf("failed to write %s: %w", out.Name(), err)
+	}
+	if gz != nil {
+		if err := gz.Close(); err != nil {
+			return object, fmt.Errorf("failed to write %s: %w", out.Name(), err)
+		}
+	}
+	if err := out.Commit(); err != nil {
+		return object, err
+	}
+	object.KeptFrom, object.KeptTo = keepFrom.UTC(), keepTo.UTC()
+	return object, nil
+}
@@ -0,0 +1,126 @@
+package aws
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"waf-log-retriever/config"
+	"waf-log-retriever/logging"
+	"waf-log-retriever/storage"
+)
+
+// DiscoveryCache stores WAF log source discovery results on disk, so repeated runs
+// do not have to list every Web ACL and logging configuration again
+type DiscoveryCache struct {
+	Dir string
+	TTL time.Duration // Entries older than this are ignored; zero disables the cache
+}
+
+// discoveryCacheEntry is the on-disk format of a cached discovery
+type discoveryCacheEntry struct {
+	CachedAt    time.Time       `json:"cachedAt"`
+	ProfileName string          `json:"profileName"`
+	Region      string          `json:"region"`
+	Sources     []*WAFLogSource `json:"sources"`
+}
+
+// NewDiscoveryCache builds a discovery cache from its configuration
+func NewDiscoveryCache(cfg config.DiscoveryCacheConfig) *DiscoveryCache {
+	dir := cfg.Directory
+	if dir == "" {
+		dir = filepath.Join(".cache", "discovery")
+	}
+	return &DiscoveryCache{Dir: dir, TTL: time.Duration(cfg.TTLMinutesOrDefault()) * time.Minute}
+}
+
+// path returns the cache file of a profile and region
+func (c *DiscoveryCache) path(profileName, region string) string {
+	name := strings.NewReplacer("/", "_", "\\", "_").Replace(profileName + "_" + region)
+	return filepath.Join(c.Dir, fmt.Sprintf("discovery_%s.json", name))
+}
+
+// Load returns the cached sources of a profile and region, or nil if there is no
+// fresh entry
+func (c *DiscoveryCache) Load(profileName, region string) ([]*WAFLogSource, time.Time, error) {
+	if c.TTL <= 0 {
+		return nil, time.Time{}, nil
+	}
+
+	data, err := os.ReadFile(c.path(profileName, region))
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil, time.Time{}, nil
+		}
+		return nil, time.Time{}, fmt.Errorf("failed to read discovery cache: %w", err)
+	}
+
+	var entry discoveryCacheEntry
+	if err := json.Unmarshal(data, &entry); err != nil {
+		return nil, time.Time{}, fmt.Errorf("failed to parse discovery cache: %w", err)
+	}
+	if time.Since(entry.CachedAt) > c.TTL {
+		return nil, time.Time{}, nil
+	}
+	return entry.Sources, entry.CachedAt, nil
+}
+
+// Save stores the discovered sources of a profile and region
+func (c *DiscoveryCache) Save(profileName, region string, sources []*WAFLogSource) error {
+	if c.TTL <= 0 {
+		return nil
+	}
+	if err := os.MkdirAll(c.Dir, 0755); err != nil {
+		return fmt.Errorf("failed to create discovery cache directory: %w", err)
+	}
+
+	data, err := json.MarshalIndent(discoveryCacheEntry{
+		CachedAt:    time.Now().UTC(),
+		ProfileName: profileName,
+		Region:      region,
+		Sources:     sources,
+	}, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to encode discovery cache: %w", err)
+	}
+	if err := storage.WriteFileAtomic(c.path(profileName, region), data); err != nil {
+		return fmt.Errorf("failed to write discovery cache: %w", err)
+	}
+	return nil
+}
+
+// DiscoverWAFLogSourcesCached returns the cached discovery results of the configured
+// profile when they are fresh, and otherwise runs DiscoverWAFLogSources and caches
+// the result. refresh bypasses the cached entry.
+func DiscoverWAFLogSourcesCached(wafv2Mgr *WAFv2Manager, cfg *config.Config, cache *DiscoveryCache, refresh bool, logger logging.Logger) ([]*WAFLogSource, error) {
+	profileName := cfg.AWSProfiles[0].ProfileName
+	region := cfg.AWSProfiles[0].RegionName
+	if regions := cfg.AWSProfiles[0].Regions; len(regions) > 0 {
+		// Discoveries of other regions are cached apart
+		region += "+" + strings.Join(regions, "+")
+	}
+
+	if !refresh {
+		sources, cachedAt, err := cache.Load(profileName, region)
+		if err != nil {
+			logger.Warningf("Ignoring discovery cache: %v", err)
+		} else if sources != nil {
+			logger.Infof("Using %d WAF Log Sources discovered at %s (use -refresh to discover again)",
+				len(sources), cachedAt.Local().Format("2006-01-02 15:04:05"))
+			return sources, nil
+		}
+	}
+
+	sources, err := DiscoverWAFLogSources(wafv2Mgr, cfg, logger)
+	if err != nil {
+		return nil, err
+	}
+	if err := cache.Save(profileName, region, sources); err != nil {
+		logger.Warningf("Failed to cache discovery results: %v", err)
+	}
+	return sources, nil
+}
@@ -0,0 +1,52 @@
+package aws
+
+import (
+	"context"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/wafv2"
+	wafTypes "github.com/aws/aws-sdk-go-v2/service/wafv2/types"
+
+	"waf-log-retriever/logging"
+)
+
+// RuleSetCapacity returns the WCUs of all rules of a Web ACL together, from
+// CheckCapacity on the current rule set
+func RuleSetCapacity(wafv2Mgr *WAFv2Manager, scope wafTypes.Scope, webACL *wafTypes.WebACL) (int64, error) {
+	return checkCapacity(wafv2.NewFromConfig(wafv2Mgr.Session), scope, webACL.Rules)
+}
+
+// RuleCapacities returns the WCUs of each rule of a Web ACL, by rule name, from
+// CheckCapacity on the rule alone. Rules whose capacity cannot be checked are logged
+// and left out so one failure does not hide the others.
+func RuleCapacities(wafv2Mgr *WAFv2Manager, scope wafTypes.Scope, webACL *wafTypes.WebACL, logger logging.Logger) map[string]int64 {
+	client := wafv2.NewFromConfig(wafv2Mgr.Session)
+
+	capacities := make(map[string]int64, len(webACL.Rules))
+	for _, rule := range webACL.Rules {
+		name := aws.ToString(rule.Name)
+		capacity, err := checkCapacity(client, scope, []wafTypes.Rule{rule})
+		if err != nil {
+			logger.Warningf("Failed to check the capacity of rule %s: %v", name, err)
+			continue
+		}
+		capacities[name] = capacity
+	}
+	logger.Debugf("Checked the capacity of %d of %d rules of %s", len(capacities), len(webACL.Rules), aws.ToString(webACL.Name))
+	return capacities
+}
+
+// checkCapacity returns the WCUs a set of rules would take in a Web ACL
+func checkCapacity(client *wafv2.Client, scope wafTypes.Scope, rules []wafTypes.Rule) (int64, error) {
+	if len(rules) == 0 {
+		return 0, nil
+	}
+	result, err := client.CheckCapacity(context.TODO(), &wafv2.CheckCapacityInput{
+		Scope: scope,
+		Rules: rules,
+	})
+	if err != nil {
+		return 0, err
+	}
+	return result.Capacity, nil
+}
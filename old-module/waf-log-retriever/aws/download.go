@@ -0,0 +1,125 @@
+package aws
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/schollz/progressbar/v3"
+
+	"waf-log-retriever/logging"
+	"waf-log-retriever/storage"
+)
+
+// objectDownload is an object to download to a log file
+type objectDownload struct {
+	Origin  string // Where the object comes from, e.g. s3://bucket/key
+	OutPath string
+	Size    int64 // 0 if unknown
+
+	// get downloads the object to outPath, writing the bytes read to progress
+	get func(ctx context.Context, outPath string, progress io.Writer) error
+}
+
+// objectDownloader downloads the objects of an S3 retrieval or a presigned import
+// into a Web ACL's directory: up to maxConcurrent at a time, each retried by its
+// policy, onto one overall progress bar. Each object downloaded is checkpointed, so
+// that a rerun of an interrupted run, resuming, skips the objects it downloaded.
+type objectDownloader struct {
+	maxConcurrent int          // 1 if not positive
+	policy        *RetryPolicy // Each object is attempted once if nil
+	checkpoint    *storage.Checkpoint
+}
+
+// newObjectDownloader starts the checkpoint of a run into a Web ACL's directory; with
+// resume, that of an interrupted run is kept. Without a checkpoint, e.g. as it could
+// not be read, objects are still downloaded.
+func newObjectDownloader(aclDir string, resume bool, maxConcurrent int, policy *RetryPolicy, logger logging.Logger) *objectDownloader {
+	checkpoint, err := storage.StartCheckpoint(aclDir, resume)
+	if err != nil {
+		logger.Warningf("Downloading without a checkpoint, so an interrupted run cannot be resumed: %v", err)
+	}
+	return &objectDownloader{maxConcurrent: maxConcurrent, policy: policy, checkpoint: checkpoint}
+}
+
+// downloaded reports whether the checkpoint of the interrupted run resumed records an
+// object as downloaded to its log file
+func (d *objectDownloader) downloaded(origin, outPath string) bool {
+	return d.checkpoint != nil && d.checkpoint.Downloaded(origin, outPath)
+}
+
+// run downloads the objects, totalSize bytes or -1 if unknown, and calls done for
+// each, one at a time, with the error it failed with. Objects done reports as kept
+// are checkpointed.
+func (d *objectDownloader) run(ctx context.Context, downloads []objectDownload, totalSize int64, logger logging.Logger, done func(i int, err error) bool) {
+	overallBar := progressbar.NewOptions64(
+		totalSize,
+		progressbar.OptionSetDescription("Overall Download Progress"),
+		progressbar.OptionSetWidth(40),
+		progressbar.OptionShowBytes(true),
+		progressbar.OptionSetTheme(progressbar.Theme{
+			Saucer:        "█",
+			SaucerHead:    "█",
+			SaucerPadding: "░",
+			BarStart:      "[",
+			BarEnd:        "]",
+		}),
+		progressbar.OptionClearOnFinish(),
+	)
+	defer overallBar.Finish()
+
+	maxConcurrent := d.maxConcurrent
+	if maxConcurrent <= 0 {
+		maxConcurrent = 1
+	}
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	semaphore := make(chan struct{}, maxConcurrent)
+	for i, download := range downloads {
+		semaphore <- struct{}{}
+		wg.Add(1)
+		go func(i int, download objectDownload) {
+			defer wg.Done()
+			defer func() { <-semaphore }()
+
+			logger.Debugf("Downloading %s to %s", download.Origin, download.OutPath)
+			get := func() error {
+				if err := os.MkdirAll(filepath.Dir(download.OutPath), 0755); err != nil {
+					return fmt.Errorf("failed to create output directory: %w", err)
+				}
+				return download.get(ctx, download.OutPath, overallBar)
+			}
+			var err error
+			if d.policy != nil {
+				err = d.policy.Do(ctx, download.Origin, logger, get)
+			} else {
+				err = get()
+			}
+
+			mu.Lock()
+			defer mu.Unlock()
+			if !done(i, err) || err != nil || d.checkpoint == nil {
+				return
+			}
+			if err := d.checkpoint.Complete(download.Origin, download.OutPath); err != nil {
+				logger.Warningf("Failed to checkpoint %s: %v", download.Origin, err)
+			}
+		}(i, download)
+	}
+	wg.Wait()
+}
+
+// finish removes the checkpoint of a run that downloaded every object. A failure is
+// only logged: a leftover checkpoint is discarded by the next run that does not
+// resume.
+func (d *objectDownloader) finish(logger logging.Logger) {
+	if d.checkpoint == nil {
+		return
+	}
+	if err := d.checkpoint.Finish(); err != nil {
+		logger.Warningf("Failed to remove the download checkpoint: %v", err)
+	}
+}
@@ -0,0 +1,145 @@
+package aws
+
+import (
+	"context"
+	"fmt"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/firehose"
+	firehoseTypes "github.com/aws/aws-sdk-go-v2/service/firehose/types"
+	"waf-log-retriever/logging"
+)
+
+// isFirehoseDestination reports whether a log destination is a Firehose delivery stream
+func isFirehoseDestination(arn string) bool {
+	return strings.Contains(arn, ":firehose:")
+}
+
+// extractDeliveryStreamName returns the name of the delivery stream of an ARN such as
+// arn:aws:firehose:us-east-1:123456789012:deliverystream/aws-waf-logs-prod
+func extractDeliveryStreamName(arn string) string {
+	parts := strings.SplitN(arn, ":", 6)
+	if len(parts) < 6 {
+		return ""
+	}
+	return strings.TrimPrefix(parts[5], "deliverystream/")
+}
+
+// ResolveFirehoseDestination looks up the S3 bucket, prefix and compression a
+// Firehose source's delivery stream delivers to. Streams delivering elsewhere, such
+// as to Splunk or an HTTP endpoint, or with compression the analysis cannot read,
+// return an error.
+func ResolveFirehoseDestination(session aws.Config, source *WAFLogSource, logger logging.Logger) error {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+
+	stream := extractDeliveryStreamName(source.DestinationARN)
+	if stream == "" {
+		return fmt.Errorf("invalid Firehose delivery stream ARN: %s", source.DestinationARN)
+	}
+	source.FirehoseStream = stream
+
+	// The stream is in the region of its ARN, which for CloudFront Web ACLs is
+	// us-east-1 whatever the profile's region
+	client := firehose.NewFromConfig(session, func(o *firehose.Options) {
+		if parts := strings.SplitN(source.DestinationARN, ":", 6); len(parts) == 6 && parts[3] != "" {
+			o.Region = parts[3]
+		}
+	})
+	result, err := client.DescribeDeliveryStream(ctx, &firehose.DescribeDeliveryStreamInput{
+		DeliveryStreamName: aws.String(stream),
+	})
+	if err != nil {
+		return fmt.Errorf("failed to describe Firehose delivery stream %s: %w", stream, err)
+	}
+	if result.DeliveryStreamDescription == nil || len(result.DeliveryStreamDescription.Destinations) == 0 {
+		return fmt.Errorf("Firehose delivery stream %s has no destination", stream)
+	}
+
+	destination := result.DeliveryStreamDescription.Destinations[0]
+	var bucketARN, prefix *string
+	var compression firehoseTypes.CompressionFormat
+	switch {
+	case destination.ExtendedS3DestinationDescription != nil:
+		s3Dest := destination.ExtendedS3DestinationDescription
+		bucketARN, prefix, compression = s3Dest.BucketARN, s3Dest.Prefix, s3Dest.CompressionFormat
+	case destination.S3DestinationDescription != nil:
+		s3Dest := destination.S3DestinationDescription
+		bucketARN, prefix, compression = s3Dest.BucketARN, s3Dest.Prefix, s3Dest.CompressionFormat
+	default:
+		return fmt.Errorf("Firehose delivery stream %s delivers to %s, not to S3, so its logs cannot be retrieved", stream, firehoseDestinationKind(destination))
+	}
+	switch compression {
+	case "", firehoseTypes.CompressionFormatUncompressed, firehoseTypes.CompressionFormatGzip:
+	default:
+		return fmt.Errorf("Firehose delivery stream %s compresses its objects with %s; only uncompressed and GZIP objects can be read", stream, compression)
+	}
+
+	source.S3BucketName = extractS3BucketName(aws.ToString(bucketARN))
+	source.S3Prefix = aws.ToString(prefix)
+	if source.S3BucketName == "" {
+		return fmt.Errorf("Firehose delivery stream %s has no S3 bucket", stream)
+	}
+	logger.Debugf("Firehose delivery stream %s delivers to s3://%s/%s", stream, source.S3BucketName, source.S3Prefix)
+	return nil
+}
+
+// firehoseDestinationKind names the kind of a delivery stream destination for errors
+func firehoseDestinationKind(destination firehoseTypes.DestinationDescription) string {
+	switch {
+	case destination.HttpEndpointDestinationDescription != nil:
+		return "an HTTP endpoint"
+	case destination.SplunkDestinationDescription != nil:
+		return "Splunk"
+	case destination.RedshiftDestinationDescription != nil:
+		return "Redshift"
+	}
+	return "a destination other than S3"
+}
+
+// RetrieveLogsFromFirehose downloads the objects a Firehose source's delivery stream
+// delivered to S3 in the time range, like RetrieveLogsFromS3. The delivery stream is
+// described first unless discovery did, e.g. for sources from waf-config.json.
+func RetrieveLogsFromFirehose(s3Mgr *S3Manager, source *WAFLogSource, startTime, endTime time.Time, logger logging.Logger) (*RetrievalResult, error) {
+	if source.FirehoseStream == "" || source.S3BucketName == "" {
+		if err := ResolveFirehoseDestination(s3Mgr.accountSession(), source, logger); err != nil {
+			return nil, err
+		}
+	}
+	return RetrieveLogsFromS3(s3Mgr, source, startTime, endTime, logger)
+}
+
+// accountSession returns the session of the Web ACLs' own account
+func (m *S3Manager) accountSession() aws.Config {
+	if m.AccountSession.Credentials == nil {
+		return m.Session
+	}
+	return m.AccountSession
+}
+
+// firehosePrefixes returns the S3 prefixes to list for a delivery stream's objects in
+// the time range. Without a custom prefix expression Firehose adds the UTC delivery
+// hour, YYYY/MM/DD/HH/, to the prefix; a prefix with !{...} expressions is listed
+// from its static part.
+func firehosePrefixes(prefix string, startTime, endTime time.Time) []string {
+	if static, _, ok := strings.Cut(prefix, "!{"); ok {
+		return []string{static}
+	}
+	return generatePrefixesForTimeRangeCustom(startTime.UTC().Truncate(24*time.Hour), endTime.UTC(), prefix)
+}
+
+// localLogName returns the name a log object is stored under. Firehose objects have
+// no extension, or .gz when compressed, so they get .log to be read as logs.
+func localLogName(source *WAFLogSource, key string) string {
+	name := path.Base(key)
+	if source.LogSourceType != "firehose" {
+		return name
+	}
+	if strings.HasSuffix(name, ".gz") {
+		return strings.TrimSuffix(name, ".gz") + ".log.gz"
+	}
+	return name + ".log"
+}
@@ -0,0 +1,95 @@
+package aws
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/service/cloudwatchlogs"
+	"github.com/aws/smithy-go"
+
+	"waf-log-retriever/logging"
+)
+
+// DefaultMaxConcurrentQueries is the number of CloudWatch Logs Insights queries run
+// at once when none is configured. An account may run 30 per region, shared with
+// dashboards and other users, so the default leaves room for them.
+const DefaultMaxConcurrentQueries = 10
+
+// Intervals between polls of a running Insights query: quick queries are picked up
+// within a second, long ones are not polled more often than needed
+const (
+	minQueryPoll = time.Second
+	maxQueryPoll = 10 * time.Second
+)
+
+// maxQueryStartDelay caps the wait before starting a query again while the account
+// runs as many queries as it may
+const maxQueryStartDelay = time.Minute
+
+// querySlots limits the Insights queries running at once
+type querySlots struct {
+	once  sync.Once
+	slots chan struct{}
+}
+
+// acquireQuery waits until fewer than MaxConcurrentQueries queries of the manager
+// are running
+func (m *CWLogsManager) acquireQuery(ctx context.Context) error {
+	m.queries.once.Do(func() {
+		n := m.MaxConcurrentQueries
+		if n <= 0 {
+			n = DefaultMaxConcurrentQueries
+		}
+		m.queries.slots = make(chan struct{}, n)
+	})
+	select {
+	case m.queries.slots <- struct{}{}:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// releaseQuery frees the slot of a finished query
+func (m *CWLogsManager) releaseQuery() {
+	<-m.queries.slots
+}
+
+// startQuery starts an Insights query. While the account runs as many queries as it
+// may, e.g. because of other users or dashboards, it waits and tries again with
+// growing delays until ctx is done.
+func startQuery(ctx context.Context, client *cloudwatchlogs.Client, input *cloudwatchlogs.StartQueryInput, logger logging.Logger) (*cloudwatchlogs.StartQueryOutput, error) {
+	delay := 5 * time.Second
+	for {
+		output, err := client.StartQuery(ctx, input)
+		var apiErr smithy.APIError
+		if !errors.As(err, &apiErr) || apiErr.ErrorCode() != "LimitExceededException" {
+			return output, err
+		}
+		logger.Debugf("Concurrent Insights query limit reached; starting again in %s", delay)
+		if err := sleepContext(ctx, delay); err != nil {
+			return nil, err
+		}
+		delay = min(delay*2, maxQueryStartDelay)
+	}
+}
+
+// nextQueryPoll lengthens the interval between polls of a running query by half, up
+// to maxQueryPoll
+func nextQueryPoll(interval time.Duration) time.Duration {
+	return min(interval*3/2, maxQueryPoll)
+}
+
+// sleepContext waits for d, returning early with the context's error once it is done
+func sleepContext(ctx context.Context, d time.Duration) error {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
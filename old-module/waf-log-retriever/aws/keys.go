@@ -0,0 +1,162 @@
+package aws
+
+import (
+	"fmt"
+	"regexp"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"waf-log-retriever/config"
+)
+
+// KeyPattern is a naming of S3 log objects: a regular expression over the object key
+// whose named groups year, month and day, and optionally hour, minute and second, give
+// the time of the object's logs
+type KeyPattern struct {
+	Name   string
+	Regexp *regexp.Regexp
+}
+
+// DefaultKeyPatterns are the namings AWS WAF and Firehose have given log objects, in
+// the order they are tried: the most precise time first.
+var DefaultKeyPatterns = []KeyPattern{
+	// Firehose: <prefix>YYYY/MM/DD/HH/<stream>-<version>-YYYY-MM-DD-HH-MM-SS-<id>,
+	// named after the delivery time
+	{"firehose", regexp.MustCompile(`-(?P<year>\d{4})-(?P<month>\d{2})-(?P<day>\d{2})-(?P<hour>\d{2})-(?P<minute>\d{2})-(?P<second>\d{2})-[^/]*$`)},
+	// Hive-compatible partitions of log deliveries, .../year=YYYY/month=MM/day=DD/hour=HH/<file>
+	{"partitioned", regexp.MustCompile(`(?:^|/)year=(?P<year>\d{4})/month=(?P<month>\d{2})/day=(?P<day>\d{2})/hour=(?P<hour>\d{2})/[^/]+$`)},
+	// 5-minute folders, AWSLogs/<account>/WAFLogs/<region>/<web ACL>/YYYY/MM/DD/HH/mm/<file>
+	{"5-minute", regexp.MustCompile(`(?:^|/)(?P<year>\d{4})/(?P<month>\d{2})/(?P<day>\d{2})/(?P<hour>\d{2})/(?P<minute>\d{2})/[^/]+$`)},
+	// Consolidated hourly folders, AWSLogs/<account>/WAFLogs/<region>/<web ACL>/YYYY/MM/DD/HH/<file>
+	{"hourly", regexp.MustCompile(`(?:^|/)(?P<year>\d{4})/(?P<month>\d{2})/(?P<day>\d{2})/(?P<hour>\d{2})/[^/]+$`)},
+	// The file name alone, <account>_waflogs_<region>_<web ACL>_YYYYMMDDTHHmmZ_<hash>.log.gz,
+	// e.g. of objects copied out of their folders
+	{"file name", regexp.MustCompile(`_(?P<year>\d{4})(?P<month>\d{2})(?P<day>\d{2})T(?P<hour>\d{2})(?P<minute>\d{2})Z_[^/]*$`)},
+}
+
+// keyTimeGroups are the named groups of a key pattern, from the year down; the first
+// three are required
+var keyTimeGroups = []string{"year", "month", "day", "hour", "minute", "second"}
+
+// CompileKeyPatterns returns the key patterns of the configuration followed by
+// DefaultKeyPatterns
+func CompileKeyPatterns(custom []config.KeyPatternConfig) ([]KeyPattern, error) {
+	patterns := make([]KeyPattern, 0, len(custom)+len(DefaultKeyPatterns))
+	for i, c := range custom {
+		name := c.Name
+		if name == "" {
+			name = fmt.Sprintf("key_patterns[%d]", i)
+		}
+		re, err := regexp.Compile(c.Pattern)
+		if err != nil {
+			return nil, fmt.Errorf("invalid key pattern %s: %w", name, err)
+		}
+		for _, group := range keyTimeGroups[:3] {
+			if re.SubexpIndex(group) < 0 {
+				return nil, fmt.Errorf("invalid key pattern %s: no (?P<%s>...) group", name, group)
+			}
+		}
+		patterns = append(patterns, KeyPattern{Name: name, Regexp: re})
+	}
+	return append(patterns, DefaultKeyPatterns...), nil
+}
+
+// match returns the time a key of the pattern gives, in UTC
+func (p KeyPattern) match(key string) (time.Time, bool) {
+	m := p.Regexp.FindStringSubmatch(key)
+	if m == nil {
+		return time.Time{}, false
+	}
+	var fields [6]int
+	for i, group := range keyTimeGroups {
+		index := p.Regexp.SubexpIndex(group)
+		if index < 0 || m[index] == "" {
+			continue
+		}
+		n, err := strconv.Atoi(m[index])
+		if err != nil {
+			return time.Time{}, false
+		}
+		fields[i] = n
+	}
+	t := time.Date(fields[0], time.Month(fields[1]), fields[2], fields[3], fields[4], fields[5], 0, time.UTC)
+	// time.Date normalizes out-of-range fields, e.g. month 13; such keys are no match
+	if t.Year() != fields[0] || int(t.Month()) != fields[1] || t.Day() != fields[2] ||
+		t.Hour() != fields[3] || t.Minute() != fields[4] || t.Second() != fields[5] {
+		return time.Time{}, false
+	}
+	return t, true
+}
+
+// extractTimestampFromKey returns the time of a log object from its key with the
+// first of the patterns it matches, and the name of that pattern
+func extractTimestampFromKey(patterns []KeyPattern, key string) (time.Time, string, error) {
+	for _, p := range patterns {
+		if t, ok := p.match(key); ok {
+			return t, p.Name, nil
+		}
+	}
+	return time.Time{}, "", fmt.Errorf("no known naming of log objects matches %s", key)
+}
+
+// keyPatterns returns the key patterns of the manager, DefaultKeyPatterns unless set
+func (m *S3Manager) keyPatterns() []KeyPattern {
+	if m.KeyPatterns == nil {
+		return DefaultKeyPatterns
+	}
+	return m.KeyPatterns
+}
+
+// keyNamings counts the listed log objects by the naming they were recognized by,
+// and collects those of no known naming
+type keyNamings struct {
+	counts       map[string]int
+	unrecognized []string
+}
+
+// add records the naming of a key, "" for none
+func (n *keyNamings) add(naming, key string) {
+	if naming == "" {
+		n.unrecognized = append(n.unrecognized, key)
+		return
+	}
+	if n.counts == nil {
+		n.counts = make(map[string]int)
+	}
+	n.counts[naming]++
+}
+
+// String describes the namings found, most common first, e.g. "5-minute (286), hourly (2)"
+func (n *keyNamings) String() string {
+	names := make([]string, 0, len(n.counts))
+	for name := range n.counts {
+		names = append(names, name)
+	}
+	sort.Slice(names, func(i, j int) bool {
+		if n.counts[names[i]] != n.counts[names[j]] {
+			return n.counts[names[i]] > n.counts[names[j]]
+		}
+		return names[i] < names[j]
+	})
+	parts := make([]string, len(names))
+	for i, name := range names {
+		parts[i] = fmt.Sprintf("%s (%d)", name, n.counts[name])
+	}
+	return strings.Join(parts, ", ")
+}
+
+// maxUnrecognizedExamples caps the unrecognized keys named in warnings
+const maxUnrecognizedExamples = 5
+
+// unrecognizedWarning describes the log objects of no known naming that were left out
+func unrecognizedWarning(keys []string) string {
+	examples := slices.Clone(keys[:min(len(keys), maxUnrecognizedExamples)])
+	if len(keys) > len(examples) {
+		examples = append(examples, fmt.Sprintf("and %d more", len(keys)-len(examples)))
+	}
+	return fmt.Sprintf("%d objects were not downloaded, as their keys are in no known naming: %s. Add a pattern for them to log_retrieval.key_patterns in config.json",
+		len(keys), strings.Join(examples, ", "))
+}
@@ -0,0 +1,380 @@
+package aws
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"sort"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/cloudfront"
+	cfTypes "github.com/aws/aws-sdk-go-v2/service/cloudfront/types"
+	"github.com/aws/aws-sdk-go-v2/service/ec2"
+	elb "github.com/aws/aws-sdk-go-v2/service/elasticloadbalancingv2"
+	elbTypes "github.com/aws/aws-sdk-go-v2/service/elasticloadbalancingv2/types"
+	"github.com/aws/aws-sdk-go-v2/service/wafv2"
+
+	"waf-log-retriever/logging"
+)
+
+// Types of CloudFront origins
+const (
+	OriginTypeALB    = "alb"    // An Elastic Load Balancing load balancer
+	OriginTypeCustom = "custom" // Any other custom origin, whose reachability is not checked
+)
+
+// elbDomainSuffix ends the DNS names of Elastic Load Balancing load balancers
+const elbDomainSuffix = ".elb.amazonaws.com"
+
+// OriginConfig is a custom origin of a CloudFront distribution using the Web ACL,
+// with what decides whether it can be reached without going through CloudFront.
+// S3 origins are left out.
+type OriginConfig struct {
+	DistributionID string              `json:"distributionId"`
+	OriginID       string              `json:"originId"`
+	DomainName     string              `json:"domainName"`
+	Type           string              `json:"type"`                    // OriginTypeALB or OriginTypeCustom
+	Ports          []int32             `json:"ports"`                   // Ports CloudFront connects to, by its origin protocol policy
+	OriginHeaders  []string            `json:"originHeaders,omitempty"` // Names of the custom headers CloudFront adds; their values are not kept
+	LoadBalancer   *LoadBalancerConfig `json:"loadBalancer,omitempty"`
+	Error          string              `json:"error,omitempty"` // Why the load balancer's configuration could not be read
+}
+
+// LoadBalancerConfig is the network exposure of a load balancer behind CloudFront
+type LoadBalancerConfig struct {
+	ARN       string           `json:"arn"`
+	Type      string           `json:"type"`                // application or network
+	Scheme    string           `json:"scheme"`              // internet-facing or internal
+	WebACLArn string           `json:"webACLArn,omitempty"` // Regional Web ACL of the load balancer itself
+	Listeners []ListenerConfig `json:"listeners"`
+	Ingress   []IngressRule    `json:"ingress"` // Inbound rules of its security groups
+}
+
+// ListenerConfig is a listener of a load balancer, with the headers its rules
+// require of requests they forward
+type ListenerConfig struct {
+	Port            int32    `json:"port"`
+	Protocol        string   `json:"protocol"`
+	RequiredHeaders []string `json:"requiredHeaders,omitempty"` // Headers of which every forwarding rule requires one; empty if a rule forwards without
+}
+
+// IngressRule is a source an inbound security group rule allows
+type IngressRule struct {
+	GroupID    string `json:"groupId"`
+	Protocol   string `json:"protocol"` // tcp, or -1 for all protocols
+	FromPort   int32  `json:"fromPort"`
+	ToPort     int32  `json:"toPort"`
+	Source     string `json:"source"`               // CIDR, prefix list ID or security group ID
+	SourceName string `json:"sourceName,omitempty"` // Name of a prefix list, e.g. com.amazonaws.global.cloudfront.origin-facing
+}
+
+// DescribeCloudFrontOrigins returns the custom origins of the CloudFront
+// distributions using the Web ACL. The load balancers among them are described
+// with their listeners and security groups in their own region; one that cannot
+// be, e.g. for a missing permission, carries the error so the others still count.
+func DescribeCloudFrontOrigins(wafv2Mgr *WAFv2Manager, source *WAFLogSource, webACLArn string, logger logging.Logger) ([]OriginConfig, error) {
+	ctx := context.TODO()
+	distributions, err := cloudFrontDistributions(ctx, cloudfront.NewFromConfig(wafv2Mgr.Session), webACLArn)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list CloudFront distributions for %s: %w", source.WebACLName, err)
+	}
+
+	var origins []OriginConfig
+	byRegion := make(map[string][]int) // Indexes of load balancer origins by region
+	for _, dist := range distributions {
+		if dist.Origins == nil {
+			continue
+		}
+		for _, o := range dist.Origins.Items {
+			if o.CustomOriginConfig == nil {
+				continue // S3
+			}
+			origin := OriginConfig{
+				DistributionID: aws.ToString(dist.Id),
+				OriginID:       aws.ToString(o.Id),
+				DomainName:     strings.ToLower(aws.ToString(o.DomainName)),
+				Type:           OriginTypeCustom,
+				Ports:          originPorts(o.CustomOriginConfig),
+			}
+			if o.CustomHeaders != nil {
+				for _, h := range o.CustomHeaders.Items {
+					origin.OriginHeaders = append(origin.OriginHeaders, strings.ToLower(aws.ToString(h.HeaderName)))
+				}
+			}
+			if region := elbRegion(origin.DomainName); region != "" {
+				origin.Type = OriginTypeALB
+				byRegion[region] = append(byRegion[region], len(origins))
+			}
+			origins = append(origins, origin)
+		}
+	}
+
+	regions := make([]string, 0, len(byRegion))
+	for region := range byRegion {
+		regions = append(regions, region)
+	}
+	sort.Strings(regions)
+	for _, region := range regions {
+		cfg := wafv2Mgr.Session.Copy()
+		cfg.Region = region
+		balancers, err := loadBalancersByDNSName(ctx, elb.NewFromConfig(cfg))
+		for _, i := range byRegion[region] {
+			origin := &origins[i]
+			if err != nil {
+				origin.Error = fmt.Sprintf("failed to list load balancers in %s: %v", region, err)
+				continue
+			}
+			lb, ok := balancers[strings.TrimPrefix(origin.DomainName, "dualstack.")]
+			if !ok {
+				origin.Error = fmt.Sprintf("no load balancer in %s has the DNS name %s", region, origin.DomainName)
+				continue
+			}
+			if origin.LoadBalancer, err = describeLoadBalancer(ctx, cfg, lb); err != nil {
+				origin.Error = err.Error()
+			}
+		}
+	}
+
+	for _, origin := range origins {
+		if origin.Error != "" {
+			logger.Warningf("Origin %s of CloudFront distribution %s: %s", origin.DomainName, origin.DistributionID, origin.Error)
+		}
+	}
+	logger.Debugf("Found %d custom origins of the CloudFront distributions using %s", len(origins), source.WebACLName)
+	return origins, nil
+}
+
+// cloudFrontDistributions returns the CloudFront distributions using a Web ACL
+func cloudFrontDistributions(ctx context.Context, client *cloudfront.Client, webACLArn string) ([]cfTypes.DistributionSummary, error) {
+	var distributions []cfTypes.DistributionSummary
+	var marker *string
+	for {
+		// CloudFront identifies WAFv2 Web ACLs by ARN
+		result, err := client.ListDistributionsByWebACLId(ctx, &cloudfront.ListDistributionsByWebACLIdInput{
+			WebACLId: aws.String(webACLArn),
+			Marker:   marker,
+		})
+		if err != nil {
+			return nil, err
+		}
+		if result.DistributionList == nil {
+			return distributions, nil
+		}
+		distributions = append(distributions, result.DistributionList.Items...)
+		if !aws.ToBool(result.DistributionList.IsTruncated) {
+			return distributions, nil
+		}
+		marker = result.DistributionList.NextMarker
+	}
+}
+
+// originPorts returns the ports CloudFront connects to a custom origin on
+func originPorts(config *cfTypes.CustomOriginConfig) []int32 {
+	httpPort, httpsPort := aws.ToInt32(config.HTTPPort), aws.ToInt32(config.HTTPSPort)
+	switch config.OriginProtocolPolicy {
+	case cfTypes.OriginProtocolPolicyHttpOnly:
+		return []int32{httpPort}
+	case cfTypes.OriginProtocolPolicyHttpsOnly:
+		return []int32{httpsPort}
+	}
+	return []int32{httpPort, httpsPort}
+}
+
+// elbRegion returns the region of a load balancer from its DNS name, e.g.
+// my-alb-1234567890.eu-west-1.elb.amazonaws.com, or "" if it is not one
+func elbRegion(domain string) string {
+	name, ok := strings.CutSuffix(domain, elbDomainSuffix)
+	if !ok {
+		return ""
+	}
+	if i := strings.LastIndex(name, "."); i >= 0 {
+		return name[i+1:]
+	}
+	return ""
+}
+
+// loadBalancersByDNSName returns the load balancers of a region by lowercase DNS name
+func loadBalancersByDNSName(ctx context.Context, client *elb.Client) (map[string]elbTypes.LoadBalancer, error) {
+	balancers := make(map[string]elbTypes.LoadBalancer)
+	var marker *string
+	for {
+		result, err := client.DescribeLoadBalancers(ctx, &elb.DescribeLoadBalancersInput{Marker: marker})
+		if err != nil {
+			return nil, err
+		}
+		for _, lb := range result.LoadBalancers {
+			balancers[strings.ToLower(aws.ToString(lb.DNSName))] = lb
+		}
+		if result.NextMarker == nil {
+			return balancers, nil
+		}
+		marker = result.NextMarker
+	}
+}
+
+// describeLoadBalancer reads the listeners, security groups and regional Web ACL of
+// a load balancer
+func describeLoadBalancer(ctx context.Context, cfg aws.Config, lb elbTypes.LoadBalancer) (*LoadBalancerConfig, error) {
+	client := elb.NewFromConfig(cfg)
+	config := &LoadBalancerConfig{
+		ARN:       aws.ToString(lb.LoadBalancerArn),
+		Type:      string(lb.Type),
+		Scheme:    string(lb.Scheme),
+		Listeners: []ListenerConfig{},
+		Ingress:   []IngressRule{},
+	}
+
+	var marker *string
+	for {
+		result, err := client.DescribeListeners(ctx, &elb.DescribeListenersInput{LoadBalancerArn: lb.LoadBalancerArn, Marker: marker})
+		if err != nil {
+			return config, fmt.Errorf("failed to describe the listeners of %s: %w", config.ARN, err)
+		}
+		for _, l := range result.Listeners {
+			listener := ListenerConfig{Port: aws.ToInt32(l.Port), Protocol: string(l.Protocol)}
+			if lb.Type == elbTypes.LoadBalancerTypeEnumApplication {
+				if listener.RequiredHeaders, err = requiredHeaders(ctx, client, l.ListenerArn); err != nil {
+					return config, fmt.Errorf("failed to describe the rules of listener %s: %w", aws.ToString(l.ListenerArn), err)
+				}
+			}
+			config.Listeners = append(config.Listeners, listener)
+		}
+		if result.NextMarker == nil {
+			break
+		}
+		marker = result.NextMarker
+	}
+
+	var err error
+	if config.Ingress, err = ingressRules(ctx, ec2.NewFromConfig(cfg), lb.SecurityGroups); err != nil {
+		return config, fmt.Errorf("failed to describe the security groups of %s: %w", config.ARN, err)
+	}
+
+	if lb.Type == elbTypes.LoadBalancerTypeEnumApplication {
+		result, err := wafv2.NewFromConfig(cfg).GetWebACLForResource(ctx, &wafv2.GetWebACLForResourceInput{ResourceArn: lb.LoadBalancerArn})
+		if err != nil {
+			return config, fmt.Errorf("failed to get the Web ACL of %s: %w", config.ARN, err)
+		}
+		if result.WebACL != nil {
+			config.WebACLArn = aws.ToString(result.WebACL.ARN)
+		}
+	}
+	return config, nil
+}
+
+// requiredHeaders returns the headers of which every rule of a listener that
+// forwards requests requires one, or nil if any forwards without. Rules that only
+// redirect or return a fixed response do not forward.
+func requiredHeaders(ctx context.Context, client *elb.Client, listenerArn *string) ([]string, error) {
+	required := make(map[string]bool)
+	var marker *string
+	for {
+		result, err := client.DescribeRules(ctx, &elb.DescribeRulesInput{ListenerArn: listenerArn, Marker: marker})
+		if err != nil {
+			return nil, err
+		}
+		for _, rule := range result.Rules {
+			forwards := false
+			for _, action := range rule.Actions {
+				if action.Type != elbTypes.ActionTypeEnumRedirect && action.Type != elbTypes.ActionTypeEnumFixedResponse {
+					forwards = true
+				}
+			}
+			if !forwards {
+				continue
+			}
+			var headers []string
+			for _, condition := range rule.Conditions {
+				if aws.ToString(condition.Field) == "http-header" && condition.HttpHeaderConfig != nil {
+					headers = append(headers, strings.ToLower(aws.ToString(condition.HttpHeaderConfig.HttpHeaderName)))
+				}
+			}
+			if len(headers) == 0 {
+				return nil, nil
+			}
+			for _, h := range headers {
+				required[h] = true
+			}
+		}
+		if result.NextMarker == nil {
+			break
+		}
+		marker = result.NextMarker
+	}
+	headers := make([]string, 0, len(required))
+	for h := range required {
+		headers = append(headers, h)
+	}
+	sort.Strings(headers)
+	return headers, nil
+}
+
+// ingressRules returns the sources the inbound rules of security groups allow,
+// naming the prefix lists among them
+func ingressRules(ctx context.Context, client *ec2.Client, groupIDs []string) ([]IngressRule, error) {
+	rules := []IngressRule{}
+	if len(groupIDs) == 0 {
+		return rules, nil // A network load balancer without security groups
+	}
+	result, err := client.DescribeSecurityGroups(ctx, &ec2.DescribeSecurityGroupsInput{GroupIds: groupIDs})
+	if err != nil {
+		return nil, err
+	}
+	var prefixLists []string
+	for _, group := range result.SecurityGroups {
+		for _, p := range group.IpPermissions {
+			rule := IngressRule{
+				GroupID:  aws.ToString(group.GroupId),
+				Protocol: aws.ToString(p.IpProtocol),
+				FromPort: aws.ToInt32(p.FromPort),
+				ToPort:   aws.ToInt32(p.ToPort),
+			}
+			if rule.Protocol == "-1" {
+				rule.FromPort, rule.ToPort = 0, 65535
+			}
+			add := func(source string) {
+				rule.Source = source
+				rules = append(rules, rule)
+			}
+			for _, r := range p.IpRanges {
+				add(aws.ToString(r.CidrIp))
+			}
+			for _, r := range p.Ipv6Ranges {
+				add(aws.ToString(r.CidrIpv6))
+			}
+			for _, r := range p.UserIdGroupPairs {
+				add(aws.ToString(r.GroupId))
+			}
+			for _, r := range p.PrefixListIds {
+				add(aws.ToString(r.PrefixListId))
+				if !slices.Contains(prefixLists, rule.Source) {
+					prefixLists = append(prefixLists, rule.Source)
+				}
+			}
+		}
+	}
+	if len(prefixLists) == 0 {
+		return rules, nil
+	}
+
+	names := make(map[string]string)
+	var token *string
+	for {
+		result, err := client.DescribeManagedPrefixLists(ctx, &ec2.DescribeManagedPrefixListsInput{PrefixListIds: prefixLists, NextToken: token})
+		if err != nil {
+			return nil, fmt.Errorf("failed to describe prefix lists: %w", err)
+		}
+		for _, list := range result.PrefixLists {
+			names[aws.ToString(list.PrefixListId)] = aws.ToString(list.PrefixListName)
+		}
+		if result.NextToken == nil {
+			break
+		}
+		token = result.NextToken
+	}
+	for i := range rules {
+		rules[i].SourceName = names[rules[i].Source]
+	}
+	return rules, nil
+}
@@ -0,0 +1,391 @@
+package aws
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"waf-log-retriever/logging"
+	"waf-log-retriever/storage"
+)
+
+// ErrPresignedURLExpired is returned for presigned URLs past their expiry
+var ErrPresignedURLExpired = errors.New("presigned URL expired")
+
+// PresignedObject is an S3 object a customer granted access to with a presigned URL
+type PresignedObject struct {
+	URL     string    // The presigned URL; it holds a signature, so it is never logged or recorded
+	Bucket  string    // "" if the URL does not name an S3 bucket, e.g. behind a custom domain
+	Key     string    // Object key, e.g. AWSLogs/<account>/WAFLogs/<region>/<webacl>/YYYY/MM/DD/HH/mm/<file>.log.gz
+	Expires time.Time // Zero if the URL does not say
+}
+
+// Origin returns where the object comes from without the URL's signature: its
+// s3:// URI, as for retrieved objects, so that objects retrieved and imported are
+// recognized as the same
+func (o PresignedObject) Origin() string {
+	if o.Bucket != "" {
+		return fmt.Sprintf("s3://%s/%s", o.Bucket, o.Key)
+	}
+	u, err := url.Parse(o.URL)
+	if err != nil {
+		return ""
+	}
+	return (&url.URL{Scheme: u.Scheme, Host: u.Host, Path: u.Path}).String()
+}
+
+// ParsePresignedURL parses a presigned URL into the object it grants access to, in
+// virtual-hosted or path style, signed with Signature Version 4 or 2
+func ParsePresignedURL(raw string) (PresignedObject, error) {
+	u, err := url.Parse(raw)
+	if err != nil {
+		return PresignedObject{}, fmt.Errorf("invalid URL: %w", err)
+	}
+	if u.Scheme != "https" || u.Host == "" {
+		// Over plain http, the signature granting access would travel in the clear
+		return PresignedObject{}, fmt.Errorf("not an https URL: %s", redactURL(raw))
+	}
+
+	object := PresignedObject{URL: raw, Key: strings.TrimPrefix(u.Path, "/")}
+	host := u.Hostname()
+	switch {
+	case strings.HasPrefix(host, "s3.") || strings.HasPrefix(host, "s3-"):
+		// Path style: the bucket is the first path segment
+		bucket, key, _ := strings.Cut(object.Key, "/")
+		object.Bucket, object.Key = bucket, key
+	case strings.Contains(host, ".s3.") || strings.Contains(host, ".s3-"):
+		object.Bucket = host[:strings.Index(host, ".s3")]
+	}
+	if object.Key == "" {
+		return PresignedObject{}, fmt.Errorf("URL names no object: %s", redactURL(raw))
+	}
+
+	query := u.Query()
+	if signed, err := time.Parse("20060102T150405Z", query.Get("X-Amz-Date")); err == nil {
+		if seconds, err := strconv.Atoi(query.Get("X-Amz-Expires")); err == nil {
+			object.Expires = signed.Add(time.Duration(seconds) * time.Second)
+		}
+	} else if seconds, err := strconv.ParseInt(query.Get("Expires"), 10, 64); err == nil {
+		object.Expires = time.Unix(seconds, 0).UTC()
+	}
+	return object, nil
+}
+
+// ReadPresignedURLs reads a list of presigned URLs: one per line, with blank lines
+// and lines starting with # ignored, or a JSON array of URLs or of objects with a
+// "url" field. A URL listed twice is returned once.
+func ReadPresignedURLs(r io.Reader) ([]PresignedObject, error) {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read URL list: %w", err)
+	}
+	data = bytes.TrimPrefix(data, []byte("\xef\xbb\xbf"))
+
+	var urls []string
+	if trimmed := bytes.TrimSpace(data); len(trimmed) > 0 && trimmed[0] == '[' {
+		var entries []json.RawMessage
+		if err := json.Unmarshal(trimmed, &entries); err != nil {
+			return nil, fmt.Errorf("failed to parse URL list: %w", err)
+		}
+		for i, entry := range entries {
+			var item struct {
+				URL string `json:"url"`
+			}
+			if err := json.Unmarshal(entry, &item.URL); err != nil {
+				if err := json.Unmarshal(entry, &item); err != nil || item.URL == "" {
+					return nil, fmt.Errorf("URL list entry %d is neither a URL nor an object with a url field", i+1)
+				}
+			}
+			urls = append(urls, item.URL)
+		}
+	} else {
+		scanner := bufio.NewScanner(bytes.NewReader(data))
+		scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+		for scanner.Scan() {
+			line := strings.TrimSpace(scanner.Text())
+			if line == "" || strings.HasPrefix(line, "#") {
+				continue
+			}
+			urls = append(urls, line)
+		}
+		if err := scanner.Err(); err != nil {
+			return nil, fmt.Errorf("failed to read URL list: %w", err)
+		}
+	}
+
+	var objects []PresignedObject
+	seen := make(map[string]bool)
+	for i, raw := range urls {
+		object, err := ParsePresignedURL(raw)
+		if err != nil {
+			return nil, fmt.Errorf("URL list entry %d: %w", i+1, err)
+		}
+		if seen[object.Origin()] {
+			continue
+		}
+		seen[object.Origin()] = true
+		objects = append(objects, object)
+	}
+	return objects, nil
+}
+
+// PresignedError is an error response of S3 to a presigned URL
+type PresignedError struct {
+	StatusCode int
+	Code       string // S3 error code, e.g. AccessDenied; "" if the response had none
+	Message    string
+}
+
+func (e *PresignedError) Error() string {
+	msg := fmt.Sprintf("HTTP %d", e.StatusCode)
+	if e.Code != "" {
+		msg += " " + e.Code
+	}
+	if e.Message != "" {
+		msg += ": " + e.Message
+	}
+	return msg
+}
+
+// Unwrap makes S3's response to an expired URL match ErrPresignedURLExpired
+func (e *PresignedError) Unwrap() error {
+	if e.StatusCode == http.StatusForbidden && strings.Contains(strings.ToLower(e.Message), "expired") {
+		return ErrPresignedURLExpired
+	}
+	return nil
+}
+
+// presignedHint suggests a fix for errors of presigned URLs, or returns "" if there
+// is none
+func presignedHint(err error) string {
+	if errors.Is(err, ErrPresignedURLExpired) {
+		return "The presigned URLs have expired: ask the customer for a fresh list and rerun; objects already downloaded are skipped"
+	}
+	var presignedErr *PresignedError
+	if !errors.As(err, &presignedErr) {
+		return ""
+	}
+	switch {
+	case presignedErr.Code == "SignatureDoesNotMatch":
+		return "The URL was altered, e.g. wrapped or re-encoded by a mail client: ask for the list as a file attachment"
+	case presignedErr.Code == "AccessDenied":
+		return "The URL was signed with credentials that cannot read the object: ask for URLs signed by a principal with s3:GetObject on the log bucket"
+	case presignedErr.Code == "NoSuchKey":
+		return "The object no longer exists, e.g. removed by a lifecycle rule: ask whether the logs are still retained"
+	case presignedErr.StatusCode == http.StatusServiceUnavailable, presignedErr.StatusCode == http.StatusTooManyRequests:
+		return "Requests are being throttled: lower max_concurrent_downloads and rerun"
+	}
+	return ""
+}
+
+// PresignedImport downloads the objects of a presigned URL list into a Web ACL's
+// directory, without AWS credentials
+type PresignedImport struct {
+	Client        *http.Client
+	Storage       *storage.StorageManager
+	Profile       string
+	WebACL        string
+	Policy        RetryPolicy
+	MaxConcurrent int
+	Resume        bool         // Skip the objects the checkpoint of an interrupted import or retrieval records, see storage.Checkpoint
+	KeyPatterns   []KeyPattern // Namings of log objects, see CompileKeyPatterns; DefaultKeyPatterns if nil
+}
+
+// Run downloads the objects into the layout of retrieved logs, placed by the hour in
+// their keys, with the downloader of S3 retrievals: up to MaxConcurrent at a time,
+// retrying each by the policy, and checkpointing each. Objects the manifest records
+// as downloaded from the same origin before, by an earlier import or a retrieval, are
+// skipped, so an interrupted import, or one whose URLs expired part way, resumes when
+// rerun, with the same list or a fresh one; with Resume, so are those the checkpoint
+// of an interrupted run records. Callers hold the directory's lock.
+func (p *PresignedImport) Run(ctx context.Context, objects []PresignedObject, logger logging.Logger) (*RetrievalResult, error) {
+	aclDir := p.Storage.WebACLDir(p.Profile, p.WebACL)
+	downloaded, _, err := storage.LoadManifest(aclDir)
+	if err != nil {
+		return nil, err
+	}
+	result := &RetrievalResult{Found: len(objects)}
+	keyPatterns := p.KeyPatterns
+	if keyPatterns == nil {
+		keyPatterns = DefaultKeyPatterns
+	}
+	recordImportProvenance(aclDir, p.Profile, p.WebACL, objects, logger)
+
+	maxConcurrent := p.MaxConcurrent
+	if maxConcurrent <= 0 {
+		maxConcurrent = 4
+	}
+	downloader := newObjectDownloader(aclDir, p.Resume, maxConcurrent, &p.Policy, logger)
+	var downloads []objectDownload
+	for _, object := range objects {
+		timestamp, _, err := extractTimestampFromKey(keyPatterns, object.Key)
+		if err != nil {
+			err = fmt.Errorf("cannot tell the hour of %s from its key: %w", object.Key, err)
+			logger.Errorf("Failed to download object %s: %v", object.Origin(), err)
+			result.addFailure(object.Origin(), err)
+			continue
+		}
+		outPath := p.Storage.GetLogFilePath(p.Profile, p.WebACL, timestamp, filepath.Base(object.Key))
+		if downloader.downloaded(object.Origin(), outPath) {
+			logger.Debugf("Skipping %s: downloaded by the interrupted run", object.Origin())
+			result.Skipped++
+			continue
+		}
+		if rel, err := filepath.Rel(aclDir, outPath); err == nil {
+			if entry, ok := downloaded[filepath.ToSlash(rel)]; ok && entry.Source == object.Origin() {
+				if _, err := os.Stat(outPath); err == nil {
+					logger.Debugf("Skipping %s: already downloaded", object.Origin())
+					result.Skipped++
+					continue
+				}
+			}
+		}
+		if !object.Expires.IsZero() && time.Now().After(object.Expires) {
+			err := fmt.Errorf("%w at %s", ErrPresignedURLExpired, object.Expires.UTC().Format(time.RFC3339))
+			logger.Errorf("Failed to download object %s: %v", object.Origin(), err)
+			result.addFailure(object.Origin(), err)
+			continue
+		}
+		presignedURL := object.URL
+		downloads = append(downloads, objectDownload{
+			Origin:  object.Origin(),
+			OutPath: outPath,
+			get: func(ctx context.Context, outPath string, progress io.Writer) error {
+				return downloadPresignedObject(ctx, p.Client, presignedURL, outPath, progress)
+			},
+		})
+	}
+	if result.Skipped > 0 {
+		logger.Infof("Skipping %d objects downloaded by an earlier run", result.Skipped)
+	}
+	if len(downloads) == 0 {
+		if len(result.Failed) == 0 {
+			downloader.finish(logger)
+		}
+		return result, nil
+	}
+
+	// Presigned URLs do not allow HEAD requests, so the total size is unknown
+	downloader.run(ctx, downloads, -1, logger, func(i int, err error) bool {
+		download := downloads[i]
+		if err != nil {
+			logger.Errorf("Failed to download object %s: %v", download.Origin, err)
+			result.addFailure(download.Origin, err)
+			return false
+		}
+		result.Retrieved++
+		recordDownload(aclDir, download.OutPath, download.Origin, logger)
+		return true
+	})
+	if len(result.Failed) == 0 {
+		downloader.finish(logger)
+	}
+	return result, nil
+}
+
+// downloadPresignedObject downloads an object with a presigned URL and writes it to
+// outputPath as-is, like downloadS3Object
+func downloadPresignedObject(ctx context.Context, client *http.Client, rawURL, outputPath string, overallBar io.Writer) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, rawURL, nil)
+	if err != nil {
+		return fmt.Errorf("failed to create request: %w", err)
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		var urlErr *url.Error
+		if errors.As(err, &urlErr) {
+			urlErr.URL = redactURL(urlErr.URL)
+		}
+		return fmt.Errorf("failed to get object: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return readPresignedError(resp)
+	}
+
+	outFile, err := storage.CreateAtomic(outputPath)
+	if err != nil {
+		return fmt.Errorf("failed to create output file: %w", err)
+	}
+	defer outFile.Abort()
+	if _, err := io.Copy(outFile, io.TeeReader(resp.Body, overallBar)); err != nil {
+		return fmt.Errorf("failed to copy compressed data: %w", err)
+	}
+	return outFile.Commit()
+}
+
+// readPresignedError reads the XML error document of an S3 error response
+func readPresignedError(resp *http.Response) error {
+	presignedErr := &PresignedError{StatusCode: resp.StatusCode}
+	var body struct {
+		Code    string `xml:"Code"`
+		Message string `xml:"Message"`
+	}
+	data, _ := io.ReadAll(io.LimitReader(resp.Body, 64*1024))
+	if xml.Unmarshal(data, &body) == nil {
+		presignedErr.Code, presignedErr.Message = body.Code, body.Message
+	}
+	return presignedErr
+}
+
+// redactURL strips the query, and with it the signature, from a URL for messages
+func redactURL(raw string) string {
+	u, err := url.Parse(raw)
+	if err != nil {
+		return "<invalid URL>"
+	}
+	u.RawQuery, u.Fragment = "", ""
+	return u.String()
+}
+
+// recordImportProvenance records the provenance of a Web ACL's directory from the
+// keys of S3's delivery layout, AWSLogs/<account>/WAFLogs/<region>/<webacl>/..., as
+// far as the objects share it. The provenance of a directory retrieved before is
+// kept, since retrieval knows more. A failure is only logged.
+func recordImportProvenance(aclDir, profile, webACL string, objects []PresignedObject, logger logging.Logger) {
+	if existing, err := storage.LoadProvenance(aclDir); err != nil || existing != nil {
+		return
+	}
+	provenance := &storage.Provenance{Profile: profile, WebACL: webACL}
+	for i, object := range objects {
+		var account, region, bucket string
+		parts := strings.Split(object.Key, "/")
+		for j := 0; j+3 < len(parts); j++ {
+			if parts[j] == "AWSLogs" && parts[j+2] == "WAFLogs" {
+				account, region = parts[j+1], parts[j+3]
+				break
+			}
+		}
+		if object.Bucket != "" {
+			bucket = "arn:aws:s3:::" + object.Bucket
+		}
+		if i == 0 {
+			provenance.AccountID, provenance.Region, provenance.Destination = account, region, bucket
+			continue
+		}
+		if account != provenance.AccountID {
+			provenance.AccountID = ""
+		}
+		if region != provenance.Region {
+			provenance.Region = ""
+		}
+		if bucket != provenance.Destination {
+			provenance.Destination = ""
+		}
+	}
+	if err := provenance.Save(aclDir); err != nil {
+		logger.Warningf("Failed to record the provenance of %s: %v", webACL, err)
+	}
+}
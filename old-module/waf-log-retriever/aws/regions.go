@@ -0,0 +1,74 @@
+package aws
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ec2"
+	wafTypes "github.com/aws/aws-sdk-go-v2/service/wafv2/types"
+
+	"waf-log-retriever/config"
+	"waf-log-retriever/logging"
+)
+
+// AllRegions in a profile's regions discovers Regional Web ACLs in every region
+// enabled in the account
+const AllRegions = "all"
+
+// DirName returns the name of the directory below the profile's that the source's
+// logs, snapshots and results are stored in: LocalName if set, otherwise the Web ACL
+// name
+func (s *WAFLogSource) DirName() string {
+	if s.LocalName != "" {
+		return s.LocalName
+	}
+	return s.WebACLName
+}
+
+// regionalLocalName returns the LocalName of a Regional Web ACL discovered in a region.
+// Web ACLs outside the profile's own region get the region appended, so Web ACLs of
+// the same name in several regions do not share a directory, while single-region
+// setups keep the directories they always had. Web ACL names cannot contain @.
+func regionalLocalName(name, region, homeRegion string) string {
+	if region == homeRegion {
+		return ""
+	}
+	return name + "@" + region
+}
+
+// discoveryRegions returns the regions to discover Regional Web ACLs of a profile in:
+// its configured regions, every enabled region for "all", or only its own region
+func discoveryRegions(session aws.Config, profile config.AWSProfileConfig, logger logging.Logger) ([]string, error) {
+	if len(profile.Regions) == 0 {
+		return []string{profile.RegionName}, nil
+	}
+	if !slices.Contains(profile.Regions, AllRegions) {
+		return profile.Regions, nil
+	}
+
+	result, err := ec2.NewFromConfig(session).DescribeRegions(context.TODO(), &ec2.DescribeRegionsInput{})
+	if err != nil {
+		return nil, fmt.Errorf("failed to list the regions enabled in the account: %w", err)
+	}
+	regions := make([]string, 0, len(result.Regions))
+	for _, region := range result.Regions {
+		regions = append(regions, aws.ToString(region.RegionName))
+	}
+	slices.Sort(regions)
+	logger.Infof("Discovering Regional Web ACLs in %d enabled regions", len(regions))
+	return regions, nil
+}
+
+// sourceSession returns the session for API calls about a source's Web ACL and logs:
+// a copy of the session in the source's region for Regional Web ACLs of another
+// region, otherwise the session itself. CloudFront Web ACLs are global and keep it.
+func sourceSession(session aws.Config, source *WAFLogSource) aws.Config {
+	if source.Region == "" || source.Region == session.Region || strings.EqualFold(source.Scope, string(wafTypes.ScopeCloudfront)) {
+		return session
+	}
+	session.Region = source.Region
+	return session
+}
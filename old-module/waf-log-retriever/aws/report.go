@@ -0,0 +1,246 @@
+package aws
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/aws/smithy-go"
+
+	"waf-log-retriever/config"
+	"waf-log-retriever/storage"
+)
+
+// Per-source retrieval statuses
+const (
+	StatusSuccess = "success"
+	StatusPartial = "partial"
+	StatusFailed  = "failed"
+)
+
+// FailedItem is an S3 object or CloudWatch Logs time chunk that could not be retrieved
+type FailedItem struct {
+	Key   string `json:"key"` // S3 object key, or the chunk's time range (see FormatChunkKey)
+	Error string `json:"error"`
+	Hint  string `json:"hint,omitempty"`
+}
+
+// RetrievalResult is the outcome of retrieving logs for a single source
+type RetrievalResult struct {
+	Found     int          // S3 objects or CloudWatch Logs time chunks in the time range
+	Retrieved int          // Objects or chunks retrieved successfully
+	Records   int          // Log records retrieved (CloudWatch Logs only)
+	Skipped   int          // Objects downloaded by an earlier run (presigned URL imports, and resumed S3 retrievals)
+	Failed    []FailedItem // Objects or chunks that could not be retrieved
+
+	Unrecognized []string // Keys of objects listed in no known naming, not downloaded (S3 only)
+	OutsideRange int      // Objects of the boundary slack holding no record in the time range, not kept (S3 only)
+
+	LastTimestamp time.Time // Of the latest S3 object found, or the end of the last chunk retrieved before any failed, see RecordRunState
+	LastKey       string    // S3 key of the latest object found
+}
+
+// addFailure records an object or chunk that could not be retrieved
+func (r *RetrievalResult) addFailure(key string, err error) {
+	r.Failed = append(r.Failed, FailedItem{Key: key, Error: err.Error(), Hint: ErrorHint(err)})
+}
+
+// FormatChunkKey identifies a CloudWatch Logs time chunk as an ISO 8601 interval
+func FormatChunkKey(start, end time.Time) string {
+	return start.UTC().Format(time.RFC3339) + "/" + end.UTC().Format(time.RFC3339)
+}
+
+// ParseChunkKey parses a time chunk key produced by FormatChunkKey
+func ParseChunkKey(key string) (start, end time.Time, err error) {
+	parts := strings.SplitN(key, "/", 2)
+	if len(parts) != 2 {
+		return time.Time{}, time.Time{}, fmt.Errorf("invalid time chunk %q", key)
+	}
+	if start, err = time.Parse(time.RFC3339, parts[0]); err != nil {
+		return time.Time{}, time.Time{}, fmt.Errorf("invalid time chunk %q: %w", key, err)
+	}
+	if end, err = time.Parse(time.RFC3339, parts[1]); err != nil {
+		return time.Time{}, time.Time{}, fmt.Errorf("invalid time chunk %q: %w", key, err)
+	}
+	return start, end, nil
+}
+
+// SourceReport is the end-of-run status of one WAF log source
+type SourceReport struct {
+	Source       *WAFLogSource `json:"source"` // Recorded in full so failed items can be retried
+	Status       string        `json:"status"`
+	Found        int           `json:"found"`
+	Retrieved    int           `json:"retrieved"`
+	Skipped      int           `json:"skipped,omitempty"` // Downloaded by the interrupted run a resumed retrieval skipped
+	Records      int           `json:"records,omitempty"`
+	FailedItems  []FailedItem  `json:"failedItems,omitempty"`
+	Unrecognized []string      `json:"unrecognizedKeys,omitempty"` // Objects in no known naming, see KeyPattern
+	Error        string        `json:"error,omitempty"`
+	Hint         string        `json:"hint,omitempty"`
+}
+
+// NewSourceReport builds the report entry for a source from its retrieval result.
+// err is an error that stopped the retrieval of the source as a whole.
+func NewSourceReport(source *WAFLogSource, result *RetrievalResult, err error) SourceReport {
+	report := SourceReport{
+		Source: source,
+		Status: StatusSuccess,
+	}
+	if result != nil {
+		report.Found = result.Found
+		report.Retrieved = result.Retrieved
+		report.Skipped = result.Skipped
+		report.Records = result.Records
+		report.FailedItems = result.Failed
+		report.Unrecognized = result.Unrecognized
+	}
+
+	switch {
+	case err != nil:
+		report.Error = err.Error()
+		report.Hint = ErrorHint(err)
+		report.Status = StatusFailed
+		if report.Retrieved+report.Skipped > 0 {
+			report.Status = StatusPartial
+		}
+	case len(report.FailedItems) > 0:
+		report.Status = StatusPartial
+		if report.Retrieved+report.Skipped == 0 {
+			report.Status = StatusFailed
+		}
+		report.Error = fmt.Sprintf("%d of %d items failed", len(report.FailedItems), report.Found)
+		report.Hint = report.FailedItems[0].Hint
+	}
+	return report
+}
+
+// RunReport summarizes a batch retrieval run across all sources
+type RunReport struct {
+	StartedAt  time.Time      `json:"startedAt"`
+	FinishedAt time.Time      `json:"finishedAt"`
+	RangeStart time.Time      `json:"rangeStart"`
+	RangeEnd   time.Time      `json:"rangeEnd"`
+	Sources    []SourceReport `json:"sources"`
+}
+
+// sortSources orders the sources by profile and Web ACL name so reports are stable
+func (r *RunReport) sortSources() {
+	sort.Slice(r.Sources, func(i, j int) bool {
+		a, b := r.Sources[i].Source, r.Sources[j].Source
+		if a.ProfileName != b.ProfileName {
+			return a.ProfileName < b.ProfileName
+		}
+		return a.DirName() < b.DirName()
+	})
+}
+
+// CountByStatus returns the number of sources with the given status
+func (r *RunReport) CountByStatus(status string) int {
+	count := 0
+	for _, source := range r.Sources {
+		if source.Status == status {
+			count++
+		}
+	}
+	return count
+}
+
+// CheckThresholds returns an error describing the first failure threshold the run exceeds
+func (r *RunReport) CheckThresholds(thresholds config.FailureThresholds) error {
+	if failed := r.CountByStatus(StatusFailed); failed > thresholds.FailedSourcesLimit() {
+		return fmt.Errorf("%d sources failed (max_failed_sources is %d)", failed, thresholds.FailedSourcesLimit())
+	}
+	if limit, ok := thresholds.PartialSourcesLimit(); ok {
+		if partial := r.CountByStatus(StatusPartial); partial > limit {
+			return fmt.Errorf("%d sources were only partially retrieved (max_partial_sources is %d)", partial, limit)
+		}
+	}
+	return nil
+}
+
+// WriteJSON writes the report as indented JSON into dir and returns the file path
+func (r *RunReport) WriteJSON(dir string) (string, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return "", fmt.Errorf("failed to create report directory: %w", err)
+	}
+
+	data, err := json.MarshalIndent(r, "", "  ")
+	if err != nil {
+		return "", fmt.Errorf("failed to encode retrieval report: %w", err)
+	}
+
+	path := filepath.Join(dir, fmt.Sprintf("retrieval_report_%s.json", r.StartedAt.Format("20060102_150405")))
+	if err := storage.WriteFileAtomic(path, data); err != nil {
+		return "", fmt.Errorf("failed to write retrieval report: %w", err)
+	}
+	return path, nil
+}
+
+// PrintTable writes a console summary table of the report, followed by the
+// error and suggested fix for every source that did not fully succeed
+func (r *RunReport) PrintTable(w io.Writer) {
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "PROFILE\tWEB ACL\tTYPE\tSTATUS\tRETRIEVED\tFAILED")
+	for _, source := range r.Sources {
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%d/%d\t%d\n", source.Source.ProfileName, source.Source.DirName(),
+			source.Source.LogSourceType, strings.ToUpper(source.Status), source.Retrieved, source.Found, len(source.FailedItems))
+	}
+	tw.Flush()
+
+	fmt.Fprintf(w, "\n%d succeeded, %d partial, %d failed\n",
+		r.CountByStatus(StatusSuccess), r.CountByStatus(StatusPartial), r.CountByStatus(StatusFailed))
+
+	for _, source := range r.Sources {
+		if len(source.Unrecognized) > 0 {
+			fmt.Fprintf(w, "\n%s/%s: %s\n", source.Source.ProfileName, source.Source.DirName(), unrecognizedWarning(source.Unrecognized))
+		}
+		if source.Status == StatusSuccess {
+			continue
+		}
+		fmt.Fprintf(w, "\n%s/%s: %s\n", source.Source.ProfileName, source.Source.DirName(), source.Error)
+		if source.Hint != "" {
+			fmt.Fprintf(w, "  -> %s\n", source.Hint)
+		}
+	}
+}
+
+// ErrorHint suggests a fix for common AWS errors, or returns "" if there is none
+func ErrorHint(err error) string {
+	if hint := presignedHint(err); hint != "" {
+		return hint
+	}
+	var apiErr smithy.APIError
+	if !errors.As(err, &apiErr) {
+		if errors.Is(err, context.DeadlineExceeded) {
+			return "The retrieval ran out of time: rerun with -resume to skip the S3 objects downloaded already"
+		}
+		if errors.Is(err, os.ErrPermission) {
+			return "Check that the output directory is writable"
+		}
+		return ""
+	}
+
+	switch apiErr.ErrorCode() {
+	case "AccessDenied", "AccessDeniedException", "UnauthorizedOperation":
+		return "The credentials lack a required permission: grant s3:ListBucket/s3:GetObject on the log bucket or logs:StartQuery/logs:GetQueryResults on the log group"
+	case "ExpiredToken", "ExpiredTokenException", "RequestExpired", "InvalidClientTokenId", "UnrecognizedClientException":
+		return "The AWS credentials are invalid or expired: refresh them (e.g. aws sso login) and rerun"
+	case "NoSuchBucket":
+		return "The log bucket does not exist: check the destination ARN in waf-config.json"
+	case "ResourceNotFoundException":
+		return "The log group does not exist in this region: check the region and log group name"
+	case "LimitExceededException":
+		return "Too many concurrent CloudWatch Logs Insights queries: lower max_concurrent_queries"
+	case "Throttling", "ThrottlingException", "SlowDown", "TooManyRequestsException":
+		return "Requests are being throttled: lower max_concurrent_downloads and rerun"
+	}
+	return ""
+}
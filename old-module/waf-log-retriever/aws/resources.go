@@ -0,0 +1,93 @@
+package aws
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/cloudfront"
+	"github.com/aws/aws-sdk-go-v2/service/wafv2"
+	wafTypes "github.com/aws/aws-sdk-go-v2/service/wafv2/types"
+
+	"waf-log-retriever/logging"
+)
+
+// ResourceTypeCloudFront identifies CloudFront distributions, which are associated
+// through CloudFront rather than through WAF's ListResourcesForWebACL.
+const ResourceTypeCloudFront = "CLOUDFRONT_DISTRIBUTION"
+
+// regionalResourceTypes lists every resource type a Regional Web ACL can protect
+var regionalResourceTypes = []wafTypes.ResourceType{
+	wafTypes.ResourceTypeApplicationLoadBalancer,
+	wafTypes.ResourceTypeApiGateway,
+	wafTypes.ResourceTypeAppsync,
+	wafTypes.ResourceTypeCognitioUserPool,
+	wafTypes.ResourceTypeAppRunnerService,
+	wafTypes.ResourceTypeVerifiedAccessInstance,
+}
+
+// AssociatedResource is an AWS resource protected by a Web ACL
+type AssociatedResource struct {
+	ResourceType string `json:"resourceType"`
+	ARN          string `json:"arn"`
+}
+
+// ListAssociatedResources returns every resource the source's Web ACL is associated with.
+// Resource types the region does not support are skipped. Other resource types that
+// cannot be listed, e.g. for a missing permission, do not hide the others: their
+// resources are returned with an error naming the types that failed, as the list is
+// then incomplete.
+func ListAssociatedResources(wafv2Mgr *WAFv2Manager, source *WAFLogSource, webACLArn string, logger logging.Logger) ([]AssociatedResource, error) {
+	if webACLArn == "" {
+		return nil, fmt.Errorf("Web ACL ARN cannot be empty")
+	}
+
+	if source.Scope == string(wafTypes.ScopeCloudfront) {
+		return listCloudFrontDistributions(wafv2Mgr, source, webACLArn, logger)
+	}
+
+	ctx := context.TODO()
+	client := wafv2.NewFromConfig(wafv2Mgr.Session)
+
+	resources := []AssociatedResource{}
+	var failures []error
+	for _, resourceType := range regionalResourceTypes {
+		result, err := client.ListResourcesForWebACL(ctx, &wafv2.ListResourcesForWebACLInput{
+			WebACLArn:    aws.String(webACLArn),
+			ResourceType: resourceType,
+		})
+		if err != nil {
+			var invalidParam *wafTypes.WAFInvalidParameterException
+			if errors.As(err, &invalidParam) {
+				logger.Debugf("Resource type %s is not supported for %s: %v", resourceType, source.WebACLName, err)
+			} else {
+				failures = append(failures, fmt.Errorf("failed to list %s resources: %w", resourceType, err))
+			}
+			continue
+		}
+
+		for _, arn := range result.ResourceArns {
+			resources = append(resources, AssociatedResource{ResourceType: string(resourceType), ARN: arn})
+		}
+		logger.Debugf("Found %d %s resources associated with %s", len(result.ResourceArns), resourceType, source.WebACLName)
+	}
+
+	return resources, errors.Join(failures...)
+}
+
+// listCloudFrontDistributions returns the CloudFront distributions using the Web ACL
+func listCloudFrontDistributions(wafv2Mgr *WAFv2Manager, source *WAFLogSource, webACLArn string, logger logging.Logger) ([]AssociatedResource, error) {
+	distributions, err := cloudFrontDistributions(context.TODO(), cloudfront.NewFromConfig(wafv2Mgr.Session), webACLArn)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list CloudFront distributions for %s: %w", source.WebACLName, err)
+	}
+
+	resources := []AssociatedResource{}
+	for _, dist := range distributions {
+		resources = append(resources, AssociatedResource{ResourceType: ResourceTypeCloudFront, ARN: aws.ToString(dist.ARN)})
+	}
+
+	logger.Debugf("Found %d CloudFront distributions associated with %s", len(resources), source.WebACLName)
+	return resources, nil
+}
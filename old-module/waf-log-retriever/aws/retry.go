@@ -0,0 +1,189 @@
+package aws
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/service/cloudwatchlogs"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+
+	"waf-log-retriever/config"
+	"waf-log-retriever/logging"
+)
+
+// RetryPolicy retries an operation with exponential backoff
+type RetryPolicy struct {
+	Attempts  int           // Total attempts, including the first
+	BaseDelay time.Duration // Delay before the second attempt; doubled for every further attempt
+	MaxDelay  time.Duration // Cap on a single delay
+}
+
+// NewRetryPolicy builds a retry policy from the log retrieval configuration
+func NewRetryPolicy(cfg config.LogRetrievalConfig) RetryPolicy {
+	policy := RetryPolicy{
+		Attempts:  cfg.RetryAttempts,
+		BaseDelay: time.Duration(cfg.RetryDelaySeconds) * time.Second,
+		MaxDelay:  time.Duration(cfg.MaxRetryDelaySeconds) * time.Second,
+	}
+	if policy.Attempts <= 0 {
+		policy.Attempts = 3
+	}
+	if policy.BaseDelay <= 0 {
+		policy.BaseDelay = 5 * time.Second
+	}
+	if policy.MaxDelay <= 0 {
+		policy.MaxDelay = time.Minute
+	}
+	return policy
+}
+
+// Delay returns the wait before the given retry (1 for the first retry)
+func (p RetryPolicy) Delay(retry int) time.Duration {
+	delay := p.BaseDelay
+	for i := 1; i < retry && delay < p.MaxDelay; i++ {
+		delay *= 2
+	}
+	if delay > p.MaxDelay {
+		delay = p.MaxDelay
+	}
+	return delay
+}
+
+// Do calls fn until it succeeds or the attempts are exhausted, returning the last error
+func (p RetryPolicy) Do(ctx context.Context, name string, logger logging.Logger, fn func() error) error {
+	var err error
+	for attempt := 1; attempt <= p.Attempts; attempt++ {
+		if err = fn(); err == nil {
+			return nil
+		}
+		if attempt == p.Attempts {
+			break
+		}
+
+		delay := p.Delay(attempt)
+		logger.Warningf("Attempt %d/%d for %s failed: %v (retrying in %s)", attempt, p.Attempts, name, err, delay)
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	return err
+}
+
+// RetryFailedItems retries only the failed objects or time chunks of a previous
+// run's source report and returns the report of the retry
+func RetryFailedItems(previous SourceReport, s3Mgr *S3Manager, cwLogsMgr *CWLogsManager, policy RetryPolicy, logger logging.Logger) SourceReport {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Minute)
+	defer cancel()
+
+	source := previous.Source
+	result := &RetrievalResult{Found: len(previous.FailedItems)}
+
+	var retrieveItem func(key string) error
+	switch source.LogSourceType {
+	case "s3", "firehose":
+		s3Client := s3.NewFromConfig(sourceSession(s3Mgr.Session, source))
+		retrieveItem = func(key string) error {
+			timestamp, _, err := extractTimestampFromKey(s3Mgr.keyPatterns(), key)
+			if err != nil {
+				return err
+			}
+			outPath := s3Mgr.Storage.GetLogFilePath(source.ProfileName, source.DirName(), timestamp, localLogName(source, key))
+			if err := os.MkdirAll(filepath.Dir(outPath), 0755); err != nil {
+				return fmt.Errorf("failed to create output directory: %w", err)
+			}
+			return downloadS3Object(ctx, s3Client, source.S3BucketName, key, outPath, io.Discard)
+		}
+	case "cloudwatchlogs":
+		cwlogsClient := cloudwatchlogs.NewFromConfig(sourceSession(cwLogsMgr.Session, source))
+		retrieveItem = func(key string) error {
+			chunkStart, chunkEnd, err := ParseChunkKey(key)
+			if err != nil {
+				return err
+			}
+			records, err := retrieveCWLogsChunk(ctx, cwLogsMgr, cwlogsClient, source, chunkStart, chunkEnd, logger)
+			if err == nil {
+				result.Records += records
+			}
+			return err
+		}
+	default:
+		return NewSourceReport(source, nil, fmt.Errorf("unsupported log source type: %s", source.LogSourceType))
+	}
+
+	for _, item := range previous.FailedItems {
+		logger.Infof("Retrying %s for %s", item.Key, source.WebACLName)
+		if err := policy.Do(ctx, item.Key, logger, func() error { return retrieveItem(item.Key) }); err != nil {
+			logger.Errorf("Giving up on %s: %v", item.Key, err)
+			result.addFailure(item.Key, err)
+			continue
+		}
+		result.Retrieved++
+	}
+
+	return NewSourceReport(source, result, nil)
+}
+
+// RetryFailedSources retries the failed items of every source in a previous run report.
+// Sources that failed before any item could be listed are not retried, since they have
+// no recorded items; rerun the retrieval for those.
+func RetryFailedSources(previous *RunReport, s3Mgr *S3Manager, cwLogsMgr *CWLogsManager, policy RetryPolicy, logger logging.Logger) *RunReport {
+	report := &RunReport{
+		StartedAt:  time.Now().UTC(),
+		RangeStart: previous.RangeStart,
+		RangeEnd:   previous.RangeEnd,
+	}
+
+	for _, source := range previous.Sources {
+		if len(source.FailedItems) == 0 {
+			if source.Status == StatusFailed {
+				logger.Warningf("Skipping %s: no failed items were recorded (%s); rerun the retrieval for this source", source.Source.WebACLName, source.Error)
+			}
+			continue
+		}
+		logger.Infof("Retrying %d failed items for %s", len(source.FailedItems), source.Source.WebACLName)
+		report.Sources = append(report.Sources, RetryFailedItems(source, s3Mgr, cwLogsMgr, policy, logger))
+	}
+
+	report.FinishedAt = time.Now().UTC()
+	report.sortSources()
+	return report
+}
+
+// LatestRunReportPath returns the most recent retrieval report in dir, or "" if there is none
+func LatestRunReportPath(dir string) (string, error) {
+	matches, err := filepath.Glob(filepath.Join(dir, "retrieval_report_*.json"))
+	if err != nil {
+		return "", fmt.Errorf("failed to list retrieval reports: %w", err)
+	}
+	if len(matches) == 0 {
+		return "", nil
+	}
+	sort.Strings(matches) // File names embed a sortable timestamp
+	return matches[len(matches)-1], nil
+}
+
+// LoadRunReport reads a retrieval report written by WriteJSON
+func LoadRunReport(path string) (*RunReport, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read retrieval report: %w", err)
+	}
+	var report RunReport
+	if err := json.Unmarshal(data, &report); err != nil {
+		return nil, fmt.Errorf("failed to parse retrieval report %s: %w", path, err)
+	}
+	for _, source := range report.Sources {
+		if source.Source == nil {
+			return nil, fmt.Errorf("retrieval report %s has a source entry without source details", path)
+		}
+	}
+	return &report, nil
+}
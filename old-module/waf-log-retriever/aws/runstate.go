@@ -0,0 +1,60 @@
+package aws
+
+import (
+	"time"
+
+	"waf-log-retriever/logging"
+	"waf-log-retriever/storage"
+)
+
+// SinceLastRun returns the start of a retrieval of a source that fetches only the
+// logs newer than the last run's: the time of the latest S3 object, or the end of the
+// last CloudWatch Logs chunk, that run retrieved. The S3 objects of that time are
+// listed again, as S3 may deliver more of them late; they are written over in place.
+// Without a recorded run it returns start.
+func SinceLastRun(store *storage.StorageManager, source *WAFLogSource, start time.Time, logger logging.Logger) time.Time {
+	state, err := storage.LoadRunState(store.WebACLDir(source.ProfileName, source.DirName()))
+	if err != nil {
+		logger.Warningf("Ignoring the run state of %s, retrieving from %s: %v", source.WebACLName, start.Format(time.RFC3339), err)
+		return start
+	}
+	if state == nil || state.LastTimestamp.IsZero() {
+		logger.Infof("No earlier run recorded for %s; retrieving from %s", source.WebACLName, start.Format(time.RFC3339))
+		return start
+	}
+	logger.Infof("Retrieving %s since the last run, from %s", source.WebACLName, state.LastTimestamp.Format(time.RFC3339))
+	return state.LastTimestamp
+}
+
+// RecordRunState records how far a retrieval of a source got, for SinceLastRun. Only
+// a retrieval without failures is recorded, so after one with failures, the next
+// run since the last fetches the failed logs again. The recorded time never moves
+// back, e.g. when an older time range is retrieved later. A failure is only logged,
+// like one to record a download.
+func RecordRunState(store *storage.StorageManager, source *WAFLogSource, result *RetrievalResult, startTime, endTime time.Time, logger logging.Logger) {
+	if result == nil || len(result.Failed) > 0 {
+		return
+	}
+	aclDir := store.WebACLDir(source.ProfileName, source.DirName())
+	previous, err := storage.LoadRunState(aclDir)
+	if err != nil {
+		logger.Warningf("Replacing the run state of %s: %v", source.WebACLName, err)
+	}
+	state := &storage.RunState{
+		LastTimestamp: result.LastTimestamp,
+		LastKey:       result.LastKey,
+		RangeStart:    startTime.UTC(),
+		RangeEnd:      endTime.UTC(),
+		At:            time.Now().UTC(),
+	}
+	if previous != nil && !previous.LastTimestamp.Before(state.LastTimestamp) {
+		state.LastTimestamp, state.LastKey = previous.LastTimestamp, previous.LastKey
+	}
+	if state.LastTimestamp.IsZero() {
+		// Nothing found, and no earlier run: the next starts where this one did
+		state.LastTimestamp = startTime.UTC()
+	}
+	if err := state.Save(aclDir); err != nil {
+		logger.Warningf("Failed to record the run state of %s: %v", source.WebACLName, err)
+	}
+}
@@ -0,0 +1,248 @@
+package aws
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	awsconfig "github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/credentials/ssocreds"
+	"github.com/aws/aws-sdk-go-v2/service/ssooidc"
+	oidcTypes "github.com/aws/aws-sdk-go-v2/service/ssooidc/types"
+	"github.com/aws/smithy-go"
+	"golang.org/x/term"
+
+	"waf-log-retriever/logging"
+	"waf-log-retriever/storage"
+)
+
+// ssoClientName names the tool's OIDC client registrations in IAM Identity Center
+const ssoClientName = "waf-log-retriever"
+
+// deviceCodeGrant is the OAuth grant type of the device authorization flow
+const deviceCodeGrant = "urn:ietf:params:oauth:grant-type:device_code"
+
+// ssoProfile is the IAM Identity Center (SSO) configuration of a shared config profile
+type ssoProfile struct {
+	Session  string // sso-session the profile refers to; empty for a legacy SSO profile
+	StartURL string
+	Region   string
+}
+
+// cacheKey names the cached token of the profile, as `aws sso login` does: the
+// sso-session name, or the start URL of a legacy profile
+func (p *ssoProfile) cacheKey() string {
+	if p.Session != "" {
+		return p.Session
+	}
+	return p.StartURL
+}
+
+// findSSOProfile returns the SSO configuration of the profile a session was loaded
+// from, or of the profile it takes its source credentials from, or nil if its
+// credentials do not come from IAM Identity Center
+func findSSOProfile(session aws.Config) *ssoProfile {
+	for _, source := range session.ConfigSources {
+		shared, ok := source.(awsconfig.SharedConfig)
+		if !ok {
+			continue
+		}
+		for profile := &shared; profile != nil; profile = profile.Source {
+			if s := profile.SSOSession; s != nil {
+				return &ssoProfile{Session: s.Name, StartURL: s.SSOStartURL, Region: s.SSORegion}
+			}
+			if profile.SSOStartURL != "" {
+				return &ssoProfile{StartURL: profile.SSOStartURL, Region: profile.SSORegion}
+			}
+		}
+	}
+	return nil
+}
+
+// ssoLoginNeeded reports whether a credential validation error means the SSO token
+// is missing, expired or revoked, so logging in again fixes it
+func ssoLoginNeeded(err error) bool {
+	if err == nil {
+		return false
+	}
+	var invalidToken *ssocreds.InvalidTokenError
+	if errors.As(err, &invalidToken) {
+		return true
+	}
+	var apiErr smithy.APIError
+	if errors.As(err, &apiErr) {
+		switch apiErr.ErrorCode() {
+		case "UnauthorizedException", "ExpiredTokenException", "InvalidGrantException":
+			return true
+		}
+	}
+	// The token provider of sso-session profiles does not type its errors, so they are
+	// recognized by their exact text, anywhere in the chain of wrapped errors
+	return anyWrapped(err, func(e error) bool {
+		msg := e.Error()
+		return msg == ssoTokenExpired ||
+			strings.HasPrefix(msg, ssoTokenUnreadable) && errors.Is(e, fs.ErrNotExist)
+	})
+}
+
+// The errors of the SDK's SSO token provider when the cached token has expired and
+// cannot be refreshed, and when there is none
+const (
+	ssoTokenExpired    = "cached SSO token is expired, or not present, and cannot be refreshed"
+	ssoTokenUnreadable = "failed to read cached SSO token file, "
+)
+
+// anyWrapped reports whether match holds for err or any error it wraps
+func anyWrapped(err error, match func(error) bool) bool {
+	if err == nil {
+		return false
+	}
+	if match(err) {
+		return true
+	}
+	switch e := err.(type) {
+	case interface{ Unwrap() error }:
+		return anyWrapped(e.Unwrap(), match)
+	case interface{ Unwrap() []error }:
+		for _, wrapped := range e.Unwrap() {
+			if anyWrapped(wrapped, match) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// ssoLogin logs in to IAM Identity Center with the OAuth device authorization flow,
+// as `aws sso login` does, and caches the token where the SDK and the AWS CLI read
+// it. The user confirms a code in the browser, so without a terminal to show it on,
+// e.g. in a cron job, it returns an error telling to log in first instead.
+func ssoLogin(ctx context.Context, session aws.Config, sso *ssoProfile, profileName string, logger logging.Logger) error {
+	if !term.IsTerminal(int(os.Stdin.Fd())) {
+		return fmt.Errorf("the SSO session of profile %s has expired or is invalid: run `aws sso login --profile %s` and retry", profileName, profileName)
+	}
+
+	client := ssooidc.NewFromConfig(session, func(o *ssooidc.Options) {
+		o.Region = sso.Region
+	})
+	registerInput := &ssooidc.RegisterClientInput{
+		ClientName: aws.String(ssoClientName),
+		ClientType: aws.String("public"),
+	}
+	if sso.Session != "" {
+		// Tokens of sso-session profiles carry a refresh token the SDK renews them with
+		registerInput.Scopes = []string{"sso:account:access"}
+	}
+	registration, err := client.RegisterClient(ctx, registerInput)
+	if err != nil {
+		return fmt.Errorf("failed to register with IAM Identity Center: %w", err)
+	}
+	authorization, err := client.StartDeviceAuthorization(ctx, &ssooidc.StartDeviceAuthorizationInput{
+		ClientId:     registration.ClientId,
+		ClientSecret: registration.ClientSecret,
+		StartUrl:     aws.String(sso.StartURL),
+	})
+	if err != nil {
+		return fmt.Errorf("failed to start the SSO login: %w", err)
+	}
+
+	fmt.Printf("\nThe SSO session of profile %s has expired. To log in again, open\n\n    %s\n\nand confirm the code %s.\n\n",
+		profileName, aws.ToString(authorization.VerificationUriComplete), aws.ToString(authorization.UserCode))
+	logger.Info("Waiting for the SSO login to be confirmed in the browser...")
+
+	interval := time.Duration(max(authorization.Interval, 1)) * time.Second
+	deadline := time.Now().Add(time.Duration(authorization.ExpiresIn) * time.Second)
+	for {
+		time.Sleep(interval)
+		if time.Now().After(deadline) {
+			return errors.New("the SSO login was not confirmed in time")
+		}
+		token, err := client.CreateToken(ctx, &ssooidc.CreateTokenInput{
+			ClientId:     registration.ClientId,
+			ClientSecret: registration.ClientSecret,
+			GrantType:    aws.String(deviceCodeGrant),
+			DeviceCode:   authorization.DeviceCode,
+		})
+		var pending *oidcTypes.AuthorizationPendingException
+		var slowDown *oidcTypes.SlowDownException
+		switch {
+		case errors.As(err, &pending):
+			continue
+		case errors.As(err, &slowDown):
+			interval += 5 * time.Second
+			continue
+		case err != nil:
+			return fmt.Errorf("the SSO login failed: %w", err)
+		}
+
+		if err := storeSSOToken(sso, registration, token); err != nil {
+			return err
+		}
+		logger.Infof("Logged in to IAM Identity Center at %s", sso.StartURL)
+		return nil
+	}
+}
+
+// ssoCachedToken is the format of the SSO token cache shared with the AWS CLI
+type ssoCachedToken struct {
+	StartURL              string `json:"startUrl"`
+	Region                string `json:"region"`
+	AccessToken           string `json:"accessToken"`
+	ExpiresAt             string `json:"expiresAt"`
+	ClientID              string `json:"clientId,omitempty"`
+	ClientSecret          string `json:"clientSecret,omitempty"`
+	RegistrationExpiresAt string `json:"registrationExpiresAt,omitempty"`
+	RefreshToken          string `json:"refreshToken,omitempty"`
+}
+
+// storeSSOToken caches a token of a profile under ~/.aws/sso/cache, readable by the
+// user only. Tokens of sso-session profiles keep the client registration, which
+// refreshing them needs.
+func storeSSOToken(sso *ssoProfile, registration *ssooidc.RegisterClientOutput, token *ssooidc.CreateTokenOutput) error {
+	path, err := ssocreds.StandardCachedTokenFilepath(sso.cacheKey())
+	if err != nil {
+		return fmt.Errorf("failed to locate the SSO token cache: %w", err)
+	}
+	cached := ssoCachedToken{
+		StartURL:    sso.StartURL,
+		Region:      sso.Region,
+		AccessToken: aws.ToString(token.AccessToken),
+		ExpiresAt:   time.Now().Add(time.Duration(token.ExpiresIn) * time.Second).UTC().Format(time.RFC3339),
+	}
+	if sso.Session != "" {
+		cached.ClientID = aws.ToString(registration.ClientId)
+		cached.ClientSecret = aws.ToString(registration.ClientSecret)
+		cached.RegistrationExpiresAt = time.Unix(registration.ClientSecretExpiresAt, 0).UTC().Format(time.RFC3339)
+		cached.RefreshToken = aws.ToString(token.RefreshToken)
+	}
+	data, err := json.Marshal(cached)
+	if err != nil {
+		return fmt.Errorf("failed to encode the SSO token: %w", err)
+	}
+
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return fmt.Errorf("failed to create the SSO token cache: %w", err)
+	}
+	f, err := storage.CreateAtomic(path)
+	if err != nil {
+		return fmt.Errorf("failed to cache the SSO token: %w", err)
+	}
+	defer f.Abort()
+	if err := f.Chmod(0600); err != nil {
+		return fmt.Errorf("failed to cache the SSO token: %w", err)
+	}
+	if _, err := f.Write(data); err != nil {
+		return fmt.Errorf("failed to cache the SSO token: %w", err)
+	}
+	if err := f.Commit(); err != nil {
+		return fmt.Errorf("failed to cache the SSO token: %w", err)
+	}
+	return nil
+}
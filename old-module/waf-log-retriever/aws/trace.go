@@ -0,0 +1,111 @@
+package aws
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	awsmiddleware "github.com/aws/aws-sdk-go-v2/aws/middleware"
+	"github.com/aws/aws-sdk-go-v2/aws/retry"
+	awsconfig "github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/smithy-go/middleware"
+)
+
+// APITraceEntry is one traced AWS API call. Request parameters and credentials are
+// never recorded.
+type APITraceEntry struct {
+	Time       time.Time `json:"time"`
+	Service    string    `json:"service"`
+	Operation  string    `json:"operation"`
+	Region     string    `json:"region,omitempty"`
+	DurationMs int64     `json:"durationMs"`
+	RequestID  string    `json:"requestId,omitempty"`
+	Retries    int       `json:"retries"`
+	Error      string    `json:"error,omitempty"`
+}
+
+// APITracer records every AWS API call as a JSON line in a trace file
+type APITracer struct {
+	mu  sync.Mutex
+	out io.WriteCloser
+	enc *json.Encoder
+}
+
+// NewAPITracer creates a tracer writing to out, which it closes on Close
+func NewAPITracer(out io.WriteCloser) *APITracer {
+	return &APITracer{out: out, enc: json.NewEncoder(out)}
+}
+
+// ConfigOption returns an AWS config load option that installs the tracer on every client
+func (t *APITracer) ConfigOption() func(*awsconfig.LoadOptions) error {
+	return awsconfig.WithAPIOptions([]func(*middleware.Stack) error{
+		func(stack *middleware.Stack) error {
+			// After the service metadata is registered, around the retry loop
+			return stack.Initialize.Add(t, middleware.After)
+		},
+	})
+}
+
+// Close closes the trace file
+func (t *APITracer) Close() error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.out.Close()
+}
+
+// ID implements middleware.InitializeMiddleware
+func (t *APITracer) ID() string {
+	return "WAFLogRetrieverAPITracer"
+}
+
+// HandleInitialize implements middleware.InitializeMiddleware
+func (t *APITracer) HandleInitialize(ctx context.Context, in middleware.InitializeInput, next middleware.InitializeHandler) (
+	out middleware.InitializeOutput, metadata middleware.Metadata, err error,
+) {
+	start := time.Now()
+	out, metadata, err = next.HandleInitialize(ctx, in)
+
+	entry := APITraceEntry{
+		Time:       start.UTC(),
+		Service:    awsmiddleware.GetServiceID(ctx),
+		Operation:  awsmiddleware.GetOperationName(ctx),
+		Region:     awsmiddleware.GetRegion(ctx),
+		DurationMs: time.Since(start).Milliseconds(),
+	}
+	entry.RequestID, _ = awsmiddleware.GetRequestIDMetadata(metadata)
+	if attempts, ok := retry.GetAttemptResults(metadata); ok && len(attempts.Results) > 0 {
+		entry.Retries = len(attempts.Results) - 1
+	}
+	if err != nil {
+		entry.Error = sanitizeTraceMessage(err.Error())
+	}
+
+	t.mu.Lock()
+	_ = t.enc.Encode(entry) // Tracing must never fail the call itself
+	t.mu.Unlock()
+
+	return out, metadata, err
+}
+
+// credentialPatterns match credential material that may appear in error messages
+var credentialPatterns = []*regexp.Regexp{
+	regexp.MustCompile(`\b(AKIA|ASIA)[A-Z0-9]{16}\b`),                              // Access key IDs
+	regexp.MustCompile(`(?i)(Signature|Credential|X-Amz-Security-Token)=[^&\s,]+`), // Signed URL / header parts
+}
+
+// sanitizeTraceMessage redacts credentials from a message
+func sanitizeTraceMessage(msg string) string {
+	for _, pattern := range credentialPatterns {
+		msg = pattern.ReplaceAllStringFunc(msg, func(match string) string {
+			if i := strings.IndexByte(match, '='); i >= 0 {
+				return match[:i+1] + "REDACTED"
+			}
+			return "REDACTED"
+		})
+	}
+	return msg
+}
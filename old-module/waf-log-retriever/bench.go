@@ -0,0 +1,150 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime"
+	"text/tabwriter"
+	"time"
+
+	"waf-log-retriever/analysis"
+	"waf-log-retriever/logging"
+)
+
+// benchPhase is the measurement of one benchmarked phase
+type benchPhase struct {
+	name     string
+	duration time.Duration
+	records  int64
+	bytes    int64 // Bytes on disk read or written, if the phase does I/O
+}
+
+// runBench generates synthetic WAF logs and measures how fast this machine parses
+// and analyzes them, to size review hardware for an engagement
+func runBench(args []string) int {
+	fs := flag.NewFlagSet("bench", flag.ExitOnError)
+	records := fs.Int("records", 200000, "Number of synthetic records to generate")
+	clientIPs := fs.Int("client-ips", 5000, "Distinct client IPs")
+	uris := fs.Int("uris", 2000, "Distinct URIs")
+	hosts := fs.Int("hosts", 3, "Distinct Host headers")
+	attackShare := fs.Float64("attack-share", 0.05, "Share of requests that are attacks or scanner probes")
+	hours := fs.Int("hours", 24, "Hours the records are spread over, one log file per hour")
+	seed := fs.Int64("seed", 1, "Seed of the generated logs")
+	dir := fs.String("dir", "", "Directory to generate the logs in (default: a temporary directory)")
+	keep := fs.Bool("keep", false, "Keep the generated logs instead of removing them")
+	settingsFile := fs.String("settings", "", "JSON file tuning the built-in detectors (optional)")
+	gzipBlocks := fs.Int("gzip-blocks", analysis.DefaultGzipBlocks(), "Blocks of 1 MB of a gzipped log file to decompress ahead of parsing")
+	logLevel := fs.String("log-level", "WARNING", "Logging level (DEBUG, INFO, WARNING, ERROR)")
+	fs.Parse(args)
+
+	if *records <= 0 || *hours <= 0 || *gzipBlocks < analysis.MinGzipBlocks || *attackShare < 0 || *attackShare > 1 {
+		fmt.Printf("bench requires positive -records and -hours, -gzip-blocks of at least %d, and -attack-share between 0 and 1\n", analysis.MinGzipBlocks)
+		fs.Usage()
+		return 2
+	}
+	analysis.SetGzipConcurrency(*gzipBlocks)
+
+	logger, err := logging.SetupLogger(*logLevel)
+	if err != nil {
+		fmt.Printf("Failed to initialize application: %v\n", err)
+		return 1
+	}
+	defer logger.Close()
+
+	settings, err := analysis.LoadSettings(*settingsFile)
+	if err != nil {
+		logger.Errorf("%v", err)
+		return 1
+	}
+
+	root := *dir
+	if root == "" {
+		if root, err = os.MkdirTemp("", "waf-bench-"); err != nil {
+			logger.Errorf("Failed to create benchmark directory: %v", err)
+			return 1
+		}
+	}
+	if !*keep {
+		defer os.RemoveAll(root)
+	}
+	aclDir := filepath.Join(root, "bench", "synthetic")
+
+	fmt.Printf("Benchmarking %d records, %d client IPs, %d URIs, %d hosts over %d hours\n",
+		*records, *clientIPs, *uris, *hosts, *hours)
+	fmt.Printf("Machine: %s/%s, %d CPUs, GOMAXPROCS %d, %s, tool version %s, %d gzip blocks\n\n",
+		runtime.GOOS, runtime.GOARCH, runtime.NumCPU(), runtime.GOMAXPROCS(0), runtime.Version(), toolVersion(), *gzipBlocks)
+
+	var phases []benchPhase
+	start := time.Now()
+	files, size, err := analysis.WriteSyntheticLogs(aclDir, analysis.SyntheticOptions{
+		Records:     *records,
+		ClientIPs:   *clientIPs,
+		URIs:        *uris,
+		Hosts:       *hosts,
+		AttackShare: *attackShare,
+		Duration:    time.Duration(*hours) * time.Hour,
+		Seed:        *seed,
+	})
+	if err != nil {
+		logger.Errorf("%v", err)
+		return 1
+	}
+	phases = append(phases, benchPhase{name: "generate", duration: time.Since(start), records: int64(*records), bytes: size})
+
+	start = time.Now()
+	var parsed int64
+	for _, file := range files {
+		if err := analysis.ForEachRecord(file, func(*analysis.Record) error {
+			parsed++
+			return nil
+		}); err != nil {
+			logger.Errorf("%v", err)
+			return 1
+		}
+	}
+	phases = append(phases, benchPhase{name: "parse", duration: time.Since(start), records: parsed, bytes: size})
+
+	start = time.Now()
+	stats, fileCount, err := analysis.AnalyzeDirectory(aclDir, settings, nil, logger)
+	if err != nil {
+		logger.Errorf("Failed to aggregate logs: %v", err)
+		return 1
+	}
+	phases = append(phases, benchPhase{name: "parse+aggregate", duration: time.Since(start), records: stats.TotalRequests, bytes: size})
+	var mem runtime.MemStats
+	runtime.ReadMemStats(&mem)
+
+	start = time.Now()
+	result, err := analyzeStats("bench", "synthetic", aclDir, "", stats, settings, fileCount, logger)
+	if err != nil {
+		logger.Errorf("Analysis failed: %v", err)
+		return 1
+	}
+	phases = append(phases, benchPhase{name: "detect", duration: time.Since(start), records: stats.TotalRequests})
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', tabwriter.AlignRight)
+	fmt.Fprintln(w, "PHASE\tDURATION\tRECORDS/S\tMB/S (GZIP)\t")
+	for _, p := range phases {
+		seconds := p.duration.Seconds()
+		throughput := "-"
+		if p.bytes > 0 {
+			throughput = fmt.Sprintf("%.1f", float64(p.bytes)/1e6/seconds)
+		}
+		fmt.Fprintf(w, "%s\t%s\t%.0f\t%s\t\n", p.name, p.duration.Round(time.Millisecond), float64(p.records)/seconds, throughput)
+	}
+	w.Flush()
+
+	analyze := phases[2].duration + phases[3].duration
+	perRecord := analyze.Seconds() / float64(stats.TotalRequests)
+	fmt.Printf("\n%d log files, %.1f MB gzipped (%.0f bytes per record), %d findings, %.0f MB heap after aggregation\n",
+		len(files), float64(size)/1e6, float64(size)/float64(*records), len(result.Findings), float64(mem.HeapSys)/1e6)
+	// Synthetic logs repeat themselves and compress far better than real ones, so
+	// hardware is sized by records rather than bytes
+	fmt.Printf("Analysis throughput: %.0f records/s, about %.1f million records per hour\n", 1/perRecord, 3600/perRecord/1e6)
+	if *keep {
+		fmt.Printf("Logs kept in %s\n", aclDir)
+	}
+	return 0
+}
@@ -0,0 +1,183 @@
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"waf-log-retriever/analysis"
+	"waf-log-retriever/workspace"
+)
+
+// runBlocklist exports the client IPs confirmed as malicious in a Web ACL's review
+// as a blocklist for firewalls and other WAFs
+func runBlocklist(args []string) int {
+	fs := flag.NewFlagSet("blocklist", flag.ExitOnError)
+	outputDir := fs.String("output-dir", "../logs/raw", "Directory containing retrieved logs")
+	profile := fs.String("profile", "", "AWS profile name the logs were retrieved with")
+	webACL := fs.String("web-acl", "", "Name of the Web ACL whose IPs to export")
+	resultFile := fs.String("result", "", "Analysis result to take blocked IPs from (default: the latest for the Web ACL)")
+	format := fs.String("format", "cidr", "Output format: "+strings.Join(analysis.BlocklistFormats, ", "))
+	sources := fs.String("source", "blocked,annotated", "Comma-separated IPs to include: blocked (IPs WAF blocked), annotated (IPs annotated true-positive)")
+	minBlocked := fs.Int64("min-blocked", 10, "Blocked requests an IP needs to be included as a blocked IP")
+	includePrivate := fs.Bool("include-private", false, "Include private, loopback and link-local addresses")
+	collapse := fs.Bool("collapse", true, "Merge adjacent addresses into CIDR blocks")
+	name := fs.String("name", "waf_blocked", "Name of the table, chain, set or IP set")
+	scope := fs.String("scope", "REGIONAL", "Scope of the AWS WAF IP set: REGIONAL or CLOUDFRONT")
+	out := fs.String("out", "", "File to write the blocklist to (default: standard output)")
+	fs.Parse(args)
+
+	if *profile == "" || *webACL == "" {
+		fmt.Println("blocklist requires -profile and -web-acl")
+		fs.Usage()
+		return 2
+	}
+	useBlocked, useAnnotated := false, false
+	for _, source := range strings.Split(*sources, ",") {
+		switch strings.TrimSpace(source) {
+		case "blocked":
+			useBlocked = true
+		case "annotated":
+			useAnnotated = true
+		default:
+			fmt.Printf("Unknown -source %q (want blocked or annotated)\n", source)
+			return 2
+		}
+	}
+	if *scope != "REGIONAL" && *scope != "CLOUDFRONT" {
+		fmt.Printf("Invalid -scope %q (want REGIONAL or CLOUDFRONT)\n", *scope)
+		return 2
+	}
+
+	aclDir := filepath.Join(*outputDir, *profile, *webACL)
+	ws, err := workspace.Open(aclDir, *profile, *webACL)
+	if err != nil {
+		fmt.Printf("%v\n", err)
+		return 1
+	}
+
+	candidates := make(map[string]*analysis.BlocklistEntry)
+	add := func(key string, blocked int64, reason string) error {
+		p, err := analysis.ParseBlocklistPrefix(key)
+		if err != nil {
+			return err
+		}
+		if !*includePrivate && analysis.IsPrivatePrefix(p) {
+			return nil
+		}
+		e, ok := candidates[p.String()]
+		if !ok {
+			e = &analysis.BlocklistEntry{Prefix: p}
+			candidates[p.String()] = e
+		}
+		e.Blocked += blocked
+		e.Reasons = append(e.Reasons, reason)
+		return nil
+	}
+
+	if useBlocked {
+		resultPath := *resultFile
+		if resultPath == "" {
+			if resultPath, err = analysis.LatestResultPath(aclDir); err != nil {
+				fmt.Printf("%v\n", err)
+				return 1
+			}
+			if resultPath == "" {
+				fmt.Printf("No analysis results found in %s; run analyze first\n", aclDir)
+				return 1
+			}
+		}
+		result, err := analysis.LoadResult(resultPath)
+		if err != nil {
+			fmt.Printf("%v\n", err)
+			return 1
+		}
+		for ip, blocked := range result.Stats.BlockedIPs {
+			if blocked < *minBlocked {
+				continue
+			}
+			if err := add(ip, blocked, "blocked"); err != nil {
+				fmt.Fprintf(os.Stderr, "Skipping client IP: %v\n", err)
+			}
+		}
+	}
+	if useAnnotated {
+		for _, a := range ws.Annotations {
+			if a.Target != workspace.TargetIP || ws.Disposition(workspace.TargetIP, a.Key) != workspace.DispositionTruePositive {
+				continue
+			}
+			if err := add(a.Key, 0, workspace.DispositionTruePositive); err != nil {
+				fmt.Fprintf(os.Stderr, "Skipping annotated IP: %v\n", err)
+			}
+		}
+	}
+
+	// Reviewers' verdicts win over WAF's: never export IPs they cleared
+	cleared := func(key string) bool {
+		switch ws.Disposition(workspace.TargetIP, key) {
+		case workspace.DispositionFalsePositive, workspace.DispositionAcceptedRisk:
+			return true
+		}
+		return false
+	}
+	var entries []analysis.BlocklistEntry
+	excluded := 0
+	for key, e := range candidates {
+		if cleared(key) || (e.Prefix.IsSingleIP() && cleared(e.Prefix.Addr().String())) {
+			excluded++
+			continue
+		}
+		e.Reasons = uniqueStrings(e.Reasons)
+		entries = append(entries, *e)
+	}
+	count := len(entries)
+	if *collapse {
+		entries = analysis.CollapseBlocklist(entries)
+	} else {
+		analysis.SortBlocklist(entries)
+	}
+
+	opts := analysis.BlocklistOptions{
+		Name: *name,
+		Description: fmt.Sprintf("%d IPs confirmed malicious in the review of Web ACL %s (%s), generated %s",
+			count, *webACL, *sources, time.Now().UTC().Format(time.RFC3339)),
+		Scope: *scope,
+	}
+	var buf bytes.Buffer
+	if err := analysis.WriteBlocklist(&buf, *format, entries, opts); err != nil {
+		fmt.Printf("%v\n", err)
+		return 1
+	}
+	summary := fmt.Sprintf("%d IPs in %d entries", count, len(entries))
+	if excluded > 0 {
+		summary += fmt.Sprintf(", %d left out as false positive or accepted risk", excluded)
+	}
+	if *out == "" {
+		os.Stdout.Write(buf.Bytes())
+		fmt.Fprintln(os.Stderr, summary)
+		return 0
+	}
+	if err := os.WriteFile(*out, buf.Bytes(), 0644); err != nil {
+		fmt.Printf("Failed to write blocklist: %v\n", err)
+		return 1
+	}
+	fmt.Printf("Blocklist with %s written to %s\n", summary, *out)
+	return 0
+}
+
+// uniqueStrings returns the values without repetitions, in order
+func uniqueStrings(values []string) []string {
+	var unique []string
+	seen := make(map[string]bool, len(values))
+	for _, v := range values {
+		if !seen[v] {
+			seen[v] = true
+			unique = append(unique, v)
+		}
+	}
+	return unique
+}
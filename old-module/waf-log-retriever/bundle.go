@@ -0,0 +1,223 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"waf-log-retriever/analysis"
+	"waf-log-retriever/aws"
+	"waf-log-retriever/bundle"
+	"waf-log-retriever/logging"
+	"waf-log-retriever/workspace"
+)
+
+// rawManifest is the bundle entry describing the retrieved raw log files
+type rawManifest struct {
+	GeneratedAt time.Time                `json:"generatedAt"`
+	ProfileName string                   `json:"profileName"`
+	WebACLName  string                   `json:"webACLName"`
+	Engagement  *workspace.Engagement    `json:"engagement,omitempty"`
+	SHA256      string                   `json:"sha256"` // See analysis.ManifestHash
+	Files       []analysis.ManifestEntry `json:"files"`
+}
+
+// findingsExport is the bundle entry holding the findings of the latest analysis
+type findingsExport struct {
+	ProfileName string                `json:"profileName"`
+	WebACLName  string                `json:"webACLName"`
+	Engagement  *workspace.Engagement `json:"engagement,omitempty"`
+	Result      string                `json:"result"` // Analysis result the findings are from
+	Findings    []analysis.Finding    `json:"findings"`
+}
+
+// runBundle packages the evidence of one Web ACL into a tar.zst archive
+func runBundle(args []string) int {
+	fs := flag.NewFlagSet("bundle", flag.ExitOnError)
+	outputDir := fs.String("output-dir", "../logs/raw", "Directory containing retrieved logs")
+	profile := fs.String("profile", "", "AWS profile name the logs were retrieved with")
+	webACL := fs.String("web-acl", "", "Name of the Web ACL to bundle")
+	out := fs.String("out", "", "Bundle file to write (default: <output-dir>/bundles/<profile>_<web-acl>_<timestamp>.tar.zst)")
+	signKey := fs.String("sign-key", "", "PEM private key to sign the bundle with (optional)")
+	includeRaw := fs.Bool("include-raw", false, "Include the raw log files, not only their manifest")
+	logLevel := fs.String("log-level", "INFO", "Logging level (DEBUG, INFO, WARNING, ERROR)")
+	fs.Parse(args)
+
+	if *profile == "" || *webACL == "" {
+		fmt.Println("bundle requires -profile and -web-acl")
+		fs.Usage()
+		return 2
+	}
+
+	logger, err := logging.SetupLogger(*logLevel)
+	if err != nil {
+		fmt.Printf("Failed to initialize application: %v\n", err)
+		return 1
+	}
+	defer logger.Close()
+
+	now := time.Now().UTC()
+	aclDir := filepath.Join(*outputDir, *profile, *webACL)
+	entries, err := bundleEntries(*outputDir, aclDir, *profile, *webACL, *includeRaw, now, logger)
+	if err != nil {
+		logger.Errorf("Failed to collect bundle contents: %v", err)
+		return 1
+	}
+
+	archivePath := *out
+	if archivePath == "" {
+		archivePath = filepath.Join(*outputDir, "bundles",
+			fmt.Sprintf("%s_%s_%s%s", *profile, *webACL, now.Format("20060102_150405"), bundle.FileExtension))
+	}
+	if err := os.MkdirAll(filepath.Dir(archivePath), 0755); err != nil {
+		logger.Errorf("Failed to create bundle directory: %v", err)
+		return 1
+	}
+
+	checksums, err := bundle.Write(archivePath, entries)
+	if err != nil {
+		logger.Errorf("Failed to write bundle: %v", err)
+		return 1
+	}
+	archiveHash, err := bundle.HashFile(archivePath)
+	if err != nil {
+		logger.Errorf("Failed to hash bundle: %v", err)
+		return 1
+	}
+	sidecar := fmt.Sprintf("%s  %s\n", archiveHash, filepath.Base(archivePath))
+	if err := os.WriteFile(archivePath+".sha256", []byte(sidecar), 0644); err != nil {
+		logger.Errorf("Failed to write bundle checksum: %v", err)
+		return 1
+	}
+
+	logger.Infof("Bundled %d files into %s", len(checksums), archivePath)
+	logger.Infof("Bundle sha256: %s", archiveHash)
+	if *signKey != "" {
+		if err := signDeliverable(archivePath, *signKey, "", logger); err != nil {
+			logger.Errorf("Failed to sign bundle: %v", err)
+			return 1
+		}
+	}
+	return 0
+}
+
+// bundleEntries collects the raw data manifest, Web ACL snapshots, analysis results,
+// latest findings, the review workspace and the retrieval reports covering the Web ACL.
+// The manifest and the findings carry the engagement metadata of the workspace.
+func bundleEntries(outputDir, aclDir, profile, webACL string, includeRaw bool, now time.Time, logger logging.Logger) ([]bundle.Entry, error) {
+	var engagement *workspace.Engagement
+	if _, err := os.Stat(workspace.Path(aclDir)); err == nil {
+		ws, err := workspace.Open(aclDir, profile, webACL)
+		if err != nil {
+			return nil, err
+		}
+		engagement = ws.Engagement
+	}
+
+	logFiles, err := analysis.ListLogFiles(aclDir)
+	if err != nil {
+		return nil, err
+	}
+	manifest, err := analysis.BuildInputManifest(aclDir, logFiles)
+	if err != nil {
+		return nil, err
+	}
+	manifestData, err := json.MarshalIndent(rawManifest{
+		GeneratedAt: now,
+		ProfileName: profile,
+		WebACLName:  webACL,
+		Engagement:  engagement,
+		SHA256:      analysis.ManifestHash(manifest),
+		Files:       manifest,
+	}, "", "  ")
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode raw data manifest: %w", err)
+	}
+	entries := []bundle.Entry{{Name: "raw-manifest.json", Data: manifestData}}
+	logger.Infof("Raw data manifest lists %d log files", len(manifest))
+
+	if includeRaw {
+		for _, file := range logFiles {
+			rel, err := filepath.Rel(aclDir, file)
+			if err != nil {
+				return nil, fmt.Errorf("failed to resolve log path %s: %w", file, err)
+			}
+			entries = append(entries, bundle.Entry{Name: "raw/" + filepath.ToSlash(rel), Path: file})
+		}
+	}
+
+	snapshots, err := filepath.Glob(filepath.Join(aclDir, analysis.SnapshotDirName, "webacl_*.json"))
+	if err != nil {
+		return nil, fmt.Errorf("failed to list snapshots: %w", err)
+	}
+	for _, snapshot := range snapshots {
+		entries = append(entries, bundle.Entry{Name: "snapshots/" + filepath.Base(snapshot), Path: snapshot})
+	}
+	logger.Infof("Including %d Web ACL snapshots", len(snapshots))
+
+	results, err := filepath.Glob(filepath.Join(aclDir, analysis.OutputDirName, "analysis_*.json"))
+	if err != nil {
+		return nil, fmt.Errorf("failed to list analysis results: %w", err)
+	}
+	sort.Strings(results) // File names embed a sortable timestamp
+	for _, result := range results {
+		entries = append(entries, bundle.Entry{Name: "analysis/" + filepath.Base(result), Path: result})
+	}
+	if len(results) > 0 {
+		findings, err := latestFindings(results[len(results)-1], engagement)
+		if err != nil {
+			return nil, err
+		}
+		entries = append(entries, bundle.Entry{Name: "findings.json", Data: findings})
+	} else {
+		logger.Warning("No analysis results found; run analyze first to include findings")
+	}
+	logger.Infof("Including %d analysis results", len(results))
+
+	if _, err := os.Stat(workspace.Path(aclDir)); err == nil {
+		entries = append(entries, bundle.Entry{Name: workspace.FileName, Path: workspace.Path(aclDir)})
+	}
+
+	reports, err := filepath.Glob(filepath.Join(outputDir, "retrieval_report_*.json"))
+	if err != nil {
+		return nil, fmt.Errorf("failed to list retrieval reports: %w", err)
+	}
+	for _, reportPath := range reports {
+		report, err := aws.LoadRunReport(reportPath)
+		if err != nil {
+			logger.Warningf("Skipping retrieval report: %v", err)
+			continue
+		}
+		for _, source := range report.Sources {
+			if source.Source.ProfileName == profile && source.Source.DirName() == webACL {
+				entries = append(entries, bundle.Entry{Name: "reports/" + filepath.Base(reportPath), Path: reportPath})
+				break
+			}
+		}
+	}
+	return entries, nil
+}
+
+// latestFindings extracts the findings of an analysis result, with the engagement
+// they belong to, as indented JSON
+func latestFindings(resultPath string, engagement *workspace.Engagement) ([]byte, error) {
+	result, err := analysis.LoadResult(resultPath)
+	if err != nil {
+		return nil, err
+	}
+	findings := result.Findings
+	if findings == nil {
+		findings = []analysis.Finding{}
+	}
+	return json.MarshalIndent(findingsExport{
+		ProfileName: result.ProfileName,
+		WebACLName:  result.WebACLName,
+		Engagement:  engagement,
+		Result:      filepath.Base(resultPath),
+		Findings:    findings,
+	}, "", "  ")
+}
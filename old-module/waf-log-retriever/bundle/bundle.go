@@ -0,0 +1,221 @@
+// Package bundle packages engagement evidence into a single tar.zst archive
+package bundle
+
+import (
+	"archive/tar"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// ManifestName is the archive entry listing the SHA-256 checksum of every other entry,
+// in sha256sum format so an extracted bundle can be checked with `sha256sum -c`
+const ManifestName = "MANIFEST.sha256"
+
+// FileExtension is the extension of bundle archives
+const FileExtension = ".tar.zst"
+
+// Entry is a file to add to a bundle, read from Path or, if Path is empty, taken from Data
+type Entry struct {
+	Name string // Slash-separated path inside the archive
+	Path string
+	Data []byte
+}
+
+// Checksum is the SHA-256 checksum of an archive entry
+type Checksum struct {
+	Name   string `json:"name"`
+	Size   int64  `json:"size"`
+	SHA256 string `json:"sha256"`
+}
+
+// Write creates a tar.zst archive at archivePath holding the entries followed by
+// the checksum manifest, and returns the entries' checksums
+func Write(archivePath string, entries []Entry) ([]Checksum, error) {
+	sorted := append([]Entry(nil), entries...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i].Name < sorted[j].Name })
+	for i, entry := range sorted {
+		if entry.Name == ManifestName || (i > 0 && sorted[i-1].Name == entry.Name) {
+			return nil, fmt.Errorf("duplicate bundle entry %s", entry.Name)
+		}
+	}
+
+	file, err := os.Create(archivePath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create bundle: %w", err)
+	}
+	defer file.Close()
+
+	zw, err := zstd.NewWriter(file)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create zstd writer: %w", err)
+	}
+	tw := tar.NewWriter(zw)
+
+	modTime := time.Now().UTC().Truncate(time.Second)
+	checksums := make([]Checksum, 0, len(sorted))
+	for _, entry := range sorted {
+		checksum, err := writeEntry(tw, entry, modTime)
+		if err != nil {
+			return nil, err
+		}
+		checksums = append(checksums, checksum)
+	}
+
+	if _, err := writeEntry(tw, Entry{Name: ManifestName, Data: FormatManifest(checksums)}, modTime); err != nil {
+		return nil, err
+	}
+
+	if err := tw.Close(); err != nil {
+		return nil, fmt.Errorf("failed to finish bundle archive: %w", err)
+	}
+	if err := zw.Close(); err != nil {
+		return nil, fmt.Errorf("failed to finish bundle compression: %w", err)
+	}
+	if err := file.Close(); err != nil {
+		return nil, fmt.Errorf("failed to write bundle: %w", err)
+	}
+	return checksums, nil
+}
+
+// writeEntry adds one file to the archive, hashing it on the way
+func writeEntry(tw *tar.Writer, entry Entry, modTime time.Time) (Checksum, error) {
+	var src io.Reader
+	var size int64
+	if entry.Path != "" {
+		file, err := os.Open(entry.Path)
+		if err != nil {
+			return Checksum{}, fmt.Errorf("failed to open %s: %w", entry.Path, err)
+		}
+		defer file.Close()
+		info, err := file.Stat()
+		if err != nil {
+			return Checksum{}, fmt.Errorf("failed to stat %s: %w", entry.Path, err)
+		}
+		src, size = file, info.Size()
+	} else {
+		src, size = bytes.NewReader(entry.Data), int64(len(entry.Data))
+	}
+
+	header := &tar.Header{
+		Name:    path.Clean(entry.Name),
+		Mode:    0644,
+		Size:    size,
+		ModTime: modTime,
+		Format:  tar.FormatPAX,
+	}
+	if err := tw.WriteHeader(header); err != nil {
+		return Checksum{}, fmt.Errorf("failed to add %s to bundle: %w", entry.Name, err)
+	}
+
+	h := sha256.New()
+	written, err := io.Copy(io.MultiWriter(tw, h), src)
+	if err != nil {
+		return Checksum{}, fmt.Errorf("failed to add %s to bundle: %w", entry.Name, err)
+	}
+	if written != size {
+		return Checksum{}, fmt.Errorf("%s changed while it was being bundled", entry.Name)
+	}
+	return Checksum{Name: header.Name, Size: size, SHA256: hex.EncodeToString(h.Sum(nil))}, nil
+}
+
+// FormatManifest renders checksums in sha256sum format
+func FormatManifest(checksums []Checksum) []byte {
+	var buf bytes.Buffer
+	for _, checksum := range checksums {
+		fmt.Fprintf(&buf, "%s  %s\n", checksum.SHA256, checksum.Name)
+	}
+	return buf.Bytes()
+}
+
+// HashFile returns the hex SHA-256 of a file, e.g. a finished bundle
+func HashFile(filePath string) (string, error) {
+	file, err := os.Open(filePath)
+	if err != nil {
+		return "", fmt.Errorf("failed to open %s: %w", filePath, err)
+	}
+	defer file.Close()
+
+	h := sha256.New()
+	if _, err := io.Copy(h, file); err != nil {
+		return "", fmt.Errorf("failed to hash %s: %w", filePath, err)
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// Verify reads a bundle and checks every entry against the checksum manifest,
+// returning the number of entries checked
+func Verify(archivePath string) (int, error) {
+	file, err := os.Open(archivePath)
+	if err != nil {
+		return 0, fmt.Errorf("failed to open bundle: %w", err)
+	}
+	defer file.Close()
+
+	zr, err := zstd.NewReader(file)
+	if err != nil {
+		return 0, fmt.Errorf("failed to read bundle: %w", err)
+	}
+	defer zr.Close()
+
+	actual := make(map[string]string)
+	var manifest []byte
+	tr := tar.NewReader(zr)
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return 0, fmt.Errorf("failed to read bundle: %w", err)
+		}
+		if header.Name == ManifestName {
+			if manifest, err = io.ReadAll(tr); err != nil {
+				return 0, fmt.Errorf("failed to read bundle manifest: %w", err)
+			}
+			continue
+		}
+		h := sha256.New()
+		if _, err := io.Copy(h, tr); err != nil {
+			return 0, fmt.Errorf("failed to read %s from bundle: %w", header.Name, err)
+		}
+		actual[header.Name] = hex.EncodeToString(h.Sum(nil))
+	}
+	if manifest == nil {
+		return 0, fmt.Errorf("bundle has no %s", ManifestName)
+	}
+
+	expected := make(map[string]string)
+	for _, line := range strings.Split(strings.TrimSpace(string(manifest)), "\n") {
+		sum, name, ok := strings.Cut(line, "  ")
+		if !ok {
+			return 0, fmt.Errorf("malformed %s line %q", ManifestName, line)
+		}
+		expected[name] = sum
+	}
+
+	for name, sum := range expected {
+		got, ok := actual[name]
+		if !ok {
+			return 0, fmt.Errorf("%s is listed in the manifest but missing from the bundle", name)
+		}
+		if got != sum {
+			return 0, fmt.Errorf("%s does not match its manifest checksum", name)
+		}
+	}
+	for name := range actual {
+		if _, ok := expected[name]; !ok {
+			return 0, fmt.Errorf("%s is in the bundle but not in the manifest", name)
+		}
+	}
+	return len(actual), nil
+}
@@ -0,0 +1,268 @@
+// Package checks runs customer-supplied compliance checks written in Starlark.
+//
+// Every *.star file in the checks directory must define a function
+//
+//	def check(acl, stats):
+//	    ...
+//
+// where acl is the Web ACL snapshot (None if no snapshot is available) and stats is
+// the aggregate statistics of the analyzed logs. The function returns None, a single
+// finding, or a list of findings. A finding is a dict with a required "title" and
+// optional "id", "severity" (defaults to MEDIUM) and "description" keys.
+package checks
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	starlarkjson "go.starlark.net/lib/json"
+	"go.starlark.net/starlark"
+	"go.starlark.net/syntax"
+
+	"waf-log-retriever/analysis"
+	"waf-log-retriever/logging"
+)
+
+// FileExtension is the extension of check scripts
+const FileExtension = ".star"
+
+// entryPoint is the function every check script must define
+const entryPoint = "check"
+
+// maxExecutionSteps bounds a single check so a runaway script cannot hang the analysis
+const maxExecutionSteps = 50_000_000
+
+// Check is a loaded check script
+type Check struct {
+	Name string
+	Path string
+	fn   starlark.Callable
+}
+
+// LoadChecks compiles every check script in dir, in file name order
+func LoadChecks(dir string) ([]*Check, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read checks directory: %w", err)
+	}
+
+	var names []string
+	for _, entry := range entries {
+		if !entry.IsDir() && filepath.Ext(entry.Name()) == FileExtension {
+			names = append(names, entry.Name())
+		}
+	}
+	sort.Strings(names)
+
+	var loaded []*Check
+	for _, name := range names {
+		check, err := loadCheck(filepath.Join(dir, name))
+		if err != nil {
+			return nil, err
+		}
+		loaded = append(loaded, check)
+	}
+	return loaded, nil
+}
+
+// loadCheck executes a script's top level and resolves its check function
+func loadCheck(path string) (*Check, error) {
+	src, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read check %s: %w", path, err)
+	}
+
+	name := strings.TrimSuffix(filepath.Base(path), FileExtension)
+	thread := newThread(name)
+	globals, err := starlark.ExecFileOptions(&syntax.FileOptions{}, thread, path, src, predeclared())
+	if err != nil {
+		return nil, fmt.Errorf("failed to load check %s: %w", path, err)
+	}
+
+	fn, ok := globals[entryPoint].(starlark.Callable)
+	if !ok {
+		return nil, fmt.Errorf("check %s does not define a %s(acl, stats) function", path, entryPoint)
+	}
+
+	return &Check{Name: name, Path: path, fn: fn}, nil
+}
+
+// Run evaluates the check against a Web ACL snapshot and aggregate statistics
+func (c *Check) Run(webACL interface{}, stats *analysis.Stats) ([]analysis.Finding, error) {
+	aclValue, err := toStarlark(webACL)
+	if err != nil {
+		return nil, fmt.Errorf("failed to convert Web ACL snapshot: %w", err)
+	}
+	statsValue, err := toStarlark(stats)
+	if err != nil {
+		return nil, fmt.Errorf("failed to convert stats: %w", err)
+	}
+
+	result, err := starlark.Call(newThread(c.Name), c.fn, starlark.Tuple{aclValue, statsValue}, nil)
+	if err != nil {
+		if evalErr, ok := err.(*starlark.EvalError); ok {
+			return nil, fmt.Errorf("check %s failed: %s", c.Name, evalErr.Backtrace())
+		}
+		return nil, fmt.Errorf("check %s failed: %w", c.Name, err)
+	}
+
+	return c.findingsFromValue(result)
+}
+
+// RunAll evaluates every check, logging and skipping checks that fail
+func RunAll(loaded []*Check, webACL interface{}, stats *analysis.Stats, logger logging.Logger) []analysis.Finding {
+	var findings []analysis.Finding
+	for _, check := range loaded {
+		logger.Debugf("Running check %s", check.Name)
+		result, err := check.Run(webACL, stats)
+		if err != nil {
+			logger.Errorf("%v", err)
+			continue
+		}
+		logger.Infof("Check %s produced %d findings", check.Name, len(result))
+		findings = append(findings, result...)
+	}
+	return findings
+}
+
+// findingsFromValue converts a check's return value into findings
+func (c *Check) findingsFromValue(v starlark.Value) ([]analysis.Finding, error) {
+	switch v := v.(type) {
+	case starlark.NoneType:
+		return nil, nil
+	case *starlark.Dict:
+		finding, err := c.findingFromDict(v)
+		if err != nil {
+			return nil, err
+		}
+		return []analysis.Finding{finding}, nil
+	case *starlark.List:
+		var findings []analysis.Finding
+		for i := 0; i < v.Len(); i++ {
+			dict, ok := v.Index(i).(*starlark.Dict)
+			if !ok {
+				return nil, fmt.Errorf("check %s returned a list element of type %s, want dict", c.Name, v.Index(i).Type())
+			}
+			finding, err := c.findingFromDict(dict)
+			if err != nil {
+				return nil, err
+			}
+			findings = append(findings, finding)
+		}
+		return findings, nil
+	default:
+		return nil, fmt.Errorf("check %s returned %s, want None, dict or list of dicts", c.Name, v.Type())
+	}
+}
+
+// findingFromDict converts a single finding dict
+func (c *Check) findingFromDict(d *starlark.Dict) (analysis.Finding, error) {
+	finding := analysis.Finding{
+		ID:       c.Name,
+		Severity: analysis.SeverityMedium,
+		Source:   filepath.Base(c.Path),
+	}
+
+	fields := map[string]*string{
+		"id":          &finding.ID,
+		"severity":    &finding.Severity,
+		"title":       &finding.Title,
+		"description": &finding.Description,
+	}
+	for key, dst := range fields {
+		v, found, err := d.Get(starlark.String(key))
+		if err != nil {
+			return finding, err
+		}
+		if !found || v == starlark.None {
+			continue
+		}
+		s, ok := starlark.AsString(v)
+		if !ok {
+			return finding, fmt.Errorf("check %s: finding %q must be a string, got %s", c.Name, key, v.Type())
+		}
+		*dst = s
+	}
+
+	finding.Severity = strings.ToUpper(finding.Severity)
+	if !analysis.ValidSeverity(finding.Severity) {
+		return finding, fmt.Errorf("check %s: invalid severity %q", c.Name, finding.Severity)
+	}
+	if finding.Title == "" {
+		return finding, fmt.Errorf("check %s: finding is missing a title", c.Name)
+	}
+	return finding, nil
+}
+
+// newThread creates a Starlark thread whose print output goes to stderr
+func newThread(name string) *starlark.Thread {
+	thread := &starlark.Thread{
+		Name: name,
+		Print: func(_ *starlark.Thread, msg string) {
+			fmt.Fprintf(os.Stderr, "[check %s] %s\n", name, msg)
+		},
+	}
+	thread.SetMaxExecutionSteps(maxExecutionSteps)
+	return thread
+}
+
+// predeclared returns the globals available to every check script
+func predeclared() starlark.StringDict {
+	return starlark.StringDict{
+		"json": starlarkjson.Module,
+	}
+}
+
+// toStarlark converts a Go value to Starlark by way of its JSON representation,
+// so scripts see the same field names as the JSON snapshot and analysis files.
+func toStarlark(v interface{}) (starlark.Value, error) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	var generic interface{}
+	if err := json.Unmarshal(data, &generic); err != nil {
+		return nil, err
+	}
+	return fromGeneric(generic), nil
+}
+
+// fromGeneric converts a decoded JSON value into the equivalent Starlark value
+func fromGeneric(v interface{}) starlark.Value {
+	switch v := v.(type) {
+	case nil:
+		return starlark.None
+	case bool:
+		return starlark.Bool(v)
+	case float64:
+		if v == float64(int64(v)) {
+			return starlark.MakeInt64(int64(v))
+		}
+		return starlark.Float(v)
+	case string:
+		return starlark.String(v)
+	case []interface{}:
+		elems := make([]starlark.Value, len(v))
+		for i, e := range v {
+			elems[i] = fromGeneric(e)
+		}
+		return starlark.NewList(elems)
+	case map[string]interface{}:
+		keys := make([]string, 0, len(v))
+		for k := range v {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		dict := starlark.NewDict(len(v))
+		for _, k := range keys {
+			_ = dict.SetKey(starlark.String(k), fromGeneric(v[k]))
+		}
+		return dict
+	default:
+		return starlark.String(fmt.Sprint(v))
+	}
+}
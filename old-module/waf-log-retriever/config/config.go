@@ -8,12 +8,86 @@ import (
 )
 
 type Config struct {
-	AWSProfiles []AWSProfileConfig `json:"aws_profiles"`
+	AWSProfiles    []AWSProfileConfig   `json:"aws_profiles"`
+	LogRetrieval   LogRetrievalConfig   `json:"log_retrieval"`
+	DiscoveryCache DiscoveryCacheConfig `json:"discovery_cache"`
+	AccountNames   map[string]string    `json:"account_names"` // Friendly names by account ID, e.g. "Payments Prod"; preferred to the IAM account alias
+}
+
+// DiscoveryCacheConfig controls the local cache of WAF Web ACL discovery results
+type DiscoveryCacheConfig struct {
+	TTLMinutes *int   `json:"ttl_minutes"` // Defaults to 60; 0 disables the cache
+	Directory  string `json:"directory"`   // Defaults to .cache/discovery
+}
+
+// TTLMinutesOrDefault returns the configured cache lifetime in minutes
+func (c DiscoveryCacheConfig) TTLMinutesOrDefault() int {
+	if c.TTLMinutes == nil {
+		return 60
+	}
+	return *c.TTLMinutes
+}
+
+// LogRetrievalConfig controls how logs are retrieved
+type LogRetrievalConfig struct {
+	MaxConcurrentDownloads int                `json:"max_concurrent_downloads"`
+	MaxConcurrentQueries   int                `json:"max_concurrent_queries"` // CloudWatch Logs Insights queries at once, across sources
+	RetryAttempts          int                `json:"retry_attempts"`
+	RetryDelaySeconds      int                `json:"retry_delay_seconds"`     // Initial backoff, doubled per retry
+	MaxRetryDelaySeconds   int                `json:"max_retry_delay_seconds"` // Cap on a single backoff
+	FailureThresholds      FailureThresholds  `json:"failure_thresholds"`
+	BoundarySlackMinutes   *int               `json:"boundary_slack_minutes"` // S3 objects this far outside the time range are checked for records in it; defaults to 15
+	KeyPatterns            []KeyPatternConfig `json:"key_patterns"`           // Namings of S3 log objects tried before the built-in ones
+}
+
+// BoundarySlackMinutesOrDefault returns the configured boundary slack in minutes;
+// LoadConfig rejects a negative one
+func (c LogRetrievalConfig) BoundarySlackMinutesOrDefault() int {
+	if c.BoundarySlackMinutes == nil {
+		return 15
+	}
+	return *c.BoundarySlackMinutes
+}
+
+// KeyPatternConfig is a naming of S3 log objects the tool does not know: a regular
+// expression over the object key whose named groups year, month and day, and
+// optionally hour, minute and second, give the time of the object's logs
+type KeyPatternConfig struct {
+	Name    string `json:"name"`
+	Pattern string `json:"pattern"`
+}
+
+// FailureThresholds decides when a batch retrieval with failures exits non-zero.
+// A source "fails" when nothing could be retrieved and is "partial" when only some
+// of its objects or time chunks could be retrieved.
+type FailureThresholds struct {
+	MaxFailedSources  *int `json:"max_failed_sources"`  // Defaults to 0
+	MaxPartialSources *int `json:"max_partial_sources"` // Unlimited when unset
+}
+
+// FailedSourcesLimit returns the number of failed sources tolerated
+func (t FailureThresholds) FailedSourcesLimit() int {
+	if t.MaxFailedSources == nil {
+		return 0
+	}
+	return *t.MaxFailedSources
+}
+
+// PartialSourcesLimit returns the number of partially retrieved sources tolerated,
+// and false if there is no limit
+func (t FailureThresholds) PartialSourcesLimit() (int, bool) {
+	if t.MaxPartialSources == nil {
+		return 0, false
+	}
+	return *t.MaxPartialSources, true
 }
 
 type AWSProfileConfig struct {
-	ProfileName string `json:"profileName"`
-	RegionName  string `json:"region_name"`
+	ProfileName string   `json:"profileName"`
+	RegionName  string   `json:"region_name"`
+	Regions     []string `json:"regions"`    // Regions to discover Regional Web ACLs in, or ["all"] for every enabled region; defaults to region_name
+	RoleARN     string   `json:"roleArn"`    // Role to assume with the profile's credentials, e.g. in a central logging account (optional)
+	ExternalID  string   `json:"externalId"` // External ID the role's trust policy requires; may be encrypted or a secret reference
 }
 
 type WAFConfig struct {
@@ -32,7 +106,8 @@ type WAFLogSourceConfig struct {
 	DestinationARN  string `json:"destinationARN"`
 	S3BucketName    string `json:"s3BucketName"`
 	CWLogsGroupName string `json:"cwLogsGroupName"`
-	Scope           string `json:"scope"` // Add this field
+	Scope           string `json:"scope"`     // Add this field
+	LocalName       string `json:"localName"` // Directory below the profile's to store the logs in (default: webACLName)
 }
 
 func LoadConfig(filename string) (*Config, error) {
@@ -45,9 +120,20 @@ func LoadConfig(filename string) (*Config, error) {
 	if err := json.Unmarshal(data, &config); err != nil {
 		return nil, fmt.Errorf("error parsing config file: %w", err)
 	}
+	if err := config.validate(); err != nil {
+		return nil, fmt.Errorf("invalid config file: %w", err)
+	}
 	return &config, nil
 }
 
+// validate rejects settings that cannot be used, rather than failing with them later
+func (c *Config) validate() error {
+	if slack := c.LogRetrieval.BoundarySlackMinutes; slack != nil && *slack < 0 {
+		return fmt.Errorf("log_retrieval.boundary_slack_minutes must not be negative, got %d", *slack)
+	}
+	return nil
+}
+
 func LoadWAFConfig(filename string) (*WAFConfig, error) {
 	data, err := os.ReadFile(filename)
 	if err != nil {
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"time"
+
+	"waf-log-retriever/analysis"
+	"waf-log-retriever/storage"
+)
+
+// The demo dataset is written under this profile and Web ACL name, so it never mixes
+// with retrieved logs
+const (
+	demoProfile = "demo"
+	demoWebACL  = "storefront"
+)
+
+// runDemo generates a synthetic dataset, runs analyze and report on it and opens the
+// report, to show the tool without AWS credentials or logs of a real Web ACL
+func runDemo(args []string) int {
+	fs := flag.NewFlagSet("demo", flag.ExitOnError)
+	outputDir := fs.String("output-dir", "../logs/demo", "Directory to write the demo dataset, result and report to")
+	records := fs.Int("records", 50000, "Number of synthetic records to generate")
+	hours := fs.Int("hours", 24, "Hours up to now the records are spread over, one log file per hour")
+	seed := fs.Int64("seed", 1, "Seed of the generated logs; the same seed generates the same traffic")
+	noOpen := fs.Bool("no-open", false, "Only print the path of the report instead of opening it in a browser")
+	logLevel := fs.String("log-level", "WARNING", "Logging level (DEBUG, INFO, WARNING, ERROR)")
+	fs.Parse(args)
+
+	if *records <= 0 || *hours <= 0 {
+		fmt.Println("demo requires positive -records and -hours")
+		fs.Usage()
+		return 2
+	}
+
+	// A previous demo is replaced rather than added to, as its hours would overlap
+	aclDir := filepath.Join(*outputDir, demoProfile, demoWebACL)
+	if err := os.RemoveAll(aclDir); err != nil {
+		fmt.Printf("Failed to remove the previous demo dataset: %v\n", err)
+		return 1
+	}
+
+	end := time.Now().UTC().Truncate(time.Hour)
+	start := end.Add(-time.Duration(*hours) * time.Hour)
+	fmt.Printf("==> demo: generating %d records over %d hours in %s\n", *records, *hours, aclDir)
+	files, _, err := analysis.WriteSyntheticLogs(aclDir, analysis.SyntheticOptions{
+		Records:     *records,
+		ClientIPs:   2000,
+		URIs:        500,
+		Hosts:       2,
+		AttackShare: 0.05,
+		Start:       start,
+		Duration:    end.Sub(start),
+		Seed:        *seed,
+		WebACLName:  demoWebACL,
+	})
+	if err != nil {
+		fmt.Printf("%v\n", err)
+		return 1
+	}
+	if err := writeDemoSnapshot(aclDir, end); err != nil {
+		fmt.Printf("%v\n", err)
+		return 1
+	}
+	fmt.Printf("==> demo: wrote %d log files and a Web ACL snapshot\n", len(files))
+
+	fmt.Println("==> demo: analyzing")
+	if code := runAnalyze([]string{
+		"-output-dir", *outputDir, "-profile", demoProfile, "-web-acl", demoWebACL, "-log-level", *logLevel,
+		"-policy-template", "ecommerce", "-seed", strconv.FormatInt(*seed, 10),
+	}); code != 0 {
+		fmt.Printf("==> demo: analyze failed with exit code %d\n", code)
+		return code
+	}
+
+	fmt.Println("==> demo: rendering the report")
+	reportPath := filepath.Join(aclDir, "reports", "report_demo.html")
+	if code := runReport([]string{
+		"-output-dir", *outputDir, "-profile", demoProfile, "-web-acl", demoWebACL, "-log-level", *logLevel,
+		"-title", "AWS WAF Review: demo storefront (synthetic data)", "-out", reportPath,
+	}); code != 0 {
+		fmt.Printf("==> demo: report failed with exit code %d\n", code)
+		return code
+	}
+
+	fmt.Printf("==> demo: report written to %s\n", reportPath)
+	if !*noOpen {
+		if err := openInBrowser(reportPath); err != nil {
+			fmt.Printf("Could not open the report (%v); open it in a browser yourself\n", err)
+		}
+	}
+	fmt.Printf("Explore the dataset further with e.g. search -output-dir %s -profile %s -web-acl %s -action BLOCK\n", *outputDir, demoProfile, demoWebACL)
+	return 0
+}
+
+// writeDemoSnapshot saves the synthetic Web ACL snapshot where retrieval saves snapshots
+func writeDemoSnapshot(aclDir string, capturedAt time.Time) error {
+	data, err := json.MarshalIndent(analysis.SyntheticSnapshot(demoWebACL, capturedAt), "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to encode snapshot: %w", err)
+	}
+	snapshotDir := filepath.Join(aclDir, analysis.SnapshotDirName)
+	if err := os.MkdirAll(snapshotDir, 0755); err != nil {
+		return fmt.Errorf("failed to create snapshot directory: %w", err)
+	}
+	path := filepath.Join(snapshotDir, fmt.Sprintf("webacl_%s.json", capturedAt.Format("20060102_150405")))
+	if err := storage.WriteFileAtomic(path, data); err != nil {
+		return fmt.Errorf("failed to write snapshot: %w", err)
+	}
+	return nil
+}
+
+// openInBrowser opens a file with the desktop's default application for it
+func openInBrowser(path string) error {
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		return err
+	}
+	var cmd *exec.Cmd
+	switch runtime.GOOS {
+	case "darwin":
+		cmd = exec.Command("open", abs)
+	case "windows":
+		cmd = exec.Command("rundll32", "url.dll,FileProtocolHandler", abs)
+	default:
+		cmd = exec.Command("xdg-open", abs)
+	}
+	return cmd.Start()
+}
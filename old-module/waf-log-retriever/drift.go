@@ -0,0 +1,187 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"waf-log-retriever/analysis"
+)
+
+// runDrift compares the Web ACL snapshots of environments, e.g. staging with
+// production, and reports the rules and settings that drifted from the baseline
+func runDrift(args []string) int {
+	fs := flag.NewFlagSet("drift", flag.ExitOnError)
+	outputDir := fs.String("output-dir", "../logs/raw", "Directory containing retrieved logs and Web ACL snapshots")
+	weakerOnly := fs.Bool("weaker-only", false, "Report only the differences that protect less than the baseline")
+	jsonOutput := fs.Bool("json", false, "Write the drift reports as JSON")
+	out := fs.String("out", "", "File to write the drift report to (default: standard output)")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: drift [flags] <baseline> <target>...\n")
+		fmt.Fprintf(fs.Output(), "Each environment is <profile>/<web-acl>, for the latest snapshot in -output-dir, or a snapshot file\n")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+
+	if fs.NArg() < 2 {
+		fmt.Println("drift requires a baseline and at least one target environment")
+		fs.Usage()
+		return 2
+	}
+
+	environments := make([]analysis.DriftEnvironment, 0, fs.NArg())
+	snapshots := make([]map[string]interface{}, 0, fs.NArg())
+	for _, arg := range fs.Args() {
+		path, err := driftSnapshotPath(*outputDir, arg)
+		if err != nil {
+			fmt.Printf("%v\n", err)
+			return 1
+		}
+		snapshot, err := analysis.LoadSnapshot(path)
+		if err != nil {
+			fmt.Printf("%v\n", err)
+			return 1
+		}
+		environments = append(environments, analysis.DescribeDriftEnvironment(arg, path, snapshot))
+		snapshots = append(snapshots, snapshot)
+	}
+
+	reports := make([]*analysis.DriftReport, 0, len(snapshots)-1)
+	for i := 1; i < len(snapshots); i++ {
+		report := analysis.CompareSnapshots(environments[0], environments[i], snapshots[0], snapshots[i])
+		if *weakerOnly {
+			report.Settings = weakerSettings(report.Settings)
+			report.Rules = weakerRules(report.Rules)
+		}
+		reports = append(reports, report)
+	}
+
+	var buf bytes.Buffer
+	var err error
+	if *jsonOutput {
+		encoder := json.NewEncoder(&buf)
+		encoder.SetIndent("", "  ")
+		err = encoder.Encode(reports)
+	} else {
+		printDrift(&buf, reports)
+	}
+	if err != nil {
+		fmt.Printf("Failed to encode drift reports: %v\n", err)
+		return 1
+	}
+	if *out == "" {
+		os.Stdout.Write(buf.Bytes())
+	} else if err := os.WriteFile(*out, buf.Bytes(), 0644); err != nil {
+		fmt.Printf("Failed to write drift report: %v\n", err)
+		return 1
+	} else {
+		fmt.Printf("Drift of %d environments from %s written to %s\n", len(reports), environments[0].Name, *out)
+	}
+	return 0
+}
+
+// driftSnapshotPath resolves an environment argument to a snapshot file: an existing
+// file as is, otherwise the latest snapshot of <profile>/<web-acl>
+func driftSnapshotPath(outputDir, arg string) (string, error) {
+	if info, err := os.Stat(arg); err == nil && !info.IsDir() {
+		return arg, nil
+	}
+	profile, webACL, ok := strings.Cut(arg, "/")
+	if !ok || profile == "" || webACL == "" || strings.Contains(webACL, "/") {
+		return "", fmt.Errorf("environment %s is neither a snapshot file nor <profile>/<web-acl>", arg)
+	}
+	aclDir := filepath.Join(outputDir, profile, webACL)
+	path, err := analysis.LatestSnapshotPath(aclDir)
+	if err != nil {
+		return "", err
+	}
+	if path == "" {
+		return "", fmt.Errorf("no Web ACL snapshots found in %s; retrieve logs to capture one", aclDir)
+	}
+	return path, nil
+}
+
+// weakerSettings keeps the settings that protect less in the target
+func weakerSettings(settings []analysis.DriftDifference) []analysis.DriftDifference {
+	kept := []analysis.DriftDifference{}
+	for _, d := range settings {
+		if d.Weaker {
+			kept = append(kept, d)
+		}
+	}
+	return kept
+}
+
+// weakerRules keeps the rules that protect less in the target, with only their
+// weakening differences
+func weakerRules(rules []analysis.RuleDrift) []analysis.RuleDrift {
+	kept := []analysis.RuleDrift{}
+	for _, r := range rules {
+		if !r.Weaker {
+			continue
+		}
+		if r.Change == analysis.DriftChanged {
+			r.Differences = weakerSettings(r.Differences)
+		}
+		kept = append(kept, r)
+	}
+	return kept
+}
+
+// printDrift writes a drift report per target, weakening differences marked with !
+func printDrift(w io.Writer, reports []*analysis.DriftReport) {
+	for i, report := range reports {
+		if i > 0 {
+			fmt.Fprintln(w)
+		}
+		fmt.Fprintf(w, "Drift of %s (%s, %d rules) from %s (%s, %d rules)\n",
+			report.Target.Name, report.Target.WebACL, report.Target.Rules,
+			report.Baseline.Name, report.Baseline.WebACL, report.Baseline.Rules)
+		if len(report.Settings) == 0 && len(report.Rules) == 0 {
+			fmt.Fprintf(w, "  Nothing protects less than the baseline; %d rules configured the same\n", report.Identical)
+			continue
+		}
+		fmt.Fprintf(w, "  %d rules the same, %d missing, extra or changed; %d protect less than the baseline\n", report.Identical, len(report.Rules), report.Weaker)
+		if len(report.Settings) > 0 {
+			fmt.Fprintln(w, "  Web ACL settings:")
+			for _, d := range report.Settings {
+				printDriftDifference(w, d)
+			}
+		}
+		for _, r := range report.Rules {
+			mark := " "
+			if r.Weaker {
+				mark = "!"
+			}
+			switch r.Change {
+			case analysis.DriftMissing:
+				fmt.Fprintf(w, "  %s Rule %s (%s) is missing from the target\n", mark, r.Rule, r.Action)
+			case analysis.DriftExtra:
+				fmt.Fprintf(w, "  %s Rule %s (%s) is only in the target\n", mark, r.Rule, r.Action)
+			default:
+				name := r.Rule
+				if r.TargetRule != "" {
+					name = fmt.Sprintf("%s (%s in the target)", r.Rule, r.TargetRule)
+				}
+				fmt.Fprintf(w, "  %s Rule %s differs:\n", mark, name)
+				for _, d := range r.Differences {
+					printDriftDifference(w, d)
+				}
+			}
+		}
+	}
+}
+
+// printDriftDifference writes one difference as baseline -> target
+func printDriftDifference(w io.Writer, d analysis.DriftDifference) {
+	mark := " "
+	if d.Weaker {
+		mark = "!"
+	}
+	fmt.Fprintf(w, "    %s %s: %s -> %s\n", mark, d.Field, d.Baseline, d.Target)
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+
+	awsconfig "github.com/aws/aws-sdk-go-v2/config"
+
+	"waf-log-retriever/secrets"
+)
+
+// runEncrypt encrypts a sensitive value for config.json with KMS or age
+func runEncrypt(args []string) int {
+	fs := flag.NewFlagSet("encrypt", flag.ExitOnError)
+	kmsKey := fs.String("kms-key", "", "KMS key ID, ARN or alias to encrypt with")
+	ageRecipients := fs.String("age-recipient", "", "Comma-separated age recipients (age1...) to encrypt to")
+	awsProfile := fs.String("aws-profile", "", "AWS shared config profile for KMS (default: default credential chain)")
+	region := fs.String("region", "", "AWS region of the KMS key")
+	value := fs.String("value", "", "Value to encrypt (default: read one line from stdin)")
+	fs.Parse(args)
+
+	if (*kmsKey == "") == (*ageRecipients == "") {
+		fmt.Println("encrypt requires exactly one of -kms-key or -age-recipient")
+		fs.Usage()
+		return 2
+	}
+
+	plaintext := *value
+	if plaintext == "" {
+		fmt.Fprint(os.Stderr, "Value to encrypt: ")
+		line, err := bufio.NewReader(os.Stdin).ReadString('\n')
+		if err != nil && line == "" {
+			fmt.Printf("Failed to read value: %v\n", err)
+			return 1
+		}
+		plaintext = strings.TrimRight(line, "\r\n")
+	}
+
+	var encrypted string
+	var err error
+	if *kmsKey != "" {
+		ctx := context.Background()
+		var options []func(*awsconfig.LoadOptions) error
+		if *awsProfile != "" {
+			options = append(options, awsconfig.WithSharedConfigProfile(*awsProfile))
+		}
+		if *region != "" {
+			options = append(options, awsconfig.WithRegion(*region))
+		}
+		awsCfg, loadErr := awsconfig.LoadDefaultConfig(ctx, options...)
+		if loadErr != nil {
+			fmt.Printf("Failed to load AWS configuration: %v\n", loadErr)
+			return 1
+		}
+		encrypted, err = secrets.EncryptKMS(ctx, awsCfg, *kmsKey, plaintext)
+	} else {
+		encrypted, err = secrets.EncryptAge(strings.Split(*ageRecipients, ","), plaintext)
+	}
+	if err != nil {
+		fmt.Printf("Failed to encrypt value: %v\n", err)
+		return 1
+	}
+
+	fmt.Println(encrypted)
+	return 0
+}
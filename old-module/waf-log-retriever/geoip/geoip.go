@@ -0,0 +1,55 @@
+// Package geoip locates client IPs with a MaxMind GeoLite2 or GeoIP2 City database
+package geoip
+
+import (
+	"fmt"
+	"net/netip"
+	"strings"
+
+	"github.com/oschwald/maxminddb-golang"
+)
+
+// DB is an open City database
+type DB struct {
+	reader *maxminddb.Reader
+}
+
+// cityRecord is the part of a City database record DB reads. The coordinates are
+// pointers since networks located only to a country carry none.
+type cityRecord struct {
+	Location struct {
+		Latitude  *float64 `maxminddb:"latitude"`
+		Longitude *float64 `maxminddb:"longitude"`
+	} `maxminddb:"location"`
+}
+
+// Open opens a City database, e.g. GeoLite2-City.mmdb. Country and ASN databases
+// carry no coordinates and are refused.
+func Open(path string) (*DB, error) {
+	reader, err := maxminddb.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open GeoIP database: %w", err)
+	}
+	if !strings.Contains(reader.Metadata.DatabaseType, "City") {
+		reader.Close()
+		return nil, fmt.Errorf("GeoIP database %s is a %s database; a City database is needed for coordinates", path, reader.Metadata.DatabaseType)
+	}
+	return &DB{reader: reader}, nil
+}
+
+// Locate returns the coordinates of an IP, or false if the database has none
+func (db *DB) Locate(addr netip.Addr) (lat, lon float64, ok bool) {
+	var record cityRecord
+	if err := db.reader.Lookup(addr.AsSlice(), &record); err != nil {
+		return 0, 0, false
+	}
+	if record.Location.Latitude == nil || record.Location.Longitude == nil {
+		return 0, 0, false
+	}
+	return *record.Location.Latitude, *record.Location.Longitude, true
+}
+
+// Close closes the database
+func (db *DB) Close() error {
+	return db.reader.Close()
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"waf-log-retriever/analysis"
+	"waf-log-retriever/geoip"
+)
+
+// HotspotsDirName is the directory, inside a Web ACL's directory, hotspot exports
+// are written to by default
+const HotspotsDirName = "hotspots"
+
+// runHotspots aggregates the client IPs of malicious requests into map cells and
+// exports them for kepler.gl, so reviews with millions of attacking IPs can be
+// explored geographically
+func runHotspots(args []string) int {
+	fs := flag.NewFlagSet("hotspots", flag.ExitOnError)
+	outputDir := fs.String("output-dir", "../logs/raw", "Directory containing retrieved logs")
+	profile := fs.String("profile", "", "AWS profile name the logs were retrieved with")
+	webACL := fs.String("web-acl", "", "Name of the Web ACL whose logs to aggregate")
+	geoIPDB := fs.String("geoip-db", "", "MaxMind GeoLite2 or GeoIP2 City database locating client IPs (default: the centroid of the country WAF logged)")
+	cellSize := fs.Float64("cell-size", 1, "Size of the map cells in degrees of latitude and longitude")
+	all := fs.Bool("all", false, "Aggregate every request, not only blocked ones, attacks and scanners")
+	out := fs.String("out", "", "Directory to write the CSV dataset and kepler.gl map to (default: <web-acl>/hotspots)")
+	fs.Parse(args)
+
+	if *profile == "" || *webACL == "" {
+		fmt.Println("hotspots requires -profile and -web-acl")
+		fs.Usage()
+		return 2
+	}
+	if *cellSize <= 0 || *cellSize > 90 {
+		fmt.Printf("Invalid -cell-size %g: must be more than 0 and at most 90 degrees\n", *cellSize)
+		return 2
+	}
+
+	aclDir := filepath.Join(*outputDir, *profile, *webACL)
+	files, err := analysis.ListLogFiles(aclDir)
+	if err != nil {
+		fmt.Printf("%v\n", err)
+		return 1
+	}
+	if len(files) == 0 {
+		fmt.Printf("No log files found in %s\n", aclDir)
+		return 1
+	}
+
+	var locator analysis.Locator
+	if *geoIPDB != "" {
+		db, err := geoip.Open(*geoIPDB)
+		if err != nil {
+			fmt.Printf("%v\n", err)
+			return 1
+		}
+		defer db.Close()
+		locator = db
+	}
+	hotspots := analysis.NewHotspots(*cellSize, locator, *all)
+	for _, file := range files {
+		if err := analysis.ForEachRecord(file, func(r *analysis.Record) error {
+			hotspots.Add(r)
+			return nil
+		}); err != nil {
+			fmt.Printf("%v\n", err)
+			return 1
+		}
+	}
+	cells := hotspots.Cells()
+	if len(cells) == 0 {
+		fmt.Printf("No requests to aggregate in %s\n", aclDir)
+		return 1
+	}
+
+	now := time.Now().UTC()
+	dir := *out
+	if dir == "" {
+		dir = filepath.Join(aclDir, HotspotsDirName)
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		fmt.Printf("Failed to create %s: %v\n", dir, err)
+		return 1
+	}
+	base := filepath.Join(dir, "hotspots_"+now.Format("20060102_150405"))
+
+	var csvBuf, mapBuf bytes.Buffer
+	if err := analysis.WriteHotspotsCSV(&csvBuf, cells); err != nil {
+		fmt.Printf("Failed to encode hotspots: %v\n", err)
+		return 1
+	}
+	title := fmt.Sprintf("%s attack hotspots", *webACL)
+	if *all {
+		title = fmt.Sprintf("%s request hotspots", *webACL)
+	}
+	if err := analysis.WriteKeplerMap(&mapBuf, title, cells, now); err != nil {
+		fmt.Printf("Failed to encode kepler.gl map: %v\n", err)
+		return 1
+	}
+	if err := os.WriteFile(base+".csv", csvBuf.Bytes(), 0644); err != nil {
+		fmt.Printf("Failed to write hotspots: %v\n", err)
+		return 1
+	}
+	if err := os.WriteFile(base+".kepler.json", mapBuf.Bytes(), 0644); err != nil {
+		fmt.Printf("Failed to write kepler.gl map: %v\n", err)
+		return 1
+	}
+
+	fmt.Printf("%d client IPs aggregated into %d cells of %g degrees", hotspots.ClientIPs(), len(cells), *cellSize)
+	if locator != nil {
+		fmt.Printf(", %d located by %s", hotspots.Located, filepath.Base(*geoIPDB))
+	}
+	fmt.Println()
+	if hotspots.Unlocated > 0 {
+		fmt.Printf("%d requests skipped from IPs without a known location\n", hotspots.Unlocated)
+	}
+	fmt.Printf("CSV dataset written to %s.csv\n", base)
+	fmt.Printf("kepler.gl map written to %s.kepler.json; open https://kepler.gl/demo and drop the file on it\n", base)
+	return 0
+}
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"waf-log-retriever/aws"
+	"waf-log-retriever/config"
+	"waf-log-retriever/logging"
+	"waf-log-retriever/storage"
+)
+
+// runImportURLs downloads the log objects of a customer-provided list of S3
+// presigned URLs into a Web ACL's directory, for engagements without AWS access
+func runImportURLs(args []string) int {
+	fs := flag.NewFlagSet("import-urls", flag.ExitOnError)
+	configPath := fs.String("config", "config.json", "Path to configuration file, for the concurrency and retries of downloads (optional)")
+	outputDir := fs.String("output-dir", "../logs/raw", "Directory containing retrieved logs")
+	profile := fs.String("profile", "", "Profile name to file the logs under, as for retrieved logs")
+	webACL := fs.String("web-acl", "", "Name of the Web ACL the logs are of")
+	concurrency := fs.Int("concurrency", 0, "Objects to download at once (default: max_concurrent_downloads of the configuration)")
+	resume := fs.Bool("resume", false, "Skip the objects an interrupted import or retrieval downloaded, as recorded in its checkpoint")
+	analyze := fs.Bool("analyze", false, "Run analyze on the Web ACL after the download")
+	logLevel := fs.String("log-level", "INFO", "Logging level (DEBUG, INFO, WARNING, ERROR)")
+	forceUnlock := fs.Bool("force-unlock", false, "Take over the lock of the Web ACL's directory even if another run appears to hold it")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage of import-urls: import-urls -profile <name> -web-acl <name> [flags] <url-list|->\n")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+
+	if *profile == "" || *webACL == "" || fs.NArg() != 1 {
+		fmt.Println("import-urls requires -profile, -web-acl and a file listing the presigned URLs (- for stdin)")
+		fs.Usage()
+		return 2
+	}
+
+	var retrievalCfg config.LogRetrievalConfig
+	cfg, err := config.LoadConfig(*configPath)
+	switch {
+	case err == nil:
+		retrievalCfg = cfg.LogRetrieval
+	case !errors.Is(err, os.ErrNotExist) || *configPath != fs.Lookup("config").DefValue:
+		fmt.Printf("Failed to load config file: %v\n", err)
+		return 1
+	}
+	if *concurrency > 0 {
+		retrievalCfg.MaxConcurrentDownloads = *concurrency
+	}
+	keyPatterns, err := aws.CompileKeyPatterns(retrievalCfg.KeyPatterns)
+	if err != nil {
+		fmt.Printf("Invalid config file: %v\n", err)
+		return 1
+	}
+
+	var list io.Reader = os.Stdin
+	if name := fs.Arg(0); name != "-" {
+		f, err := os.Open(name)
+		if err != nil {
+			fmt.Printf("Failed to open URL list: %v\n", err)
+			return 1
+		}
+		defer f.Close()
+		list = f
+	}
+	objects, err := aws.ReadPresignedURLs(list)
+	if err != nil {
+		fmt.Printf("%v\n", err)
+		return 1
+	}
+	if len(objects) == 0 {
+		fmt.Println("The URL list holds no URLs")
+		return 1
+	}
+
+	logger, err := logging.SetupLogger(*logLevel)
+	if err != nil {
+		fmt.Printf("Failed to initialize application: %v\n", err)
+		return 1
+	}
+	defer logger.Close()
+
+	storageMgr, err := storage.NewStorageManager(storage.StorageConfig{BaseDirectory: *outputDir})
+	if err != nil {
+		logger.Errorf("%v", err)
+		return 1
+	}
+	aclDir := storageMgr.WebACLDir(*profile, *webACL)
+	if err := os.MkdirAll(aclDir, 0755); err != nil {
+		logger.Errorf("Failed to create %s: %v", aclDir, err)
+		return 1
+	}
+	lock, err := lockWebACL(aclDir, "import-urls", *forceUnlock, logger.Infof, logger.Warningf)
+	if err != nil {
+		logger.Errorf("%v", err)
+		return 1
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	importer := &aws.PresignedImport{
+		Client:        http.DefaultClient,
+		Storage:       storageMgr,
+		Profile:       *profile,
+		WebACL:        *webACL,
+		Policy:        aws.NewRetryPolicy(retrievalCfg),
+		MaxConcurrent: retrievalCfg.MaxConcurrentDownloads,
+		Resume:        *resume,
+		KeyPatterns:   keyPatterns,
+	}
+	logger.Infof("Importing %d objects for %s", len(objects), *webACL)
+	result, err := importer.Run(ctx, objects, logger)
+	releaseLock(lock, logger.Warningf)
+	if err != nil {
+		logger.Errorf("%v", err)
+		return 1
+	}
+
+	hints := make(map[string]bool)
+	for _, item := range result.Failed {
+		if item.Hint != "" && !hints[item.Hint] {
+			hints[item.Hint] = true
+			logger.Warningf("%s", item.Hint)
+		}
+	}
+	if len(result.Failed) > 0 {
+		logger.Warningf("Downloaded %d of %d objects (%d skipped as already downloaded); %d failed",
+			result.Retrieved, result.Found, result.Skipped, len(result.Failed))
+	} else {
+		logger.Infof("Downloaded %d of %d objects (%d skipped as already downloaded)", result.Retrieved, result.Found, result.Skipped)
+	}
+
+	if result.Retrieved > 0 && *analyze {
+		analyzeArgs := []string{"-output-dir", *outputDir, "-profile", *profile, "-web-acl", *webACL, "-log-level", *logLevel}
+		if *forceUnlock {
+			analyzeArgs = append(analyzeArgs, "-force-unlock")
+		}
+		if code := runAnalyze(analyzeArgs); code != 0 {
+			return code
+		}
+	}
+	if len(result.Failed) > 0 {
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,278 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+
+	"waf-log-retriever/analysis"
+	"waf-log-retriever/logging"
+	"waf-log-retriever/storage"
+)
+
+// runIngest ingests WAF log files delivered outside AWS, e.g. as file drops, into a
+// Web ACL's directory, once or watching for new files
+func runIngest(args []string) int {
+	fs := flag.NewFlagSet("ingest", flag.ExitOnError)
+	outputDir := fs.String("output-dir", "../logs/raw", "Directory containing retrieved logs")
+	profile := fs.String("profile", "", "Profile name to file the logs under, as for retrieved logs")
+	webACL := fs.String("web-acl", "", "Name of the Web ACL the logs are of")
+	watch := fs.Bool("watch", false, "Keep watching the given directories for new files until interrupted")
+	interval := fs.Duration("interval", 10*time.Second, "How often to look for new files with -watch; a file is ingested once it is unchanged for a whole interval")
+	analyze := fs.Bool("analyze", false, "Run analyze on the Web ACL after each batch of ingested files")
+	logLevel := fs.String("log-level", "INFO", "Logging level (DEBUG, INFO, WARNING, ERROR)")
+	forceUnlock := fs.Bool("force-unlock", false, "Take over the lock of the Web ACL's directory even if another run appears to hold it")
+	noDedup := fs.Bool("no-dedup", false, "Ingest records even if the directory holds records with their request IDs already")
+	fs.Parse(args)
+
+	if *profile == "" || *webACL == "" || fs.NArg() == 0 {
+		fmt.Println("ingest requires -profile, -web-acl and the files or directories to ingest")
+		fs.Usage()
+		return 2
+	}
+	if *watch && *interval <= 0 {
+		fmt.Println("-interval must be positive")
+		return 2
+	}
+
+	logger, err := logging.SetupLogger(*logLevel)
+	if err != nil {
+		fmt.Printf("Failed to initialize application: %v\n", err)
+		return 1
+	}
+	defer logger.Close()
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	ingester := &fileIngester{
+		aclDir:  filepath.Join(*outputDir, *profile, *webACL),
+		roots:   fs.Args(),
+		force:   *forceUnlock,
+		dedup:   !*noDedup,
+		logger:  logger,
+		done:    make(map[string]fileState),
+		pending: make(map[string]fileState),
+	}
+	if *watch {
+		logger.Infof("Watching %s for WAF log files every %s; interrupt to stop", strings.Join(ingester.roots, ", "), *interval)
+	}
+	for {
+		records, failed, err := ingester.poll(!*watch)
+		if err != nil && !*watch {
+			logger.Errorf("%v", err)
+			return 1
+		}
+		if err != nil {
+			logger.Warningf("%v; retrying in %s", err, *interval)
+		}
+		if records > 0 && *analyze {
+			analyzeArgs := []string{"-output-dir", *outputDir, "-profile", *profile, "-web-acl", *webACL, "-log-level", *logLevel}
+			if *forceUnlock {
+				analyzeArgs = append(analyzeArgs, "-force-unlock")
+			}
+			if code := runAnalyze(analyzeArgs); code != 0 && !*watch {
+				return code
+			}
+		}
+		if !*watch {
+			if failed > 0 {
+				return 1
+			}
+			return 0
+		}
+		select {
+		case <-ctx.Done():
+			logger.Infof("Stopped watching")
+			return 0
+		case <-time.After(*interval):
+		}
+	}
+}
+
+// fileState is what a delivered file is recognized as unchanged by between polls
+type fileState struct {
+	size    int64
+	modTime time.Time
+}
+
+// fileIngester ingests the files below its roots that it has not ingested in their
+// current state yet
+type fileIngester struct {
+	aclDir string
+	roots  []string
+	force  bool
+	dedup  bool // Leave out records whose request IDs are stored already, see storage.SeenRequests
+	logger logging.Logger
+
+	done    map[string]fileState // Files ingested, skipped or failed, as they were then
+	pending map[string]fileState // Files seen changing at the last poll
+}
+
+// poll ingests the new files below the roots and returns the records ingested and the
+// files that failed. Unless immediately is set, a file is only ingested once it was
+// seen unchanged at the previous poll, so files still being copied are left alone.
+// An error means no file was tried, e.g. because another run holds the lock; the
+// files are tried again at the next poll.
+func (f *fileIngester) poll(immediately bool) (int64, int, error) {
+	var ready []string
+	for _, root := range f.roots {
+		err := filepath.WalkDir(root, func(path string, d os.DirEntry, err error) error {
+			if err != nil {
+				return err
+			}
+			// Hidden and temporary files are partial copies, journals or locks
+			hidden := path != root && strings.HasPrefix(d.Name(), ".")
+			if d.IsDir() {
+				if hidden {
+					return filepath.SkipDir
+				}
+				return nil
+			}
+			if hidden || storage.IsTempFile(d.Name()) || !d.Type().IsRegular() {
+				return nil
+			}
+			info, err := d.Info()
+			if err != nil {
+				return nil // Moved away since the directory was read
+			}
+			state := fileState{size: info.Size(), modTime: info.ModTime()}
+			if f.done[path] == state {
+				return nil
+			}
+			if immediately || f.pending[path] == state {
+				ready = append(ready, path)
+				return nil
+			}
+			f.pending[path] = state
+			return nil
+		})
+		if err != nil {
+			return 0, 0, fmt.Errorf("failed to list %s: %w", root, err)
+		}
+	}
+	if len(ready) == 0 {
+		return 0, 0, nil
+	}
+
+	lock, err := lockWebACL(f.aclDir, "ingest", f.force, f.logger.Infof, f.logger.Warningf)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer releaseLock(lock, f.logger.Warningf)
+
+	var seen *storage.SeenRequests
+	if f.dedup {
+		if seen, err = storage.OpenSeenRequests(f.aclDir, forEachStoredRecord); err != nil {
+			return 0, 0, err
+		}
+		defer func() {
+			if err := seen.Save(); err != nil {
+				f.logger.Warningf("%v", err)
+			}
+			if seen.Duplicates > 0 {
+				f.logger.Infof("Left out %d records stored already (%d of %d request IDs checked exactly)", seen.Duplicates, seen.Candidates, seen.Checked)
+			}
+		}()
+	}
+
+	var records int64
+	failed := 0
+	for _, path := range ready {
+		state := f.pending[path]
+		delete(f.pending, path)
+		if info, err := os.Stat(path); err == nil {
+			state = fileState{size: info.Size(), modTime: info.ModTime()}
+		}
+		f.done[path] = state
+
+		archive, err := analysis.DeliveredArchiveFormat(path)
+		if err != nil {
+			f.logger.Errorf("Failed to ingest %s: %v", path, err)
+			failed++
+			continue
+		}
+		if archive == "" {
+			result, err := storage.Ingest(f.aclDir, path, parseDelivered, seen)
+			if f.report(path, result, err) {
+				records += result.Records
+			} else if err != nil {
+				failed++
+			}
+			continue
+		}
+
+		result, err := storage.IngestArchive(f.aclDir, path, func(fn func(name string, r io.Reader) error) (string, error) {
+			return analysis.ForEachArchiveMember(path, fn)
+		}, parseDelivered, seen)
+		if err != nil || result.Duplicate {
+			f.report(path, result, err)
+			if err != nil {
+				failed++
+			}
+			continue
+		}
+		members, skipped := 0, 0
+		for _, member := range result.Members {
+			switch {
+			case errors.Is(member.Err, storage.ErrUnknownFormat):
+				f.logger.Warningf("Skipped %s: not in a known log format", member.Name)
+				skipped++
+			case f.report(member.Name, member.IngestResult, member.Err):
+				records += member.Records
+				members++
+			case member.Err != nil:
+				failed++
+			default:
+				members++
+			}
+		}
+		f.logger.Infof("Ingested %s (%s): %d of %d files, %d skipped as not logs", path, result.Format, members, len(result.Members), skipped)
+	}
+	return records, failed, nil
+}
+
+// report logs the outcome of ingesting a delivered file and returns whether new
+// records were ingested
+func (f *fileIngester) report(name string, result *storage.IngestResult, err error) bool {
+	switch {
+	case err != nil:
+		f.logger.Errorf("Failed to ingest %s: %v", name, err)
+	case result.Duplicate:
+		f.logger.Infof("Skipped %s: already ingested as %s on %s", name, result.Name, result.At.Format(time.RFC3339))
+	case result.Records == 0 && result.AlreadyStored > 0:
+		f.logger.Infof("Ingested %s (%s): all of its %d records were stored already", name, result.Format, result.AlreadyStored)
+	case result.Records == 0:
+		f.logger.Warningf("Ingested %s (%s), but it holds no WAF records", name, result.Format)
+	case result.AlreadyStored > 0:
+		f.logger.Infof("Ingested %s (%s): %d records into %d log files, %d stored already left out", name, result.Format, result.Records, len(result.Files), result.AlreadyStored)
+		return true
+	default:
+		f.logger.Infof("Ingested %s (%s): %d records into %d log files", name, result.Format, result.Records, len(result.Files))
+		return true
+	}
+	return false
+}
+
+// forEachStoredRecord streams the records of a log file of a Web ACL's directory for
+// storage.Reorganize, storage.OpenSeenRequests and the boundary checks of S3 retrievals
+func forEachStoredRecord(file string, fn func(timestamp int64, raw []byte) error) error {
+	return analysis.ForEachRawRecord(file, func(r *analysis.Record, raw []byte) error {
+		return fn(r.Timestamp, raw)
+	})
+}
+
+// parseDelivered streams the records of a delivered file for storage.Ingest
+func parseDelivered(r io.Reader, name string, fn func(timestamp int64, raw []byte) error) (string, error) {
+	return analysis.ForEachDeliveredRecord(r, name, func(r *analysis.Record, payload []byte) error {
+		return fn(r.Timestamp, payload)
+	})
+}
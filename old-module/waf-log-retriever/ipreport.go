@@ -0,0 +1,295 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"waf-log-retriever/analysis"
+	"waf-log-retriever/workspace"
+)
+
+// ipReport is the dossier of an IP with the reviewers' annotations on it
+type ipReport struct {
+	*analysis.IPDossier
+	ProfileName string                 `json:"profileName"`
+	WebACLName  string                 `json:"webAclName"`
+	From        *time.Time             `json:"from,omitempty"`
+	To          *time.Time             `json:"to,omitempty"`
+	Annotations []workspace.Annotation `json:"annotations"`
+	Disposition string                 `json:"disposition,omitempty"`
+}
+
+// runIPReport prints a dossier of everything a Web ACL's logs say about one client IP
+func runIPReport(args []string) int {
+	fs := flag.NewFlagSet("ip-report", flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "Usage: ip-report [flags] IP")
+		fs.PrintDefaults()
+	}
+	outputDir := fs.String("output-dir", "../logs/raw", "Directory containing retrieved logs")
+	profile := fs.String("profile", "", "AWS profile name the logs were retrieved with")
+	webACL := fs.String("web-acl", "", "Name of the Web ACL whose logs to search")
+	from := fs.String("from", "", "Only records at or after this time (YYYY-MM-DD or YYYY-MM-DDTHH:mm:ssZ)")
+	to := fs.String("to", "", "Only records before this time (YYYY-MM-DD or YYYY-MM-DDTHH:mm:ssZ)")
+	top := fs.Int("top", 10, "Entries to list in each ranked section")
+	samples := fs.Int("samples", 5, "Sample requests to include, one per distinct terminating rule")
+	enrichFile := fs.String("enrich", "", "JSON file of networks with ASN, organization and reputation (optional)")
+	rdns := fs.Bool("rdns", false, "Look up the reverse DNS name of the IP")
+	out := fs.String("out", "", "File to write the dossier to (default: standard output)")
+	jsonOutput := fs.Bool("json", false, "Write the dossier as JSON instead of Markdown")
+	fs.Parse(args)
+	// Accept flags after the IP as well
+	ip := fs.Arg(0)
+	if fs.NArg() > 0 {
+		fs.Parse(fs.Args()[1:])
+	}
+
+	if *profile == "" || *webACL == "" || ip == "" || fs.NArg() > 0 {
+		fmt.Println("ip-report requires -profile, -web-acl and a single IP")
+		fs.Usage()
+		return 2
+	}
+	if net.ParseIP(ip) == nil {
+		fmt.Printf("Invalid IP %q\n", ip)
+		return 2
+	}
+	q := analysis.Query{IP: ip}
+	var err error
+	if *from != "" {
+		if q.From, err = parseTime(*from); err != nil {
+			fmt.Printf("Invalid -from: %v\n", err)
+			return 2
+		}
+	}
+	if *to != "" {
+		if q.To, err = parseTime(*to); err != nil {
+			fmt.Printf("Invalid -to: %v\n", err)
+			return 2
+		}
+	}
+	if err := q.Compile(); err != nil {
+		fmt.Printf("%v\n", err)
+		return 2
+	}
+	var intel []analysis.IPIntel
+	if *enrichFile != "" {
+		if intel, err = analysis.LoadIPIntel(*enrichFile); err != nil {
+			fmt.Printf("%v\n", err)
+			return 1
+		}
+	}
+
+	aclDir := filepath.Join(*outputDir, *profile, *webACL)
+	files, err := analysis.ListLogFiles(aclDir)
+	if err != nil {
+		fmt.Printf("%v\n", err)
+		return 1
+	}
+	dossier := analysis.NewIPDossier(ip, *samples)
+	for _, file := range files {
+		if !q.MayContain(aclDir, file) {
+			continue
+		}
+		if err := q.ForEachMatch(file, func(r *analysis.Record, raw []byte) error {
+			dossier.Add(r, raw)
+			return nil
+		}); err != nil {
+			fmt.Printf("%v\n", err)
+			return 1
+		}
+	}
+	if dossier.Requests == 0 {
+		fmt.Printf("No requests from %s in %s\n", ip, aclDir)
+		return 1
+	}
+	dossier.Finish(*top, intel)
+	if *rdns {
+		if err := dossier.LookupReverseDNS(); err != nil {
+			fmt.Fprintf(os.Stderr, "%v\n", err)
+		}
+	}
+
+	ws, err := workspace.Open(aclDir, *profile, *webACL)
+	if err != nil {
+		fmt.Printf("%v\n", err)
+		return 1
+	}
+	report := ipReport{
+		IPDossier:   dossier,
+		ProfileName: *profile,
+		WebACLName:  *webACL,
+		Annotations: ws.AnnotationsFor(workspace.TargetIP, ip),
+		Disposition: ws.Disposition(workspace.TargetIP, ip),
+	}
+	if report.Annotations == nil {
+		report.Annotations = []workspace.Annotation{}
+	}
+	if !q.From.IsZero() {
+		report.From = &q.From
+	}
+	if !q.To.IsZero() {
+		report.To = &q.To
+	}
+
+	var buf bytes.Buffer
+	if *jsonOutput {
+		encoder := json.NewEncoder(&buf)
+		encoder.SetIndent("", "  ")
+		err = encoder.Encode(report)
+	} else {
+		writeIPReportMarkdown(&buf, &report)
+	}
+	if err != nil {
+		fmt.Printf("Failed to encode dossier: %v\n", err)
+		return 1
+	}
+	if *out == "" {
+		os.Stdout.Write(buf.Bytes())
+		return 0
+	}
+	if err := os.WriteFile(*out, buf.Bytes(), 0644); err != nil {
+		fmt.Printf("Failed to write dossier: %v\n", err)
+		return 1
+	}
+	fmt.Printf("IP dossier written to %s\n", *out)
+	return 0
+}
+
+// writeIPReportMarkdown renders a dossier as Markdown, for pasting into tickets
+func writeIPReportMarkdown(w io.Writer, r *ipReport) {
+	d := r.IPDossier
+	fmt.Fprintf(w, "# IP dossier: %s\n\n", d.IP)
+	fmt.Fprintf(w, "Web ACL `%s` (profile `%s`)", r.WebACLName, r.ProfileName)
+	if r.From != nil || r.To != nil {
+		fmt.Fprintf(w, ", records %s to %s", formatBound(r.From, "start"), formatBound(r.To, "end"))
+	}
+	fmt.Fprint(w, "\n\n")
+
+	fmt.Fprintln(w, "## Summary")
+	fmt.Fprintf(w, "- First seen: %s\n", d.FirstSeen.Format(time.RFC3339))
+	fmt.Fprintf(w, "- Last seen: %s\n", d.LastSeen.Format(time.RFC3339))
+	fmt.Fprintf(w, "- Requests: %d (%s)\n", d.Requests, formatCountMap(d.Actions))
+	fmt.Fprintf(w, "- Methods: %s\n", formatCountMap(d.Methods))
+	fmt.Fprintf(w, "- Distinct URIs: %d\n", d.DistinctURIs)
+	if r.Disposition != "" {
+		fmt.Fprintf(w, "- Reviewer disposition: %s\n", r.Disposition)
+	}
+
+	fmt.Fprintln(w, "\n## Enrichment")
+	e := d.Enrichment
+	fmt.Fprintf(w, "- Geolocation (by AWS WAF): %s\n", formatCounts(e.Countries))
+	if e.Private {
+		fmt.Fprintln(w, "- Private, loopback or link-local address")
+	}
+	if e.Intel != nil {
+		fmt.Fprintf(w, "- Network %s", e.Intel.CIDR)
+		if e.Intel.ASN != 0 {
+			fmt.Fprintf(w, ", AS%d", e.Intel.ASN)
+		}
+		if e.Intel.Org != "" {
+			fmt.Fprintf(w, " (%s)", e.Intel.Org)
+		}
+		fmt.Fprintln(w)
+		if e.Intel.Reputation != "" {
+			fmt.Fprintf(w, "- Reputation: %s", e.Intel.Reputation)
+			if e.Intel.Source != "" {
+				fmt.Fprintf(w, " (source: %s)", e.Intel.Source)
+			}
+			fmt.Fprintln(w)
+		}
+	}
+	if len(e.ReverseDNS) > 0 {
+		fmt.Fprintf(w, "- Reverse DNS: %s\n", strings.Join(e.ReverseDNS, ", "))
+	}
+	if len(d.Scanners) > 0 {
+		fmt.Fprintf(w, "- Scanner signatures: %s\n", formatCounts(d.Scanners))
+	}
+
+	fmt.Fprintf(w, "\n## Request volume by %s\n", d.Bucket)
+	fmt.Fprintln(w, "| Start (UTC) | Requests | Blocked |")
+	fmt.Fprintln(w, "|---|---:|---:|")
+	for _, b := range d.Timeline {
+		fmt.Fprintf(w, "| %s | %d | %d |\n", b.Start.Format("2006-01-02 15:04"), b.Requests, b.Blocked)
+	}
+
+	writeCountTable(w, "Hosts", "Host", d.Hosts)
+	writeCountTable(w, "Endpoints touched", "URI", d.URIs)
+	writeCountTable(w, "Rules triggered", "Rule", d.Rules)
+	writeCountTable(w, "Labels", "Label", d.Labels)
+	writeCountTable(w, "User-Agents", "User-Agent", d.UserAgents)
+
+	if len(r.Annotations) > 0 {
+		fmt.Fprintln(w, "\n## Reviewer annotations")
+		for _, a := range r.Annotations {
+			fmt.Fprintf(w, "- %s, %s", a.At.Format("2006-01-02"), a.Reviewer)
+			if a.Disposition != "" {
+				fmt.Fprintf(w, " [%s]", a.Disposition)
+			}
+			if a.Note != "" {
+				fmt.Fprintf(w, ": %s", a.Note)
+			}
+			fmt.Fprintln(w)
+		}
+	}
+
+	if len(d.Samples) > 0 {
+		fmt.Fprintln(w, "\n## Sample requests")
+		for _, raw := range d.Samples {
+			var pretty bytes.Buffer
+			if err := json.Indent(&pretty, raw, "", "  "); err != nil {
+				pretty.Reset()
+				pretty.Write(raw)
+			}
+			fmt.Fprintf(w, "```json\n%s\n```\n", pretty.String())
+		}
+	}
+}
+
+// writeCountTable writes a ranked section as a Markdown table
+func writeCountTable(w io.Writer, title, column string, counts []analysis.Count) {
+	if len(counts) == 0 {
+		return
+	}
+	fmt.Fprintf(w, "\n## %s\n| %s | Requests |\n|---|---:|\n", title, column)
+	for _, c := range counts {
+		key := c.Key
+		if key == "" {
+			key = "(none)"
+		}
+		fmt.Fprintf(w, "| `%s` | %d |\n", strings.ReplaceAll(key, "|", `\|`), c.Count)
+	}
+}
+
+// formatCounts formats ranked counts as "a 3, b 1"
+func formatCounts(counts []analysis.Count) string {
+	parts := make([]string, 0, len(counts))
+	for _, c := range counts {
+		key := c.Key
+		if key == "" {
+			key = "unknown"
+		}
+		parts = append(parts, fmt.Sprintf("%s %d", key, c.Count))
+	}
+	return strings.Join(parts, ", ")
+}
+
+// formatCountMap formats a count map, largest first
+func formatCountMap(counts map[string]int64) string {
+	return formatCounts(analysis.TopN(counts, 0))
+}
+
+// formatBound formats an optional time bound of a window
+func formatBound(t *time.Time, open string) string {
+	if t == nil {
+		return open
+	}
+	return t.Format(time.RFC3339)
+}
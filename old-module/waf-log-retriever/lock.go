@@ -0,0 +1,66 @@
+package main
+
+import (
+	"fmt"
+	"os"
+
+	"waf-log-retriever/storage"
+)
+
+// lockWebACL locks a Web ACL's directory for a run of command, reporting through
+// warnf a lock it took over from a run that is gone, or any with force. Once locked,
+// the directory's index and manifest are migrated from older versions, reported
+// through infof, and the temporary files of runs that crashed mid-write are removed.
+func lockWebACL(aclDir, command string, force bool, infof, warnf func(format string, v ...interface{})) (*storage.Lock, error) {
+	lock, err := storage.AcquireLock(aclDir, command, force)
+	if err != nil {
+		return nil, err
+	}
+	switch {
+	case lock.Replaced != nil:
+		warnf("Took over the lock of %s held by %s", aclDir, lock.Replaced)
+	case lock.TookOver:
+		warnf("Took over the unreadable lock of %s", aclDir)
+	}
+	migrations, err := storage.MigrateWebACL(aclDir)
+	for _, m := range migrations {
+		infof("Migrated %s", m)
+	}
+	if err != nil {
+		releaseLock(lock, warnf)
+		return nil, fmt.Errorf("failed to migrate %s: %w", aclDir, err)
+	}
+	removeStaleTempFiles(aclDir, infof, warnf)
+	return lock, nil
+}
+
+// removeStaleTempFiles removes the temporary files below a directory left behind by
+// runs that crashed before renaming them into place, reporting them through infof.
+// A failure is only reported through warnf: the files are removed by a later run.
+func removeStaleTempFiles(dir string, infof, warnf func(format string, v ...interface{})) {
+	removed, err := storage.RemoveStaleTempFiles(dir)
+	for _, path := range removed {
+		infof("Removed stale temporary file %s", path)
+	}
+	if err != nil {
+		warnf("%v", err)
+	}
+}
+
+// releaseLock releases a lock, reporting a failure through warnf
+func releaseLock(lock *storage.Lock, warnf func(format string, v ...interface{})) {
+	if err := lock.Release(); err != nil {
+		warnf("%v", err)
+	}
+}
+
+// printInfo prints a message of a command without a logger to standard error, which
+// keeps standard output to the command's results
+func printInfo(format string, v ...interface{}) {
+	fmt.Fprintf(os.Stderr, format+"\n", v...)
+}
+
+// printWarning prints a warning of a command without a logger to standard error
+func printWarning(format string, v ...interface{}) {
+	fmt.Fprintf(os.Stderr, "Warning: "+format+"\n", v...)
+}
@@ -36,20 +36,11 @@ type DefaultLogger struct {
 
 // SetupLogger creates a new logger that writes to both file and stdout.
 func SetupLogger(logLevel string) (Logger, error) {
-    // Create logs directory structure
-    logDir := filepath.Join("logs", "app", time.Now().Format("2006-01-02"))
-    if err := os.MkdirAll(logDir, 0755); err != nil {
-        return nil, fmt.Errorf("failed to create log directory: %w", err)
-    }
-
-    // Create log file with timestamp
-    logFileName := fmt.Sprintf("waf-retriever_%s.log", time.Now().Format("20060102_150405"))
-    logPath := filepath.Join(logDir, logFileName)
-    
-    file, err := os.Create(logPath)
+    file, err := CreateRunFile("waf-retriever", ".log")
     if err != nil {
-        return nil, fmt.Errorf("failed to create log file: %w", err)
+        return nil, err
     }
+    logPath := file.Name()
 
     multiWrite := io.MultiWriter(os.Stdout, file)
     logger := log.New(multiWrite, "[WAF-LOG-RETRIEVER] ", log.Ldate|log.Ltime|log.Lshortfile)
@@ -63,6 +54,24 @@ func SetupLogger(logLevel string) (Logger, error) {
     }, nil
 }
 
+// CreateRunFile creates a timestamped file, e.g. waf-retriever_20060102_150405.log,
+// in today's application log directory (logs/app/YYYY-MM-DD/).
+func CreateRunFile(prefix, ext string) (*os.File, error) {
+    // Create logs directory structure
+    logDir := filepath.Join("logs", "app", time.Now().Format("2006-01-02"))
+    if err := os.MkdirAll(logDir, 0755); err != nil {
+        return nil, fmt.Errorf("failed to create log directory: %w", err)
+    }
+
+    // Create log file with timestamp
+    fileName := fmt.Sprintf("%s_%s%s", prefix, time.Now().Format("20060102_150405"), ext)
+    file, err := os.Create(filepath.Join(logDir, fileName))
+    if err != nil {
+        return nil, fmt.Errorf("failed to create log file: %w", err)
+    }
+    return file, nil
+}
+
 func (l *DefaultLogger) Close() error {
     if l.file != nil {
         if err := l.file.Close(); err != nil {
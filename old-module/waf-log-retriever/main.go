@@ -3,17 +3,27 @@ package main
 
 import (
     "compress/gzip"
+    "context"
+    "encoding/json"
     "flag"
     "fmt"
     "os"
     "path/filepath"
+    "strings"
     "time"
 
+    awsconfig "github.com/aws/aws-sdk-go-v2/config"
+
+    "waf-log-retriever/analysis"
     "waf-log-retriever/aws"
     "waf-log-retriever/cli"
     "waf-log-retriever/config"
     "waf-log-retriever/logging"
+    "waf-log-retriever/secrets"
     "waf-log-retriever/storage"
+    "waf-log-retriever/telemetry"
+
+    "go.opentelemetry.io/otel/attribute"
 )
 
 // Command line flags
@@ -27,6 +37,15 @@ var (
     outputDirFlag = flag.String("output-dir", "../logs/raw", "Output directory for raw logs")
 	logLevelFlag   = flag.String("log-level", "INFO", "Logging level (DEBUG, INFO, WARNING, ERROR)")
 	interactiveFlag = flag.Bool("interactive", false, "Run in interactive mode")
+	allSourcesFlag  = flag.Bool("all-sources", false, "Retrieve logs for every WAF source of the profile in one batch")
+	retryFailedFlag = flag.Bool("retry-failed", false, "Retry only the objects/chunks that failed in a previous run")
+	reportFlag      = flag.String("report", "", "Retrieval report to retry with -retry-failed (default: latest in -output-dir)")
+	refreshFlag     = flag.Bool("refresh", false, "Ignore cached WAF discovery results and discover again")
+	traceAWSFlag    = flag.Bool("trace-aws", false, "Log every AWS API call to a separate trace file")
+	sinceLastRunFlag = flag.Bool("since-last-run", false, "Retrieve only the logs newer than the last run's, from the state it recorded per WAF source")
+	resumeFlag      = flag.Bool("resume", false, "Skip the S3 objects an interrupted retrieval downloaded, as recorded in its checkpoint")
+	forceUnlockFlag = flag.Bool("force-unlock", false, "Take over the lock of a Web ACL's directory held by another run that is no longer active")
+	otlpEndpointFlag = flag.String("otlp-endpoint", "", "OTLP/HTTP endpoint URL for OpenTelemetry traces and metrics (default: OTEL_EXPORTER_OTLP_ENDPOINT)")
 )
 
 // AppContext holds all the initialized components and configuration
@@ -37,6 +56,8 @@ type AppContext struct {
     Logger         logging.Logger
     StorageManager *storage.StorageManager
     AWSSession     *aws.SessionManager
+    APITracer      *aws.APITracer // nil unless -trace-aws is set
+    ShutdownTelemetry func(context.Context) error
     StartTime      time.Time
     EndTime        time.Time
 }
@@ -44,17 +65,44 @@ type AppContext struct {
 // main.go
 
 func main() {
-    // Parse command line flags
-    flag.Parse()
+    // Profiling flags come first and apply to every command
+    args, err := startProfiling(os.Args[1:])
+    if err != nil {
+        fmt.Printf("%v\n", err)
+        os.Exit(2)
+    }
+    os.Args = append(os.Args[:1], args...)
+
+    // Dispatch subcommands; without one the tool retrieves logs as before
+    if len(os.Args) > 1 {
+        if command, ok := subcommands[os.Args[1]]; ok {
+            code := command(os.Args[2:])
+            stopProfiling()
+            os.Exit(code)
+        }
+    }
+
+    // Parse command line flags; "retrieve" names the default command explicitly
+    if len(os.Args) > 1 && os.Args[1] == "retrieve" {
+        flag.CommandLine.Parse(os.Args[2:])
+    } else {
+        flag.Parse()
+    }
 
     // Initialize application context
     appCtx, err := initializeApp()
     if err != nil {
         fmt.Printf("Failed to initialize application: %v\n", err)
+        stopProfiling()
         os.Exit(1)
     }
+    defer func() { stopProfiling() }()
     // Ensure logger is closed properly
     defer appCtx.Logger.Close()
+    if appCtx.APITracer != nil {
+        defer appCtx.APITracer.Close()
+    }
+    defer flushTelemetry(appCtx)
 
     // Log application start with configuration details
     appCtx.Logger.Info("Starting AWS WAF Log Retrieval Script")
@@ -69,11 +117,33 @@ func main() {
 
     // Initialize AWS managers
     appCtx.Logger.Info("Initializing AWS service managers...")
-    s3Mgr := aws.NewS3Manager(appCtx.AWSSession.Session)
+    // Only the S3 log objects are read through the profile's role, if it has one
+    s3Mgr := aws.NewS3Manager(appCtx.AWSSession.LogSession)
+    s3Mgr.AccountSession = appCtx.AWSSession.Session
+    s3Mgr.Storage = appCtx.StorageManager
+    s3Mgr.Account = appCtx.AWSSession.Account
+    s3Mgr.Resume = *resumeFlag
+    s3Mgr.SkipConfirmation = *sinceLastRunFlag // Incremental runs are unattended, e.g. from cron
+    s3Mgr.BoundarySlack = time.Duration(appCtx.Config.LogRetrieval.BoundarySlackMinutesOrDefault()) * time.Minute
+    s3Mgr.Records = forEachStoredRecord
+    if s3Mgr.KeyPatterns, err = aws.CompileKeyPatterns(appCtx.Config.LogRetrieval.KeyPatterns); err != nil {
+        appCtx.Logger.Errorf("Invalid config file: %v", err)
+        exit(appCtx, 1)
+    }
     cwLogsMgr := aws.NewCWLogsManager(appCtx.AWSSession.Session)
+    cwLogsMgr.Storage = appCtx.StorageManager
+    cwLogsMgr.Account = appCtx.AWSSession.Account
+    cwLogsMgr.MaxConcurrentQueries = appCtx.Config.LogRetrieval.MaxConcurrentQueries
     wafv2Mgr := aws.NewWAFv2Manager(appCtx.AWSSession.Session)
     appCtx.Logger.Info("AWS service managers initialized successfully")
 
+    if *retryFailedFlag {
+        exit(appCtx, runRetryFailed(appCtx, s3Mgr, cwLogsMgr))
+    }
+    if *allSourcesFlag {
+        exit(appCtx, runBatch(appCtx, s3Mgr, cwLogsMgr, wafv2Mgr))
+    }
+
     // Select WAF source based on mode
     var selectedWAFSource *aws.WAFLogSource
     if *wafSourceFlag != "" {
@@ -84,12 +154,12 @@ func main() {
 
     if err != nil {
         appCtx.Logger.Errorf("Failed to select WAF source: %v", err)
-        os.Exit(1)
+        exit(appCtx, 1)
     }
 
     if selectedWAFSource == nil {
         appCtx.Logger.Error("No WAF Log Source selected or configured. Exiting.")
-        os.Exit(1)
+        exit(appCtx, 1)
     }
 
     // Log the selected WAF source details
@@ -99,11 +169,25 @@ func main() {
     appCtx.Logger.Infof("  - Type: %s", selectedWAFSource.LogSourceType)
     appCtx.Logger.Infof("  - Region: %s", selectedWAFSource.Region)
 
+    // Keep other runs out of the Web ACL's directory while writing to it
+    unlock, err := lockSources(appCtx, []*aws.WAFLogSource{selectedWAFSource})
+    if err != nil {
+        appCtx.Logger.Errorf("%v", err)
+        exit(appCtx, 1)
+    }
+
     // Process the selected WAF source
     if err := processWAFSource(appCtx, selectedWAFSource, s3Mgr, cwLogsMgr); err != nil {
         appCtx.Logger.Errorf("Failed to process WAF source: %v", err)
-        os.Exit(1)
+        unlock()
+        exit(appCtx, 1)
+    }
+
+    // Capture the Web ACL definition alongside the logs for offline analysis
+    if err := saveWebACLSnapshot(appCtx, wafv2Mgr, selectedWAFSource); err != nil {
+        appCtx.Logger.Warningf("Failed to capture Web ACL snapshot: %v", err)
     }
+    unlock()
 
     // Log completion status and summary
     appCtx.Logger.Info("AWS WAF Log Retrieval Script completed successfully")
@@ -143,19 +227,49 @@ func initializeApp() (*AppContext, error) {
 
     // Initialize AWS session
     logger.Info("Initializing AWS session...")
-    awsSession, err := aws.NewSessionManager(cfg, logger)
+    var sessionOptions []func(*awsconfig.LoadOptions) error
+    if *traceAWSFlag {
+        traceFile, err := logging.CreateRunFile("aws-trace", ".jsonl")
+        if err != nil {
+            return nil, fmt.Errorf("failed to create AWS trace file: %w", err)
+        }
+        appCtx.APITracer = aws.NewAPITracer(traceFile)
+        sessionOptions = append(sessionOptions, appCtx.APITracer.ConfigOption())
+        logger.Infof("Tracing AWS API calls to: %s", traceFile.Name())
+    }
+
+    // Set up OpenTelemetry; without an OTLP endpoint spans and metrics are discarded
+    shutdownTelemetry, err := telemetry.Setup(context.Background(), *otlpEndpointFlag)
+    if err != nil {
+        return nil, fmt.Errorf("failed to set up telemetry: %w", err)
+    }
+    appCtx.ShutdownTelemetry = shutdownTelemetry
+    awsSession, err := aws.NewSessionManager(cfg, logger, sessionOptions...)
     if err != nil {
         return nil, fmt.Errorf("failed to create AWS session manager: %w", err)
     }
     appCtx.AWSSession = awsSession
 
-    // Parse time range
-    startTime, endTime, err := parseTimeRange(*startDateFlag, *endDateFlag)
-    if err != nil {
-        return nil, fmt.Errorf("failed to parse time range: %w", err)
+    // Decrypt encrypted config values and resolve secret references through the
+    // profile's own session, not that of a role it assumes in another account
+    if err := secrets.Resolve(context.Background(), cfg, secrets.SessionResolvers(awsSession.Session)); err != nil {
+        return nil, fmt.Errorf("failed to resolve config secrets: %w", err)
+    }
+
+    // Parse time range; a retry takes it from the previous run's report. Runs since the
+    // last need no dates, e.g. from cron: they end now and, for sources without an
+    // earlier run, start a day before.
+    if *sinceLastRunFlag && *startDateFlag == "" && *endDateFlag == "" {
+        appCtx.EndTime = time.Now().UTC()
+        appCtx.StartTime = appCtx.EndTime.Add(-24 * time.Hour)
+    } else if !*retryFailedFlag {
+        startTime, endTime, err := parseTimeRange(*startDateFlag, *endDateFlag)
+        if err != nil {
+            return nil, fmt.Errorf("failed to parse time range: %w", err)
+        }
+        appCtx.StartTime = startTime
+        appCtx.EndTime = endTime
     }
-    appCtx.StartTime = startTime
-    appCtx.EndTime = endTime
 
     // Initialize storage manager
     storageConfig := storage.StorageConfig{
@@ -171,6 +285,10 @@ func initializeApp() (*AppContext, error) {
     }
     appCtx.StorageManager = storageManager
 
+    // Writes go to temporary files renamed into place once complete; those of a run
+    // that crashed mid-write are removed
+    removeStaleTempFiles(*outputDirFlag, appCtx.Logger.Infof, appCtx.Logger.Warningf)
+
     return appCtx, nil
 }
 
@@ -190,7 +308,8 @@ func handleNonInteractiveMode(appCtx *AppContext, wafSourceName string) (*aws.WA
 func handleInteractiveMode(appCtx *AppContext, wafv2Mgr *aws.WAFv2Manager) (*aws.WAFLogSource, error) {
     appCtx.Logger.Info("Starting WAF Web ACL discovery...")
 
-    discoveredSources, err := aws.DiscoverWAFLogSources(wafv2Mgr, appCtx.Config, appCtx.Logger)
+    discoveryCache := aws.NewDiscoveryCache(appCtx.Config.DiscoveryCache)
+    discoveredSources, err := aws.DiscoverWAFLogSourcesCached(wafv2Mgr, appCtx.Config, discoveryCache, *refreshFlag, appCtx.Logger)
     if err != nil {
         return nil, fmt.Errorf("error during WAF Log Source Discovery: %w", err)
     }
@@ -210,20 +329,32 @@ func handleInteractiveMode(appCtx *AppContext, wafv2Mgr *aws.WAFv2Manager) (*aws
 }
 
 // processWAFSource handles the log retrieval for a selected WAF source
-func processWAFSource(appCtx *AppContext, source *aws.WAFLogSource, s3Mgr *aws.S3Manager, cwLogsMgr *aws.CWLogsManager) error {
+func processWAFSource(appCtx *AppContext, source *aws.WAFLogSource, s3Mgr *aws.S3Manager, cwLogsMgr *aws.CWLogsManager) (err error) {
     appCtx.Logger.Infof("Processing logs for WAF Web ACL: %s", source.WebACLName)
     appCtx.Logger.Infof("Log destination type: %s", source.LogSourceType)
 
-    var logCount int
-    var err error
+    ctx, phase := telemetry.StartPhase(context.Background(), telemetry.PhaseRetrieve,
+        attribute.String("waf.profile", source.ProfileName),
+        attribute.String("waf.web_acl", source.WebACLName),
+        attribute.String("waf.log_source_type", source.LogSourceType))
+    defer func() { phase.End(ctx, err) }()
+
+    var result *aws.RetrievalResult
+    startTime := appCtx.StartTime
+    if *sinceLastRunFlag {
+        startTime = aws.SinceLastRun(appCtx.StorageManager, source, startTime, appCtx.Logger)
+    }
 
     switch source.LogSourceType {
     case "s3":
         appCtx.Logger.Infof("Retrieving logs from S3 bucket: %s", source.S3BucketName)
-        logCount, err = aws.RetrieveLogsFromS3(s3Mgr, source, appCtx.StartTime, appCtx.EndTime, *outputDirFlag, appCtx.Logger)
+        result, err = aws.RetrieveLogsFromS3(s3Mgr, source, startTime, appCtx.EndTime, appCtx.Logger)
     case "cloudwatchlogs":
         appCtx.Logger.Infof("Retrieving logs from CloudWatch Logs group: %s", source.CWLogsGroupName)
-        logCount, err = aws.RetrieveLogsFromCWLogs(cwLogsMgr, source, appCtx.StartTime, appCtx.EndTime, *outputDirFlag, appCtx.Logger)
+        result, err = aws.RetrieveLogsFromCWLogs(cwLogsMgr, source, startTime, appCtx.EndTime, appCtx.Logger)
+    case "firehose":
+        appCtx.Logger.Infof("Retrieving logs delivered to S3 by Firehose delivery stream: %s", source.DestinationARN)
+        result, err = aws.RetrieveLogsFromFirehose(s3Mgr, source, startTime, appCtx.EndTime, appCtx.Logger)
     default:
         return fmt.Errorf("unsupported log source type: %s", source.LogSourceType)
     }
@@ -231,9 +362,278 @@ func processWAFSource(appCtx *AppContext, source *aws.WAFLogSource, s3Mgr *aws.S
     if err != nil {
         return fmt.Errorf("failed to retrieve logs: %w", err)
     }
+    defer func() {
+        phase.AddFiles(ctx, result.Retrieved)
+        phase.AddRecords(ctx, result.Records)
+        phase.SetAttributes(attribute.Int("waf.found", result.Found), attribute.Int("waf.retrieved", result.Retrieved),
+            attribute.Int("waf.failed", len(result.Failed)))
+    }()
+
+    if len(result.Failed) > 0 {
+        sourceReport := aws.NewSourceReport(source, result, nil)
+        if *wafSourceFlag == "" && promptRetry(len(sourceReport.FailedItems)) {
+            policy := aws.NewRetryPolicy(appCtx.Config.LogRetrieval)
+            sourceReport = aws.RetryFailedItems(sourceReport, s3Mgr, cwLogsMgr, policy, appCtx.Logger)
+            result.Retrieved += sourceReport.Retrieved
+            result.Failed = sourceReport.FailedItems
+        }
+    }
+
+    if len(result.Failed) > 0 {
+        for _, item := range result.Failed {
+            appCtx.Logger.Warningf("Not retrieved: %s: %s", item.Key, item.Error)
+        }
+
+        // Record the failures so they can be retried later with -retry-failed
+        report := &aws.RunReport{
+            StartedAt:  time.Now().UTC(),
+            FinishedAt: time.Now().UTC(),
+            RangeStart: startTime,
+            RangeEnd:   appCtx.EndTime,
+            Sources:    []aws.SourceReport{aws.NewSourceReport(source, result, nil)},
+        }
+        if reportPath, err := report.WriteJSON(*outputDirFlag); err != nil {
+            appCtx.Logger.Errorf("Failed to write retrieval report: %v", err)
+        } else {
+            appCtx.Logger.Infof("%d items failed; retry them with: retrieve -retry-failed -report %s", len(result.Failed), reportPath)
+        }
+
+        if result.Retrieved+result.Skipped == 0 {
+            return fmt.Errorf("none of the %d log files could be retrieved", result.Found)
+        }
+    }
+
+    aws.RecordRunState(appCtx.StorageManager, source, result, startTime, appCtx.EndTime, appCtx.Logger)
+    if result.Skipped > 0 {
+        appCtx.Logger.Infof("Successfully retrieved %d of %d log files for WAF Web ACL: %s (%d downloaded by the interrupted run)",
+            result.Retrieved, result.Found, source.WebACLName, result.Skipped)
+    } else {
+        appCtx.Logger.Infof("Successfully retrieved %d of %d log files for WAF Web ACL: %s", result.Retrieved, result.Found, source.WebACLName)
+    }
+    appCtx.Logger.Infof("Logs stored in: %s", appCtx.StorageManager.WebACLDir(source.ProfileName, source.DirName()))
+    return nil
+}
+
+// runBatch retrieves logs for every source of the selected profile, writes the
+// end-of-run report and returns the process exit code
+func runBatch(appCtx *AppContext, s3Mgr *aws.S3Manager, cwLogsMgr *aws.CWLogsManager, wafv2Mgr *aws.WAFv2Manager) int {
+    sources, err := batchSources(appCtx, wafv2Mgr)
+    if err != nil {
+        appCtx.Logger.Errorf("Failed to select WAF sources: %v", err)
+        return 1
+    }
+    if len(sources) == 0 {
+        appCtx.Logger.Error("No WAF Log Sources found for batch retrieval. Exiting.")
+        return 1
+    }
+    appCtx.Logger.Infof("Retrieving logs for %d WAF sources", len(sources))
+    unlock, err := lockSources(appCtx, sources)
+    if err != nil {
+        appCtx.Logger.Errorf("%v", err)
+        return 1
+    }
+    defer unlock()
+
+    ctx, phase := telemetry.StartPhase(context.Background(), telemetry.PhaseRetrieve, attribute.Int("waf.sources", len(sources)))
+
+    // Concurrent retrievals cannot share the terminal for confirmation prompts
+    s3Mgr.SkipConfirmation = true
+    retrievalCfg := appCtx.Config.LogRetrieval
+    report := aws.BatchRetrieveLogs(sources, s3Mgr, cwLogsMgr, appCtx.StartTime, appCtx.EndTime,
+        appCtx.Logger, retrievalCfg.MaxConcurrentDownloads, *sinceLastRunFlag)
+    thresholdErr := report.CheckThresholds(retrievalCfg.FailureThresholds)
+    recordReportTelemetry(ctx, phase, report)
+    phase.End(ctx, thresholdErr)
+
+    for _, source := range sources {
+        if err := saveWebACLSnapshot(appCtx, wafv2Mgr, source); err != nil {
+            appCtx.Logger.Warningf("Failed to capture Web ACL snapshot for %s: %v", source.WebACLName, err)
+        }
+    }
+
+    fmt.Println()
+    report.PrintTable(os.Stdout)
+    reportPath, err := report.WriteJSON(*outputDirFlag)
+    if err != nil {
+        appCtx.Logger.Errorf("Failed to write retrieval report: %v", err)
+    } else {
+        appCtx.Logger.Infof("Retrieval report saved to: %s", reportPath)
+    }
+
+    if thresholdErr != nil {
+        appCtx.Logger.Errorf("Batch retrieval exceeded failure thresholds: %v", thresholdErr)
+        return 1
+    }
+    return 0
+}
+
+// runRetryFailed retries the failed items recorded in a previous retrieval report and
+// returns the process exit code
+func runRetryFailed(appCtx *AppContext, s3Mgr *aws.S3Manager, cwLogsMgr *aws.CWLogsManager) int {
+    reportPath := *reportFlag
+    if reportPath == "" {
+        var err error
+        if reportPath, err = aws.LatestRunReportPath(*outputDirFlag); err != nil {
+            appCtx.Logger.Errorf("Failed to find a retrieval report: %v", err)
+            return 1
+        }
+        if reportPath == "" {
+            appCtx.Logger.Errorf("No retrieval report found in %s; nothing to retry", *outputDirFlag)
+            return 1
+        }
+    }
+
+    previous, err := aws.LoadRunReport(reportPath)
+    if err != nil {
+        appCtx.Logger.Errorf("Failed to load retrieval report: %v", err)
+        return 1
+    }
+    appCtx.Logger.Infof("Retrying failed items from %s", reportPath)
+    var sources []*aws.WAFLogSource
+    for _, source := range previous.Sources {
+        if len(source.FailedItems) > 0 && source.Source != nil {
+            sources = append(sources, source.Source)
+        }
+    }
+    unlock, err := lockSources(appCtx, sources)
+    if err != nil {
+        appCtx.Logger.Errorf("%v", err)
+        return 1
+    }
+    defer unlock()
+
+    ctx, phase := telemetry.StartPhase(context.Background(), telemetry.PhaseRetrieve, attribute.Bool("waf.retry", true))
+    policy := aws.NewRetryPolicy(appCtx.Config.LogRetrieval)
+    report := aws.RetryFailedSources(previous, s3Mgr, cwLogsMgr, policy, appCtx.Logger)
+    thresholdErr := report.CheckThresholds(appCtx.Config.LogRetrieval.FailureThresholds)
+    recordReportTelemetry(ctx, phase, report)
+    phase.End(ctx, thresholdErr)
+    if len(report.Sources) == 0 {
+        appCtx.Logger.Info("The retrieval report has no failed items to retry")
+        return 0
+    }
+
+    fmt.Println()
+    report.PrintTable(os.Stdout)
+    newReportPath, err := report.WriteJSON(*outputDirFlag)
+    if err != nil {
+        appCtx.Logger.Errorf("Failed to write retrieval report: %v", err)
+    } else {
+        appCtx.Logger.Infof("Retry report saved to: %s", newReportPath)
+    }
+
+    if thresholdErr != nil {
+        appCtx.Logger.Errorf("Retry exceeded failure thresholds: %v", thresholdErr)
+        return 1
+    }
+    return 0
+}
+
+// lockSources locks the directories of the Web ACLs retrieval writes to, so that
+// concurrent runs cannot corrupt their manifests and indexes, and returns a function
+// releasing them
+func lockSources(appCtx *AppContext, sources []*aws.WAFLogSource) (func(), error) {
+    var locks []*storage.Lock
+    release := func() {
+        for _, lock := range locks {
+            releaseLock(lock, appCtx.Logger.Warningf)
+        }
+    }
+    seen := make(map[string]bool)
+    for _, source := range sources {
+        aclDir := appCtx.StorageManager.WebACLDir(source.ProfileName, source.DirName())
+        if seen[aclDir] {
+            continue
+        }
+        seen[aclDir] = true
+        lock, err := lockWebACL(aclDir, "retrieve", *forceUnlockFlag, appCtx.Logger.Infof, appCtx.Logger.Warningf)
+        if err != nil {
+            release()
+            return nil, err
+        }
+        locks = append(locks, lock)
+    }
+    return release, nil
+}
+
+// recordReportTelemetry adds a run report's totals to a retrieval phase
+func recordReportTelemetry(ctx context.Context, phase *telemetry.Phase, report *aws.RunReport) {
+    retrieved, records := 0, 0
+    for _, source := range report.Sources {
+        retrieved += source.Retrieved
+        records += source.Records
+    }
+    phase.AddFiles(ctx, retrieved)
+    phase.AddRecords(ctx, records)
+    phase.SetAttributes(
+        attribute.Int("waf.sources.success", report.CountByStatus(aws.StatusSuccess)),
+        attribute.Int("waf.sources.partial", report.CountByStatus(aws.StatusPartial)),
+        attribute.Int("waf.sources.failed", report.CountByStatus(aws.StatusFailed)))
+}
+
+// flushTelemetry exports any buffered spans and metrics
+func flushTelemetry(appCtx *AppContext) {
+    if err := telemetry.Shutdown(appCtx.ShutdownTelemetry); err != nil {
+        appCtx.Logger.Warningf("%v", err)
+    }
+}
+
+// exit flushes telemetry and profiles before exiting, since os.Exit skips deferred calls
+func exit(appCtx *AppContext, code int) {
+    flushTelemetry(appCtx)
+    stopProfiling()
+    os.Exit(code)
+}
+
+// promptRetry asks the user whether to retry the failed items right away
+func promptRetry(failed int) bool {
+    fmt.Printf("\n%d items could not be retrieved. Retry them now? (y/n): ", failed)
+    var userResp string
+    _, _ = fmt.Scanln(&userResp)
+    return strings.ToLower(userResp) == "y"
+}
+
+// batchSources returns the profile's sources from waf-config.json, or discovers them if none are configured
+func batchSources(appCtx *AppContext, wafv2Mgr *aws.WAFv2Manager) ([]*aws.WAFLogSource, error) {
+    if appCtx.WAFConfig != nil && len(appCtx.WAFConfig.WAFLogSources) > 0 {
+        var sources []*aws.WAFLogSource
+        for i := range appCtx.WAFConfig.WAFLogSources {
+            sourceCfg := &appCtx.WAFConfig.WAFLogSources[i]
+            if *profileFlag == "" || sourceCfg.ProfileName == *profileFlag {
+                sources = append(sources, aws.ConvertWAFLogSource(sourceCfg))
+            }
+        }
+        return sources, nil
+    }
+
+    appCtx.Logger.Info("No WAF sources configured; discovering Web ACLs with logging enabled...")
+    discoveryCache := aws.NewDiscoveryCache(appCtx.Config.DiscoveryCache)
+    return aws.DiscoverWAFLogSourcesCached(wafv2Mgr, appCtx.Config, discoveryCache, *refreshFlag, appCtx.Logger)
+}
+
+// saveWebACLSnapshot writes the current Web ACL definition into the source's snapshot directory
+func saveWebACLSnapshot(appCtx *AppContext, wafv2Mgr *aws.WAFv2Manager, source *aws.WAFLogSource) error {
+    snapshot, err := aws.GetWebACLSnapshot(wafv2Mgr, source, appCtx.Logger)
+    if err != nil {
+        return err
+    }
+
+    data, err := json.MarshalIndent(snapshot, "", "  ")
+    if err != nil {
+        return fmt.Errorf("failed to encode snapshot: %w", err)
+    }
+
+    snapshotDir := filepath.Join(*outputDirFlag, source.ProfileName, source.DirName(), analysis.SnapshotDirName)
+    if err := appCtx.StorageManager.EnsureDirExists(snapshotDir); err != nil {
+        return err
+    }
+
+    snapshotPath := filepath.Join(snapshotDir, fmt.Sprintf("webacl_%s.json", snapshot.CapturedAt.Format("20060102_150405")))
+    if err := storage.WriteFileAtomic(snapshotPath, data); err != nil {
+        return fmt.Errorf("failed to write snapshot: %w", err)
+    }
 
-    appCtx.Logger.Infof("Successfully retrieved %d log files for WAF Web ACL: %s", logCount, source.WebACLName)
-    appCtx.Logger.Infof("Logs stored in: %s", filepath.Join(*outputDirFlag, source.ProfileName, source.WebACLName))
+    appCtx.Logger.Infof("Web ACL snapshot saved to: %s", snapshotPath)
     return nil
 }
 
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strings"
+
+	"waf-log-retriever/analysis"
+	"waf-log-retriever/storage"
+	"waf-log-retriever/workspace"
+)
+
+// manifestCommands maps the manifest subcommands to their entry points
+var manifestCommands = map[string]func(args []string) int{
+	"verify": runManifestVerify,
+}
+
+// runManifest dispatches the manifest subcommands, which audit retrieved log files
+func runManifest(args []string) int {
+	if len(args) > 0 {
+		if command, ok := manifestCommands[args[0]]; ok {
+			return command(args[1:])
+		}
+	}
+	names := make([]string, 0, len(manifestCommands))
+	for name := range manifestCommands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	fmt.Printf("manifest requires a subcommand: %s\n", strings.Join(names, ", "))
+	return 2
+}
+
+// runManifestVerify audits the retrieved logs of a Web ACL against its manifest
+func runManifestVerify(args []string) int {
+	fs := flag.NewFlagSet("manifest verify", flag.ExitOnError)
+	outputDir := fs.String("output-dir", "../logs/raw", "Directory containing retrieved logs")
+	profile := fs.String("profile", "", "AWS profile name the logs were retrieved with")
+	webACL := fs.String("web-acl", "", "Name of the Web ACL whose logs to verify")
+	adopt := fs.Bool("adopt-orphans", false, "Record orphaned files in the manifest, e.g. logs retrieved before it existed")
+	jsonOutput := fs.Bool("json", false, "Write the audit as JSON")
+	forceUnlock := fs.Bool("force-unlock", false, "With -adopt-orphans, take over the lock of the Web ACL's directory even if another run appears to hold it")
+	fs.Parse(args)
+
+	if *profile == "" || *webACL == "" {
+		fmt.Println("manifest verify requires -profile and -web-acl")
+		fs.Usage()
+		return 2
+	}
+
+	aclDir := filepath.Join(*outputDir, *profile, *webACL)
+	// Only adopting orphans writes to the manifest; a plain audit runs alongside others
+	if *adopt {
+		lock, err := lockWebACL(aclDir, "manifest verify", *forceUnlock, printInfo, printWarning)
+		if err != nil {
+			fmt.Printf("%v\n", err)
+			return 1
+		}
+		defer releaseLock(lock, printWarning)
+	}
+	files, err := analysis.ListLogFiles(aclDir)
+	if err != nil {
+		fmt.Printf("%v\n", err)
+		return 1
+	}
+	// The workspace changes with every review, so only the log files are audited
+	files = slices.DeleteFunc(files, func(file string) bool {
+		return file == filepath.Join(aclDir, workspace.FileName)
+	})
+	report, err := storage.VerifyManifest(aclDir, files)
+	if err != nil {
+		fmt.Printf("Failed to verify %s: %v\n", aclDir, err)
+		return 1
+	}
+
+	if *adopt && len(report.Orphaned) > 0 {
+		entries := make([]storage.ManifestEntry, 0, len(report.Orphaned))
+		for _, rel := range report.Orphaned {
+			entry, err := storage.FileEntry(aclDir, filepath.Join(aclDir, filepath.FromSlash(rel)), "adopted")
+			if err != nil {
+				fmt.Printf("%v\n", err)
+				return 1
+			}
+			entries = append(entries, entry)
+		}
+		if err := storage.AppendManifest(aclDir, entries...); err != nil {
+			fmt.Printf("%v\n", err)
+			return 1
+		}
+		fmt.Fprintf(os.Stderr, "Adopted %d orphaned files into %s\n", len(entries), filepath.Join(aclDir, storage.ManifestFileName))
+		report.Entries += len(entries)
+		report.Verified += len(entries)
+		report.Orphaned = []string{}
+	}
+
+	if *jsonOutput {
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		if err := encoder.Encode(report); err != nil {
+			fmt.Printf("Failed to encode audit: %v\n", err)
+			return 1
+		}
+	} else {
+		printManifestReport(aclDir, report)
+	}
+	if !report.OK() {
+		return 1
+	}
+	return 0
+}
+
+// printManifestReport prints an audit, listing every discrepancy
+func printManifestReport(aclDir string, report *storage.ManifestReport) {
+	fmt.Printf("Manifest %s: %d entries\n", filepath.Join(aclDir, storage.ManifestFileName), report.Entries)
+	fmt.Printf("  Verified: %d\n", report.Verified)
+	for _, group := range []struct {
+		name  string
+		files []string
+		hint  string
+	}{
+		{"Missing", report.Missing, "recorded but no longer on disk"},
+		{"Modified", report.Modified, "checksum differs from the one recorded"},
+		{"Orphaned", report.Orphaned, "on disk but never recorded; -adopt-orphans records them"},
+	} {
+		fmt.Printf("  %s: %d", group.name, len(group.files))
+		if len(group.files) > 0 {
+			fmt.Printf(" (%s)", group.hint)
+		}
+		fmt.Println()
+		for _, file := range group.files {
+			fmt.Printf("    %s\n", file)
+		}
+	}
+	if report.OK() {
+		fmt.Println("All files match the manifest")
+	}
+}
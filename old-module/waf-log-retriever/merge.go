@@ -0,0 +1,154 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+
+	"waf-log-retriever/analysis"
+	"waf-log-retriever/logging"
+)
+
+// runMerge merges partial aggregates, written by analyze -partials on one or more
+// machines, and analyzes the merged statistics like analyze
+func runMerge(args []string) int {
+	fs := flag.NewFlagSet("merge", flag.ExitOnError)
+	outputDir := fs.String("output-dir", "../logs/raw", "Directory holding the Web ACL's log directory, where the result and snapshot are")
+	profile := fs.String("profile", "", "AWS profile name (default: the profile recorded in the partials)")
+	webACL := fs.String("web-acl", "", "Name of the Web ACL (default: the Web ACL recorded in the partials)")
+	checksDir := fs.String("checks-dir", "", "Directory of custom check scripts (*.star)")
+	narrativeFile := fs.String("narratives", "", "JSON file enabling model-drafted finding narratives (optional)")
+	signKey := fs.String("sign-key", "", "PEM private key to sign the analysis result with (optional)")
+	combine := fs.Bool("combine", false, "Merge partials of several Web ACLs or accounts into one analysis, written for -profile and -web-acl")
+	logLevel := fs.String("log-level", "INFO", "Logging level (DEBUG, INFO, WARNING, ERROR)")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: merge [flags] <partial file or directory>...\n")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+
+	if fs.NArg() == 0 {
+		fmt.Println("merge requires at least one partial aggregate file or directory")
+		fs.Usage()
+		return 2
+	}
+
+	logger, err := logging.SetupLogger(*logLevel)
+	if err != nil {
+		fmt.Printf("Failed to initialize application: %v\n", err)
+		return 1
+	}
+	defer logger.Close()
+
+	paths, err := partialPaths(fs.Args())
+	if err != nil {
+		logger.Errorf("%v", err)
+		return 1
+	}
+	partials := make([]*analysis.Partial, 0, len(paths))
+	var migrated int
+	caveats := make(map[string]int)
+	var caveatOrder []string
+	for _, path := range paths {
+		p, err := analysis.ReadPartial(path)
+		if err != nil {
+			logger.Errorf("%v", err)
+			return 1
+		}
+		if p.MigratedFrom > 0 {
+			logger.Debugf("Migrated partial aggregate %s from schema version %d", path, p.MigratedFrom)
+			migrated++
+			for _, caveat := range p.Caveats {
+				if caveats[caveat] == 0 {
+					caveatOrder = append(caveatOrder, caveat)
+				}
+				caveats[caveat]++
+			}
+		}
+		partials = append(partials, p)
+	}
+	if migrated > 0 {
+		logger.Infof("Migrated %d partial aggregates written by older versions to schema version %d", migrated, analysis.PartialSchemaVersion)
+		for _, caveat := range caveatOrder {
+			logger.Warningf("%d migrated partial aggregates have %s", caveats[caveat], caveat)
+		}
+	}
+	merged, err := analysis.MergePartials(partials, *combine, logger)
+	if err != nil {
+		logger.Errorf("Failed to merge partial aggregates: %v", err)
+		return 1
+	}
+
+	if *profile == "" {
+		*profile = merged.ProfileName
+	}
+	if *webACL == "" {
+		*webACL = merged.WebACLName
+	}
+	if *profile == "" || *webACL == "" {
+		fmt.Println("The partials record no single Web ACL; merge requires -profile and -web-acl")
+		return 2
+	}
+	aclDir := filepath.Join(*outputDir, *profile, *webACL)
+	removeStaleTempFiles(aclDir, logger.Infof, logger.Warningf)
+
+	result, err := analyzeStats(*profile, *webACL, aclDir, *checksDir, merged.Stats, merged.Settings, merged.Files, logger)
+	if err != nil {
+		logger.Errorf("Analysis failed: %v", err)
+		return 1
+	}
+	if result.Environment, err = mergedEnvironment(aclDir, *checksDir, merged, logger); err != nil {
+		logger.Errorf("Failed to capture the analysis environment: %v", err)
+		return 1
+	}
+	return writeAnalysis(result, aclDir, *narrativeFile, *signKey, logger)
+}
+
+// partialPaths expands directories among the arguments to the partial aggregates in them
+func partialPaths(args []string) ([]string, error) {
+	var paths []string
+	for _, arg := range args {
+		info, err := os.Stat(arg)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read partial aggregate: %w", err)
+		}
+		if !info.IsDir() {
+			paths = append(paths, arg)
+			continue
+		}
+		matches, err := filepath.Glob(filepath.Join(arg, "*"+analysis.PartialExtension))
+		if err != nil {
+			return nil, fmt.Errorf("failed to list partial aggregates: %w", err)
+		}
+		if len(matches) == 0 {
+			return nil, fmt.Errorf("no partial aggregates (*%s) in %s", analysis.PartialExtension, arg)
+		}
+		sort.Strings(matches)
+		paths = append(paths, matches...)
+	}
+	return paths, nil
+}
+
+// mergedEnvironment records the environment of a merged analysis from the input
+// manifests of the partials and the local Web ACL snapshot, if there is one
+func mergedEnvironment(aclDir, checksDir string, merged *analysis.Merged, logger logging.Logger) (*analysis.Environment, error) {
+	if merged.Inputs == nil {
+		logger.Warning("Some partials record no input manifest; the input manifest hash only covers the snapshot")
+	}
+	manifest := append([]analysis.ManifestEntry(nil), merged.Inputs...)
+	snapshotPath, err := analysis.LatestSnapshotPath(aclDir)
+	if err != nil {
+		return nil, err
+	}
+	if snapshotPath != "" {
+		snapshot, err := analysis.BuildInputManifest(aclDir, []string{snapshotPath})
+		if err != nil {
+			return nil, err
+		}
+		manifest = append(manifest, snapshot...)
+		sort.Slice(manifest, func(i, j int) bool { return manifest[i].Path < manifest[j].Path })
+	}
+	return environmentOf(manifest, checksDir, merged.Settings)
+}
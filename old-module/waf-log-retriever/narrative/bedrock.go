@@ -0,0 +1,129 @@
+package narrative
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	v4 "github.com/aws/aws-sdk-go-v2/aws/signer/v4"
+	awsconfig "github.com/aws/aws-sdk-go-v2/config"
+)
+
+// bedrockProvider calls the Amazon Bedrock Converse API, signing requests with the
+// AWS credentials of the configured profile
+type bedrockProvider struct {
+	cfg      *Config
+	awsCfg   aws.Config
+	endpoint string
+	signer   *v4.Signer
+	client   *http.Client
+}
+
+// newBedrockProvider loads AWS credentials and resolves the Bedrock runtime endpoint
+func newBedrockProvider(ctx context.Context, cfg *Config) (*bedrockProvider, error) {
+	var options []func(*awsconfig.LoadOptions) error
+	if cfg.Profile != "" {
+		options = append(options, awsconfig.WithSharedConfigProfile(cfg.Profile))
+	}
+	if cfg.Region != "" {
+		options = append(options, awsconfig.WithRegion(cfg.Region))
+	}
+	awsCfg, err := awsconfig.LoadDefaultConfig(ctx, options...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load AWS config for Bedrock: %w", err)
+	}
+	if awsCfg.Region == "" {
+		return nil, fmt.Errorf("no region configured for Bedrock; set region in the narrative config")
+	}
+
+	endpoint := cfg.Endpoint
+	if endpoint == "" {
+		endpoint = fmt.Sprintf("https://bedrock-runtime.%s.amazonaws.com", awsCfg.Region)
+	}
+	return &bedrockProvider{
+		cfg:      cfg,
+		awsCfg:   awsCfg,
+		endpoint: strings.TrimSuffix(endpoint, "/"),
+		signer:   v4.NewSigner(),
+		client:   &http.Client{},
+	}, nil
+}
+
+type converseText struct {
+	Text string `json:"text"`
+}
+
+type converseMessage struct {
+	Role    string         `json:"role"`
+	Content []converseText `json:"content"`
+}
+
+type converseRequest struct {
+	System          []converseText    `json:"system"`
+	Messages        []converseMessage `json:"messages"`
+	InferenceConfig struct {
+		MaxTokens   int     `json:"maxTokens"`
+		Temperature float64 `json:"temperature"`
+	} `json:"inferenceConfig"`
+}
+
+type converseResponse struct {
+	Output struct {
+		Message converseMessage `json:"message"`
+	} `json:"output"`
+}
+
+// Complete sends one Converse request
+func (p *bedrockProvider) Complete(ctx context.Context, system, prompt string) (string, error) {
+	input := converseRequest{
+		System:   []converseText{{Text: system}},
+		Messages: []converseMessage{{Role: "user", Content: []converseText{{Text: prompt}}}},
+	}
+	input.InferenceConfig.MaxTokens = p.cfg.MaxTokens
+	input.InferenceConfig.Temperature = p.cfg.Temperature
+	body, err := json.Marshal(input)
+	if err != nil {
+		return "", fmt.Errorf("failed to encode Converse request: %w", err)
+	}
+
+	endpoint := fmt.Sprintf("%s/model/%s/converse", p.endpoint, url.PathEscape(p.cfg.Model))
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, endpoint, bytes.NewReader(body))
+	if err != nil {
+		return "", fmt.Errorf("failed to create Converse request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	creds, err := p.awsCfg.Credentials.Retrieve(ctx)
+	if err != nil {
+		return "", fmt.Errorf("failed to retrieve AWS credentials: %w", err)
+	}
+	payloadHash := sha256.Sum256(body)
+	if err := p.signer.SignHTTP(ctx, creds, req, hex.EncodeToString(payloadHash[:]), "bedrock", p.awsCfg.Region, time.Now()); err != nil {
+		return "", fmt.Errorf("failed to sign Converse request: %w", err)
+	}
+
+	data, err := doRequest(p.client, req)
+	if err != nil {
+		return "", err
+	}
+	var resp converseResponse
+	if err := json.Unmarshal(data, &resp); err != nil {
+		return "", fmt.Errorf("failed to parse Converse response: %w", err)
+	}
+	var text strings.Builder
+	for _, content := range resp.Output.Message.Content {
+		text.WriteString(content.Text)
+	}
+	if text.Len() == 0 {
+		return "", fmt.Errorf("Converse response has no text")
+	}
+	return text.String(), nil
+}
@@ -0,0 +1,213 @@
+// Package narrative drafts finding descriptions and remediation narratives with a
+// language model. It is opt-in: nothing is sent anywhere unless a config enables it,
+// and only the structured findings are sent, never raw log records.
+package narrative
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"waf-log-retriever/analysis"
+	"waf-log-retriever/logging"
+)
+
+// Provider names
+const (
+	ProviderBedrock = "bedrock"
+	ProviderOpenAI  = "openai" // Any OpenAI-compatible chat completions endpoint
+)
+
+// Config selects and tunes the model endpoint. The zero value is disabled.
+type Config struct {
+	Enabled        bool    `json:"enabled"`
+	Provider       string  `json:"provider"`       // bedrock or openai
+	Model          string  `json:"model"`          // Bedrock model ID or OpenAI model name
+	Endpoint       string  `json:"endpoint"`       // OpenAI base URL, or a Bedrock (VPC) endpoint override
+	Region         string  `json:"region"`         // Bedrock region
+	Profile        string  `json:"profile"`        // AWS profile for Bedrock (default: the default credential chain)
+	APIKeyEnv      string  `json:"apiKeyEnv"`      // Environment variable holding the OpenAI API key
+	MaxFindings    int     `json:"maxFindings"`    // Most severe findings to draft narratives for; 0 means all
+	MinSeverity    string  `json:"minSeverity"`    // Skip findings less severe than this
+	MaxTokens      int     `json:"maxTokens"`      // Response length limit per finding
+	Temperature    float64 `json:"temperature"`    // Sampling temperature
+	TimeoutSeconds int     `json:"timeoutSeconds"` // Per request
+}
+
+// DefaultConfig returns the disabled default configuration
+func DefaultConfig() *Config {
+	return &Config{
+		APIKeyEnv:      "OPENAI_API_KEY",
+		MaxTokens:      800,
+		Temperature:    0.2,
+		TimeoutSeconds: 60,
+	}
+}
+
+// LoadConfig reads a narrative config file over the defaults
+func LoadConfig(path string) (*Config, error) {
+	cfg := DefaultConfig()
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read narrative config: %w", err)
+	}
+	if err := json.Unmarshal(data, cfg); err != nil {
+		return nil, fmt.Errorf("failed to parse narrative config %s: %w", path, err)
+	}
+	if err := cfg.Validate(); err != nil {
+		return nil, fmt.Errorf("invalid narrative config %s: %w", path, err)
+	}
+	return cfg, nil
+}
+
+// Validate checks an enabled config names a provider and model it can reach
+func (c *Config) Validate() error {
+	if !c.Enabled {
+		return nil
+	}
+	switch c.Provider {
+	case ProviderBedrock:
+		if c.Region == "" && c.Endpoint == "" {
+			return fmt.Errorf("bedrock needs a region or an endpoint")
+		}
+	case ProviderOpenAI:
+		if c.Endpoint == "" {
+			return fmt.Errorf("openai needs an endpoint, e.g. https://api.openai.com/v1")
+		}
+	default:
+		return fmt.Errorf("unknown provider %q (want %s or %s)", c.Provider, ProviderBedrock, ProviderOpenAI)
+	}
+	if c.Model == "" {
+		return fmt.Errorf("model is required")
+	}
+	if c.MinSeverity != "" && !analysis.ValidSeverity(c.MinSeverity) {
+		return fmt.Errorf("unknown minSeverity %q", c.MinSeverity)
+	}
+	if c.MaxTokens <= 0 || c.TimeoutSeconds <= 0 {
+		return fmt.Errorf("maxTokens and timeoutSeconds must be positive")
+	}
+	return nil
+}
+
+// Provider sends one prompt to a model and returns its reply
+type Provider interface {
+	Complete(ctx context.Context, system, prompt string) (string, error)
+}
+
+// NewProvider creates the provider an enabled config selects
+func NewProvider(ctx context.Context, cfg *Config) (Provider, error) {
+	switch cfg.Provider {
+	case ProviderBedrock:
+		return newBedrockProvider(ctx, cfg)
+	case ProviderOpenAI:
+		return newOpenAIProvider(cfg)
+	}
+	return nil, fmt.Errorf("unknown narrative provider %q", cfg.Provider)
+}
+
+// systemPrompt frames the model's task; the finding itself is the user prompt
+const systemPrompt = `You are an AWS WAF security reviewer writing a client-facing assessment report.
+You are given one finding from an automated analysis of a Web ACL's logs and configuration, as JSON.
+Use only the evidence in the finding; do not invent numbers, rule names or resources.
+Reply with a JSON object with two string fields and nothing else:
+"description": two to four sentences explaining what was observed and why it matters,
+"remediation": concrete steps to address it in AWS WAF, as short sentences.`
+
+// evidence is what is sent to the model for one finding
+type evidence struct {
+	WebACLName    string `json:"webACLName"`
+	ID            string `json:"id"`
+	Severity      string `json:"severity"`
+	Title         string `json:"title"`
+	Description   string `json:"description,omitempty"`
+	Source        string `json:"source"`
+	EndpointClass string `json:"endpointClass,omitempty"`
+}
+
+// Draft adds model-drafted narratives to the findings of a result, most severe first.
+// A finding whose draft fails keeps its generated description; the failure is logged.
+// It returns the number of narratives drafted.
+func Draft(ctx context.Context, cfg *Config, provider Provider, result *analysis.Result, logger logging.Logger) int {
+	targets := selectFindings(cfg, result.Findings)
+	logger.Infof("Drafting narratives for %d of %d findings with %s model %s", len(targets), len(result.Findings), cfg.Provider, cfg.Model)
+
+	drafted := 0
+	for _, i := range targets {
+		f := &result.Findings[i]
+		n, err := draftOne(ctx, cfg, provider, result.WebACLName, f)
+		if err != nil {
+			logger.Warningf("Failed to draft a narrative for finding %s: %v", f.ID, err)
+			continue
+		}
+		f.Narrative = n
+		drafted++
+	}
+	return drafted
+}
+
+// selectFindings returns the indexes of the findings to draft, most severe first
+func selectFindings(cfg *Config, findings []analysis.Finding) []int {
+	minRank := analysis.SeverityRank(cfg.MinSeverity)
+	var targets []int
+	for rank := analysis.SeverityRank(analysis.SeverityCritical); rank >= 0 && rank >= minRank; rank-- {
+		for i, f := range findings {
+			if analysis.SeverityRank(f.Severity) == rank {
+				targets = append(targets, i)
+			}
+		}
+	}
+	if cfg.MaxFindings > 0 && len(targets) > cfg.MaxFindings {
+		targets = targets[:cfg.MaxFindings]
+	}
+	return targets
+}
+
+// draftOne asks the model for the narrative of one finding
+func draftOne(ctx context.Context, cfg *Config, provider Provider, webACLName string, f *analysis.Finding) (*analysis.Narrative, error) {
+	prompt, err := json.MarshalIndent(evidence{
+		WebACLName:    webACLName,
+		ID:            f.ID,
+		Severity:      f.Severity,
+		Title:         f.Title,
+		Description:   f.Description,
+		Source:        f.Source,
+		EndpointClass: f.EndpointClass,
+	}, "", "  ")
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode finding: %w", err)
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, time.Duration(cfg.TimeoutSeconds)*time.Second)
+	defer cancel()
+	reply, err := provider.Complete(ctx, systemPrompt, string(prompt))
+	if err != nil {
+		return nil, err
+	}
+	n, err := parseReply(reply)
+	if err != nil {
+		return nil, err
+	}
+	n.Provider = cfg.Provider
+	n.Model = cfg.Model
+	return n, nil
+}
+
+// parseReply extracts the narrative from the model's reply. Models sometimes wrap
+// JSON in a Markdown code fence or add text around it, so the outermost object is used.
+func parseReply(reply string) (*analysis.Narrative, error) {
+	start, end := strings.Index(reply, "{"), strings.LastIndex(reply, "}")
+	if start < 0 || end < start {
+		return nil, fmt.Errorf("model reply is not a JSON object")
+	}
+	var n analysis.Narrative
+	if err := json.Unmarshal([]byte(reply[start:end+1]), &n); err != nil {
+		return nil, fmt.Errorf("failed to parse model reply: %w", err)
+	}
+	if n.Description == "" && n.Remediation == "" {
+		return nil, fmt.Errorf("model reply has no description or remediation")
+	}
+	return &n, nil
+}
@@ -0,0 +1,105 @@
+package narrative
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+)
+
+// openAIProvider calls an OpenAI-compatible chat completions endpoint, such as
+// OpenAI, Azure OpenAI, vLLM, Ollama or LiteLLM
+type openAIProvider struct {
+	cfg    *Config
+	apiKey string
+	client *http.Client
+}
+
+// newOpenAIProvider creates an OpenAI-compatible provider. The API key is optional,
+// since self-hosted endpoints often have none.
+func newOpenAIProvider(cfg *Config) (*openAIProvider, error) {
+	p := &openAIProvider{cfg: cfg, client: &http.Client{}}
+	if cfg.APIKeyEnv != "" {
+		p.apiKey = os.Getenv(cfg.APIKeyEnv)
+	}
+	return p, nil
+}
+
+type chatMessage struct {
+	Role    string `json:"role"`
+	Content string `json:"content"`
+}
+
+type chatRequest struct {
+	Model       string        `json:"model"`
+	Messages    []chatMessage `json:"messages"`
+	MaxTokens   int           `json:"max_tokens"`
+	Temperature float64       `json:"temperature"`
+}
+
+type chatResponse struct {
+	Choices []struct {
+		Message chatMessage `json:"message"`
+	} `json:"choices"`
+}
+
+// Complete sends one chat completion request
+func (p *openAIProvider) Complete(ctx context.Context, system, prompt string) (string, error) {
+	body, err := json.Marshal(chatRequest{
+		Model: p.cfg.Model,
+		Messages: []chatMessage{
+			{Role: "system", Content: system},
+			{Role: "user", Content: prompt},
+		},
+		MaxTokens:   p.cfg.MaxTokens,
+		Temperature: p.cfg.Temperature,
+	})
+	if err != nil {
+		return "", fmt.Errorf("failed to encode chat request: %w", err)
+	}
+
+	url := strings.TrimSuffix(p.cfg.Endpoint, "/") + "/chat/completions"
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return "", fmt.Errorf("failed to create chat request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if p.apiKey != "" {
+		req.Header.Set("Authorization", "Bearer "+p.apiKey)
+	}
+
+	data, err := doRequest(p.client, req)
+	if err != nil {
+		return "", err
+	}
+	var resp chatResponse
+	if err := json.Unmarshal(data, &resp); err != nil {
+		return "", fmt.Errorf("failed to parse chat response: %w", err)
+	}
+	if len(resp.Choices) == 0 {
+		return "", fmt.Errorf("chat response has no choices")
+	}
+	return resp.Choices[0].Message.Content, nil
+}
+
+// doRequest sends a request and returns the body of a successful response
+func doRequest(client *http.Client, req *http.Request) ([]byte, error) {
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to call %s: %w", req.URL.Host, err)
+	}
+	defer resp.Body.Close()
+
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read response from %s: %w", req.URL.Host, err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%s returned %s: %s", req.URL.Host, resp.Status, strings.TrimSpace(string(data)))
+	}
+	return data, nil
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"waf-log-retriever/analysis"
+	"waf-log-retriever/logging"
+	"waf-log-retriever/notebook"
+)
+
+// runNotebook exports an analysis result as CSV datasets with a pre-built Jupyter or
+// Observable notebook reading them
+func runNotebook(args []string) int {
+	fs := flag.NewFlagSet("notebook", flag.ExitOnError)
+	outputDir := fs.String("output-dir", "../logs/raw", "Directory containing retrieved logs")
+	profile := fs.String("profile", "", "AWS profile name the logs were retrieved with")
+	webACL := fs.String("web-acl", "", "Name of the Web ACL to export")
+	resultFile := fs.String("result", "", "Analysis result to export (default: the latest for the Web ACL)")
+	format := fs.String("format", notebook.FormatJupyter, "Notebook format: "+strings.Join(notebook.Formats, ", "))
+	out := fs.String("out", "", "Directory to export to (default: <output-dir>/<profile>/<web-acl>/notebooks/notebook_<timestamp>)")
+	logLevel := fs.String("log-level", "INFO", "Logging level (DEBUG, INFO, WARNING, ERROR)")
+	fs.Parse(args)
+
+	if *resultFile == "" && (*profile == "" || *webACL == "") {
+		fmt.Println("notebook requires -profile and -web-acl, or -result")
+		fs.Usage()
+		return 2
+	}
+
+	logger, err := logging.SetupLogger(*logLevel)
+	if err != nil {
+		fmt.Printf("Failed to initialize application: %v\n", err)
+		return 1
+	}
+	defer logger.Close()
+
+	resultPath := *resultFile
+	if resultPath == "" {
+		aclDir := filepath.Join(*outputDir, *profile, *webACL)
+		if resultPath, err = analysis.LatestResultPath(aclDir); err != nil {
+			logger.Errorf("%v", err)
+			return 1
+		}
+		if resultPath == "" {
+			logger.Errorf("No analysis results found in %s; run analyze first", aclDir)
+			return 1
+		}
+	}
+	logger.Infof("Exporting analysis result: %s", resultPath)
+
+	result, err := analysis.LoadResult(resultPath)
+	if err != nil {
+		logger.Errorf("%v", err)
+		return 1
+	}
+	resultData, err := os.ReadFile(resultPath)
+	if err != nil {
+		logger.Errorf("Failed to read analysis result: %v", err)
+		return 1
+	}
+
+	dir := *out
+	if dir == "" {
+		// Results live in <aclDir>/analysis, so the Web ACL directory is found from -result too
+		dir = filepath.Join(filepath.Dir(filepath.Dir(resultPath)), notebook.DirName,
+			"notebook_"+time.Now().UTC().Format("20060102_150405"))
+	}
+	path, err := notebook.Write(dir, result, resultData, *format)
+	if err != nil {
+		logger.Errorf("%v", err)
+		return 1
+	}
+	logger.Infof("Notebook written to: %s", path)
+	logger.Infof("Datasets written to: %s", filepath.Join(dir, notebook.DataDirName))
+	return 0
+}
@@ -0,0 +1,433 @@
+// Package notebook exports analysis results as datasets with a pre-built Jupyter or
+// Observable notebook, for customers who extend the analysis themselves
+package notebook
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"waf-log-retriever/analysis"
+)
+
+// DirName is the directory, inside a Web ACL's log directory, where notebooks are exported
+const DirName = "notebooks"
+
+// Notebook formats
+const (
+	FormatJupyter    = "jupyter"    // Python notebook reading the datasets with pandas
+	FormatObservable = "observable" // Observable notebook JSON with the datasets as file attachments
+)
+
+// Formats are the notebook formats, the default first
+var Formats = []string{FormatJupyter, FormatObservable}
+
+// ResultName is the file the analysis result is exported as
+const ResultName = "analysis.json"
+
+// DataDirName is the directory of an export holding the CSV datasets
+const DataDirName = "data"
+
+// Table is one CSV dataset flattened from an analysis result
+type Table struct {
+	Name    string // File name without the .csv extension, and the notebook variable
+	Columns []string
+	Rows    [][]string
+}
+
+// Tables flattens the statistics, findings and breakdowns of an analysis result into
+// CSV datasets. Every table is exported, even if empty, so the notebook cells keep
+// working for any result.
+func Tables(result *analysis.Result) []Table {
+	stats := result.Stats
+	if stats == nil {
+		stats = &analysis.Stats{}
+	}
+	return []Table{
+		findingsTable(result.Findings),
+		countTable("actions", "action", stats.Actions),
+		countTable("terminating_rules", "rule", stats.TerminatingRules),
+		countTable("countries", "country", stats.Countries),
+		countTable("client_ips", "client", stats.ClientIPs),
+		countTable("blocked_ips", "ip", stats.BlockedIPs),
+		countTable("uris", "uri", stats.URIs),
+		countTable("methods", "method", stats.Methods),
+		heatmapTable(stats.Heatmap),
+		hostsTable(result.Hosts),
+		attacksTable(result.AttackLandscape),
+		originsTable(result.Origins),
+		scannersTable(result.Scanners),
+		sourcesTable(result.Sources),
+		queriesTable(result.Queries),
+		reconciliationTable(result.Reconciliation),
+	}
+}
+
+// countTable lists a count map, largest first
+func countTable(name, key string, counts map[string]int64) Table {
+	t := Table{Name: name, Columns: []string{key, "requests"}}
+	for _, c := range analysis.TopN(counts, 0) {
+		t.Rows = append(t.Rows, []string{c.Key, itoa(c.Count)})
+	}
+	return t
+}
+
+func findingsTable(findings []analysis.Finding) Table {
+	t := Table{Name: "findings", Columns: []string{"id", "severity", "title", "source", "endpoint_class", "description"}}
+	for _, f := range findings {
+		t.Rows = append(t.Rows, []string{f.ID, f.Severity, f.Title, f.Source, f.EndpointClass, f.Description})
+	}
+	return t
+}
+
+// heatmapTable lists the requests of every hour of the week, in the heatmap's time zone
+func heatmapTable(heatmap *analysis.Heatmap) Table {
+	t := Table{Name: "heatmap", Columns: []string{"day", "hour", "requests", "blocked"}}
+	if heatmap == nil {
+		return t
+	}
+	for day, name := range analysis.Weekdays {
+		for hour := range 24 {
+			t.Rows = append(t.Rows, []string{name, strconv.Itoa(hour), itoa(heatmap.Requests[day][hour]), itoa(heatmap.Blocked[day][hour])})
+		}
+	}
+	return t
+}
+
+func hostsTable(hosts []analysis.HostReport) Table {
+	t := Table{Name: "hosts", Columns: []string{"host", "requests", "blocked", "first_seen", "last_seen"}}
+	for _, h := range hosts {
+		t.Rows = append(t.Rows, []string{h.Host, itoa(h.Requests), itoa(h.Blocked), timestamp(h.FirstSeen), timestamp(h.LastSeen)})
+	}
+	return t
+}
+
+func attacksTable(landscape []analysis.LandscapeEntry) Table {
+	t := Table{Name: "attacks", Columns: []string{"owasp", "name", "requests", "blocked"}}
+	for _, e := range landscape {
+		t.Rows = append(t.Rows, []string{e.OWASP, e.Name, itoa(e.Requests), itoa(e.Blocked)})
+	}
+	return t
+}
+
+func originsTable(origins []analysis.OriginReport) Table {
+	t := Table{Name: "origins", Columns: []string{"country", "name", "lat", "lon", "requests", "blocked", "attacks", "attacks_not_blocked"}}
+	for _, o := range origins {
+		lat, lon := "", ""
+		if o.Located {
+			lat, lon = strconv.FormatFloat(o.Lat, 'f', -1, 64), strconv.FormatFloat(o.Lon, 'f', -1, 64)
+		}
+		t.Rows = append(t.Rows, []string{o.Country, o.Name, lat, lon, itoa(o.Requests), itoa(o.Blocked), itoa(o.Attacks), itoa(o.AttacksNotBlocked)})
+	}
+	return t
+}
+
+func scannersTable(scanners []analysis.ScannerActivity) Table {
+	t := Table{Name: "scanners", Columns: []string{"name", "requests", "blocked", "allowed", "client_ips", "first_seen", "last_seen", "peak_per_minute"}}
+	for _, s := range scanners {
+		t.Rows = append(t.Rows, []string{s.Name, itoa(s.Requests), itoa(s.Blocked), itoa(s.Allowed), strconv.Itoa(s.ClientIPs),
+			timestamp(s.FirstSeen), timestamp(s.LastSeen), itoa(s.PeakPerMinute)})
+	}
+	return t
+}
+
+func sourcesTable(sources []analysis.SourceReport) Table {
+	t := Table{Name: "sources", Columns: []string{"source", "account", "region", "web_acl", "requests", "blocked", "attacks", "attacks_not_blocked"}}
+	for _, s := range sources {
+		t.Rows = append(t.Rows, []string{s.Key, s.Account, s.Region, s.WebACL, itoa(s.Requests), itoa(s.Blocked), itoa(s.Attacks), itoa(s.AttacksNotBlocked)})
+	}
+	return t
+}
+
+// queriesTable lists the saved queries run with the analysis, one row per value of a
+// top query and one row holding the matches of other queries
+func queriesTable(queries []analysis.QueryResult) Table {
+	t := Table{Name: "queries", Columns: []string{"query", "statement", "matched", "value", "requests"}}
+	for _, q := range queries {
+		if len(q.Top) == 0 {
+			t.Rows = append(t.Rows, []string{q.Name, q.Statement, itoa(q.Matched), "", ""})
+		}
+		for _, c := range q.Top {
+			t.Rows = append(t.Rows, []string{q.Name, q.Statement, itoa(q.Matched), c.Key, itoa(c.Count)})
+		}
+	}
+	return t
+}
+
+// reconciliationTable lists the record count of every stage from download to export
+func reconciliationTable(r *analysis.Reconciliation) Table {
+	t := Table{Name: "reconciliation", Columns: []string{"stage", "records", "files"}}
+	if r == nil {
+		return t
+	}
+	for _, s := range r.Stages {
+		t.Rows = append(t.Rows, []string{s.Stage, itoa(s.Records), strconv.Itoa(s.Files)})
+	}
+	return t
+}
+
+func itoa(n int64) string {
+	return strconv.FormatInt(n, 10)
+}
+
+// timestamp formats a time as RFC 3339, which pandas and d3 both parse, or "" if zero
+func timestamp(t time.Time) string {
+	if t.IsZero() {
+		return ""
+	}
+	return t.UTC().Format(time.RFC3339)
+}
+
+// Write exports an analysis result into dir: the result file as analysis.json, its
+// tables as data/<name>.csv and a notebook of the format reading them. resultData is
+// the result file as written by analyze, copied unchanged. It returns the notebook path.
+func Write(dir string, result *analysis.Result, resultData []byte, format string) (string, error) {
+	if !slices.Contains(Formats, format) {
+		return "", fmt.Errorf("unknown notebook format %q (known: %s)", format, strings.Join(Formats, ", "))
+	}
+	if err := os.MkdirAll(filepath.Join(dir, DataDirName), 0755); err != nil {
+		return "", fmt.Errorf("failed to create notebook directory: %w", err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, ResultName), resultData, 0644); err != nil {
+		return "", fmt.Errorf("failed to write analysis result: %w", err)
+	}
+	tables := Tables(result)
+	for _, t := range tables {
+		if err := writeCSV(filepath.Join(dir, DataDirName, t.Name+".csv"), t); err != nil {
+			return "", err
+		}
+	}
+
+	var path string
+	var data []byte
+	var err error
+	switch format {
+	case FormatJupyter:
+		path = filepath.Join(dir, "review.ipynb")
+		data, err = jupyterNotebook(result, tables)
+	case FormatObservable:
+		path = filepath.Join(dir, "review.observable.json")
+		data, err = observableNotebook(result, tables)
+	}
+	if err != nil {
+		return "", fmt.Errorf("failed to encode notebook: %w", err)
+	}
+	if err := os.WriteFile(path, data, 0644); err != nil {
+		return "", fmt.Errorf("failed to write notebook: %w", err)
+	}
+	return path, nil
+}
+
+// writeCSV writes a table as a CSV file with a header row
+func writeCSV(path string, t Table) error {
+	file, err := os.Create(path)
+	if err != nil {
+		return fmt.Errorf("failed to create dataset: %w", err)
+	}
+	defer file.Close()
+
+	w := csv.NewWriter(file)
+	w.Write(t.Columns)
+	w.WriteAll(t.Rows) // Flushes, reporting any write error
+	if err := w.Error(); err != nil {
+		return fmt.Errorf("failed to write dataset %s: %w", t.Name, err)
+	}
+	if err := file.Close(); err != nil {
+		return fmt.Errorf("failed to write dataset %s: %w", t.Name, err)
+	}
+	return nil
+}
+
+// introduction is the first cell of a notebook, in Markdown
+func introduction(result *analysis.Result, tables []Table) string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "# AWS WAF Review: %s\n\n", result.WebACLName)
+	fmt.Fprintf(&b, "Analysis of profile `%s` generated %s", result.ProfileName, result.GeneratedAt.UTC().Format("2006-01-02 15:04 UTC"))
+	if result.Account != "" {
+		fmt.Fprintf(&b, " for account %s", result.Account)
+	}
+	if result.Stats != nil {
+		fmt.Fprintf(&b, ", covering %d requests from %s to %s",
+			result.Stats.TotalRequests, timestamp(result.Stats.FirstSeen), timestamp(result.Stats.LastSeen))
+	}
+	b.WriteString(".\n\n")
+	fmt.Fprintf(&b, "`%s` holds the complete analysis result; the datasets below are flattened from it: ", ResultName)
+	names := make([]string, len(tables))
+	for i, t := range tables {
+		names[i] = "`" + t.Name + "`"
+	}
+	b.WriteString(strings.Join(names, ", "))
+	b.WriteString(".")
+	return b.String()
+}
+
+// jupyterNotebook builds a Python notebook (nbformat 4) loading the datasets with pandas
+func jupyterNotebook(result *analysis.Result, tables []Table) ([]byte, error) {
+	cells := []jupyterCell{
+		markdownCell(introduction(result, tables)),
+		codeCell("import json\n\nimport pandas as pd\n\n" +
+			"with open(\"" + ResultName + "\") as f:\n    result = json.load(f)\n" +
+			"stats = result[\"stats\"]\n" +
+			"print(f\"{stats['totalRequests']} requests from {stats['firstSeen']} to {stats['lastSeen']}\")"),
+		markdownCell("## Datasets"),
+	}
+	var load strings.Builder
+	for _, t := range tables {
+		fmt.Fprintf(&load, "%s = pd.read_csv(\"%s/%s.csv\"%s)\n", t.Name, DataDirName, t.Name, jupyterDates(t))
+	}
+	cells = append(cells,
+		codeCell(strings.TrimSuffix(load.String(), "\n")),
+		markdownCell("## Findings"),
+		codeCell("findings.groupby(\"severity\").size().sort_values(ascending=False)"),
+		codeCell("findings[[\"severity\", \"title\", \"source\"]]"),
+		markdownCell("## Traffic\n\nActions and the busiest terminating rules, countries and URIs."),
+		codeCell("actions.set_index(\"action\")[\"requests\"].plot.bar(title=\"Requests by action\")"),
+		codeCell("terminating_rules.head(15).set_index(\"rule\")[\"requests\"].plot.barh(title=\"Busiest terminating rules\")"),
+		codeCell("countries.head(15)"),
+		codeCell("uris.head(20)"),
+		markdownCell("## When\n\nRequests by day of week and hour, in the time zone of the analysis."),
+		codeCell("heatmap.pivot(index=\"day\", columns=\"hour\", values=\"requests\")"+
+			".reindex([\"Mon\", \"Tue\", \"Wed\", \"Thu\", \"Fri\", \"Sat\", \"Sun\"])"),
+		markdownCell("## Attacks and Scanners"),
+		codeCell("attacks.assign(not_blocked=attacks.requests - attacks.blocked)"),
+		codeCell("origins.head(15)"),
+		codeCell("scanners.sort_values(\"requests\", ascending=False)"),
+		markdownCell("## Your Analysis\n\nEvery dataset is a pandas DataFrame; `result` holds the complete analysis result."),
+		codeCell(""),
+	)
+	return json.MarshalIndent(jupyterDocument{
+		Cells: cells,
+		Metadata: map[string]any{
+			"kernelspec":    map[string]string{"display_name": "Python 3", "language": "python", "name": "python3"},
+			"language_info": map[string]string{"name": "python"},
+		},
+		NBFormat:      4,
+		NBFormatMinor: 4,
+	}, "", " ")
+}
+
+// jupyterDates returns the read_csv argument parsing the time columns of a table
+func jupyterDates(t Table) string {
+	var columns []string
+	for _, c := range t.Columns {
+		if strings.HasSuffix(c, "_seen") {
+			columns = append(columns, "\""+c+"\"")
+		}
+	}
+	if len(columns) == 0 {
+		return ""
+	}
+	return ", parse_dates=[" + strings.Join(columns, ", ") + "]"
+}
+
+// jupyterDocument is the nbformat 4 notebook document
+type jupyterDocument struct {
+	Cells         []jupyterCell  `json:"cells"`
+	Metadata      map[string]any `json:"metadata"`
+	NBFormat      int            `json:"nbformat"`
+	NBFormatMinor int            `json:"nbformat_minor"`
+}
+
+// jupyterCell is a markdown or code cell; code cells start unexecuted
+type jupyterCell struct {
+	CellType string         `json:"cell_type"`
+	Metadata map[string]any `json:"metadata"`
+	Source   []string       `json:"source"`
+}
+
+func markdownCell(text string) jupyterCell {
+	return jupyterCell{CellType: "markdown", Metadata: map[string]any{}, Source: sourceLines(text)}
+}
+
+func codeCell(code string) jupyterCell {
+	return jupyterCell{CellType: "code", Metadata: map[string]any{}, Source: sourceLines(code)}
+}
+
+// MarshalJSON adds the null execution count and empty outputs nbformat requires of
+// code cells, and forbids on markdown cells
+func (c jupyterCell) MarshalJSON() ([]byte, error) {
+	type plain jupyterCell
+	if c.CellType != "code" {
+		return json.Marshal(plain(c))
+	}
+	return json.Marshal(struct {
+		plain
+		ExecutionCount *int  `json:"execution_count"`
+		Outputs        []any `json:"outputs"`
+	}{plain(c), nil, []any{}})
+}
+
+// sourceLines splits cell source into lines keeping their newlines, as nbformat stores it
+func sourceLines(text string) []string {
+	if text == "" {
+		return []string{}
+	}
+	return strings.SplitAfter(text, "\n")
+}
+
+// observableNotebook builds an Observable notebook JSON, whose cells read the result
+// and datasets as file attachments and chart them with Observable Plot
+func observableNotebook(result *analysis.Result, tables []Table) ([]byte, error) {
+	var nodes []observableNode
+	add := func(mode, value string) {
+		nodes = append(nodes, observableNode{ID: len(nodes) + 1, Mode: mode, Value: value})
+	}
+	add("md", introduction(result, tables))
+	add("js", "result = FileAttachment(\""+ResultName+"\").json()")
+	add("md", "## Datasets")
+	for _, t := range tables {
+		add("js", fmt.Sprintf("%s = FileAttachment(\"%s.csv\").csv({typed: true})", t.Name, t.Name))
+	}
+	add("md", "## Findings")
+	add("js", "Inputs.table(findings, {columns: [\"severity\", \"title\", \"source\"]})")
+	add("md", "## Traffic")
+	add("js", "Plot.plot({marginLeft: 60, marks: [Plot.barY(actions, {x: \"action\", y: \"requests\", sort: {x: \"-y\"}})]})")
+	add("js", "Plot.plot({marginLeft: 240, marks: [Plot.barX(terminating_rules.slice(0, 15), {y: \"rule\", x: \"requests\", sort: {y: \"-x\"}})]})")
+	add("js", "Inputs.table(uris)")
+	add("md", "## When\n\nRequests by day of week and hour, in the time zone of the analysis.")
+	add("js", "Plot.plot({color: {scheme: \"reds\", legend: true}, y: {domain: [\"Mon\", \"Tue\", \"Wed\", \"Thu\", \"Fri\", \"Sat\", \"Sun\"]}, "+
+		"marks: [Plot.cell(heatmap, {x: \"hour\", y: \"day\", fill: \"requests\"})]})")
+	add("md", "## Attacks and Scanners")
+	add("js", "Inputs.table(attacks)")
+	add("js", "Plot.plot({projection: \"equirectangular\", marks: [Plot.graticule(), "+
+		"Plot.dot(origins.filter((d) => d.lat !== null), {x: \"lon\", y: \"lat\", r: \"attacks\", fill: \"#c0392b\", title: \"name\"})]})")
+	add("js", "Inputs.table(scanners)")
+
+	files := []observableFile{{Name: ResultName, MimeType: "application/json"}}
+	for _, t := range tables {
+		files = append(files, observableFile{Name: t.Name + ".csv", MimeType: "text/csv"})
+	}
+	return json.MarshalIndent(observableDocument{
+		Title: "AWS WAF Review: " + result.WebACLName,
+		Nodes: nodes,
+		Files: files,
+	}, "", "  ")
+}
+
+// observableDocument is an Observable notebook. Its files are attached from the export
+// (analysis.json and data/*.csv) when the notebook is imported.
+type observableDocument struct {
+	Title string           `json:"title"`
+	Nodes []observableNode `json:"nodes"`
+	Files []observableFile `json:"files"`
+}
+
+// observableNode is a notebook cell in Markdown ("md") or JavaScript ("js")
+type observableNode struct {
+	ID     int    `json:"id"`
+	Mode   string `json:"mode"`
+	Value  string `json:"value"`
+	Pinned bool   `json:"pinned"`
+}
+
+// observableFile is a file attachment of a notebook
+type observableFile struct {
+	Name     string `json:"name"`
+	MimeType string `json:"mimeType"`
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"waf-log-retriever/analysis"
+)
+
+// runOrigins exports where the requests and attacks of an analysis result came from
+// as GeoJSON, for maps and GIS tools
+func runOrigins(args []string) int {
+	fs := flag.NewFlagSet("origins", flag.ExitOnError)
+	outputDir := fs.String("output-dir", "../logs/raw", "Directory containing retrieved logs")
+	profile := fs.String("profile", "", "AWS profile name the logs were retrieved with")
+	webACL := fs.String("web-acl", "", "Name of the Web ACL whose attack origins to export")
+	resultFile := fs.String("result", "", "Analysis result to export (default: the latest for the Web ACL)")
+	out := fs.String("out", "", "File to write the GeoJSON to (default: standard output)")
+	fs.Parse(args)
+
+	if *resultFile == "" && (*profile == "" || *webACL == "") {
+		fmt.Println("origins requires -profile and -web-acl, or -result")
+		fs.Usage()
+		return 2
+	}
+
+	resultPath := *resultFile
+	if resultPath == "" {
+		aclDir := filepath.Join(*outputDir, *profile, *webACL)
+		var err error
+		if resultPath, err = analysis.LatestResultPath(aclDir); err != nil {
+			fmt.Printf("%v\n", err)
+			return 1
+		}
+		if resultPath == "" {
+			fmt.Printf("No analysis results found in %s; run analyze first\n", aclDir)
+			return 1
+		}
+	}
+	result, err := analysis.LoadResult(resultPath)
+	if err != nil {
+		fmt.Printf("%v\n", err)
+		return 1
+	}
+	if len(result.Origins) == 0 {
+		fmt.Printf("%s has no attack origins; rerun analyze to add them\n", resultPath)
+		return 1
+	}
+
+	var buf bytes.Buffer
+	if err := analysis.WriteOriginsGeoJSON(&buf, result.Origins); err != nil {
+		fmt.Printf("Failed to encode attack origins: %v\n", err)
+		return 1
+	}
+	located := 0
+	for _, o := range result.Origins {
+		if o.Located {
+			located++
+		}
+	}
+	summary := fmt.Sprintf("%d countries of origin", located)
+	if *out == "" {
+		os.Stdout.Write(buf.Bytes())
+		fmt.Fprintln(os.Stderr, summary)
+		return 0
+	}
+	if err := os.WriteFile(*out, buf.Bytes(), 0644); err != nil {
+		fmt.Printf("Failed to write attack origins: %v\n", err)
+		return 1
+	}
+	fmt.Printf("GeoJSON with %s written to %s\n", summary, *out)
+	return 0
+}
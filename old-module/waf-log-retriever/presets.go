@@ -0,0 +1,206 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"time"
+
+	"waf-log-retriever/config"
+)
+
+// Workflow stages, in the order presets run them. Parsing is part of analyze, which
+// reads the raw logs directly.
+const (
+	stageRetrieve = "retrieve"
+	stageAnalyze  = "analyze"
+	stageReport   = "report"
+)
+
+// presets are named workflows that chain stages under one command; the stage-level
+// commands remain for finer control
+var presets = map[string][]string{
+	"download-only": {stageRetrieve},
+	"full-review":   {stageRetrieve, stageAnalyze, stageReport},
+	"full":          {stageRetrieve, stageAnalyze, stageReport},
+	"review":        {stageAnalyze, stageReport}, // Logs retrieved earlier
+}
+
+// presetCommand returns the subcommand running a preset's stages
+func presetCommand(name string) func(args []string) int {
+	return func(args []string) int {
+		return runPreset(name, presets[name], args)
+	}
+}
+
+// runPreset runs the stages of a preset in order, stopping at the first that fails
+func runPreset(name string, stages []string, args []string) int {
+	fs := flag.NewFlagSet(name, flag.ExitOnError)
+	configPath := fs.String("config", "config.json", "Path to configuration file")
+	wafConfigPath := fs.String("waf-config", "waf-config.json", "Path to WAF configuration file")
+	profile := fs.String("profile", "", "AWS profile name (default: the profile of the WAF source)")
+	wafSource := fs.String("waf-source", "", "WAF Log Source Name from waf-config.json")
+	webACL := fs.String("web-acl", "", "Name of the Web ACL; selects its WAF source from waf-config.json")
+	last := fs.String("last", "", "Retrieve the logs of this period up to now, e.g. 7d or 12h")
+	startDate := fs.String("start-date", "", "Start date for log retrieval (YYYY-MM-DD or YYYY-MM-DDTHH:mm:ssZ)")
+	endDate := fs.String("end-date", "", "End date for log retrieval (YYYY-MM-DD or YYYY-MM-DDTHH:mm:ssZ)")
+	outputDir := fs.String("output-dir", "../logs/raw", "Output directory for raw logs")
+	settingsFile := fs.String("settings", "", "JSON file tuning the built-in detectors (optional)")
+	checksDir := fs.String("checks-dir", "", "Directory of custom check scripts (*.star)")
+	queries := fs.String("queries", "", "Saved queries of the review to run with the analysis (comma-separated names, or all)")
+	reportConfig := fs.String("report-config", "", "JSON file selecting the title, sections and minimum severity of the report")
+	signKey := fs.String("sign-key", "", "PEM private key to sign the analysis result and report with (optional)")
+	logLevel := fs.String("log-level", "INFO", "Logging level (DEBUG, INFO, WARNING, ERROR)")
+	forceUnlock := fs.Bool("force-unlock", false, "Take over the lock of the Web ACL's directory even if another run appears to hold it")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage of %s (%s):\n", name, strings.Join(stages, " -> "))
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+
+	retrieve := stages[0] == stageRetrieve
+	if retrieve {
+		if *wafSource == "" && *webACL == "" {
+			fmt.Printf("%s requires -waf-source or -web-acl\n", name)
+			fs.Usage()
+			return 2
+		}
+		source, err := presetSource(*wafConfigPath, *profile, *wafSource, *webACL)
+		if err != nil {
+			fmt.Printf("%v\n", err)
+			return 1
+		}
+		*profile, *wafSource, *webACL = source.ProfileName, source.LogSourceName, source.WebACLName
+		if source.LocalName != "" {
+			*webACL = source.LocalName
+		}
+
+		if *last != "" {
+			period, err := parsePeriod(*last)
+			if err != nil {
+				fmt.Printf("%v\n", err)
+				return 2
+			}
+			now := time.Now().UTC()
+			*startDate = now.Add(-period).Format("2006-01-02T15:04:05Z")
+			*endDate = now.Format("2006-01-02T15:04:05Z")
+		}
+		if *startDate == "" || *endDate == "" {
+			fmt.Printf("%s requires -last, or -start-date and -end-date\n", name)
+			fs.Usage()
+			return 2
+		}
+	} else if *profile == "" || *webACL == "" {
+		fmt.Printf("%s requires -profile and -web-acl\n", name)
+		fs.Usage()
+		return 2
+	}
+
+	// Each stage locks the Web ACL's directory itself, so a stage never waits on the
+	// lock of the one before it
+	var lockArgs []string
+	if *forceUnlock {
+		lockArgs = []string{"-force-unlock"}
+	}
+
+	for i, stage := range stages {
+		fmt.Printf("==> %s: stage %d of %d, %s\n", name, i+1, len(stages), stage)
+		var code int
+		switch stage {
+		case stageRetrieve:
+			code = runRetrieveStage(append([]string{
+				"-config", *configPath, "-waf-config", *wafConfigPath, "-profile", *profile, "-waf-source", *wafSource,
+				"-start-date", *startDate, "-end-date", *endDate, "-output-dir", *outputDir, "-log-level", *logLevel,
+			}, lockArgs...))
+		case stageAnalyze:
+			code = runAnalyze(withOptional(append([]string{
+				"-output-dir", *outputDir, "-profile", *profile, "-web-acl", *webACL, "-log-level", *logLevel,
+			}, lockArgs...), "-settings", *settingsFile, "-checks-dir", *checksDir, "-queries", *queries, "-sign-key", *signKey))
+		case stageReport:
+			code = runReport(withOptional([]string{
+				"-output-dir", *outputDir, "-profile", *profile, "-web-acl", *webACL, "-log-level", *logLevel,
+			}, "-report-config", *reportConfig, "-sign-key", *signKey))
+		}
+		if code != 0 {
+			fmt.Printf("==> %s: stage %s failed with exit code %d\n", name, stage, code)
+			return code
+		}
+	}
+	fmt.Printf("==> %s: all %d stages completed\n", name, len(stages))
+	return 0
+}
+
+// runRetrieveStage runs log retrieval in a child process. Retrieval parses the global
+// flags and exits the process when done, so it cannot run in-process.
+func runRetrieveStage(args []string) int {
+	executable, err := os.Executable()
+	if err != nil {
+		fmt.Printf("Failed to locate the executable: %v\n", err)
+		return 1
+	}
+	cmd := exec.Command(executable, append([]string{stageRetrieve}, args...)...)
+	cmd.Stdin, cmd.Stdout, cmd.Stderr = os.Stdin, os.Stdout, os.Stderr
+	if err := cmd.Run(); err != nil {
+		if exitErr, ok := err.(*exec.ExitError); ok {
+			return exitErr.ExitCode()
+		}
+		fmt.Printf("Failed to run retrieval: %v\n", err)
+		return 1
+	}
+	return 0
+}
+
+// presetSource finds the WAF source to retrieve, by log source name or Web ACL name
+func presetSource(wafConfigPath, profile, wafSource, webACL string) (*config.WAFLogSourceConfig, error) {
+	wafCfg, err := config.LoadWAFConfig(wafConfigPath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load WAF config: %w", err)
+	}
+	if wafCfg == nil {
+		return nil, fmt.Errorf("%s not found; presets retrieve the WAF sources configured in it", wafConfigPath)
+	}
+	var matches []config.WAFLogSourceConfig
+	for _, source := range wafCfg.WAFLogSources {
+		if (profile == "" || source.ProfileName == profile) &&
+			(wafSource == "" || source.LogSourceName == wafSource) &&
+			(webACL == "" || source.WebACLName == webACL || source.LocalName == webACL) {
+			matches = append(matches, source)
+		}
+	}
+	switch len(matches) {
+	case 0:
+		return nil, fmt.Errorf("no WAF source in %s matches the given -profile, -waf-source and -web-acl", wafConfigPath)
+	case 1:
+		return &matches[0], nil
+	}
+	return nil, fmt.Errorf("%d WAF sources in %s match; narrow them down with -profile or -waf-source", len(matches), wafConfigPath)
+}
+
+// parsePeriod parses a duration such as 12h or 90m, also accepting days such as 7d
+func parsePeriod(s string) (time.Duration, error) {
+	if days, ok := strings.CutSuffix(s, "d"); ok {
+		n, err := strconv.Atoi(days)
+		if err != nil || n <= 0 {
+			return 0, fmt.Errorf("invalid period %q", s)
+		}
+		return time.Duration(n) * 24 * time.Hour, nil
+	}
+	d, err := time.ParseDuration(s)
+	if err != nil || d <= 0 {
+		return 0, fmt.Errorf("invalid period %q (want e.g. 7d or 12h)", s)
+	}
+	return d, nil
+}
+
+// withOptional appends flag/value pairs whose value is set
+func withOptional(args []string, pairs ...string) []string {
+	for i := 0; i+1 < len(pairs); i += 2 {
+		if pairs[i+1] != "" {
+			args = append(args, pairs[i], pairs[i+1])
+		}
+	}
+	return args
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/pprof"
+	"os"
+	"runtime"
+	runtimepprof "runtime/pprof"
+	"strings"
+)
+
+// profiler holds the profiling requested with the leading -pprof-addr and -prof
+// flags, which apply to every command
+type profiler struct {
+	cpuFile *os.File
+	memPath string
+}
+
+// stopProfiling ends the profiling started by startProfiling; commands call it
+// before exiting
+var stopProfiling = func() {}
+
+// startProfiling consumes the profiling flags at the start of args and starts the
+// requested profiling, returning the remaining arguments:
+//
+//	-pprof-addr ADDR   serve net/http/pprof on ADDR, e.g. localhost:6060
+//	-prof cpu=FILE     write a CPU profile of the run to FILE
+//	-prof mem=FILE     write a heap profile to FILE when the run ends
+func startProfiling(args []string) ([]string, error) {
+	var pprofAddr, cpuPath, memPath string
+	for len(args) > 0 {
+		name, value, hasValue := strings.Cut(strings.TrimLeft(args[0], "-"), "=")
+		if !strings.HasPrefix(args[0], "-") || (name != "pprof-addr" && name != "prof") {
+			break
+		}
+		if !hasValue {
+			if len(args) < 2 {
+				return nil, fmt.Errorf("flag -%s needs a value", name)
+			}
+			value, args = args[1], args[1:]
+		}
+		args = args[1:]
+
+		if name == "pprof-addr" {
+			pprofAddr = value
+			continue
+		}
+		kind, path, ok := strings.Cut(value, "=")
+		if !ok || path == "" {
+			return nil, fmt.Errorf("invalid -prof %q (want cpu=FILE or mem=FILE)", value)
+		}
+		switch kind {
+		case "cpu":
+			cpuPath = path
+		case "mem":
+			memPath = path
+		default:
+			return nil, fmt.Errorf("unknown profile %q (want cpu or mem)", kind)
+		}
+	}
+
+	if pprofAddr != "" {
+		if err := servePprof(pprofAddr); err != nil {
+			return nil, err
+		}
+	}
+	p := &profiler{memPath: memPath}
+	if cpuPath != "" {
+		f, err := os.Create(cpuPath)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create CPU profile: %w", err)
+		}
+		if err := runtimepprof.StartCPUProfile(f); err != nil {
+			f.Close()
+			return nil, fmt.Errorf("failed to start CPU profile: %w", err)
+		}
+		p.cpuFile = f
+	}
+	if p.cpuFile != nil || p.memPath != "" {
+		stopProfiling = p.stop
+	}
+	return args, nil
+}
+
+// servePprof serves the net/http/pprof endpoints on addr in the background
+func servePprof(addr string) error {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return fmt.Errorf("failed to listen on pprof address %s: %w", addr, err)
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/debug/pprof/", pprof.Index)
+	mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+	fmt.Fprintf(os.Stderr, "Serving pprof on http://%s/debug/pprof/\n", listener.Addr())
+	go func() {
+		if err := http.Serve(listener, mux); err != nil {
+			fmt.Fprintf(os.Stderr, "pprof server stopped: %v\n", err)
+		}
+	}()
+	return nil
+}
+
+// stop finishes the CPU profile and writes the heap profile
+func (p *profiler) stop() {
+	stopProfiling = func() {}
+	if p.cpuFile != nil {
+		runtimepprof.StopCPUProfile()
+		if err := p.cpuFile.Close(); err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to write CPU profile: %v\n", err)
+		} else {
+			fmt.Fprintf(os.Stderr, "CPU profile written to %s\n", p.cpuFile.Name())
+		}
+	}
+	if p.memPath != "" {
+		f, err := os.Create(p.memPath)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to create heap profile: %v\n", err)
+			return
+		}
+		defer f.Close()
+		runtime.GC() // Profile live objects as of now
+		if err := runtimepprof.WriteHeapProfile(f); err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to write heap profile: %v\n", err)
+			return
+		}
+		fmt.Fprintf(os.Stderr, "Heap profile written to %s\n", p.memPath)
+	}
+}
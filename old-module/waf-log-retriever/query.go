@@ -0,0 +1,250 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"waf-log-retriever/analysis"
+	"waf-log-retriever/logging"
+	"waf-log-retriever/workspace"
+)
+
+// queryCommands maps the query subcommands to their entry points
+var queryCommands = map[string]func(args []string) int{
+	"save":   runQuerySave,
+	"list":   runQueryList,
+	"run":    runQueryRun,
+	"delete": runQueryDelete,
+}
+
+// runQuery dispatches the query subcommands, which manage the saved query library of
+// a Web ACL's review
+func runQuery(args []string) int {
+	if len(args) > 0 {
+		if command, ok := queryCommands[args[0]]; ok {
+			return command(args[1:])
+		}
+	}
+	names := make([]string, 0, len(queryCommands))
+	for name := range queryCommands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	fmt.Printf("query requires a subcommand: %s\n", strings.Join(names, ", "))
+	return 2
+}
+
+// queryFlags adds the flags selecting the workspace of a Web ACL to a query subcommand
+func queryFlags(fs *flag.FlagSet) (outputDir, profile, webACL *string) {
+	outputDir = fs.String("output-dir", "../logs/raw", "Directory containing retrieved logs")
+	profile = fs.String("profile", "", "AWS profile name the logs were retrieved with")
+	webACL = fs.String("web-acl", "", "Name of the Web ACL under review")
+	return outputDir, profile, webACL
+}
+
+// runQuerySave saves a named statement to the query library, replacing one with the
+// same name
+func runQuerySave(args []string) int {
+	fs := flag.NewFlagSet("query save", flag.ExitOnError)
+	outputDir, profile, webACL := queryFlags(fs)
+	description := fs.String("description", "", "What the query shows, e.g. for the report")
+	reviewer := fs.String("reviewer", defaultReviewer(), "Name of the reviewer saving the query")
+	forceUnlock := fs.Bool("force-unlock", false, "Take over the lock of the Web ACL's directory even if another run appears to hold it")
+	fs.Parse(args)
+
+	if *profile == "" || *webACL == "" || fs.NArg() < 2 {
+		fmt.Println("query save requires -profile, -web-acl, a name and a statement, e.g. top-cn-blocks top ips where country=CN and action=BLOCK")
+		fs.Usage()
+		return 2
+	}
+	name, statement := fs.Arg(0), strings.Join(fs.Args()[1:], " ")
+	if err := saveQuery(filepath.Join(*outputDir, *profile, *webACL), *profile, *webACL, workspace.SavedQuery{
+		Name:        name,
+		Statement:   statement,
+		Description: *description,
+		SavedBy:     *reviewer,
+		SavedAt:     time.Now().UTC(),
+	}, *forceUnlock); err != nil {
+		fmt.Printf("%v\n", err)
+		return 1
+	}
+	fmt.Printf("Saved query %s\n", name)
+	return 0
+}
+
+// saveQuery checks a query's name and statement and saves it to the workspace of a
+// Web ACL's log directory, holding its lock; force takes over any lock
+func saveQuery(aclDir, profile, webACL string, q workspace.SavedQuery, force bool) error {
+	if !workspace.ValidQueryName(q.Name) {
+		return fmt.Errorf("invalid query name %q (use letters, digits, dots, dashes and underscores)", q.Name)
+	}
+	if _, err := analysis.ParseStatement(q.Statement); err != nil {
+		return fmt.Errorf("invalid statement: %w", err)
+	}
+	// Opened right before saving, and locked until then, so that changes made
+	// meanwhile by other reviewers are kept
+	lock, err := lockWebACL(aclDir, "query save", force, printInfo, printWarning)
+	if err != nil {
+		return err
+	}
+	defer releaseLock(lock, printWarning)
+	ws, err := workspace.Open(aclDir, profile, webACL)
+	if err != nil {
+		return err
+	}
+	ws.SaveQuery(q)
+	return ws.Save()
+}
+
+// runQueryList prints the query library
+func runQueryList(args []string) int {
+	fs := flag.NewFlagSet("query list", flag.ExitOnError)
+	outputDir, profile, webACL := queryFlags(fs)
+	fs.Parse(args)
+
+	if *profile == "" || *webACL == "" {
+		fmt.Println("query list requires -profile and -web-acl")
+		fs.Usage()
+		return 2
+	}
+	ws, err := workspace.Open(filepath.Join(*outputDir, *profile, *webACL), *profile, *webACL)
+	if err != nil {
+		fmt.Printf("%v\n", err)
+		return 1
+	}
+	printQueries(ws.Queries)
+	return 0
+}
+
+// printQueries prints saved queries as a table
+func printQueries(queries []workspace.SavedQuery) {
+	if len(queries) == 0 {
+		fmt.Println("No saved queries")
+		return
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "NAME\tSTATEMENT\tBY\tAT\tDESCRIPTION")
+	for _, q := range queries {
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\n", q.Name, q.Statement, q.SavedBy, q.SavedAt.Local().Format("2006-01-02 15:04"), q.Description)
+	}
+	w.Flush()
+}
+
+// runQueryRun runs saved queries over the retrieved logs, like the repl does
+func runQueryRun(args []string) int {
+	fs := flag.NewFlagSet("query run", flag.ExitOnError)
+	outputDir, profile, webACL := queryFlags(fs)
+	pretty := fs.Bool("pretty", false, "Indent the records shown")
+	fs.Parse(args)
+
+	if *profile == "" || *webACL == "" || fs.NArg() == 0 {
+		fmt.Println("query run requires -profile, -web-acl and at least one query name")
+		fs.Usage()
+		return 2
+	}
+	session, err := newREPLSession(*outputDir, *profile, *webACL, *pretty)
+	if err != nil {
+		fmt.Printf("%v\n", err)
+		return 1
+	}
+	code := 0
+	for _, name := range fs.Args() {
+		if !session.exec("run " + name) {
+			code = 1
+		}
+	}
+	return code
+}
+
+// runQueryDelete removes saved queries from the library
+func runQueryDelete(args []string) int {
+	fs := flag.NewFlagSet("query delete", flag.ExitOnError)
+	outputDir, profile, webACL := queryFlags(fs)
+	forceUnlock := fs.Bool("force-unlock", false, "Take over the lock of the Web ACL's directory even if another run appears to hold it")
+	fs.Parse(args)
+
+	if *profile == "" || *webACL == "" || fs.NArg() == 0 {
+		fmt.Println("query delete requires -profile, -web-acl and at least one query name")
+		fs.Usage()
+		return 2
+	}
+	aclDir := filepath.Join(*outputDir, *profile, *webACL)
+	lock, err := lockWebACL(aclDir, "query delete", *forceUnlock, printInfo, printWarning)
+	if err != nil {
+		fmt.Printf("%v\n", err)
+		return 1
+	}
+	defer releaseLock(lock, printWarning)
+	ws, err := workspace.Open(aclDir, *profile, *webACL)
+	if err != nil {
+		fmt.Printf("%v\n", err)
+		return 1
+	}
+	for _, name := range fs.Args() {
+		if !ws.DeleteQuery(name) {
+			fmt.Printf("Unknown query %s\n", name)
+			return 1
+		}
+	}
+	if err := ws.Save(); err != nil {
+		fmt.Printf("%v\n", err)
+		return 1
+	}
+	fmt.Printf("Deleted %s\n", strings.Join(fs.Args(), ", "))
+	return 0
+}
+
+// runSavedQueries runs saved queries of the workspace of a Web ACL's log directory
+// for an analysis result: the named ones, or all with "all"
+func runSavedQueries(aclDir, profile, webACL, names string, logger logging.Logger) ([]analysis.QueryResult, error) {
+	ws, err := workspace.Open(aclDir, profile, webACL)
+	if err != nil {
+		return nil, err
+	}
+	queries := ws.Queries
+	if names != "all" {
+		queries = nil
+		for _, name := range strings.Split(names, ",") {
+			q := ws.Query(strings.TrimSpace(name))
+			if q == nil {
+				return nil, fmt.Errorf("unknown saved query %s", name)
+			}
+			queries = append(queries, *q)
+		}
+	}
+	files, err := analysis.ListLogFiles(aclDir)
+	if err != nil {
+		return nil, err
+	}
+	end := datasetEnd(aclDir, files)
+
+	results := make([]analysis.QueryResult, 0, len(queries))
+	for _, q := range queries {
+		statement, err := analysis.ParseStatement(q.Statement)
+		if err != nil {
+			return nil, fmt.Errorf("invalid statement of saved query %s: %w", q.Name, err)
+		}
+		if statement.Verb == analysis.VerbShow {
+			statement.Verb = analysis.VerbCount // Results hold no raw records
+		}
+		outcome, err := statement.Run(aclDir, files, end, nil)
+		if err != nil {
+			return nil, fmt.Errorf("failed to run saved query %s: %w", q.Name, err)
+		}
+		results = append(results, analysis.QueryResult{
+			Name:        q.Name,
+			Description: q.Description,
+			Statement:   q.Statement,
+			Matched:     outcome.Matched,
+			Top:         outcome.Top,
+		})
+		logger.Infof("Saved query %s matched %d records", q.Name, outcome.Matched)
+	}
+	return results, nil
+}
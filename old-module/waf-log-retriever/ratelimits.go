@@ -0,0 +1,112 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"text/tabwriter"
+	"time"
+
+	"waf-log-retriever/analysis"
+)
+
+// runRateLimits recommends a rate limit for each URI of a Web ACL from the peak
+// rates of its legitimate clients
+func runRateLimits(args []string) int {
+	fs := flag.NewFlagSet("rate-limits", flag.ExitOnError)
+	outputDir := fs.String("output-dir", "../logs/raw", "Directory containing retrieved logs")
+	profile := fs.String("profile", "", "AWS profile name the logs were retrieved with")
+	webACL := fs.String("web-acl", "", "Name of the Web ACL whose logs to analyze")
+	window := fs.Duration("window", 5*time.Minute, "Evaluation window of the recommended rules: 1m, 2m, 5m or 10m")
+	percentile := fs.Float64("percentile", 99.9, "Percentile of the legitimate clients' peak rates to derive the limits from")
+	headroom := fs.Float64("headroom", 1.5, "Factor applied to the percentile rate")
+	minClients := fs.Int("min-clients", 20, "Legitimate clients a URI needs to get a recommendation")
+	top := fs.Int("top", 20, "Most URIs to recommend limits for, by requests (0 for all)")
+	jsonOutput := fs.Bool("json", false, "Write the recommendations with their rules as JSON")
+	out := fs.String("out", "", "File to write the recommendations to (default: standard output)")
+	fs.Parse(args)
+
+	if *profile == "" || *webACL == "" {
+		fmt.Println("rate-limits requires -profile and -web-acl")
+		fs.Usage()
+		return 2
+	}
+	settings := analysis.EndpointLimitSettings{Window: *window, Percentile: *percentile, Headroom: *headroom, MinClients: *minClients}
+	if err := settings.Validate(); err != nil {
+		fmt.Printf("Invalid settings: %v\n", err)
+		return 2
+	}
+
+	aclDir := filepath.Join(*outputDir, *profile, *webACL)
+	files, err := analysis.ListLogFiles(aclDir)
+	if err != nil {
+		fmt.Printf("%v\n", err)
+		return 1
+	}
+	if len(files) == 0 {
+		fmt.Printf("No log files found in %s\n", aclDir)
+		return 1
+	}
+	endpoints := analysis.NewEndpointLimitAnalysis(*window)
+	for _, file := range files {
+		if err := analysis.ForEachRecord(file, func(r *analysis.Record) error {
+			endpoints.Add(r)
+			return nil
+		}); err != nil {
+			fmt.Printf("%v\n", err)
+			return 1
+		}
+	}
+	limits := endpoints.Recommendations(settings, *top)
+
+	var buf bytes.Buffer
+	if *jsonOutput {
+		encoder := json.NewEncoder(&buf)
+		encoder.SetIndent("", "  ")
+		err = encoder.Encode(limits)
+	} else {
+		err = printRateLimits(&buf, limits, settings)
+	}
+	if err != nil {
+		fmt.Printf("Failed to encode recommendations: %v\n", err)
+		return 1
+	}
+	if *out == "" {
+		os.Stdout.Write(buf.Bytes())
+		return 0
+	}
+	if err := os.WriteFile(*out, buf.Bytes(), 0644); err != nil {
+		fmt.Printf("Failed to write recommendations: %v\n", err)
+		return 1
+	}
+	fmt.Printf("%d rate limit recommendations written to %s\n", len(limits), *out)
+	return 0
+}
+
+// printRateLimits writes a table of the recommended limits followed by their rules
+func printRateLimits(w io.Writer, limits []analysis.EndpointLimit, settings analysis.EndpointLimitSettings) error {
+	if len(limits) == 0 {
+		fmt.Fprintf(w, "No URI had %d legitimate clients to derive a limit from\n", settings.MinClients)
+		return nil
+	}
+	fmt.Fprintf(w, "Peak requests per client and %s, limit = max(p%g x %g, 10)\n\n", settings.Window, settings.Percentile, settings.Headroom)
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintf(tw, "URI\tREQUESTS\tCLIENTS\tP50\tP%g\tMAX\tLIMIT\tLEGITIMATE OVER\tOTHER OVER\n", settings.Percentile)
+	for _, l := range limits {
+		fmt.Fprintf(tw, "%s\t%d\t%d\t%d\t%d\t%d\t%d\t%d\t%d/%d\n", truncate(l.URI, 60), l.Requests, l.LegitimateClients,
+			l.MedianRate, l.PercentileRate, l.MaxRate, l.Limit, l.LegitimateOverLimit, l.OtherOverLimit, l.OtherClients)
+	}
+	tw.Flush()
+	for _, l := range limits {
+		ruleJSON, err := analysis.MarshalRuleJSON(l.Rule)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(w, "\n%s\n", ruleJSON)
+	}
+	return nil
+}
@@ -0,0 +1,217 @@
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"waf-log-retriever/analysis"
+	"waf-log-retriever/workspace"
+)
+
+// replHelp describes the statements of the interactive prompt
+const replHelp = `Statements:
+  top <dimension> [where <key>=<value> [and ...]] [last <duration>] [limit <n>]
+  count [where ...] [last <duration>]
+  show [where ...] [last <duration>] [limit <n>]
+  run <name>    Run a saved query
+  save <name> <statement>
+                Save a statement to the query library of the review
+  queries       List the saved queries
+  dimensions    List what top counts by
+  help          Show this help
+  quit          Leave the prompt (also exit or Ctrl-D)
+
+Condition keys: %s
+Values with spaces are double-quoted; durations count back from the end of the logs,
+e.g. 30m, 24h or 7d. Examples:
+  top ips where action=BLOCK last 24h
+  top uris where rule=SQLi and country=US limit 20
+  count where header="user-agent=python" last 7d
+  show where ip=203.0.113.10 limit 5
+`
+
+// runREPL offers an interactive prompt exploring the retrieved logs of a Web ACL with
+// statements backed by the search query engine, e.g. for live exploration in workshops
+func runREPL(args []string) int {
+	fs := flag.NewFlagSet("repl", flag.ExitOnError)
+	outputDir := fs.String("output-dir", "../logs/raw", "Directory containing retrieved logs")
+	profile := fs.String("profile", "", "AWS profile name the logs were retrieved with")
+	webACL := fs.String("web-acl", "", "Name of the Web ACL whose logs to explore")
+	execute := fs.String("e", "", "Run these statements (separated by ;) and exit instead of prompting")
+	pretty := fs.Bool("pretty", false, "Indent the records shown")
+	fs.Parse(args)
+
+	if *profile == "" || *webACL == "" {
+		fmt.Println("repl requires -profile and -web-acl")
+		fs.Usage()
+		return 2
+	}
+
+	session, err := newREPLSession(*outputDir, *profile, *webACL, *pretty)
+	if err != nil {
+		fmt.Printf("%v\n", err)
+		return 1
+	}
+
+	if *execute != "" {
+		code := 0
+		for _, line := range strings.Split(*execute, ";") {
+			if strings.TrimSpace(line) == "" {
+				continue
+			}
+			if !session.exec(line) {
+				code = 1
+			}
+		}
+		return code
+	}
+
+	fmt.Printf("Exploring %d log files of Web ACL %s (profile %s) up to %s\n", len(session.files), *webACL, *profile, session.end.Format("2006-01-02 15:04 MST"))
+	fmt.Println("Type help for the statements.")
+	scanner := bufio.NewScanner(os.Stdin)
+	for {
+		fmt.Print("waf> ")
+		if !scanner.Scan() {
+			fmt.Println()
+			break
+		}
+		line := strings.TrimSpace(scanner.Text())
+		switch strings.ToLower(line) {
+		case "":
+			continue
+		case "quit", "exit":
+			return 0
+		}
+		session.exec(line)
+	}
+	if err := scanner.Err(); err != nil {
+		fmt.Printf("%v\n", err)
+		return 1
+	}
+	return 0
+}
+
+// replSession holds the dataset the prompt explores
+type replSession struct {
+	aclDir  string
+	profile string
+	webACL  string
+	files   []string
+	end     time.Time // End of the logs, which last clauses count back from
+	pretty  bool
+	out     io.Writer
+}
+
+// newREPLSession lists the log files of a Web ACL to explore
+func newREPLSession(outputDir, profile, webACL string, pretty bool) (*replSession, error) {
+	aclDir := filepath.Join(outputDir, profile, webACL)
+	files, err := analysis.ListLogFiles(aclDir)
+	if err != nil {
+		return nil, err
+	}
+	return &replSession{
+		aclDir:  aclDir,
+		profile: profile,
+		webACL:  webACL,
+		files:   files,
+		end:     datasetEnd(aclDir, files),
+		pretty:  pretty,
+		out:     os.Stdout,
+	}, nil
+}
+
+// datasetEnd returns the end of the logs of a Web ACL, which last clauses count back
+// from, or now for logs outside a partitioned layout
+func datasetEnd(aclDir string, files []string) time.Time {
+	if end := analysis.DatasetEnd(aclDir, files); !end.IsZero() {
+		return end
+	}
+	return time.Now().UTC()
+}
+
+// exec runs one line of the prompt and prints its outcome, reporting whether it
+// succeeded
+func (s *replSession) exec(line string) bool {
+	command, rest, _ := strings.Cut(strings.TrimSpace(line), " ")
+	rest = strings.TrimSpace(rest)
+	switch strings.ToLower(command) {
+	case "help":
+		fmt.Fprintf(s.out, replHelp, strings.Join(analysis.ConditionKeys, ", "))
+		return true
+	case "dimensions":
+		fmt.Fprintln(s.out, strings.Join(analysis.DimensionNames(), ", "))
+		return true
+	case "queries":
+		ws, err := workspace.Open(s.aclDir, s.profile, s.webACL)
+		if err != nil {
+			fmt.Fprintf(s.out, "%v\n", err)
+			return false
+		}
+		printQueries(ws.Queries)
+		return true
+	case "run":
+		ws, err := workspace.Open(s.aclDir, s.profile, s.webACL)
+		if err != nil {
+			fmt.Fprintf(s.out, "%v\n", err)
+			return false
+		}
+		q := ws.Query(rest)
+		if q == nil {
+			fmt.Fprintf(s.out, "Unknown query %q; queries lists the saved ones\n", rest)
+			return false
+		}
+		fmt.Fprintf(s.out, "%s: %s\n", q.Name, q.Statement)
+		line = q.Statement
+	case "save":
+		name, statement, _ := strings.Cut(rest, " ")
+		err := saveQuery(s.aclDir, s.profile, s.webACL, workspace.SavedQuery{
+			Name:      name,
+			Statement: strings.TrimSpace(statement),
+			SavedBy:   defaultReviewer(),
+			SavedAt:   time.Now().UTC(),
+		}, false)
+		if err != nil {
+			fmt.Fprintf(s.out, "%v\n", err)
+			return false
+		}
+		fmt.Fprintf(s.out, "Saved query %s\n", name)
+		return true
+	}
+
+	statement, err := analysis.ParseStatement(line)
+	if err != nil {
+		fmt.Fprintf(s.out, "%v\n", err)
+		return false
+	}
+	start := time.Now()
+	records := bufio.NewWriter(s.out)
+	result, err := statement.Run(s.aclDir, s.files, s.end, func(r *analysis.Record, raw []byte) error {
+		return writeRecord(records, raw, s.pretty)
+	})
+	records.Flush()
+	if err != nil {
+		fmt.Fprintf(s.out, "%v\n", err)
+		return false
+	}
+
+	switch statement.Verb {
+	case analysis.VerbTop:
+		w := tabwriter.NewWriter(s.out, 0, 0, 2, ' ', 0)
+		fmt.Fprintf(w, "%s\tREQUESTS\tSHARE\n", strings.ToUpper(statement.Dimension))
+		for _, c := range result.Top {
+			fmt.Fprintf(w, "%s\t%d\t%.1f%%\n", c.Key, c.Count, float64(c.Count)*100/float64(result.Matched))
+		}
+		w.Flush()
+	case analysis.VerbCount:
+		fmt.Fprintln(s.out, result.Matched)
+	}
+	fmt.Fprintf(s.out, "(%d matching records in %d of %d log files, %s)\n", result.Matched, result.Scanned, len(s.files), time.Since(start).Round(time.Millisecond))
+	return true
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"waf-log-retriever/analysis"
+	"waf-log-retriever/logging"
+	"waf-log-retriever/report"
+	"waf-log-retriever/workspace"
+)
+
+// runReport renders an analysis result as an HTML report
+func runReport(args []string) int {
+	fs := flag.NewFlagSet("report", flag.ExitOnError)
+	outputDir := fs.String("output-dir", "../logs/raw", "Directory containing retrieved logs")
+	profile := fs.String("profile", "", "AWS profile name the logs were retrieved with")
+	webACL := fs.String("web-acl", "", "Name of the Web ACL to report on")
+	resultFile := fs.String("result", "", "Analysis result to render (default: the latest for the Web ACL)")
+	out := fs.String("out", "", "Report file to write (default: <output-dir>/<profile>/<web-acl>/reports/report_<timestamp>.html)")
+	templateFile := fs.String("template", "", "Go html/template file overriding blocks of, or replacing, the default report template")
+	brandName := fs.String("brand-name", "", "Name of the customer or consultancy shown on the report")
+	brandLogo := fs.String("brand-logo", "", "Logo image (PNG, JPEG, SVG or GIF) embedded in the report header")
+	brandCSS := fs.String("brand-css", "", "Stylesheet added after the default report styles")
+	configFile := fs.String("report-config", "", "JSON file selecting the title, sections and minimum severity of the report")
+	title := fs.String("title", "", "Report title (default: from -report-config or \"AWS WAF Review: <web-acl>\")")
+	sections := fs.String("sections", "", "Comma-separated sections to include: "+strings.Join(report.Sections, ", ")+" (default: all)")
+	minSeverity := fs.String("min-severity", "", "Lowest severity of the findings shown (INFO, LOW, MEDIUM, HIGH, CRITICAL)")
+	signKey := fs.String("sign-key", "", "PEM private key to sign the report with (optional)")
+	logLevel := fs.String("log-level", "INFO", "Logging level (DEBUG, INFO, WARNING, ERROR)")
+	fs.Parse(args)
+
+	if *resultFile == "" && (*profile == "" || *webACL == "") {
+		fmt.Println("report requires -profile and -web-acl, or -result")
+		fs.Usage()
+		return 2
+	}
+
+	logger, err := logging.SetupLogger(*logLevel)
+	if err != nil {
+		fmt.Printf("Failed to initialize application: %v\n", err)
+		return 1
+	}
+	defer logger.Close()
+
+	aclDir := filepath.Join(*outputDir, *profile, *webACL)
+	resultPath := *resultFile
+	if resultPath == "" {
+		if resultPath, err = analysis.LatestResultPath(aclDir); err != nil {
+			logger.Errorf("%v", err)
+			return 1
+		}
+		if resultPath == "" {
+			logger.Errorf("No analysis results found in %s; run analyze first", aclDir)
+			return 1
+		}
+	}
+	logger.Infof("Rendering analysis result: %s", resultPath)
+
+	result, err := analysis.LoadResult(resultPath)
+	if err != nil {
+		logger.Errorf("%v", err)
+		return 1
+	}
+
+	options, err := report.LoadOptions(*configFile)
+	if err != nil {
+		logger.Errorf("%v", err)
+		return 1
+	}
+	if *title != "" {
+		options.Title = *title
+	}
+	if *sections != "" {
+		options.Sections = strings.Split(*sections, ",")
+	}
+	if *minSeverity != "" {
+		options.MinSeverity = strings.ToUpper(*minSeverity)
+	}
+	if err := options.Validate(); err != nil {
+		logger.Errorf("%v", err)
+		return 1
+	}
+
+	tmpl, err := report.LoadTemplate(*templateFile)
+	if err != nil {
+		logger.Errorf("%v", err)
+		return 1
+	}
+	branding, err := report.LoadBranding(*brandName, *brandLogo, *brandCSS)
+	if err != nil {
+		logger.Errorf("%v", err)
+		return 1
+	}
+
+	// Results live in <aclDir>/analysis, so the Web ACL directory is found from -result too
+	resultACLDir := filepath.Dir(filepath.Dir(resultPath))
+	removeStaleTempFiles(resultACLDir, logger.Infof, logger.Warningf)
+	data := report.NewData(result, branding, options)
+	if _, err := os.Stat(workspace.Path(resultACLDir)); err == nil {
+		if data.Workspace, err = workspace.Open(resultACLDir, result.ProfileName, result.WebACLName); err != nil {
+			logger.Errorf("%v", err)
+			return 1
+		}
+		logger.Infof("Including %d reviewer annotations", len(data.Workspace.Annotations))
+	}
+
+	reportPath := *out
+	if reportPath == "" {
+		dir := filepath.Join(resultACLDir, report.DirName)
+		reportPath = filepath.Join(dir, fmt.Sprintf("report_%s.html", time.Now().UTC().Format("20060102_150405")))
+	}
+	if err := tmpl.WriteFile(reportPath, data); err != nil {
+		logger.Errorf("%v", err)
+		return 1
+	}
+	logger.Infof("Report written to: %s", reportPath)
+
+	if *signKey != "" {
+		if err := signDeliverable(reportPath, *signKey, "", logger); err != nil {
+			logger.Errorf("Failed to sign report: %v", err)
+			return 1
+		}
+	}
+	return 0
+}
@@ -0,0 +1,462 @@
+// Package report renders analysis results as self-contained HTML reports
+package report
+
+import (
+	_ "embed"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"io"
+	"math"
+	"mime"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"text/template/parse"
+	"time"
+
+	"waf-log-retriever/analysis"
+	"waf-log-retriever/storage"
+	"waf-log-retriever/workspace"
+)
+
+// DirName is the directory, inside a Web ACL's log directory, where reports are written
+const DirName = "reports"
+
+//go:embed templates/report.html.tmpl
+var defaultTemplate string
+
+// Sections are the report sections that can be toggled, in report order
+var Sections = []string{"header", "summary", "findings", "policy", "casestudies", "assets", "annotations", "timing", "attacks", "origins", "scanners", "actors", "challenge", "hosts", "sources", "queries", "reconciliation"}
+
+// Options select what a report shows, e.g. an executive summary or a technical appendix
+type Options struct {
+	Title       string   `json:"title"`       // Overrides the default title
+	Sections    []string `json:"sections"`    // Sections to include; all when empty
+	MinSeverity string   `json:"minSeverity"` // Lowest severity of the findings shown; all when empty
+}
+
+// LoadOptions reads a report options file; an empty path returns the defaults
+func LoadOptions(path string) (Options, error) {
+	var options Options
+	if path == "" {
+		return options, nil
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return Options{}, fmt.Errorf("failed to read report config: %w", err)
+	}
+	if err := json.Unmarshal(data, &options); err != nil {
+		return Options{}, fmt.Errorf("failed to parse report config %s: %w", path, err)
+	}
+	return options, options.Validate()
+}
+
+// Validate checks the section names and the severity
+func (o Options) Validate() error {
+	for _, section := range o.Sections {
+		if !slices.Contains(Sections, section) {
+			return fmt.Errorf("unknown report section %q (known: %s)", section, strings.Join(Sections, ", "))
+		}
+	}
+	if o.MinSeverity != "" && !analysis.ValidSeverity(o.MinSeverity) {
+		return fmt.Errorf("unknown severity %q", o.MinSeverity)
+	}
+	return nil
+}
+
+// Data is what report templates are rendered with. Result holds the analysis result
+// exactly as in its JSON file, with Go field names (e.g. .Result.Stats.TotalRequests).
+type Data struct {
+	Title       string
+	GeneratedAt time.Time
+	Branding    Branding
+	Result      *analysis.Result
+	Findings    []analysis.Finding // Findings at or above MinSeverity
+	MinSeverity string
+	Traffic     HeatmapView // Heatmaps of .Result.Stats.Heatmap prepared for rendering
+	Blocks      HeatmapView
+	Origins     OriginMap            // World map of .Result.Origins
+	Workspace   *workspace.Workspace // Reviewer annotations; nil if the Web ACL has no workspace
+
+	sections []string
+}
+
+// Show reports whether a section is included in the report
+func (d *Data) Show(section string) bool {
+	return len(d.sections) == 0 || slices.Contains(d.sections, section)
+}
+
+// Engagement returns the engagement metadata of the review, or nil if none is recorded
+func (d *Data) Engagement() *workspace.Engagement {
+	if d.Workspace == nil {
+		return nil
+	}
+	return d.Workspace.Engagement
+}
+
+// EngagementFacts returns the customer, engagement ID, reviewer and review window of
+// the engagement metadata that are set, e.g. "Customer Example Corp", for the header
+func (d *Data) EngagementFacts() []string {
+	e := d.Engagement()
+	if e == nil {
+		return nil
+	}
+	var facts []string
+	for _, fact := range [][2]string{{"Customer", e.Customer}, {"Engagement", e.ID}, {"Reviewer", e.Reviewer}} {
+		if fact[1] != "" {
+			facts = append(facts, fact[0]+" "+fact[1])
+		}
+	}
+	if e.HasWindow() {
+		facts = append(facts, "Review window "+windowDate(e.WindowStart)+" to "+windowDate(e.WindowEnd))
+	}
+	return facts
+}
+
+// windowDate formats an end of the review window like the date template function,
+// "?" if it is open
+func windowDate(t time.Time) string {
+	if t.IsZero() {
+		return "?"
+	}
+	return t.Format("2006-01-02 15:04 MST")
+}
+
+// FindingAnnotations returns the reviewer annotations of a finding ID, oldest first
+func (d *Data) FindingAnnotations(id string) []workspace.Annotation {
+	if d.Workspace == nil {
+		return nil
+	}
+	return d.Workspace.AnnotationsFor(workspace.TargetFinding, id)
+}
+
+// Disposition returns the latest reviewer disposition of a finding ID, or ""
+func (d *Data) Disposition(id string) string {
+	if d.Workspace == nil {
+		return ""
+	}
+	return d.Workspace.Disposition(workspace.TargetFinding, id)
+}
+
+// EntityAnnotations are the reviewer annotations of one client IP or rule
+type EntityAnnotations struct {
+	Target      string // ip or rule
+	Key         string
+	Disposition string // Latest disposition
+	Annotations []workspace.Annotation
+}
+
+// Entities returns the annotated client IPs and rules in the order they were first annotated
+func (d *Data) Entities() []EntityAnnotations {
+	if d.Workspace == nil {
+		return nil
+	}
+	var entities []EntityAnnotations
+	seen := make(map[string]bool)
+	for _, a := range d.Workspace.Annotations {
+		if a.Target == workspace.TargetFinding || seen[a.Target+" "+a.Key] {
+			continue
+		}
+		seen[a.Target+" "+a.Key] = true
+		entities = append(entities, EntityAnnotations{
+			Target:      a.Target,
+			Key:         a.Key,
+			Disposition: d.Workspace.Disposition(a.Target, a.Key),
+			Annotations: d.Workspace.AnnotationsFor(a.Target, a.Key),
+		})
+	}
+	return entities
+}
+
+// Branding customizes the default report for the customer or consultancy delivering it
+type Branding struct {
+	Name string       // Shown as "Prepared by"
+	Logo template.URL // data: URL of the logo image
+	CSS  template.CSS // Added after the default styles
+}
+
+// LoadBranding reads the logo and stylesheet files of a branding; empty paths are skipped
+func LoadBranding(name, logoPath, cssPath string) (Branding, error) {
+	branding := Branding{Name: name}
+	if logoPath != "" {
+		data, err := os.ReadFile(logoPath)
+		if err != nil {
+			return Branding{}, fmt.Errorf("failed to read logo: %w", err)
+		}
+		mimeType := mime.TypeByExtension(filepath.Ext(logoPath))
+		if mimeType == "" {
+			return Branding{}, fmt.Errorf("unknown image type of logo %s", logoPath)
+		}
+		branding.Logo = template.URL("data:" + mimeType + ";base64," + base64.StdEncoding.EncodeToString(data))
+	}
+	if cssPath != "" {
+		data, err := os.ReadFile(cssPath)
+		if err != nil {
+			return Branding{}, fmt.Errorf("failed to read stylesheet: %w", err)
+		}
+		branding.CSS = template.CSS(data)
+	}
+	return branding, nil
+}
+
+// HeatmapView is a heatmap prepared for rendering, one row per day of the week
+type HeatmapView struct {
+	Title string
+	Max   int64
+	Rows  []HeatmapRow
+}
+
+// HeatmapRow is one day of a heatmap
+type HeatmapRow struct {
+	Day   string
+	Cells []HeatmapCell
+}
+
+// HeatmapCell is one hour of a heatmap; Level is the count relative to the busiest cell, from 0 to 1
+type HeatmapCell struct {
+	Hour  int
+	Count int64
+	Level float64
+}
+
+// NewData prepares an analysis result for rendering
+func NewData(result *analysis.Result, branding Branding, options Options) *Data {
+	data := &Data{
+		Title:       fmt.Sprintf("AWS WAF Review: %s", result.WebACLName),
+		GeneratedAt: time.Now().UTC(),
+		Branding:    branding,
+		Result:      result,
+		Findings:    []analysis.Finding{},
+		MinSeverity: options.MinSeverity,
+		sections:    options.Sections,
+	}
+	if options.Title != "" {
+		data.Title = options.Title
+	}
+	minRank := analysis.SeverityRank(options.MinSeverity)
+	for _, f := range result.Findings {
+		if analysis.SeverityRank(f.Severity) >= minRank {
+			data.Findings = append(data.Findings, f)
+		}
+	}
+	if result.Stats != nil && result.Stats.Heatmap != nil {
+		data.Traffic = heatmapView("Requests", &result.Stats.Heatmap.Requests)
+		data.Blocks = heatmapView("Blocked requests", &result.Stats.Heatmap.Blocked)
+	}
+	data.Origins = originMap(result.Origins)
+	return data
+}
+
+// heatmapView scales heatmap counts to the busiest cell
+func heatmapView(title string, counts *[7][24]int64) HeatmapView {
+	view := HeatmapView{Title: title}
+	for _, row := range counts {
+		for _, n := range row {
+			if n > view.Max {
+				view.Max = n
+			}
+		}
+	}
+	for day, row := range counts {
+		r := HeatmapRow{Day: analysis.Weekdays[day]}
+		for hour, n := range row {
+			cell := HeatmapCell{Hour: hour, Count: n}
+			if view.Max > 0 {
+				cell.Level = float64(n) / float64(view.Max)
+			}
+			r.Cells = append(r.Cells, cell)
+		}
+		view.Rows = append(view.Rows, r)
+	}
+	return view
+}
+
+// OriginMap is a tile grid map of the world prepared for rendering: every country is
+// a tile placed near its centroid and shaded by the attacks from it, so no map
+// geometry has to be embedded in the report
+type OriginMap struct {
+	Width, Height int // In SVG units
+	Tiles         []OriginTile
+	MaxAttacks    int64
+	Unlocated     int64 // Requests from codes the country table lacks, e.g. "-"
+}
+
+// OriginTile is one country of an origin map; Level is its attacks relative to the
+// country with the most on a log scale, from 0 to 1
+type OriginTile struct {
+	X, Y   int
+	Code   string
+	Name   string
+	Counts analysis.OriginCounts
+	Level  float64
+}
+
+// Tile grid of origin maps: cells of tileDegrees in longitude and latitude, from
+// tileTop degrees north, drawn tileSize units wide
+const (
+	tileDegrees = 5
+	tileTop     = 75
+	tileColumns = 360 / tileDegrees
+	tileRows    = (tileTop + 50) / tileDegrees // Down to 50 degrees south
+	tileSize    = 14
+)
+
+// tileCells places the countries of the built-in table on the tile grid
+var tileCells = layoutTiles(analysis.CountryLocations())
+
+// layoutTiles places each country in the grid cell of its centroid or, if a country
+// earlier in the table took it, the nearest free cell, so small neighbours such as
+// the countries of Europe spread out around their true positions
+func layoutTiles(locations []analysis.CountryLocation) map[string][2]int {
+	cells := make(map[string][2]int, len(locations))
+	taken := make(map[[2]int]bool, len(locations))
+	for _, l := range locations {
+		col := min(max(int((l.Lon+180)/tileDegrees), 0), tileColumns-1)
+		row := min(max(int((tileTop-l.Lat)/tileDegrees), 0), tileRows-1)
+		for radius := 0; radius < tileColumns; radius++ {
+			best, bestDistance := [2]int{-1, -1}, -1
+			for dy := -radius; dy <= radius; dy++ {
+				for dx := -radius; dx <= radius; dx++ {
+					if max(abs(dx), abs(dy)) != radius {
+						continue // Inner rings were searched already
+					}
+					cell := [2]int{col + dx, row + dy}
+					if cell[0] < 0 || cell[0] >= tileColumns || cell[1] < 0 || cell[1] >= tileRows || taken[cell] {
+						continue
+					}
+					if d := dx*dx + dy*dy; bestDistance < 0 || d < bestDistance {
+						best, bestDistance = cell, d
+					}
+				}
+			}
+			if bestDistance >= 0 {
+				cells[l.Code] = best
+				taken[best] = true
+				break
+			}
+		}
+	}
+	return cells
+}
+
+func abs(n int) int {
+	if n < 0 {
+		return -n
+	}
+	return n
+}
+
+// originMap shades the tile grid by the attacks of each country of origin
+func originMap(origins []analysis.OriginReport) OriginMap {
+	m := OriginMap{Width: tileColumns * tileSize, Height: tileRows * tileSize}
+	if len(origins) == 0 {
+		return m
+	}
+	counts := make(map[string]analysis.OriginCounts, len(origins))
+	for _, o := range origins {
+		if !o.Located {
+			m.Unlocated += o.Requests
+			continue
+		}
+		counts[o.Country] = o.OriginCounts
+		m.MaxAttacks = max(m.MaxAttacks, o.Attacks)
+	}
+	for _, l := range analysis.CountryLocations() {
+		cell := tileCells[l.Code]
+		tile := OriginTile{X: cell[0] * tileSize, Y: cell[1] * tileSize, Code: l.Code, Name: l.Name, Counts: counts[l.Code]}
+		if m.MaxAttacks > 0 {
+			tile.Level = math.Log1p(float64(tile.Counts.Attacks)) / math.Log1p(float64(m.MaxAttacks))
+		}
+		m.Tiles = append(m.Tiles, tile)
+	}
+	return m
+}
+
+// funcs are the helper functions available to report templates
+var funcs = template.FuncMap{
+	"percent": func(part, total int64) string {
+		if total == 0 {
+			return "0%"
+		}
+		return fmt.Sprintf("%.1f%%", float64(part)*100/float64(total))
+	},
+	"heat": func(level float64) template.CSS {
+		return template.CSS(fmt.Sprintf("background-color: rgba(192, 57, 43, %.2f)", level))
+	},
+	"tileFill": func(t OriginTile) template.CSS {
+		switch {
+		case t.Counts.Attacks > 0:
+			return template.CSS(fmt.Sprintf("fill: rgba(192, 57, 43, %.2f)", 0.15+0.85*t.Level))
+		case t.Counts.Requests > 0:
+			return "fill: #d6eaf8" // Traffic without attacks
+		}
+		return "fill: #eee"
+	},
+	"date": func(t time.Time) string {
+		return t.Format("2006-01-02 15:04 MST")
+	},
+}
+
+// Template is a parsed report template
+type Template struct {
+	tmpl *template.Template
+	name string // Template to execute
+}
+
+// LoadTemplate parses the default report template and, if customPath is set, a custom
+// template over it. A custom template either redefines blocks of the default one with
+// {{define}} (styles, header, summary, findings, timing, heatmap, attacks, origins, scanners,
+// hosts, footer) or, if it has content outside {{define}}, replaces it completely.
+func LoadTemplate(customPath string) (*Template, error) {
+	tmpl, err := template.New("report").Funcs(funcs).Parse(defaultTemplate)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse report template: %w", err)
+	}
+	if customPath == "" {
+		return &Template{tmpl: tmpl, name: "report"}, nil
+	}
+
+	text, err := os.ReadFile(customPath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read report template: %w", err)
+	}
+	custom, err := tmpl.New("custom").Parse(string(text))
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse report template %s: %w", customPath, err)
+	}
+	if custom.Tree != nil && !parse.IsEmptyTree(custom.Tree.Root) {
+		return &Template{tmpl: tmpl, name: "custom"}, nil
+	}
+	return &Template{tmpl: tmpl, name: "report"}, nil
+}
+
+// Render writes the HTML report of an analysis result
+func (t *Template) Render(w io.Writer, data *Data) error {
+	if err := t.tmpl.ExecuteTemplate(w, t.name, data); err != nil {
+		return fmt.Errorf("failed to render report: %w", err)
+	}
+	return nil
+}
+
+// WriteFile renders the report of an analysis result to path
+func (t *Template) WriteFile(path string, data *Data) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return fmt.Errorf("failed to create report directory: %w", err)
+	}
+	file, err := storage.CreateAtomic(path)
+	if err != nil {
+		return fmt.Errorf("failed to create report: %w", err)
+	}
+	defer file.Abort()
+
+	if err := t.Render(file, data); err != nil {
+		return err
+	}
+	if err := file.Commit(); err != nil {
+		return fmt.Errorf("failed to write report: %w", err)
+	}
+	return nil
+}
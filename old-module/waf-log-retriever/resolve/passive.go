@@ -0,0 +1,206 @@
+package resolve
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Passive DNS providers
+const (
+	ProviderCIRCL = "circl" // CIRCL Passive DNS
+	ProviderDNSDB = "dnsdb" // DomainTools (Farsight) DNSDB API v2
+)
+
+// Default endpoints and API key variables of the providers
+const (
+	circlEndpoint = "https://www.circl.lu/pdns"
+	dnsdbEndpoint = "https://api.dnsdb.info"
+	circlKeyEnv   = "CIRCL_PDNS_AUTH"
+	dnsdbKeyEnv   = "DNSDB_API_KEY"
+)
+
+// PassiveConfig selects and tunes the passive DNS service
+type PassiveConfig struct {
+	Provider       string `json:"provider"`       // circl or dnsdb
+	Endpoint       string `json:"endpoint"`       // API base URL (default: the provider's public API)
+	APIKeyEnv      string `json:"apiKeyEnv"`      // Environment variable holding the DNSDB API key, or the CIRCL "<user>:<password>"
+	MaxNames       int    `json:"maxNames"`       // Names kept per address, most recently seen first
+	TimeoutSeconds int    `json:"timeoutSeconds"` // Per request
+}
+
+// LoadPassiveConfig reads a passive DNS config file over the defaults
+func LoadPassiveConfig(path string) (*PassiveConfig, error) {
+	cfg := &PassiveConfig{MaxNames: 20, TimeoutSeconds: 30}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read passive DNS config: %w", err)
+	}
+	if err := json.Unmarshal(data, cfg); err != nil {
+		return nil, fmt.Errorf("failed to parse passive DNS config %s: %w", path, err)
+	}
+	switch cfg.Provider {
+	case ProviderCIRCL:
+		if cfg.Endpoint == "" {
+			cfg.Endpoint = circlEndpoint
+		}
+		if cfg.APIKeyEnv == "" {
+			cfg.APIKeyEnv = circlKeyEnv
+		}
+	case ProviderDNSDB:
+		if cfg.Endpoint == "" {
+			cfg.Endpoint = dnsdbEndpoint
+		}
+		if cfg.APIKeyEnv == "" {
+			cfg.APIKeyEnv = dnsdbKeyEnv
+		}
+	default:
+		return nil, fmt.Errorf("invalid passive DNS config %s: unknown provider %q (want %s or %s)", path, cfg.Provider, ProviderCIRCL, ProviderDNSDB)
+	}
+	if cfg.MaxNames <= 0 || cfg.TimeoutSeconds <= 0 {
+		return nil, fmt.Errorf("invalid passive DNS config %s: maxNames and timeoutSeconds must be positive", path)
+	}
+	return cfg, nil
+}
+
+// Passive looks up the names passive DNS saw resolve to addresses
+type Passive struct {
+	cfg    *PassiveConfig
+	apiKey string
+	client *http.Client
+}
+
+// NewPassive creates a passive DNS client, reading its API key from the environment
+func NewPassive(cfg *PassiveConfig) (*Passive, error) {
+	apiKey := os.Getenv(cfg.APIKeyEnv)
+	if apiKey == "" {
+		return nil, fmt.Errorf("%s passive DNS needs an API key in %s", cfg.Provider, cfg.APIKeyEnv)
+	}
+	if _, _, ok := strings.Cut(apiKey, ":"); cfg.Provider == ProviderCIRCL && !ok {
+		return nil, fmt.Errorf("%s must hold the CIRCL credentials as <user>:<password>", cfg.APIKeyEnv)
+	}
+	return &Passive{
+		cfg:    cfg,
+		apiKey: apiKey,
+		client: &http.Client{Timeout: time.Duration(cfg.TimeoutSeconds) * time.Second},
+	}, nil
+}
+
+// Provider returns the name of the passive DNS provider
+func (p *Passive) Provider() string {
+	return p.cfg.Provider
+}
+
+// passiveRecord is one resource record of a passive DNS answer. DNSDB wraps each
+// record in an object of its streaming format; CIRCL returns the records themselves.
+type passiveRecord struct {
+	RRName   string         `json:"rrname"`
+	RRType   string         `json:"rrtype"`
+	TimeLast int64          `json:"time_last"`
+	Obj      *passiveRecord `json:"obj"`
+}
+
+// Lookup returns the names passive DNS saw resolve to each address, one request per
+// address. On an error it returns the names found so far with the error.
+func (p *Passive) Lookup(ctx context.Context, addresses []string) (map[string][]string, error) {
+	names := make(map[string][]string)
+	for _, address := range addresses {
+		found, err := p.names(ctx, address)
+		if err != nil {
+			return names, fmt.Errorf("passive DNS lookup of %s failed: %w", address, err)
+		}
+		if len(found) > 0 {
+			names[address] = found
+		}
+	}
+	return names, nil
+}
+
+// names queries the names of one address, most recently seen first
+func (p *Passive) names(ctx context.Context, address string) ([]string, error) {
+	endpoint := strings.TrimSuffix(p.cfg.Endpoint, "/")
+	var req *http.Request
+	var err error
+	switch p.cfg.Provider {
+	case ProviderCIRCL:
+		req, err = http.NewRequestWithContext(ctx, http.MethodGet, endpoint+"/query/"+url.PathEscape(address), nil)
+		if err == nil {
+			user, password, _ := strings.Cut(p.apiKey, ":")
+			req.SetBasicAuth(user, password)
+		}
+	case ProviderDNSDB:
+		req, err = http.NewRequestWithContext(ctx, http.MethodGet, fmt.Sprintf("%s/dnsdb/v2/lookup/rdata/ip/%s?limit=%d", endpoint, url.PathEscape(address), p.cfg.MaxNames*5), nil)
+		if err == nil {
+			req.Header.Set("X-API-Key", p.apiKey)
+			req.Header.Set("Accept", "application/x-ndjson")
+		}
+	default:
+		return nil, fmt.Errorf("unknown passive DNS provider %q", p.cfg.Provider)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to create request: %w", err)
+	}
+
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to call %s: %w", req.URL.Host, err)
+	}
+	defer resp.Body.Close()
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read response from %s: %w", req.URL.Host, err)
+	}
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, nil // No records
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%s returned %s: %s", req.URL.Host, resp.Status, strings.TrimSpace(string(data)))
+	}
+
+	var records []passiveRecord
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		line := bytes.TrimSpace(scanner.Bytes())
+		if len(line) == 0 {
+			continue
+		}
+		var record passiveRecord
+		if err := json.Unmarshal(line, &record); err != nil {
+			return nil, fmt.Errorf("failed to parse response from %s: %w", req.URL.Host, err)
+		}
+		if record.Obj != nil {
+			record = *record.Obj
+		}
+		if record.RRType == "A" || record.RRType == "AAAA" {
+			records = append(records, record)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read response from %s: %w", req.URL.Host, err)
+	}
+
+	sort.SliceStable(records, func(i, j int) bool { return records[i].TimeLast > records[j].TimeLast })
+	var names []string
+	seen := make(map[string]bool)
+	for _, record := range records {
+		name := strings.ToLower(strings.TrimSuffix(record.RRName, "."))
+		if name == "" || seen[name] {
+			continue
+		}
+		seen[name] = true
+		if names = append(names, name); len(names) == p.cfg.MaxNames {
+			break
+		}
+	}
+	return names, nil
+}
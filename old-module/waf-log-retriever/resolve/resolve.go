@@ -0,0 +1,79 @@
+// Package resolve looks up the DNS names of attacker IPs: their reverse DNS names
+// through the system resolver, and the names a passive DNS service saw resolve to
+// them. Both send the addresses to outside services, so both are opt-in.
+package resolve
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DefaultWorkers is the number of concurrent reverse DNS queries
+const DefaultWorkers = 16
+
+// reverseTimeout bounds one reverse DNS query
+const reverseTimeout = 5 * time.Second
+
+// Reverse looks up the PTR names of addresses with at most workers concurrent
+// queries. Addresses without names are left out; failed counts the lookups that
+// failed other than with "not found".
+func Reverse(ctx context.Context, resolver *net.Resolver, addresses []string, workers int) (names map[string][]string, failed int) {
+	if workers <= 0 {
+		workers = DefaultWorkers
+	}
+	names = make(map[string][]string)
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	queue := make(chan string)
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for address := range queue {
+				lookupCtx, cancel := context.WithTimeout(ctx, reverseTimeout)
+				found, err := resolver.LookupAddr(lookupCtx, address)
+				cancel()
+				var dnsErr *net.DNSError
+				mu.Lock()
+				if err != nil && !(errors.As(err, &dnsErr) && dnsErr.IsNotFound) {
+					failed++
+				}
+				if found = normalizeNames(found); len(found) > 0 {
+					names[address] = found
+				}
+				mu.Unlock()
+			}
+		}()
+	}
+	for _, address := range addresses {
+		if ctx.Err() != nil {
+			break
+		}
+		queue <- address
+	}
+	close(queue)
+	wg.Wait()
+	return names, failed
+}
+
+// normalizeNames lower-cases names, drops their trailing dots and duplicates, and
+// sorts them
+func normalizeNames(names []string) []string {
+	var normalized []string
+	seen := make(map[string]bool)
+	for _, name := range names {
+		name = strings.ToLower(strings.TrimSuffix(name, "."))
+		if name == "" || seen[name] {
+			continue
+		}
+		seen[name] = true
+		normalized = append(normalized, name)
+	}
+	sort.Strings(normalized)
+	return normalized
+}
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+
+	"waf-log-retriever/analysis"
+	"waf-log-retriever/workspace"
+)
+
+// runScopeDown recommends scope-down statements for the managed rule groups of a Web
+// ACL that matched requests the reviewers marked as false positives
+func runScopeDown(args []string) int {
+	fs := flag.NewFlagSet("scope-down", flag.ExitOnError)
+	outputDir := fs.String("output-dir", "../logs/raw", "Directory containing retrieved logs")
+	profile := fs.String("profile", "", "AWS profile name the logs were retrieved with")
+	webACL := fs.String("web-acl", "", "Name of the Web ACL whose rule groups to scope down")
+	snapshotFile := fs.String("snapshot", "", "Web ACL snapshot to take the rules from (default: the latest for the Web ACL)")
+	minFalsePositives := fs.Int64("min-false-positives", 5, "False positives a rule group needs to get a recommendation")
+	maxPaths := fs.Int("max-paths", 10, "Most paths to exclude from each rule group")
+	jsonOutput := fs.Bool("json", false, "Write the recommendations with their evidence as JSON")
+	out := fs.String("out", "", "File to write the recommendations to (default: standard output)")
+	fs.Parse(args)
+
+	if *profile == "" || *webACL == "" {
+		fmt.Println("scope-down requires -profile and -web-acl")
+		fs.Usage()
+		return 2
+	}
+	if *maxPaths < 1 {
+		fmt.Println("scope-down requires a positive -max-paths")
+		return 2
+	}
+
+	aclDir := filepath.Join(*outputDir, *profile, *webACL)
+	snapshotPath := *snapshotFile
+	if snapshotPath == "" {
+		var err error
+		if snapshotPath, err = analysis.LatestSnapshotPath(aclDir); err != nil {
+			fmt.Printf("%v\n", err)
+			return 1
+		}
+		if snapshotPath == "" {
+			fmt.Printf("No Web ACL snapshots found in %s; retrieve logs to capture one\n", aclDir)
+			return 1
+		}
+	}
+	snapshot, err := analysis.LoadSnapshot(snapshotPath)
+	if err != nil {
+		fmt.Printf("%v\n", err)
+		return 1
+	}
+	ws, err := workspace.Open(aclDir, *profile, *webACL)
+	if err != nil {
+		fmt.Printf("%v\n", err)
+		return 1
+	}
+
+	// A match is a false positive when the reviewers marked the rule, its rule group
+	// or the client IP as one
+	falsePositive := func(key, target string) bool {
+		return ws.Disposition(target, key) == workspace.DispositionFalsePositive
+	}
+	scopeDown := analysis.NewScopeDownAnalysis(snapshot, func(r *analysis.Record, webACLRule, ruleGroupID, ruleID string) bool {
+		return falsePositive(ruleID, workspace.TargetRule) || falsePositive(ruleGroupID, workspace.TargetRule) ||
+			falsePositive(webACLRule, workspace.TargetRule) || falsePositive(r.HTTPRequest.ClientIP, workspace.TargetIP)
+	})
+	if scopeDown.RuleGroups() == 0 {
+		fmt.Printf("Web ACL %s has no managed rule groups in %s\n", *webACL, snapshotPath)
+		return 1
+	}
+
+	files, err := analysis.ListLogFiles(aclDir)
+	if err != nil {
+		fmt.Printf("%v\n", err)
+		return 1
+	}
+	for _, file := range files {
+		if err := analysis.ForEachRecord(file, func(r *analysis.Record) error {
+			scopeDown.Add(r)
+			return nil
+		}); err != nil {
+			fmt.Printf("%v\n", err)
+			return 1
+		}
+	}
+	recs := scopeDown.Recommendations(*minFalsePositives, *maxPaths)
+
+	var buf bytes.Buffer
+	if *jsonOutput {
+		if recs == nil {
+			recs = []analysis.ScopeDownRecommendation{}
+		}
+		encoder := json.NewEncoder(&buf)
+		encoder.SetIndent("", "  ")
+		err = encoder.Encode(recs)
+	} else {
+		err = printScopeDown(&buf, recs)
+	}
+	if err != nil {
+		fmt.Printf("Failed to encode recommendations: %v\n", err)
+		return 1
+	}
+	if *out == "" {
+		os.Stdout.Write(buf.Bytes())
+		return 0
+	}
+	if err := os.WriteFile(*out, buf.Bytes(), 0644); err != nil {
+		fmt.Printf("Failed to write recommendations: %v\n", err)
+		return 1
+	}
+	fmt.Printf("%d scope-down recommendations written to %s\n", len(recs), *out)
+	return 0
+}
+
+// printScopeDown writes each recommendation's evidence followed by its rule JSON
+func printScopeDown(w io.Writer, recs []analysis.ScopeDownRecommendation) error {
+	if len(recs) == 0 {
+		fmt.Fprintln(w, "No managed rule group matched enough requests marked as false positives")
+		return nil
+	}
+	for i, rec := range recs {
+		if i > 0 {
+			fmt.Fprintln(w)
+		}
+		fmt.Fprintf(w, "Rule %s (%s): %d of %d matches are false positives\n", rec.Rule, rec.RuleGroupID, rec.FalsePositives, rec.Matches)
+		if len(rec.SubRules) > 0 {
+			fmt.Fprintf(w, "  Rules with false positives: %s\n", formatCounts(rec.SubRules))
+		}
+		fmt.Fprintln(w, "  Excluded from inspection:")
+		for _, p := range rec.Paths {
+			host := p.Host
+			if host == "" {
+				host = "any host"
+			}
+			fmt.Fprintf(w, "    %s %s (%s): %d false positives, %d other matches\n", host, p.Path, p.Match, p.FalsePositives, p.OtherMatches)
+		}
+		if rec.Uncovered > 0 {
+			fmt.Fprintf(w, "  %d false positives on further paths are not excluded; raise -max-paths to cover them\n", rec.Uncovered)
+		}
+		if rec.LostMatches > 0 {
+			fmt.Fprintf(w, "  The rule group would no longer inspect %d requests it matched that are not marked false positives\n", rec.LostMatches)
+		}
+		ruleJSON, err := analysis.MarshalRuleJSON(rec.RuleJSON)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(w, "%s\n", ruleJSON)
+	}
+	return nil
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"waf-log-retriever/analysis"
+)
+
+// errSearchLimit stops a search once enough records matched
+var errSearchLimit = errors.New("search limit reached")
+
+// runSearch prints the raw WAF records of a Web ACL's retrieved logs that match a query
+func runSearch(args []string) int {
+	fs := flag.NewFlagSet("search", flag.ExitOnError)
+	outputDir := fs.String("output-dir", "../logs/raw", "Directory containing retrieved logs")
+	profile := fs.String("profile", "", "AWS profile name the logs were retrieved with")
+	webACL := fs.String("web-acl", "", "Name of the Web ACL whose logs to search")
+	var q analysis.Query
+	fs.StringVar(&q.IP, "ip", "", "Client IP or CIDR range")
+	fs.StringVar(&q.URI, "uri", "", "Substring of the URI")
+	fs.StringVar(&q.Args, "args", "", "Substring of the query string")
+	fs.StringVar(&q.Header, "header", "", "Header name, or name=value to match a substring of its value")
+	fs.StringVar(&q.Rule, "rule", "", "Substring of a matched rule ID, rule group ID or label")
+	fs.StringVar(&q.Action, "action", "", "Action: ALLOW, BLOCK, COUNT, CAPTCHA or CHALLENGE")
+	fs.StringVar(&q.Host, "host", "", "Host header (*.example.com matches subdomains)")
+	fs.StringVar(&q.Country, "country", "", "Two-letter country code")
+	fs.StringVar(&q.RequestID, "request-id", "", "Request ID")
+	fs.StringVar(&q.Text, "text", "", "Substring of the raw record JSON")
+	from := fs.String("from", "", "Only records at or after this time (YYYY-MM-DD or YYYY-MM-DDTHH:mm:ssZ)")
+	to := fs.String("to", "", "Only records before this time (YYYY-MM-DD or YYYY-MM-DDTHH:mm:ssZ)")
+	limit := fs.Int("limit", 100, "Stop after printing this many matches (0: no limit)")
+	count := fs.Bool("count", false, "Only count the matches, without a limit")
+	pretty := fs.Bool("pretty", false, "Indent the printed records")
+	fs.Parse(args)
+
+	if *profile == "" || *webACL == "" {
+		fmt.Println("search requires -profile and -web-acl")
+		fs.Usage()
+		return 2
+	}
+	var err error
+	if *from != "" {
+		if q.From, err = parseTime(*from); err != nil {
+			fmt.Printf("Invalid -from: %v\n", err)
+			return 2
+		}
+	}
+	if *to != "" {
+		if q.To, err = parseTime(*to); err != nil {
+			fmt.Printf("Invalid -to: %v\n", err)
+			return 2
+		}
+	}
+	if err := q.Compile(); err != nil {
+		fmt.Printf("%v\n", err)
+		return 2
+	}
+
+	if *count {
+		*limit = 0
+	}
+
+	aclDir := filepath.Join(*outputDir, *profile, *webACL)
+	files, err := analysis.ListLogFiles(aclDir)
+	if err != nil {
+		fmt.Printf("%v\n", err)
+		return 1
+	}
+
+	out := bufio.NewWriter(os.Stdout)
+	defer out.Flush()
+	start := time.Now()
+	matched, scanned := 0, 0
+	for _, file := range files {
+		if !q.MayContain(aclDir, file) {
+			continue
+		}
+		scanned++
+		err := q.ForEachMatch(file, func(r *analysis.Record, raw []byte) error {
+			matched++
+			if !*count {
+				if err := writeRecord(out, raw, *pretty); err != nil {
+					return err
+				}
+			}
+			if *limit > 0 && matched >= *limit {
+				return errSearchLimit
+			}
+			return nil
+		})
+		if errors.Is(err, errSearchLimit) {
+			break
+		}
+		if err != nil {
+			out.Flush()
+			fmt.Fprintf(os.Stderr, "%v\n", err)
+			return 1
+		}
+	}
+	out.Flush()
+
+	summary := fmt.Sprintf("%d matching records in %d of %d log files (%s)", matched, scanned, len(files), time.Since(start).Round(time.Millisecond))
+	if *limit > 0 && matched >= *limit {
+		summary += fmt.Sprintf("; stopped at -limit %d", *limit)
+	}
+	if *count {
+		fmt.Println(matched)
+	}
+	fmt.Fprintln(os.Stderr, summary)
+	return 0
+}
+
+// writeRecord prints a raw record on one line, or indented
+func writeRecord(out *bufio.Writer, raw []byte, pretty bool) error {
+	if pretty {
+		var buf bytes.Buffer
+		if err := json.Indent(&buf, raw, "", "  "); err == nil {
+			raw = buf.Bytes()
+		}
+	}
+	if _, err := out.Write(bytes.TrimSpace(raw)); err != nil {
+		return err
+	}
+	return out.WriteByte('\n')
+}
@@ -0,0 +1,74 @@
+package secrets
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"filippo.io/age"
+)
+
+// AgeIdentityEnv names the environment variable holding the path of the age
+// identity (private key) file used to decrypt "age:" values
+const AgeIdentityEnv = "WAF_AGE_IDENTITY_FILE"
+
+// AgeResolver decrypts "age:<base64 ciphertext>" values with the identities in
+// identityFile. The file is only read once an age value is found.
+func AgeResolver(identityFile string) Resolver {
+	var identities []age.Identity
+	return func(ctx context.Context, ref string) (string, error) {
+		if identities == nil {
+			if identityFile == "" {
+				return "", fmt.Errorf("set %s to the age identity file to decrypt age values", AgeIdentityEnv)
+			}
+			file, err := os.Open(identityFile)
+			if err != nil {
+				return "", fmt.Errorf("failed to open age identity file: %w", err)
+			}
+			defer file.Close()
+			if identities, err = age.ParseIdentities(file); err != nil {
+				return "", fmt.Errorf("failed to parse age identity file %s: %w", identityFile, err)
+			}
+		}
+
+		ciphertext, err := base64.StdEncoding.DecodeString(ref)
+		if err != nil {
+			return "", fmt.Errorf("invalid base64 ciphertext: %w", err)
+		}
+		r, err := age.Decrypt(bytes.NewReader(ciphertext), identities...)
+		if err != nil {
+			return "", fmt.Errorf("age decrypt failed: %w", err)
+		}
+		plaintext, err := io.ReadAll(r)
+		if err != nil {
+			return "", fmt.Errorf("age decrypt failed: %w", err)
+		}
+		return string(plaintext), nil
+	}
+}
+
+// EncryptAge encrypts a value to age recipients (e.g. "age1...") and returns it in
+// the "age:<base64 ciphertext>" config form
+func EncryptAge(recipients []string, plaintext string) (string, error) {
+	parsed, err := age.ParseRecipients(strings.NewReader(strings.Join(recipients, "\n")))
+	if err != nil {
+		return "", fmt.Errorf("invalid age recipient: %w", err)
+	}
+
+	var buf bytes.Buffer
+	w, err := age.Encrypt(&buf, parsed...)
+	if err != nil {
+		return "", fmt.Errorf("age encrypt failed: %w", err)
+	}
+	if _, err := io.WriteString(w, plaintext); err != nil {
+		return "", fmt.Errorf("age encrypt failed: %w", err)
+	}
+	if err := w.Close(); err != nil {
+		return "", fmt.Errorf("age encrypt failed: %w", err)
+	}
+	return PrefixAge + ":" + base64.StdEncoding.EncodeToString(buf.Bytes()), nil
+}
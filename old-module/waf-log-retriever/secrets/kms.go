@@ -0,0 +1,43 @@
+package secrets
+
+import (
+	"context"
+	"encoding/base64"
+	"fmt"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/kms"
+)
+
+// KMSResolver decrypts "kms:<base64 ciphertext>" values with AWS KMS through the
+// active session. The ciphertext embeds the key, so no key ID is needed.
+func KMSResolver(awsCfg aws.Config) Resolver {
+	var client *kms.Client
+	return func(ctx context.Context, ref string) (string, error) {
+		ciphertext, err := base64.StdEncoding.DecodeString(ref)
+		if err != nil {
+			return "", fmt.Errorf("invalid base64 ciphertext: %w", err)
+		}
+		if client == nil {
+			client = kms.NewFromConfig(awsCfg)
+		}
+		out, err := client.Decrypt(ctx, &kms.DecryptInput{CiphertextBlob: ciphertext})
+		if err != nil {
+			return "", fmt.Errorf("KMS decrypt failed: %w", err)
+		}
+		return string(out.Plaintext), nil
+	}
+}
+
+// EncryptKMS encrypts a value with a KMS key (ID, ARN or alias) and returns it in
+// the "kms:<base64 ciphertext>" config form
+func EncryptKMS(ctx context.Context, awsCfg aws.Config, keyID, plaintext string) (string, error) {
+	out, err := kms.NewFromConfig(awsCfg).Encrypt(ctx, &kms.EncryptInput{
+		KeyId:     aws.String(keyID),
+		Plaintext: []byte(plaintext),
+	})
+	if err != nil {
+		return "", fmt.Errorf("KMS encrypt failed: %w", err)
+	}
+	return PrefixKMS + ":" + base64.StdEncoding.EncodeToString(out.CiphertextBlob), nil
+}
@@ -0,0 +1,75 @@
+package secrets
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/secretsmanager"
+	"github.com/aws/aws-sdk-go-v2/service/ssm"
+)
+
+// Reference prefixes; a config value "ssm:/path" is replaced with the parameter value
+const (
+	PrefixSecretsManager = "secretsmanager"
+	PrefixSSM            = "ssm"
+)
+
+// SecretsManagerResolver resolves "secretsmanager:<name or ARN>" references through
+// the active session. "secretsmanager:<name>#<key>" selects one key of a JSON secret.
+func SecretsManagerResolver(awsCfg aws.Config) Resolver {
+	var client *secretsmanager.Client
+	return func(ctx context.Context, ref string) (string, error) {
+		name, key, hasKey := strings.Cut(ref, "#")
+		if client == nil {
+			client = secretsmanager.NewFromConfig(awsCfg)
+		}
+		out, err := client.GetSecretValue(ctx, &secretsmanager.GetSecretValueInput{SecretId: aws.String(name)})
+		if err != nil {
+			return "", fmt.Errorf("failed to get secret %s: %w", name, err)
+		}
+		if out.SecretString == nil {
+			return "", fmt.Errorf("secret %s is binary; only string secrets are supported", name)
+		}
+		if !hasKey {
+			return *out.SecretString, nil
+		}
+
+		var fields map[string]interface{}
+		if err := json.Unmarshal([]byte(*out.SecretString), &fields); err != nil {
+			return "", fmt.Errorf("secret %s is not a JSON object, so key %q cannot be selected", name, key)
+		}
+		value, ok := fields[key]
+		if !ok {
+			return "", fmt.Errorf("secret %s has no key %q", name, key)
+		}
+		if s, ok := value.(string); ok {
+			return s, nil
+		}
+		return fmt.Sprint(value), nil
+	}
+}
+
+// SSMResolver resolves "ssm:<parameter name>" references to SSM Parameter Store
+// parameters through the active session, decrypting SecureString parameters
+func SSMResolver(awsCfg aws.Config) Resolver {
+	var client *ssm.Client
+	return func(ctx context.Context, ref string) (string, error) {
+		if client == nil {
+			client = ssm.NewFromConfig(awsCfg)
+		}
+		out, err := client.GetParameter(ctx, &ssm.GetParameterInput{
+			Name:           aws.String(ref),
+			WithDecryption: aws.Bool(true),
+		})
+		if err != nil {
+			return "", fmt.Errorf("failed to get parameter %s: %w", ref, err)
+		}
+		if out.Parameter == nil || out.Parameter.Value == nil {
+			return "", fmt.Errorf("parameter %s has no value", ref)
+		}
+		return *out.Parameter.Value, nil
+	}
+}
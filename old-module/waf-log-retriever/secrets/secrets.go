@@ -0,0 +1,134 @@
+// Package secrets resolves sensitive config.json values that are stored encrypted
+// or as references, so configs can be committed without plaintext secrets
+package secrets
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"reflect"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+)
+
+// Resolver turns the part of a config value after its prefix into the plaintext value
+type Resolver func(ctx context.Context, ref string) (string, error)
+
+// Value prefixes; a config value "kms:<base64>" is decrypted with the "kms" resolver
+const (
+	PrefixKMS = "kms"
+	PrefixAge = "age"
+)
+
+// Resolve replaces every string in cfg (a pointer to a struct) whose prefix names a
+// resolver with the resolved value. Strings without a known prefix are left alone.
+func Resolve(ctx context.Context, cfg interface{}, resolvers map[string]Resolver) error {
+	v := reflect.ValueOf(cfg)
+	if v.Kind() != reflect.Ptr || v.IsNil() {
+		return fmt.Errorf("secrets.Resolve needs a non-nil pointer, got %T", cfg)
+	}
+	return resolveValue(ctx, v.Elem(), "", resolvers)
+}
+
+// ResolveString resolves a single value like Resolve, e.g. one needed to open the
+// session the rest of the config is resolved through
+func ResolveString(ctx context.Context, value string, resolvers map[string]Resolver) (string, error) {
+	if err := resolveValue(ctx, reflect.ValueOf(&value).Elem(), "value", resolvers); err != nil {
+		return "", err
+	}
+	return value, nil
+}
+
+// SessionResolvers returns a resolver for every prefix, decrypting and fetching
+// through an AWS session and reading age identities from AgeIdentityEnv
+func SessionResolvers(awsCfg aws.Config) map[string]Resolver {
+	return map[string]Resolver{
+		PrefixKMS:            KMSResolver(awsCfg),
+		PrefixAge:            AgeResolver(os.Getenv(AgeIdentityEnv)),
+		PrefixSecretsManager: SecretsManagerResolver(awsCfg),
+		PrefixSSM:            SSMResolver(awsCfg),
+	}
+}
+
+// resolveValue walks structs, pointers, slices and maps, resolving strings in place
+func resolveValue(ctx context.Context, v reflect.Value, path string, resolvers map[string]Resolver) error {
+	switch v.Kind() {
+	case reflect.Ptr, reflect.Interface:
+		if v.IsNil() {
+			return nil
+		}
+		if v.Kind() == reflect.Interface {
+			// Values inside interfaces are not addressable; resolve a copy and store it back
+			elem := reflect.New(v.Elem().Type()).Elem()
+			elem.Set(v.Elem())
+			if err := resolveValue(ctx, elem, path, resolvers); err != nil {
+				return err
+			}
+			if v.CanSet() {
+				v.Set(elem)
+			}
+			return nil
+		}
+		return resolveValue(ctx, v.Elem(), path, resolvers)
+	case reflect.Struct:
+		t := v.Type()
+		for i := 0; i < v.NumField(); i++ {
+			if !t.Field(i).IsExported() {
+				continue
+			}
+			if err := resolveValue(ctx, v.Field(i), joinPath(path, fieldName(t.Field(i))), resolvers); err != nil {
+				return err
+			}
+		}
+	case reflect.Slice, reflect.Array:
+		for i := 0; i < v.Len(); i++ {
+			if err := resolveValue(ctx, v.Index(i), fmt.Sprintf("%s[%d]", path, i), resolvers); err != nil {
+				return err
+			}
+		}
+	case reflect.Map:
+		for _, key := range v.MapKeys() {
+			// Map elements are not addressable; resolve a copy and store it back
+			elem := reflect.New(v.Type().Elem()).Elem()
+			elem.Set(v.MapIndex(key))
+			if err := resolveValue(ctx, elem, joinPath(path, fmt.Sprint(key.Interface())), resolvers); err != nil {
+				return err
+			}
+			v.SetMapIndex(key, elem)
+		}
+	case reflect.String:
+		prefix, ref, ok := strings.Cut(v.String(), ":")
+		if !ok {
+			return nil
+		}
+		resolver, ok := resolvers[prefix]
+		if !ok {
+			return nil
+		}
+		plaintext, err := resolver(ctx, ref)
+		if err != nil {
+			return fmt.Errorf("failed to resolve %s value of %s: %w", prefix, path, err)
+		}
+		if v.CanSet() {
+			v.SetString(plaintext)
+		}
+	}
+	return nil
+}
+
+// fieldName returns the JSON name of a struct field, for error messages
+func fieldName(field reflect.StructField) string {
+	if name, _, _ := strings.Cut(field.Tag.Get("json"), ","); name != "" && name != "-" {
+		return name
+	}
+	return field.Name
+}
+
+// joinPath appends a field name to a dotted config path
+func joinPath(path, name string) string {
+	if path == "" {
+		return name
+	}
+	return path + "." + name
+}
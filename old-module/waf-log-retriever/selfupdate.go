@@ -0,0 +1,107 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"time"
+
+	"waf-log-retriever/signing"
+	"waf-log-retriever/update"
+)
+
+// releaseKeyName is the trusted release signing key looked up next to the executable
+// when self-update is given no -key
+const releaseKeyName = "release-key.pub.pem"
+
+// runSelfUpdate replaces the running binary with the latest signed release
+func runSelfUpdate(args []string) int {
+	fs := flag.NewFlagSet("self-update", flag.ExitOnError)
+	url := fs.String("url", update.DefaultURL, "Base URL of the release assets, or a file:// directory holding them, e.g. on a USB drive")
+	keyFile := fs.String("key", "", "Trusted PEM public key the release checksums are signed with (default: "+releaseKeyName+" next to the executable)")
+	check := fs.Bool("check", false, "Only report whether a newer release is available")
+	force := fs.Bool("force", false, "Install the release even if it is not newer than the running version, or over a development build")
+	timeout := fs.Duration("timeout", 10*time.Minute, "Time limit of the download")
+	fs.Parse(args)
+
+	exePath, err := update.Executable()
+	if err != nil {
+		fmt.Printf("%v\n", err)
+		return 1
+	}
+	if *keyFile == "" {
+		*keyFile = filepath.Join(filepath.Dir(exePath), releaseKeyName)
+	}
+	publicKey, err := signing.LoadPublicKey(*keyFile)
+	if err != nil {
+		fmt.Printf("Failed to load the release signing key: %v\n", err)
+		return 1
+	}
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.RegisterProtocol("file", http.NewFileTransport(http.Dir("/")))
+	client := &http.Client{Transport: transport}
+	ctx, cancel := context.WithTimeout(context.Background(), *timeout)
+	defer cancel()
+
+	dir, err := os.MkdirTemp("", "waf-log-retriever-update-")
+	if err != nil {
+		fmt.Printf("Failed to create a download directory: %v\n", err)
+		return 1
+	}
+	defer os.RemoveAll(dir)
+	release, err := update.Fetch(ctx, client, *url, publicKey, dir)
+	if err != nil {
+		fmt.Printf("%v\n", err)
+		return 1
+	}
+	current := toolVersion()
+	fmt.Printf("Release %s, signed %s by key %s; running %s\n", release.Version,
+		release.Signature.SignedAt.Format("2006-01-02 15:04:05 MST"), release.Signature.KeyID, current)
+
+	order, err := release.Compare(current)
+	switch {
+	case version == "" || err != nil:
+		// A development build, or one of another versioning, is only replaced on request
+		if *check {
+			fmt.Printf("Release %s may replace this build; install it with: self-update -force\n", release.Version)
+			return 0
+		}
+		if !*force {
+			fmt.Printf("This is a development build; pass -force to replace it with release %s\n", release.Version)
+			return 1
+		}
+	case order == 0 && !*force:
+		fmt.Println("Already up to date")
+		return 0
+	case order < 0 && !*force:
+		fmt.Printf("The running version is newer than release %s; pass -force to downgrade to it\n", release.Version)
+		return 0
+	case *check:
+		if order > 0 {
+			fmt.Println("Update available; install it with: self-update")
+		} else {
+			fmt.Printf("No newer release; install release %s anyway with: self-update -force\n", release.Version)
+		}
+		return 0
+	}
+
+	if err := release.Install(ctx, client, exePath); err != nil {
+		fmt.Printf("Update failed: %v\n", err)
+		fmt.Printf("%s was left unchanged\n", exePath)
+		return 1
+	}
+	fmt.Printf("Updated %s from %s to %s\n", exePath, current, release.Version)
+	return 0
+}
+
+// runVersion prints the tool version
+func runVersion(args []string) int {
+	fs := flag.NewFlagSet("version", flag.ExitOnError)
+	fs.Parse(args)
+	fmt.Println(toolVersion())
+	return 0
+}
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"waf-log-retriever/analysis"
+	"waf-log-retriever/storage"
+)
+
+// SharedDirName is the directory, inside a Web ACL's analysis directory, anonymized
+// exports are written to by default
+const SharedDirName = "shared"
+
+// runShare exports the records of a Web ACL's retrieved logs stripped of payloads and
+// with identifiers hashed, so they can be shared for cross-customer trend analysis
+// without exposing customer data
+func runShare(args []string) int {
+	fs := flag.NewFlagSet("share", flag.ExitOnError)
+	outputDir := fs.String("output-dir", "../logs/raw", "Directory containing retrieved logs")
+	profile := fs.String("profile", "", "AWS profile name the logs were retrieved with")
+	webACL := fs.String("web-acl", "", "Name of the Web ACL whose logs to export")
+	keyFile := fs.String("hash-key", "", fmt.Sprintf("File holding the secret key identifiers are hashed with (at least %d bytes); datasets hashed with the same key correlate", analysis.MinHashKeyBytes))
+	resolution := fs.Duration("resolution", time.Hour, "Truncate record times to this resolution (0 keeps them exact)")
+	attacksOnly := fs.Bool("attacks-only", false, "Only export requests matching an attack category or from a scanner")
+	clientIPHeader := fs.String("client-ip-header", "", "Header holding the client's address behind a CDN or proxy, e.g. True-Client-IP or X-Forwarded-For (default: clientIp)")
+	from := fs.String("from", "", "Only records at or after this time (YYYY-MM-DD or YYYY-MM-DDTHH:mm:ssZ)")
+	to := fs.String("to", "", "Only records before this time (YYYY-MM-DD or YYYY-MM-DDTHH:mm:ssZ)")
+	out := fs.String("out", "", "Directory to write the export to (default: <web-acl>/"+analysis.OutputDirName+"/"+SharedDirName+")")
+	fs.Parse(args)
+
+	if *profile == "" || *webACL == "" || *keyFile == "" {
+		fmt.Println("share requires -profile, -web-acl and -hash-key")
+		fs.Usage()
+		return 2
+	}
+	var fromTime, toTime time.Time
+	var err error
+	if *from != "" {
+		if fromTime, err = parseTime(*from); err != nil {
+			fmt.Printf("Invalid -from: %v\n", err)
+			return 2
+		}
+	}
+	if *to != "" {
+		if toTime, err = parseTime(*to); err != nil {
+			fmt.Printf("Invalid -to: %v\n", err)
+			return 2
+		}
+	}
+
+	key, err := readHashKey(*keyFile)
+	if err != nil {
+		fmt.Printf("%v\n", err)
+		return 1
+	}
+	settings := analysis.DefaultSettings()
+	settings.ClientIdentity.IPHeader = *clientIPHeader
+	anonymizer, err := analysis.NewAnonymizer(key, *resolution, settings, *attacksOnly)
+	if err != nil {
+		fmt.Printf("%v\n", err)
+		return 2
+	}
+
+	aclDir := filepath.Join(*outputDir, *profile, *webACL)
+	removeStaleTempFiles(aclDir, printInfo, printWarning)
+	files, err := analysis.ListLogFiles(aclDir)
+	if err != nil {
+		fmt.Printf("%v\n", err)
+		return 1
+	}
+	if len(files) == 0 {
+		fmt.Printf("No log files found in %s\n", aclDir)
+		return 1
+	}
+
+	now := time.Now().UTC()
+	dir := *out
+	if dir == "" {
+		dir = filepath.Join(aclDir, analysis.OutputDirName, SharedDirName)
+	}
+	base := filepath.Join(dir, "anonymized_"+now.Format("20060102_150405"))
+	file, err := storage.CreateAtomic(base + ".jsonl.gz")
+	if err != nil {
+		fmt.Printf("%v\n", err)
+		return 1
+	}
+	defer file.Abort()
+	gz := gzip.NewWriter(file)
+	buf := bufio.NewWriter(gz)
+	enc := json.NewEncoder(buf)
+	for _, path := range files {
+		err := analysis.ForEachRecord(path, func(r *analysis.Record) error {
+			if ts := r.Time(); !fromTime.IsZero() && ts.Before(fromTime) || !toTime.IsZero() && !ts.Before(toTime) {
+				return nil
+			}
+			record, ok := anonymizer.Anonymize(r)
+			if !ok {
+				return nil
+			}
+			return enc.Encode(&record)
+		})
+		if err != nil {
+			fmt.Printf("%v\n", err)
+			return 1
+		}
+	}
+	if err := buf.Flush(); err != nil {
+		fmt.Printf("Failed to write anonymized records: %v\n", err)
+		return 1
+	}
+	if err := gz.Close(); err != nil {
+		fmt.Printf("Failed to write anonymized records: %v\n", err)
+		return 1
+	}
+
+	export := anonymizer.Export()
+	if export.Records == 0 {
+		fmt.Printf("No records to export from %s\n", aclDir)
+		return 1
+	}
+	export.CreatedAt = now
+	data, err := json.MarshalIndent(export, "", "  ")
+	if err != nil {
+		fmt.Printf("Failed to encode export description: %v\n", err)
+		return 1
+	}
+	if err := file.Commit(); err != nil {
+		fmt.Printf("%v\n", err)
+		return 1
+	}
+	if err := storage.WriteFileAtomic(base+".json", data); err != nil {
+		fmt.Printf("%v\n", err)
+		return 1
+	}
+
+	fmt.Printf("%d anonymized records exported", export.Records)
+	if export.Skipped > 0 {
+		fmt.Printf(", %d without an attack left out", export.Skipped)
+	}
+	fmt.Printf(" (hash key %s)\n", export.KeyID)
+	fmt.Printf("Records written to %s.jsonl.gz, described in %s.json\n", base, base)
+	return 0
+}
+
+// readHashKey reads the secret key identifiers are hashed with from a file
+func readHashKey(path string) ([]byte, error) {
+	key, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read hash key: %w", err)
+	}
+	// A trailing newline must not change the hashes of a key shared as text
+	return bytes.TrimSpace(key), nil
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"strings"
+
+	"waf-log-retriever/bundle"
+	"waf-log-retriever/logging"
+	"waf-log-retriever/signing"
+)
+
+// runKeygen creates an Ed25519 signing key pair
+func runKeygen(args []string) int {
+	fs := flag.NewFlagSet("keygen", flag.ExitOnError)
+	privateKey := fs.String("private-key", "signing-key.pem", "Private key file to create (keep it secret)")
+	publicKey := fs.String("public-key", "signing-key.pub.pem", "Public key file to create (share it with recipients)")
+	fs.Parse(args)
+
+	if err := signing.GenerateKey(*privateKey, *publicKey); err != nil {
+		fmt.Printf("Failed to generate signing key: %v\n", err)
+		return 1
+	}
+	fmt.Printf("Private key written to %s\nPublic key written to %s\n", *privateKey, *publicKey)
+	return 0
+}
+
+// runSign signs reports, bundles or any other deliverable files
+func runSign(args []string) int {
+	fs := flag.NewFlagSet("sign", flag.ExitOnError)
+	keyFile := fs.String("key", "", "PEM private key (Ed25519, ECDSA or RSA) to sign with")
+	signVersion := fs.String("version", "", "Version to sign the files as, e.g. the release version of a release's SHA256SUMS")
+	logLevel := fs.String("log-level", "INFO", "Logging level (DEBUG, INFO, WARNING, ERROR)")
+	fs.Parse(args)
+
+	if *keyFile == "" || fs.NArg() == 0 {
+		fmt.Println("sign requires -key and at least one file")
+		fs.Usage()
+		return 2
+	}
+
+	logger, err := logging.SetupLogger(*logLevel)
+	if err != nil {
+		fmt.Printf("Failed to initialize application: %v\n", err)
+		return 1
+	}
+	defer logger.Close()
+
+	for _, path := range fs.Args() {
+		if err := signDeliverable(path, *keyFile, *signVersion, logger); err != nil {
+			logger.Errorf("%v", err)
+			return 1
+		}
+	}
+	return 0
+}
+
+// runVerify checks deliverables against their signatures and, for bundles, their
+// checksum manifest
+func runVerify(args []string) int {
+	fs := flag.NewFlagSet("verify", flag.ExitOnError)
+	keyFile := fs.String("key", "", "Trusted PEM public key or x509 certificate of the signer")
+	fs.Parse(args)
+
+	if *keyFile == "" || fs.NArg() == 0 {
+		fmt.Println("verify requires -key and at least one file")
+		fs.Usage()
+		return 2
+	}
+
+	publicKey, err := signing.LoadPublicKey(*keyFile)
+	if err != nil {
+		fmt.Printf("Failed to load public key: %v\n", err)
+		return 1
+	}
+
+	failed := 0
+	for _, path := range fs.Args() {
+		signature, err := signing.VerifyFile(path, path+signing.SignatureExtension, publicKey)
+		if err == nil && strings.HasSuffix(path, bundle.FileExtension) {
+			_, err = bundle.Verify(path)
+		}
+		if err != nil {
+			fmt.Printf("FAILED  %s: %v\n", path, err)
+			failed++
+			continue
+		}
+		fmt.Printf("OK      %s (%s)\n", path, describeSignature(signature))
+	}
+
+	if failed > 0 {
+		fmt.Printf("%d of %d files failed verification\n", failed, fs.NArg())
+		return 1
+	}
+	return 0
+}
+
+// describeSignature describes a verified signature, e.g. "v1.4.0, signed 2025-02-01
+// 12:00:00 UTC by key 0123456789abcdef"
+func describeSignature(signature *signing.Signature) string {
+	description := "signed"
+	if !signature.SignedAt.IsZero() {
+		description += " " + signature.SignedAt.Format("2006-01-02 15:04:05 MST")
+	}
+	description += " by key " + signature.KeyID
+	if signature.Version != "" {
+		description = signature.Version + ", " + description
+	}
+	return description
+}
+
+// signDeliverable signs a file with the private key in keyFile, as version if given
+func signDeliverable(path, keyFile, version string, logger logging.Logger) error {
+	signer, err := signing.LoadSigner(keyFile)
+	if err != nil {
+		return fmt.Errorf("failed to load signing key: %w", err)
+	}
+	sigPath, err := signing.SignFile(path, signer, version)
+	if err != nil {
+		return err
+	}
+	logger.Infof("Signature written to: %s", sigPath)
+	return nil
+}
@@ -0,0 +1,300 @@
+// Package signing signs deliverables and verifies their signatures, so recipients
+// can check that reports and bundles were not modified after delivery
+package signing
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// SignatureExtension is appended to a file's path to name its detached signature
+const SignatureExtension = ".sig"
+
+// Signature algorithms
+const (
+	AlgorithmEd25519 = "ed25519"
+	AlgorithmECDSA   = "ecdsa-sha256"
+	AlgorithmRSA     = "rsa-pkcs1v15-sha256"
+)
+
+// payloadScheme names the signed payload of signatures that cover their signing time
+// and version along with the file, see payload. Signatures without it only cover the
+// file's digest.
+const payloadScheme = "waf-log-retriever-signature-v2"
+
+// Signature is a detached signature over the SHA-256 digest of a file, its signing
+// time and the version the file was signed as
+type Signature struct {
+	File      string    `json:"file"` // Base name of the signed file
+	SHA256    string    `json:"sha256"`
+	Algorithm string    `json:"algorithm"`
+	KeyID     string    `json:"keyId"` // See KeyID
+	Scheme    string    `json:"scheme,omitempty"`
+	SignedAt  time.Time `json:"signedAt"`          // Zero for signatures that do not cover it
+	Version   string    `json:"version,omitempty"` // E.g. the release version of release checksums
+	Signature []byte    `json:"signature"`
+}
+
+// payload returns the digest the signature signs: that of the scheme, the file's
+// digest, the signing time and the version
+func (s *Signature) payload() []byte {
+	h := sha256.New()
+	fmt.Fprintf(h, "%s\n%s\n%s\n%s\n", payloadScheme, s.SHA256, s.SignedAt.UTC().Format(time.RFC3339Nano), s.Version)
+	return h.Sum(nil)
+}
+
+// GenerateKey creates an Ed25519 key pair and writes the private key (PKCS #8) and
+// public key (PKIX) as PEM files
+func GenerateKey(privatePath, publicPath string) error {
+	publicKey, privateKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return fmt.Errorf("failed to generate key: %w", err)
+	}
+
+	privateDER, err := x509.MarshalPKCS8PrivateKey(privateKey)
+	if err != nil {
+		return fmt.Errorf("failed to encode private key: %w", err)
+	}
+	publicDER, err := x509.MarshalPKIXPublicKey(publicKey)
+	if err != nil {
+		return fmt.Errorf("failed to encode public key: %w", err)
+	}
+
+	if err := writePEM(privatePath, "PRIVATE KEY", privateDER, 0600); err != nil {
+		return err
+	}
+	return writePEM(publicPath, "PUBLIC KEY", publicDER, 0644)
+}
+
+// LoadSigner reads a PEM private key: PKCS #8 (Ed25519, ECDSA or RSA), or the
+// PKCS #1 / SEC 1 keys typically issued alongside x509 certificates
+func LoadSigner(path string) (crypto.Signer, error) {
+	block, err := readPEM(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var key interface{}
+	switch block.Type {
+	case "RSA PRIVATE KEY":
+		key, err = x509.ParsePKCS1PrivateKey(block.Bytes)
+	case "EC PRIVATE KEY":
+		key, err = x509.ParseECPrivateKey(block.Bytes)
+	default:
+		key, err = x509.ParsePKCS8PrivateKey(block.Bytes)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse private key %s: %w", path, err)
+	}
+
+	signer, ok := key.(crypto.Signer)
+	if !ok {
+		return nil, fmt.Errorf("unsupported private key type in %s", path)
+	}
+	return signer, nil
+}
+
+// LoadPublicKey reads a PEM public key (PKIX) or x509 certificate
+func LoadPublicKey(path string) (crypto.PublicKey, error) {
+	block, err := readPEM(path)
+	if err != nil {
+		return nil, err
+	}
+
+	if block.Type == "CERTIFICATE" {
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse certificate %s: %w", path, err)
+		}
+		return cert.PublicKey, nil
+	}
+
+	key, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse public key %s: %w", path, err)
+	}
+	return key, nil
+}
+
+// KeyID identifies a public key by the first 8 bytes of the SHA-256 of its PKIX encoding
+func KeyID(publicKey crypto.PublicKey) (string, error) {
+	der, err := x509.MarshalPKIXPublicKey(publicKey)
+	if err != nil {
+		return "", fmt.Errorf("failed to encode public key: %w", err)
+	}
+	sum := sha256.Sum256(der)
+	return hex.EncodeToString(sum[:8]), nil
+}
+
+// SignFile signs a file, its signing time and the version it is signed as, which may
+// be empty, and writes the signature next to it, returning the signature path
+func SignFile(path string, signer crypto.Signer, version string) (string, error) {
+	digest, err := fileDigest(path)
+	if err != nil {
+		return "", err
+	}
+
+	algorithm, err := algorithmOf(signer.Public())
+	if err != nil {
+		return "", err
+	}
+	keyID, err := KeyID(signer.Public())
+	if err != nil {
+		return "", err
+	}
+
+	signature := Signature{
+		File:      filepath.Base(path),
+		SHA256:    hex.EncodeToString(digest),
+		Algorithm: algorithm,
+		KeyID:     keyID,
+		Scheme:    payloadScheme,
+		SignedAt:  time.Now().UTC(),
+		Version:   version,
+	}
+	var opts crypto.SignerOpts = crypto.SHA256
+	if algorithm == AlgorithmEd25519 {
+		opts = crypto.Hash(0) // Ed25519 signs the digest itself as the message
+	}
+	if signature.Signature, err = signer.Sign(rand.Reader, signature.payload(), opts); err != nil {
+		return "", fmt.Errorf("failed to sign %s: %w", path, err)
+	}
+
+	data, err := json.MarshalIndent(signature, "", "  ")
+	if err != nil {
+		return "", fmt.Errorf("failed to encode signature: %w", err)
+	}
+
+	sigPath := path + SignatureExtension
+	if err := os.WriteFile(sigPath, data, 0644); err != nil {
+		return "", fmt.Errorf("failed to write signature: %w", err)
+	}
+	return sigPath, nil
+}
+
+// VerifyFile checks a file against its detached signature and a trusted public key.
+// Signatures made before they covered their signing time and version are accepted
+// for the file alone; their signing time is returned as zero and they cannot carry a
+// version.
+func VerifyFile(path, sigPath string, publicKey crypto.PublicKey) (*Signature, error) {
+	data, err := os.ReadFile(sigPath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read signature: %w", err)
+	}
+	var signature Signature
+	if err := json.Unmarshal(data, &signature); err != nil {
+		return nil, fmt.Errorf("failed to parse signature %s: %w", sigPath, err)
+	}
+
+	keyID, err := KeyID(publicKey)
+	if err != nil {
+		return nil, err
+	}
+	if signature.KeyID != keyID {
+		return nil, fmt.Errorf("%s was signed with key %s, not the trusted key %s", filepath.Base(path), signature.KeyID, keyID)
+	}
+
+	digest, err := fileDigest(path)
+	if err != nil {
+		return nil, err
+	}
+	if hex.EncodeToString(digest) != signature.SHA256 {
+		return nil, fmt.Errorf("%s was modified after signing (checksum mismatch)", filepath.Base(path))
+	}
+	signed := digest
+	switch signature.Scheme {
+	case payloadScheme:
+		signed = signature.payload()
+	case "":
+		if signature.Version != "" {
+			return nil, fmt.Errorf("invalid signature for %s: its version is not signed", filepath.Base(path))
+		}
+		signature.SignedAt = time.Time{}
+	default:
+		return nil, fmt.Errorf("unsupported signature scheme %q for %s", signature.Scheme, filepath.Base(path))
+	}
+
+	valid := false
+	switch key := publicKey.(type) {
+	case ed25519.PublicKey:
+		valid = signature.Algorithm == AlgorithmEd25519 && ed25519.Verify(key, signed, signature.Signature)
+	case *ecdsa.PublicKey:
+		valid = signature.Algorithm == AlgorithmECDSA && ecdsa.VerifyASN1(key, signed, signature.Signature)
+	case *rsa.PublicKey:
+		valid = signature.Algorithm == AlgorithmRSA && rsa.VerifyPKCS1v15(key, crypto.SHA256, signed, signature.Signature) == nil
+	default:
+		return nil, errors.New("unsupported public key type")
+	}
+	if !valid {
+		return nil, fmt.Errorf("invalid signature for %s", filepath.Base(path))
+	}
+	return &signature, nil
+}
+
+// algorithmOf returns the signature algorithm used with a public key
+func algorithmOf(publicKey crypto.PublicKey) (string, error) {
+	switch publicKey.(type) {
+	case ed25519.PublicKey:
+		return AlgorithmEd25519, nil
+	case *ecdsa.PublicKey:
+		return AlgorithmECDSA, nil
+	case *rsa.PublicKey:
+		return AlgorithmRSA, nil
+	}
+	return "", errors.New("unsupported key type: use an Ed25519, ECDSA or RSA key")
+}
+
+// fileDigest returns the SHA-256 digest of a file
+func fileDigest(path string) ([]byte, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open %s: %w", path, err)
+	}
+	defer file.Close()
+
+	h := sha256.New()
+	if _, err := io.Copy(h, file); err != nil {
+		return nil, fmt.Errorf("failed to hash %s: %w", path, err)
+	}
+	return h.Sum(nil), nil
+}
+
+// readPEM reads the first PEM block of a file
+func readPEM(path string) (*pem.Block, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read key file: %w", err)
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("%s is not a PEM file", path)
+	}
+	return block, nil
+}
+
+// writePEM writes a single PEM block, refusing to overwrite an existing key
+func writePEM(path, blockType string, der []byte, perm os.FileMode) error {
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, perm)
+	if err != nil {
+		return fmt.Errorf("failed to create key file: %w", err)
+	}
+	if err := pem.Encode(file, &pem.Block{Type: blockType, Bytes: der}); err != nil {
+		file.Close()
+		return fmt.Errorf("failed to write key file: %w", err)
+	}
+	return file.Close()
+}
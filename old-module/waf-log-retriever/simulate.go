@@ -0,0 +1,128 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"waf-log-retriever/analysis"
+)
+
+// runSimulateRate replays the retrieved logs of a Web ACL through a proposed
+// rate-based rule and reports the clients it would have limited
+func runSimulateRate(args []string) int {
+	fs := flag.NewFlagSet("simulate-rate", flag.ExitOnError)
+	outputDir := fs.String("output-dir", "../logs/raw", "Directory containing retrieved logs")
+	profile := fs.String("profile", "", "AWS profile name the logs were retrieved with")
+	webACL := fs.String("web-acl", "", "Name of the Web ACL whose logs to replay")
+	limit := fs.Int64("limit", 0, "Requests allowed per window and key")
+	window := fs.Duration("window", 5*time.Minute, "Evaluation window: 1m, 2m, 5m or 10m")
+	keys := fs.String("key", "ip", "Comma-separated aggregation key components: ip, forwarded-ip, uri, host")
+	forwardedHeader := fs.String("forwarded-header", "X-Forwarded-For", "Header holding the client IP for the forwarded-ip key")
+	uris := fs.String("uri", "", "Comma-separated URIs the rule is scoped down to; a trailing * matches a prefix (default: all)")
+	hosts := fs.String("host", "", "Comma-separated hosts the rule is scoped down to; *.example.com matches subdomains (default: all)")
+	model := fs.String("model", "sliding-window", "How requests are counted: sliding-window, as AWS WAF does, or token-bucket")
+	top := fs.Int("top", 20, "Most limited keys to list (0 for all)")
+	jsonOutput := fs.Bool("json", false, "Write the simulation report as JSON")
+	out := fs.String("out", "", "File to write the report to (default: standard output)")
+	fs.Parse(args)
+
+	if *profile == "" || *webACL == "" || *limit == 0 {
+		fmt.Println("simulate-rate requires -profile, -web-acl and -limit")
+		fs.Usage()
+		return 2
+	}
+	opts := analysis.RateLimitOptions{
+		Limit:           *limit,
+		Window:          *window,
+		Keys:            strings.Split(*keys, ","),
+		ForwardedHeader: *forwardedHeader,
+		Model:           *model,
+	}
+	if *uris != "" {
+		opts.URIs = strings.Split(*uris, ",")
+	}
+	if *hosts != "" {
+		opts.Hosts = strings.Split(*hosts, ",")
+	}
+	if err := opts.Validate(); err != nil {
+		fmt.Printf("Invalid rate limit: %v\n", err)
+		return 2
+	}
+
+	aclDir := filepath.Join(*outputDir, *profile, *webACL)
+	files, err := analysis.ListLogFiles(aclDir)
+	if err != nil {
+		fmt.Printf("%v\n", err)
+		return 1
+	}
+	if len(files) == 0 {
+		fmt.Printf("No log files found in %s\n", aclDir)
+		return 1
+	}
+	sim := analysis.NewRateLimitSimulation(opts)
+	for _, file := range files {
+		if err := analysis.ForEachRecord(file, func(r *analysis.Record) error {
+			sim.Add(r)
+			return nil
+		}); err != nil {
+			fmt.Printf("%v\n", err)
+			return 1
+		}
+	}
+	report := sim.Report(*top)
+
+	var buf bytes.Buffer
+	if *jsonOutput {
+		encoder := json.NewEncoder(&buf)
+		encoder.SetIndent("", "  ")
+		if err := encoder.Encode(report); err != nil {
+			fmt.Printf("Failed to encode report: %v\n", err)
+			return 1
+		}
+	} else {
+		printRateSimulation(&buf, report)
+	}
+	if *out == "" {
+		os.Stdout.Write(buf.Bytes())
+		return 0
+	}
+	if err := os.WriteFile(*out, buf.Bytes(), 0644); err != nil {
+		fmt.Printf("Failed to write report: %v\n", err)
+		return 1
+	}
+	fmt.Printf("Simulation of %d requests written to %s\n", report.Requests, *out)
+	return 0
+}
+
+// printRateSimulation writes the totals of a simulation followed by the limited keys
+func printRateSimulation(w io.Writer, report *analysis.RateLimitReport) {
+	fmt.Fprintf(w, "Rate limit of %d requests per %ds by %s (%s)\n", report.Limit, report.WindowSeconds,
+		strings.Join(report.Keys, " + "), report.Model)
+	fmt.Fprintf(w, "Replayed %d requests, %d counted by the rule\n", report.Requests, report.Evaluated)
+	if report.Limited == 0 {
+		fmt.Fprintln(w, "No key exceeded the limit")
+		return
+	}
+	fmt.Fprintf(w, "Limited %d requests from %d keys; %d of them were blocked anyway\n", report.Limited, report.LimitedKeys, report.AlreadyBlocked)
+	fmt.Fprintf(w, "Collateral damage: %d legitimate requests limited (%.2f%% of %d)\n\n", report.LegitimateLimited,
+		report.CollateralShare, report.Legitimate)
+
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "KEY\tREQUESTS\tPEAK\tLIMITED\tLEGITIMATE LIMITED\tFIRST LIMITED\tLAST LIMITED")
+	for _, c := range report.Clients {
+		fmt.Fprintf(tw, "%s\t%d\t%d\t%d\t%d\t%s\t%s\n", truncate(c.Key, 60), c.Requests, c.PeakRate, c.Limited,
+			c.LegitimateLimited, c.FirstLimited.Format(time.RFC3339), c.LastLimited.Format(time.RFC3339))
+	}
+	tw.Flush()
+	if report.LimitedKeys > len(report.Clients) {
+		fmt.Fprintf(w, "... %d more limited keys; raise -top to list them\n", report.LimitedKeys-len(report.Clients))
+	}
+}
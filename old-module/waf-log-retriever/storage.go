@@ -0,0 +1,265 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strings"
+	"text/tabwriter"
+
+	"waf-log-retriever/analysis"
+	"waf-log-retriever/storage"
+	"waf-log-retriever/workspace"
+)
+
+// storageCommands maps the storage subcommands to their entry points
+var storageCommands = map[string]func(args []string) int{
+	"du":         runStorageDu,
+	"reorganize": runStorageReorganize,
+}
+
+// runStorage dispatches the storage subcommands, which manage retrieved log files
+func runStorage(args []string) int {
+	if len(args) > 0 {
+		if command, ok := storageCommands[args[0]]; ok {
+			return command(args[1:])
+		}
+	}
+	names := make([]string, 0, len(storageCommands))
+	for name := range storageCommands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	fmt.Printf("storage requires a subcommand: %s\n", strings.Join(names, ", "))
+	return 2
+}
+
+// runStorageReorganize migrates the retrieved logs of a Web ACL to another layout
+func runStorageReorganize(args []string) int {
+	fs := flag.NewFlagSet("storage reorganize", flag.ExitOnError)
+	outputDir := fs.String("output-dir", "../logs/raw", "Directory containing retrieved logs")
+	profile := fs.String("profile", "", "AWS profile name the logs were retrieved with")
+	webACL := fs.String("web-acl", "", "Name of the Web ACL whose logs to reorganize")
+	layout := fs.String("layout", "", "Layout to migrate to: "+strings.Join(storage.Layouts, ", "))
+	forceUnlock := fs.Bool("force-unlock", false, "Take over the lock of the Web ACL's directory even if another run appears to hold it")
+	fs.Parse(args)
+
+	if *profile == "" || *webACL == "" || *layout == "" {
+		fmt.Println("storage reorganize requires -profile, -web-acl and -layout")
+		fs.Usage()
+		return 2
+	}
+	if !slices.Contains(storage.Layouts, *layout) {
+		fmt.Printf("Unknown -layout %q (known: %s)\n", *layout, strings.Join(storage.Layouts, ", "))
+		return 2
+	}
+
+	aclDir := filepath.Join(*outputDir, *profile, *webACL)
+	lock, err := lockWebACL(aclDir, "storage reorganize", *forceUnlock, printInfo, printWarning)
+	if err != nil {
+		fmt.Printf("%v\n", err)
+		return 1
+	}
+	defer releaseLock(lock, printWarning)
+	files, err := analysis.ListLogFiles(aclDir)
+	if err != nil {
+		fmt.Printf("%v\n", err)
+		return 1
+	}
+	if len(files) == 0 {
+		fmt.Printf("No log files found in %s\n", aclDir)
+		return 1
+	}
+
+	// Show what the reorganization starts from: usually a mix after a layout change
+	layouts := make(map[string]int64)
+	for _, file := range files {
+		rel, _ := filepath.Rel(aclDir, filepath.Dir(file))
+		name, _, _, ok := storage.ParsePartition(rel)
+		if !ok {
+			name = "unpartitioned"
+		}
+		layouts[name]++
+	}
+	fmt.Printf("Reorganizing %d log files in %s (%s) into the %s layout\n", len(files), aclDir, formatCountMap(layouts), *layout)
+
+	result, err := storage.Reorganize(aclDir, *layout, files, forEachStoredRecord)
+	if err != nil {
+		fmt.Printf("Reorganization failed: %v\n", err)
+		fmt.Println("The original files are kept until every partition is staged; rerun the command to retry or complete it")
+		return 1
+	}
+	if result.Resumed {
+		fmt.Println("Completed an interrupted reorganization first")
+	}
+	fmt.Printf("Wrote %d records from %d files into %d %s partitions\n", result.Records, result.Sources-len(result.Kept), result.Files, result.Layout)
+	if len(result.Kept) > 0 {
+		fmt.Printf("Left %d files without WAF records in place: %s\n", len(result.Kept), strings.Join(result.Kept, ", "))
+	}
+	fmt.Printf("Index updated: %s\n", filepath.Join(aclDir, storage.IndexFileName))
+	return 0
+}
+
+// diskUsage is the size of the log files of one row of storage du
+type diskUsage struct {
+	Profile    string `json:"profile"`
+	WebACL     string `json:"webAcl,omitempty"`
+	Day        string `json:"day,omitempty"` // YYYY-MM-DD, or "unpartitioned"
+	Files      int    `json:"files"`
+	Compressed int64  `json:"compressedBytes"` // Bytes on disk
+	Logical    int64  `json:"logicalBytes"`    // Bytes once decompressed
+}
+
+// storageUsageLevels are the -by levels of storage du, from the coarsest
+var storageUsageLevels = []string{"profile", "acl", "day"}
+
+// runStorageDu summarizes the size of the retrieved logs per profile, Web ACL and day
+func runStorageDu(args []string) int {
+	fs := flag.NewFlagSet("storage du", flag.ExitOnError)
+	outputDir := fs.String("output-dir", "../logs/raw", "Directory containing retrieved logs")
+	profile := fs.String("profile", "", "Only report this AWS profile")
+	webACL := fs.String("web-acl", "", "Only report this Web ACL")
+	by := fs.String("by", "day", "Level of the rows: "+strings.Join(storageUsageLevels, ", "))
+	jsonOutput := fs.Bool("json", false, "Write the rows as JSON")
+	fs.Parse(args)
+
+	if !slices.Contains(storageUsageLevels, *by) {
+		fmt.Printf("Unknown -by %q (known: %s)\n", *by, strings.Join(storageUsageLevels, ", "))
+		return 2
+	}
+
+	profiles, err := subdirectories(*outputDir, *profile)
+	if err != nil {
+		fmt.Printf("%v\n", err)
+		return 1
+	}
+	rows := make(map[[3]string]*diskUsage)
+	unreadable := 0
+	for _, profileName := range profiles {
+		acls, err := subdirectories(filepath.Join(*outputDir, profileName), *webACL)
+		if err != nil {
+			fmt.Printf("%v\n", err)
+			return 1
+		}
+		for _, aclName := range acls {
+			aclDir := filepath.Join(*outputDir, profileName, aclName)
+			files, err := analysis.ListLogFiles(aclDir)
+			if err != nil {
+				fmt.Printf("%v\n", err)
+				return 1
+			}
+			for _, file := range files {
+				if file == filepath.Join(aclDir, workspace.FileName) {
+					continue
+				}
+				info, err := os.Stat(file)
+				if err != nil {
+					fmt.Printf("%v\n", err)
+					return 1
+				}
+				logical, err := storage.LogicalSize(file)
+				if err != nil {
+					// A damaged file should not hide the rest of the usage; count it as stored
+					fmt.Fprintf(os.Stderr, "Warning: %v\n", err)
+					logical = info.Size()
+					unreadable++
+				}
+				key := [3]string{profileName}
+				if *by != "profile" {
+					key[1] = aclName
+				}
+				if *by == "day" {
+					rel, _ := filepath.Rel(aclDir, file)
+					key[2] = "unpartitioned"
+					if day, ok := storage.FileDay(filepath.ToSlash(rel)); ok {
+						key[2] = day.Format("2006-01-02")
+					}
+				}
+				row, ok := rows[key]
+				if !ok {
+					row = &diskUsage{Profile: key[0], WebACL: key[1], Day: key[2]}
+					rows[key] = row
+				}
+				row.Files++
+				row.Compressed += info.Size()
+				row.Logical += logical
+			}
+		}
+	}
+	if len(rows) == 0 {
+		fmt.Printf("No log files found in %s\n", *outputDir)
+		return 1
+	}
+
+	sorted := make([]diskUsage, 0, len(rows))
+	for _, row := range rows {
+		sorted = append(sorted, *row)
+	}
+	sort.Slice(sorted, func(i, j int) bool {
+		a, b := sorted[i], sorted[j]
+		if a.Profile != b.Profile {
+			return a.Profile < b.Profile
+		}
+		if a.WebACL != b.WebACL {
+			return a.WebACL < b.WebACL
+		}
+		return a.Day < b.Day
+	})
+	if *jsonOutput {
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		if err := encoder.Encode(sorted); err != nil {
+			fmt.Printf("Failed to encode disk usage: %v\n", err)
+			return 1
+		}
+		return 0
+	}
+
+	total := diskUsage{Profile: "TOTAL", WebACL: "-", Day: "-"}
+	for _, row := range sorted {
+		total.Files += row.Files
+		total.Compressed += row.Compressed
+		total.Logical += row.Logical
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "PROFILE\tWEB ACL\tDAY\tFILES\tCOMPRESSED MB\tLOGICAL MB\tRATIO\t")
+	for _, row := range append(sorted, total) {
+		ratio := "-"
+		if row.Compressed > 0 {
+			ratio = fmt.Sprintf("%.1fx", float64(row.Logical)/float64(row.Compressed))
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%d\t%.1f\t%.1f\t%s\t\n", row.Profile, row.WebACL, row.Day,
+			row.Files, float64(row.Compressed)/1e6, float64(row.Logical)/1e6, ratio)
+	}
+	w.Flush()
+	if unreadable > 0 {
+		fmt.Printf("\n%d files could not be decompressed and are counted at their size on disk; run manifest verify to check them\n", unreadable)
+	}
+	return 0
+}
+
+// subdirectories returns the names of the directories in dir, or only the given
+// one if set
+func subdirectories(dir, only string) ([]string, error) {
+	if only != "" {
+		if info, err := os.Stat(filepath.Join(dir, only)); err != nil || !info.IsDir() {
+			return nil, fmt.Errorf("no directory %s", filepath.Join(dir, only))
+		}
+		return []string{only}, nil
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read %s: %w", dir, err)
+	}
+	var names []string
+	for _, entry := range entries {
+		if entry.IsDir() && !strings.HasPrefix(entry.Name(), ".") {
+			names = append(names, entry.Name())
+		}
+	}
+	return names, nil
+}
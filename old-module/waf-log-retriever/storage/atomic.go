@@ -0,0 +1,131 @@
+package storage
+
+import (
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// TempExtension ends the names of the temporary files writes go to before they are
+// renamed into place
+const TempExtension = ".tmp"
+
+// StaleTempAge is how long a temporary file goes unmodified before it is taken for
+// the leftover of a crashed run rather than a write in progress
+const StaleTempAge = time.Hour
+
+// WriteFileAtomic writes data to a temporary file next to path, syncs it and renames
+// it to path, so that readers see either the old or the new content
+func WriteFileAtomic(path string, data []byte) error {
+	f, err := CreateAtomic(path)
+	if err != nil {
+		return err
+	}
+	defer f.Abort()
+	if _, err := f.Write(data); err != nil {
+		return fmt.Errorf("failed to write %s: %w", f.Name(), err)
+	}
+	return f.Commit()
+}
+
+// AtomicFile is a file written under a hidden temporary name next to its final path
+// and only renamed to it by Commit, so a crash never leaves a half-written file at
+// the final path
+type AtomicFile struct {
+	*os.File
+	path string
+	done bool
+}
+
+// CreateAtomic creates the temporary file of path, creating its directory if needed
+func CreateAtomic(path string) (*AtomicFile, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return nil, fmt.Errorf("failed to create directory for %s: %w", path, err)
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".*"+TempExtension)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create temporary file: %w", err)
+	}
+	if err := tmp.Chmod(0644); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return nil, fmt.Errorf("failed to create temporary file: %w", err)
+	}
+	return &AtomicFile{File: tmp, path: path}, nil
+}
+
+// Commit syncs and closes the temporary file and renames it to the final path
+func (f *AtomicFile) Commit() error {
+	if f.done {
+		return fmt.Errorf("%s was already committed or aborted", f.path)
+	}
+	f.done = true
+	if err := f.Sync(); err != nil {
+		f.File.Close()
+		os.Remove(f.Name())
+		return fmt.Errorf("failed to sync %s: %w", f.Name(), err)
+	}
+	if err := f.File.Close(); err != nil {
+		os.Remove(f.Name())
+		return fmt.Errorf("failed to close %s: %w", f.Name(), err)
+	}
+	if err := os.Rename(f.Name(), f.path); err != nil {
+		os.Remove(f.Name())
+		return fmt.Errorf("failed to replace %s: %w", f.path, err)
+	}
+	return nil
+}
+
+// Abort closes and removes the temporary file, leaving the final path untouched. It
+// does nothing after Commit, so it can be deferred.
+func (f *AtomicFile) Abort() {
+	if f.done {
+		return
+	}
+	f.done = true
+	f.File.Close()
+	os.Remove(f.Name())
+}
+
+// IsTempFile reports whether a file name is that of a temporary file
+func IsTempFile(name string) bool {
+	return strings.HasSuffix(name, TempExtension)
+}
+
+// RemoveStaleTempFiles removes the temporary files below dir that were not modified
+// for StaleTempAge, left behind by runs that crashed before renaming them into
+// place, and returns their paths
+func RemoveStaleTempFiles(dir string) ([]string, error) {
+	cutoff := time.Now().Add(-StaleTempAge)
+	var removed []string
+	err := filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			if path == dir && os.IsNotExist(err) {
+				return filepath.SkipDir
+			}
+			return err
+		}
+		if d.IsDir() || !IsTempFile(d.Name()) {
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			return nil // Renamed into place since the directory was read
+		}
+		if info.ModTime().After(cutoff) {
+			return nil // Possibly written by a concurrent run
+		}
+		if err := os.Remove(path); err != nil {
+			return fmt.Errorf("failed to remove stale temporary file %s: %w", path, err)
+		}
+		removed = append(removed, path)
+		return nil
+	})
+	if err != nil {
+		return removed, fmt.Errorf("failed to clean up temporary files: %w", err)
+	}
+	return removed, nil
+}
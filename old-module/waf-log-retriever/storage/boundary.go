@@ -0,0 +1,155 @@
+package storage
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// BoundaryFileName records the S3 objects retrievals into a Web ACL's directory
+// downloaded from the boundary slack of their time range: JSON Lines of the records
+// each object holds and those its log file keeps, the last line of an object
+// counting. It is hidden so that it is never mistaken for a log file.
+const BoundaryFileName = ".boundary-objects.jsonl"
+
+// BoundaryObject is one line of the boundary journal: an S3 object downloaded from
+// the boundary slack, whose log file keeps only the records of the time ranges
+// retrieved. Times are those of the records, in milliseconds.
+type BoundaryObject struct {
+	Origin   string    `json:"origin"`             // Where the object came from, e.g. s3://bucket/key
+	First    time.Time `json:"first,omitempty"`    // Of the object's records; zero if it has none
+	Last     time.Time `json:"last,omitempty"`     // Of the object's records
+	KeptFrom time.Time `json:"keptFrom,omitempty"` // The log file keeps the records from KeptFrom to KeptTo; zero if it was dropped
+	KeptTo   time.Time `json:"keptTo,omitempty"`
+	Whole    bool      `json:"whole,omitempty"` // The log file keeps every record, e.g. as a retrieval of the range downloaded it
+	At       time.Time `json:"at"`
+}
+
+// Kept reports whether the object's log file was kept
+func (o BoundaryObject) Kept() bool {
+	return o.Whole || !o.KeptFrom.IsZero()
+}
+
+// Covers reports whether a retrieval of startTime to endTime needs nothing of the
+// object it has not got: the object has no records in the range, or its log file,
+// if it exists, keeps them all
+func (o BoundaryObject) Covers(startTime, endTime time.Time, fileExists bool) bool {
+	if o.Whole {
+		return fileExists
+	}
+	if o.First.IsZero() || o.Last.Before(startTime) || o.First.After(endTime) {
+		return true
+	}
+	if !fileExists || o.KeptFrom.IsZero() {
+		return false
+	}
+	return !o.KeptFrom.After(maxTime(startTime, o.First)) && !o.KeptTo.Before(minTime(endTime, o.Last))
+}
+
+// KeepRange returns the records the object's log file is to keep for a retrieval of
+// startTime to endTime: those of the range, and those it keeps for earlier
+// retrievals
+func (o BoundaryObject) KeepRange(startTime, endTime time.Time) (time.Time, time.Time) {
+	if o.KeptFrom.IsZero() {
+		return startTime, endTime
+	}
+	return minTime(startTime, o.KeptFrom), maxTime(endTime, o.KeptTo)
+}
+
+// BoundaryObjects is the boundary journal of a Web ACL's directory. Retrievals look
+// up the objects of their boundary slack in it, so that objects holding no records
+// of their range, or whose log files keep those already, are not downloaded again,
+// e.g. by each run since the last.
+type BoundaryObjects struct {
+	aclDir  string
+	mu      sync.Mutex
+	objects map[string]BoundaryObject // By origin
+}
+
+// LoadBoundaryObjects reads the boundary journal of a Web ACL's directory. A last
+// line cut short by a crash is ignored.
+func LoadBoundaryObjects(aclDir string) (*BoundaryObjects, error) {
+	b := &BoundaryObjects{aclDir: aclDir, objects: make(map[string]BoundaryObject)}
+	f, err := os.Open(filepath.Join(aclDir, BoundaryFileName))
+	if errors.Is(err, os.ErrNotExist) {
+		return b, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to open boundary journal: %w", err)
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var object BoundaryObject
+		if err := json.Unmarshal(scanner.Bytes(), &object); err != nil {
+			continue
+		}
+		b.objects[object.Origin] = object
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read boundary journal: %w", err)
+	}
+	return b, nil
+}
+
+// Lookup returns the last line of an object, if the journal, which may be nil, has
+// one
+func (b *BoundaryObjects) Lookup(origin string) (BoundaryObject, bool) {
+	if b == nil {
+		return BoundaryObject{}, false
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	object, ok := b.objects[origin]
+	return object, ok
+}
+
+// Record appends a line of an object to the journal
+func (b *BoundaryObjects) Record(object BoundaryObject) error {
+	object.At = time.Now().UTC()
+	data, err := json.Marshal(object)
+	if err != nil {
+		return fmt.Errorf("failed to encode boundary object: %w", err)
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	f, err := os.OpenFile(filepath.Join(b.aclDir, BoundaryFileName), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return fmt.Errorf("failed to open boundary journal: %w", err)
+	}
+	if _, err := f.Write(append(data, '\n')); err != nil {
+		f.Close()
+		return fmt.Errorf("failed to append to boundary journal: %w", err)
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return fmt.Errorf("failed to sync boundary journal: %w", err)
+	}
+	if err := f.Close(); err != nil {
+		return fmt.Errorf("failed to close boundary journal: %w", err)
+	}
+	b.objects[object.Origin] = object
+	return nil
+}
+
+// minTime returns the earlier of two times
+func minTime(a, b time.Time) time.Time {
+	if a.Before(b) {
+		return a
+	}
+	return b
+}
+
+// maxTime returns the later of two times
+func maxTime(a, b time.Time) time.Time {
+	if a.After(b) {
+		return a
+	}
+	return b
+}
@@ -0,0 +1,132 @@
+package storage
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// CheckpointFileName is the checkpoint of the S3 retrieval or presigned import into a
+// Web ACL's directory last started: JSON Lines of the objects it downloaded, appended
+// as each completes. It is hidden so that it is never mistaken for a log file.
+const CheckpointFileName = ".retrieval-checkpoint.jsonl"
+
+// CheckpointEntry is one line of a checkpoint: an object downloaded to a log file
+type CheckpointEntry struct {
+	Origin string    `json:"origin"` // Where the object came from, e.g. s3://bucket/key
+	Path   string    `json:"path"`   // Slash-separated, relative to the Web ACL's directory
+	Size   int64     `json:"size"`
+	At     time.Time `json:"at"`
+}
+
+// Checkpoint records the objects a retrieval downloaded, so that a rerun after it was
+// interrupted, e.g. by its timeout or a network failure, can resume it rather than
+// download every object again. It is removed once a retrieval downloaded every
+// object.
+type Checkpoint struct {
+	aclDir    string
+	mu        sync.Mutex
+	completed map[string]CheckpointEntry // By origin
+}
+
+// StartCheckpoint starts the checkpoint of a retrieval into a Web ACL's directory.
+// With resume, it keeps the objects of the checkpoint of an interrupted run; otherwise
+// that checkpoint is discarded. A last line cut short by a crash is ignored.
+func StartCheckpoint(aclDir string, resume bool) (*Checkpoint, error) {
+	c := &Checkpoint{aclDir: aclDir, completed: make(map[string]CheckpointEntry)}
+	path := filepath.Join(aclDir, CheckpointFileName)
+	if !resume {
+		if err := os.Remove(path); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return nil, fmt.Errorf("failed to discard checkpoint: %w", err)
+		}
+		return c, nil
+	}
+
+	f, err := os.Open(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return c, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to open checkpoint: %w", err)
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var entry CheckpointEntry
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			continue
+		}
+		c.completed[entry.Origin] = entry
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read checkpoint: %w", err)
+	}
+	return c, nil
+}
+
+// Downloaded reports whether the checkpoint records an object as downloaded to a log
+// file that is still there, with the size it was downloaded with
+func (c *Checkpoint) Downloaded(origin, file string) bool {
+	c.mu.Lock()
+	entry, ok := c.completed[origin]
+	c.mu.Unlock()
+	if !ok {
+		return false
+	}
+	rel, err := filepath.Rel(c.aclDir, file)
+	if err != nil || filepath.ToSlash(rel) != entry.Path {
+		return false
+	}
+	info, err := os.Stat(file)
+	return err == nil && info.Size() == entry.Size
+}
+
+// Complete appends an object downloaded to a log file below the Web ACL's directory
+func (c *Checkpoint) Complete(origin, file string) error {
+	rel, err := filepath.Rel(c.aclDir, file)
+	if err != nil {
+		return fmt.Errorf("failed to resolve %s: %w", file, err)
+	}
+	info, err := os.Stat(file)
+	if err != nil {
+		return fmt.Errorf("failed to checkpoint %s: %w", file, err)
+	}
+	entry := CheckpointEntry{Origin: origin, Path: filepath.ToSlash(rel), Size: info.Size(), At: time.Now().UTC()}
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return fmt.Errorf("failed to encode checkpoint entry: %w", err)
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	f, err := os.OpenFile(filepath.Join(c.aclDir, CheckpointFileName), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return fmt.Errorf("failed to open checkpoint: %w", err)
+	}
+	if _, err := f.Write(append(data, '\n')); err != nil {
+		f.Close()
+		return fmt.Errorf("failed to append to checkpoint: %w", err)
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return fmt.Errorf("failed to sync checkpoint: %w", err)
+	}
+	if err := f.Close(); err != nil {
+		return fmt.Errorf("failed to close checkpoint: %w", err)
+	}
+	c.completed[origin] = entry
+	return nil
+}
+
+// Finish removes the checkpoint once the retrieval downloaded every object
+func (c *Checkpoint) Finish() error {
+	if err := os.Remove(filepath.Join(c.aclDir, CheckpointFileName)); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("failed to remove checkpoint: %w", err)
+	}
+	return nil
+}
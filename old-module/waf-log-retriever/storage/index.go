@@ -0,0 +1,76 @@
+package storage
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// IndexFileName is the index of the log files in a Web ACL's directory. It is hidden
+// so that it is never mistaken for a log file.
+const IndexFileName = ".index.json"
+
+// IndexVersion is the version of the index written; indexes written before it was
+// stamped read as version 0, and indexes of a newer version are refused rather than
+// misread
+const IndexVersion = 1
+
+// Index records the layout and the log files of a Web ACL's directory
+type Index struct {
+	Version   int                    `json:"version"`
+	Layout    string                 `json:"layout"`
+	UpdatedAt time.Time              `json:"updatedAt"`
+	Files     []IndexEntry           `json:"files"`
+	Pending   *PendingReorganization `json:"pending,omitempty"` // A reorganization that has not completed
+}
+
+// IndexEntry is one log file of the index
+type IndexEntry struct {
+	Path      string    `json:"path"`      // Slash-separated, relative to the Web ACL's directory
+	Partition time.Time `json:"partition"` // Start of the hour or day the file holds
+	Records   int64     `json:"records"`
+	Size      int64     `json:"size"` // Bytes on disk
+}
+
+// PendingReorganization is the journal of a reorganization: every staged file has
+// been written, and the index is updated once they replace the old files
+type PendingReorganization struct {
+	Layout string            `json:"layout"`
+	Staged map[string]string `json:"staged"` // Staged file -> final file
+	Remove []string          `json:"remove"` // Old files that are not replaced by a staged file
+}
+
+// LoadIndex reads the index of a Web ACL's directory, or returns nil if it has none
+func LoadIndex(aclDir string) (*Index, error) {
+	data, err := os.ReadFile(filepath.Join(aclDir, IndexFileName))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read index: %w", err)
+	}
+	var index Index
+	if err := json.Unmarshal(data, &index); err != nil {
+		return nil, fmt.Errorf("failed to parse index %s: %w", filepath.Join(aclDir, IndexFileName), err)
+	}
+	if index.Version > IndexVersion {
+		return nil, fmt.Errorf("index %s has version %d; this build reads up to version %d",
+			filepath.Join(aclDir, IndexFileName), index.Version, IndexVersion)
+	}
+	return &index, nil
+}
+
+// Save writes the index atomically, in the current version: to a temporary file
+// renamed over the old index
+func (i *Index) Save(aclDir string) error {
+	i.Version = IndexVersion
+	i.UpdatedAt = time.Now().UTC()
+	data, err := json.MarshalIndent(i, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to encode index: %w", err)
+	}
+	return WriteFileAtomic(filepath.Join(aclDir, IndexFileName), data)
+}
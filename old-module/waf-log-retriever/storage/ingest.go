@@ -0,0 +1,449 @@
+package storage
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// IngestedFileName is the journal of the files ingested into a Web ACL's directory:
+// JSON Lines that are only ever appended to. It is hidden so that it is never
+// mistaken for a log file.
+const IngestedFileName = ".ingested.jsonl"
+
+// ingestedMu serializes appends to ingest journals within the process
+var ingestedMu sync.Mutex
+
+// unsafeNameChars are replaced in the names of ingested files
+var unsafeNameChars = regexp.MustCompile(`[^A-Za-z0-9._-]+`)
+
+// IngestedFile is one line of an ingest journal: a delivered file whose records were
+// written to the Web ACL's directory
+type IngestedFile struct {
+	SHA256  string    `json:"sha256"` // Of the delivered file, identifying it whatever its name
+	Name    string    `json:"name"`
+	Size    int64     `json:"size"`
+	Format  string    `json:"format"`
+	Records int64     `json:"records"`
+	Files   []string  `json:"files,omitempty"` // Log files written, relative to the Web ACL's directory
+	At      time.Time `json:"at"`
+
+	AlreadyStored int64 `json:"alreadyStored,omitempty"` // Records left out as the directory held them already, see SeenRequests
+}
+
+// IngestResult summarizes the ingestion of a delivered file
+type IngestResult struct {
+	IngestedFile
+	Duplicate bool           // The file was ingested before, under this or another name
+	Members   []MemberResult // Of an archive, its files in order
+}
+
+// LoadIngested returns the files ingested into a Web ACL's directory by checksum. A
+// last line cut short by a crash is ignored.
+func LoadIngested(aclDir string) (map[string]IngestedFile, error) {
+	ingested := make(map[string]IngestedFile)
+	f, err := os.Open(filepath.Join(aclDir, IngestedFileName))
+	if errors.Is(err, os.ErrNotExist) {
+		return ingested, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to open ingest journal: %w", err)
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	for scanner.Scan() {
+		var entry IngestedFile
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			continue
+		}
+		ingested[entry.SHA256] = entry
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read ingest journal: %w", err)
+	}
+	return ingested, nil
+}
+
+// ErrUnknownFormat is returned, wrapped, by a ParseFunc for a file in no known log
+// format. Such files are skipped in archives rather than failing them.
+var ErrUnknownFormat = errors.New("not in a known log format")
+
+// ParseFunc streams the records of a delivered file with their timestamps in epoch
+// milliseconds and returns its format; name identifies the file in errors
+type ParseFunc func(r io.Reader, name string, fn func(timestamp int64, raw []byte) error) (string, error)
+
+// MemberFunc streams the files of a delivered archive in order, with their paths
+// inside it, and returns the archive's format
+type MemberFunc func(fn func(name string, r io.Reader) error) (string, error)
+
+// MemberResult is the outcome of ingesting a file of an archive
+type MemberResult struct {
+	*IngestResult
+	Name string // Path inside the archive
+	Err  error  // Wraps ErrUnknownFormat for files that are not logs, which were skipped
+}
+
+// Ingest writes the records of a file delivered outside AWS into a Web ACL's
+// directory, in its layout (hourly, unless it was reorganized): one log file per
+// partition the records fall in, named after the delivered file and its checksum,
+// recorded in the manifest and the index like retrieved files. The file is then
+// journaled, so that it is skipped when delivered again, under any name. The names
+// are derived from the content, so ingesting a file again after an interruption
+// overwrites what the interrupted run wrote rather than duplicating records. With
+// seen, records whose request IDs the directory holds already, e.g. of an overlapping
+// delivery, are left out. Callers hold the directory's lock.
+func Ingest(aclDir, file string, parse ParseFunc, seen *SeenRequests) (*IngestResult, error) {
+	_, _, entry, err := journaled(aclDir, file)
+	if err != nil {
+		return nil, err
+	}
+	if entry != nil {
+		return &IngestResult{IngestedFile: *entry, Duplicate: true}, nil
+	}
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open %s: %w", file, err)
+	}
+	defer f.Close()
+	return ingest(aclDir, filepath.Base(file), filepath.ToSlash(file), f, parse, seen)
+}
+
+// IngestArchive ingests the files of a delivered archive one by one, streaming them
+// out of it, like delivered files named <archive>/<path inside it>. Files that are
+// not logs are skipped. Once all of its files are ingested, the archive itself is
+// journaled too, so that it is skipped as a whole when delivered again; if some
+// failed, a redelivery only ingests those. Records are left out with seen as by
+// Ingest. Callers hold the directory's lock.
+func IngestArchive(aclDir, file string, members MemberFunc, parse ParseFunc, seen *SeenRequests) (*IngestResult, error) {
+	sum, size, entry, err := journaled(aclDir, file)
+	if err != nil {
+		return nil, err
+	}
+	if entry != nil {
+		return &IngestResult{IngestedFile: *entry, Duplicate: true}, nil
+	}
+	archive := filepath.Base(file)
+	result := &IngestResult{IngestedFile: IngestedFile{SHA256: sum, Name: archive, Size: size}}
+	failed := false
+	format, err := members(func(name string, r io.Reader) error {
+		name = path.Join(archive, name)
+		member, err := ingest(aclDir, name, name, r, parse, seen)
+		result.Members = append(result.Members, MemberResult{IngestResult: member, Name: name, Err: err})
+		switch {
+		case err != nil:
+			failed = failed || !errors.Is(err, ErrUnknownFormat)
+		default:
+			result.Records += member.Records
+			result.AlreadyStored += member.AlreadyStored
+			result.Files = append(result.Files, member.Files...)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	result.Format = format
+	if failed {
+		return result, nil
+	}
+	sort.Strings(result.Files)
+	result.At = time.Now().UTC()
+	if err := appendIngested(aclDir, result.IngestedFile); err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+// journaled returns the checksum and size of a delivered file, and its journal
+// entry if it was ingested before
+func journaled(aclDir, file string) (string, int64, *IngestedFile, error) {
+	sum, size, err := hashFile(file)
+	if err != nil {
+		return "", 0, nil, err
+	}
+	ingested, err := LoadIngested(aclDir)
+	if err != nil {
+		return "", 0, nil, err
+	}
+	if entry, ok := ingested[sum]; ok {
+		return sum, size, &entry, nil
+	}
+	return sum, size, nil, nil
+}
+
+// ingest writes the records of a delivered file read from r, checksumming it as it
+// is read. Its records are staged under names without the checksum, then checked
+// against the journal and renamed into place. Records without a timestamp are placed
+// in the partition the file's location, e.g. a path inside an archive copied from
+// S3, names, if any. Records seen, if set, finds stored already are left out.
+func ingest(aclDir, name, location string, r io.Reader, parse ParseFunc, seen *SeenRequests) (*IngestResult, error) {
+	index, err := LoadIndex(aclDir)
+	if err != nil {
+		return nil, err
+	}
+	layout := LayoutHourly
+	if index != nil {
+		if index.Pending != nil {
+			return nil, fmt.Errorf("a reorganization of %s has not completed; rerun storage reorganize first", aclDir)
+		}
+		layout = index.Layout
+	}
+	inferred, inferredOK := locationPartition(location)
+	if seen != nil {
+		defer seen.discard() // Unless committed, when the files written are recorded
+	}
+
+	stem := ingestedStem(path.Base(name))
+	provisional := func(dir string) string { return path.Join(dir, stem+".log.gz") }
+	result := &IngestResult{IngestedFile: IngestedFile{Name: name}}
+	entries := make(map[string]*IndexEntry) // By partition directory
+	open := make(map[string]*stagedPartition)
+	closeAll := func() error {
+		var errs []error
+		for dir, p := range open {
+			errs = append(errs, p.gz.Close(), p.file.Close())
+			delete(open, dir)
+		}
+		return errors.Join(errs...)
+	}
+	removeStaged := func() {
+		closeAll()
+		for dir := range entries {
+			os.Remove(filepath.Join(aclDir, filepath.FromSlash(stagedPath(provisional(dir)))))
+		}
+	}
+
+	hashed := &hashingReader{r: r, h: sha256.New()}
+	var line bytes.Buffer
+	format, err := parse(hashed, name, func(timestamp int64, raw []byte) error {
+		partition := time.UnixMilli(timestamp).UTC()
+		if timestamp == 0 {
+			if !inferredOK {
+				return fmt.Errorf("a record of %s has no timestamp, and its location names no partition", name)
+			}
+			partition = inferred
+		}
+		file, err := PartitionPath(layout, partition)
+		if err != nil {
+			return err
+		}
+		dir := path.Dir(file)
+		if seen != nil {
+			stored, err := seen.seen(dir, requestIDOf(raw))
+			if err != nil {
+				return err
+			}
+			if stored {
+				result.AlreadyStored++
+				return nil
+			}
+		}
+		p, ok := open[dir]
+		if !ok {
+			if len(open) >= maxOpenPartitions {
+				if err := closeAll(); err != nil {
+					return fmt.Errorf("failed to close staged files: %w", err)
+				}
+			}
+			if p, err = openStaged(aclDir, provisional(dir), entries[dir] != nil); err != nil {
+				return err
+			}
+			open[dir] = p
+		}
+		entry, ok := entries[dir]
+		if !ok {
+			entry = &IndexEntry{Partition: partitionStart(layout, partition)}
+			entries[dir] = entry
+		}
+		entry.Records++
+		result.Records++
+
+		line.Reset()
+		if err := json.Compact(&line, raw); err != nil {
+			return fmt.Errorf("failed to compact record: %w", err)
+		}
+		line.WriteByte('\n')
+		if _, err := p.gz.Write(line.Bytes()); err != nil {
+			return fmt.Errorf("failed to write staged file for %s: %w", dir, err)
+		}
+		return nil
+	})
+	if err == nil {
+		_, err = io.Copy(io.Discard, hashed) // Whatever follows the records is part of the file too
+	}
+	if err != nil {
+		removeStaged()
+		return nil, err
+	}
+	if err := closeAll(); err != nil {
+		removeStaged()
+		return nil, fmt.Errorf("failed to close staged files: %w", err)
+	}
+	result.Format = format
+	result.SHA256 = hex.EncodeToString(hashed.h.Sum(nil))
+	result.Size = hashed.n
+
+	ingested, err := LoadIngested(aclDir)
+	if err != nil {
+		removeStaged()
+		return nil, err
+	}
+	if entry, ok := ingested[result.SHA256]; ok {
+		removeStaged()
+		return &IngestResult{IngestedFile: entry, Duplicate: true}, nil
+	}
+
+	// Move the staged files into place, then record them
+	dirs := make([]string, 0, len(entries))
+	for dir := range entries {
+		dirs = append(dirs, dir)
+	}
+	sort.Strings(dirs)
+	final := make(map[string]*IndexEntry, len(entries))
+	var changes []ManifestEntry
+	for _, dir := range dirs {
+		entry := entries[dir]
+		entry.Path = path.Join(dir, ingestedName(stem, result.SHA256))
+		dest := filepath.Join(aclDir, filepath.FromSlash(entry.Path))
+		if err := os.Rename(filepath.Join(aclDir, filepath.FromSlash(stagedPath(provisional(dir)))), dest); err != nil {
+			removeStaged()
+			return nil, fmt.Errorf("failed to move %s into place: %w", entry.Path, err)
+		}
+		change, err := FileEntry(aclDir, dest, "ingest:"+result.Name)
+		if err != nil {
+			return nil, err
+		}
+		entry.Size = change.Size
+		changes = append(changes, change)
+		final[entry.Path] = entry
+		result.Files = append(result.Files, entry.Path)
+	}
+	if err := AppendManifest(aclDir, changes...); err != nil {
+		return nil, err
+	}
+	if seen != nil {
+		seen.commit(changes)
+	}
+	if index != nil {
+		index.Files = mergeIndexEntries(index.Files, final)
+		if err := index.Save(aclDir); err != nil {
+			return nil, err
+		}
+	}
+
+	result.At = time.Now().UTC()
+	if err := appendIngested(aclDir, result.IngestedFile); err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+// hashingReader checksums and counts what is read through it
+type hashingReader struct {
+	r io.Reader
+	h hash.Hash
+	n int64
+}
+
+func (r *hashingReader) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	r.h.Write(p[:n])
+	r.n += int64(n)
+	return n, err
+}
+
+// locationPartition returns the start of the partition a delivered file's location
+// names in its last directories, in any layout, e.g. .../2025/01/31/14/file.log.gz
+// as S3 delivers them
+func locationPartition(location string) (time.Time, bool) {
+	parts := strings.Split(path.Dir(location), "/")
+	for _, n := range []int{4, 3} {
+		if len(parts) < n {
+			continue
+		}
+		if _, start, _, ok := ParsePartition(strings.Join(parts[len(parts)-n:], "/")); ok {
+			return start, true
+		}
+	}
+	return time.Time{}, false
+}
+
+// ingestedStem returns a delivered file's name without extensions, made safe
+func ingestedStem(name string) string {
+	stem := name
+	for {
+		ext := strings.ToLower(filepath.Ext(stem))
+		switch ext {
+		case ".gz", ".json", ".jsonl", ".log", ".txt":
+			stem = strings.TrimSuffix(stem, filepath.Ext(stem))
+			continue
+		}
+		break
+	}
+	stem = strings.Trim(unsafeNameChars.ReplaceAllString(stem, "_"), "._")
+	if stem == "" {
+		stem = "ingested"
+	}
+	return stem
+}
+
+// ingestedName returns the name of the log files a delivered file is ingested into:
+// its stem and the start of its checksum
+func ingestedName(stem, sum string) string {
+	return fmt.Sprintf("%s_%s.log.gz", stem, sum[:12])
+}
+
+// mergeIndexEntries replaces the index entries of the files written, adds the new
+// ones and keeps the index sorted by path
+func mergeIndexEntries(files []IndexEntry, written map[string]*IndexEntry) []IndexEntry {
+	merged := make([]IndexEntry, 0, len(files)+len(written))
+	for _, entry := range files {
+		if written[entry.Path] == nil {
+			merged = append(merged, entry)
+		}
+	}
+	for _, entry := range written {
+		merged = append(merged, *entry)
+	}
+	sort.Slice(merged, func(i, j int) bool { return merged[i].Path < merged[j].Path })
+	return merged
+}
+
+// appendIngested appends an entry to the ingest journal of a Web ACL's directory
+func appendIngested(aclDir string, entry IngestedFile) error {
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return fmt.Errorf("failed to encode ingest journal entry: %w", err)
+	}
+	ingestedMu.Lock()
+	defer ingestedMu.Unlock()
+	f, err := os.OpenFile(filepath.Join(aclDir, IngestedFileName), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return fmt.Errorf("failed to open ingest journal: %w", err)
+	}
+	if _, err := f.Write(append(data, '\n')); err != nil {
+		f.Close()
+		return fmt.Errorf("failed to append to ingest journal: %w", err)
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return fmt.Errorf("failed to sync ingest journal: %w", err)
+	}
+	return f.Close()
+}
@@ -0,0 +1,54 @@
+package storage
+
+import (
+	"fmt"
+	"path"
+	"strings"
+	"time"
+)
+
+// Layouts of the log files below a Web ACL's directory
+const (
+	LayoutHourly = "hourly" // YYYY/MM/DD/HH/<file>, as retrieved from S3
+	LayoutDaily  = "daily"  // YYYY/MM/DD/<one file per day>
+	LayoutHive   = "hive"   // year=YYYY/month=MM/day=DD/hour=HH/<file>, for Athena, Spark and DuckDB
+)
+
+// Layouts lists the supported layouts
+var Layouts = []string{LayoutHourly, LayoutDaily, LayoutHive}
+
+// PartitionPath returns the slash-separated path, relative to a Web ACL's directory,
+// of the file consolidating the records of the partition holding t
+func PartitionPath(layout string, t time.Time) (string, error) {
+	t = t.UTC()
+	switch layout {
+	case LayoutHourly:
+		return t.Format("2006/01/02/15/waf_logs_20060102_15.log.gz"), nil
+	case LayoutDaily:
+		return t.Format("2006/01/02/waf_logs_20060102.log.gz"), nil
+	case LayoutHive:
+		return t.Format("year=2006/month=01/day=02/hour=15/waf_logs_20060102_15.log.gz"), nil
+	}
+	return "", fmt.Errorf("unknown layout %q (known: %s)", layout, strings.Join(Layouts, ", "))
+}
+
+// ParsePartition returns the layout and time span of a log file's directory, given
+// relative to the Web ACL's directory, and false if it is not a partition of any
+// layout
+func ParsePartition(dir string) (layout string, start time.Time, length time.Duration, ok bool) {
+	parts := strings.Split(path.Clean(strings.ReplaceAll(dir, "\\", "/")), "/")
+	switch len(parts) {
+	case 3:
+		if t, err := time.Parse("2006/01/02", strings.Join(parts, "/")); err == nil {
+			return LayoutDaily, t, 24 * time.Hour, true
+		}
+	case 4:
+		if t, err := time.Parse("2006/01/02/15", strings.Join(parts, "/")); err == nil {
+			return LayoutHourly, t, time.Hour, true
+		}
+		if t, err := time.Parse("year=2006/month=01/day=02/hour=15", strings.Join(parts, "/")); err == nil {
+			return LayoutHive, t, time.Hour, true
+		}
+	}
+	return "", time.Time{}, 0, false
+}
@@ -0,0 +1,219 @@
+package storage
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// LockFileName is the advisory lock of a Web ACL's directory, held by the run
+// writing to it. It is hidden so that it is never mistaken for a log file.
+const LockFileName = ".lock"
+
+// lockWriteGrace is how long an unreadable lock file is taken for one being written
+// by the run acquiring it
+const lockWriteGrace = time.Minute
+
+// LockInfo identifies the run holding a lock
+type LockInfo struct {
+	PID     int       `json:"pid"`
+	Host    string    `json:"host"`
+	Command string    `json:"command"`
+	Started time.Time `json:"started"`
+}
+
+// LockedError is returned when another run holds the lock of a Web ACL's directory
+type LockedError struct {
+	Dir    string
+	Holder LockInfo
+}
+
+func (e *LockedError) Error() string {
+	return fmt.Sprintf("another run is active on %s (%s); wait for it to finish, or rerun with -force-unlock if it is no longer running",
+		e.Dir, e.Holder)
+}
+
+// Lock is a held lock of a Web ACL's directory
+type Lock struct {
+	path string
+	info LockInfo
+
+	// TookOver is set if a lock was taken over because its process was gone, it was
+	// unreadable or force was given; Replaced is its holder, if readable
+	TookOver bool
+	Replaced *LockInfo
+}
+
+// AcquireLock locks a Web ACL's directory for a run of command, so that concurrent
+// runs cannot interleave their writes to its logs, manifest and index. A lock left
+// by a process on this host that no longer runs is taken over; force takes over any
+// lock. The lock is advisory: only runs acquiring it are kept out.
+func AcquireLock(aclDir, command string, force bool) (*Lock, error) {
+	if err := os.MkdirAll(aclDir, 0755); err != nil {
+		return nil, fmt.Errorf("failed to create %s: %w", aclDir, err)
+	}
+	host, _ := os.Hostname()
+	lock := &Lock{
+		path: filepath.Join(aclDir, LockFileName),
+		info: LockInfo{PID: os.Getpid(), Host: host, Command: command, Started: time.Now().UTC()},
+	}
+	data, err := json.Marshal(lock.info)
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode lock: %w", err)
+	}
+
+	for attempt := 0; attempt < 3; attempt++ {
+		f, err := os.OpenFile(lock.path, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0644)
+		if err == nil {
+			_, err = f.Write(append(data, '\n'))
+			if closeErr := f.Close(); err == nil {
+				err = closeErr
+			}
+			if err != nil {
+				os.Remove(lock.path)
+				return nil, fmt.Errorf("failed to write lock %s: %w", lock.path, err)
+			}
+			return lock, nil
+		}
+		if !errors.Is(err, os.ErrExist) {
+			return nil, fmt.Errorf("failed to create lock %s: %w", lock.path, err)
+		}
+
+		holder, err := ReadLock(aclDir)
+		switch {
+		case err != nil:
+			// Unreadable: being written by a run acquiring it, or left by a crash doing so
+			if lockBeingWritten(lock.path) && !force {
+				return nil, fmt.Errorf("lock %s is being acquired by another run; retry shortly, or rerun with -force-unlock", lock.path)
+			}
+		case holder == nil:
+			continue // Released since
+		case !force && (holder.Host != host || processAlive(holder.PID)):
+			return nil, &LockedError{Dir: aclDir, Holder: *holder}
+		}
+		tookOver, err := takeOverLock(lock.path, holder, force)
+		if err != nil {
+			return nil, err
+		}
+		if tookOver {
+			lock.TookOver, lock.Replaced = true, holder
+		}
+	}
+	return nil, fmt.Errorf("failed to acquire lock %s: it keeps being taken by other runs", lock.path)
+}
+
+// takeOverLock removes a lock found stale, whose holder was read, or which was
+// unreadable if holder is nil. Runs that found the same lock stale may have taken it
+// over and acquired it since, so rather than removing it by name, the lock is moved
+// aside, which only one run can do, and read again: a lock that is not the one found
+// stale is put back, unless a run acquired the lock meanwhile, and false returned.
+func takeOverLock(path string, holder *LockInfo, force bool) (bool, error) {
+	aside := fmt.Sprintf("%s.stale-%d-%d", path, os.Getpid(), time.Now().UnixNano())
+	if err := os.Rename(path, aside); err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return false, nil // Released or taken over since
+		}
+		return false, fmt.Errorf("failed to move stale lock %s aside: %w", path, err)
+	}
+	moved, err := readLockFile(aside)
+	stale := holder == nil && err != nil && (force || !lockBeingWritten(aside))
+	if holder != nil && moved != nil {
+		stale = moved.same(*holder)
+	}
+	if !stale {
+		err := os.Link(aside, path)
+		os.Remove(aside)
+		if err != nil && !errors.Is(err, os.ErrExist) {
+			return false, fmt.Errorf("failed to restore lock %s: %w", path, err)
+		}
+		return false, nil
+	}
+	if err := os.Remove(aside); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return false, fmt.Errorf("failed to remove stale lock %s: %w", aside, err)
+	}
+	return true, nil
+}
+
+// lockBeingWritten reports whether an unreadable lock file is recent enough to be
+// one being written by the run acquiring it
+func lockBeingWritten(path string) bool {
+	info, err := os.Stat(path)
+	return err == nil && time.Since(info.ModTime()) < lockWriteGrace
+}
+
+// ReadLock returns the holder of the lock of a Web ACL's directory, or nil if it is
+// not locked
+func ReadLock(aclDir string) (*LockInfo, error) {
+	return readLockFile(filepath.Join(aclDir, LockFileName))
+}
+
+// readLockFile returns the holder of a lock file, or nil if it does not exist
+func readLockFile(path string) (*LockInfo, error) {
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read lock: %w", err)
+	}
+	var info LockInfo
+	if err := json.Unmarshal(data, &info); err != nil {
+		return nil, fmt.Errorf("failed to parse lock %s: %w", path, err)
+	}
+	return &info, nil
+}
+
+// Release removes the lock, unless another run took it over in the meantime
+func (l *Lock) Release() error {
+	holder, err := ReadLock(filepath.Dir(l.path))
+	if err != nil || holder == nil {
+		return err
+	}
+	if !holder.same(l.info) {
+		return nil
+	}
+	if err := os.Remove(l.path); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("failed to release lock %s: %w", l.path, err)
+	}
+	return nil
+}
+
+// same reports whether two lock holders are the same run
+func (i LockInfo) same(other LockInfo) bool {
+	return i.PID == other.PID && i.Host == other.Host && i.Started.Equal(other.Started)
+}
+
+// String describes the holder of a lock
+func (i LockInfo) String() string {
+	parts := []string{fmt.Sprintf("pid %d", i.PID)}
+	if i.Host != "" {
+		parts[0] += " on " + i.Host
+	}
+	if i.Command != "" {
+		parts = append(parts, i.Command)
+	}
+	if !i.Started.IsZero() {
+		parts = append(parts, "started "+i.Started.Local().Format(time.RFC3339))
+	}
+	return strings.Join(parts, ", ")
+}
+
+// processAlive reports whether a process of this host is running. Where signals are
+// not supported, processes are assumed to run, so their locks are only taken over
+// with -force-unlock.
+func processAlive(pid int) bool {
+	if pid <= 0 {
+		return false
+	}
+	process, err := os.FindProcess(pid)
+	if err != nil {
+		return false
+	}
+	err = process.Signal(syscall.Signal(0))
+	return !errors.Is(err, os.ErrProcessDone) && !errors.Is(err, syscall.ESRCH)
+}
@@ -0,0 +1,222 @@
+package storage
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+// ManifestFileName is the download manifest of a Web ACL's directory: JSON Lines
+// that are only ever appended to. It is hidden so that it is never mistaken for a
+// log file.
+const ManifestFileName = ".manifest.jsonl"
+
+// ManifestVersion is the version of the manifest entries written; entries of a
+// newer version are refused rather than misread. Since version 2, add entries carry
+// the record count of their file; MigrateWebACL backfills those of older entries.
+const ManifestVersion = 2
+
+// Manifest operations
+const (
+	ManifestAdd    = "add"    // A file was written, or rewritten
+	ManifestRemove = "remove" // A file was deleted on purpose
+)
+
+// manifestMu serializes appends to manifests within the process
+var manifestMu sync.Mutex
+
+// ManifestEntry is one line of a manifest
+type ManifestEntry struct {
+	Version int       `json:"v"`
+	Op      string    `json:"op"`
+	Path    string    `json:"path"` // Slash-separated, relative to the Web ACL's directory
+	SHA256  string    `json:"sha256,omitempty"`
+	Size    int64     `json:"size,omitempty"`
+	Records *int64    `json:"records,omitempty"` // Records in the file when it was written, see CountRecords; nil in older entries
+	Source  string    `json:"source,omitempty"`  // Where the file came from, e.g. s3://bucket/key
+	At      time.Time `json:"at"`
+}
+
+// FileEntry hashes a file below a Web ACL's directory into an add entry, with the
+// number of records it holds so analyses can reconcile their counts against it
+func FileEntry(aclDir, file, source string) (ManifestEntry, error) {
+	rel, err := filepath.Rel(aclDir, file)
+	if err != nil {
+		return ManifestEntry{}, fmt.Errorf("failed to resolve %s: %w", file, err)
+	}
+	sum, size, err := hashFile(file)
+	if err != nil {
+		return ManifestEntry{}, err
+	}
+	records, err := CountRecords(file)
+	if err != nil {
+		return ManifestEntry{}, err
+	}
+	return ManifestEntry{Op: ManifestAdd, Path: filepath.ToSlash(rel), SHA256: sum, Size: size, Records: &records, Source: source}, nil
+}
+
+// RemoveEntry returns the entry of a file deleted on purpose
+func RemoveEntry(path, source string) ManifestEntry {
+	return ManifestEntry{Op: ManifestRemove, Path: path, Source: source}
+}
+
+// hashFile returns the hex SHA-256 checksum and size of a file
+func hashFile(file string) (string, int64, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return "", 0, fmt.Errorf("failed to open %s: %w", file, err)
+	}
+	defer f.Close()
+	h := sha256.New()
+	size, err := io.Copy(h, f)
+	if err != nil {
+		return "", 0, fmt.Errorf("failed to hash %s: %w", file, err)
+	}
+	return hex.EncodeToString(h.Sum(nil)), size, nil
+}
+
+// AppendManifest appends entries to the manifest of a Web ACL's directory in a
+// single write, stamping their version and time
+func AppendManifest(aclDir string, entries ...ManifestEntry) error {
+	if len(entries) == 0 {
+		return nil
+	}
+	var buf bytes.Buffer
+	now := time.Now().UTC()
+	for _, entry := range entries {
+		entry.Version = ManifestVersion
+		if entry.At.IsZero() {
+			entry.At = now
+		}
+		data, err := json.Marshal(entry)
+		if err != nil {
+			return fmt.Errorf("failed to encode manifest entry: %w", err)
+		}
+		buf.Write(data)
+		buf.WriteByte('\n')
+	}
+
+	manifestMu.Lock()
+	defer manifestMu.Unlock()
+	f, err := os.OpenFile(filepath.Join(aclDir, ManifestFileName), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return fmt.Errorf("failed to open manifest: %w", err)
+	}
+	if _, err := f.Write(buf.Bytes()); err != nil {
+		f.Close()
+		return fmt.Errorf("failed to append to manifest: %w", err)
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return fmt.Errorf("failed to sync manifest: %w", err)
+	}
+	return f.Close()
+}
+
+// LoadManifest replays the manifest of a Web ACL's directory and returns the latest
+// add entry of every file not removed since, by path, and the number of entries
+// read. A last line cut short by a crash is ignored.
+func LoadManifest(aclDir string) (map[string]ManifestEntry, int, error) {
+	files := make(map[string]ManifestEntry)
+	f, err := os.Open(filepath.Join(aclDir, ManifestFileName))
+	if errors.Is(err, os.ErrNotExist) {
+		return files, 0, nil
+	}
+	if err != nil {
+		return nil, 0, fmt.Errorf("failed to open manifest: %w", err)
+	}
+	defer f.Close()
+
+	reader := bufio.NewReader(f)
+	entries := 0
+	for line := 1; ; line++ {
+		data, err := reader.ReadBytes('\n')
+		if errors.Is(err, io.EOF) {
+			return files, entries, nil // Without a newline, the last line was never completed
+		}
+		if err != nil {
+			return nil, 0, fmt.Errorf("failed to read manifest: %w", err)
+		}
+		var entry ManifestEntry
+		if err := json.Unmarshal(data, &entry); err != nil {
+			return nil, 0, fmt.Errorf("failed to parse manifest line %d: %w", line, err)
+		}
+		if entry.Version > ManifestVersion {
+			return nil, 0, fmt.Errorf("manifest line %d has version %d; this build reads up to version %d", line, entry.Version, ManifestVersion)
+		}
+		entries++
+		switch entry.Op {
+		case ManifestAdd:
+			files[entry.Path] = entry
+		case ManifestRemove:
+			delete(files, entry.Path)
+		default:
+			return nil, 0, fmt.Errorf("manifest line %d has unknown operation %q", line, entry.Op)
+		}
+	}
+}
+
+// ManifestReport is the outcome of auditing local files against a manifest
+type ManifestReport struct {
+	Entries  int      `json:"entries"`  // Manifest lines read
+	Verified int      `json:"verified"` // Files matching their checksum
+	Missing  []string `json:"missing"`  // In the manifest but not on disk
+	Modified []string `json:"modified"` // On disk with another checksum
+	Orphaned []string `json:"orphaned"` // On disk but not in the manifest
+}
+
+// OK reports whether every file matches the manifest
+func (r *ManifestReport) OK() bool {
+	return len(r.Missing) == 0 && len(r.Modified) == 0 && len(r.Orphaned) == 0
+}
+
+// VerifyManifest checks the log files of a Web ACL's directory against its manifest
+func VerifyManifest(aclDir string, logFiles []string) (*ManifestReport, error) {
+	expected, entries, err := LoadManifest(aclDir)
+	if err != nil {
+		return nil, err
+	}
+	report := &ManifestReport{Entries: entries, Missing: []string{}, Modified: []string{}, Orphaned: []string{}}
+	seen := make(map[string]bool, len(logFiles))
+	for _, file := range logFiles {
+		rel, err := filepath.Rel(aclDir, file)
+		if err != nil {
+			return nil, fmt.Errorf("failed to resolve %s: %w", file, err)
+		}
+		rel = filepath.ToSlash(rel)
+		seen[rel] = true
+		entry, ok := expected[rel]
+		if !ok {
+			report.Orphaned = append(report.Orphaned, rel)
+			continue
+		}
+		sum, size, err := hashFile(file)
+		if err != nil {
+			return nil, err
+		}
+		if sum != entry.SHA256 || size != entry.Size {
+			report.Modified = append(report.Modified, rel)
+			continue
+		}
+		report.Verified++
+	}
+	for rel := range expected {
+		if !seen[rel] {
+			report.Missing = append(report.Missing, rel)
+		}
+	}
+	sort.Strings(report.Missing)
+	sort.Strings(report.Modified)
+	sort.Strings(report.Orphaned)
+	return report, nil
+}
@@ -0,0 +1,115 @@
+package storage
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+)
+
+// Migration is an upgrade of a file of a Web ACL's directory written by an older
+// version to the current format
+type Migration struct {
+	File   string // Relative to the Web ACL's directory
+	From   int
+	To     int
+	Detail string
+}
+
+func (m Migration) String() string {
+	s := fmt.Sprintf("%s from version %d to %d", m.File, m.From, m.To)
+	if m.Detail != "" {
+		s += ": " + m.Detail
+	}
+	return s
+}
+
+// MigrateWebACL upgrades the index and manifest of a Web ACL's directory to the
+// current versions and returns the migrations applied, so that upgrading mid-review
+// keeps the data retrieved so far. Files of a newer version are refused. It writes
+// to the directory, so callers hold its lock.
+func MigrateWebACL(aclDir string) ([]Migration, error) {
+	var migrations []Migration
+	for _, migrate := range []func(string) (*Migration, error){migrateIndex, migrateManifest} {
+		m, err := migrate(aclDir)
+		if err != nil {
+			return migrations, err
+		}
+		if m != nil {
+			migrations = append(migrations, *m)
+		}
+	}
+	return migrations, nil
+}
+
+// migrateIndex stamps the version into an index written before it was versioned;
+// its entries are unchanged
+func migrateIndex(aclDir string) (*Migration, error) {
+	index, err := LoadIndex(aclDir)
+	if err != nil || index == nil || index.Version == IndexVersion {
+		return nil, err
+	}
+	from := index.Version
+	if err := index.Save(aclDir); err != nil {
+		return nil, fmt.Errorf("failed to migrate index: %w", err)
+	}
+	return &Migration{File: IndexFileName, From: from, To: IndexVersion}, nil
+}
+
+// migrateManifest backfills the record counts of files added by version 1 entries,
+// by appending an entry with the count of each file that still matches its
+// checksum. Files that are missing or were modified since are left to manifest
+// verify; their entries keep no count.
+func migrateManifest(aclDir string) (*Migration, error) {
+	files, _, err := LoadManifest(aclDir)
+	if err != nil {
+		return nil, err
+	}
+	paths := make([]string, 0, len(files))
+	from := ManifestVersion
+	for path, entry := range files {
+		if entry.Records == nil {
+			paths = append(paths, path)
+			from = min(from, entry.Version)
+		}
+	}
+	if len(paths) == 0 {
+		return nil, nil
+	}
+	sort.Strings(paths)
+
+	var backfilled []ManifestEntry
+	for _, path := range paths {
+		entry := files[path]
+		file := filepath.Join(aclDir, filepath.FromSlash(path))
+		sum, size, err := hashFile(file)
+		if errors.Is(err, os.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		if sum != entry.SHA256 || size != entry.Size {
+			continue
+		}
+		records, err := CountRecords(file)
+		if err != nil {
+			return nil, err
+		}
+		entry.Records = &records
+		backfilled = append(backfilled, entry)
+	}
+	if len(backfilled) == 0 {
+		return nil, nil
+	}
+	if err := AppendManifest(aclDir, backfilled...); err != nil {
+		return nil, fmt.Errorf("failed to migrate manifest: %w", err)
+	}
+	return &Migration{
+		File:   ManifestFileName,
+		From:   from,
+		To:     ManifestVersion,
+		Detail: fmt.Sprintf("backfilled the record counts of %d files", len(backfilled)),
+	}, nil
+}
@@ -0,0 +1,54 @@
+package storage
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// ProvenanceFileName records where the logs of a Web ACL's directory come from. It is
+// hidden so that it is never mistaken for a log file.
+const ProvenanceFileName = ".source.json"
+
+// Provenance identifies the source of logs: the profile they were retrieved with, the
+// account, region and Web ACL that logged them and the logging destination
+type Provenance struct {
+	Profile     string `json:"profile,omitempty"`
+	AccountID   string `json:"accountId,omitempty"`
+	AccountName string `json:"accountName,omitempty"` // Friendly name or IAM alias of the account at retrieval
+	Region      string `json:"region,omitempty"`
+	WebACL      string `json:"webAcl,omitempty"`
+	Destination string `json:"destination,omitempty"` // ARN of the S3 bucket, log group or Firehose stream
+}
+
+// LoadProvenance reads the provenance of a Web ACL's directory, or returns nil if it
+// has none
+func LoadProvenance(aclDir string) (*Provenance, error) {
+	path := filepath.Join(aclDir, ProvenanceFileName)
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read provenance: %w", err)
+	}
+	var p Provenance
+	if err := json.Unmarshal(data, &p); err != nil {
+		return nil, fmt.Errorf("failed to parse provenance %s: %w", path, err)
+	}
+	return &p, nil
+}
+
+// Save writes the provenance of a Web ACL's directory atomically
+func (p *Provenance) Save(aclDir string) error {
+	if err := os.MkdirAll(aclDir, 0755); err != nil {
+		return fmt.Errorf("failed to create %s: %w", aclDir, err)
+	}
+	data, err := json.MarshalIndent(p, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to encode provenance: %w", err)
+	}
+	return WriteFileAtomic(filepath.Join(aclDir, ProvenanceFileName), data)
+}
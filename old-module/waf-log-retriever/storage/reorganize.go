@@ -0,0 +1,237 @@
+package storage
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"time"
+)
+
+// maxOpenPartitions caps the staged files written to at once
+const maxOpenPartitions = 64
+
+// RecordFunc streams the records of a log file with their timestamps in epoch
+// milliseconds
+type RecordFunc func(file string, fn func(timestamp int64, raw []byte) error) error
+
+// ReorganizeResult summarizes a reorganization
+type ReorganizeResult struct {
+	Layout  string
+	Sources int // Log files read
+	Files   int // Log files written
+	Records int64
+	Kept    []string // Files without records, such as workspace files, left in place
+	Resumed bool     // An interrupted reorganization was completed first
+}
+
+// stagedPartition is a staged file being written
+type stagedPartition struct {
+	file *os.File
+	gz   *gzip.Writer
+}
+
+// Reorganize rewrites the log files below a Web ACL's directory into a layout, one
+// file per partition, partitioning every record by its timestamp. The new files are
+// staged as hidden files next to their final paths and recorded in the index before
+// any old file is touched, so an interrupted run is completed by the next one
+// rather than losing or duplicating records.
+func Reorganize(aclDir, layout string, sources []string, forEach RecordFunc) (*ReorganizeResult, error) {
+	if _, err := PartitionPath(layout, time.Time{}); err != nil {
+		return nil, err
+	}
+	result := &ReorganizeResult{Layout: layout, Sources: len(sources)}
+	index, err := LoadIndex(aclDir)
+	if err != nil {
+		return nil, err
+	}
+	if index != nil && index.Pending != nil {
+		if err := completeReorganization(aclDir, index); err != nil {
+			return nil, err
+		}
+		result.Resumed = true
+	}
+
+	entries := make(map[string]*IndexEntry)
+	open := make(map[string]*stagedPartition)
+	closeAll := func() error {
+		var errs []error
+		for final, p := range open {
+			errs = append(errs, p.gz.Close(), p.file.Close())
+			delete(open, final)
+		}
+		return errors.Join(errs...)
+	}
+	var line bytes.Buffer
+	read := make(map[string]bool)
+	for _, source := range sources {
+		err := forEach(source, func(timestamp int64, raw []byte) error {
+			read[source] = true
+			partition := time.UnixMilli(timestamp).UTC()
+			final, err := PartitionPath(layout, partition)
+			if err != nil {
+				return err
+			}
+			p, ok := open[final]
+			if !ok {
+				if len(open) >= maxOpenPartitions {
+					if err := closeAll(); err != nil {
+						return fmt.Errorf("failed to close staged files: %w", err)
+					}
+				}
+				if p, err = openStaged(aclDir, final, entries[final] != nil); err != nil {
+					return err
+				}
+				open[final] = p
+			}
+			entry, ok := entries[final]
+			if !ok {
+				entry = &IndexEntry{Path: final, Partition: partitionStart(layout, partition)}
+				entries[final] = entry
+			}
+			entry.Records++
+			result.Records++
+
+			line.Reset()
+			if err := json.Compact(&line, raw); err != nil {
+				return fmt.Errorf("failed to compact record: %w", err)
+			}
+			line.WriteByte('\n')
+			if _, err := p.gz.Write(line.Bytes()); err != nil {
+				return fmt.Errorf("failed to write staged file for %s: %w", final, err)
+			}
+			return nil
+		})
+		if err != nil {
+			closeAll()
+			return nil, err
+		}
+	}
+	if err := closeAll(); err != nil {
+		return nil, fmt.Errorf("failed to close staged files: %w", err)
+	}
+
+	pending := &PendingReorganization{Layout: layout, Staged: make(map[string]string)}
+	newIndex := &Index{Layout: layout, Files: []IndexEntry{}, Pending: pending}
+	for final, entry := range entries {
+		info, err := os.Stat(filepath.Join(aclDir, filepath.FromSlash(stagedPath(final))))
+		if err != nil {
+			return nil, fmt.Errorf("failed to stat staged file for %s: %w", final, err)
+		}
+		entry.Size = info.Size()
+		pending.Staged[stagedPath(final)] = final
+		newIndex.Files = append(newIndex.Files, *entry)
+	}
+	sort.Slice(newIndex.Files, func(i, j int) bool { return newIndex.Files[i].Path < newIndex.Files[j].Path })
+	for _, source := range sources {
+		rel, err := filepath.Rel(aclDir, source)
+		if err != nil {
+			return nil, fmt.Errorf("failed to resolve %s: %w", source, err)
+		}
+		rel = filepath.ToSlash(rel)
+		if !read[source] {
+			result.Kept = append(result.Kept, rel)
+			continue
+		}
+		if entries[rel] == nil {
+			pending.Remove = append(pending.Remove, rel)
+		}
+	}
+	result.Files = len(newIndex.Files)
+
+	// The journal is in place: from here on, a rerun completes the reorganization
+	if err := newIndex.Save(aclDir); err != nil {
+		return nil, err
+	}
+	if err := completeReorganization(aclDir, newIndex); err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+// openStaged opens the staged file of a partition, appending a new gzip member if
+// the run already wrote to it
+func openStaged(aclDir, final string, appendTo bool) (*stagedPartition, error) {
+	staged := filepath.Join(aclDir, filepath.FromSlash(stagedPath(final)))
+	if err := os.MkdirAll(filepath.Dir(staged), 0755); err != nil {
+		return nil, fmt.Errorf("failed to create directory for %s: %w", final, err)
+	}
+	flags := os.O_CREATE | os.O_WRONLY | os.O_TRUNC
+	if appendTo {
+		flags = os.O_CREATE | os.O_WRONLY | os.O_APPEND
+	}
+	file, err := os.OpenFile(staged, flags, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create staged file for %s: %w", final, err)
+	}
+	return &stagedPartition{file: file, gz: gzip.NewWriter(file)}, nil
+}
+
+// stagedPath returns the hidden path a partition's file is staged at
+func stagedPath(final string) string {
+	return path.Join(path.Dir(final), "."+path.Base(final)+".staged")
+}
+
+// partitionStart truncates a time to the start of its partition
+func partitionStart(layout string, t time.Time) time.Time {
+	if layout == LayoutDaily {
+		return time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, time.UTC)
+	}
+	return t.Truncate(time.Hour)
+}
+
+// completeReorganization moves the staged files of a pending reorganization into
+// place, removes the old files and directories left empty, and clears the journal.
+// Every step can be repeated, so it also completes an interrupted run.
+func completeReorganization(aclDir string, index *Index) error {
+	pending := index.Pending
+	for staged, final := range pending.Staged {
+		from := filepath.Join(aclDir, filepath.FromSlash(staged))
+		if _, err := os.Stat(from); errors.Is(err, os.ErrNotExist) {
+			continue // Moved before an interruption
+		}
+		if err := os.Rename(from, filepath.Join(aclDir, filepath.FromSlash(final))); err != nil {
+			return fmt.Errorf("failed to move %s into place: %w", final, err)
+		}
+	}
+	root := filepath.Clean(aclDir)
+	for _, old := range pending.Remove {
+		file := filepath.Join(aclDir, filepath.FromSlash(old))
+		if err := os.Remove(file); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return fmt.Errorf("failed to remove %s: %w", old, err)
+		}
+		// Remove the directories the file leaves empty, up to the Web ACL's directory
+		for dir := filepath.Dir(file); dir != root && dir != "."; dir = filepath.Dir(dir) {
+			if os.Remove(dir) != nil {
+				break
+			}
+		}
+	}
+
+	// Record the change in the manifest before clearing the journal: a rerun appends
+	// the same entries again, which replay to the same files
+	var changes []ManifestEntry
+	for _, old := range pending.Remove {
+		changes = append(changes, RemoveEntry(old, "reorganize"))
+	}
+	for _, final := range pending.Staged {
+		entry, err := FileEntry(aclDir, filepath.Join(aclDir, filepath.FromSlash(final)), "reorganize")
+		if err != nil {
+			return err
+		}
+		changes = append(changes, entry)
+	}
+	sort.Slice(changes, func(i, j int) bool { return changes[i].Path < changes[j].Path })
+	if err := AppendManifest(aclDir, changes...); err != nil {
+		return err
+	}
+
+	index.Layout = pending.Layout
+	index.Pending = nil
+	return index.Save(aclDir)
+}
@@ -0,0 +1,55 @@
+package storage
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// RunStateFileName records how far the retrievals into a Web ACL's directory got, so
+// that the next can fetch only newer logs. It is hidden so that it is never mistaken
+// for a log file.
+const RunStateFileName = ".last-run.json"
+
+// RunState is the progress of the last retrieval of a WAF log source that retrieved
+// everything in its time range
+type RunState struct {
+	LastTimestamp time.Time `json:"lastTimestamp"`     // Of the latest S3 object retrieved, or the end of the last CloudWatch Logs chunk
+	LastKey       string    `json:"lastKey,omitempty"` // S3 key of the latest object retrieved
+	RangeStart    time.Time `json:"rangeStart"`
+	RangeEnd      time.Time `json:"rangeEnd"`
+	At            time.Time `json:"at"`
+}
+
+// LoadRunState reads the run state of a Web ACL's directory, or returns nil if it has
+// none
+func LoadRunState(aclDir string) (*RunState, error) {
+	path := filepath.Join(aclDir, RunStateFileName)
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read run state: %w", err)
+	}
+	var s RunState
+	if err := json.Unmarshal(data, &s); err != nil {
+		return nil, fmt.Errorf("failed to parse run state %s: %w", path, err)
+	}
+	return &s, nil
+}
+
+// Save writes the run state of a Web ACL's directory atomically
+func (s *RunState) Save(aclDir string) error {
+	if err := os.MkdirAll(aclDir, 0755); err != nil {
+		return fmt.Errorf("failed to create %s: %w", aclDir, err)
+	}
+	data, err := json.MarshalIndent(s, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to encode run state: %w", err)
+	}
+	return WriteFileAtomic(filepath.Join(aclDir, RunStateFileName), data)
+}
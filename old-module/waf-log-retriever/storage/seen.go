@@ -0,0 +1,338 @@
+package storage
+
+import (
+	"bytes"
+	"encoding/gob"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+)
+
+// SeenRequestsFileName is the filter of the request IDs a Web ACL's directory holds
+// records of, see SeenRequests. It is hidden so that it is never mistaken for a log
+// file.
+const SeenRequestsFileName = ".seen-requests.bloom"
+
+// seenRequestsVersion is the version of the filter file written; other versions are
+// rebuilt from the log files
+const seenRequestsVersion = 1
+
+// Sizing of the layers of the filter
+const (
+	seenFalsePositiveRate = 0.01    // Of each layer when full
+	seenInitialCapacity   = 1 << 20 // Request IDs of the first layer; each further layer holds twice as many
+)
+
+// maxExactPartitions caps the partitions whose request IDs are held in memory at once
+const maxExactPartitions = 16
+
+// SeenRequests tells which request IDs a Web ACL's directory already holds records
+// of, so that ingesting overlapping deliveries, e.g. an export repeating the last
+// hour of the previous one, does not duplicate records. A bloom filter of every
+// request ID, persisted in the directory, answers most lookups without reading any
+// log file; only those it reports as possibly seen are checked exactly against the
+// request IDs of the log files of the record's partition. The filter covers the log
+// files of the manifest; files it does not cover yet, e.g. retrieved since the last
+// ingest, are added to it when it is opened.
+type SeenRequests struct {
+	aclDir  string
+	forEach RecordFunc
+	files   map[string]ManifestEntry // Log files of the manifest
+
+	filter seenFilter
+	dirty  bool
+
+	exact  map[string]map[string]bool // Request IDs of the log files of a partition, by partition directory
+	staged map[string]map[string]bool // Request IDs staged by the current ingest, by partition directory
+
+	Checked    int64 // Request IDs looked up
+	Candidates int64 // Lookups the filter could not rule out, checked exactly
+	Duplicates int64 // Records found stored already
+}
+
+// seenFilter is the persisted form of the filter: a scalable bloom filter, which
+// adds a larger layer whenever the last one is full, and the manifest checksums of
+// the log files whose request IDs it holds
+type seenFilter struct {
+	Version int
+	Layers  []*bloomLayer
+	Files   map[string]string // Manifest path -> SHA-256
+}
+
+// bloomLayer is one bloom filter of a seenFilter
+type bloomLayer struct {
+	Bits     []uint64
+	Hashes   uint32
+	Capacity int64
+	Count    int64
+}
+
+// newBloomLayer sizes a layer for capacity request IDs at seenFalsePositiveRate
+func newBloomLayer(capacity int64) *bloomLayer {
+	bits := math.Ceil(-float64(capacity) * math.Log(seenFalsePositiveRate) / (math.Ln2 * math.Ln2))
+	hashes := max(1, uint32(math.Round(bits/float64(capacity)*math.Ln2)))
+	return &bloomLayer{Bits: make([]uint64, (int64(bits)+63)/64), Hashes: hashes, Capacity: capacity}
+}
+
+// hashID returns the 64-bit FNV-1a hash of a request ID
+func hashID(id string) uint64 {
+	const offset, prime = 14695981039346656037, 1099511628211
+	h := uint64(offset)
+	for i := 0; i < len(id); i++ {
+		h ^= uint64(id[i])
+		h *= prime
+	}
+	return h
+}
+
+// positions calls fn with the bit positions of a request ID, derived from one
+// 64-bit hash by double hashing, until fn returns false
+func (l *bloomLayer) positions(id string, fn func(bit uint64) bool) bool {
+	sum := hashID(id)
+	h1, h2 := sum&0xffffffff, sum>>32|1
+	size := uint64(len(l.Bits)) * 64
+	for i := uint64(0); i < uint64(l.Hashes); i++ {
+		if !fn((h1 + i*h2) % size) {
+			return false
+		}
+	}
+	return true
+}
+
+// add sets the bits of a request ID
+func (l *bloomLayer) add(id string) {
+	l.positions(id, func(bit uint64) bool {
+		l.Bits[bit/64] |= 1 << (bit % 64)
+		return true
+	})
+	l.Count++
+}
+
+// mayContain reports whether every bit of a request ID is set
+func (l *bloomLayer) mayContain(id string) bool {
+	return l.positions(id, func(bit uint64) bool {
+		return l.Bits[bit/64]&(1<<(bit%64)) != 0
+	})
+}
+
+// add adds a request ID to the last layer, first adding a layer if it is full
+func (f *seenFilter) add(id string) {
+	if n := len(f.Layers); n == 0 || f.Layers[n-1].Count >= f.Layers[n-1].Capacity {
+		capacity := int64(seenInitialCapacity)
+		if n > 0 {
+			capacity = f.Layers[n-1].Capacity * 2
+		}
+		f.Layers = append(f.Layers, newBloomLayer(capacity))
+	}
+	f.Layers[len(f.Layers)-1].add(id)
+}
+
+// mayContain reports whether any layer may hold a request ID
+func (f *seenFilter) mayContain(id string) bool {
+	for _, l := range f.Layers {
+		if l.mayContain(id) {
+			return true
+		}
+	}
+	return false
+}
+
+// OpenSeenRequests loads the request ID filter of a Web ACL's directory and adds the
+// log files of its manifest it does not cover yet, reading their records with
+// forEach. The first call on a directory reads every log file. Callers hold the
+// directory's lock.
+func OpenSeenRequests(aclDir string, forEach RecordFunc) (*SeenRequests, error) {
+	files, _, err := LoadManifest(aclDir)
+	if err != nil {
+		return nil, err
+	}
+	s := &SeenRequests{
+		aclDir:  aclDir,
+		forEach: forEach,
+		files:   files,
+		exact:   make(map[string]map[string]bool),
+		staged:  make(map[string]map[string]bool),
+	}
+	if err := s.load(); err != nil {
+		return nil, err
+	}
+
+	// Forget files no longer in the manifest; their request IDs stay in the filter,
+	// which only costs an exact check should they come up
+	for file := range s.filter.Files {
+		if _, ok := files[file]; !ok {
+			delete(s.filter.Files, file)
+			s.dirty = true
+		}
+	}
+	paths := make([]string, 0, len(files))
+	for file, entry := range files {
+		if s.filter.Files[file] != entry.SHA256 {
+			paths = append(paths, file)
+		}
+	}
+	sort.Strings(paths)
+	for _, file := range paths {
+		err := s.forEachRequestID(file, func(id string) {
+			s.filter.add(id)
+		})
+		if err != nil {
+			return nil, err
+		}
+		s.filter.Files[file] = files[file].SHA256
+		s.dirty = true
+	}
+	return s, nil
+}
+
+// load reads the filter file, starting an empty filter if there is none or it is of
+// another version
+func (s *SeenRequests) load() error {
+	s.filter = seenFilter{Version: seenRequestsVersion, Files: make(map[string]string)}
+	data, err := os.ReadFile(filepath.Join(s.aclDir, SeenRequestsFileName))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to read request ID filter: %w", err)
+	}
+	var filter seenFilter
+	if err := gob.NewDecoder(bytes.NewReader(data)).Decode(&filter); err != nil || filter.Version != seenRequestsVersion {
+		return nil // Rebuilt from the log files
+	}
+	if filter.Files == nil {
+		filter.Files = make(map[string]string)
+	}
+	s.filter = filter
+	return nil
+}
+
+// Save writes the filter back to the directory if it changed
+func (s *SeenRequests) Save() error {
+	if !s.dirty {
+		return nil
+	}
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(&s.filter); err != nil {
+		return fmt.Errorf("failed to encode request ID filter: %w", err)
+	}
+	if err := WriteFileAtomic(filepath.Join(s.aclDir, SeenRequestsFileName), buf.Bytes()); err != nil {
+		return fmt.Errorf("failed to write request ID filter: %w", err)
+	}
+	s.dirty = false
+	return nil
+}
+
+// forEachRequestID calls fn with the request ID of every record of a log file of the
+// manifest that has one
+func (s *SeenRequests) forEachRequestID(file string, fn func(id string)) error {
+	err := s.forEach(filepath.Join(s.aclDir, filepath.FromSlash(file)), func(timestamp int64, raw []byte) error {
+		if id := requestIDOf(raw); id != "" {
+			fn(id)
+		}
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("failed to read the request IDs of %s: %w", file, err)
+	}
+	return nil
+}
+
+// requestIDOf returns the request ID of a raw WAF record, or "" if it has none
+func requestIDOf(raw []byte) string {
+	var record struct {
+		HTTPRequest struct {
+			RequestID string `json:"requestId"`
+		} `json:"httpRequest"`
+	}
+	if json.Unmarshal(raw, &record) != nil {
+		return ""
+	}
+	return record.HTTPRequest.RequestID
+}
+
+// seen reports whether a record with a request ID is stored in a partition directory
+// already, or was staged for it by the current ingest, and otherwise stages it.
+// Records without a request ID are never seen.
+func (s *SeenRequests) seen(dir, id string) (bool, error) {
+	if id == "" {
+		return false, nil
+	}
+	s.Checked++
+	staged := s.staged[dir]
+	if staged[id] {
+		s.Duplicates++
+		return true, nil
+	}
+	if s.filter.mayContain(id) {
+		s.Candidates++
+		exact, err := s.partitionIDs(dir)
+		if err != nil {
+			return false, err
+		}
+		if exact[id] {
+			s.Duplicates++
+			return true, nil
+		}
+	}
+	if staged == nil {
+		staged = make(map[string]bool)
+		s.staged[dir] = staged
+	}
+	staged[id] = true
+	return false, nil
+}
+
+// partitionIDs returns the request IDs of the log files of a partition directory,
+// reading them on first use
+func (s *SeenRequests) partitionIDs(dir string) (map[string]bool, error) {
+	if ids, ok := s.exact[dir]; ok {
+		return ids, nil
+	}
+	if len(s.exact) >= maxExactPartitions {
+		clear(s.exact)
+	}
+	ids := make(map[string]bool)
+	for file := range s.files {
+		if path.Dir(file) != dir {
+			continue
+		}
+		if err := s.forEachRequestID(file, func(id string) { ids[id] = true }); err != nil {
+			return nil, err
+		}
+	}
+	s.exact[dir] = ids
+	return ids, nil
+}
+
+// commit adds the request IDs staged by an ingest to the filter, once the log files
+// written with them are recorded in the manifest
+func (s *SeenRequests) commit(written []ManifestEntry) {
+	for dir, staged := range s.staged {
+		exact := s.exact[dir]
+		for id := range staged {
+			s.filter.add(id)
+			if exact != nil {
+				exact[id] = true
+			}
+		}
+	}
+	for _, entry := range written {
+		s.files[entry.Path] = entry
+		s.filter.Files[entry.Path] = entry.SHA256
+	}
+	if len(s.staged) > 0 || len(written) > 0 {
+		s.dirty = true
+	}
+	clear(s.staged)
+}
+
+// discard forgets the request IDs staged by an ingest that wrote nothing
+func (s *SeenRequests) discard() {
+	clear(s.staged)
+}
@@ -78,59 +78,73 @@ func (sm *StorageManager) EnsureDirExists(dirPath string) error {
 	return nil
 }
 
-// GetLogFilePath generates the appropriate path for a WAF log file.
-func (sm *StorageManager) GetLogFilePath(profileName, wafName string, timestamp time.Time) string {
-	// Create directory structure: BaseDirectory/profile/waf/YYYY-MM-DD/HH/
-	datePath := timestamp.Format("2006-01-02")
-	hourPath := timestamp.Format("15")
-
-	fileName := fmt.Sprintf("waf_log_%s.json", timestamp.Format("20060102_150405"))
-	if sm.config.CompressionEnabled {
-		fileName += ".gz"
-	}
+// WebACLDir returns the directory of a Web ACL's logs: BaseDirectory/profile/waf/
+func (sm *StorageManager) WebACLDir(profileName, wafName string) string {
+	return filepath.Join(sm.config.BaseDirectory, profileName, wafName)
+}
 
+// GetLogFilePath returns the path of a retrieved log file in the layout shared by
+// every log source: BaseDirectory/profile/waf/YYYY/MM/DD/HH/fileName, in the UTC hour
+// of timestamp. This is the hourly layout of PartitionPath, so S3 deliveries and
+// CloudWatch Logs query results are read the same way.
+func (sm *StorageManager) GetLogFilePath(profileName, wafName string, timestamp time.Time, fileName string) string {
+	timestamp = timestamp.UTC()
 	return filepath.Join(
-		sm.config.BaseDirectory,
-		profileName,
-		wafName,
-		datePath,
-		hourPath,
+		sm.WebACLDir(profileName, wafName),
+		timestamp.Format("2006"),
+		timestamp.Format("01"),
+		timestamp.Format("02"),
+		timestamp.Format("15"),
 		fileName,
 	)
 }
 
-// WriteLogFile writes log content to a file, with optional compression.
+// LogFileName returns the name of a log file as written by WriteLogFile: name with a
+// .gz extension if compression is enabled.
+func (sm *StorageManager) LogFileName(name string) string {
+	if sm.config.CompressionEnabled {
+		return name + ".gz"
+	}
+	return name
+}
+
+// WriteLogFile writes log content to a file, with optional compression. The content
+// goes to a temporary file that only replaces logPath once it is complete.
 func (sm *StorageManager) WriteLogFile(logPath string, content []byte) error {
 	// Ensure the directory exists
 	if err := sm.EnsureDirExists(filepath.Dir(logPath)); err != nil {
 		return fmt.Errorf("failed to create log directory: %w", err)
 	}
 
-	// Create the file
-	file, err := os.Create(logPath)
+	// Create the temporary file
+	file, err := CreateAtomic(logPath)
 	if err != nil {
 		return fmt.Errorf("failed to create log file: %w", err)
 	}
-	defer file.Close()
-
-	var writer io.Writer = file
+	defer file.Abort()
 
-	// If compression is enabled, wrap the file writer in a gzip writer
+	// If compression is enabled, write through a gzip writer, whose close flushes the
+	// rest of the compressed stream
 	if sm.config.CompressionEnabled {
 		gw, err := gzip.NewWriterLevel(file, sm.config.CompressionLevel)
 		if err != nil {
 			return fmt.Errorf("failed to create gzip writer: %w", err)
 		}
-		defer gw.Close()
-		writer = gw
+		if _, err := gw.Write(content); err != nil {
+			return fmt.Errorf("failed to write log content: %w", err)
+		}
+		if err := gw.Close(); err != nil {
+			return fmt.Errorf("failed to compress log content: %w", err)
+		}
+		return file.Commit()
 	}
 
 	// Write the content
-	if _, err := writer.Write(content); err != nil {
+	if _, err := file.Write(content); err != nil {
 		return fmt.Errorf("failed to write log content: %w", err)
 	}
 
-	return nil
+	return file.Commit()
 }
 
 // CleanupOldLogs removes log files older than the retention period.
@@ -169,33 +183,33 @@ func (sm *StorageManager) IsCompressed(filename string) bool {
 
 // ReadLogFile reads a log file, assuming .gz files are compressed.
 func (sm *StorageManager) ReadLogFile(filePath string) ([]byte, error) {
-    file, err := os.Open(filePath)
-    if err != nil {
-        return nil, fmt.Errorf("failed to open log file: %w", err)
-    }
-    defer file.Close()
-
-    // If the file has a .gz extension, assume it’s compressed and decompress it for reading
-    if sm.IsCompressed(filePath) {
-        gr, err := gzip.NewReader(file)
-        if err != nil {
-            return nil, fmt.Errorf("file %s has a .gz extension but is not a valid gzip file: %w", filePath, err)
-        }
-        defer gr.Close()
-        // Read the decompressed content (for reading purposes only, not storage)
-        content, err := io.ReadAll(gr)
-        if err != nil {
-            return nil, fmt.Errorf("failed to read decompressed log content: %w", err)
-        }
-        return content, nil
-    }
-
-    // For non-.gz files (unlikely in this context), read directly
-    content, err := io.ReadAll(file)
-    if err != nil {
-        return nil, fmt.Errorf("failed to read log content: %w", err)
-    }
-    return content, nil
+	file, err := os.Open(filePath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open log file: %w", err)
+	}
+	defer file.Close()
+
+	// If the file has a .gz extension, assume it’s compressed and decompress it for reading
+	if sm.IsCompressed(filePath) {
+		gr, err := gzip.NewReader(file)
+		if err != nil {
+			return nil, fmt.Errorf("file %s has a .gz extension but is not a valid gzip file: %w", filePath, err)
+		}
+		defer gr.Close()
+		// Read the decompressed content (for reading purposes only, not storage)
+		content, err := io.ReadAll(gr)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read decompressed log content: %w", err)
+		}
+		return content, nil
+	}
+
+	// For non-.gz files (unlikely in this context), read directly
+	content, err := io.ReadAll(file)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read log content: %w", err)
+	}
+	return content, nil
 }
 
 // ListLogFiles returns a list of log files in the storage directory.
@@ -220,4 +234,4 @@ func (sm *StorageManager) ListLogFiles(profileName, wafName string) ([]string, e
 	}
 
 	return files, nil
-}
\ No newline at end of file
+}
@@ -0,0 +1,102 @@
+package storage
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// LogicalSize returns the uncompressed size of a log file: the size of its content
+// for a .gz file, whose every gzip member is read, and its size on disk otherwise
+func LogicalSize(file string) (int64, error) {
+	if filepath.Ext(file) != ".gz" {
+		info, err := os.Stat(file)
+		if err != nil {
+			return 0, fmt.Errorf("failed to stat %s: %w", file, err)
+		}
+		return info.Size(), nil
+	}
+	f, err := os.Open(file)
+	if err != nil {
+		return 0, fmt.Errorf("failed to open %s: %w", file, err)
+	}
+	defer f.Close()
+	gr, err := gzip.NewReader(bufio.NewReader(f))
+	if err != nil {
+		return 0, fmt.Errorf("file %s has a .gz extension but is not a valid gzip file: %w", file, err)
+	}
+	defer gr.Close()
+	size, err := io.Copy(io.Discard, gr)
+	if err != nil {
+		return 0, fmt.Errorf("failed to decompress %s: %w", file, err)
+	}
+	return size, nil
+}
+
+// CountRecords returns the number of records in a log file: its non-blank lines,
+// which is one WAF record each in S3 deliveries and retrieved CloudWatch Logs alike
+func CountRecords(file string) (int64, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return 0, fmt.Errorf("failed to open %s: %w", file, err)
+	}
+	defer f.Close()
+	var src io.Reader = f
+	if filepath.Ext(file) == ".gz" {
+		gr, err := gzip.NewReader(bufio.NewReader(f))
+		if err != nil {
+			return 0, fmt.Errorf("file %s has a .gz extension but is not a valid gzip file: %w", file, err)
+		}
+		defer gr.Close()
+		src = gr
+	}
+
+	reader := bufio.NewReaderSize(src, 64*1024)
+	var records int64
+	content := false // Whether the current line, which may span several reads, has any
+	for {
+		line, err := reader.ReadSlice('\n')
+		if len(bytes.TrimSpace(line)) > 0 {
+			content = true
+		}
+		if err == bufio.ErrBufferFull {
+			continue
+		}
+		if err != nil && err != io.EOF {
+			return 0, fmt.Errorf("failed to read %s: %w", file, err)
+		}
+		if content {
+			records++
+			content = false
+		}
+		if err == io.EOF {
+			return records, nil
+		}
+	}
+}
+
+// FileDay returns the day a log file holds, given its slash-separated path relative
+// to the Web ACL's directory: from its partition directory in any layout, or for a
+// CloudWatch Logs file retrieved into the Web ACL's directory itself by earlier
+// versions, from the chunk start in its name, e.g.
+// waf_logs_20250131_140000_to_20250131_150000.json
+func FileDay(rel string) (time.Time, bool) {
+	rel = strings.ReplaceAll(rel, "\\", "/")
+	if _, start, _, ok := ParsePartition(path.Dir(rel)); ok {
+		return start.Truncate(24 * time.Hour), true
+	}
+	name := path.Base(rel)
+	if strings.HasPrefix(name, "waf_logs_") && strings.Contains(name, "_to_") {
+		if t, err := time.Parse("20060102_150405", strings.SplitN(strings.TrimPrefix(name, "waf_logs_"), "_to_", 2)[0]); err == nil {
+			return t.Truncate(24 * time.Hour), true
+		}
+	}
+	return time.Time{}, false
+}
@@ -0,0 +1,150 @@
+package telemetry
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"time"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlpmetric/otlpmetrichttp"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/metric"
+	sdkmetric "go.opentelemetry.io/otel/sdk/metric"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// ServiceName is the default OpenTelemetry service name of the tool; OTEL_SERVICE_NAME overrides it
+const ServiceName = "waf-log-retriever"
+
+// instrumentationName identifies the tool's spans and metrics
+const instrumentationName = "waf-log-retriever"
+
+// Run phases
+const (
+	PhaseRetrieve = "retrieve"
+	PhaseParse    = "parse"
+	PhaseAnalyze  = "analyze"
+)
+
+// Setup installs OTLP/HTTP trace and metric exporters when an endpoint is given, either
+// as endpointURL (e.g. http://collector:4318) or through OTEL_EXPORTER_OTLP_ENDPOINT.
+// Without one, spans and metrics are no-ops. The returned function flushes and stops
+// the exporters and must be called before the process exits.
+func Setup(ctx context.Context, endpointURL string) (func(context.Context) error, error) {
+	if endpointURL == "" && os.Getenv("OTEL_EXPORTER_OTLP_ENDPOINT") == "" {
+		return func(context.Context) error { return nil }, nil
+	}
+
+	res, err := resource.New(ctx,
+		resource.WithAttributes(attribute.String("service.name", ServiceName)),
+		resource.WithFromEnv(), // OTEL_SERVICE_NAME and OTEL_RESOURCE_ATTRIBUTES
+		resource.WithTelemetrySDK(),
+		resource.WithHost(),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create telemetry resource: %w", err)
+	}
+
+	var traceOptions []otlptracehttp.Option
+	var metricOptions []otlpmetrichttp.Option
+	if endpointURL != "" {
+		traceOptions = append(traceOptions, otlptracehttp.WithEndpointURL(endpointURL))
+		metricOptions = append(metricOptions, otlpmetrichttp.WithEndpointURL(endpointURL))
+	}
+
+	traceExporter, err := otlptracehttp.New(ctx, traceOptions...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create OTLP trace exporter: %w", err)
+	}
+	metricExporter, err := otlpmetrichttp.New(ctx, metricOptions...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create OTLP metric exporter: %w", err)
+	}
+
+	tracerProvider := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(traceExporter),
+		sdktrace.WithResource(res),
+	)
+	meterProvider := sdkmetric.NewMeterProvider(
+		sdkmetric.WithReader(sdkmetric.NewPeriodicReader(metricExporter)),
+		sdkmetric.WithResource(res),
+	)
+	otel.SetTracerProvider(tracerProvider)
+	otel.SetMeterProvider(meterProvider)
+
+	return func(ctx context.Context) error {
+		return errors.Join(tracerProvider.Shutdown(ctx), meterProvider.Shutdown(ctx))
+	}, nil
+}
+
+// Shutdown calls a shutdown function returned by Setup with a bounded timeout
+func Shutdown(shutdown func(context.Context) error) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if err := shutdown(ctx); err != nil {
+		return fmt.Errorf("failed to flush telemetry: %w", err)
+	}
+	return nil
+}
+
+// Phase is a traced and measured run phase
+type Phase struct {
+	name  string
+	start time.Time
+	span  trace.Span
+}
+
+// StartPhase starts a span for a run phase; End must be called when the phase finishes
+func StartPhase(ctx context.Context, name string, attrs ...attribute.KeyValue) (context.Context, *Phase) {
+	ctx, span := otel.Tracer(instrumentationName).Start(ctx, name, trace.WithAttributes(attrs...))
+	return ctx, &Phase{name: name, start: time.Now(), span: span}
+}
+
+// SetAttributes adds attributes, such as file and record counts, to the phase's span
+func (p *Phase) SetAttributes(attrs ...attribute.KeyValue) {
+	p.span.SetAttributes(attrs...)
+}
+
+// AddFiles counts log files handled by the phase
+func (p *Phase) AddFiles(ctx context.Context, n int) {
+	filesCounter.Add(ctx, int64(n), metric.WithAttributes(attribute.String("phase", p.name)))
+}
+
+// AddRecords counts log records handled by the phase
+func (p *Phase) AddRecords(ctx context.Context, n int) {
+	recordsCounter.Add(ctx, int64(n), metric.WithAttributes(attribute.String("phase", p.name)))
+}
+
+// End ends the phase's span and records its duration; err marks the phase as failed
+func (p *Phase) End(ctx context.Context, err error) {
+	status := "ok"
+	if err != nil {
+		status = "error"
+		p.span.RecordError(err)
+		p.span.SetStatus(codes.Error, err.Error())
+	}
+	durationHistogram.Record(ctx, time.Since(p.start).Seconds(), metric.WithAttributes(
+		attribute.String("phase", p.name),
+		attribute.String("status", status),
+	))
+	p.span.End()
+}
+
+// Instruments are created against the global meter provider, which forwards to the
+// provider installed by Setup
+var (
+	meter = otel.Meter(instrumentationName)
+
+	durationHistogram, _ = meter.Float64Histogram("waf_log_retriever.phase.duration",
+		metric.WithDescription("Duration of a run phase"), metric.WithUnit("s"))
+	filesCounter, _ = meter.Int64Counter("waf_log_retriever.files",
+		metric.WithDescription("Log files handled"), metric.WithUnit("{file}"))
+	recordsCounter, _ = meter.Int64Counter("waf_log_retriever.records",
+		metric.WithDescription("Log records handled"), metric.WithUnit("{record}"))
+)
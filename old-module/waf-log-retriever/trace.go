@@ -0,0 +1,190 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"text/tabwriter"
+	"time"
+
+	"waf-log-retriever/analysis"
+)
+
+// runTrace reconstructs the context of a single request for forensic review: the
+// record itself, the rules it matched, the client's neighboring requests and the
+// matching ALB access log lines
+func runTrace(args []string) int {
+	fs := flag.NewFlagSet("trace", flag.ExitOnError)
+	outputDir := fs.String("output-dir", "../logs/raw", "Directory containing retrieved logs")
+	profile := fs.String("profile", "", "AWS profile name the logs were retrieved with")
+	webACL := fs.String("web-acl", "", "Name of the Web ACL whose logs to search")
+	requestID := fs.String("request-id", "", "Request ID of the request to trace")
+	ip := fs.String("ip", "", "Client IP of the request to trace, with -around")
+	around := fs.String("around", "", "Time of the request to trace (YYYY-MM-DDTHH:mm:ssZ or epoch milliseconds), with -ip")
+	window := fs.Duration("window", 5*time.Minute, "Time on either side of the request to show the client's requests for")
+	context := fs.Int("context", 20, "Most of the client's requests to show before and after the request")
+	albLogs := fs.String("alb-logs", "", "Directory of ALB access logs to correlate the request with (optional)")
+	jsonOutput := fs.Bool("json", false, "Print the trace as JSON")
+	fs.Parse(args)
+
+	if *profile == "" || *webACL == "" || (*requestID == "") == (*ip == "" || *around == "") {
+		fmt.Println("trace requires -profile, -web-acl and either -request-id or -ip with -around")
+		fs.Usage()
+		return 2
+	}
+	if *window <= 0 || *context < 0 {
+		fmt.Println("trace requires a positive -window and a non-negative -context")
+		return 2
+	}
+	var at time.Time
+	if *around != "" {
+		var err error
+		if at, err = parseTraceTime(*around); err != nil {
+			fmt.Printf("Invalid -around: %v\n", err)
+			return 2
+		}
+	}
+
+	aclDir := filepath.Join(*outputDir, *profile, *webACL)
+	files, err := analysis.ListLogFiles(aclDir)
+	if err != nil {
+		fmt.Printf("%v\n", err)
+		return 1
+	}
+
+	var record *analysis.Record
+	var raw []byte
+	if *requestID != "" {
+		record, raw, err = analysis.FindRequest(files, *requestID)
+	} else {
+		record, raw, err = analysis.FindNearest(aclDir, files, *ip, at, *window)
+	}
+	if err != nil {
+		fmt.Printf("%v\n", err)
+		return 1
+	}
+	if record == nil {
+		if *requestID != "" {
+			fmt.Printf("No request with ID %s in %s\n", *requestID, aclDir)
+		} else {
+			fmt.Printf("No request from %s within %s of %s in %s\n", *ip, *window, at.Format(time.RFC3339), aclDir)
+		}
+		return 1
+	}
+
+	trace, err := analysis.BuildTrace(aclDir, files, record, raw, *window, *context)
+	if err != nil {
+		fmt.Printf("%v\n", err)
+		return 1
+	}
+	if *albLogs != "" {
+		if trace.ALBLines, err = analysis.FindALBLines(*albLogs, record, 2*time.Second); err != nil {
+			fmt.Printf("%v\n", err)
+			return 1
+		}
+	}
+
+	if *jsonOutput {
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		if err := encoder.Encode(trace); err != nil {
+			fmt.Printf("Failed to write trace: %v\n", err)
+			return 1
+		}
+		return 0
+	}
+	printTrace(trace, *albLogs != "")
+	return 0
+}
+
+// parseTraceTime parses a time as parseTime does, or as epoch milliseconds like the
+// timestamp of a WAF record
+func parseTraceTime(s string) (time.Time, error) {
+	if ms, err := strconv.ParseInt(s, 10, 64); err == nil {
+		return time.UnixMilli(ms).UTC(), nil
+	}
+	return parseTime(s)
+}
+
+// printTrace prints a trace for reading in a terminal
+func printTrace(t *analysis.Trace, albSearched bool) {
+	r := t.Record
+	fmt.Printf("Request %s from %s (%s) at %s\n", r.HTTPRequest.RequestID, r.HTTPRequest.ClientIP, r.HTTPRequest.Country,
+		r.Time().Format("2006-01-02T15:04:05.000Z"))
+	fmt.Printf("%s %s %s\n", r.HTTPRequest.HTTPMethod, r.Host(), requestLine(r.HTTPRequest.URI, r.HTTPRequest.Args))
+	fmt.Printf("Action %s by %s (%s)\n", r.Action, r.TerminatingRuleID, r.TerminatingRuleType)
+
+	fmt.Println("\nMatched rules:")
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	for _, rule := range t.Rules {
+		group := rule.RuleGroup
+		if group == "" {
+			group = "-"
+		}
+		fmt.Fprintf(w, "  %s\t%s\t%s\t%s\n", rule.Match, rule.RuleID, rule.Action, group)
+	}
+	w.Flush()
+	if len(t.Labels) > 0 {
+		fmt.Println("\nLabels:")
+		for _, l := range t.Labels {
+			fmt.Printf("  %s\n", l)
+		}
+	}
+
+	fmt.Println("\nRecord:")
+	var pretty bytes.Buffer
+	if err := json.Indent(&pretty, t.Raw, "  ", "  "); err == nil {
+		fmt.Printf("  %s\n", pretty.String())
+	} else {
+		fmt.Printf("  %s\n", t.Raw)
+	}
+
+	fmt.Printf("\nRequests from %s between %s and %s:\n", r.HTTPRequest.ClientIP,
+		t.From.Format("15:04:05"), t.To.Format("15:04:05 on 2006-01-02"))
+	if t.Before > 0 {
+		fmt.Printf("  ... %d earlier requests\n", t.Before)
+	}
+	w = tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	for _, e := range t.Timeline {
+		marker := " "
+		if e.Focus {
+			marker = ">"
+		}
+		fmt.Fprintf(w, "%s %s\t%s\t%s\t%s\t%s\n", marker, e.Time.Format("15:04:05.000"), e.Action, e.Method,
+			truncate(requestLine(e.URI, e.Args), 80), e.Rule)
+	}
+	w.Flush()
+	if t.After > 0 {
+		fmt.Printf("  ... %d later requests\n", t.After)
+	}
+
+	if albSearched {
+		fmt.Println("\nALB access log:")
+		if len(t.ALBLines) == 0 {
+			fmt.Println("  No matching line")
+		}
+		for _, line := range t.ALBLines {
+			fmt.Printf("  %s\n", line)
+		}
+	}
+}
+
+// requestLine joins a URI and its query string
+func requestLine(uri, args string) string {
+	if args == "" {
+		return uri
+	}
+	return uri + "?" + args
+}
+
+// truncate shortens a string to at most n runes
+func truncate(s string, n int) string {
+	if r := []rune(s); len(r) > n {
+		return string(r[:n-3]) + "..."
+	}
+	return s
+}
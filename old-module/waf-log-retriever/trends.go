@@ -0,0 +1,214 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"waf-log-retriever/analysis"
+	"waf-log-retriever/trends"
+	"waf-log-retriever/workspace"
+)
+
+// trendsCommands maps the trends subcommands to their entry points
+var trendsCommands = map[string]func(args []string) int{
+	"compare": runTrendsCompare,
+	"push":    runTrendsPush,
+}
+
+// runTrends dispatches the trends subcommands, which share anonymized engagement
+// profiles through a central database and compare against them
+func runTrends(args []string) int {
+	if len(args) > 0 {
+		if command, ok := trendsCommands[args[0]]; ok {
+			return command(args[1:])
+		}
+	}
+	names := make([]string, 0, len(trendsCommands))
+	for name := range trendsCommands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	fmt.Printf("trends requires a subcommand: %s\n", strings.Join(names, ", "))
+	return 2
+}
+
+// trendsFlags are the flags selecting an engagement's profile and the trend database
+type trendsFlags struct {
+	outputDir, profile, webACL, result *string
+	keyFile, engagementID, industry    *string
+	database                           *string
+	timeout                            *time.Duration
+}
+
+func addTrendsFlags(fs *flag.FlagSet) *trendsFlags {
+	return &trendsFlags{
+		outputDir:    fs.String("output-dir", "../logs/raw", "Directory containing retrieved logs"),
+		profile:      fs.String("profile", "", "AWS profile name the logs were retrieved with"),
+		webACL:       fs.String("web-acl", "", "Name of the Web ACL whose analysis result to profile"),
+		result:       fs.String("result", "", "Analysis result to profile (default: the latest for the Web ACL)"),
+		keyFile:      fs.String("hash-key", "", fmt.Sprintf("File holding the secret key the engagement is identified by (at least %d bytes)", analysis.MinHashKeyBytes)),
+		engagementID: fs.String("engagement", "", "Engagement ID telling engagements of the same Web ACL apart (default: the ID in the workspace)"),
+		industry:     fs.String("industry", "", "Industry of the customer, e.g. retail or finance"),
+		database:     fs.String("db", "", "Trend database: a postgres:// URL or a SQLite file (default: $"+trends.DatabaseEnv+")"),
+		timeout:      fs.Duration("timeout", time.Minute, "Time limit of the database operations"),
+	}
+}
+
+// load derives the anonymized profile of the selected analysis result
+func (f *trendsFlags) load(command string, fs *flag.FlagSet) (*trends.Profile, int) {
+	if *f.result == "" && (*f.profile == "" || *f.webACL == "") || *f.keyFile == "" {
+		fmt.Printf("%s requires -profile and -web-acl, or -result, and -hash-key\n", command)
+		fs.Usage()
+		return nil, 2
+	}
+	resultPath := *f.result
+	engagementID := *f.engagementID
+	if *f.profile != "" && *f.webACL != "" {
+		aclDir := filepath.Join(*f.outputDir, *f.profile, *f.webACL)
+		if resultPath == "" {
+			var err error
+			if resultPath, err = analysis.LatestResultPath(aclDir); err != nil {
+				fmt.Printf("%v\n", err)
+				return nil, 1
+			}
+			if resultPath == "" {
+				fmt.Printf("No analysis results found in %s; run analyze first\n", aclDir)
+				return nil, 1
+			}
+		}
+		if engagementID == "" {
+			ws, err := workspace.Open(aclDir, *f.profile, *f.webACL)
+			if err != nil {
+				fmt.Printf("%v\n", err)
+				return nil, 1
+			}
+			if ws.Engagement != nil {
+				engagementID = ws.Engagement.ID
+			}
+		}
+	}
+	result, err := analysis.LoadResult(resultPath)
+	if err != nil {
+		fmt.Printf("%v\n", err)
+		return nil, 1
+	}
+	key, err := readHashKey(*f.keyFile)
+	if err != nil {
+		fmt.Printf("%v\n", err)
+		return nil, 1
+	}
+	p, err := trends.FromResult(result, key, engagementID, *f.industry)
+	if err != nil {
+		fmt.Printf("Failed to profile %s: %v\n", resultPath, err)
+		return nil, 1
+	}
+	return p, 0
+}
+
+// open connects to the selected trend database
+func (f *trendsFlags) open(ctx context.Context, command string) (*trends.Store, int) {
+	dsn := *f.database
+	if dsn == "" {
+		dsn = os.Getenv(trends.DatabaseEnv)
+	}
+	if dsn == "" {
+		fmt.Printf("%s requires -db or $%s\n", command, trends.DatabaseEnv)
+		return nil, 2
+	}
+	store, err := trends.Open(ctx, dsn)
+	if err != nil {
+		fmt.Printf("%v\n", err)
+		return nil, 1
+	}
+	return store, 0
+}
+
+// runTrendsPush pushes the anonymized profile of an engagement to the trend database
+func runTrendsPush(args []string) int {
+	fs := flag.NewFlagSet("trends push", flag.ExitOnError)
+	f := addTrendsFlags(fs)
+	dryRun := fs.Bool("dry-run", false, "Print the profile that would be pushed instead of pushing it")
+	fs.Parse(args)
+
+	p, code := f.load("trends push", fs)
+	if p == nil {
+		return code
+	}
+	if *dryRun {
+		data, err := json.MarshalIndent(p, "", "  ")
+		if err != nil {
+			fmt.Printf("Failed to encode profile: %v\n", err)
+			return 1
+		}
+		fmt.Println(string(data))
+		return 0
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), *f.timeout)
+	defer cancel()
+	store, code := f.open(ctx, "trends push")
+	if store == nil {
+		return code
+	}
+	defer store.Close()
+	if err := store.Push(ctx, p); err != nil {
+		fmt.Printf("%v\n", err)
+		return 1
+	}
+	fmt.Printf("Profile %s pushed: %d requests, %d attacks in %d categories from %d countries\n",
+		p.ID, p.Requests, p.Attacks, len(p.Categories), len(p.Countries))
+	return 0
+}
+
+// runTrendsCompare compares the profile of an engagement against the profiles of
+// the trend database
+func runTrendsCompare(args []string) int {
+	fs := flag.NewFlagSet("trends compare", flag.ExitOnError)
+	f := addTrendsFlags(fs)
+	minPeers := fs.Int("min-peers", 5, "Fewest other engagements a baseline is shown for, so no single customer's profile can be read from it")
+	fs.Parse(args)
+
+	p, code := f.load("trends compare", fs)
+	if p == nil {
+		return code
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), *f.timeout)
+	defer cancel()
+	store, code := f.open(ctx, "trends compare")
+	if store == nil {
+		return code
+	}
+	defer store.Close()
+	profiles, err := store.Profiles(ctx, p.Industry)
+	if err != nil {
+		fmt.Printf("%v\n", err)
+		return 1
+	}
+
+	comparisons, peers := trends.Compare(p, profiles)
+	baseline := "all industries"
+	if p.Industry != "" {
+		baseline = "the " + p.Industry + " industry"
+	}
+	if peers < *minPeers {
+		fmt.Printf("Only %d other engagements in %s; a baseline needs at least %d (-min-peers)\n", peers, baseline, *minPeers)
+		return 1
+	}
+	fmt.Printf("Compared against %d engagements in %s\n\n", peers, baseline)
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "METRIC\tTHIS ENGAGEMENT\tMEDIAN\tMIDDLE HALF\tPERCENTILE\t")
+	for _, c := range comparisons {
+		fmt.Fprintf(w, "%s\t%.1f%%\t%.1f%%\t%.1f%% - %.1f%%\t%.0f\t\n",
+			c.Name, 100*c.Value, 100*c.Median, 100*c.P25, 100*c.P75, c.Percentile)
+	}
+	w.Flush()
+	return 0
+}
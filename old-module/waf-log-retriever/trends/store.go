@@ -0,0 +1,142 @@
+package trends
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	_ "github.com/lib/pq"  // Postgres driver
+	_ "modernc.org/sqlite" // SQLite driver, in pure Go so that builds need no cgo
+)
+
+// DatabaseEnv names the environment variable holding the trend database, so that
+// credentials in a Postgres URL stay off the command line
+const DatabaseEnv = "WAF_TRENDS_DB"
+
+// schema creates the profile table, in SQL both Postgres and SQLite accept. The
+// profile is kept whole as JSON; the other columns are for filtering and auditing.
+const schema = `CREATE TABLE IF NOT EXISTS engagement_profiles (
+	id             TEXT PRIMARY KEY,
+	schema_version INTEGER NOT NULL,
+	key_id         TEXT NOT NULL,
+	industry       TEXT NOT NULL,
+	period_start   TIMESTAMP NOT NULL,
+	period_end     TIMESTAMP NOT NULL,
+	pushed_at      TIMESTAMP NOT NULL,
+	profile        TEXT NOT NULL
+)`
+
+// Store is a trend database
+type Store struct {
+	db       *sql.DB
+	postgres bool
+}
+
+// Open connects to a trend database, creating its table if needed. A
+// postgres:// or postgresql:// URL selects Postgres; anything else is a SQLite
+// database file, optionally prefixed with sqlite:// or sqlite:.
+func Open(ctx context.Context, dsn string) (*Store, error) {
+	driver, source := "sqlite", dsn
+	switch {
+	case strings.HasPrefix(dsn, "postgres://"), strings.HasPrefix(dsn, "postgresql://"):
+		driver = "postgres"
+	case strings.HasPrefix(dsn, "sqlite://"):
+		source = strings.TrimPrefix(dsn, "sqlite://")
+	case strings.HasPrefix(dsn, "sqlite:"):
+		source = strings.TrimPrefix(dsn, "sqlite:")
+	}
+	if source == "" {
+		return nil, fmt.Errorf("no trend database in %q", dsn)
+	}
+	db, err := sql.Open(driver, source)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open trend database: %w", err)
+	}
+	s := &Store{db: db, postgres: driver == "postgres"}
+	if _, err := db.ExecContext(ctx, schema); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("failed to set up trend database: %w", err)
+	}
+	return s, nil
+}
+
+// Close closes the connection to the database
+func (s *Store) Close() error {
+	return s.db.Close()
+}
+
+// Push adds a profile to the database, replacing an earlier push of it
+func (s *Store) Push(ctx context.Context, p *Profile) error {
+	data, err := json.Marshal(p)
+	if err != nil {
+		return fmt.Errorf("failed to encode profile: %w", err)
+	}
+	_, err = s.db.ExecContext(ctx, s.rebind(`INSERT INTO engagement_profiles
+	(id, schema_version, key_id, industry, period_start, period_end, pushed_at, profile)
+	VALUES (?, ?, ?, ?, ?, ?, ?, ?)
+	ON CONFLICT (id) DO UPDATE SET
+		schema_version = excluded.schema_version, key_id = excluded.key_id, industry = excluded.industry,
+		period_start = excluded.period_start, period_end = excluded.period_end,
+		pushed_at = excluded.pushed_at, profile = excluded.profile`),
+		p.ID, p.SchemaVersion, p.KeyID, p.Industry, p.PeriodStart.UTC(), p.PeriodEnd.UTC(), time.Now().UTC(), string(data))
+	if err != nil {
+		return fmt.Errorf("failed to push profile: %w", err)
+	}
+	return nil
+}
+
+// Profiles returns the profiles of an industry, or of all industries if it is
+// empty. Profiles of a newer schema version are left out, so older versions of the
+// tool keep working against a database newer ones push to.
+func (s *Store) Profiles(ctx context.Context, industry string) ([]*Profile, error) {
+	query := `SELECT profile FROM engagement_profiles WHERE schema_version <= ?`
+	args := []any{SchemaVersion}
+	if industry != "" {
+		query += ` AND industry = ?`
+		args = append(args, industry)
+	}
+	rows, err := s.db.QueryContext(ctx, s.rebind(query), args...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read profiles: %w", err)
+	}
+	defer rows.Close()
+
+	var profiles []*Profile
+	for rows.Next() {
+		var data string
+		if err := rows.Scan(&data); err != nil {
+			return nil, fmt.Errorf("failed to read profiles: %w", err)
+		}
+		var p Profile
+		if err := json.Unmarshal([]byte(data), &p); err != nil {
+			return nil, fmt.Errorf("failed to parse profile: %w", err)
+		}
+		profiles = append(profiles, &p)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read profiles: %w", err)
+	}
+	return profiles, nil
+}
+
+// rebind turns the ? placeholders of a query into Postgres' $1, $2...
+func (s *Store) rebind(query string) string {
+	if !s.postgres {
+		return query
+	}
+	var b strings.Builder
+	n := 0
+	for _, c := range query {
+		if c == '?' {
+			n++
+			b.WriteString("$" + strconv.Itoa(n))
+			continue
+		}
+		b.WriteRune(c)
+	}
+	return b.String()
+}
@@ -0,0 +1,213 @@
+// Package trends keeps anonymized attack profiles of engagements in a central
+// database shared across reviews, and compares an engagement's profile against the
+// others as an industry baseline. Profiles hold aggregate counts only: no customer,
+// account, Web ACL, host or client identifier.
+package trends
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"time"
+
+	"waf-log-retriever/analysis"
+)
+
+// SchemaVersion is the version of profiles; it changes whenever a field is added,
+// removed or derived differently
+const SchemaVersion = 1
+
+// topCountries is how many countries of origin of an engagement's attacks are compared
+const topCountries = 5
+
+// Profile is the anonymized attack profile of an engagement
+type Profile struct {
+	SchemaVersion     int              `json:"schemaVersion"`
+	ID                string           `json:"id"`    // Keyed hash of the profile, Web ACL and engagement ID; pushing it again replaces it
+	KeyID             string           `json:"keyId"` // Identifies the hash key, see analysis.HashKeyID
+	Industry          string           `json:"industry,omitempty"`
+	PeriodStart       time.Time        `json:"periodStart"` // Of the records, truncated to the day
+	PeriodEnd         time.Time        `json:"periodEnd"`
+	Requests          int64            `json:"requests"`
+	Blocked           int64            `json:"blocked"`
+	Attacks           int64            `json:"attacks"` // Matching an attack category or from a scanner
+	AttacksNotBlocked int64            `json:"attacksNotBlocked"`
+	ScannerRequests   int64            `json:"scannerRequests"`
+	Categories        map[string]int64 `json:"categories"` // Attack requests by OWASP Top 10 category ID
+	Countries         map[string]int64 `json:"countries"`  // Attack requests by country of origin
+}
+
+// FromResult derives the anonymized profile of an analysis result. The ID hashes the
+// profile and Web ACL names and the engagement ID (if any) with key, so the store
+// cannot tell whose profile it is, and later pushes of the same engagement replace it.
+func FromResult(result *analysis.Result, key []byte, engagementID, industry string) (*Profile, error) {
+	if len(key) < analysis.MinHashKeyBytes {
+		return nil, fmt.Errorf("the hash key has %d bytes; use at least %d random bytes", len(key), analysis.MinHashKeyBytes)
+	}
+	if result.Stats == nil || result.Stats.TotalRequests == 0 {
+		return nil, errors.New("the analysis result has no requests")
+	}
+	if len(result.Origins) == 0 {
+		return nil, errors.New("the analysis result has no attack origins; rerun analyze to add them")
+	}
+	p := &Profile{
+		SchemaVersion: SchemaVersion,
+		ID:            analysis.KeyedHash(key, "engagement", result.ProfileName+"/"+result.WebACLName+"/"+engagementID),
+		KeyID:         analysis.HashKeyID(key),
+		Industry:      industry,
+		PeriodStart:   result.Stats.FirstSeen.UTC().Truncate(24 * time.Hour),
+		PeriodEnd:     result.Stats.LastSeen.UTC().Truncate(24 * time.Hour),
+		Requests:      result.Stats.TotalRequests,
+		Blocked:       result.Stats.Actions["BLOCK"],
+		Categories:    make(map[string]int64),
+		Countries:     make(map[string]int64),
+	}
+	for _, o := range result.Origins {
+		p.Attacks += o.Attacks
+		p.AttacksNotBlocked += o.AttacksNotBlocked
+		if o.Attacks > 0 && o.Country != "" && o.Country != "-" {
+			p.Countries[o.Country] = o.Attacks
+		}
+	}
+	for _, entry := range result.AttackLandscape {
+		p.Categories[entry.OWASP] = entry.Requests
+	}
+	for _, s := range result.Scanners {
+		p.ScannerRequests += s.Requests
+	}
+	return p, nil
+}
+
+// Metric is a rate compared across profiles
+type Metric struct {
+	Name  string
+	Value float64
+}
+
+// Metrics returns the rates of a profile compared against the baseline: the shares
+// of blocked, attack and scanner requests and of attacks blocked, the share of
+// attacks in each OWASP Top 10 category, and the shares of attacks from its top
+// countries of origin
+func (p *Profile) Metrics() []Metric {
+	metrics := p.rates()
+	for _, id := range sortedKeys(p.Categories, 0) {
+		metrics = append(metrics, Metric{categoryMetric(id), ratio(p.Categories[id], p.Attacks)})
+	}
+	for _, country := range sortedKeys(p.Countries, topCountries) {
+		metrics = append(metrics, Metric{countryMetric(country), ratio(p.Countries[country], p.Attacks)})
+	}
+	return metrics
+}
+
+// rates returns the metrics every profile has
+func (p *Profile) rates() []Metric {
+	return []Metric{
+		{"Blocked requests", ratio(p.Blocked, p.Requests)},
+		{"Attack requests", ratio(p.Attacks, p.Requests)},
+		{"Scanner requests", ratio(p.ScannerRequests, p.Requests)},
+		{"Attacks blocked", ratio(p.Attacks-p.AttacksNotBlocked, p.Attacks)},
+	}
+}
+
+// metric returns the value of a named metric of a profile, which is 0 for a category
+// or country it saw no attacks in
+func (p *Profile) metric(name string) float64 {
+	for _, m := range p.rates() {
+		if m.Name == name {
+			return m.Value
+		}
+	}
+	for id, n := range p.Categories {
+		if categoryMetric(id) == name {
+			return ratio(n, p.Attacks)
+		}
+	}
+	for country, n := range p.Countries {
+		if countryMetric(country) == name {
+			return ratio(n, p.Attacks)
+		}
+	}
+	return 0
+}
+
+// Comparison is a metric of an engagement against the same metric over its peers
+type Comparison struct {
+	Metric
+	Median     float64
+	P25        float64
+	P75        float64
+	Percentile float64 // Share of peers with a lower value, ties counting half, 0 to 100
+}
+
+// Compare compares the metrics of a profile against its peers, the profile itself
+// left out, and returns the number of peers compared against
+func Compare(p *Profile, peers []*Profile) ([]Comparison, int) {
+	others := make([]*Profile, 0, len(peers))
+	for _, peer := range peers {
+		if peer.ID != p.ID {
+			others = append(others, peer)
+		}
+	}
+	var comparisons []Comparison
+	for _, m := range p.Metrics() {
+		values := make([]float64, len(others))
+		for i, peer := range others {
+			values[i] = peer.metric(m.Name)
+		}
+		sort.Float64s(values)
+		c := Comparison{Metric: m}
+		if len(values) > 0 {
+			c.Median, c.P25, c.P75 = quantile(values, 0.5), quantile(values, 0.25), quantile(values, 0.75)
+			// Mid-rank, so that a value equal to every peer's is at the 50th percentile
+			below := sort.SearchFloat64s(values, m.Value)
+			equal := sort.Search(len(values), func(i int) bool { return values[i] > m.Value }) - below
+			c.Percentile = 100 * (float64(below) + float64(equal)/2) / float64(len(values))
+		}
+		comparisons = append(comparisons, c)
+	}
+	return comparisons, len(others)
+}
+
+func categoryMetric(id string) string {
+	return "Attacks in " + id
+}
+
+func countryMetric(country string) string {
+	return "Attacks from " + country
+}
+
+// quantile returns the q-quantile of sorted values by linear interpolation
+func quantile(sorted []float64, q float64) float64 {
+	pos := q * float64(len(sorted)-1)
+	lower := int(pos)
+	if lower+1 >= len(sorted) {
+		return sorted[lower]
+	}
+	return sorted[lower] + (pos-float64(lower))*(sorted[lower+1]-sorted[lower])
+}
+
+func ratio(part, total int64) float64 {
+	if total <= 0 {
+		return 0
+	}
+	return float64(part) / float64(total)
+}
+
+// sortedKeys returns the keys of counts with the highest counts first, at most n of
+// them unless n is 0
+func sortedKeys(counts map[string]int64, n int) []string {
+	keys := make([]string, 0, len(counts))
+	for k := range counts {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if counts[keys[i]] != counts[keys[j]] {
+			return counts[keys[i]] > counts[keys[j]]
+		}
+		return keys[i] < keys[j]
+	})
+	if n > 0 && len(keys) > n {
+		keys = keys[:n]
+	}
+	return keys
+}
@@ -0,0 +1,255 @@
+// Package update replaces the running binary with a signed release, for review
+// machines outside the usual deployment tooling. A release publishes, next to one
+// binary per platform, a SHA256SUMS file of their checksums signed with the
+// signing package as the release version, and a VERSION file.
+package update
+
+import (
+	"bufio"
+	"context"
+	"crypto"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strings"
+
+	"golang.org/x/mod/semver"
+
+	"waf-log-retriever/signing"
+	"waf-log-retriever/storage"
+)
+
+// DefaultURL is where the assets of the latest release are downloaded from
+const DefaultURL = "https://github.com/bimat0206/aws-waf-review/releases/latest/download"
+
+// Release asset names
+const (
+	ChecksumsName = "SHA256SUMS" // "<sha256>  <asset>" lines, signed to ChecksumsName + signing.SignatureExtension
+	VersionName   = "VERSION"    // The version the binaries report
+)
+
+// oldExtension names the replaced binary on Windows, which cannot replace a
+// running executable but can rename it
+const oldExtension = ".old"
+
+// AssetName is the name of the release binary for a platform
+func AssetName(goos, goarch string) string {
+	name := fmt.Sprintf("waf-log-retriever_%s_%s", goos, goarch)
+	if goos == "windows" {
+		name += ".exe"
+	}
+	return name
+}
+
+// Release is a release whose checksums were verified against a trusted key
+type Release struct {
+	URL       string
+	Version   string
+	Signature *signing.Signature
+	checksums map[string]string // By asset name
+}
+
+// Fetch downloads the checksums of the release at url and their signature into dir,
+// verifies them against publicKey and reads the release version. The version must be
+// a semantic version, signed with the checksums, that the VERSION file agrees with.
+func Fetch(ctx context.Context, client *http.Client, url string, publicKey crypto.PublicKey, dir string) (*Release, error) {
+	url = strings.TrimSuffix(url, "/")
+	checksumsPath := filepath.Join(dir, ChecksumsName)
+	sigPath := checksumsPath + signing.SignatureExtension
+	for _, name := range []string{ChecksumsName, ChecksumsName + signing.SignatureExtension} {
+		if err := downloadFile(ctx, client, url+"/"+name, filepath.Join(dir, name)); err != nil {
+			return nil, err
+		}
+	}
+	signature, err := signing.VerifyFile(checksumsPath, sigPath, publicKey)
+	if err != nil {
+		return nil, fmt.Errorf("release checksums failed verification: %w", err)
+	}
+	if signature.Version == "" {
+		return nil, errors.New("the release checksums are not signed with a version; sign them with: sign -version")
+	}
+	if !semver.IsValid(signature.Version) {
+		return nil, fmt.Errorf("the release version %q is not a semantic version, e.g. v1.4.0", signature.Version)
+	}
+	checksums, err := readChecksums(checksumsPath)
+	if err != nil {
+		return nil, err
+	}
+	r := &Release{URL: url, Version: signature.Version, Signature: signature, checksums: checksums}
+
+	versionPath, err := r.Download(ctx, client, VersionName, dir)
+	if err != nil {
+		return nil, err
+	}
+	data, err := os.ReadFile(versionPath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read release version: %w", err)
+	}
+	if version := strings.TrimSpace(string(data)); version != r.Version {
+		return nil, fmt.Errorf("the release VERSION %q is not the signed version %s", version, r.Version)
+	}
+	return r, nil
+}
+
+// Compare compares the release version with the running version, returning -1, 0 or
+// +1 as the release is older, the same or newer. It fails for a running version that
+// is not a semantic version, e.g. the VCS revision of a development build.
+func (r *Release) Compare(current string) (int, error) {
+	if !semver.IsValid(current) {
+		return 0, fmt.Errorf("the running version %q is not a semantic version", current)
+	}
+	return semver.Compare(r.Version, current), nil
+}
+
+// Download downloads an asset of the release into dir and verifies it against the
+// signed checksums, returning its path
+func (r *Release) Download(ctx context.Context, client *http.Client, name, dir string) (string, error) {
+	want, ok := r.checksums[name]
+	if !ok {
+		return "", fmt.Errorf("the release has no %s", name)
+	}
+	path := filepath.Join(dir, name)
+	if err := downloadFile(ctx, client, r.URL+"/"+name, path); err != nil {
+		return "", err
+	}
+	got, err := fileSHA256(path)
+	if err != nil {
+		return "", err
+	}
+	if got != want {
+		os.Remove(path)
+		return "", fmt.Errorf("%s does not match the signed checksum (got %s, want %s)", name, got, want)
+	}
+	return path, nil
+}
+
+// Install downloads the release binary of this platform next to the executable at
+// exePath, checks that it runs and reports the release version, and renames it over
+// the executable
+func (r *Release) Install(ctx context.Context, client *http.Client, exePath string) error {
+	dir := filepath.Dir(exePath)
+	// Leftovers of an earlier update on Windows, no longer running
+	os.Remove(exePath + oldExtension)
+
+	staging, err := os.MkdirTemp(dir, "."+filepath.Base(exePath)+".*"+storage.TempExtension)
+	if err != nil {
+		return fmt.Errorf("failed to stage the update next to %s: %w", exePath, err)
+	}
+	defer os.RemoveAll(staging)
+
+	newPath, err := r.Download(ctx, client, AssetName(runtime.GOOS, runtime.GOARCH), staging)
+	if err != nil {
+		return err
+	}
+	if err := os.Chmod(newPath, 0755); err != nil {
+		return fmt.Errorf("failed to make the update executable: %w", err)
+	}
+	out, err := exec.CommandContext(ctx, newPath, "version").Output()
+	if err != nil {
+		return fmt.Errorf("the downloaded binary does not run on this machine: %w", err)
+	}
+	if got := strings.TrimSpace(string(out)); got != r.Version {
+		return fmt.Errorf("the downloaded binary reports version %q, not the release version %s", got, r.Version)
+	}
+
+	if runtime.GOOS == "windows" {
+		if err := os.Rename(exePath, exePath+oldExtension); err != nil {
+			return fmt.Errorf("failed to move %s aside: %w", exePath, err)
+		}
+	}
+	if err := os.Rename(newPath, exePath); err != nil {
+		if runtime.GOOS == "windows" {
+			os.Rename(exePath+oldExtension, exePath)
+		}
+		return fmt.Errorf("failed to replace %s: %w", exePath, err)
+	}
+	return nil
+}
+
+// Executable returns the path of the running binary, with symlinks resolved so the
+// binary itself is replaced rather than a link to it
+func Executable() (string, error) {
+	path, err := os.Executable()
+	if err != nil {
+		return "", fmt.Errorf("failed to locate the executable: %w", err)
+	}
+	if path, err = filepath.EvalSymlinks(path); err != nil {
+		return "", fmt.Errorf("failed to resolve the executable: %w", err)
+	}
+	return path, nil
+}
+
+// readChecksums parses a SHA256SUMS file as written by sha256sum
+func readChecksums(path string) (map[string]string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open checksums: %w", err)
+	}
+	defer file.Close()
+
+	checksums := make(map[string]string)
+	scanner := bufio.NewScanner(file)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" {
+			continue
+		}
+		sum, name, ok := strings.Cut(text, " ")
+		name = strings.TrimPrefix(strings.TrimSpace(name), "*") // Binary mode marker
+		if !ok || len(sum) != sha256.Size*2 || name == "" {
+			return nil, fmt.Errorf("checksums line %d is not \"<sha256>  <file>\"", line)
+		}
+		checksums[name] = strings.ToLower(sum)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read checksums: %w", err)
+	}
+	return checksums, nil
+}
+
+// downloadFile downloads url to path
+func downloadFile(ctx context.Context, client *http.Client, url, path string) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return fmt.Errorf("failed to request %s: %w", url, err)
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to download %s: %w", url, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("failed to download %s: %s", url, resp.Status)
+	}
+
+	file, err := os.Create(path)
+	if err != nil {
+		return fmt.Errorf("failed to create %s: %w", path, err)
+	}
+	if _, err := io.Copy(file, resp.Body); err != nil {
+		file.Close()
+		return fmt.Errorf("failed to download %s: %w", url, err)
+	}
+	return file.Close()
+}
+
+// fileSHA256 returns the hex SHA-256 checksum of a file
+func fileSHA256(path string) (string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return "", fmt.Errorf("failed to open %s: %w", path, err)
+	}
+	defer file.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, file); err != nil {
+		return "", fmt.Errorf("failed to hash %s: %w", path, err)
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
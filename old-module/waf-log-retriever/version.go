@@ -0,0 +1,33 @@
+package main
+
+import "runtime/debug"
+
+// version is the tool version, set at build time with -ldflags "-X main.version=v1.2.3"
+var version = ""
+
+// toolVersion returns the build-time version, or the VCS revision the binary was built from
+func toolVersion() string {
+	if version != "" {
+		return version
+	}
+	info, ok := debug.ReadBuildInfo()
+	if !ok {
+		return "unknown"
+	}
+	revision, modified := "", false
+	for _, setting := range info.Settings {
+		switch setting.Key {
+		case "vcs.revision":
+			revision = setting.Value
+		case "vcs.modified":
+			modified = setting.Value == "true"
+		}
+	}
+	if revision == "" {
+		return "devel"
+	}
+	if modified {
+		revision += "-dirty"
+	}
+	return revision
+}
@@ -0,0 +1,342 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"os/user"
+	"path/filepath"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"waf-log-retriever/storage"
+	"waf-log-retriever/workspace"
+)
+
+// defaultReviewer names the reviewer after the OS user
+func defaultReviewer() string {
+	if u, err := user.Current(); err == nil && u.Username != "" {
+		return u.Username
+	}
+	return os.Getenv("USER")
+}
+
+// runStatus prints the review checklist and annotations of a Web ACL
+func runStatus(args []string) int {
+	fs := flag.NewFlagSet("status", flag.ExitOnError)
+	outputDir := fs.String("output-dir", "../logs/raw", "Directory containing retrieved logs")
+	profile := fs.String("profile", "", "AWS profile name the logs were retrieved with")
+	webACL := fs.String("web-acl", "", "Name of the Web ACL under review")
+	fs.Parse(args)
+
+	if *profile == "" || *webACL == "" {
+		fmt.Println("status requires -profile and -web-acl")
+		fs.Usage()
+		return 2
+	}
+
+	ws, err := workspace.Open(filepath.Join(*outputDir, *profile, *webACL), *profile, *webACL)
+	if err != nil {
+		fmt.Printf("%v\n", err)
+		return 1
+	}
+
+	done, total := ws.Progress()
+	fmt.Printf("Review of Web ACL %s (profile %s): %d of %d checklist items done\n\n", ws.WebACLName, ws.ProfileName, done, total)
+	if ws.Engagement != nil {
+		printEngagement(ws.Engagement)
+		fmt.Println()
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "\tITEM\tTITLE\tBY\tAT\tNOTE")
+	for _, item := range ws.Checklist {
+		mark, at := "[ ]", ""
+		if item.Done {
+			mark = "[x]"
+			at = item.DoneAt.Local().Format("2006-01-02 15:04")
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\n", mark, item.ID, item.Title, item.DoneBy, at, item.Note)
+	}
+	w.Flush()
+
+	if len(ws.Annotations) > 0 {
+		fmt.Printf("\nAnnotations:\n")
+		w = tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(w, "TARGET\tKEY\tDISPOSITION\tBY\tAT\tNOTE")
+		for _, a := range ws.Annotations {
+			fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\n", a.Target, a.Key, a.Disposition, a.Reviewer,
+				a.At.Local().Format("2006-01-02 15:04"), a.Note)
+		}
+		w.Flush()
+	}
+
+	if len(ws.Archives) > 0 {
+		fmt.Printf("\nArchives:\n")
+		w = tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(w, "ID\tLOCATION\tCLASS\tFILES\tBY\tLOCAL\tLAST RESTORE")
+		for _, a := range ws.Archives {
+			local, restored := "kept", ""
+			if a.Pruned {
+				local = "pruned"
+			}
+			if n := len(a.Restores); n > 0 {
+				last := a.Restores[n-1]
+				restored = fmt.Sprintf("%s by %s (%d pending)", last.At.Local().Format("2006-01-02 15:04"), last.Reviewer, last.Pending)
+			}
+			fmt.Fprintf(w, "%s\t%s\t%s\t%d\t%s\t%s\t%s\n", a.ID, a.Location, a.StorageClass, a.Files, a.ArchivedBy, local, restored)
+		}
+		w.Flush()
+	}
+	return 0
+}
+
+// runCheckoff marks checklist items of a Web ACL's review done, or reopens them
+func runCheckoff(args []string) int {
+	fs := flag.NewFlagSet("checkoff", flag.ExitOnError)
+	outputDir := fs.String("output-dir", "../logs/raw", "Directory containing retrieved logs")
+	profile := fs.String("profile", "", "AWS profile name the logs were retrieved with")
+	webACL := fs.String("web-acl", "", "Name of the Web ACL under review")
+	reviewer := fs.String("reviewer", defaultReviewer(), "Name of the reviewer checking the items off")
+	note := fs.String("note", "", "Note to record with the items")
+	title := fs.String("title", "", "Add the item to the checklist with this title if it is not on it")
+	reopen := fs.Bool("reopen", false, "Reopen the items instead of checking them off")
+	forceUnlock := fs.Bool("force-unlock", false, "Take over the lock of the Web ACL's directory even if another run appears to hold it")
+	fs.Parse(args)
+
+	if *profile == "" || *webACL == "" || fs.NArg() == 0 {
+		fmt.Println("checkoff requires -profile, -web-acl and at least one checklist item")
+		fs.Usage()
+		return 2
+	}
+
+	// Held from reading the workspace to saving it, so that concurrent reviewers'
+	// changes are not lost
+	aclDir := filepath.Join(*outputDir, *profile, *webACL)
+	lock, err := lockWebACL(aclDir, "checkoff", *forceUnlock, printInfo, printWarning)
+	if err != nil {
+		fmt.Printf("%v\n", err)
+		return 1
+	}
+	defer releaseLock(lock, printWarning)
+	ws, err := workspace.Open(aclDir, *profile, *webACL)
+	if err != nil {
+		fmt.Printf("%v\n", err)
+		return 1
+	}
+
+	now := time.Now().UTC()
+	for _, id := range fs.Args() {
+		item := ws.Item(id)
+		if item == nil {
+			if *title == "" {
+				fmt.Printf("Unknown checklist item %s; pass -title to add it\n", id)
+				return 1
+			}
+			if item, err = ws.AddItem(id, *title); err != nil {
+				fmt.Printf("%v\n", err)
+				return 1
+			}
+		}
+		if *reopen {
+			item.Reopen(*reviewer, *note, now)
+			fmt.Printf("Reopened %s\n", id)
+		} else {
+			item.CheckOff(*reviewer, *note, now)
+			fmt.Printf("Checked off %s as %s\n", id, *reviewer)
+		}
+	}
+	if err := ws.Save(); err != nil {
+		fmt.Printf("%v\n", err)
+		return 1
+	}
+	return 0
+}
+
+// runAnnotate attaches a note and disposition to a finding, client IP or rule of a
+// Web ACL's review
+func runAnnotate(args []string) int {
+	fs := flag.NewFlagSet("annotate", flag.ExitOnError)
+	outputDir := fs.String("output-dir", "../logs/raw", "Directory containing retrieved logs")
+	profile := fs.String("profile", "", "AWS profile name the logs were retrieved with")
+	webACL := fs.String("web-acl", "", "Name of the Web ACL under review")
+	finding := fs.String("finding", "", "ID of the finding to annotate")
+	ip := fs.String("ip", "", "Client IP to annotate")
+	rule := fs.String("rule", "", "Rule to annotate")
+	disposition := fs.String("disposition", "", "Disposition: true-positive, false-positive or accepted-risk")
+	note := fs.String("note", "", "Note to attach")
+	reviewer := fs.String("reviewer", defaultReviewer(), "Name of the reviewer annotating")
+	forceUnlock := fs.Bool("force-unlock", false, "Take over the lock of the Web ACL's directory even if another run appears to hold it")
+	fs.Parse(args)
+
+	var targets []workspace.Annotation
+	for target, key := range map[string]string{workspace.TargetFinding: *finding, workspace.TargetIP: *ip, workspace.TargetRule: *rule} {
+		if key != "" {
+			targets = append(targets, workspace.Annotation{Target: target, Key: key})
+		}
+	}
+	if *profile == "" || *webACL == "" || len(targets) != 1 {
+		fmt.Println("annotate requires -profile, -web-acl and one of -finding, -ip or -rule")
+		fs.Usage()
+		return 2
+	}
+
+	aclDir := filepath.Join(*outputDir, *profile, *webACL)
+	lock, err := lockWebACL(aclDir, "annotate", *forceUnlock, printInfo, printWarning)
+	if err != nil {
+		fmt.Printf("%v\n", err)
+		return 1
+	}
+	defer releaseLock(lock, printWarning)
+	ws, err := workspace.Open(aclDir, *profile, *webACL)
+	if err != nil {
+		fmt.Printf("%v\n", err)
+		return 1
+	}
+	a := targets[0]
+	a.Disposition = *disposition
+	a.Note = *note
+	a.Reviewer = *reviewer
+	a.At = time.Now().UTC()
+	if err := ws.Annotate(a); err != nil {
+		fmt.Printf("%v\n", err)
+		return 1
+	}
+	if err := ws.Save(); err != nil {
+		fmt.Printf("%v\n", err)
+		return 1
+	}
+	fmt.Printf("Annotated %s %s\n", a.Target, a.Key)
+	return 0
+}
+
+// runEngagement sets the engagement metadata of a Web ACL's review, or prints it
+// when no metadata flag is given. Only the flags given change; an empty value clears
+// a field.
+func runEngagement(args []string) int {
+	fs := flag.NewFlagSet("engagement", flag.ExitOnError)
+	outputDir := fs.String("output-dir", "../logs/raw", "Directory containing retrieved logs")
+	profile := fs.String("profile", "", "AWS profile name the logs were retrieved with")
+	webACL := fs.String("web-acl", "", "Name of the Web ACL under review")
+	id := fs.String("id", "", "Engagement or ticket reference, e.g. ENG-2025-014")
+	customer := fs.String("customer", "", "Customer name")
+	reviewer := fs.String("reviewer", "", "Lead reviewer")
+	from := fs.String("from", "", "Start of the review window (YYYY-MM-DD, YYYY-MM-DDTHH:mmZ or YYYY-MM-DDTHH:mm:ssZ)")
+	to := fs.String("to", "", "End of the review window (YYYY-MM-DD, YYYY-MM-DDTHH:mmZ or YYYY-MM-DDTHH:mm:ssZ)")
+	dataSources := fs.String("data-sources", "", "Comma-separated data sources reviewed (default: the log destination recorded at retrieval)")
+	forceUnlock := fs.Bool("force-unlock", false, "Take over the lock of the Web ACL's directory even if another run appears to hold it")
+	fs.Parse(args)
+
+	if *profile == "" || *webACL == "" {
+		fmt.Println("engagement requires -profile and -web-acl")
+		fs.Usage()
+		return 2
+	}
+
+	set := make(map[string]bool)
+	fs.Visit(func(f *flag.Flag) { set[f.Name] = true })
+	update := set["id"] || set["customer"] || set["reviewer"] || set["from"] || set["to"] || set["data-sources"]
+
+	aclDir := filepath.Join(*outputDir, *profile, *webACL)
+	if update {
+		lock, err := lockWebACL(aclDir, "engagement", *forceUnlock, printInfo, printWarning)
+		if err != nil {
+			fmt.Printf("%v\n", err)
+			return 1
+		}
+		defer releaseLock(lock, printWarning)
+	}
+	ws, err := workspace.Open(aclDir, *profile, *webACL)
+	if err != nil {
+		fmt.Printf("%v\n", err)
+		return 1
+	}
+
+	if !update {
+		if ws.Engagement == nil {
+			fmt.Printf("No engagement metadata recorded for Web ACL %s (profile %s)\n", ws.WebACLName, ws.ProfileName)
+			return 0
+		}
+		printEngagement(ws.Engagement)
+		return 0
+	}
+
+	engagement := ws.Engagement
+	if engagement == nil {
+		engagement = &workspace.Engagement{}
+	}
+	if set["id"] {
+		engagement.ID = *id
+	}
+	if set["customer"] {
+		engagement.Customer = *customer
+	}
+	if set["reviewer"] {
+		engagement.Reviewer = *reviewer
+	}
+	for _, window := range []struct {
+		name  string
+		value string
+		field *time.Time
+	}{{"from", *from, &engagement.WindowStart}, {"to", *to, &engagement.WindowEnd}} {
+		if !set[window.name] {
+			continue
+		}
+		*window.field = time.Time{}
+		if window.value != "" {
+			if *window.field, err = parseTime(window.value); err != nil {
+				fmt.Printf("Invalid -%s: %v\n", window.name, err)
+				return 2
+			}
+		}
+	}
+	if !engagement.WindowStart.IsZero() && !engagement.WindowEnd.IsZero() && engagement.WindowStart.After(engagement.WindowEnd) {
+		fmt.Println("The review window cannot start after it ends")
+		return 2
+	}
+	if set["data-sources"] {
+		engagement.DataSources = nil
+		for _, source := range strings.Split(*dataSources, ",") {
+			if source = strings.TrimSpace(source); source != "" {
+				engagement.DataSources = append(engagement.DataSources, source)
+			}
+		}
+	}
+	if len(engagement.DataSources) == 0 {
+		// Logs retrieved by earlier versions have no recorded destination
+		if provenance, err := storage.LoadProvenance(aclDir); err == nil && provenance != nil && provenance.Destination != "" {
+			engagement.DataSources = []string{provenance.Destination}
+		}
+	}
+
+	ws.Engagement = engagement
+	if err := ws.Save(); err != nil {
+		fmt.Printf("%v\n", err)
+		return 1
+	}
+	printEngagement(engagement)
+	return 0
+}
+
+// printEngagement prints engagement metadata as a table
+func printEngagement(e *workspace.Engagement) {
+	window := ""
+	if e.HasWindow() {
+		window = formatWindowTime(e.WindowStart) + " to " + formatWindowTime(e.WindowEnd)
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintf(w, "Engagement:\t%s\n", e.ID)
+	fmt.Fprintf(w, "Customer:\t%s\n", e.Customer)
+	fmt.Fprintf(w, "Reviewer:\t%s\n", e.Reviewer)
+	fmt.Fprintf(w, "Review window:\t%s\n", window)
+	fmt.Fprintf(w, "Data sources:\t%s\n", strings.Join(e.DataSources, ", "))
+	w.Flush()
+}
+
+// formatWindowTime formats an end of the review window, "?" if it is open
+func formatWindowTime(t time.Time) string {
+	if t.IsZero() {
+		return "?"
+	}
+	return t.Format("2006-01-02 15:04 MST")
+}
@@ -0,0 +1,337 @@
+// Package workspace keeps the review state of a Web ACL engagement, such as the
+// checklist and annotations, next to its logs so every reviewer working on the
+// output directory shares it
+package workspace
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"time"
+
+	"waf-log-retriever/storage"
+)
+
+// FileName is the workspace file inside a Web ACL's log directory
+const FileName = "workspace.json"
+
+// Workspace is the shared review state of one Web ACL
+type Workspace struct {
+	ProfileName string          `json:"profileName"`
+	WebACLName  string          `json:"webACLName"`
+	UpdatedAt   time.Time       `json:"updatedAt"`
+	Engagement  *Engagement     `json:"engagement,omitempty"`
+	Checklist   []ChecklistItem `json:"checklist"`
+	Annotations []Annotation    `json:"annotations,omitempty"`
+	Queries     []SavedQuery    `json:"queries,omitempty"`
+	Archives    []Archive       `json:"archives,omitempty"`
+
+	path string
+}
+
+// Engagement describes the review engagement, shown in report headers and carried
+// into evidence bundles and exported findings
+type Engagement struct {
+	ID          string    `json:"id,omitempty"`       // Engagement or ticket reference, e.g. ENG-2025-014
+	Customer    string    `json:"customer,omitempty"` // Customer name
+	Reviewer    string    `json:"reviewer,omitempty"` // Lead reviewer
+	WindowStart time.Time `json:"windowStart,omitzero"`
+	WindowEnd   time.Time `json:"windowEnd,omitzero"`
+	DataSources []string  `json:"dataSources,omitempty"` // What was reviewed, e.g. log destinations and Web ACL snapshots
+}
+
+// HasWindow reports whether the review window is set
+func (e *Engagement) HasWindow() bool {
+	return !e.WindowStart.IsZero() || !e.WindowEnd.IsZero()
+}
+
+// ChecklistItem is one review step
+type ChecklistItem struct {
+	ID      string           `json:"id"`
+	Title   string           `json:"title"`
+	Done    bool             `json:"done"`
+	DoneBy  string           `json:"doneBy,omitempty"`
+	DoneAt  *time.Time       `json:"doneAt,omitempty"`
+	Note    string           `json:"note,omitempty"`
+	History []ChecklistEvent `json:"history,omitempty"`
+}
+
+// ChecklistEvent records who checked off or reopened an item, and when
+type ChecklistEvent struct {
+	At       time.Time `json:"at"`
+	Reviewer string    `json:"reviewer"`
+	Action   string    `json:"action"` // checked or reopened
+	Note     string    `json:"note,omitempty"`
+}
+
+// DefaultChecklist is the checklist of a new workspace
+func DefaultChecklist() []ChecklistItem {
+	return []ChecklistItem{
+		{ID: "logging-reviewed", Title: "Logging configuration and coverage reviewed"},
+		{ID: "rules-reviewed", Title: "Web ACL rules and rule groups reviewed"},
+		{ID: "fp-analysis-done", Title: "False positive analysis done"},
+		{ID: "findings-triaged", Title: "Findings triaged"},
+		{ID: "report-reviewed", Title: "Report reviewed"},
+	}
+}
+
+// Path returns the workspace file of a Web ACL's log directory
+func Path(aclDir string) string {
+	return filepath.Join(aclDir, FileName)
+}
+
+// Open loads the workspace of a Web ACL's log directory, or returns a new one with
+// the default checklist if none has been saved yet
+func Open(aclDir, profile, webACL string) (*Workspace, error) {
+	ws := &Workspace{path: Path(aclDir)}
+	data, err := os.ReadFile(ws.path)
+	if errors.Is(err, os.ErrNotExist) {
+		ws.ProfileName = profile
+		ws.WebACLName = webACL
+		ws.Checklist = DefaultChecklist()
+		return ws, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read workspace: %w", err)
+	}
+	if err := json.Unmarshal(data, ws); err != nil {
+		return nil, fmt.Errorf("failed to parse workspace %s: %w", ws.path, err)
+	}
+	return ws, nil
+}
+
+// Save writes the workspace. It writes a temporary file and renames it, so a
+// concurrent reader never sees a partial file.
+func (w *Workspace) Save() error {
+	w.UpdatedAt = time.Now().UTC()
+	data, err := json.MarshalIndent(w, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to encode workspace: %w", err)
+	}
+	if err := os.MkdirAll(filepath.Dir(w.path), 0755); err != nil {
+		return fmt.Errorf("failed to create workspace directory: %w", err)
+	}
+	if err := storage.WriteFileAtomic(w.path, data); err != nil {
+		return fmt.Errorf("failed to write workspace: %w", err)
+	}
+	return nil
+}
+
+// Item returns the checklist item with the given ID, or nil
+func (w *Workspace) Item(id string) *ChecklistItem {
+	for i := range w.Checklist {
+		if w.Checklist[i].ID == id {
+			return &w.Checklist[i]
+		}
+	}
+	return nil
+}
+
+// AddItem appends a custom checklist item
+func (w *Workspace) AddItem(id, title string) (*ChecklistItem, error) {
+	if w.Item(id) != nil {
+		return nil, fmt.Errorf("checklist item %s already exists", id)
+	}
+	w.Checklist = append(w.Checklist, ChecklistItem{ID: id, Title: title})
+	return &w.Checklist[len(w.Checklist)-1], nil
+}
+
+// CheckOff marks an item done by a reviewer
+func (item *ChecklistItem) CheckOff(reviewer, note string, at time.Time) {
+	item.Done = true
+	item.DoneBy = reviewer
+	item.DoneAt = &at
+	item.Note = note
+	item.History = append(item.History, ChecklistEvent{At: at, Reviewer: reviewer, Action: "checked", Note: note})
+}
+
+// Reopen marks a done item as open again
+func (item *ChecklistItem) Reopen(reviewer, note string, at time.Time) {
+	item.Done = false
+	item.DoneBy = ""
+	item.DoneAt = nil
+	item.Note = note
+	item.History = append(item.History, ChecklistEvent{At: at, Reviewer: reviewer, Action: "reopened", Note: note})
+}
+
+// Progress returns the number of done items and the checklist length
+func (w *Workspace) Progress() (int, int) {
+	done := 0
+	for _, item := range w.Checklist {
+		if item.Done {
+			done++
+		}
+	}
+	return done, len(w.Checklist)
+}
+
+// Annotation targets
+const (
+	TargetFinding = "finding"
+	TargetIP      = "ip"
+	TargetRule    = "rule"
+)
+
+// Annotation dispositions
+const (
+	DispositionTruePositive  = "true-positive"
+	DispositionFalsePositive = "false-positive"
+	DispositionAcceptedRisk  = "accepted-risk"
+)
+
+// Annotation is a reviewer's note and optional disposition on a finding (by ID), a
+// client IP or a rule. Annotations are only ever appended; the latest disposition
+// of a target wins.
+type Annotation struct {
+	Target      string    `json:"target"` // finding, ip or rule
+	Key         string    `json:"key"`    // Finding ID, IP address or rule name
+	Disposition string    `json:"disposition,omitempty"`
+	Note        string    `json:"note,omitempty"`
+	Reviewer    string    `json:"reviewer"`
+	At          time.Time `json:"at"`
+}
+
+// ValidDisposition reports whether d is a known disposition or empty
+func ValidDisposition(d string) bool {
+	switch d {
+	case "", DispositionTruePositive, DispositionFalsePositive, DispositionAcceptedRisk:
+		return true
+	}
+	return false
+}
+
+// Annotate appends an annotation
+func (w *Workspace) Annotate(a Annotation) error {
+	switch a.Target {
+	case TargetFinding, TargetIP, TargetRule:
+	default:
+		return fmt.Errorf("unknown annotation target %q", a.Target)
+	}
+	if !ValidDisposition(a.Disposition) {
+		return fmt.Errorf("unknown disposition %q (want %s, %s or %s)", a.Disposition,
+			DispositionTruePositive, DispositionFalsePositive, DispositionAcceptedRisk)
+	}
+	if a.Disposition == "" && a.Note == "" {
+		return fmt.Errorf("an annotation needs a disposition or a note")
+	}
+	w.Annotations = append(w.Annotations, a)
+	return nil
+}
+
+// AnnotationsFor returns the annotations of a target, oldest first
+func (w *Workspace) AnnotationsFor(target, key string) []Annotation {
+	var annotations []Annotation
+	for _, a := range w.Annotations {
+		if a.Target == target && a.Key == key {
+			annotations = append(annotations, a)
+		}
+	}
+	return annotations
+}
+
+// Disposition returns the latest disposition of a target, or ""
+func (w *Workspace) Disposition(target, key string) string {
+	for i := len(w.Annotations) - 1; i >= 0; i-- {
+		a := w.Annotations[i]
+		if a.Target == target && a.Key == key && a.Disposition != "" {
+			return a.Disposition
+		}
+	}
+	return ""
+}
+
+// SavedQuery is a named statement of the review's query library, run with query run,
+// in the repl and with analyses
+type SavedQuery struct {
+	Name        string    `json:"name"`
+	Statement   string    `json:"statement"` // See analysis.ParseStatement
+	Description string    `json:"description,omitempty"`
+	SavedBy     string    `json:"savedBy"`
+	SavedAt     time.Time `json:"savedAt"`
+}
+
+// ValidQueryName reports whether name can name a saved query: letters, digits, dots,
+// dashes and underscores, starting with a letter or digit
+func ValidQueryName(name string) bool {
+	return queryName.MatchString(name)
+}
+
+var queryName = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9._-]*$`)
+
+// SaveQuery adds a query to the library, replacing one with the same name
+func (w *Workspace) SaveQuery(q SavedQuery) {
+	for i := range w.Queries {
+		if w.Queries[i].Name == q.Name {
+			w.Queries[i] = q
+			return
+		}
+	}
+	w.Queries = append(w.Queries, q)
+}
+
+// Query returns the saved query with the given name, or nil
+func (w *Workspace) Query(name string) *SavedQuery {
+	for i := range w.Queries {
+		if w.Queries[i].Name == name {
+			return &w.Queries[i]
+		}
+	}
+	return nil
+}
+
+// DeleteQuery removes a saved query, reporting whether it existed
+func (w *Workspace) DeleteQuery(name string) bool {
+	for i := range w.Queries {
+		if w.Queries[i].Name == name {
+			w.Queries = append(w.Queries[:i], w.Queries[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+// Archive records raw data pushed to an S3 archive, and every restore of it
+type Archive struct {
+	ID           string           `json:"id"`       // Archive time, e.g. 20250131T140000Z
+	Location     string           `json:"location"` // s3://bucket/prefix/ holding the archive
+	StorageClass string           `json:"storageClass"`
+	Files        int              `json:"files"`
+	Bytes        int64            `json:"bytes"`
+	ArchivedBy   string           `json:"archivedBy"`
+	ArchivedAt   time.Time        `json:"archivedAt"`
+	Pruned       bool             `json:"pruned"` // The local copies were removed
+	Restores     []ArchiveRestore `json:"restores,omitempty"`
+}
+
+// ArchiveRestore records one run of restore
+type ArchiveRestore struct {
+	At       time.Time `json:"at"`
+	Reviewer string    `json:"reviewer"`
+	Restored int       `json:"restored"` // Files downloaded by the run
+	Pending  int       `json:"pending"`  // Files still being retrieved from a Glacier tier
+}
+
+// AddArchive records an archive, replacing an earlier record with the same ID
+func (w *Workspace) AddArchive(a Archive) {
+	for i := range w.Archives {
+		if w.Archives[i].ID == a.ID {
+			w.Archives[i] = a
+			return
+		}
+	}
+	w.Archives = append(w.Archives, a)
+}
+
+// FindArchive returns the archive with the given ID, or the latest one if id is
+// empty, or nil
+func (w *Workspace) FindArchive(id string) *Archive {
+	for i := len(w.Archives) - 1; i >= 0; i-- {
+		if id == "" || w.Archives[i].ID == id {
+			return &w.Archives[i]
+		}
+	}
+	return nil
+}
@@ -20,16 +20,17 @@ if [[ ! -d "$INPUT_DIR" ]]; then
     exit 1
 fi
 
-# ✅ Find and process all JSON log files
-log_files=("$INPUT_DIR"/*.json)
+# ✅ Find all CloudWatch Logs files, gzipped or not, also in the YYYY/MM/DD/HH directories
+mapfile -t log_files < <(find "$INPUT_DIR" -type f \( -name 'waf_logs_*.json' -o -name 'waf_logs_*.json.gz' \) | sort)
 if [[ ${#log_files[@]} -eq 0 ]]; then
     echo "No JSON log files found in $INPUT_DIR."
     exit 1
 fi
 
 echo "Processing ${#log_files[@]} log files from $INPUT_DIR..."
-for log_file in "$INPUT_DIR"/*.json; do
-    output_file="$OUTPUT_DIR/$(basename "${log_file%.json}_parsed.json")"
+for log_file in "${log_files[@]}"; do
+    log_name=$(basename "${log_file%.gz}")
+    output_file="$OUTPUT_DIR/${log_name%.json}_parsed.json"
     echo "Parsing: $log_file -> $output_file"
     
     # ✅ Run the log parser for each file pretty printing
@@ -1,12 +1,18 @@
 package main
 
 import (
+	"bufio"
 	"bytes"
+	"compress/gzip"
+	"container/heap"
+	"encoding/csv"
 	"encoding/json"
 	"flag"
 	"fmt"
 	"io"
+	"net"
 	"os"
+	"strconv"
 	"strings"
 )
 
@@ -17,204 +23,603 @@ type CloudWatchLogEntry struct {
 	Timestamp string `json:"@timestamp"`
 }
 
-// min returns the smaller of two integers
-func min(a, b int) int {
-	if a < b {
-		return a
-	}
-	return b
+// wafRequest holds the parts of an inner WAF record needed to filter by host
+type wafRequest struct {
+	HTTPRequest struct {
+		Host    string `json:"host"`
+		Headers []struct {
+			Name  string `json:"name"`
+			Value string `json:"value"`
+		} `json:"headers"`
+	} `json:"httpRequest"`
 }
 
-func main() {
-	// Define command line flags
-	inputFile := flag.String("input", "", "Input file path (required)")
-	outputFile := flag.String("output", "", "Output file path (defaults to stdout)")
-	prettyPrint := flag.Bool("pretty", false, "Pretty-print JSON output")
-	debugMode := flag.Bool("debug", false, "Enable debug output")
-	validateJSON := flag.Bool("validate", true, "Validate inner JSON before processing (disable with -validate=false)")
-	flag.Parse()
+// requestHost returns the lower-cased host of a WAF record without a port, or "" if it has none
+func requestHost(message string) string {
+	var record wafRequest
+	if err := json.Unmarshal([]byte(message), &record); err != nil {
+		return ""
+	}
+	host := record.HTTPRequest.Host
+	if host == "" {
+		for _, h := range record.HTTPRequest.Headers {
+			if strings.EqualFold(h.Name, "Host") {
+				host = h.Value
+				break
+			}
+		}
+	}
+	host = strings.ToLower(strings.TrimSpace(host))
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	return host
+}
 
-	// Validate required flags
-	if *inputFile == "" {
-		fmt.Fprintln(os.Stderr, "Error: input file is required")
-		flag.Usage()
-		os.Exit(1)
+// matchesHosts reports whether host matches one of the patterns; a pattern
+// starting with *. matches any subdomain
+func matchesHosts(patterns []string, host string) bool {
+	for _, pattern := range patterns {
+		pattern = strings.ToLower(strings.TrimSpace(pattern))
+		if strings.HasPrefix(pattern, "*.") {
+			if strings.HasSuffix(host, pattern[1:]) {
+				return true
+			}
+		} else if host == pattern {
+			return true
+		}
 	}
+	return false
+}
 
-	// Open input file
-	file, err := os.Open(*inputFile)
-	if err != nil {
-		fmt.Fprintf(os.Stderr, "Error opening input file: %v\n", err)
-		os.Exit(1)
+// defaultCSVColumns are the columns of -format csv unless -columns is given
+const defaultCSVColumns = "timestamp,action,terminatingRuleId,clientIp,country,host,method,uri,args,header:User-Agent,labels"
+
+// csvColumnAliases maps short column names to the paths of their fields in a WAF record
+var csvColumnAliases = map[string]string{
+	"clientIp":    "httpRequest.clientIp",
+	"country":     "httpRequest.country",
+	"uri":         "httpRequest.uri",
+	"args":        "httpRequest.args",
+	"method":      "httpRequest.httpMethod",
+	"httpVersion": "httpRequest.httpVersion",
+	"requestId":   "httpRequest.requestId",
+}
+
+// csvRow returns the cells of a WAF record for the given columns. A column is a
+// dotted field path (e.g. httpRequest.clientIp) or an alias of one, host (from the
+// host field or Host header), labels (the label names), or header:<name> (the
+// header's first value, or all of them pipe-joined if joinRepeated is set). Arrays
+// of plain values are pipe-joined; objects and other arrays are written as JSON.
+func csvRow(message string, columns []string, joinRepeated bool) ([]string, error) {
+	var record map[string]interface{}
+	decoder := json.NewDecoder(strings.NewReader(message))
+	decoder.UseNumber() // Keep millisecond timestamps exact
+	if err := decoder.Decode(&record); err != nil {
+		return nil, err
+	}
+	row := make([]string, len(columns))
+	for i, column := range columns {
+		switch {
+		case column == "host":
+			row[i] = requestHost(message)
+		case column == "labels":
+			labels, _ := record["labels"].([]interface{})
+			names := make([]string, 0, len(labels))
+			for _, label := range labels {
+				if l, ok := label.(map[string]interface{}); ok {
+					names = append(names, fmt.Sprint(l["name"]))
+				}
+			}
+			row[i] = strings.Join(names, "|")
+		case strings.HasPrefix(column, "header:"):
+			name := strings.TrimPrefix(column, "header:")
+			request, _ := record["httpRequest"].(map[string]interface{})
+			headers, _ := request["headers"].([]interface{})
+			var values []string
+			for _, header := range headers {
+				if h, ok := header.(map[string]interface{}); ok && strings.EqualFold(fmt.Sprint(h["name"]), name) {
+					values = append(values, fmt.Sprint(h["value"]))
+				}
+			}
+			if len(values) > 0 && !joinRepeated {
+				values = values[:1]
+			}
+			row[i] = strings.Join(values, "|")
+		default:
+			path := column
+			if alias, ok := csvColumnAliases[column]; ok {
+				path = alias
+			}
+			var value interface{} = record
+			for _, key := range strings.Split(path, ".") {
+				object, ok := value.(map[string]interface{})
+				if !ok {
+					value = nil
+					break
+				}
+				value = object[key]
+			}
+			row[i] = csvCell(value)
+		}
 	}
-	defer file.Close()
+	return row, nil
+}
 
-	// Prepare output writer
-	var output *os.File
-	if *outputFile == "" {
-		output = os.Stdout
-	} else {
-		output, err = os.Create(*outputFile)
-		if err != nil {
-			fmt.Fprintf(os.Stderr, "Error creating output file: %v\n", err)
-			os.Exit(1)
+// csvCell formats a JSON value as a CSV cell
+func csvCell(value interface{}) string {
+	switch v := value.(type) {
+	case nil:
+		return ""
+	case string:
+		return v
+	case json.Number:
+		return v.String()
+	case bool:
+		return strconv.FormatBool(v)
+	case []interface{}:
+		cells := make([]string, 0, len(v))
+		for _, item := range v {
+			switch item.(type) {
+			case map[string]interface{}, []interface{}:
+				data, _ := json.Marshal(v)
+				return string(data)
+			}
+			cells = append(cells, csvCell(item))
 		}
-		defer output.Close()
+		return strings.Join(cells, "|")
 	}
+	data, _ := json.Marshal(value)
+	return string(data)
+}
 
-	// Read entire file content
-	fileBytes, err := io.ReadAll(file)
+// decompressed returns a reader of the gzip-decompressed input if it starts with the
+// gzip magic number, and of the input as it is otherwise
+func decompressed(r *bufio.Reader, bufferSize int) (*bufio.Reader, error) {
+	magic, err := r.Peek(2)
+	if err != nil || magic[0] != 0x1f || magic[1] != 0x8b {
+		return r, nil // Too short to be gzip, or plain
+	}
+	gz, err := gzip.NewReader(r)
 	if err != nil {
-		fmt.Fprintf(os.Stderr, "Error reading file: %v\n", err)
-		os.Exit(1)
+		return nil, err
 	}
+	return bufio.NewReaderSize(gz, bufferSize), nil
+}
 
-	// Track record counts
-	processedRecords := 0
-	validRecords := 0
-	invalidRecords := 0
-	skippedRecords := 0
-
-	// Preprocess the file content to ensure proper JSON formatting
-	fileContent := string(fileBytes)
-	
-	if *debugMode {
-		fmt.Fprintf(os.Stderr, "File size: %d bytes\n", len(fileContent))
-	}
-	
-	// Split the file by JSON objects - this looks for standalone JSON objects 
-	// that each start with '{' and end with '}'
-	objectStarts := []int{}
-	objectEnds := []int{}
+// scanObjects calls fn with every standalone JSON object of the input - starting
+// with '{' and ending with the matching '}', wherever they are - as soon as it is
+// complete, and returns the number of bytes read. The slice passed to fn is only
+// valid during the call.
+func scanObjects(r io.ByteReader, fn func(object []byte)) (int64, error) {
+	var object []byte
+	var size int64
 	braceLevel := 0
 	inString := false
 	escapeNext := false
-	
-	for i, c := range fileContent {
+	for {
+		c, err := r.ReadByte()
+		if err == io.EOF {
+			return size, nil
+		}
+		if err != nil {
+			return size, err
+		}
+		size++
+		if braceLevel > 0 {
+			object = append(object, c)
+		}
 		if escapeNext {
 			escapeNext = false
 			continue
 		}
-		
 		if c == '\\' && inString {
 			escapeNext = true
 			continue
 		}
-		
-		if c == '"' && !escapeNext {
+		if c == '"' {
 			inString = !inString
 			continue
 		}
-		
-		if !inString {
-			if c == '{' {
-				if braceLevel == 0 {
-					objectStarts = append(objectStarts, i)
-				}
-				braceLevel++
-			} else if c == '}' {
-				braceLevel--
-				if braceLevel == 0 {
-					objectEnds = append(objectEnds, i)
-				}
+		if inString {
+			continue
+		}
+		if c == '{' {
+			if braceLevel == 0 {
+				object = append(object[:0], c)
+			}
+			braceLevel++
+		} else if c == '}' && braceLevel > 0 {
+			braceLevel--
+			if braceLevel == 0 {
+				fn(object)
 			}
 		}
 	}
+}
+
+// isWAFRecord reports whether a JSON object is a bare WAF record rather than a
+// CloudWatch entry
+func isWAFRecord(object string) bool {
+	var record struct {
+		HTTPRequest json.RawMessage `json:"httpRequest"`
+	}
+	return json.Unmarshal([]byte(object), &record) == nil && record.HTTPRequest != nil
+}
+
+// parseCounts tracks the record counts of the processing summary
+type parseCounts struct {
+	objects   int
+	processed int
+	valid     int
+	invalid   int
+	skipped   int
+	filtered  int
+}
+
+// add adds the counts of another input
+func (c *parseCounts) add(o parseCounts) {
+	c.objects += o.objects
+	c.processed += o.processed
+	c.valid += o.valid
+	c.invalid += o.invalid
+	c.skipped += o.skipped
+	c.filtered += o.filtered
+}
+
+// extractor turns the JSON objects of an input into WAF records
+type extractor struct {
+	validate bool
+	debug    bool
+	hosts    []string
+}
+
+// extract returns the WAF record of a JSON object, unwrapped from its CloudWatch
+// entry, and false if the object is skipped, invalid or for another host
+func (ex *extractor) extract(jsonObject string, counts *parseCounts) (string, bool) {
+	counts.objects++
+	
+	// Parse the CloudWatch log entry
+	var logEntry CloudWatchLogEntry
+	decoder := json.NewDecoder(bytes.NewReader([]byte(jsonObject)))
+	if err := decoder.Decode(&logEntry); err != nil {
+		if ex.debug {
+			fmt.Fprintf(os.Stderr, "Error parsing log entry: %v\n", err)
+			fmt.Fprintf(os.Stderr, "JSON object: %s\n", jsonObject[:min(100, len(jsonObject))])
+		}
+		counts.invalid++
+		return "", false
+	}
+	
+	counts.processed++
 	
-	if *debugMode {
-		fmt.Fprintf(os.Stderr, "Found %d potential JSON objects\n", len(objectStarts))
+	// Records that are not wrapped in a CloudWatch entry, e.g. from zcat of S3 log
+	// files, are processed as they are
+	if logEntry.Message == "" && isWAFRecord(jsonObject) {
+		var compact bytes.Buffer
+		if err := json.Compact(&compact, []byte(jsonObject)); err == nil {
+			logEntry.Message = compact.String()
+		}
 	}
 	
-	// Now extract and process each object
-	for i := 0; i < len(objectStarts) && i < len(objectEnds); i++ {
-		start := objectStarts[i]
-		end := objectEnds[i]
-		
-		if end <= start {
-			if *debugMode {
-				fmt.Fprintf(os.Stderr, "Skipping invalid object range: start=%d, end=%d\n", start, end)
-			}
-			skippedRecords++
-			continue
+	if logEntry.Message == "" {
+		if ex.debug {
+			fmt.Fprintf(os.Stderr, "Empty @message field in record %d\n", counts.objects)
 		}
-		
-		jsonObject := fileContent[start:end+1]
-		jsonObject = strings.TrimSpace(jsonObject)
-		
-		// Skip if not a valid JSON object
-		if !strings.HasPrefix(jsonObject, "{") || !strings.HasSuffix(jsonObject, "}") {
-			if *debugMode {
-				fmt.Fprintf(os.Stderr, "Skipping non-JSON object: %s\n", jsonObject[:min(50, len(jsonObject))])
+		counts.skipped++
+		return "", false
+	}
+	
+	// Optionally validate the inner JSON
+	if ex.validate {
+		var innerJSON interface{}
+		if err := json.Unmarshal([]byte(logEntry.Message), &innerJSON); err != nil {
+			if ex.debug {
+				fmt.Fprintf(os.Stderr, "Invalid inner JSON: %v\n", err)
+				fmt.Fprintf(os.Stderr, "First 100 chars: %s\n", 
+					logEntry.Message[:min(100, len(logEntry.Message))])
 			}
-			skippedRecords++
-			continue
+			counts.invalid++
+			return "", false
 		}
-		
-		// Parse the CloudWatch log entry
-		var logEntry CloudWatchLogEntry
-		decoder := json.NewDecoder(bytes.NewReader([]byte(jsonObject)))
-		if err := decoder.Decode(&logEntry); err != nil {
-			if *debugMode {
-				fmt.Fprintf(os.Stderr, "Error parsing log entry: %v\n", err)
-				fmt.Fprintf(os.Stderr, "JSON object: %s\n", jsonObject[:min(100, len(jsonObject))])
+	}
+	
+	counts.valid++
+	
+	// Drop records for other hosts
+	if len(ex.hosts) > 0 && !matchesHosts(ex.hosts, requestHost(logEntry.Message)) {
+		counts.filtered++
+		return "", false
+	}
+	return logEntry.Message, true
+}
+
+// parseInput streams the WAF records of an input file, or stdin for -, to fn, and
+// returns the number of bytes read. Each standalone JSON object is processed as soon
+// as it is read, so input of any size streams through.
+func parseInput(path string, ex *extractor, bufferSize int, counts *parseCounts, fn func(message string)) (int64, error) {
+	var input io.Reader = os.Stdin
+	if path != "-" {
+		file, err := os.Open(path)
+		if err != nil {
+			return 0, fmt.Errorf("error opening input file: %w", err)
+		}
+		defer file.Close()
+		input = file
+	}
+	reader, err := decompressed(bufio.NewReaderSize(input, bufferSize), bufferSize)
+	if err != nil {
+		return 0, fmt.Errorf("error reading gzip input %s: %w", path, err)
+	}
+	return scanObjects(reader, func(object []byte) {
+		if message, ok := ex.extract(strings.TrimSpace(string(object)), counts); ok {
+			fn(message)
+		}
+	})
+}
+
+// mergeRecord is a record of one input of -merge
+type mergeRecord struct {
+	timestamp int64
+	input     int
+	seq       int
+	message   string
+}
+
+// recordHeap orders records by timestamp, and records with the same timestamp by
+// input and position, so the merge is stable
+type recordHeap []mergeRecord
+
+func (h recordHeap) Len() int { return len(h) }
+func (h recordHeap) Less(i, j int) bool {
+	if h[i].timestamp != h[j].timestamp {
+		return h[i].timestamp < h[j].timestamp
+	}
+	if h[i].input != h[j].input {
+		return h[i].input < h[j].input
+	}
+	return h[i].seq < h[j].seq
+}
+func (h recordHeap) Swap(i, j int)       { h[i], h[j] = h[j], h[i] }
+func (h *recordHeap) Push(x interface{}) { *h = append(*h, x.(mergeRecord)) }
+func (h *recordHeap) Pop() interface{} {
+	old := *h
+	record := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return record
+}
+
+// mergeSummary summarizes a merge
+type mergeSummary struct {
+	inputs     int
+	outOfOrder int // Records written after a newer one
+}
+
+// recordTimestamp returns the timestamp of a WAF record in epoch milliseconds, or 0
+func recordTimestamp(message string) int64 {
+	var record struct {
+		Timestamp int64 `json:"timestamp"`
+	}
+	json.Unmarshal([]byte(message), &record)
+	return record.Timestamp
+}
+
+// mergeInputs k-way merges the records of the inputs into one stream ordered by
+// timestamp, passed to fn. Every input is read concurrently and streamed through a
+// reorder buffer of up to bufferSize records, so records out of order within an
+// input by less than the buffer are still written in order.
+func mergeInputs(inputs []string, ex *extractor, bufferSize int, counts *parseCounts, fn func(message string)) (*mergeSummary, error) {
+	channels := make([]chan mergeRecord, len(inputs))
+	inputCounts := make([]parseCounts, len(inputs))
+	errs := make([]error, len(inputs))
+	for i, path := range inputs {
+		channels[i] = make(chan mergeRecord, 256)
+		go func(i int, path string) {
+			defer close(channels[i])
+			seq := 0
+			_, errs[i] = parseInput(path, ex, 64<<10, &inputCounts[i], func(message string) {
+				channels[i] <- mergeRecord{timestamp: recordTimestamp(message), input: i, seq: seq, message: message}
+				seq++
+			})
+		}(i, path)
+	}
+
+	// The heap holds up to bufferSize records of each input; writing one record of an
+	// input reads the input's next record
+	h := &recordHeap{}
+	for i := range channels {
+		for n := 0; n < bufferSize; n++ {
+			record, ok := <-channels[i]
+			if !ok {
+				break
 			}
-			invalidRecords++
-			continue
+			heap.Push(h, record)
 		}
-		
-		processedRecords++
-		
-		// Extract and output the inner message content
-		if logEntry.Message != "" {
-			// Optionally validate the inner JSON
-			if *validateJSON {
-				var innerJSON interface{}
-				if err := json.Unmarshal([]byte(logEntry.Message), &innerJSON); err != nil {
-					if *debugMode {
-						fmt.Fprintf(os.Stderr, "Invalid inner JSON: %v\n", err)
-						fmt.Fprintf(os.Stderr, "First 100 chars: %s\n", 
-							logEntry.Message[:min(100, len(logEntry.Message))])
-					}
-					invalidRecords++
-					continue
-				}
+	}
+	summary := &mergeSummary{inputs: len(inputs)}
+	var last int64
+	for h.Len() > 0 {
+		record := heap.Pop(h).(mergeRecord)
+		if record.timestamp < last {
+			summary.outOfOrder++
+		} else {
+			last = record.timestamp
+		}
+		fn(record.message)
+		if next, ok := <-channels[record.input]; ok {
+			heap.Push(h, next)
+		}
+	}
+
+	for i, err := range errs {
+		if err != nil {
+			return summary, fmt.Errorf("%s: %w", inputs[i], err)
+		}
+		counts.add(inputCounts[i])
+	}
+	return summary, nil
+}
+
+// min returns the smaller of two integers
+func min(a, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+func main() {
+	// Define command line flags
+	inputFile := flag.String("input", "", "Input file path, gzipped or not; - reads stdin (required)")
+	outputFile := flag.String("output", "", "Output file path; - or empty writes to stdout")
+	prettyPrint := flag.Bool("pretty", false, "Pretty-print JSON output")
+	debugMode := flag.Bool("debug", false, "Enable debug output")
+	validateJSON := flag.Bool("validate", true, "Validate inner JSON before processing (disable with -validate=false)")
+	hostFilter := flag.String("host", "", "Only output records for these hosts (comma-separated; *.example.com matches subdomains)")
+	format := flag.String("format", "json", "Output format: json (one record per line) or csv")
+	columnList := flag.String("columns", defaultCSVColumns, "Comma-separated CSV columns: field paths (e.g. httpRequest.clientIp), aliases, host, labels or header:<name>")
+	csvHeader := flag.Bool("csv-header", true, "Write a header row with the column names (disable with -csv-header=false)")
+	joinRepeated := flag.Bool("join-repeated", false, "Pipe-join all values of a repeated header into one CSV cell instead of keeping the first")
+	merge := flag.Bool("merge", false, "Merge the records of all input files given after the flags into one stream ordered by timestamp")
+	mergeBuffer := flag.Int("merge-buffer", 1000, "Records of each input held to reorder records that are out of order within it")
+	flag.Parse()
+
+	if *format != "json" && *format != "csv" {
+		fmt.Fprintf(os.Stderr, "Error: unknown format %q (want json or csv)\n", *format)
+		os.Exit(1)
+	}
+	if *format == "csv" && *prettyPrint {
+		fmt.Fprintln(os.Stderr, "Error: -pretty only applies to -format json")
+		os.Exit(1)
+	}
+	var columns []string
+	for _, column := range strings.Split(*columnList, ",") {
+		if column = strings.TrimSpace(column); column != "" {
+			columns = append(columns, column)
+		}
+	}
+	if *format == "csv" && len(columns) == 0 {
+		fmt.Fprintln(os.Stderr, "Error: -columns lists no columns")
+		os.Exit(1)
+	}
+
+	var hosts []string
+	if *hostFilter != "" {
+		hosts = strings.Split(*hostFilter, ",")
+	}
+
+	// Validate required flags
+	inputs := flag.Args()
+	if *inputFile != "" {
+		inputs = append([]string{*inputFile}, inputs...)
+	}
+	if len(inputs) == 0 || (!*merge && len(inputs) > 1) {
+		fmt.Fprintln(os.Stderr, "Error: exactly one input file is required (use - for stdin), or any number with -merge")
+		flag.Usage()
+		os.Exit(1)
+	}
+	if *mergeBuffer < 1 {
+		fmt.Fprintln(os.Stderr, "Error: -merge-buffer must be at least 1")
+		os.Exit(1)
+	}
+
+	// Prepare output writer; only records are written to it, diagnostics go to stderr
+	var output *os.File
+	var err error
+	if *outputFile == "" || *outputFile == "-" {
+		output = os.Stdout
+	} else {
+		output, err = os.Create(*outputFile)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error creating output file: %v\n", err)
+			os.Exit(1)
+		}
+		defer output.Close()
+	}
+	writer := bufio.NewWriter(output)
+
+	// CSV quotes cells holding commas, quotes or newlines, as header values may
+	var csvWriter *csv.Writer
+	if *format == "csv" {
+		csvWriter = csv.NewWriter(writer)
+		if *csvHeader {
+			csvWriter.Write(columns)
+		}
+	}
+
+	// Output based on format and pretty-print option
+	emit := func(message string) {
+		if csvWriter != nil {
+			row, err := csvRow(message, columns, *joinRepeated)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Error parsing inner JSON: %v\n", err)
+				return
+			}
+			csvWriter.Write(row)
+		} else if *prettyPrint {
+			var innerJSON interface{}
+			if err := json.Unmarshal([]byte(message), &innerJSON); err != nil {
+				// This should never happen if validation is enabled
+				fmt.Fprintf(os.Stderr, "Error parsing inner JSON: %v\n", err)
+				return
 			}
 			
-			validRecords++
-			
-			// Output based on pretty-print option
-			if *prettyPrint {
-				var innerJSON interface{}
-				if err := json.Unmarshal([]byte(logEntry.Message), &innerJSON); err != nil {
-					// This should never happen if validation is enabled
-					fmt.Fprintf(os.Stderr, "Error parsing inner JSON: %v\n", err)
-					continue
-				}
-				
-				prettyBytes, err := json.MarshalIndent(innerJSON, "", "  ")
-				if err != nil {
-					fmt.Fprintf(os.Stderr, "Error formatting JSON: %v\n", err)
-					continue
-				}
-				
-				fmt.Fprintln(output, string(prettyBytes))
-			} else {
-				// Just output the inner message as-is
-				fmt.Fprintln(output, logEntry.Message)
+			prettyBytes, err := json.MarshalIndent(innerJSON, "", "  ")
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Error formatting JSON: %v\n", err)
+				return
 			}
+			
+			fmt.Fprintln(writer, string(prettyBytes))
 		} else {
-			if *debugMode {
-				fmt.Fprintf(os.Stderr, "Empty @message field in record %d\n", i+1)
-			}
-			skippedRecords++
+			// Just output the inner message as-is
+			fmt.Fprintln(writer, message)
 		}
 	}
 
+	ex := &extractor{validate: *validateJSON, debug: *debugMode, hosts: hosts}
+	var counts parseCounts
+	var merged *mergeSummary
+	if *merge {
+		merged, err = mergeInputs(inputs, ex, *mergeBuffer, &counts, emit)
+	} else {
+		var inputSize int64
+		inputSize, err = parseInput(inputs[0], ex, 1<<20, &counts, emit)
+		if *debugMode {
+			fmt.Fprintf(os.Stderr, "Input size: %d bytes\n", inputSize)
+		}
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error reading input: %v\n", err)
+		os.Exit(1)
+	}
+
+	if csvWriter != nil {
+		csvWriter.Flush()
+		if err := csvWriter.Error(); err != nil {
+			fmt.Fprintf(os.Stderr, "Error writing CSV: %v\n", err)
+			os.Exit(1)
+		}
+	}
+	if err := writer.Flush(); err != nil {
+		fmt.Fprintf(os.Stderr, "Error writing output: %v\n", err)
+		os.Exit(1)
+	}
+
 	// Print summary to stderr
 	fmt.Fprintf(os.Stderr, "Processing summary:\n")
-	fmt.Fprintf(os.Stderr, "- Total JSON objects found: %d\n", len(objectStarts))
-	fmt.Fprintf(os.Stderr, "- Successfully processed: %d records\n", processedRecords)
-	fmt.Fprintf(os.Stderr, "- Valid @message fields: %d\n", validRecords)
-	fmt.Fprintf(os.Stderr, "- Invalid @message fields: %d\n", invalidRecords)
-	fmt.Fprintf(os.Stderr, "- Skipped records: %d\n", skippedRecords)
-}
\ No newline at end of file
+	if merged != nil {
+		fmt.Fprintf(os.Stderr, "- Merged inputs: %d\n", merged.inputs)
+	}
+	fmt.Fprintf(os.Stderr, "- Total JSON objects found: %d\n", counts.objects)
+	fmt.Fprintf(os.Stderr, "- Successfully processed: %d records\n", counts.processed)
+	fmt.Fprintf(os.Stderr, "- Valid @message fields: %d\n", counts.valid)
+	fmt.Fprintf(os.Stderr, "- Invalid @message fields: %d\n", counts.invalid)
+	fmt.Fprintf(os.Stderr, "- Skipped records: %d\n", counts.skipped)
+	if len(hosts) > 0 {
+		fmt.Fprintf(os.Stderr, "- Filtered out (other hosts): %d\n", counts.filtered)
+	}
+	if merged != nil && merged.outOfOrder > 0 {
+		fmt.Fprintf(os.Stderr, "- Out of order: %d records were older than a record already written; raise -merge-buffer\n", merged.outOfOrder)
+	}
+}